@@ -25,6 +25,7 @@ require (
 
 require (
 	go.mau.fi/whatsmeow v0.0.0-20251127132918-b9ac3d51d746
+	golang.org/x/time v0.5.0
 	google.golang.org/protobuf v1.36.10
 )
 
@@ -71,7 +72,6 @@ require (
 	golang.org/x/sync v0.18.0 // indirect
 	golang.org/x/sys v0.38.0 // indirect
 	golang.org/x/text v0.31.0 // indirect
-	golang.org/x/time v0.5.0 // indirect
 	google.golang.org/appengine v1.6.8 // indirect
 	google.golang.org/genproto/googleapis/api v0.0.0-20240617180043-68d350f18fd4 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20240617180043-68d350f18fd4 // indirect
@@ -84,6 +84,8 @@ func Register(c echo.Context) error {
 		// Log error but don't fail registration - tenant can be created later
 		// In production, you might want to handle this differently
 		c.Logger().Warnf("Failed to auto-create tenant for user %s: %v", user.ID, err)
+	} else if err := addTenantMember(tenantID, user.ID, models.RoleOwner, nil); err != nil {
+		c.Logger().Warnf("Failed to add owner membership for user %s: %v", user.ID, err)
 	}
 
 	// Set cookies for frontend
@@ -168,9 +170,10 @@ func Login(c echo.Context) error {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Gagal membuat token"})
 	}
 
-	// Check if user has a tenant, create one if not
+	// Check if user belongs to a tenant, create one if not
 	var tenantID string
-	tenantCheckQuery := `SELECT id FROM tenants WHERE user_id = $1 AND is_active = true LIMIT 1`
+	tenantCheckQuery := `SELECT tm.tenant_id FROM tenant_members tm JOIN tenants t ON t.id = tm.tenant_id
+	                     WHERE tm.user_id = $1 AND t.is_active = true LIMIT 1`
 	err = db.DB.QueryRow(tenantCheckQuery, user.ID).Scan(&tenantID)
 	if err == sql.ErrNoRows {
 		// User doesn't have a tenant, create one
@@ -182,6 +185,9 @@ func Login(c echo.Context) error {
 			// Log error but don't fail login
 			c.Logger().Warnf("Failed to auto-create tenant for user %s on login: %v", user.ID, err)
 		} else {
+			if err := addTenantMember(tenantID, user.ID, models.RoleOwner, nil); err != nil {
+				c.Logger().Warnf("Failed to add owner membership for user %s: %v", user.ID, err)
+			}
 			c.Logger().Infof("Auto-created tenant %s for user %s on login", tenantID, user.ID)
 		}
 	} else if err != nil {
@@ -3,39 +3,131 @@ package handlers
 import (
 	"context"
 	"database/sql"
-	"fmt"
+	"encoding/json"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"gowa-backend/db"
+	broadcastsvc "gowa-backend/services/broadcast"
+	"gowa-backend/services/recurrence"
+	"gowa-backend/services/segment"
 
 	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
 )
 
 // Broadcast represents a broadcast message
 type Broadcast struct {
-	ID              string     `json:"id" db:"id"`
-	TenantID        string     `json:"tenant_id" db:"tenant_id"`
-	Name            string     `json:"name" db:"name"`
-	MessageContent  string     `json:"message_content" db:"message_content"`
-	TemplateID      *string    `json:"template_id" db:"template_id"`
-	Status          string     `json:"status" db:"status"`
-	ScheduledAt     *time.Time `json:"scheduled_at" db:"scheduled_at"`
-	StartedAt       *time.Time `json:"started_at" db:"started_at"`
-	CompletedAt     *time.Time `json:"completed_at" db:"completed_at"`
-	TotalRecipients int        `json:"total_recipients" db:"total_recipients"`
-	SentCount       int        `json:"sent_count" db:"sent_count"`
-	DeliveredCount  int        `json:"delivered_count" db:"delivered_count"`
-	FailedCount     int        `json:"failed_count" db:"failed_count"`
-	CreatedAt       time.Time  `json:"created_at" db:"created_at"`
-	UpdatedAt       time.Time  `json:"updated_at" db:"updated_at"`
+	ID                    string          `json:"id" db:"id"`
+	TenantID              string          `json:"tenant_id" db:"tenant_id"`
+	Name                  string          `json:"name" db:"name"`
+	MessageContent        string          `json:"message_content" db:"message_content"`
+	TemplateID            *string         `json:"template_id" db:"template_id"`
+	Status                string          `json:"status" db:"status"`
+	ScheduledAt           *time.Time      `json:"scheduled_at" db:"scheduled_at"`
+	StartedAt             *time.Time      `json:"started_at" db:"started_at"`
+	CompletedAt           *time.Time      `json:"completed_at" db:"completed_at"`
+	TotalRecipients       int             `json:"total_recipients" db:"total_recipients"`
+	SentCount             int             `json:"sent_count" db:"sent_count"`
+	DeliveredCount        int             `json:"delivered_count" db:"delivered_count"`
+	FailedCount           int             `json:"failed_count" db:"failed_count"`
+	SegmentID             *string         `json:"segment_id" db:"segment_id"`
+	IsRecurring           bool            `json:"is_recurring" db:"is_recurring"`
+	RecurrenceType        *string         `json:"recurrence_type" db:"recurrence_type"`
+	RecurrenceInterval    *int            `json:"recurrence_interval" db:"recurrence_interval"`
+	RecurrenceDays        json.RawMessage `json:"recurrence_days" db:"recurrence_days"`
+	RecurrenceTime        *string         `json:"recurrence_time" db:"recurrence_time"`
+	RecurrenceEndDate     *time.Time      `json:"recurrence_end_date" db:"recurrence_end_date"`
+	RecurrenceCount       *int            `json:"recurrence_count" db:"recurrence_count"`
+	RecurrenceMonthDay    *int            `json:"recurrence_month_day" db:"recurrence_month_day"`
+	RecurrenceWeekOrdinal *int            `json:"recurrence_week_ordinal" db:"recurrence_week_ordinal"`
+	RecurrenceWeekday     *string         `json:"recurrence_weekday" db:"recurrence_weekday"`
+	RecurrenceCron        *string         `json:"recurrence_cron" db:"recurrence_cron"`
+	LastExecutedAt        *time.Time      `json:"last_executed_at" db:"last_executed_at"`
+	ExecutionCount        int             `json:"execution_count" db:"execution_count"`
+	ABTestPercent         int             `json:"ab_test_percent" db:"ab_test_percent"`
+	ABDecideAfterHours    int             `json:"ab_decide_after_hours" db:"ab_decide_after_hours"`
+	ABWinnerMetric        string          `json:"ab_winner_metric" db:"ab_winner_metric"`
+	ABWinnerVariantID     *string         `json:"ab_winner_variant_id" db:"ab_winner_variant_id"`
+	ABDecidedAt           *time.Time      `json:"ab_decided_at" db:"ab_decided_at"`
+	SendWindowStart       *string         `json:"send_window_start" db:"send_window_start"`
+	SendWindowEnd         *string         `json:"send_window_end" db:"send_window_end"`
+	PausedAt              *time.Time      `json:"paused_at" db:"paused_at"`
+	PauseReason           *string         `json:"pause_reason" db:"pause_reason"`
+	MediaURL              *string         `json:"media_url" db:"media_url"`
+	MediaType             *string         `json:"media_type" db:"media_type"`
+	MediaFileName         *string         `json:"media_file_name" db:"media_file_name"`
+	CurrentRunID          *string         `json:"current_run_id" db:"current_run_id"`
+	CreatedAt             time.Time       `json:"created_at" db:"created_at"`
+	UpdatedAt             time.Time       `json:"updated_at" db:"updated_at"`
+}
+
+// broadcastColumns is the select list for Broadcast
+const broadcastColumns = `
+	id, tenant_id, name, message_content, template_id, status,
+	scheduled_at, started_at, completed_at, total_recipients,
+	sent_count, delivered_count, failed_count, segment_id,
+	COALESCE(is_recurring, false) as is_recurring, recurrence_type, recurrence_interval,
+	recurrence_days, to_char(recurrence_time, 'HH24:MI') as recurrence_time,
+	recurrence_end_date, recurrence_count, recurrence_month_day, recurrence_week_ordinal,
+	recurrence_weekday, recurrence_cron, last_executed_at,
+	COALESCE(execution_count, 0) as execution_count,
+	ab_test_percent, ab_decide_after_hours, ab_winner_metric, ab_winner_variant_id, ab_decided_at,
+	to_char(send_window_start, 'HH24:MI') as send_window_start, to_char(send_window_end, 'HH24:MI') as send_window_end,
+	paused_at, pause_reason, media_url, media_type, media_file_name, current_run_id,
+	created_at, updated_at`
+
+// recurrenceRule is the broadcast's recurrence rule
+func (b *Broadcast) recurrenceRule() recurrence.Rule {
+	rule := recurrence.Rule{}
+	if b.RecurrenceType != nil {
+		rule.Type = *b.RecurrenceType
+	}
+	if b.RecurrenceInterval != nil {
+		rule.Interval = *b.RecurrenceInterval
+	}
+	if b.RecurrenceTime != nil {
+		rule.Time = *b.RecurrenceTime
+	}
+	if b.RecurrenceMonthDay != nil {
+		rule.MonthDay = *b.RecurrenceMonthDay
+	}
+	if b.RecurrenceWeekOrdinal != nil {
+		rule.WeekOrdinal = *b.RecurrenceWeekOrdinal
+	}
+	if b.RecurrenceWeekday != nil {
+		rule.Weekday = *b.RecurrenceWeekday
+	}
+	if b.RecurrenceCron != nil {
+		rule.Cron = *b.RecurrenceCron
+	}
+	json.Unmarshal(b.RecurrenceDays, &rule.Days)
+	return rule
+}
+
+// nextRuns lists up to n upcoming runs of a recurring broadcast
+func nextRuns(ctx context.Context, b *Broadcast, n int) ([]time.Time, error) {
+	if !b.IsRecurring || b.ScheduledAt == nil || (b.Status != "scheduled" && b.Status != "active") {
+		return []time.Time{}, nil
+	}
+	loc, err := recurrence.TenantLocation(ctx, db.DB, b.TenantID)
+	if err != nil {
+		return nil, err
+	}
+	remaining := -1
+	if b.RecurrenceCount != nil {
+		remaining = max(*b.RecurrenceCount-b.ExecutionCount, 0)
+	}
+	return b.recurrenceRule().Runs(*b.ScheduledAt, loc, n, b.RecurrenceEndDate, remaining)
 }
 
 // BroadcastRecipient represents a recipient in a broadcast
 type BroadcastRecipient struct {
 	ID           string     `json:"id" db:"id"`
 	BroadcastID  string     `json:"broadcast_id" db:"broadcast_id"`
+	RunID        *string    `json:"run_id" db:"run_id"`
 	CustomerID   string     `json:"customer_id" db:"customer_id"`
 	CustomerJID  string     `json:"customer_jid" db:"customer_jid"`
 	CustomerName string     `json:"customer_name" db:"customer_name"`
@@ -43,10 +135,29 @@ type BroadcastRecipient struct {
 	MessageID    *string    `json:"message_id" db:"message_id"`
 	SentAt       *time.Time `json:"sent_at" db:"sent_at"`
 	DeliveredAt  *time.Time `json:"delivered_at" db:"delivered_at"`
+	ReadAt       *time.Time `json:"read_at" db:"read_at"`
+	VariantID    *string    `json:"variant_id" db:"variant_id"`
 	ErrorMessage *string    `json:"error_message" db:"error_message"`
-	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
+	ErrorCode    *string    `json:"error_code" db:"error_code"`
+	Attempts     int        `json:"attempts" db:"attempts"`
+	NextRetryAt  *time.Time `json:"next_retry_at" db:"next_retry_at"`
+	// First reply attributed to this send and the intents that followed
+	RepliedAt     *time.Time `json:"replied_at" db:"replied_at"`
+	ReplyIntent   *string    `json:"reply_intent" db:"reply_intent"`
+	OrderIntentAt *time.Time `json:"order_intent_at" db:"order_intent_at"`
+	CreatedAt     time.Time  `json:"created_at" db:"created_at"`
 }
 
+// recipientSelect selects BroadcastRecipient; callers add the WHERE clause
+const recipientSelect = `
+	SELECT br.id, br.broadcast_id, br.run_id, br.customer_id, br.customer_jid,
+	       COALESCE(ci.customer_name, ci.customer_phone, br.customer_jid) as customer_name,
+	       br.status, br.message_id, br.sent_at, br.delivered_at, br.read_at, br.variant_id,
+	       br.error_message, br.error_code, br.attempts, br.next_retry_at,
+	       br.replied_at, br.reply_intent, br.order_intent_at, br.created_at
+	FROM broadcast_recipients br
+	LEFT JOIN customer_insights ci ON ci.id = br.customer_id`
+
 // GetBroadcasts returns all broadcasts for a tenant
 func GetBroadcasts(c echo.Context) error {
 	tenantID := getTenantIDFromContext(c)
@@ -67,9 +178,7 @@ func GetBroadcasts(c echo.Context) error {
 
 	if status != "" && status != "all" {
 		query = `
-			SELECT id, tenant_id, name, message_content, template_id, status,
-			       scheduled_at, started_at, completed_at, total_recipients,
-			       sent_count, delivered_count, failed_count, created_at, updated_at
+			SELECT ` + broadcastColumns + `
 			FROM broadcasts
 			WHERE tenant_id = $1 AND status = $2
 			ORDER BY created_at DESC
@@ -77,9 +186,7 @@ func GetBroadcasts(c echo.Context) error {
 		args = []interface{}{tenantID, status}
 	} else {
 		query = `
-			SELECT id, tenant_id, name, message_content, template_id, status,
-			       scheduled_at, started_at, completed_at, total_recipients,
-			       sent_count, delivered_count, failed_count, created_at, updated_at
+			SELECT ` + broadcastColumns + `
 			FROM broadcasts
 			WHERE tenant_id = $1
 			ORDER BY created_at DESC
@@ -112,9 +219,7 @@ func GetBroadcast(c echo.Context) error {
 
 	var broadcast Broadcast
 	query := `
-		SELECT id, tenant_id, name, message_content, template_id, status,
-		       scheduled_at, started_at, completed_at, total_recipients,
-		       sent_count, delivered_count, failed_count, created_at, updated_at
+		SELECT ` + broadcastColumns + `
 		FROM broadcasts
 		WHERE id = $1 AND tenant_id = $2
 	`
@@ -123,28 +228,277 @@ func GetBroadcast(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusNotFound, "Broadcast not found")
 	}
 
-	// Get recipients
+	// Get the recipients of the current run
 	var recipients []BroadcastRecipient
-	recipientQuery := `
-		SELECT br.id, br.broadcast_id, br.customer_id, br.customer_jid, 
-		       COALESCE(ci.customer_name, ci.customer_phone, br.customer_jid) as customer_name,
-		       br.status, br.message_id, br.sent_at, br.delivered_at, br.error_message, br.created_at
-		FROM broadcast_recipients br
-		LEFT JOIN customer_insights ci ON ci.id = br.customer_id
-		WHERE br.broadcast_id = $1
+	if err := db.DB.Select(&recipients, recipientSelect+`
+		WHERE br.broadcast_id = $1 AND br.run_id IS NOT DISTINCT FROM $2
 		ORDER BY br.created_at ASC
-	`
+	`, broadcastID, broadcast.CurrentRunID); err != nil {
+		recipients = []BroadcastRecipient{}
+	}
+
+	// Variants with how each is performing
+	svc := broadcastsvc.NewService(db.DB)
+	variants, err := svc.Results(c.Request().Context(), broadcastID, broadcastsvc.ReplyWindow)
+	if err != nil {
+		variants = []broadcastsvc.VariantResult{}
+	}
+
+	failures, err := svc.FailureBreakdown(c.Request().Context(), tenantID, broadcastID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get failure breakdown")
+	}
+
+	runs, err := nextRuns(c.Request().Context(), &broadcast, 5)
+	if err != nil {
+		runs = []time.Time{}
+	}
+
+	// Replies attributed to the broadcast, latest first
+	attribution, err := svc.Attribution(c.Request().Context(), broadcastID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get reply attribution")
+	}
+	replies, _, err := svc.Replies(c.Request().Context(), tenantID, broadcastID, 50, 0)
+	if err != nil {
+		replies = []broadcastsvc.Reply{}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"broadcast":   broadcast,
+		"recipients":  recipients,
+		"variants":    variants,
+		"failures":    failures,
+		"next_runs":   runs,
+		"attribution": attribution,
+		"replies":     replies,
+	})
+}
+
+// GetBroadcastReplies lists the replies attributed to a broadcast, latest
+// first, with the message text, time to reply and detected intents
+// GET /api/broadcasts/:id/replies?page=&limit=
+func GetBroadcastReplies(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found. Please create a tenant first.")
+	}
+
+	broadcastID := c.Param("id")
+	var exists bool
+	db.DB.Get(&exists, `SELECT EXISTS(SELECT 1 FROM broadcasts WHERE id = $1 AND tenant_id = $2)`, broadcastID, tenantID)
+	if !exists {
+		return echo.NewHTTPError(http.StatusNotFound, "Broadcast not found")
+	}
 
-	if err := db.DB.Select(&recipients, recipientQuery, broadcastID); err != nil {
+	page, _ := strconv.Atoi(c.QueryParam("page"))
+	if page < 1 {
+		page = 1
+	}
+	limit, _ := strconv.Atoi(c.QueryParam("limit"))
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	replies, total, err := broadcastsvc.NewService(db.DB).Replies(c.Request().Context(), tenantID, broadcastID, limit, (page-1)*limit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get broadcast replies")
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"items":       replies,
+		"total":       total,
+		"page":        page,
+		"limit":       limit,
+		"total_pages": (total + limit - 1) / limit,
+	})
+}
+
+// GetBroadcastABResults returns per-variant delivery, read and reply rates.
+// Replies count when they arrive within window_hours of the send (default 72).
+// GET /api/broadcasts/:id/ab-results
+func GetBroadcastABResults(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found. Please create a tenant first.")
+	}
+
+	broadcastID := c.Param("id")
+
+	var broadcast Broadcast
+	query := `SELECT ` + broadcastColumns + ` FROM broadcasts WHERE id = $1 AND tenant_id = $2`
+	if err := db.DB.Get(&broadcast, query, broadcastID, tenantID); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Broadcast not found")
+	}
+
+	window, err := replyWindow(c)
+	if err != nil {
+		return err
+	}
+
+	results, err := broadcastsvc.NewService(db.DB).Results(c.Request().Context(), broadcastID, window)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get variant results")
+	}
+
+	var held int
+	db.DB.Get(&held, `SELECT COUNT(*) FROM broadcast_recipients WHERE broadcast_id = $1 AND status = 'held'`, broadcastID)
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"variants":          results,
+		"window_hours":      int(window.Hours()),
+		"test_percent":      broadcast.ABTestPercent,
+		"winner_metric":     broadcast.ABWinnerMetric,
+		"winner_variant_id": broadcast.ABWinnerVariantID,
+		"decided_at":        broadcast.ABDecidedAt,
+		"held_recipients":   held,
+	})
+}
+
+// PreviewRecurrence lists the next count (default 10) run times of a
+// recurrence rule in the tenant's timezone, from scheduled_at or, without
+// it, the first run after now
+// POST /api/broadcasts/recurrence/preview
+func PreviewRecurrence(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found. Please create a tenant first.")
+	}
+
+	var req struct {
+		recurrence.Rule
+		ScheduledAt       *time.Time `json:"scheduled_at"`
+		RecurrenceEndDate *time.Time `json:"recurrence_end_date"`
+		RecurrenceCount   *int       `json:"recurrence_count"`
+		Count             int        `json:"count"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	}
+	if req.Count == 0 {
+		req.Count = 10
+	}
+	if req.Count < 1 || req.Count > 50 {
+		return echo.NewHTTPError(http.StatusBadRequest, "count must be between 1 and 50")
+	}
+	if err := req.Rule.Validate(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	ctx := c.Request().Context()
+	loc, err := recurrence.TenantLocation(ctx, db.DB, tenantID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get tenant timezone")
+	}
+
+	first := time.Now()
+	if req.ScheduledAt != nil {
+		first = *req.ScheduledAt
+	} else if first, err = req.Rule.Next(first, loc); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	remaining := -1
+	if req.RecurrenceCount != nil {
+		remaining = max(*req.RecurrenceCount, 0)
+	}
+	runs, err := req.Rule.Runs(first, loc, req.Count, req.RecurrenceEndDate, remaining)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"timezone": loc.String(),
+		"runs":     runs,
+	})
+}
+
+// GetBroadcastRuns lists the runs of a broadcast, latest first, with their
+// delivery, read and reply rates. Replies count when they arrive within
+// window_hours of the send (default 72).
+// GET /api/broadcasts/:id/runs
+func GetBroadcastRuns(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found. Please create a tenant first.")
+	}
+
+	broadcastID := c.Param("id")
+	var exists bool
+	db.DB.Get(&exists, `SELECT EXISTS(SELECT 1 FROM broadcasts WHERE id = $1 AND tenant_id = $2)`, broadcastID, tenantID)
+	if !exists {
+		return echo.NewHTTPError(http.StatusNotFound, "Broadcast not found")
+	}
+
+	window, err := replyWindow(c)
+	if err != nil {
+		return err
+	}
+
+	runs, err := broadcastsvc.NewService(db.DB).Runs(c.Request().Context(), broadcastID, window)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get broadcast runs")
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"runs":         runs,
+		"window_hours": int(window.Hours()),
+	})
+}
+
+// GetBroadcastRun returns one run of a broadcast with its recipients
+// GET /api/broadcasts/:id/runs/:runId
+func GetBroadcastRun(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found. Please create a tenant first.")
+	}
+
+	broadcastID := c.Param("id")
+	var exists bool
+	db.DB.Get(&exists, `SELECT EXISTS(SELECT 1 FROM broadcasts WHERE id = $1 AND tenant_id = $2)`, broadcastID, tenantID)
+	if !exists {
+		return echo.NewHTTPError(http.StatusNotFound, "Broadcast not found")
+	}
+
+	window, err := replyWindow(c)
+	if err != nil {
+		return err
+	}
+
+	run, err := broadcastsvc.NewService(db.DB).Run(c.Request().Context(), broadcastID, c.Param("runId"), window)
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "Run not found")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get broadcast run")
+	}
+
+	var recipients []BroadcastRecipient
+	if err := db.DB.Select(&recipients, recipientSelect+`
+		WHERE br.run_id = $1
+		ORDER BY br.created_at ASC
+	`, run.ID); err != nil {
 		recipients = []BroadcastRecipient{}
 	}
 
 	return c.JSON(http.StatusOK, map[string]interface{}{
-		"broadcast":  broadcast,
+		"run":        run,
 		"recipients": recipients,
 	})
 }
 
+// replyWindow reads the window_hours query parameter replies are counted in
+func replyWindow(c echo.Context) (time.Duration, error) {
+	window := broadcastsvc.ReplyWindow
+	if hours, err := strconv.Atoi(c.QueryParam("window_hours")); err == nil {
+		if hours < 1 || hours > 720 {
+			return 0, echo.NewHTTPError(http.StatusBadRequest, "window_hours must be between 1 and 720")
+		}
+		window = time.Duration(hours) * time.Hour
+	}
+	return window, nil
+}
+
 // CreateBroadcast creates a new broadcast
 func CreateBroadcast(c echo.Context) error {
 	tenantID := getTenantIDFromContext(c)
@@ -153,31 +507,108 @@ func CreateBroadcast(c echo.Context) error {
 	}
 
 	var req struct {
-		Name           string   `json:"name"`
-		MessageContent string   `json:"message_content"`
-		TemplateID     *string  `json:"template_id"`
-		CustomerIDs    []string `json:"customer_ids"`
-		ScheduledAt    *string  `json:"scheduled_at"`
+		Name               string   `json:"name"`
+		MessageContent     string   `json:"message_content"`
+		TemplateID         *string  `json:"template_id"`
+		CustomerIDs        []string `json:"customer_ids"`
+		SegmentID          *string  `json:"segment_id"`
+		ScheduledAt        *string  `json:"scheduled_at"`
+		IsRecurring        bool     `json:"is_recurring"`
+		RecurrenceType     *string  `json:"recurrence_type"`
+		RecurrenceInterval *int     `json:"recurrence_interval"`
+		RecurrenceDays     []string `json:"recurrence_days"`
+		RecurrenceTime     *string  `json:"recurrence_time"`
+		RecurrenceEndDate  *string  `json:"recurrence_end_date"`
+		RecurrenceCount    *int     `json:"recurrence_count"`
+		// Monthly rules take a month day or the nth weekday, cron rules an
+		// expression
+		RecurrenceMonthDay    *int    `json:"recurrence_month_day"`
+		RecurrenceWeekOrdinal *int    `json:"recurrence_week_ordinal"`
+		RecurrenceWeekday     *string `json:"recurrence_weekday"`
+		RecurrenceCron        *string `json:"recurrence_cron"`
+		// Variants split recipients by weight; with ab_test only the test
+		// portion is sent first and the rest get the winner
+		Variants []broadcastsvc.VariantInput `json:"variants"`
+		ABTest   *broadcastsvc.ABTest        `json:"ab_test"`
+		// Daily window (HH:MM, tenant time) recipients are sent in
+		SendWindowStart string `json:"send_window_start"`
+		SendWindowEnd   string `json:"send_window_end"`
+		// Uploaded file sent with the message as its caption
+		MediaURL      string `json:"media_url"`
+		MediaFileName string `json:"media_file_name"`
 	}
 
 	if err := c.Bind(&req); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
 	}
 
-	if req.Name == "" || req.MessageContent == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "Name and message content are required")
+	if err := broadcastsvc.ValidateVariants(req.Variants); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	for _, v := range req.Variants {
+		if _, err := checkTemplateContent(c, tenantID, v.MessageContent, nil); err != nil {
+			return err
+		}
+	}
+	if req.MessageContent == "" && len(req.Variants) > 0 {
+		req.MessageContent = req.Variants[0].MessageContent
 	}
 
-	if len(req.CustomerIDs) == 0 {
-		return echo.NewHTTPError(http.StatusBadRequest, "At least one customer is required")
+	var mediaURL, mediaType, mediaFileName *string
+	if req.MediaURL != "" {
+		_, resolvedType, err := broadcastsvc.ResolveMedia(tenantID, req.MediaURL)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		mediaURL, mediaType = &req.MediaURL, &resolvedType
+		if req.MediaFileName = strings.TrimSpace(req.MediaFileName); req.MediaFileName != "" {
+			mediaFileName = &req.MediaFileName
+		}
 	}
 
-	// Start transaction
-	tx, err := db.DB.Beginx()
+	// A media broadcast may go without a caption
+	if req.Name == "" || (req.MessageContent == "" && mediaURL == nil) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Name and message content are required")
+	}
+	if _, err := checkTemplateContent(c, tenantID, req.MessageContent, nil); err != nil {
+		return err
+	}
+
+	window, err := broadcastsvc.ParseWindow(req.SendWindowStart, req.SendWindowEnd)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to start transaction")
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if window != nil && req.IsRecurring {
+		return echo.NewHTTPError(http.StatusBadRequest, "Recurring broadcasts run at their recurrence time and cannot have a send window")
+	}
+	var windowStart, windowEnd *string
+	if window != nil {
+		windowStart, windowEnd = &req.SendWindowStart, &req.SendWindowEnd
+	}
+
+	abTest := broadcastsvc.ABTest{}
+	if req.ABTest != nil {
+		if len(req.Variants) == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "ab_test requires variants")
+		}
+		if req.IsRecurring && req.ABTest.TestPercent > 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Recurring broadcasts cannot send a test portion first")
+		}
+		abTest = *req.ABTest
+	}
+	if err := abTest.Validate(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if req.SegmentID != nil && *req.SegmentID == "" {
+		req.SegmentID = nil
+	}
+	if len(req.CustomerIDs) == 0 && req.SegmentID == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "At least one customer or a segment is required")
+	}
+	if len(req.CustomerIDs) > 0 && req.SegmentID != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Use either customer_ids or segment_id, not both")
 	}
-	defer tx.Rollback()
 
 	// Create broadcast
 	var broadcast Broadcast
@@ -189,35 +620,163 @@ func CreateBroadcast(c echo.Context) error {
 		}
 	}
 
+	ctx := c.Request().Context()
+
+	var recurrenceDays interface{}
+	var recurrenceEndDate *time.Time
+	if req.IsRecurring {
+		if req.RecurrenceType == nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "recurrence_type is required for recurring broadcasts")
+		}
+		if req.RecurrenceInterval != nil && *req.RecurrenceInterval < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "recurrence_interval must be at least 1")
+		}
+		if req.RecurrenceTime != nil && *req.RecurrenceTime == "" {
+			req.RecurrenceTime = nil
+		}
+
+		// Keep only the fields the rule's type uses
+		rule := recurrence.Rule{Type: *req.RecurrenceType, Days: req.RecurrenceDays}
+		switch rule.Type {
+		case recurrence.Hourly, recurrence.Cron:
+			req.RecurrenceTime = nil
+		}
+		if rule.Type != recurrence.Weekly {
+			rule.Days = nil
+		}
+		if rule.Type != recurrence.Monthly {
+			req.RecurrenceMonthDay, req.RecurrenceWeekOrdinal, req.RecurrenceWeekday = nil, nil, nil
+		}
+		if rule.Type != recurrence.Cron {
+			req.RecurrenceCron = nil
+		}
+		if req.RecurrenceInterval != nil {
+			rule.Interval = *req.RecurrenceInterval
+		}
+		if req.RecurrenceTime != nil {
+			rule.Time = *req.RecurrenceTime
+		}
+		if req.RecurrenceMonthDay != nil {
+			rule.MonthDay = *req.RecurrenceMonthDay
+		}
+		if req.RecurrenceWeekOrdinal != nil {
+			rule.WeekOrdinal = *req.RecurrenceWeekOrdinal
+		}
+		if req.RecurrenceWeekday != nil {
+			rule.Weekday = strings.ToLower(*req.RecurrenceWeekday)
+			req.RecurrenceWeekday = &rule.Weekday
+		}
+		if req.RecurrenceCron != nil {
+			rule.Cron = strings.TrimSpace(*req.RecurrenceCron)
+			req.RecurrenceCron = &rule.Cron
+		}
+		if err := rule.Validate(); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		if len(rule.Days) > 0 {
+			daysJSON, _ := json.Marshal(rule.Days)
+			recurrenceDays = string(daysJSON)
+		}
+
+		// Without scheduled_at the broadcast starts at the rule's first run;
+		// hourly rules have no time of day to start from
+		if scheduledAt == nil {
+			if rule.Type == recurrence.Hourly {
+				return echo.NewHTTPError(http.StatusBadRequest, "scheduled_at is required for hourly broadcasts")
+			}
+			loc, err := recurrence.TenantLocation(ctx, db.DB, tenantID)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get tenant timezone")
+			}
+			first, err := rule.Next(time.Now(), loc)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+			scheduledAt = &first
+		}
+
+		if req.RecurrenceEndDate != nil && *req.RecurrenceEndDate != "" {
+			t, err := time.Parse(time.RFC3339, *req.RecurrenceEndDate)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "Invalid recurrence_end_date")
+			}
+			recurrenceEndDate = &t
+		}
+	} else {
+		req.RecurrenceType, req.RecurrenceInterval, req.RecurrenceTime, req.RecurrenceCount = nil, nil, nil, nil
+		req.RecurrenceMonthDay, req.RecurrenceWeekOrdinal, req.RecurrenceWeekday, req.RecurrenceCron = nil, nil, nil, nil
+	}
+
+	segments := segment.NewService(db.DB)
+
+	// Segment audiences are resolved when the broadcast is sent; store the
+	// current size as an estimate
+	totalRecipients := len(req.CustomerIDs)
+	if req.SegmentID != nil {
+		seg, err := segments.Get(ctx, tenantID, *req.SegmentID)
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusNotFound, "Segment not found")
+		} else if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get segment")
+		}
+		if totalRecipients, err = segments.Count(ctx, tenantID, seg.Filter, true); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to count segment members")
+		}
+	}
+
 	status := "draft"
 	if scheduledAt != nil {
 		status = "scheduled"
 	}
 
-	insertQuery := `
-		INSERT INTO broadcasts (tenant_id, name, message_content, template_id, status, scheduled_at, total_recipients)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
-		RETURNING id, tenant_id, name, message_content, template_id, status, scheduled_at, started_at, completed_at, total_recipients, sent_count, delivered_count, failed_count, created_at, updated_at
-	`
+	// Start transaction
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to start transaction")
+	}
+	defer tx.Rollback()
 
-	if err := tx.Get(&broadcast, insertQuery, tenantID, req.Name, req.MessageContent, req.TemplateID, status, scheduledAt, len(req.CustomerIDs)); err != nil {
+	insertQuery := `
+		INSERT INTO broadcasts (
+			tenant_id, name, message_content, template_id, status, scheduled_at, total_recipients, segment_id,
+			is_recurring, recurrence_type, recurrence_interval, recurrence_days, recurrence_time,
+			recurrence_end_date, recurrence_count, ab_test_percent, ab_decide_after_hours, ab_winner_metric,
+			send_window_start, send_window_end, media_url, media_type, media_file_name,
+			recurrence_month_day, recurrence_week_ordinal, recurrence_weekday, recurrence_cron
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, COALESCE($11, 1), $12::jsonb, $13::time, $14, $15, $16, $17, $18,
+			$19::time, $20::time, $21, $22, $23, $24, $25, $26, $27)
+		RETURNING ` + broadcastColumns
+
+	err = tx.Get(&broadcast, insertQuery, tenantID, req.Name, req.MessageContent, req.TemplateID, status, scheduledAt,
+		totalRecipients, req.SegmentID, req.IsRecurring, req.RecurrenceType, req.RecurrenceInterval, recurrenceDays,
+		req.RecurrenceTime, recurrenceEndDate, req.RecurrenceCount,
+		abTest.TestPercent, abTest.DecideAfterHours, abTest.WinnerMetric, windowStart, windowEnd,
+		mediaURL, mediaType, mediaFileName,
+		req.RecurrenceMonthDay, req.RecurrenceWeekOrdinal, req.RecurrenceWeekday, req.RecurrenceCron)
+	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create broadcast")
 	}
 
-	// Add recipients
-	for _, customerID := range req.CustomerIDs {
-		// Get customer JID
-		var customerJID string
-		jidQuery := `SELECT customer_jid FROM customer_insights WHERE id = $1 AND tenant_id = $2`
-		if err := tx.Get(&customerJID, jidQuery, customerID, tenantID); err != nil {
-			continue // Skip invalid customers
-		}
+	if err := broadcastsvc.CreateVariants(c.Request().Context(), tx, broadcast.ID, req.Variants); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to save variants")
+	}
 
-		recipientQuery := `
+	// Add recipients, skipping unknown and opted-out customers
+	if len(req.CustomerIDs) > 0 {
+		result, err := tx.Exec(`
 			INSERT INTO broadcast_recipients (broadcast_id, customer_id, customer_jid)
-			VALUES ($1, $2, $3)
-		`
-		tx.Exec(recipientQuery, broadcast.ID, customerID, customerJID)
+			SELECT $1, id, customer_jid
+			FROM customer_insights
+			WHERE tenant_id = $2 AND id::text = ANY($3) AND opted_out = false
+		`, broadcast.ID, tenantID, pq.Array(req.CustomerIDs))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to add recipients")
+		}
+
+		added, _ := result.RowsAffected()
+		broadcast.TotalRecipients = int(added)
+		tx.Exec(`UPDATE broadcasts SET total_recipients = $1 WHERE id = $2`, added, broadcast.ID)
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -238,7 +797,7 @@ func SendBroadcast(c echo.Context) error {
 
 	// Get broadcast
 	var broadcast Broadcast
-	query := `SELECT * FROM broadcasts WHERE id = $1 AND tenant_id = $2`
+	query := `SELECT ` + broadcastColumns + ` FROM broadcasts WHERE id = $1 AND tenant_id = $2`
 	if err := db.DB.Get(&broadcast, query, broadcastID, tenantID); err != nil {
 		return echo.NewHTTPError(http.StatusNotFound, "Broadcast not found")
 	}
@@ -247,120 +806,154 @@ func SendBroadcast(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "Broadcast cannot be sent in current status")
 	}
 
-	// Update status to sending
-	updateQuery := `UPDATE broadcasts SET status = 'sending', started_at = NOW(), updated_at = NOW() WHERE id = $1`
-	db.DB.Exec(updateQuery, broadcastID)
-
-	// Get recipients
-	var recipients []BroadcastRecipient
-	recipientQuery := `SELECT id, customer_id, customer_jid FROM broadcast_recipients WHERE broadcast_id = $1 AND status = 'pending'`
-	if err := db.DB.Select(&recipients, recipientQuery, broadcastID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get recipients")
+	// Start the broadcast's run; outside the send window it waits for the window to open
+	sending, err := broadcastEngine.Start(c.Request().Context(), broadcastID, nil, nil)
+	if err == broadcastsvc.ErrInvalidTransition {
+		return echo.NewHTTPError(http.StatusBadRequest, "Broadcast cannot be sent in current status")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to start broadcast")
+	}
+	if !sending {
+		return c.JSON(http.StatusOK, map[string]string{
+			"message": "Broadcast paused until its send window opens",
+			"status":  broadcastsvc.StatusPaused,
+		})
 	}
-
-	// Send messages in background
-	go sendBroadcastMessages(tenantID, broadcastID, broadcast.MessageContent, recipients)
 
 	return c.JSON(http.StatusOK, map[string]string{
 		"message": "Broadcast started",
-		"status":  "sending",
+		"status":  broadcastsvc.StatusSending,
 	})
 }
 
-// sendBroadcastMessages sends messages to all recipients (runs in background)
-func sendBroadcastMessages(tenantID, broadcastID, messageTemplate string, recipients []BroadcastRecipient) {
-	ctx := context.Background()
-	sentCount := 0
-	failedCount := 0
-
-	for _, recipient := range recipients {
-		// Get customer name for personalization
-		var customerName string
-		nameQuery := `SELECT COALESCE(customer_name, customer_phone, '') FROM customer_insights WHERE id = $1`
-		db.DB.Get(&customerName, nameQuery, recipient.CustomerID)
-
-		// If no name found, use phone number from JID
-		if customerName == "" {
-			parts := strings.Split(recipient.CustomerJID, "@")
-			if len(parts) > 0 {
-				customerName = parts[0]
-			}
-		}
+// CancelBroadcast cancels a broadcast
+func CancelBroadcast(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found. Please create a tenant first.")
+	}
 
-		// Personalize message - replace placeholders
-		personalizedMessage := personalizeMessage(messageTemplate, customerName)
+	broadcastID := c.Param("id")
 
-		// Send message via WhatsApp service
-		messageID, err := whatsappService.SendMessage(ctx, tenantID, recipient.CustomerJID, personalizedMessage)
+	// Anything not finished can be cancelled; queued messages are pulled back
+	err := broadcastsvc.NewService(db.DB).Cancel(c.Request().Context(), redisClient, tenantID, broadcastID)
+	if err == broadcastsvc.ErrNotCancellable {
+		return echo.NewHTTPError(http.StatusBadRequest, "Broadcast cannot be cancelled")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to cancel broadcast")
+	}
 
-		if err != nil {
-			// Mark as failed
-			failedCount++
-			errMsg := err.Error()
-			updateQuery := `UPDATE broadcast_recipients SET status = 'failed', error_message = $1 WHERE id = $2`
-			db.DB.Exec(updateQuery, errMsg, recipient.ID)
-		} else {
-			// Mark as sent
-			sentCount++
-			updateQuery := `UPDATE broadcast_recipients SET status = 'sent', message_id = $1, sent_at = NOW() WHERE id = $2`
-			db.DB.Exec(updateQuery, messageID, recipient.ID)
-		}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Broadcast cancelled"})
+}
 
-		// Update broadcast counts
-		updateBroadcastQuery := `UPDATE broadcasts SET sent_count = $1, failed_count = $2, updated_at = NOW() WHERE id = $3`
-		db.DB.Exec(updateBroadcastQuery, sentCount, failedCount, broadcastID)
+// RetryFailedBroadcast sends failed recipients again, except those whose
+// failure a retry cannot fix (not on WhatsApp, invalid JID)
+// POST /api/broadcasts/:id/retry-failed
+func RetryFailedBroadcast(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found. Please create a tenant first.")
+	}
 
-		// Add small delay between messages to avoid rate limiting
-		time.Sleep(500 * time.Millisecond)
+	broadcastID := c.Param("id")
+	var broadcast Broadcast
+	query := `SELECT ` + broadcastColumns + ` FROM broadcasts WHERE id = $1 AND tenant_id = $2`
+	if err := db.DB.Get(&broadcast, query, broadcastID, tenantID); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Broadcast not found")
 	}
 
-	// Mark broadcast as completed
-	completeQuery := `UPDATE broadcasts SET status = 'completed', completed_at = NOW(), updated_at = NOW() WHERE id = $1`
-	db.DB.Exec(completeQuery, broadcastID)
+	ctx := c.Request().Context()
+	svc := broadcastsvc.NewService(db.DB)
+	retried, err := svc.RetryFailed(ctx, broadcastID)
+	if err == broadcastsvc.ErrNotRetryable {
+		return echo.NewHTTPError(http.StatusBadRequest, "Only sending, paused or completed broadcasts can be retried")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to retry recipients")
+	}
 
-	fmt.Printf("[Broadcast] Completed: %s - Sent: %d, Failed: %d\n", broadcastID, sentCount, failedCount)
-}
+	// Paused broadcasts send the retried recipients when they resume
+	if retried > 0 {
+		if ok, err := svc.Continue(ctx, nil, broadcastID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to check send window")
+		} else if ok {
+			broadcastEngine.Dispatch(broadcastID)
+		}
+	}
 
-// personalizeMessage replaces placeholders with actual values
-// Supported placeholders:
-// - {{nama}} or {{name}} - Customer name
-// - {{phone}} - Customer phone number
-func personalizeMessage(template, customerName string) string {
-	result := template
-
-	// Replace name placeholders (case insensitive)
-	result = strings.ReplaceAll(result, "{{nama}}", customerName)
-	result = strings.ReplaceAll(result, "{{Nama}}", customerName)
-	result = strings.ReplaceAll(result, "{{NAMA}}", customerName)
-	result = strings.ReplaceAll(result, "{{name}}", customerName)
-	result = strings.ReplaceAll(result, "{{Name}}", customerName)
-	result = strings.ReplaceAll(result, "{{NAME}}", customerName)
-
-	return result
+	progress, err := svc.Progress(ctx, broadcastID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get progress")
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"retried":  retried,
+		"progress": progress,
+	})
 }
 
-// CancelBroadcast cancels a broadcast
-func CancelBroadcast(c echo.Context) error {
+// PauseBroadcast stops a sending broadcast and pulls its queued messages back
+// POST /api/broadcasts/:id/pause
+func PauseBroadcast(c echo.Context) error {
 	tenantID := getTenantIDFromContext(c)
 	if tenantID == "" {
 		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found. Please create a tenant first.")
 	}
 
 	broadcastID := c.Param("id")
+	var exists bool
+	db.DB.Get(&exists, `SELECT EXISTS(SELECT 1 FROM broadcasts WHERE id = $1 AND tenant_id = $2)`, broadcastID, tenantID)
+	if !exists {
+		return echo.NewHTTPError(http.StatusNotFound, "Broadcast not found")
+	}
 
-	// Allow cancelling draft, scheduled, and active (recurring) broadcasts
-	query := `UPDATE broadcasts SET status = 'cancelled', updated_at = NOW() WHERE id = $1 AND tenant_id = $2 AND status IN ('draft', 'scheduled', 'active')`
-	result, err := db.DB.Exec(query, broadcastID, tenantID)
+	svc := broadcastsvc.NewService(db.DB)
+	err := svc.Pause(c.Request().Context(), redisClient, broadcastID, broadcastsvc.PauseManual)
+	if err == broadcastsvc.ErrNotSending {
+		return echo.NewHTTPError(http.StatusBadRequest, "Only sending broadcasts can be paused")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to pause broadcast")
+	}
+
+	progress, err := svc.Progress(c.Request().Context(), broadcastID)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to cancel broadcast")
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get progress")
 	}
+	return c.JSON(http.StatusOK, progress)
+}
 
-	rows, _ := result.RowsAffected()
-	if rows == 0 {
-		return echo.NewHTTPError(http.StatusBadRequest, "Broadcast cannot be cancelled")
+// ResumeBroadcast continues a paused broadcast. Outside its send window it
+// stays paused until the window opens.
+// POST /api/broadcasts/:id/resume
+func ResumeBroadcast(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found. Please create a tenant first.")
 	}
 
-	return c.JSON(http.StatusOK, map[string]string{"message": "Broadcast cancelled"})
+	broadcastID := c.Param("id")
+	var broadcast Broadcast
+	query := `SELECT ` + broadcastColumns + ` FROM broadcasts WHERE id = $1 AND tenant_id = $2`
+	if err := db.DB.Get(&broadcast, query, broadcastID, tenantID); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Broadcast not found")
+	}
+
+	ctx := c.Request().Context()
+	svc := broadcastsvc.NewService(db.DB)
+	resumed, err := svc.Resume(ctx, broadcastID)
+	if err == broadcastsvc.ErrNotPaused {
+		return echo.NewHTTPError(http.StatusBadRequest, "Only paused broadcasts can be resumed")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to resume broadcast")
+	}
+
+	if resumed {
+		broadcastEngine.Dispatch(broadcastID)
+	}
+
+	progress, err := svc.Progress(ctx, broadcastID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get progress")
+	}
+	return c.JSON(http.StatusOK, progress)
 }
 
 // DeleteBroadcast deletes a broadcast
@@ -393,38 +986,47 @@ func GetBroadcastStats(c echo.Context) error {
 	if tenantID == "" {
 		// Tenant not found - return empty stats instead of 401
 		return c.JSON(http.StatusOK, map[string]interface{}{
-			"total_broadcasts":   0,
+			"total_broadcasts":    0,
 			"total_messages_sent": 0,
-			"total_delivered":    0,
-			"total_failed":       0,
+			"total_delivered":     0,
+			"total_failed":        0,
+			"failure_breakdown":   map[string]int{},
 		})
 	}
 
 	var stats struct {
-		TotalBroadcasts   int `db:"total_broadcasts"`
-		TotalMessagesSent int `db:"total_messages_sent"`
-		TotalDelivered    int `db:"total_delivered"`
-		TotalFailed       int `db:"total_failed"`
+		TotalBroadcasts   int            `json:"total_broadcasts" db:"total_broadcasts"`
+		TotalMessagesSent int            `json:"total_messages_sent" db:"total_messages_sent"`
+		TotalDelivered    int            `json:"total_delivered" db:"total_delivered"`
+		TotalFailed       int            `json:"total_failed" db:"total_failed"`
+		FailureBreakdown  map[string]int `json:"failure_breakdown" db:"-"`
 	}
 
+	// Counted from recipients so every run of recurring broadcasts adds up
 	query := `
-		SELECT 
-			COUNT(*) as total_broadcasts,
-			COALESCE(SUM(sent_count), 0) as total_messages_sent,
-			COALESCE(SUM(delivered_count), 0) as total_delivered,
-			COALESCE(SUM(failed_count), 0) as total_failed
-		FROM broadcasts
-		WHERE tenant_id = $1
+		SELECT
+			(SELECT COUNT(*) FROM broadcasts WHERE tenant_id = $1) as total_broadcasts,
+			COUNT(br.sent_at) as total_messages_sent,
+			COUNT(br.delivered_at) as total_delivered,
+			COUNT(*) FILTER (WHERE br.status = 'failed') as total_failed
+		FROM broadcast_recipients br
+		JOIN broadcasts b ON b.id = br.broadcast_id
+		WHERE b.tenant_id = $1
 	`
 
 	if err := db.DB.Get(&stats, query, tenantID); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get stats")
 	}
 
+	breakdown, err := broadcastsvc.NewService(db.DB).FailureBreakdown(c.Request().Context(), tenantID, "")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get stats")
+	}
+	stats.FailureBreakdown = breakdown
+
 	return c.JSON(http.StatusOK, stats)
 }
 
 // Placeholder for SQL NULL handling
 var _ = sql.NullString{}
 var _ = strings.TrimSpace
-
@@ -0,0 +1,508 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gowa-backend/db"
+	"gowa-backend/models"
+	"gowa-backend/services/conversation"
+	ws "gowa-backend/services/websocket"
+
+	"github.com/labstack/echo/v4"
+)
+
+// GetConversations returns the inbox: conversations with their last message,
+// status and the current user's unread count
+// GET /api/conversations?status=open&assigned=mine&search=&page=1&limit=20
+func GetConversations(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"items": []models.ConversationSummary{},
+			"total": 0,
+		})
+	}
+
+	page, _ := strconv.Atoi(c.QueryParam("page"))
+	if page < 1 {
+		page = 1
+	}
+	limit, _ := strconv.Atoi(c.QueryParam("limit"))
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	status := c.QueryParam("status")
+	if status != "" && status != "all" && !models.IsValidConversationStatus(status) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid status")
+	}
+
+	items, total, err := conversation.NewService(db.DB).List(c.Request().Context(), tenantID, getUserIDFromContext(c), conversation.ListFilter{
+		Status:   status,
+		Assigned: c.QueryParam("assigned"),
+		Search:   strings.TrimSpace(c.QueryParam("search")),
+		Page:     page,
+		Limit:    limit,
+	})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get conversations")
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"items":       items,
+		"total":       total,
+		"page":        page,
+		"limit":       limit,
+		"total_pages": (total + limit - 1) / limit,
+	})
+}
+
+// GetConversationMessages returns a page of message history, newest first.
+// Pass the returned next_cursor as ?cursor= to load older messages.
+// GET /api/conversations/:id/messages?cursor=&limit=50
+func GetConversationMessages(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	svc := conversation.NewService(db.DB)
+	ctx := c.Request().Context()
+
+	conv, err := svc.Get(ctx, tenantID, c.Param("id"))
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "Conversation not found")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get conversation")
+	}
+
+	limit, _ := strconv.Atoi(c.QueryParam("limit"))
+	if limit < 1 || limit > 100 {
+		limit = 50
+	}
+
+	messages, nextCursor, err := svc.Messages(ctx, conv, c.QueryParam("cursor"), limit)
+	if err == conversation.ErrInvalidCursor {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid cursor")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get messages")
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"items":       messages,
+		"next_cursor": nextCursor,
+		"has_more":    nextCursor != "",
+	})
+}
+
+// MarkConversationRead marks the conversation as read for the current user and
+// optionally sends WhatsApp read receipts ("send_receipt": true)
+// POST /api/conversations/:id/read
+func MarkConversationRead(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	svc := conversation.NewService(db.DB)
+	ctx := c.Request().Context()
+
+	var req struct {
+		SendReceipt bool `json:"send_receipt"`
+	}
+	c.Bind(&req)
+
+	conv, err := svc.Get(ctx, tenantID, c.Param("id"))
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "Conversation not found")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get conversation")
+	}
+
+	unreadIDs, err := svc.MarkRead(ctx, conv, getUserIDFromContext(c))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to mark conversation as read")
+	}
+
+	receiptSent := false
+	if req.SendReceipt && len(unreadIDs) > 0 && whatsappService != nil {
+		if err := whatsappService.MarkRead(ctx, tenantID, conv.CustomerJID, unreadIDs); err != nil {
+			fmt.Printf("[Conversation] Failed to send read receipt: %v\n", err)
+		} else {
+			receiptSent = true
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message":      "Conversation marked as read",
+		"marked":       len(unreadIDs),
+		"receipt_sent": receiptSent,
+	})
+}
+
+// UpdateConversationStatus sets a conversation to open, pending, resolved or
+// snoozed (with snooze_until in the future)
+// PUT /api/conversations/:id/status
+func UpdateConversationStatus(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+
+	var req struct {
+		Status      string     `json:"status"`
+		SnoozeUntil *time.Time `json:"snooze_until"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	}
+
+	if !models.IsValidConversationStatus(req.Status) {
+		return echo.NewHTTPError(http.StatusBadRequest, "status must be open, pending, resolved or snoozed")
+	}
+	if req.Status == models.ConversationSnoozed && (req.SnoozeUntil == nil || !req.SnoozeUntil.After(time.Now())) {
+		return echo.NewHTTPError(http.StatusBadRequest, "snooze_until must be a future time")
+	}
+
+	conv, err := conversation.NewService(db.DB).SetStatus(c.Request().Context(), tenantID, c.Param("id"), req.Status, req.SnoozeUntil)
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "Conversation not found")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to update conversation status")
+	}
+
+	return c.JSON(http.StatusOK, conv)
+}
+
+// GetConversation returns a conversation with its assignee
+// GET /api/conversations/:id
+func GetConversation(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found")
+	}
+
+	conv, err := conversation.NewService(db.DB).Get(c.Request().Context(), tenantID, c.Param("id"))
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "Conversation not found")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get conversation")
+	}
+
+	return c.JSON(http.StatusOK, conv)
+}
+
+// ClaimConversation assigns a conversation to the current user. Conversations
+// owned by someone else can only be taken over by admins with "force": true.
+// POST /api/conversations/:id/claim
+func ClaimConversation(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	userID := getUserIDFromContext(c)
+
+	var req struct {
+		Force bool `json:"force"`
+	}
+	c.Bind(&req)
+
+	svc := conversation.NewService(db.DB)
+	ctx := c.Request().Context()
+
+	var conv *models.Conversation
+	var err error
+	if req.Force && models.RoleAtLeast(getTenantRoleFromContext(c), models.RoleAdmin) {
+		conv, err = svc.Assign(ctx, tenantID, c.Param("id"), &userID, conversation.AssignedByClaim)
+	} else {
+		conv, err = svc.Claim(ctx, tenantID, c.Param("id"), userID)
+	}
+
+	if err == conversation.ErrAlreadyAssigned {
+		return echo.NewHTTPError(http.StatusConflict, "Conversation is already assigned to another member")
+	} else if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "Conversation not found")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to claim conversation")
+	}
+
+	return c.JSON(http.StatusOK, conv)
+}
+
+// TransferConversation hands a conversation over to another member.
+// Only the current assignee or an admin may transfer it.
+// POST /api/conversations/:id/transfer
+func TransferConversation(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+
+	var req struct {
+		UserID string `json:"user_id"`
+	}
+	if err := c.Bind(&req); err != nil || req.UserID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "user_id is required")
+	}
+
+	svc := conversation.NewService(db.DB)
+	ctx := c.Request().Context()
+
+	if err := ensureCanReassign(c, svc, tenantID); err != nil {
+		return err
+	}
+
+	ok, err := svc.IsAssignableMember(ctx, tenantID, req.UserID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to check member")
+	}
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "Target user is not an agent of this tenant")
+	}
+
+	conv, err := svc.Assign(ctx, tenantID, c.Param("id"), &req.UserID, conversation.AssignedByTransfer)
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "Conversation not found")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to transfer conversation")
+	}
+
+	return c.JSON(http.StatusOK, conv)
+}
+
+// UnassignConversation returns a conversation to the unassigned queue
+// POST /api/conversations/:id/unassign
+func UnassignConversation(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	svc := conversation.NewService(db.DB)
+
+	if err := ensureCanReassign(c, svc, tenantID); err != nil {
+		return err
+	}
+
+	conv, err := svc.Assign(c.Request().Context(), tenantID, c.Param("id"), nil, conversation.AssignedByManual)
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "Conversation not found")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to unassign conversation")
+	}
+
+	return c.JSON(http.StatusOK, conv)
+}
+
+// ensureCanReassign allows admins, the current assignee, or anyone when the
+// conversation is unassigned
+func ensureCanReassign(c echo.Context, svc *conversation.Service, tenantID string) error {
+	conv, err := svc.Get(c.Request().Context(), tenantID, c.Param("id"))
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "Conversation not found")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get conversation")
+	}
+
+	if models.RoleAtLeast(getTenantRoleFromContext(c), models.RoleAdmin) {
+		return nil
+	}
+	if conv.AssignedTo != nil && *conv.AssignedTo != getUserIDFromContext(c) {
+		return echo.NewHTTPError(http.StatusForbidden, "Only the assignee or an admin can reassign this conversation")
+	}
+	return nil
+}
+
+// assignmentRuleRequest is the body for creating/updating routing rules
+type assignmentRuleRequest struct {
+	Name         string  `json:"name"`
+	RuleType     string  `json:"rule_type"`
+	MatchValue   *string `json:"match_value"`
+	AssignToUser *string `json:"assign_to_user"`
+	AssignToRole *string `json:"assign_to_role"`
+	Priority     int     `json:"priority"`
+	IsActive     *bool   `json:"is_active"`
+}
+
+// validate normalises empty optional fields and checks the rule makes sense
+func (r *assignmentRuleRequest) validate(c echo.Context, tenantID string) error {
+	r.Name = strings.TrimSpace(r.Name)
+	if r.Name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Name is required")
+	}
+
+	for _, field := range []**string{&r.MatchValue, &r.AssignToUser, &r.AssignToRole} {
+		if *field != nil && strings.TrimSpace(**field) == "" {
+			*field = nil
+		}
+	}
+
+	switch r.RuleType {
+	case models.RuleTypeRoundRobin:
+		r.MatchValue = nil
+	case models.RuleTypeTag, models.RuleTypeIntent:
+		if r.MatchValue == nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "match_value is required for tag and intent rules")
+		}
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "rule_type must be round_robin, tag or intent")
+	}
+
+	if r.AssignToRole != nil && !models.RoleAtLeast(*r.AssignToRole, models.RoleAgent) {
+		return echo.NewHTTPError(http.StatusBadRequest, "assign_to_role must be owner, admin or agent")
+	}
+
+	if r.AssignToUser != nil {
+		ok, err := conversation.NewService(db.DB).IsAssignableMember(c.Request().Context(), tenantID, *r.AssignToUser)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to check member")
+		}
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "assign_to_user is not an agent of this tenant")
+		}
+	}
+
+	return nil
+}
+
+// GetAssignmentRules returns the tenant's routing rules in evaluation order
+// GET /api/assignment-rules
+func GetAssignmentRules(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found")
+	}
+
+	var rules []models.AssignmentRule
+	err := db.DB.Select(&rules, `
+		SELECT id, tenant_id, name, rule_type, match_value, assign_to_user, assign_to_role,
+		       priority, is_active, created_at, updated_at
+		FROM assignment_rules
+		WHERE tenant_id = $1
+		ORDER BY priority DESC, created_at ASC
+	`, tenantID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get assignment rules")
+	}
+
+	if rules == nil {
+		rules = []models.AssignmentRule{}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"items": rules,
+		"total": len(rules),
+	})
+}
+
+// CreateAssignmentRule adds a routing rule
+// POST /api/assignment-rules
+func CreateAssignmentRule(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+
+	var req assignmentRuleRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	}
+	if err := req.validate(c, tenantID); err != nil {
+		return err
+	}
+
+	isActive := true
+	if req.IsActive != nil {
+		isActive = *req.IsActive
+	}
+
+	var rule models.AssignmentRule
+	err := db.DB.Get(&rule, `
+		INSERT INTO assignment_rules (tenant_id, name, rule_type, match_value, assign_to_user, assign_to_role, priority, is_active)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, tenant_id, name, rule_type, match_value, assign_to_user, assign_to_role,
+		          priority, is_active, created_at, updated_at
+	`, tenantID, req.Name, req.RuleType, req.MatchValue, req.AssignToUser, req.AssignToRole, req.Priority, isActive)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create assignment rule")
+	}
+
+	return c.JSON(http.StatusCreated, rule)
+}
+
+// UpdateAssignmentRule replaces a routing rule
+// PUT /api/assignment-rules/:id
+func UpdateAssignmentRule(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+
+	var req assignmentRuleRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	}
+	if err := req.validate(c, tenantID); err != nil {
+		return err
+	}
+
+	isActive := true
+	if req.IsActive != nil {
+		isActive = *req.IsActive
+	}
+
+	var rule models.AssignmentRule
+	err := db.DB.Get(&rule, `
+		UPDATE assignment_rules
+		SET name = $1, rule_type = $2, match_value = $3, assign_to_user = $4,
+		    assign_to_role = $5, priority = $6, is_active = $7, updated_at = NOW()
+		WHERE id = $8 AND tenant_id = $9
+		RETURNING id, tenant_id, name, rule_type, match_value, assign_to_user, assign_to_role,
+		          priority, is_active, created_at, updated_at
+	`, req.Name, req.RuleType, req.MatchValue, req.AssignToUser, req.AssignToRole, req.Priority, isActive, c.Param("id"), tenantID)
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "Assignment rule not found")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to update assignment rule")
+	}
+
+	return c.JSON(http.StatusOK, rule)
+}
+
+// DeleteAssignmentRule removes a routing rule
+// DELETE /api/assignment-rules/:id
+func DeleteAssignmentRule(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+
+	result, err := db.DB.Exec(`DELETE FROM assignment_rules WHERE id = $1 AND tenant_id = $2`, c.Param("id"), tenantID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to delete assignment rule")
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "Assignment rule not found")
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Assignment rule deleted"})
+}
+
+// GetOnlineAgents returns the members currently connected over WebSocket,
+// i.e. the ones round-robin rules can pick
+// GET /api/conversations/agents
+func GetOnlineAgents(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found")
+	}
+
+	var agents []struct {
+		UserID         string     `json:"user_id" db:"user_id"`
+		FullName       string     `json:"full_name" db:"full_name"`
+		Role           string     `json:"role" db:"role"`
+		Online         bool       `json:"online" db:"-"`
+		AssignedCount  int        `json:"assigned_count" db:"assigned_count"`
+		LastAssignedAt *time.Time `json:"last_assigned_at" db:"last_assigned_at"`
+	}
+	err := db.DB.Select(&agents, `
+		SELECT tm.user_id, u.full_name, tm.role, tm.last_assigned_at,
+		       (SELECT COUNT(*) FROM conversations conv
+		        WHERE conv.tenant_id = tm.tenant_id AND conv.assigned_to = tm.user_id) as assigned_count
+		FROM tenant_members tm
+		JOIN users u ON u.id = tm.user_id
+		WHERE tm.tenant_id = $1 AND tm.role <> 'viewer'
+		ORDER BY u.full_name
+	`, tenantID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get agents")
+	}
+
+	online := map[string]bool{}
+	for _, id := range ws.GetHub().GetOnlineUserIDs(tenantID) {
+		online[id] = true
+	}
+	for i := range agents {
+		agents[i].Online = online[agents[i].UserID]
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"items": agents,
+		"total": len(agents),
+	})
+}
@@ -2,37 +2,59 @@ package handlers
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 	"time"
 
 	"gowa-backend/db"
+	"gowa-backend/services/customfields"
+	"gowa-backend/services/followup"
+	"gowa-backend/services/scheduledmsg"
 
 	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
 )
 
 // Customer represents a customer/contact from WhatsApp
 type Customer struct {
-	ID                 string     `json:"id" db:"id"`
-	TenantID           string     `json:"tenant_id" db:"tenant_id"`
-	CustomerJID        string     `json:"customer_jid" db:"customer_jid"`
-	CustomerName       *string    `json:"customer_name" db:"customer_name"`
-	CustomerPhone      *string    `json:"customer_phone" db:"customer_phone"`
-	Status             string     `json:"status" db:"status"`
-	Sentiment          *string    `json:"sentiment" db:"sentiment"`
-	Intent             *string    `json:"intent" db:"intent"`
-	ProductInterest    *string    `json:"product_interest" db:"product_interest"`
-	LastMessageSummary *string    `json:"last_message_summary" db:"last_message_summary"`
-	MessageCount       int        `json:"message_count" db:"message_count"`
-	LastMessageAt      *time.Time `json:"last_message_at" db:"last_message_at"`
-	FirstMessageAt     *time.Time `json:"first_message_at" db:"first_message_at"`
-	NeedsFollowUp      bool       `json:"needs_follow_up" db:"needs_follow_up"`
-	Tags               *string    `json:"tags" db:"tags"`
-	LeadScore          int        `json:"lead_score" db:"lead_score"`
-	CreatedAt          time.Time  `json:"created_at" db:"created_at"`
-	UpdatedAt          time.Time  `json:"updated_at" db:"updated_at"`
+	ID                  string     `json:"id" db:"id"`
+	TenantID            string     `json:"tenant_id" db:"tenant_id"`
+	CustomerJID         string     `json:"customer_jid" db:"customer_jid"`
+	CustomerName        *string    `json:"customer_name" db:"customer_name"`
+	CustomerPhone       *string    `json:"customer_phone" db:"customer_phone"`
+	Status              string     `json:"status" db:"status"`
+	Sentiment           *string    `json:"sentiment" db:"sentiment"`
+	Intent              *string    `json:"intent" db:"intent"`
+	ProductInterest     *string    `json:"product_interest" db:"product_interest"`
+	LastMessageSummary  *string    `json:"last_message_summary" db:"last_message_summary"`
+	MessageCount        int        `json:"message_count" db:"message_count"`
+	LastMessageAt       *time.Time `json:"last_message_at" db:"last_message_at"`
+	FirstMessageAt      *time.Time `json:"first_message_at" db:"first_message_at"`
+	NeedsFollowUp       bool       `json:"needs_follow_up" db:"needs_follow_up"`
+	Tags                *string    `json:"tags" db:"tags"`
+	LeadScore           int        `json:"lead_score" db:"lead_score"`
+	OptedOut            bool       `json:"opted_out" db:"opted_out"`
+	PurchaseCount       int        `json:"purchase_count" db:"purchase_count"`
+	CustomFields        *string    `json:"custom_fields" db:"custom_fields"`
+	ConversationSummary *string    `json:"conversation_summary" db:"conversation_summary"`
+	AIFacts             *string    `json:"ai_facts" db:"ai_facts"`
+	InsightsUpdatedAt   *time.Time `json:"insights_updated_at" db:"insights_updated_at"`
+	InsightsOptedOut    bool       `json:"insights_opted_out" db:"insights_opted_out"`
+	ConversationID      *string    `json:"conversation_id" db:"conversation_id"`
+	AssignedTo          *string    `json:"assigned_to" db:"assigned_to"`
+	CreatedAt           time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt           time.Time  `json:"updated_at" db:"updated_at"`
 }
 
+// conversationColumns selects the customer's conversation ID and assignee
+const conversationColumns = `
+	(SELECT conv.id::text FROM conversations conv
+	 WHERE conv.tenant_id = customer_insights.tenant_id AND conv.customer_jid = customer_insights.customer_jid) as conversation_id,
+	(SELECT conv.assigned_to::text FROM conversations conv
+	 WHERE conv.tenant_id = customer_insights.tenant_id AND conv.customer_jid = customer_insights.customer_jid) as assigned_to`
+
 // CustomerListResponse represents paginated customer list
 type CustomerListResponse struct {
 	Customers  []Customer `json:"customers"`
@@ -56,6 +78,8 @@ type CustomerMessage struct {
 type CustomerDetailResponse struct {
 	Customer Customer          `json:"customer"`
 	Messages []CustomerMessage `json:"messages"`
+	// Messages scheduled to the customer that have not gone out or failed
+	ScheduledMessages []scheduledmsg.Message `json:"scheduled_messages"`
 }
 
 // GetCustomers returns paginated list of customers with optional search/filter
@@ -123,6 +147,30 @@ func GetCustomers(c echo.Context) error {
 		args = append(args, status)
 	}
 
+	// Add assignment filter: "mine", "unassigned" or a member's user ID
+	switch assigned := c.QueryParam("assigned"); assigned {
+	case "", "all":
+	case "unassigned":
+		baseQuery += ` AND NOT EXISTS (
+			SELECT 1 FROM conversations conv
+			WHERE conv.tenant_id = customer_insights.tenant_id
+			  AND conv.customer_jid = customer_insights.customer_jid
+			  AND conv.assigned_to IS NOT NULL
+		)`
+	default:
+		if assigned == "mine" {
+			assigned = getUserIDFromContext(c)
+		}
+		argCount++
+		baseQuery += ` AND EXISTS (
+			SELECT 1 FROM conversations conv
+			WHERE conv.tenant_id = customer_insights.tenant_id
+			  AND conv.customer_jid = customer_insights.customer_jid
+			  AND conv.assigned_to::text = $` + strconv.Itoa(argCount) + `
+		)`
+		args = append(args, assigned)
+	}
+
 	// Get total count
 	var total int
 	countQuery := "SELECT COUNT(*) " + baseQuery
@@ -152,7 +200,9 @@ func GetCustomers(c echo.Context) error {
 			COALESCE(status, 'new') as status, sentiment, intent,
 			product_interest::text, last_message_summary,
 			message_count, last_message_at, first_message_at,
-			needs_follow_up, tags::text, COALESCE(lead_score, 0) as lead_score,
+			needs_follow_up, tags::text, COALESCE(lead_score, 0) as lead_score, opted_out, purchase_count,
+			custom_fields::text, conversation_summary, ai_facts::text, insights_updated_at, insights_opted_out,
+			` + conversationColumns + `,
 			created_at, updated_at
 		` + baseQuery + `
 		ORDER BY ` + sortBy + ` ` + sortOrder + ` NULLS LAST
@@ -176,7 +226,10 @@ func GetCustomers(c echo.Context) error {
 			&cust.CustomerPhone, &cust.Status, &cust.Sentiment, &cust.Intent,
 			&cust.ProductInterest, &cust.LastMessageSummary, &cust.MessageCount,
 			&cust.LastMessageAt, &cust.FirstMessageAt, &cust.NeedsFollowUp,
-			&cust.Tags, &cust.LeadScore, &cust.CreatedAt, &cust.UpdatedAt,
+			&cust.Tags, &cust.LeadScore, &cust.OptedOut, &cust.PurchaseCount,
+			&cust.CustomFields, &cust.ConversationSummary, &cust.AIFacts, &cust.InsightsUpdatedAt, &cust.InsightsOptedOut,
+			&cust.ConversationID, &cust.AssignedTo,
+			&cust.CreatedAt, &cust.UpdatedAt,
 		)
 		if err != nil {
 			continue
@@ -219,7 +272,9 @@ func GetCustomerDetail(c echo.Context) error {
 			COALESCE(status, 'new') as status, sentiment, intent,
 			product_interest::text, last_message_summary,
 			message_count, last_message_at, first_message_at,
-			needs_follow_up, tags::text, COALESCE(lead_score, 0) as lead_score,
+			needs_follow_up, tags::text, COALESCE(lead_score, 0) as lead_score, opted_out, purchase_count,
+			custom_fields::text, conversation_summary, ai_facts::text, insights_updated_at, insights_opted_out,
+			` + conversationColumns + `,
 			created_at, updated_at
 		FROM customer_insights
 		WHERE id = $1 AND tenant_id = $2
@@ -230,7 +285,10 @@ func GetCustomerDetail(c echo.Context) error {
 		&cust.CustomerPhone, &cust.Status, &cust.Sentiment, &cust.Intent,
 		&cust.ProductInterest, &cust.LastMessageSummary, &cust.MessageCount,
 		&cust.LastMessageAt, &cust.FirstMessageAt, &cust.NeedsFollowUp,
-		&cust.Tags, &cust.LeadScore, &cust.CreatedAt, &cust.UpdatedAt,
+		&cust.Tags, &cust.LeadScore, &cust.OptedOut, &cust.PurchaseCount,
+		&cust.CustomFields, &cust.ConversationSummary, &cust.AIFacts, &cust.InsightsUpdatedAt, &cust.InsightsOptedOut,
+		&cust.ConversationID, &cust.AssignedTo,
+		&cust.CreatedAt, &cust.UpdatedAt,
 	)
 
 	if err == sql.ErrNoRows {
@@ -247,7 +305,7 @@ func GetCustomerDetail(c echo.Context) error {
 	// Get chat history
 	messagesQuery := `
 		SELECT 
-			id, COALESCE(message_text, '') as message_text, 
+			id, COALESCE(NULLIF(message_text, ''), caption, '') as message_text, 
 			message_type, COALESCE(media_url, '') as media_url,
 			is_from_me, to_timestamp(timestamp) as timestamp
 		FROM whatsapp_messages
@@ -256,12 +314,18 @@ func GetCustomerDetail(c echo.Context) error {
 		LIMIT 50
 	`
 	
+	scheduled, err := scheduledmsg.NewService(db.DB).Timeline(c.Request().Context(), tenantID, cust.ID)
+	if err != nil {
+		scheduled = []scheduledmsg.Message{}
+	}
+
 	rows, err := db.DB.Query(messagesQuery, tenantID, cust.CustomerJID)
 	if err != nil {
 		// Return customer without messages if query fails
 		return c.JSON(http.StatusOK, CustomerDetailResponse{
-			Customer: cust,
-			Messages: []CustomerMessage{},
+			Customer:          cust,
+			Messages:          []CustomerMessage{},
+			ScheduledMessages: scheduled,
 		})
 	}
 	defer rows.Close()
@@ -277,8 +341,9 @@ func GetCustomerDetail(c echo.Context) error {
 	}
 
 	return c.JSON(http.StatusOK, CustomerDetailResponse{
-		Customer: cust,
-		Messages: messages,
+		Customer:          cust,
+		Messages:          messages,
+		ScheduledMessages: scheduled,
 	})
 }
 
@@ -300,10 +365,16 @@ func UpdateCustomer(c echo.Context) error {
 
 	// Parse request body
 	var req struct {
-		CustomerName  *string `json:"customer_name"`
-		Status        *string `json:"status"`
-		NeedsFollowUp *bool   `json:"needs_follow_up"`
-		Tags          *string `json:"tags"`
+		CustomerName     *string `json:"customer_name"`
+		Status           *string `json:"status"`
+		NeedsFollowUp    *bool   `json:"needs_follow_up"`
+		OptedOut         *bool   `json:"opted_out"`
+		PurchaseCount    *int    `json:"purchase_count"`
+		InsightsOptedOut *bool   `json:"insights_opted_out"`
+		Tags             *string `json:"tags"`
+
+		// CustomFields sets the given fields; null or "" clears one
+		CustomFields map[string]json.RawMessage `json:"custom_fields"`
 	}
 
 	if err := c.Bind(&req); err != nil {
@@ -345,12 +416,57 @@ func UpdateCustomer(c echo.Context) error {
 		args = append(args, *req.NeedsFollowUp)
 	}
 
+	if req.OptedOut != nil {
+		argCount++
+		updates = append(updates, "opted_out = $"+strconv.Itoa(argCount))
+		args = append(args, *req.OptedOut)
+		updates = append(updates, "opted_out_at = CASE WHEN $"+strconv.Itoa(argCount)+"::boolean THEN COALESCE(opted_out_at, NOW()) END")
+	}
+
+	if req.PurchaseCount != nil {
+		if *req.PurchaseCount < 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Purchase count must not be negative",
+			})
+		}
+		argCount++
+		updates = append(updates, "purchase_count = $"+strconv.Itoa(argCount))
+		args = append(args, *req.PurchaseCount)
+	}
+
+	if req.InsightsOptedOut != nil {
+		argCount++
+		updates = append(updates, "insights_opted_out = $"+strconv.Itoa(argCount))
+		args = append(args, *req.InsightsOptedOut)
+		// Opting out also forgets what the AI derived from the conversation
+		if *req.InsightsOptedOut {
+			updates = append(updates, "conversation_summary = NULL", "ai_facts = '{}'::jsonb")
+		}
+	}
+
 	if req.Tags != nil {
 		argCount++
 		updates = append(updates, "tags = $"+strconv.Itoa(argCount)+"::jsonb")
 		args = append(args, *req.Tags)
 	}
 
+	if len(req.CustomFields) > 0 {
+		set, unset, err := customfields.NewService(db.DB).Validate(c.Request().Context(), tenantID, req.CustomFields)
+		if errors.Is(err, customfields.ErrInvalidValue) {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": err.Error(),
+			})
+		} else if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to validate custom fields",
+			})
+		}
+		setJSON, _ := json.Marshal(set)
+		updates = append(updates, "custom_fields = (COALESCE(custom_fields, '{}'::jsonb) || $"+strconv.Itoa(argCount+1)+"::jsonb) - $"+strconv.Itoa(argCount+2)+"::text[]")
+		args = append(args, string(setJSON), pq.Array(unset))
+		argCount += 2
+	}
+
 	if len(updates) == 0 {
 		return c.JSON(http.StatusBadRequest, map[string]string{
 			"error": "No fields to update",
@@ -386,6 +502,18 @@ func UpdateCustomer(c echo.Context) error {
 		})
 	}
 
+	// The flag is driven by open follow-up tasks: flagging opens one, clearing completes them
+	if req.NeedsFollowUp != nil {
+		err := followup.NewService(db.DB).SetNeedsFollowUp(c.Request().Context(), tenantID, customerID, *req.NeedsFollowUp, getUserIDFromContext(c))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to update follow-up tasks",
+			})
+		}
+	}
+
+	applyCustomerTagRules(c, tenantID, customerID)
+
 	return c.JSON(http.StatusOK, map[string]string{
 		"message": "Customer updated successfully",
 	})
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"gowa-backend/db"
+	"gowa-backend/services/customfields"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+)
+
+// customFieldRequest is the body for creating/updating custom fields
+type customFieldRequest struct {
+	Key      string   `json:"key"`
+	Label    string   `json:"label"`
+	Type     string   `json:"type"`
+	Options  []string `json:"options"`
+	Required bool     `json:"required"`
+	Position int      `json:"position"`
+}
+
+func (r customFieldRequest) definition() (customfields.Definition, error) {
+	d := customfields.Definition{
+		Key:      r.Key,
+		Label:    r.Label,
+		Type:     r.Type,
+		Options:  r.Options,
+		Required: r.Required,
+		Position: r.Position,
+	}
+	if err := d.Normalize(); err != nil {
+		return d, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return d, nil
+}
+
+// customFieldSaveError maps insert/update failures to HTTP errors
+func customFieldSaveError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return echo.NewHTTPError(http.StatusConflict, "A custom field with this key already exists")
+	}
+	return echo.NewHTTPError(http.StatusInternalServerError, "Failed to save custom field")
+}
+
+// GetCustomerFields returns the tenant's custom customer fields
+// GET /api/customer-fields
+func GetCustomerFields(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found")
+	}
+
+	definitions, err := customfields.NewService(db.DB).Definitions(c.Request().Context(), tenantID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get custom fields")
+	}
+
+	return c.JSON(http.StatusOK, definitions)
+}
+
+// CreateCustomerField defines a new custom customer field
+// POST /api/customer-fields
+func CreateCustomerField(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found")
+	}
+
+	var req customFieldRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	}
+	d, err := req.definition()
+	if err != nil {
+		return err
+	}
+
+	var field customfields.Definition
+	err = db.DB.Get(&field, `
+		INSERT INTO customer_field_definitions (tenant_id, key, label, field_type, options, required, position)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING `+customfields.Columns,
+		tenantID, d.Key, d.Label, d.Type, d.Options, d.Required, d.Position)
+	if err != nil {
+		return customFieldSaveError(err)
+	}
+
+	return c.JSON(http.StatusCreated, field)
+}
+
+// UpdateCustomerField changes a custom field. The type can only change
+// while no customer has a value for the field, and the key never changes
+// because templates and segments refer to it.
+// PUT /api/customer-fields/:id
+func UpdateCustomerField(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found")
+	}
+
+	var current customfields.Definition
+	err := db.DB.Get(&current, `SELECT `+customfields.Columns+` FROM customer_field_definitions WHERE id = $1 AND tenant_id = $2`, c.Param("id"), tenantID)
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "Custom field not found")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get custom field")
+	}
+
+	var req customFieldRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	}
+	req.Key = current.Key
+	d, err := req.definition()
+	if err != nil {
+		return err
+	}
+
+	if d.Type != current.Type {
+		var inUse bool
+		db.DB.Get(&inUse, `SELECT EXISTS (SELECT 1 FROM customer_insights WHERE tenant_id = $1 AND custom_fields ? $2)`, tenantID, current.Key)
+		if inUse {
+			return echo.NewHTTPError(http.StatusConflict, "The type of a field that customers already have values for cannot be changed")
+		}
+	}
+
+	var field customfields.Definition
+	err = db.DB.Get(&field, `
+		UPDATE customer_field_definitions
+		SET label = $1, field_type = $2, options = $3, required = $4, position = $5, updated_at = NOW()
+		WHERE id = $6 AND tenant_id = $7
+		RETURNING `+customfields.Columns,
+		d.Label, d.Type, d.Options, d.Required, d.Position, current.ID, tenantID)
+	if err != nil {
+		return customFieldSaveError(err)
+	}
+
+	return c.JSON(http.StatusOK, field)
+}
+
+// DeleteCustomerField removes a custom field and its values from every
+// customer
+// DELETE /api/customer-fields/:id
+func DeleteCustomerField(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found")
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to delete custom field")
+	}
+	defer tx.Rollback()
+
+	var key string
+	err = tx.Get(&key, `DELETE FROM customer_field_definitions WHERE id = $1 AND tenant_id = $2 RETURNING key`, c.Param("id"), tenantID)
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "Custom field not found")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to delete custom field")
+	}
+
+	_, err = tx.Exec(`
+		UPDATE customer_insights SET custom_fields = custom_fields - $1::text, updated_at = NOW()
+		WHERE tenant_id = $2 AND custom_fields ? $1
+	`, key, tenantID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to delete custom field values")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to delete custom field")
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Custom field deleted"})
+}
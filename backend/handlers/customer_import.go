@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gowa-backend/db"
+	"gowa-backend/services/customers"
+	"gowa-backend/services/spreadsheet"
+
+	"github.com/labstack/echo/v4"
+)
+
+// CustomerImport is a finished customer import without its error report
+type CustomerImport struct {
+	ID           string    `json:"id" db:"id"`
+	ImportedBy   *string   `json:"imported_by" db:"imported_by"`
+	FileName     *string   `json:"file_name" db:"file_name"`
+	OnDuplicate  string    `json:"on_duplicate" db:"on_duplicate"`
+	TotalRows    int       `json:"total_rows" db:"total_rows"`
+	CreatedCount int       `json:"created" db:"created_count"`
+	UpdatedCount int       `json:"updated" db:"updated_count"`
+	SkippedCount int       `json:"skipped" db:"skipped_count"`
+	FailedCount  int       `json:"failed" db:"failed_count"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+}
+
+// ImportCustomers imports customers from a CSV or XLSX file. Form fields:
+//   - file: the spreadsheet, first row is the header
+//   - mapping: optional JSON such as {"phone":"No HP","name":"Nama","cf_city":"Kota"}
+//   - on_duplicate: skip (default) or update existing customers
+//   - tag_ids: comma separated tag IDs added to every imported customer
+//   - dry_run: true to only validate and preview
+//
+// POST /api/customers/import
+func ImportCustomers(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found")
+	}
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "File is required")
+	}
+	if fileHeader.Size > maxFileSize {
+		return echo.NewHTTPError(http.StatusBadRequest, "File size exceeds maximum allowed (10MB)")
+	}
+
+	format, err := spreadsheet.FormatFromFileName(fileHeader.Filename)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	src, err := fileHeader.Open()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to open uploaded file")
+	}
+	defer src.Close()
+
+	data, err := io.ReadAll(io.LimitReader(src, maxFileSize))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to read uploaded file")
+	}
+
+	// The header row comes on top of the data rows
+	rows, err := spreadsheet.ReadAll(data, format, customers.MaxImportRows+1)
+	if errors.Is(err, spreadsheet.ErrTooManyRows) {
+		return echo.NewHTTPError(http.StatusBadRequest, customers.ErrTooManyRows.Error())
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	opts := customers.ImportOptions{
+		TenantID:    tenantID,
+		UserID:      getUserIDFromContext(c),
+		FileName:    fileHeader.Filename,
+		OnDuplicate: c.FormValue("on_duplicate"),
+		DryRun:      c.FormValue("dry_run") == "true",
+	}
+
+	if opts.OnDuplicate != "" && opts.OnDuplicate != customers.DuplicateSkip && opts.OnDuplicate != customers.DuplicateUpdate {
+		return echo.NewHTTPError(http.StatusBadRequest, "on_duplicate must be skip or update")
+	}
+
+	if mapping := c.FormValue("mapping"); mapping != "" {
+		if err := json.Unmarshal([]byte(mapping), &opts.Mapping); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "mapping must be a JSON object of field to column name")
+		}
+	}
+
+	for _, tagID := range strings.Split(c.FormValue("tag_ids"), ",") {
+		if tagID = strings.TrimSpace(tagID); tagID != "" {
+			opts.TagIDs = append(opts.TagIDs, tagID)
+		}
+	}
+
+	result, err := customers.NewService(db.DB).Import(c.Request().Context(), rows, opts)
+	switch {
+	case errors.Is(err, customers.ErrUnknownTag):
+		return echo.NewHTTPError(http.StatusNotFound, "Tag not found")
+	case errors.Is(err, customers.ErrEmptyFile),
+		errors.Is(err, customers.ErrTooManyRows),
+		errors.Is(err, customers.ErrPhoneColumnRequired),
+		errors.Is(err, customers.ErrUnknownColumn),
+		errors.Is(err, customers.ErrUnknownField):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	case err != nil:
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to import customers")
+	}
+
+	status := http.StatusOK
+	if !result.DryRun {
+		status = http.StatusCreated
+	}
+	return c.JSON(status, result)
+}
+
+// GetCustomerImports returns the tenant's recent imports
+// GET /api/customers/imports
+func GetCustomerImports(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found")
+	}
+
+	var imports []CustomerImport
+	err := db.DB.Select(&imports, `
+		SELECT id, imported_by, file_name, on_duplicate, total_rows,
+			created_count, updated_count, skipped_count, failed_count, created_at
+		FROM customer_imports
+		WHERE tenant_id = $1
+		ORDER BY created_at DESC
+		LIMIT 50
+	`, tenantID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get imports")
+	}
+	if imports == nil {
+		imports = []CustomerImport{}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"items": imports,
+		"total": len(imports),
+	})
+}
+
+// GetCustomerImportErrors returns the error report of an import, as a CSV
+// download by default or as JSON with format=json
+// GET /api/customers/imports/:id/errors?format=csv|json
+func GetCustomerImportErrors(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+
+	report, err := customers.NewService(db.DB).ImportErrors(c.Request().Context(), tenantID, c.Param("id"))
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "Import not found")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get import errors")
+	}
+
+	if c.QueryParam("format") == "json" {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"items": report,
+			"total": len(report),
+		})
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, spreadsheet.ContentType(spreadsheet.FormatCSV))
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", "import_errors_"+c.Param("id")+".csv"))
+	res.WriteHeader(http.StatusOK)
+
+	w, _ := spreadsheet.NewWriter(res, spreadsheet.FormatCSV)
+	w.Write([]string{"row", "column", "value", "error"})
+	for _, e := range report {
+		w.Write([]string{strconv.Itoa(e.Row), e.Column, e.Value, e.Error})
+	}
+	return w.Close()
+}
+
+// ExportCustomers downloads customers with tags, lead score, notes and custom
+// fields in the same layout the importer accepts
+// GET /api/customers/export?format=csv|xlsx&search=&status=&tag_id=
+func ExportCustomers(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found")
+	}
+
+	format := c.QueryParam("format")
+	if format == "" {
+		format = spreadsheet.FormatCSV
+	}
+	if format != spreadsheet.FormatCSV && format != spreadsheet.FormatXLSX {
+		return echo.NewHTTPError(http.StatusBadRequest, "format must be csv or xlsx")
+	}
+
+	filter := customers.ExportFilter{
+		TenantID: tenantID,
+		Search:   c.QueryParam("search"),
+		Status:   c.QueryParam("status"),
+		TagID:    c.QueryParam("tag_id"),
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, spreadsheet.ContentType(format))
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", "customers_"+time.Now().Format("20060102")+"."+format))
+	res.WriteHeader(http.StatusOK)
+
+	if _, err := customers.NewService(db.DB).Export(c.Request().Context(), res, format, filter); err != nil {
+		// Headers are already sent, so just log the failure
+		fmt.Printf("[Export] Failed to write customers: %v\n", err)
+	}
+	return nil
+}
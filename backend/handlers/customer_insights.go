@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"gowa-backend/db"
+	"gowa-backend/services/insights"
+
+	"github.com/labstack/echo/v4"
+)
+
+// maxInsightsBudgetUSD caps the monthly insights budget a tenant can set
+const maxInsightsBudgetUSD = 1000
+
+// GetInsightSettings returns the tenant's AI insight settings and this
+// month's spend
+// GET /api/ai/insights-settings
+func (h *AIHandler) GetInsightSettings(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found")
+	}
+
+	settings, err := insights.NewService(db.DB, h.aiService).Settings(c.Request().Context(), tenantID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get insight settings")
+	}
+
+	return c.JSON(http.StatusOK, settings)
+}
+
+// UpdateInsightSettings turns background insights on or off and sets the
+// monthly budget
+// PUT /api/ai/insights-settings
+func (h *AIHandler) UpdateInsightSettings(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found")
+	}
+
+	var req struct {
+		Enabled          *bool    `json:"enabled"`
+		MonthlyBudgetUSD *float64 `json:"monthly_budget_usd"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	}
+
+	svc := insights.NewService(db.DB, h.aiService)
+	ctx := c.Request().Context()
+	settings, err := svc.Settings(ctx, tenantID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get insight settings")
+	}
+
+	if req.Enabled != nil {
+		settings.Enabled = *req.Enabled
+	}
+	if req.MonthlyBudgetUSD != nil {
+		if *req.MonthlyBudgetUSD < 0 || *req.MonthlyBudgetUSD > maxInsightsBudgetUSD {
+			return echo.NewHTTPError(http.StatusBadRequest, "monthly_budget_usd must be between 0 and 1000")
+		}
+		settings.MonthlyBudgetUSD = *req.MonthlyBudgetUSD
+	}
+
+	if err := svc.SaveSettings(ctx, tenantID, settings.Enabled, settings.MonthlyBudgetUSD); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to save insight settings")
+	}
+
+	return c.JSON(http.StatusOK, settings)
+}
+
+// RefreshCustomerInsights analyses a customer's conversation now instead of
+// waiting for the background worker. Budget and opt-out still apply.
+// POST /api/customers/:id/insights/refresh
+func (h *AIHandler) RefreshCustomerInsights(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found")
+	}
+	if h.aiService == nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "AI service not available")
+	}
+
+	config, userAPIKey, err := getAIConfigWithKey(tenantID)
+	if err != nil && err != sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get AI configuration")
+	}
+
+	provider := insights.Provider{
+		Name:            config.AIProvider,
+		Model:           config.Model,
+		BusinessContext: buildBusinessContextFromConfig(config),
+	}
+	if !config.UseSystemKey {
+		provider.APIKey = userAPIKey
+	}
+
+	insight, err := insights.NewService(db.DB, h.aiService).Enrich(c.Request().Context(), tenantID, c.Param("id"), provider)
+	switch {
+	case err == nil:
+		return c.JSON(http.StatusOK, insight)
+	case errors.Is(err, sql.ErrNoRows):
+		return echo.NewHTTPError(http.StatusNotFound, "Customer not found")
+	case errors.Is(err, insights.ErrBudgetExceeded):
+		return echo.NewHTTPError(http.StatusPaymentRequired, err.Error())
+	case errors.Is(err, insights.ErrDisabled), errors.Is(err, insights.ErrOptedOut), errors.Is(err, insights.ErrNoMessages):
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	default:
+		return echo.NewHTTPError(http.StatusBadGateway, "Failed to analyse conversation: "+err.Error())
+	}
+}
+
+// GetAnalyticsInsights returns sentiment, intent and product interest across
+// the tenant's customers, with this month's insight spend
+// GET /api/analytics/insights
+func GetAnalyticsInsights(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+
+	type count struct {
+		Label string `db:"label" json:"label"`
+		Count int    `db:"count" json:"count"`
+	}
+	sentiments := []count{}
+	intents := []count{}
+	products := []count{}
+
+	err := db.DB.Select(&sentiments, `
+		SELECT sentiment as label, COUNT(*) as count
+		FROM customer_insights
+		WHERE tenant_id = $1 AND sentiment IS NOT NULL
+		GROUP BY sentiment
+		ORDER BY count DESC
+	`, tenantID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get sentiment analytics")
+	}
+
+	err = db.DB.Select(&intents, `
+		SELECT intent as label, COUNT(*) as count
+		FROM customer_insights
+		WHERE tenant_id = $1 AND intent IS NOT NULL AND intent != ''
+		GROUP BY intent
+		ORDER BY count DESC
+	`, tenantID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get intent analytics")
+	}
+
+	// Product names are grouped case-insensitively and shown as most often written
+	err = db.DB.Select(&products, `
+		SELECT MODE() WITHIN GROUP (ORDER BY p.name) as label, COUNT(DISTINCT ci.id) as count
+		FROM customer_insights ci
+		CROSS JOIN LATERAL jsonb_array_elements_text(
+			CASE WHEN jsonb_typeof(ci.product_interest) = 'array' THEN ci.product_interest ELSE '[]'::jsonb END
+		) AS p(name)
+		WHERE ci.tenant_id = $1
+		GROUP BY LOWER(p.name)
+		ORDER BY count DESC
+		LIMIT 20
+	`, tenantID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get product interest analytics")
+	}
+
+	var analysed int
+	db.DB.Get(&analysed, `SELECT COUNT(*) FROM customer_insights WHERE tenant_id = $1 AND insights_updated_at IS NOT NULL`, tenantID)
+
+	settings, err := insights.NewService(db.DB, nil).Settings(c.Request().Context(), tenantID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get insight spend")
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"sentiments":         sentiments,
+		"intents":            intents,
+		"product_interests":  products,
+		"analysed_customers": analysed,
+		"settings":           settings,
+	})
+}
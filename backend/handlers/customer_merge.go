@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"gowa-backend/db"
+	"gowa-backend/services/customers"
+	"gowa-backend/services/leadscore"
+
+	"github.com/labstack/echo/v4"
+)
+
+// GetCustomerDuplicates lists pairs of customers that are probably the same
+// person, best matches first
+// GET /api/customers/duplicates?min_score=&page=&limit=
+func GetCustomerDuplicates(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found")
+	}
+
+	minScore := 0.5
+	if v := c.QueryParam("min_score"); v != "" {
+		parsed, err := strconv.ParseFloat(v, 64)
+		if err != nil || parsed < 0 || parsed > 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "min_score must be between 0 and 1")
+		}
+		minScore = parsed
+	}
+
+	page, _ := strconv.Atoi(c.QueryParam("page"))
+	if page < 1 {
+		page = 1
+	}
+	limit, _ := strconv.Atoi(c.QueryParam("limit"))
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	duplicates, err := customers.NewService(db.DB).FindDuplicates(c.Request().Context(), tenantID, minScore)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to find duplicate customers")
+	}
+
+	total := len(duplicates)
+	start := (page - 1) * limit
+	if start > total {
+		start = total
+	}
+	end := start + limit
+	if end > total {
+		end = total
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"items":       duplicates[start:end],
+		"total":       total,
+		"page":        page,
+		"limit":       limit,
+		"total_pages": (total + limit - 1) / limit,
+	})
+}
+
+// MergeCustomers merges a duplicate customer into the surviving one
+// POST /api/customers/merge
+func MergeCustomers(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found")
+	}
+
+	var req struct {
+		SurvivorID string `json:"survivor_id"`
+		MergedID   string `json:"merged_id"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	}
+	if req.SurvivorID == "" || req.MergedID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "survivor_id and merged_id are required")
+	}
+
+	merge, err := customers.NewService(db.DB).MergeCustomers(c.Request().Context(), tenantID, getUserIDFromContext(c), req.SurvivorID, req.MergedID)
+	if err != nil {
+		return mergeError(err, "Failed to merge customers")
+	}
+
+	rescoreCustomer(c, tenantID, merge.SurvivorID)
+	return c.JSON(http.StatusOK, merge)
+}
+
+// GetCustomerMerges returns the merge history, optionally of one customer
+// GET /api/customers/merges?customer_id=&page=&limit=
+func GetCustomerMerges(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found")
+	}
+
+	page, _ := strconv.Atoi(c.QueryParam("page"))
+	if page < 1 {
+		page = 1
+	}
+	limit, _ := strconv.Atoi(c.QueryParam("limit"))
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	merges, total, err := customers.NewService(db.DB).ListMerges(c.Request().Context(), tenantID, c.QueryParam("customer_id"), limit, (page-1)*limit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get merges")
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"items":       merges,
+		"total":       total,
+		"page":        page,
+		"limit":       limit,
+		"total_pages": (total + limit - 1) / limit,
+	})
+}
+
+// UndoCustomerMerge restores a merged customer and moves its history back
+// POST /api/customers/merges/:id/undo
+func UndoCustomerMerge(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found")
+	}
+
+	merge, err := customers.NewService(db.DB).UndoMerge(c.Request().Context(), tenantID, getUserIDFromContext(c), c.Param("id"))
+	if err != nil {
+		return mergeError(err, "Failed to undo merge")
+	}
+
+	rescoreCustomer(c, tenantID, merge.SurvivorID)
+	rescoreCustomer(c, tenantID, merge.MergedID)
+	return c.JSON(http.StatusOK, merge)
+}
+
+// rescoreCustomer recomputes the lead score and tag rules of a customer
+// whose history changed
+func rescoreCustomer(c echo.Context, tenantID, customerID string) {
+	if _, err := leadscore.NewService(db.DB).RecomputeCustomer(c.Request().Context(), tenantID, customerID, leadscore.ReasonRecompute); err != nil {
+		fmt.Printf("[Customers] Failed to recompute lead score of %s: %v\n", customerID, err)
+	}
+	applyCustomerTagRules(c, tenantID, customerID)
+}
+
+func mergeError(err error, message string) error {
+	switch {
+	case errors.Is(err, customers.ErrCustomerNotFound), errors.Is(err, customers.ErrMergeNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case errors.Is(err, customers.ErrSameCustomer), errors.Is(err, customers.ErrGroupMerge):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	case errors.Is(err, customers.ErrMergeUndone), errors.Is(err, customers.ErrUndoExpired),
+		errors.Is(err, customers.ErrSurvivorGone), errors.Is(err, customers.ErrJIDInUse):
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	default:
+		fmt.Printf("[Customers] %s: %v\n", message, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, message)
+	}
+}
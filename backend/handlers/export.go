@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"gowa-backend/db"
+	"gowa-backend/services/export"
+
+	"github.com/labstack/echo/v4"
+)
+
+// transcriptInlineLimit is the largest transcript returned directly; bigger
+// ones are turned into background export jobs
+const transcriptInlineLimit = 2000
+
+// parseTranscriptRange reads optional from/to dates into a transcript filter
+func parseTranscriptRange(filter *export.TranscriptFilter, from, to string) error {
+	if from != "" {
+		t, ok := parseDateParam(from, false)
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid from date")
+		}
+		filter.From = &t
+	}
+	if to != "" {
+		t, ok := parseDateParam(to, true)
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid to date")
+		}
+		filter.To = &t
+	}
+	return nil
+}
+
+// transcriptFileName builds a download name such as transcript_628123_20240131.csv
+func transcriptFileName(subject, format string) string {
+	subject = strings.NewReplacer(" ", "_", "/", "_", "@", "_").Replace(subject)
+	return fmt.Sprintf("transcript_%s_%s.%s", subject, time.Now().Format("20060102"), format)
+}
+
+// startTranscriptJob records an export job and runs it in the background
+func startTranscriptJob(c echo.Context, tenantID, format, title, fileName string, filter export.TranscriptFilter, params map[string]interface{}) (*export.Job, error) {
+	params["filter"] = filter
+	paramsJSON, _ := json.Marshal(params)
+
+	var requestedBy *string
+	if userID := getUserIDFromContext(c); userID != "" {
+		requestedBy = &userID
+	}
+
+	var job export.Job
+	err := db.DB.Get(&job, `
+		INSERT INTO export_jobs (tenant_id, requested_by, export_type, format, params)
+		VALUES ($1, $2, 'transcript', $3, $4)
+		RETURNING `+export.JobColumns,
+		tenantID, requestedBy, format, string(paramsJSON))
+	if err != nil {
+		return nil, err
+	}
+
+	go export.RunTranscriptJob(db.DB, job.ID, format, title, fileName, filter)
+	return &job, nil
+}
+
+// ExportCustomerTranscript downloads one customer's chat as csv, json or
+// print-ready html. Transcripts over transcriptInlineLimit messages are
+// exported in the background and a job is returned instead (202).
+// GET /api/customers/:id/transcript?format=csv&from=2024-01-01&to=2024-01-31
+func ExportCustomerTranscript(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found")
+	}
+
+	format := c.QueryParam("format")
+	if format == "" {
+		format = export.FormatCSV
+	}
+	if !export.IsValidFormat(format) {
+		return echo.NewHTTPError(http.StatusBadRequest, "format must be csv, json or html")
+	}
+
+	var customer struct {
+		JID  string  `db:"customer_jid"`
+		Name *string `db:"customer_name"`
+	}
+	err := db.DB.Get(&customer, `SELECT customer_jid, customer_name FROM customer_insights WHERE id = $1 AND tenant_id = $2`, c.Param("id"), tenantID)
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "Customer not found")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get customer")
+	}
+
+	filter := export.TranscriptFilter{TenantID: tenantID, CustomerJID: customer.JID}
+	if err := parseTranscriptRange(&filter, c.QueryParam("from"), c.QueryParam("to")); err != nil {
+		return err
+	}
+
+	subject := strings.SplitN(customer.JID, "@", 2)[0]
+	title := "Transkrip Chat " + subject
+	if customer.Name != nil && *customer.Name != "" {
+		title = "Transkrip Chat " + *customer.Name + " (" + subject + ")"
+	}
+	fileName := transcriptFileName(subject, format)
+
+	ctx := c.Request().Context()
+	count, err := export.CountTranscript(ctx, db.DB, filter)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to count messages")
+	}
+
+	if count > transcriptInlineLimit {
+		job, err := startTranscriptJob(c, tenantID, format, title, fileName, filter, map[string]interface{}{
+			"customer_id": c.Param("id"),
+		})
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create export job")
+		}
+		return c.JSON(http.StatusAccepted, map[string]interface{}{
+			"message": "Transcript is large and is being exported in the background",
+			"job":     job,
+		})
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, export.ContentType(format))
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", fileName))
+	res.WriteHeader(http.StatusOK)
+
+	if _, err := export.WriteTranscript(ctx, db.DB, res, format, title, filter); err != nil {
+		// Headers are already sent, so just log the failure
+		fmt.Printf("[Export] Failed to write transcript: %v\n", err)
+	}
+	return nil
+}
+
+// CreateTranscriptExport starts a background transcript export for the whole
+// tenant (from/to required) or for one customer
+// POST /api/exports/transcripts
+func CreateTranscriptExport(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+
+	var req struct {
+		Format     string `json:"format"`
+		CustomerID string `json:"customer_id"`
+		From       string `json:"from"`
+		To         string `json:"to"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	}
+
+	if req.Format == "" {
+		req.Format = export.FormatCSV
+	}
+	if !export.IsValidFormat(req.Format) {
+		return echo.NewHTTPError(http.StatusBadRequest, "format must be csv, json or html")
+	}
+
+	filter := export.TranscriptFilter{TenantID: tenantID}
+	if err := parseTranscriptRange(&filter, req.From, req.To); err != nil {
+		return err
+	}
+
+	title := "Transkrip Chat"
+	subject := "all"
+	params := map[string]interface{}{}
+
+	if req.CustomerID != "" {
+		err := db.DB.Get(&filter.CustomerJID, `SELECT customer_jid FROM customer_insights WHERE id = $1 AND tenant_id = $2`, req.CustomerID, tenantID)
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusNotFound, "Customer not found")
+		} else if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get customer")
+		}
+		subject = strings.SplitN(filter.CustomerJID, "@", 2)[0]
+		title += " " + subject
+		params["customer_id"] = req.CustomerID
+	} else if filter.From == nil || filter.To == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "from and to are required when exporting all chats")
+	}
+
+	if filter.From != nil && filter.To != nil {
+		title += fmt.Sprintf(" %s - %s", filter.From.Format("02 Jan 2006"), filter.To.Format("02 Jan 2006"))
+	}
+
+	job, err := startTranscriptJob(c, tenantID, req.Format, title, transcriptFileName(subject, req.Format), filter, params)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create export job")
+	}
+
+	return c.JSON(http.StatusAccepted, job)
+}
+
+// GetExportJobs returns the tenant's recent export jobs
+// GET /api/exports
+func GetExportJobs(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found")
+	}
+
+	var jobs []export.Job
+	err := db.DB.Select(&jobs, `
+		SELECT `+export.JobColumns+`
+		FROM export_jobs
+		WHERE tenant_id = $1
+		ORDER BY created_at DESC
+		LIMIT 50
+	`, tenantID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get export jobs")
+	}
+	if jobs == nil {
+		jobs = []export.Job{}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"items": jobs,
+		"total": len(jobs),
+	})
+}
+
+// GetExportJob returns one export job; poll it until status is completed
+// GET /api/exports/:id
+func GetExportJob(c echo.Context) error {
+	job, err := getExportJob(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, job)
+}
+
+// DownloadExport downloads the file of a completed export job
+// GET /api/exports/:id/download
+func DownloadExport(c echo.Context) error {
+	job, err := getExportJob(c)
+	if err != nil {
+		return err
+	}
+
+	if job.Status != "completed" || job.FilePath == nil {
+		return echo.NewHTTPError(http.StatusConflict, "Export is not ready yet")
+	}
+
+	fileName := job.ID + "." + job.Format
+	if job.FileName != nil {
+		fileName = *job.FileName
+	}
+	return c.Attachment(*job.FilePath, fileName)
+}
+
+// getExportJob loads the export job in the :id param for the active tenant
+func getExportJob(c echo.Context) (*export.Job, error) {
+	tenantID := getTenantIDFromContext(c)
+
+	var job export.Job
+	err := db.DB.Get(&job, `SELECT `+export.JobColumns+` FROM export_jobs WHERE id = $1 AND tenant_id = $2`, c.Param("id"), tenantID)
+	if err == sql.ErrNoRows {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Export not found")
+	} else if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Failed to get export")
+	}
+	return &job, nil
+}
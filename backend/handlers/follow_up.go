@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gowa-backend/db"
+	"gowa-backend/services/followup"
+	"gowa-backend/services/templating"
+	"gowa-backend/services/whatsapp"
+
+	"github.com/labstack/echo/v4"
+)
+
+// followUpError maps service failures to HTTP errors
+func followUpError(err error, message string) error {
+	switch {
+	case err == sql.ErrNoRows:
+		return echo.NewHTTPError(http.StatusNotFound, "Open follow-up task not found")
+	case errors.Is(err, followup.ErrInvalidTask):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return echo.NewHTTPError(http.StatusInternalServerError, message)
+}
+
+// GetFollowUps lists follow-up tasks, soonest due first. assigned_to takes a
+// user ID, "me" or "none"; status takes open (default), done, cancelled or all.
+// GET /api/follow-ups?status=&assigned_to=&customer_id=&overdue=true&due_before=&page=&limit=
+func GetFollowUps(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found")
+	}
+
+	filter := followup.Filter{
+		Status:     c.QueryParam("status"),
+		AssignedTo: c.QueryParam("assigned_to"),
+		CustomerID: c.QueryParam("customer_id"),
+		Overdue:    c.QueryParam("overdue") == "true",
+	}
+	if filter.AssignedTo == "me" {
+		filter.AssignedTo = getUserIDFromContext(c)
+	}
+	switch filter.Status {
+	case "", followup.StatusOpen, followup.StatusDone, followup.StatusCancelled, "all":
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "status must be open, done, cancelled or all")
+	}
+	if v := c.QueryParam("due_before"); v != "" {
+		dueBefore, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "due_before must be an RFC 3339 time")
+		}
+		filter.DueBefore = &dueBefore
+	}
+
+	page, _ := strconv.Atoi(c.QueryParam("page"))
+	if page < 1 {
+		page = 1
+	}
+	limit, _ := strconv.Atoi(c.QueryParam("limit"))
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	tasks, total, err := followup.NewService(db.DB).List(c.Request().Context(), tenantID, filter, limit, (page-1)*limit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get follow-up tasks")
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"items":       tasks,
+		"total":       total,
+		"page":        page,
+		"limit":       limit,
+		"total_pages": (total + limit - 1) / limit,
+	})
+}
+
+// GetFollowUp returns a follow-up task
+// GET /api/follow-ups/:id
+func GetFollowUp(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+
+	task, err := followup.NewService(db.DB).Get(c.Request().Context(), tenantID, c.Param("id"))
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "Follow-up task not found")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get follow-up task")
+	}
+	return c.JSON(http.StatusOK, task)
+}
+
+// CreateFollowUp creates a follow-up task for a customer. Without due_at it
+// is due now; without assigned_to it goes to the conversation's assignee.
+// POST /api/follow-ups
+func CreateFollowUp(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found")
+	}
+
+	var req followup.Input
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	}
+
+	task, err := followup.NewService(db.DB).Create(c.Request().Context(), tenantID, req, getUserIDFromContext(c))
+	if err != nil {
+		return followUpError(err, "Failed to create follow-up task")
+	}
+	return c.JSON(http.StatusCreated, task)
+}
+
+// UpdateFollowUp changes the due time, assignee or note of an open task.
+// An empty assigned_to unassigns it.
+// PUT /api/follow-ups/:id
+func UpdateFollowUp(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+
+	var req followup.Input
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	}
+
+	task, err := followup.NewService(db.DB).Update(c.Request().Context(), tenantID, c.Param("id"), req)
+	if err != nil {
+		return followUpError(err, "Failed to update follow-up task")
+	}
+	return c.JSON(http.StatusOK, task)
+}
+
+// CompleteFollowUp marks an open task done
+// POST /api/follow-ups/:id/complete
+func CompleteFollowUp(c echo.Context) error {
+	return closeFollowUp(c, followup.StatusDone)
+}
+
+// CancelFollowUp cancels an open task
+// POST /api/follow-ups/:id/cancel
+func CancelFollowUp(c echo.Context) error {
+	return closeFollowUp(c, followup.StatusCancelled)
+}
+
+func closeFollowUp(c echo.Context, status string) error {
+	tenantID := getTenantIDFromContext(c)
+
+	task, err := followup.NewService(db.DB).Close(c.Request().Context(), tenantID, c.Param("id"), status, getUserIDFromContext(c))
+	if err != nil {
+		return followUpError(err, "Failed to update follow-up task")
+	}
+	return c.JSON(http.StatusOK, task)
+}
+
+// SnoozeFollowUp moves an open task's due time to until, or minutes from now
+// POST /api/follow-ups/:id/snooze
+func SnoozeFollowUp(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+
+	var req struct {
+		Until   *time.Time `json:"until"`
+		Minutes int        `json:"minutes"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	}
+
+	var until time.Time
+	switch {
+	case req.Until != nil:
+		until = *req.Until
+	case req.Minutes > 0 && req.Minutes <= 60*24*90:
+		until = time.Now().Add(time.Duration(req.Minutes) * time.Minute)
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "Provide until, or minutes between 1 and 129600")
+	}
+
+	task, err := followup.NewService(db.DB).Snooze(c.Request().Context(), tenantID, c.Param("id"), until)
+	if err != nil {
+		return followUpError(err, "Failed to snooze follow-up task")
+	}
+	return c.JSON(http.StatusOK, task)
+}
+
+// SendFollowUpTemplate sends a message template, personalized for the task's
+// customer, and unless complete is false marks the task done
+// POST /api/follow-ups/:id/send-template
+func SendFollowUpTemplate(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	ctx := c.Request().Context()
+
+	var req struct {
+		TemplateID string `json:"template_id"`
+		Complete   *bool  `json:"complete"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	}
+	if req.TemplateID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "template_id is required")
+	}
+
+	svc := followup.NewService(db.DB)
+	task, err := svc.Get(ctx, tenantID, c.Param("id"))
+	if err == sql.ErrNoRows || (err == nil && task.Status != followup.StatusOpen) {
+		return echo.NewHTTPError(http.StatusNotFound, "Open follow-up task not found")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get follow-up task")
+	}
+
+	var content string
+	err = db.DB.Get(&content, `SELECT content FROM message_templates WHERE id::text = $1 AND tenant_id = $2`, req.TemplateID, tenantID)
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "Template not found")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get template")
+	}
+
+	personalizer, err := templating.NewService(db.DB).Personalizer(ctx, tenantID, content)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to prepare template")
+	}
+	message, err := personalizer.Render(ctx, task.CustomerID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to personalize template")
+	}
+
+	sendCtx := whatsapp.WithSender(ctx, whatsapp.SentByAgent, getUserIDFromContext(c))
+	messageID, err := whatsappService.SendMessage(sendCtx, tenantID, task.CustomerJID, message)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadGateway, "Failed to send message: "+err.Error())
+	}
+	db.DB.Exec(`UPDATE message_templates SET usage_count = usage_count + 1, updated_at = NOW() WHERE id = $1`, req.TemplateID)
+
+	if req.Complete == nil || *req.Complete {
+		if task, err = svc.Close(ctx, tenantID, task.ID, followup.StatusDone, getUserIDFromContext(c)); err != nil {
+			return followUpError(err, "Message sent but failed to complete the task")
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message_id": messageID,
+		"message":    message,
+		"task":       task,
+	})
+}
@@ -102,7 +102,8 @@ func GoogleAuthCallback(c echo.Context) error {
 	// Auto-create tenant if it doesn't exist (similar to email registration)
 	// This is mandatory - login will fail if tenant creation fails
 	var existingTenantID string
-	tenantCheckQuery := `SELECT id FROM tenants WHERE user_id = $1 AND is_active = true LIMIT 1`
+	tenantCheckQuery := `SELECT tm.tenant_id FROM tenant_members tm JOIN tenants t ON t.id = tm.tenant_id
+	                     WHERE tm.user_id = $1 AND t.is_active = true LIMIT 1`
 	err = db.DB.QueryRow(tenantCheckQuery, user.ID).Scan(&existingTenantID)
 	if err == sql.ErrNoRows {
 		// Tenant doesn't exist, create one (mandatory)
@@ -121,6 +122,9 @@ func GoogleAuthCallback(c echo.Context) error {
 				"error": "Gagal membuat tenant. Silakan coba lagi nanti atau hubungi administrator.",
 			})
 		}
+		if err := addTenantMember(tenantID, user.ID, models.RoleOwner, nil); err != nil {
+			c.Logger().Errorf("Failed to add owner membership for Google user %s: %v", user.ID, err)
+		}
 		c.Logger().Infof("Auto-created tenant %s for Google user %s", tenantID, user.ID)
 	} else if err != nil {
 		// Database error while checking tenant - fail login
@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"gowa-backend/db"
+	"gowa-backend/services/leadscore"
+
+	"github.com/labstack/echo/v4"
+)
+
+// GetLeadScoringModel returns the tenant's lead scoring model, or the
+// default model when none was saved
+// GET /api/lead-scoring
+func GetLeadScoringModel(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found")
+	}
+
+	model, err := leadscore.NewService(db.DB).Model(c.Request().Context(), tenantID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get lead scoring model")
+	}
+
+	return c.JSON(http.StatusOK, model)
+}
+
+// UpdateLeadScoringModel saves the tenant's lead scoring model. Fields left
+// out keep their defaults. All customers are rescored in the background.
+// PUT /api/lead-scoring
+func UpdateLeadScoringModel(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found")
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request().Body, 64*1024))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	}
+
+	model, err := leadscore.ParseModel(body)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	svc := leadscore.NewService(db.DB)
+	if err := svc.SaveModel(c.Request().Context(), tenantID, getUserIDFromContext(c), model); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to save lead scoring model")
+	}
+
+	go func() {
+		if _, err := svc.RecomputeTenant(context.Background(), tenantID, leadscore.ReasonRecompute); err != nil {
+			fmt.Printf("[LeadScore] Failed to rescore tenant %s: %v\n", tenantID, err)
+		}
+	}()
+
+	return c.JSON(http.StatusOK, model)
+}
+
+// RecomputeLeadScores rescores all of the tenant's customers now
+// POST /api/lead-scoring/recompute
+func RecomputeLeadScores(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found")
+	}
+
+	changed, err := leadscore.NewService(db.DB).RecomputeTenant(c.Request().Context(), tenantID, leadscore.ReasonRecompute)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to recompute lead scores")
+	}
+
+	return c.JSON(http.StatusOK, map[string]int{"changed": changed})
+}
+
+// GetCustomerLeadScore explains a customer's score with the current model
+// GET /api/customers/:id/lead-score
+func GetCustomerLeadScore(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	customerID := c.Param("id")
+
+	var current struct {
+		LeadScore int  `db:"lead_score" json:"lead_score"`
+		Locked    bool `db:"lead_score_locked" json:"locked"`
+	}
+	err := db.DB.Get(&current, `
+		SELECT COALESCE(lead_score, 0) as lead_score, lead_score_locked
+		FROM customer_insights WHERE id = $1 AND tenant_id = $2
+	`, customerID, tenantID)
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "Customer not found")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get lead score")
+	}
+
+	breakdown, err := leadscore.NewService(db.DB).Explain(c.Request().Context(), tenantID, customerID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to explain lead score")
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"lead_score": current.LeadScore,
+		"locked":     current.Locked,
+		"breakdown":  breakdown,
+	})
+}
+
+// GetCustomerLeadScoreHistory returns why a customer's score changed over time
+// GET /api/customers/:id/lead-score/history?page=&limit=
+func GetCustomerLeadScoreHistory(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	customerID := c.Param("id")
+
+	var exists bool
+	db.DB.Get(&exists, `SELECT EXISTS(SELECT 1 FROM customer_insights WHERE id = $1 AND tenant_id = $2)`, customerID, tenantID)
+	if !exists {
+		return echo.NewHTTPError(http.StatusNotFound, "Customer not found")
+	}
+
+	page, _ := strconv.Atoi(c.QueryParam("page"))
+	if page < 1 {
+		page = 1
+	}
+	limit, _ := strconv.Atoi(c.QueryParam("limit"))
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	entries, total, err := leadscore.NewService(db.DB).History(c.Request().Context(), tenantID, customerID, limit, (page-1)*limit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get lead score history")
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"items":       entries,
+		"total":       total,
+		"page":        page,
+		"limit":       limit,
+		"total_pages": (total + limit - 1) / limit,
+	})
+}
@@ -0,0 +1,491 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+
+	"gowa-backend/db"
+	"gowa-backend/models"
+	"gowa-backend/services/email"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// invitationTTL is how long an invitation link stays valid
+const invitationTTL = 7 * 24 * time.Hour
+
+var mailer = email.NewMailerFromEnv()
+
+// addTenantMember adds a user to a tenant, keeping the existing role if already a member
+func addTenantMember(tenantID, userID, role string, invitedBy *string) error {
+	_, err := db.DB.Exec(`
+		INSERT INTO tenant_members (tenant_id, user_id, role, invited_by)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (tenant_id, user_id) DO NOTHING
+	`, tenantID, userID, role, invitedBy)
+	return err
+}
+
+// GetTenantMembers returns the members of the active tenant
+// GET /api/tenant/members
+func GetTenantMembers(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found. Please create a tenant first.")
+	}
+
+	var members []models.TenantMember
+	query := `
+		SELECT tm.id, tm.tenant_id, tm.user_id, u.email, u.full_name, tm.role, tm.created_at
+		FROM tenant_members tm
+		JOIN users u ON u.id = tm.user_id
+		WHERE tm.tenant_id = $1
+		ORDER BY CASE tm.role WHEN 'owner' THEN 0 WHEN 'admin' THEN 1 WHEN 'agent' THEN 2 ELSE 3 END, tm.created_at ASC
+	`
+	if err := db.DB.Select(&members, query, tenantID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get members")
+	}
+
+	if members == nil {
+		members = []models.TenantMember{}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"members": members,
+		"total":   len(members),
+	})
+}
+
+// UpdateTenantMember changes a member's role
+// PUT /api/tenant/members/:userId
+func UpdateTenantMember(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	actorRole := getTenantRoleFromContext(c)
+	memberUserID := c.Param("userId")
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	}
+
+	if !models.IsValidRole(req.Role) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid role")
+	}
+
+	var currentRole string
+	err := db.DB.Get(&currentRole, `SELECT role FROM tenant_members WHERE tenant_id = $1 AND user_id = $2`, tenantID, memberUserID)
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "Member not found")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get member")
+	}
+
+	// Only owners may grant or take away the owner role
+	if (req.Role == models.RoleOwner || currentRole == models.RoleOwner) && actorRole != models.RoleOwner {
+		return echo.NewHTTPError(http.StatusForbidden, "Only an owner can change owner roles")
+	}
+
+	if currentRole == models.RoleOwner && req.Role != models.RoleOwner {
+		if err := ensureAnotherOwner(tenantID, memberUserID); err != nil {
+			return err
+		}
+	}
+
+	_, err = db.DB.Exec(`
+		UPDATE tenant_members SET role = $1, updated_at = NOW()
+		WHERE tenant_id = $2 AND user_id = $3
+	`, req.Role, tenantID, memberUserID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to update member")
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Member updated"})
+}
+
+// RemoveTenantMember removes a user from the active tenant
+// DELETE /api/tenant/members/:userId
+func RemoveTenantMember(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	actorRole := getTenantRoleFromContext(c)
+	memberUserID := c.Param("userId")
+
+	var currentRole string
+	err := db.DB.Get(&currentRole, `SELECT role FROM tenant_members WHERE tenant_id = $1 AND user_id = $2`, tenantID, memberUserID)
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "Member not found")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get member")
+	}
+
+	if currentRole == models.RoleOwner {
+		if actorRole != models.RoleOwner {
+			return echo.NewHTTPError(http.StatusForbidden, "Only an owner can remove an owner")
+		}
+		if err := ensureAnotherOwner(tenantID, memberUserID); err != nil {
+			return err
+		}
+	}
+
+	_, err = db.DB.Exec(`DELETE FROM tenant_members WHERE tenant_id = $1 AND user_id = $2`, tenantID, memberUserID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to remove member")
+	}
+
+	// Conversations of the removed member go back to the unassigned queue
+	db.DB.Exec(`
+		UPDATE conversations SET assigned_to = NULL, assigned_at = NULL, assigned_by = NULL, updated_at = NOW()
+		WHERE tenant_id = $1 AND assigned_to = $2
+	`, tenantID, memberUserID)
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Member removed"})
+}
+
+// ensureAnotherOwner makes sure a tenant keeps at least one owner besides userID
+func ensureAnotherOwner(tenantID, userID string) error {
+	var otherOwners int
+	err := db.DB.Get(&otherOwners, `
+		SELECT COUNT(*) FROM tenant_members
+		WHERE tenant_id = $1 AND role = 'owner' AND user_id <> $2
+	`, tenantID, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to check owners")
+	}
+	if otherOwners == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "A tenant must keep at least one owner")
+	}
+	return nil
+}
+
+// GetInvitations returns pending invitations of the active tenant
+// GET /api/tenant/invitations
+func GetInvitations(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+
+	var invitations []models.TenantInvitation
+	query := `
+		SELECT id, tenant_id, email, role, token, invited_by, expires_at, accepted_at, created_at
+		FROM tenant_invitations
+		WHERE tenant_id = $1 AND accepted_at IS NULL AND expires_at > NOW()
+		ORDER BY created_at DESC
+	`
+	if err := db.DB.Select(&invitations, query, tenantID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get invitations")
+	}
+
+	if invitations == nil {
+		invitations = []models.TenantInvitation{}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"invitations": invitations,
+		"total":       len(invitations),
+	})
+}
+
+// CreateInvitation invites someone by email to join the active tenant
+// POST /api/tenant/invitations
+func CreateInvitation(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	actorRole := getTenantRoleFromContext(c)
+	userID := getUserIDFromContext(c)
+
+	var req struct {
+		Email string `json:"email"`
+		Role  string `json:"role"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	}
+
+	addr, err := mail.ParseAddress(strings.TrimSpace(req.Email))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "A valid email is required")
+	}
+	req.Email = strings.ToLower(addr.Address)
+
+	if req.Role == "" {
+		req.Role = models.RoleAgent
+	}
+	if !models.IsValidRole(req.Role) || req.Role == models.RoleOwner {
+		return echo.NewHTTPError(http.StatusBadRequest, "Role must be admin, agent or viewer")
+	}
+	if !models.RoleAtLeast(actorRole, req.Role) {
+		return echo.NewHTTPError(http.StatusForbidden, "Cannot invite with a role higher than your own")
+	}
+
+	// Skip if the email already belongs to a member
+	var alreadyMember bool
+	err = db.DB.Get(&alreadyMember, `
+		SELECT EXISTS(
+			SELECT 1 FROM tenant_members tm JOIN users u ON u.id = tm.user_id
+			WHERE tm.tenant_id = $1 AND LOWER(u.email) = $2
+		)
+	`, tenantID, req.Email)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to check membership")
+	}
+	if alreadyMember {
+		return echo.NewHTTPError(http.StatusConflict, "User is already a member of this tenant")
+	}
+
+	token, err := generateInvitationToken()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to generate invitation token")
+	}
+
+	var invitation models.TenantInvitation
+	query := `
+		INSERT INTO tenant_invitations (tenant_id, email, role, token, invited_by, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, tenant_id, email, role, token, invited_by, expires_at, accepted_at, created_at
+	`
+	err = db.DB.Get(&invitation, query, tenantID, req.Email, req.Role, token, userID, time.Now().Add(invitationTTL))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create invitation")
+	}
+
+	var businessName string
+	db.DB.Get(&businessName, `SELECT business_name FROM tenants WHERE id = $1`, tenantID)
+
+	acceptURL := invitationAcceptURL(token)
+	body := fmt.Sprintf("Anda diundang untuk bergabung dengan %s sebagai %s.\n\nBuka tautan berikut untuk menerima undangan:\n%s\n\nTautan berlaku sampai %s.",
+		businessName, req.Role, acceptURL, invitation.ExpiresAt.Format("02 Jan 2006 15:04"))
+	if err := mailer.Send(req.Email, "Undangan bergabung dengan "+businessName, body); err != nil {
+		log.Printf("[Invitation] Failed to email invitation %s: %v", invitation.ID, err)
+	}
+
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"invitation": invitation,
+		"accept_url": acceptURL,
+	})
+}
+
+// RevokeInvitation deletes a pending invitation
+// DELETE /api/tenant/invitations/:id
+func RevokeInvitation(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	invitationID := c.Param("id")
+
+	result, err := db.DB.Exec(`
+		DELETE FROM tenant_invitations
+		WHERE id = $1 AND tenant_id = $2 AND accepted_at IS NULL
+	`, invitationID, tenantID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to revoke invitation")
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "Invitation not found")
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Invitation revoked"})
+}
+
+// AcceptInvitation adds the authenticated user to the inviting tenant
+// POST /api/invitations/accept
+func AcceptInvitation(c echo.Context) error {
+	userID := getUserIDFromContext(c)
+	if userID == "" {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Unauthorized")
+	}
+
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := c.Bind(&req); err != nil || req.Token == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invitation token is required")
+	}
+
+	var invitation models.TenantInvitation
+	err := db.DB.Get(&invitation, `
+		SELECT id, tenant_id, email, role, token, invited_by, expires_at, accepted_at, created_at
+		FROM tenant_invitations WHERE token = $1
+	`, req.Token)
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "Invitation not found")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get invitation")
+	}
+
+	if invitation.AcceptedAt != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invitation has already been used")
+	}
+	if time.Now().After(invitation.ExpiresAt) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invitation has expired")
+	}
+
+	var userEmail string
+	if err := db.DB.Get(&userEmail, `SELECT email FROM users WHERE id = $1`, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get user")
+	}
+	if !strings.EqualFold(userEmail, invitation.Email) {
+		return echo.NewHTTPError(http.StatusForbidden, "This invitation was sent to a different email address")
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO tenant_members (tenant_id, user_id, role, invited_by)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (tenant_id, user_id) DO UPDATE SET role = EXCLUDED.role, updated_at = NOW()
+		WHERE tenant_members.role <> 'owner'
+	`, invitation.TenantID, userID, invitation.Role, invitation.InvitedBy)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to join tenant")
+	}
+
+	_, err = tx.Exec(`UPDATE tenant_invitations SET accepted_at = NOW(), accepted_by = $1 WHERE id = $2`, userID, invitation.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to accept invitation")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to accept invitation")
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message":   "Invitation accepted",
+		"tenant_id": invitation.TenantID,
+		"role":      invitation.Role,
+	})
+}
+
+// GetMyTenants lists every tenant the user belongs to
+// GET /api/tenants
+func GetMyTenants(c echo.Context) error {
+	userID := getUserIDFromContext(c)
+	if userID == "" {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Unauthorized")
+	}
+
+	var tenants []models.TenantMembership
+	query := `
+		SELECT tm.tenant_id, t.business_name, tm.role
+		FROM tenant_members tm
+		JOIN tenants t ON t.id = tm.tenant_id
+		WHERE tm.user_id = $1 AND t.is_active = true
+		ORDER BY t.business_name ASC
+	`
+	if err := db.DB.Select(&tenants, query, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get tenants")
+	}
+
+	currentTenantID := getTenantIDFromContext(c)
+	for i := range tenants {
+		tenants[i].IsCurrent = tenants[i].TenantID == currentTenantID
+	}
+
+	if tenants == nil {
+		tenants = []models.TenantMembership{}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"tenants": tenants,
+		"total":   len(tenants),
+	})
+}
+
+// SwitchTenant issues a new token bound to another tenant the user belongs to
+// POST /api/tenants/switch
+func SwitchTenant(c echo.Context) error {
+	userID := getUserIDFromContext(c)
+	if userID == "" {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Unauthorized")
+	}
+
+	var req struct {
+		TenantID string `json:"tenant_id"`
+	}
+	if err := c.Bind(&req); err != nil || req.TenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "tenant_id is required")
+	}
+
+	var role string
+	err := db.DB.Get(&role, `
+		SELECT tm.role FROM tenant_members tm
+		JOIN tenants t ON t.id = tm.tenant_id
+		WHERE tm.tenant_id = $1 AND tm.user_id = $2 AND t.is_active = true
+	`, req.TenantID, userID)
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusForbidden, "You are not a member of this tenant")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to check membership")
+	}
+
+	var userRole string
+	db.DB.Get(&userRole, `SELECT role FROM users WHERE id = $1`, userID)
+
+	t, err := signUserToken(userID, userRole, req.TenantID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Gagal membuat token")
+	}
+
+	cookie := new(http.Cookie)
+	cookie.Name = "token"
+	cookie.Value = t
+	cookie.Expires = time.Now().Add(72 * time.Hour)
+	cookie.Path = "/"
+	cookie.HttpOnly = true
+	cookie.Secure = os.Getenv("ENV") == "production"
+	cookie.SameSite = http.SameSiteLaxMode
+	c.SetCookie(cookie)
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"token":     t,
+		"tenant_id": req.TenantID,
+		"role":      role,
+	})
+}
+
+// signUserToken creates a JWT for a user, optionally bound to a tenant
+func signUserToken(userID, userRole, tenantID string) (string, error) {
+	jwtSecret := os.Getenv("JWT_SECRET")
+	if jwtSecret == "" {
+		return "", fmt.Errorf("JWT_SECRET is not set")
+	}
+
+	token := jwt.New(jwt.SigningMethodHS256)
+	claims := token.Claims.(jwt.MapClaims)
+	claims["user_id"] = userID
+	claims["role"] = userRole
+	if tenantID != "" {
+		claims["tenant_id"] = tenantID
+	}
+	claims["exp"] = time.Now().Add(time.Hour * 72).Unix() // 3 days
+
+	return token.SignedString([]byte(jwtSecret))
+}
+
+// generateInvitationToken returns a random hex token for invitation links
+func generateInvitationToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// invitationAcceptURL builds the frontend link used to accept an invitation
+func invitationAcceptURL(token string) string {
+	frontendURL := os.Getenv("FRONTEND_URL")
+	if frontendURL == "" {
+		frontendURL = "http://localhost:3000"
+	}
+	return fmt.Sprintf("%s/invitations/accept?token=%s", strings.TrimRight(frontendURL, "/"), token)
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gowa-backend/db"
+	"gowa-backend/services/scheduledmsg"
+
+	"github.com/labstack/echo/v4"
+)
+
+// scheduledMessageError maps service failures to HTTP errors
+func scheduledMessageError(err error, message string) error {
+	switch {
+	case err == sql.ErrNoRows:
+		return echo.NewHTTPError(http.StatusNotFound, "Pending scheduled message not found")
+	case errors.Is(err, scheduledmsg.ErrInvalidMessage):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return echo.NewHTTPError(http.StatusInternalServerError, message)
+}
+
+// GetScheduledMessages lists scheduled messages, soonest first. status takes
+// pending, sending, sent, failed, cancelled or all; without it cancelled
+// messages are left out. from and to bound the send time.
+// GET /api/scheduled-messages?status=&customer_id=&from=&to=&page=&limit=
+func GetScheduledMessages(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found")
+	}
+
+	filter := scheduledmsg.Filter{
+		Status:     c.QueryParam("status"),
+		CustomerID: c.QueryParam("customer_id"),
+	}
+	switch filter.Status {
+	case "", scheduledmsg.StatusPending, scheduledmsg.StatusSending, scheduledmsg.StatusSent,
+		scheduledmsg.StatusFailed, scheduledmsg.StatusCancelled, "all":
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "status must be pending, sending, sent, failed, cancelled or all")
+	}
+	if v := c.QueryParam("from"); v != "" {
+		from, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "from must be an RFC 3339 time")
+		}
+		filter.From = &from
+	}
+	if v := c.QueryParam("to"); v != "" {
+		to, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "to must be an RFC 3339 time")
+		}
+		filter.To = &to
+	}
+
+	page, _ := strconv.Atoi(c.QueryParam("page"))
+	if page < 1 {
+		page = 1
+	}
+	limit, _ := strconv.Atoi(c.QueryParam("limit"))
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	messages, total, err := scheduledmsg.NewService(db.DB).List(c.Request().Context(), tenantID, filter, limit, (page-1)*limit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get scheduled messages")
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"items":       messages,
+		"total":       total,
+		"page":        page,
+		"limit":       limit,
+		"total_pages": (total + limit - 1) / limit,
+	})
+}
+
+// GetScheduledMessage returns a scheduled message
+// GET /api/scheduled-messages/:id
+func GetScheduledMessage(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+
+	msg, err := scheduledmsg.NewService(db.DB).Get(c.Request().Context(), tenantID, c.Param("id"))
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "Scheduled message not found")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get scheduled message")
+	}
+	return c.JSON(http.StatusOK, msg)
+}
+
+// CreateScheduledMessage schedules a text and/or media message to a
+// customer. send_at is an RFC 3339 time or a local time read in timezone,
+// the tenant's by default.
+// POST /api/scheduled-messages
+func CreateScheduledMessage(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found")
+	}
+
+	var req scheduledmsg.Input
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	}
+
+	msg, err := scheduledmsg.NewService(db.DB).Create(c.Request().Context(), tenantID, req, getUserIDFromContext(c))
+	if err != nil {
+		return scheduledMessageError(err, "Failed to schedule message")
+	}
+	return c.JSON(http.StatusCreated, msg)
+}
+
+// UpdateScheduledMessage changes the text, media or send time of a message
+// that has not been picked up for sending yet. An empty media_url removes
+// the media.
+// PUT /api/scheduled-messages/:id
+func UpdateScheduledMessage(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+
+	var req scheduledmsg.Input
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	}
+
+	msg, err := scheduledmsg.NewService(db.DB).Update(c.Request().Context(), tenantID, c.Param("id"), req)
+	if err != nil {
+		return scheduledMessageError(err, "Failed to update scheduled message")
+	}
+	return c.JSON(http.StatusOK, msg)
+}
+
+// CancelScheduledMessage cancels a message that has not been picked up for
+// sending yet
+// POST /api/scheduled-messages/:id/cancel
+func CancelScheduledMessage(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+
+	msg, err := scheduledmsg.NewService(db.DB).Cancel(c.Request().Context(), tenantID, c.Param("id"), getUserIDFromContext(c))
+	if err != nil {
+		return scheduledMessageError(err, "Failed to cancel scheduled message")
+	}
+	return c.JSON(http.StatusOK, msg)
+}
@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gowa-backend/db"
+	"gowa-backend/services/conversation"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Snippet match markers. Postgres marks matches with these private use
+// characters, stripped from the message beforehand, so the snippet can be
+// escaped before the markers become <mark> tags.
+const (
+	snippetStart = "\uE000"
+	snippetStop  = "\uE001"
+)
+
+var snippetMarks = strings.NewReplacer(snippetStart, "<mark>", snippetStop, "</mark>")
+
+// highlight HTML-escapes a search snippet and marks its matches
+func highlight(snippet string) string {
+	return snippetMarks.Replace(html.EscapeString(snippet))
+}
+
+// MessageSearchResult is a message matching a full-text search
+type MessageSearchResult struct {
+	ID             string    `json:"id" db:"id"`
+	MessageID      string    `json:"message_id" db:"message_id"`
+	MessageType    string    `json:"message_type" db:"message_type"`
+	IsFromMe       bool      `json:"is_from_me" db:"is_from_me"`
+	Timestamp      int64     `json:"-" db:"timestamp"`
+	SentAt         time.Time `json:"timestamp" db:"sent_at"`
+	CustomerJID    string    `json:"customer_jid" db:"customer_jid"`
+	CustomerID     *string   `json:"customer_id" db:"customer_id"`
+	CustomerName   *string   `json:"customer_name" db:"customer_name"`
+	ConversationID *string   `json:"conversation_id" db:"conversation_id"`
+	Snippet        string    `json:"snippet" db:"snippet"`
+	Rank           float64   `json:"rank" db:"rank"`
+	HistoryCursor  string    `json:"history_cursor" db:"-"`
+}
+
+// parseDateParam accepts YYYY-MM-DD or RFC3339. endOfDay moves plain dates
+// to the end of that day so "to" is inclusive.
+func parseDateParam(value string, endOfDay bool) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, true
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Second)
+	}
+	return t, true
+}
+
+// SearchMessages runs a full-text search over message text and captions.
+// Snippets wrap matches in <mark></mark>. Open a hit with
+// GET /api/conversations/:conversation_id/messages?cursor=:history_cursor
+// GET /api/messages/search?q=&from=&to=&direction=incoming|outgoing&customer_id=&tag_id=&type=&page=&limit=
+func SearchMessages(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found")
+	}
+
+	q := strings.TrimSpace(c.QueryParam("q"))
+	if q == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Query parameter q is required")
+	}
+
+	page, _ := strconv.Atoi(c.QueryParam("page"))
+	if page < 1 {
+		page = 1
+	}
+	limit, _ := strconv.Atoi(c.QueryParam("limit"))
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	// The customer side of a message: sender for incoming, chat for outgoing
+	customerJIDExpr := `CASE WHEN m.is_from_me THEN m.chat_jid ELSE m.sender_jid END`
+
+	baseQuery := `
+		FROM whatsapp_messages m
+		CROSS JOIN websearch_to_tsquery('simple', $2) q
+		LEFT JOIN customer_insights ci ON ci.tenant_id = m.tenant_id AND ci.customer_jid = ` + customerJIDExpr + `
+		LEFT JOIN conversations conv ON conv.tenant_id = m.tenant_id AND conv.customer_jid = ` + customerJIDExpr + `
+		WHERE m.tenant_id = $1 AND m.is_group = false AND m.search_vector @@ q
+	`
+	args := []interface{}{tenantID, q}
+	argCount := 2
+
+	if from := c.QueryParam("from"); from != "" {
+		t, ok := parseDateParam(from, false)
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid from date")
+		}
+		argCount++
+		baseQuery += ` AND m.timestamp >= $` + strconv.Itoa(argCount)
+		args = append(args, t.Unix())
+	}
+
+	if to := c.QueryParam("to"); to != "" {
+		t, ok := parseDateParam(to, true)
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid to date")
+		}
+		argCount++
+		baseQuery += ` AND m.timestamp <= $` + strconv.Itoa(argCount)
+		args = append(args, t.Unix())
+	}
+
+	switch c.QueryParam("direction") {
+	case "", "all":
+	case "incoming":
+		baseQuery += ` AND m.is_from_me = false`
+	case "outgoing":
+		baseQuery += ` AND m.is_from_me = true`
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "direction must be incoming or outgoing")
+	}
+
+	if customerID := c.QueryParam("customer_id"); customerID != "" {
+		argCount++
+		baseQuery += ` AND ci.id::text = $` + strconv.Itoa(argCount)
+		args = append(args, customerID)
+	}
+
+	if tagID := c.QueryParam("tag_id"); tagID != "" {
+		argCount++
+		baseQuery += ` AND EXISTS (
+			SELECT 1 FROM customer_tag_assignments cta
+			WHERE cta.customer_id = ci.id AND cta.tag_id::text = $` + strconv.Itoa(argCount) + `
+		)`
+		args = append(args, tagID)
+	}
+
+	if messageType := c.QueryParam("type"); messageType != "" {
+		argCount++
+		baseQuery += ` AND m.message_type = $` + strconv.Itoa(argCount)
+		args = append(args, messageType)
+	}
+
+	var total int
+	if err := db.DB.Get(&total, "SELECT COUNT(*) "+baseQuery, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to search messages")
+	}
+
+	selectQuery := `
+		SELECT
+			m.id, m.message_id, COALESCE(m.message_type, 'text') as message_type, m.is_from_me,
+			m.timestamp, to_timestamp(m.timestamp) as sent_at,
+			` + customerJIDExpr + ` as customer_jid,
+			ci.id::text as customer_id, ci.customer_name, conv.id::text as conversation_id,
+			ts_headline('simple', translate(COALESCE(m.message_text, '') || ' ' || COALESCE(m.caption, ''), E'\uE000\uE001', ''), q,
+				E'StartSel=\uE000, StopSel=\uE001, MaxWords=25, MinWords=8, MaxFragments=2') as snippet,
+			ts_rank(m.search_vector, q) as rank
+		` + baseQuery + `
+		ORDER BY rank DESC, m.timestamp DESC
+		LIMIT $` + strconv.Itoa(argCount+1) + ` OFFSET $` + strconv.Itoa(argCount+2)
+	args = append(args, limit, (page-1)*limit)
+
+	var results []MessageSearchResult
+	if err := db.DB.Select(&results, selectQuery, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to search messages")
+	}
+	if results == nil {
+		results = []MessageSearchResult{}
+	}
+
+	for i := range results {
+		results[i].Snippet = highlight(results[i].Snippet)
+		results[i].HistoryCursor = conversation.CursorAt(results[i].Timestamp)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"items":       results,
+		"total":       total,
+		"page":        page,
+		"limit":       limit,
+		"total_pages": (total + limit - 1) / limit,
+	})
+}
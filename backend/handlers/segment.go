@@ -0,0 +1,268 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gowa-backend/db"
+	"gowa-backend/services/segment"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+)
+
+// segmentRequest is the body for creating/updating segments
+type segmentRequest struct {
+	Name        string         `json:"name"`
+	Description *string        `json:"description"`
+	Filter      segment.Filter `json:"filter"`
+}
+
+// validate trims the name and checks the filter compiles
+func (r *segmentRequest) validate() error {
+	r.Name = strings.TrimSpace(r.Name)
+	if r.Name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Name is required")
+	}
+	if err := r.Filter.Validate(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return nil
+}
+
+// segmentSaveError maps insert/update failures to HTTP errors
+func segmentSaveError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return echo.NewHTTPError(http.StatusConflict, "A segment with this name already exists")
+	}
+	return echo.NewHTTPError(http.StatusInternalServerError, "Failed to save segment")
+}
+
+// GetSegments returns the tenant's saved segments
+// GET /api/segments?with_counts=true
+func GetSegments(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found")
+	}
+
+	var segments []segment.Segment
+	err := db.DB.Select(&segments, `SELECT `+segment.Columns+` FROM customer_segments WHERE tenant_id = $1 ORDER BY name ASC`, tenantID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get segments")
+	}
+	if segments == nil {
+		segments = []segment.Segment{}
+	}
+
+	svc := segment.NewService(db.DB)
+	withCounts := c.QueryParam("with_counts") == "true"
+	for i := range segments {
+		segments[i].DecodeFilter()
+		if withCounts {
+			if count, err := svc.Count(c.Request().Context(), tenantID, segments[i].Filter, false); err == nil {
+				segments[i].MemberCount = &count
+			}
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"items": segments,
+		"total": len(segments),
+	})
+}
+
+// GetSegment returns a segment with its current member count
+// GET /api/segments/:id
+func GetSegment(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	ctx := c.Request().Context()
+	svc := segment.NewService(db.DB)
+
+	seg, err := svc.Get(ctx, tenantID, c.Param("id"))
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "Segment not found")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get segment")
+	}
+
+	count, err := svc.Count(ctx, tenantID, seg.Filter, false)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to count segment members")
+	}
+	seg.MemberCount = &count
+
+	return c.JSON(http.StatusOK, seg)
+}
+
+// CreateSegment saves a new segment
+// POST /api/segments
+func CreateSegment(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+
+	var req segmentRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	}
+	if err := req.validate(); err != nil {
+		return err
+	}
+
+	var createdBy *string
+	if userID := getUserIDFromContext(c); userID != "" {
+		createdBy = &userID
+	}
+
+	filterJSON, _ := json.Marshal(req.Filter)
+
+	var seg segment.Segment
+	err := db.DB.Get(&seg, `
+		INSERT INTO customer_segments (tenant_id, name, description, filter, created_by)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING `+segment.Columns,
+		tenantID, req.Name, req.Description, string(filterJSON), createdBy)
+	if err != nil {
+		return segmentSaveError(err)
+	}
+	seg.DecodeFilter()
+
+	return c.JSON(http.StatusCreated, seg)
+}
+
+// UpdateSegment replaces a segment's name, description and filter. Broadcasts
+// targeting it use the new filter the next time they are sent.
+// PUT /api/segments/:id
+func UpdateSegment(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+
+	var req segmentRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	}
+	if err := req.validate(); err != nil {
+		return err
+	}
+
+	filterJSON, _ := json.Marshal(req.Filter)
+
+	var seg segment.Segment
+	err := db.DB.Get(&seg, `
+		UPDATE customer_segments
+		SET name = $1, description = $2, filter = $3, updated_at = NOW()
+		WHERE id = $4 AND tenant_id = $5
+		RETURNING `+segment.Columns,
+		req.Name, req.Description, string(filterJSON), c.Param("id"), tenantID)
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "Segment not found")
+	} else if err != nil {
+		return segmentSaveError(err)
+	}
+	seg.DecodeFilter()
+
+	return c.JSON(http.StatusOK, seg)
+}
+
+// DeleteSegment removes a segment. Broadcasts that targeted it keep the
+// recipients already added.
+// DELETE /api/segments/:id
+func DeleteSegment(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+
+	result, err := db.DB.Exec(`DELETE FROM customer_segments WHERE id = $1 AND tenant_id = $2`, c.Param("id"), tenantID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to delete segment")
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "Segment not found")
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Segment deleted"})
+}
+
+// PreviewSegment evaluates an unsaved filter and returns the member count,
+// how many of them can receive broadcasts, and a sample of members
+// POST /api/segments/preview
+func PreviewSegment(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found")
+	}
+
+	var req struct {
+		Filter segment.Filter `json:"filter"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	}
+	if err := req.Filter.Validate(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	ctx := c.Request().Context()
+	svc := segment.NewService(db.DB)
+
+	total, err := svc.Count(ctx, tenantID, req.Filter, false)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to evaluate segment")
+	}
+	reachable, err := svc.Count(ctx, tenantID, req.Filter, true)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to evaluate segment")
+	}
+	sample, err := svc.Members(ctx, tenantID, req.Filter, 20, 0)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to evaluate segment")
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"total":     total,
+		"reachable": reachable,
+		"sample":    sample,
+	})
+}
+
+// GetSegmentCustomers returns the segment's current members
+// GET /api/segments/:id/customers?page=&limit=
+func GetSegmentCustomers(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	ctx := c.Request().Context()
+	svc := segment.NewService(db.DB)
+
+	seg, err := svc.Get(ctx, tenantID, c.Param("id"))
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "Segment not found")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get segment")
+	}
+
+	page, _ := strconv.Atoi(c.QueryParam("page"))
+	if page < 1 {
+		page = 1
+	}
+	limit, _ := strconv.Atoi(c.QueryParam("limit"))
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	total, err := svc.Count(ctx, tenantID, seg.Filter, false)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to count segment members")
+	}
+	members, err := svc.Members(ctx, tenantID, seg.Filter, limit, (page-1)*limit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get segment members")
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"items":       members,
+		"total":       total,
+		"page":        page,
+		"limit":       limit,
+		"total_pages": (total + limit - 1) / limit,
+	})
+}
@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"gowa-backend/db"
+	"gowa-backend/services/sequence"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+)
+
+// validateSequence checks the definition and the templates of its steps
+func validateSequence(c echo.Context, tenantID string, def *sequence.Definition) error {
+	if err := def.Validate(tenantID); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	for _, step := range def.Steps {
+		if step.MessageContent == "" {
+			continue
+		}
+		if _, err := checkTemplateContent(c, tenantID, step.MessageContent, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sequenceError maps service failures to HTTP errors
+func sequenceError(err error, message string) error {
+	var pqErr *pq.Error
+	switch {
+	case err == sql.ErrNoRows:
+		return echo.NewHTTPError(http.StatusNotFound, "Sequence not found")
+	case errors.Is(err, sequence.ErrInvalidSequence):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	case errors.As(err, &pqErr) && pqErr.Code == "23505":
+		return echo.NewHTTPError(http.StatusConflict, "A sequence with this name already exists")
+	}
+	return echo.NewHTTPError(http.StatusInternalServerError, message)
+}
+
+// GetSequences returns the tenant's drip sequences
+// GET /api/sequences
+func GetSequences(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found")
+	}
+
+	sequences := []sequence.Sequence{}
+	err := db.DB.Select(&sequences, `SELECT `+sequence.Columns+` FROM sequences s WHERE s.tenant_id = $1 ORDER BY s.name ASC`, tenantID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get sequences")
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"items": sequences,
+		"total": len(sequences),
+	})
+}
+
+// GetSequence returns a sequence with its steps
+// GET /api/sequences/:id
+func GetSequence(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+
+	seq, err := sequence.NewService(db.DB).Get(c.Request().Context(), tenantID, c.Param("id"))
+	if err != nil {
+		return sequenceError(err, "Failed to get sequence")
+	}
+	return c.JSON(http.StatusOK, seq)
+}
+
+// CreateSequence saves a new sequence with its steps
+// POST /api/sequences
+func CreateSequence(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found")
+	}
+
+	var def sequence.Definition
+	if err := c.Bind(&def); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	}
+	if err := validateSequence(c, tenantID, &def); err != nil {
+		return err
+	}
+
+	seq, err := sequence.NewService(db.DB).Save(c.Request().Context(), tenantID, "", def, getUserIDFromContext(c))
+	if err != nil {
+		return sequenceError(err, "Failed to save sequence")
+	}
+	return c.JSON(http.StatusCreated, seq)
+}
+
+// UpdateSequence replaces a sequence's definition. Enrolled customers
+// continue with the new steps from the position they reached.
+// PUT /api/sequences/:id
+func UpdateSequence(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+
+	var def sequence.Definition
+	if err := c.Bind(&def); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	}
+	if err := validateSequence(c, tenantID, &def); err != nil {
+		return err
+	}
+
+	seq, err := sequence.NewService(db.DB).Save(c.Request().Context(), tenantID, c.Param("id"), def, "")
+	if err != nil {
+		return sequenceError(err, "Failed to save sequence")
+	}
+	return c.JSON(http.StatusOK, seq)
+}
+
+// DeleteSequence removes a sequence, ending its enrollments
+// DELETE /api/sequences/:id
+func DeleteSequence(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+
+	if err := sequence.NewService(db.DB).Delete(c.Request().Context(), tenantID, c.Param("id")); err != nil {
+		return sequenceError(err, "Failed to delete sequence")
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Sequence deleted"})
+}
+
+// EnrollSequence enrolls customers by ID, everyone carrying a tag, or the
+// current members of a segment. Customers already in the sequence, opted
+// out or in group chats are skipped.
+// POST /api/sequences/:id/enroll
+func EnrollSequence(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+
+	var req struct {
+		CustomerIDs []string `json:"customer_ids"`
+		TagID       string   `json:"tag_id"`
+		SegmentID   string   `json:"segment_id"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	}
+
+	audiences := 0
+	for _, set := range []bool{len(req.CustomerIDs) > 0, req.TagID != "", req.SegmentID != ""} {
+		if set {
+			audiences++
+		}
+	}
+	if audiences != 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Provide exactly one of customer_ids, tag_id or segment_id")
+	}
+
+	ctx := c.Request().Context()
+	svc := sequence.NewService(db.DB)
+	sequenceID, userID := c.Param("id"), getUserIDFromContext(c)
+
+	var enrolled int
+	var err error
+	switch {
+	case len(req.CustomerIDs) > 0:
+		enrolled, err = svc.EnrollCustomers(ctx, tenantID, sequenceID, req.CustomerIDs, userID)
+	case req.TagID != "":
+		enrolled, err = svc.EnrollTag(ctx, tenantID, sequenceID, req.TagID, userID)
+	default:
+		if err = svc.Exists(ctx, tenantID, sequenceID); err == nil {
+			enrolled, err = svc.EnrollSegment(ctx, tenantID, sequenceID, req.SegmentID, userID)
+			if err == sql.ErrNoRows {
+				return echo.NewHTTPError(http.StatusNotFound, "Segment not found")
+			}
+		}
+	}
+	if err != nil {
+		return sequenceError(err, "Failed to enroll customers")
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message":  "Customers enrolled",
+		"enrolled": enrolled,
+	})
+}
+
+// GetSequenceEnrollments returns the sequence's enrollments
+// GET /api/sequences/:id/enrollments?status=&page=&limit=
+func GetSequenceEnrollments(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	ctx := c.Request().Context()
+	svc := sequence.NewService(db.DB)
+
+	if err := svc.Exists(ctx, tenantID, c.Param("id")); err != nil {
+		return sequenceError(err, "Failed to get sequence")
+	}
+
+	page, _ := strconv.Atoi(c.QueryParam("page"))
+	if page < 1 {
+		page = 1
+	}
+	limit, _ := strconv.Atoi(c.QueryParam("limit"))
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	enrollments, total, err := svc.Enrollments(ctx, tenantID, c.Param("id"), c.QueryParam("status"), limit, (page-1)*limit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get enrollments")
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"items":       enrollments,
+		"total":       total,
+		"page":        page,
+		"limit":       limit,
+		"total_pages": (total + limit - 1) / limit,
+	})
+}
+
+// CancelSequenceEnrollment takes a customer out of a sequence
+// DELETE /api/sequences/:id/enrollments/:enrollmentId
+func CancelSequenceEnrollment(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+
+	err := sequence.NewService(db.DB).Cancel(c.Request().Context(), tenantID, c.Param("id"), c.Param("enrollmentId"))
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "Active enrollment not found")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to cancel enrollment")
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Enrollment cancelled"})
+}
+
+// GetSequenceStats returns enrollment counts and the performance of each step
+// GET /api/sequences/:id/stats?window_hours=72
+func GetSequenceStats(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+
+	window, err := replyWindow(c)
+	if err != nil {
+		return err
+	}
+	stats, err := sequence.NewService(db.DB).Stats(c.Request().Context(), tenantID, c.Param("id"), window)
+	if err != nil {
+		return sequenceError(err, "Failed to get sequence stats")
+	}
+	return c.JSON(http.StatusOK, stats)
+}
@@ -1,10 +1,16 @@
 package handlers
 
 import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"time"
 
 	"gowa-backend/db"
+	"gowa-backend/services/leadscore"
+	"gowa-backend/services/tagrules"
 
 	"github.com/labstack/echo/v4"
 )
@@ -18,6 +24,50 @@ type Tag struct {
 	Description   string    `db:"description" json:"description"`
 	CustomerCount int       `db:"customer_count" json:"customer_count"`
 	CreatedAt     time.Time `db:"created_at" json:"created_at"`
+
+	AutoApplyRules *tagrules.Rules `db:"-" json:"auto_apply_rules"`
+	RulesJSON      *string         `db:"auto_apply_rules" json:"-"`
+}
+
+// decodeRules fills AutoApplyRules from the stored JSON
+func (t *Tag) decodeRules() {
+	if t.RulesJSON != nil {
+		json.Unmarshal([]byte(*t.RulesJSON), &t.AutoApplyRules)
+	}
+}
+
+// parseTagRules validates auto_apply_rules from a request body. It returns
+// the JSON to store, or nil when the rules are cleared.
+func parseTagRules(raw json.RawMessage) (*string, *tagrules.Rules, error) {
+	rules, err := tagrules.Parse(raw)
+	if err != nil {
+		return nil, nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if rules == nil {
+		return nil, nil, nil
+	}
+	data, _ := json.Marshal(rules)
+	stored := string(data)
+	return &stored, rules, nil
+}
+
+// applyTagRules runs a tag's rules right after they are saved so users don't
+// wait for the next sweep
+func applyTagRules(c echo.Context, tenantID, tagID string, rules *tagrules.Rules) {
+	if rules == nil || !rules.Enabled {
+		return
+	}
+	if _, err := tagrules.NewService(db.DB).ApplyTag(c.Request().Context(), tenantID, tagID); err != nil {
+		fmt.Printf("[Tags] Failed to apply rules of tag %s: %v\n", tagID, err)
+	}
+}
+
+// applyCustomerTagRules re-evaluates tag rules after a customer is edited,
+// e.g. when the lead score or purchase count changes
+func applyCustomerTagRules(c echo.Context, tenantID, customerID string) {
+	if _, err := tagrules.NewService(db.DB).ApplyCustomer(c.Request().Context(), tenantID, customerID); err != nil {
+		fmt.Printf("[Tags] Failed to apply tag rules to customer %s: %v\n", customerID, err)
+	}
 }
 
 // CustomerNote represents a note about a customer
@@ -39,11 +89,11 @@ func GetTags(c echo.Context) error {
 			t.id, t.tenant_id, t.name, t.color, 
 			COALESCE(t.description, '') as description,
 			COUNT(cta.customer_id) as customer_count,
-			t.created_at
+			t.created_at, t.auto_apply_rules::text as auto_apply_rules
 		FROM customer_tags t
 		LEFT JOIN customer_tag_assignments cta ON t.id = cta.tag_id
 		WHERE t.tenant_id = $1
-		GROUP BY t.id, t.tenant_id, t.name, t.color, t.description, t.created_at
+		GROUP BY t.id, t.tenant_id, t.name, t.color, t.description, t.created_at, t.auto_apply_rules
 		ORDER BY t.created_at DESC
 	`
 
@@ -51,6 +101,9 @@ func GetTags(c echo.Context) error {
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get tags")
 	}
+	for i := range tags {
+		tags[i].decodeRules()
+	}
 
 	return c.JSON(http.StatusOK, tags)
 }
@@ -61,9 +114,10 @@ func CreateTag(c echo.Context) error {
 	tenantID := getTenantIDFromContext(c)
 
 	var req struct {
-		Name        string `json:"name" validate:"required"`
-		Color       string `json:"color"`
-		Description string `json:"description"`
+		Name           string          `json:"name" validate:"required"`
+		Color          string          `json:"color"`
+		Description    string          `json:"description"`
+		AutoApplyRules json.RawMessage `json:"auto_apply_rules"`
 	}
 
 	if err := c.Bind(&req); err != nil {
@@ -78,20 +132,28 @@ func CreateTag(c echo.Context) error {
 		req.Color = "#6366f1"
 	}
 
+	rulesJSON, rules, err := parseTagRules(req.AutoApplyRules)
+	if err != nil {
+		return err
+	}
+
 	var tag Tag
 	query := `
-		INSERT INTO customer_tags (tenant_id, name, color, description)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO customer_tags (tenant_id, name, color, description, auto_apply_rules)
+		VALUES ($1, $2, $3, $4, $5::jsonb)
 		RETURNING id, tenant_id, name, color, description, customer_count, created_at
 	`
 
-	err := db.DB.QueryRow(query, tenantID, req.Name, req.Color, req.Description).Scan(
+	err = db.DB.QueryRow(query, tenantID, req.Name, req.Color, req.Description, rulesJSON).Scan(
 		&tag.ID, &tag.TenantID, &tag.Name, &tag.Color, &tag.Description, &tag.CustomerCount, &tag.CreatedAt,
 	)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create tag: "+err.Error())
 	}
 
+	tag.AutoApplyRules = rules
+	applyTagRules(c, tenantID, tag.ID, rules)
+
 	return c.JSON(http.StatusCreated, tag)
 }
 
@@ -101,26 +163,34 @@ func UpdateTag(c echo.Context) error {
 	tenantID := getTenantIDFromContext(c)
 	tagID := c.Param("id")
 
+	// auto_apply_rules is only changed when present; null clears the rules
 	var req struct {
-		Name        string `json:"name"`
-		Color       string `json:"color"`
-		Description string `json:"description"`
+		Name           string          `json:"name"`
+		Color          string          `json:"color"`
+		Description    string          `json:"description"`
+		AutoApplyRules json.RawMessage `json:"auto_apply_rules"`
 	}
 
 	if err := c.Bind(&req); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
 	}
 
+	rulesJSON, rules, err := parseTagRules(req.AutoApplyRules)
+	if err != nil {
+		return err
+	}
+
 	query := `
 		UPDATE customer_tags 
 		SET name = COALESCE(NULLIF($1, ''), name),
 			color = COALESCE(NULLIF($2, ''), color),
 			description = $3,
+			auto_apply_rules = CASE WHEN $6 THEN $7::jsonb ELSE auto_apply_rules END,
 			updated_at = NOW()
 		WHERE id = $4 AND tenant_id = $5
 	`
 
-	result, err := db.DB.Exec(query, req.Name, req.Color, req.Description, tagID, tenantID)
+	result, err := db.DB.Exec(query, req.Name, req.Color, req.Description, tagID, tenantID, len(req.AutoApplyRules) > 0, rulesJSON)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to update tag")
 	}
@@ -130,6 +200,8 @@ func UpdateTag(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusNotFound, "Tag not found")
 	}
 
+	applyTagRules(c, tenantID, tagID, rules)
+
 	return c.JSON(http.StatusOK, map[string]string{"message": "Tag updated"})
 }
 
@@ -338,7 +410,9 @@ func DeleteCustomerNote(c echo.Context) error {
 	return c.JSON(http.StatusOK, map[string]string{"message": "Note deleted"})
 }
 
-// UpdateCustomerLeadScore updates a customer's lead score
+// UpdateCustomerLeadScore sets a customer's lead score by hand. The score is
+// locked so the scoring engine doesn't overwrite it; send {"auto": true}
+// to unlock it and let the engine score the customer again.
 // PUT /api/customers/:id/lead-score
 func UpdateCustomerLeadScore(c echo.Context) error {
 	tenantID := getTenantIDFromContext(c)
@@ -347,12 +421,34 @@ func UpdateCustomerLeadScore(c echo.Context) error {
 	var req struct {
 		LeadScore int    `json:"lead_score"`
 		Status    string `json:"status"`
+		Auto      bool   `json:"auto"`
 	}
 
 	if err := c.Bind(&req); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
 	}
 
+	ctx := c.Request().Context()
+	scores := leadscore.NewService(db.DB)
+
+	if req.Auto {
+		result, err := db.DB.Exec(`
+			UPDATE customer_insights SET lead_score_locked = false, updated_at = NOW()
+			WHERE id = $1 AND tenant_id = $2
+		`, customerID, tenantID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to update lead score")
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			return echo.NewHTTPError(http.StatusNotFound, "Customer not found")
+		}
+		if _, err := scores.RecomputeCustomer(ctx, tenantID, customerID, leadscore.ReasonRecompute); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to recompute lead score")
+		}
+		applyCustomerTagRules(c, tenantID, customerID)
+		return c.JSON(http.StatusOK, map[string]string{"message": "Lead score is scored automatically again"})
+	}
+
 	// Validate lead score
 	if req.LeadScore < 0 || req.LeadScore > 100 {
 		return echo.NewHTTPError(http.StatusBadRequest, "Lead score must be between 0 and 100")
@@ -367,9 +463,24 @@ func UpdateCustomerLeadScore(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "Invalid status")
 	}
 
+	var old struct {
+		LeadScore int    `db:"lead_score"`
+		Status    string `db:"status"`
+	}
+	err := db.DB.Get(&old, `
+		SELECT COALESCE(lead_score, 0) as lead_score, COALESCE(status, 'new') as status
+		FROM customer_insights WHERE id = $1 AND tenant_id = $2
+	`, customerID, tenantID)
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "Customer not found")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to update lead score")
+	}
+
 	query := `
 		UPDATE customer_insights 
-		SET lead_score = $1, status = COALESCE(NULLIF($2, ''), status), updated_at = NOW()
+		SET lead_score = $1, status = COALESCE(NULLIF($2, ''), status),
+			lead_score_locked = true, lead_score_updated_at = NOW(), updated_at = NOW()
 		WHERE id = $3 AND tenant_id = $4
 	`
 
@@ -383,6 +494,16 @@ func UpdateCustomerLeadScore(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusNotFound, "Customer not found")
 	}
 
+	newStatus := old.Status
+	if req.Status != "" {
+		newStatus = req.Status
+	}
+	if err := scores.RecordManual(ctx, tenantID, customerID, getUserIDFromContext(c), old.LeadScore, req.LeadScore, old.Status, newStatus); err != nil {
+		fmt.Printf("[LeadScore] Failed to record manual change: %v\n", err)
+	}
+
+	applyCustomerTagRules(c, tenantID, customerID)
+
 	return c.JSON(http.StatusOK, map[string]string{"message": "Lead score updated"})
 }
 
@@ -430,3 +551,57 @@ func GetCustomersByTag(c echo.Context) error {
 	return c.JSON(http.StatusOK, customers)
 }
 
+// TestTagRules evaluates auto-apply rules against the tenant's current
+// customers without changing any tags. With tag_id, the result also shows
+// how many assignments applying the rules would add and remove.
+// POST /api/tags/rules/test
+func TestTagRules(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found")
+	}
+
+	var req struct {
+		TagID string         `json:"tag_id"`
+		Rules tagrules.Rules `json:"rules"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	}
+	if err := req.Rules.Validate(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if req.TagID != "" {
+		var exists bool
+		db.DB.Get(&exists, `SELECT EXISTS(SELECT 1 FROM customer_tags WHERE id = $1 AND tenant_id = $2)`, req.TagID, tenantID)
+		if !exists {
+			return echo.NewHTTPError(http.StatusNotFound, "Tag not found")
+		}
+	}
+
+	result, err := tagrules.NewService(db.DB).Test(c.Request().Context(), tenantID, req.TagID, req.Rules)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to test rules")
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
+
+// ApplyTagRules runs a tag's saved rules against all customers now
+// POST /api/tags/:id/rules/apply
+func ApplyTagRules(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+
+	result, err := tagrules.NewService(db.DB).ApplyTag(c.Request().Context(), tenantID, c.Param("id"))
+	switch {
+	case errors.Is(err, tagrules.ErrNoRules):
+		return echo.NewHTTPError(http.StatusNotFound, "Tag not found or it has no enabled rules")
+	case errors.Is(err, tagrules.ErrInvalidRules):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	case err != nil:
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to apply rules")
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
@@ -1,11 +1,18 @@
 package handlers
 
 import (
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"regexp"
+	"strings"
 	"time"
 
 	"gowa-backend/db"
+	"gowa-backend/services/customfields"
+	"gowa-backend/services/templating"
 
 	"github.com/labstack/echo/v4"
 )
@@ -100,11 +107,14 @@ func CreateTemplate(c echo.Context) error {
 		req.Category = "general"
 	}
 
-	// Convert variables to JSON string
-	variablesJSON := "[]"
-	if len(req.Variables) > 0 {
-		variablesJSON = `["` + joinStrings(req.Variables, `","`) + `"]`
+	variables, err := templateVariables(req.Variables)
+	if err != nil {
+		return err
+	}
+	if _, err := checkTemplateContent(c, tenantID, req.Content, variables); err != nil {
+		return err
 	}
+	variablesJSON, _ := json.Marshal(variables)
 
 	var template Template
 	query := `
@@ -113,7 +123,7 @@ func CreateTemplate(c echo.Context) error {
 		RETURNING id, tenant_id, name, category, content, variables, is_active, usage_count, created_at, updated_at
 	`
 
-	if err := db.DB.Get(&template, query, tenantID, req.Name, req.Category, req.Content, variablesJSON); err != nil {
+	if err := db.DB.Get(&template, query, tenantID, req.Name, req.Category, req.Content, string(variablesJSON)); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create template")
 	}
 
@@ -141,6 +151,41 @@ func UpdateTemplate(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
 	}
 
+	// Content and variables are checked together, so load whichever is unchanged
+	var variablesJSON string
+	if req.Content != "" || req.Variables != nil {
+		var current struct {
+			Content   string `db:"content"`
+			Variables string `db:"variables"`
+		}
+		err := db.DB.Get(&current, `SELECT content, COALESCE(variables, '[]'::jsonb)::text as variables FROM message_templates WHERE id = $1 AND tenant_id = $2`, templateID, tenantID)
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusNotFound, "Template not found")
+		} else if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get template")
+		}
+
+		declared := req.Variables
+		if declared == nil {
+			json.Unmarshal([]byte(current.Variables), &declared)
+		}
+		variables, err := templateVariables(declared)
+		if err != nil {
+			return err
+		}
+		content := req.Content
+		if content == "" {
+			content = current.Content
+		}
+		if _, err := checkTemplateContent(c, tenantID, content, variables); err != nil {
+			return err
+		}
+		if req.Variables != nil {
+			data, _ := json.Marshal(variables)
+			variablesJSON = string(data)
+		}
+	}
+
 	// Build update query dynamically
 	query := `UPDATE message_templates SET updated_at = NOW()`
 	args := []interface{}{}
@@ -161,8 +206,7 @@ func UpdateTemplate(c echo.Context) error {
 		args = append(args, req.Content)
 		argNum++
 	}
-	if len(req.Variables) > 0 {
-		variablesJSON := `["` + joinStrings(req.Variables, `","`) + `"]`
+	if variablesJSON != "" {
 		query += `, variables = $` + itoa(argNum)
 		args = append(args, variablesJSON)
 		argNum++
@@ -226,18 +270,143 @@ func IncrementTemplateUsage(c echo.Context) error {
 	return c.JSON(http.StatusOK, map[string]string{"message": "Usage count updated"})
 }
 
-// Helper functions
-func joinStrings(strs []string, sep string) string {
-	if len(strs) == 0 {
-		return ""
+// templateVariablePattern is what a declared template variable may be named
+var templateVariablePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,49}$`)
+
+// templateVariables lowercases and deduplicates declared variables
+func templateVariables(names []string) ([]string, error) {
+	variables := []string{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || seen[name] {
+			continue
+		}
+		if !templateVariablePattern.MatchString(name) {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid variable name: "+name)
+		}
+		seen[name] = true
+		variables = append(variables, name)
+	}
+	return variables, nil
+}
+
+// checkTemplateContent parses message content and checks that every
+// variable is built in, a custom field of the tenant or declared
+func checkTemplateContent(c echo.Context, tenantID, content string, declared []string) (*templating.Template, error) {
+	tmpl, err := templating.Parse(content)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	definitions, err := customfields.NewService(db.DB).Definitions(c.Request().Context(), tenantID)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Failed to get custom fields")
+	}
+	keys := make([]string, len(definitions))
+	for i, d := range definitions {
+		keys[i] = d.Key
+	}
+
+	if err := tmpl.Check(keys, declared); err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return tmpl, nil
+}
+
+// GetTemplateVariables lists the variables templates can use: the built-in
+// ones and the tenant's custom fields
+// GET /api/templates/variables
+func GetTemplateVariables(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found. Please create a tenant first.")
+	}
+
+	definitions, err := customfields.NewService(db.DB).Definitions(c.Request().Context(), tenantID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get custom fields")
+	}
+	custom := make([]templating.Variable, len(definitions))
+	for i, d := range definitions {
+		custom[i] = templating.Variable{Name: "custom." + d.Key, Description: d.Label}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"builtins":      templating.Builtins,
+		"custom_fields": custom,
+	})
+}
+
+// PreviewTemplate renders a saved template or unsaved content for a chosen
+// customer, as broadcasts, auto-replies and quick replies would send it.
+// Without a customer only business and date variables have values.
+// POST /api/templates/preview
+func PreviewTemplate(c echo.Context) error {
+	tenantID := getTenantIDFromContext(c)
+	if tenantID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Tenant not found. Please create a tenant first.")
 	}
-	result := strs[0]
-	for i := 1; i < len(strs); i++ {
-		result += sep + strs[i]
+
+	var req struct {
+		TemplateID string            `json:"template_id"`
+		Content    string            `json:"content"`
+		CustomerID string            `json:"customer_id"`
+		Variables  map[string]string `json:"variables"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	}
+
+	declared := []string{}
+	if req.TemplateID != "" {
+		var saved struct {
+			Content   string `db:"content"`
+			Variables string `db:"variables"`
+		}
+		err := db.DB.Get(&saved, `SELECT content, COALESCE(variables, '[]'::jsonb)::text as variables FROM message_templates WHERE id = $1 AND tenant_id = $2`, req.TemplateID, tenantID)
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusNotFound, "Template not found")
+		} else if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get template")
+		}
+		if req.Content == "" {
+			req.Content = saved.Content
+		}
+		json.Unmarshal([]byte(saved.Variables), &declared)
 	}
-	return result
+	if req.Content == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "template_id or content is required")
+	}
+	for name := range req.Variables {
+		declared = append(declared, name)
+	}
+
+	tmpl, err := checkTemplateContent(c, tenantID, req.Content, declared)
+	if err != nil {
+		return err
+	}
+
+	data, err := templating.NewService(db.DB).Data(c.Request().Context(), tenantID, req.CustomerID, req.Variables)
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "Customer not found")
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to load template data")
+	}
+
+	rendered, missing := tmpl.Render(data)
+	if missing == nil {
+		missing = []string{}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"content":   rendered,
+		"variables": tmpl.Variables(),
+		"missing":   missing,
+	})
 }
 
+// Helper functions
 func itoa(n int) string {
 	return fmt.Sprintf("%d", n)
 }
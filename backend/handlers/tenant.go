@@ -6,6 +6,7 @@ import (
 
 	"gowa-backend/db"
 	"gowa-backend/models"
+	"gowa-backend/services/recurrence"
 
 	"github.com/labstack/echo/v4"
 )
@@ -18,6 +19,7 @@ func CreateTenant(c echo.Context) error {
 		BusinessDescription string `json:"business_description"`
 		BusinessPhone       string `json:"business_phone"`
 		BusinessAddress     string `json:"business_address"`
+		Timezone            string `json:"timezone"`
 	}
 
 	if err := c.Bind(&req); err != nil {
@@ -26,6 +28,17 @@ func CreateTenant(c echo.Context) error {
 		})
 	}
 
+	timezone := recurrence.DefaultTimezone
+	if req.Timezone != "" {
+		tz, err := recurrence.NormalizeTimezone(req.Timezone)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Invalid timezone",
+			})
+		}
+		timezone = tz
+	}
+
 	// Get user ID from JWT (for now, use a placeholder)
 	userID := getUserIDFromContext(c)
 	if userID == "" {
@@ -36,8 +49,8 @@ func CreateTenant(c echo.Context) error {
 
 	// Create tenant
 	query := `
-		INSERT INTO tenants (user_id, business_name, business_type, business_description, business_phone, business_address, is_active)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		INSERT INTO tenants (user_id, business_name, business_type, business_description, business_phone, business_address, is_active, timezone)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
 		RETURNING id, created_at, updated_at
 	`
 
@@ -50,6 +63,7 @@ func CreateTenant(c echo.Context) error {
 		req.BusinessPhone,
 		req.BusinessAddress,
 		true, // is_active
+		timezone,
 	).Scan(&tenant.ID, &tenant.CreatedAt, &tenant.UpdatedAt)
 
 	if err != nil {
@@ -58,12 +72,17 @@ func CreateTenant(c echo.Context) error {
 		})
 	}
 
+	if err := addTenantMember(tenant.ID, userID, models.RoleOwner, nil); err != nil {
+		c.Logger().Warnf("Failed to add owner membership for tenant %s: %v", tenant.ID, err)
+	}
+
 	tenant.UserID = userID
 	tenant.BusinessName = req.BusinessName
 	tenant.BusinessType = req.BusinessType
 	tenant.BusinessDescription = req.BusinessDescription
 	tenant.BusinessPhone = req.BusinessPhone
 	tenant.BusinessAddress = req.BusinessAddress
+	tenant.Timezone = timezone
 	tenant.IsActive = true
 
 	return c.JSON(http.StatusCreated, tenant)
@@ -79,27 +98,32 @@ func GetMyTenant(c echo.Context) error {
 	}
 
 	var tenant models.Tenant
-	// Check for active tenant first, consistent with getTenantIDFromContext
-	query := `SELECT * FROM tenants WHERE user_id = $1 AND is_active = true LIMIT 1`
+	// Return the active tenant, which may be one the user was invited to
+	query := `SELECT id, user_id, business_name, business_type, business_description, business_phone, business_address, timezone, is_active, created_at, updated_at
+	          FROM tenants WHERE id = $1 AND is_active = true`
 	
-	err := db.DB.QueryRow(query, userID).Scan(
-		&tenant.ID,
-		&tenant.UserID,
-		&tenant.BusinessName,
-		&tenant.BusinessType,
-		&tenant.BusinessDescription,
-		&tenant.BusinessPhone,
-		&tenant.BusinessAddress,
-		&tenant.IsActive,
-		&tenant.CreatedAt,
-		&tenant.UpdatedAt,
-	)
+	err := sql.ErrNoRows
+	if tenantID := getTenantIDFromContext(c); tenantID != "" {
+		err = db.DB.QueryRow(query, tenantID).Scan(
+			&tenant.ID,
+			&tenant.UserID,
+			&tenant.BusinessName,
+			&tenant.BusinessType,
+			&tenant.BusinessDescription,
+			&tenant.BusinessPhone,
+			&tenant.BusinessAddress,
+			&tenant.Timezone,
+			&tenant.IsActive,
+			&tenant.CreatedAt,
+			&tenant.UpdatedAt,
+		)
+	}
 
 	if err == sql.ErrNoRows {
 		// Tenant not found - try to auto-create one (for existing users who logged in before auto-create was implemented)
 		businessName := "My Business"
 		tenantQuery := `INSERT INTO tenants (user_id, business_name, business_type, business_description, business_phone, business_address, is_active)
-		                VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, user_id, business_name, business_type, business_description, business_phone, business_address, is_active, created_at, updated_at`
+		                VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, user_id, business_name, business_type, business_description, business_phone, business_address, timezone, is_active, created_at, updated_at`
 		
 		err = db.DB.QueryRow(tenantQuery, userID, businessName, "UMKM", "", "", "", true).Scan(
 			&tenant.ID,
@@ -109,6 +133,7 @@ func GetMyTenant(c echo.Context) error {
 			&tenant.BusinessDescription,
 			&tenant.BusinessPhone,
 			&tenant.BusinessAddress,
+			&tenant.Timezone,
 			&tenant.IsActive,
 			&tenant.CreatedAt,
 			&tenant.UpdatedAt,
@@ -120,6 +145,10 @@ func GetMyTenant(c echo.Context) error {
 				"error": "Tenant not found. Please create a tenant first.",
 			})
 		}
+
+		if err := addTenantMember(tenant.ID, userID, models.RoleOwner, nil); err != nil {
+			c.Logger().Warnf("Failed to add owner membership for tenant %s: %v", tenant.ID, err)
+		}
 		
 		// Successfully auto-created tenant
 		return c.JSON(http.StatusOK, tenant)
@@ -142,6 +171,7 @@ func UpdateTenant(c echo.Context) error {
 		BusinessDescription string `json:"business_description"`
 		BusinessPhone       string `json:"business_phone"`
 		BusinessAddress     string `json:"business_address"`
+		Timezone            string `json:"timezone"`
 	}
 
 	if err := c.Bind(&req); err != nil {
@@ -150,6 +180,17 @@ func UpdateTenant(c echo.Context) error {
 		})
 	}
 
+	// An empty timezone keeps the current one
+	if req.Timezone != "" {
+		tz, err := recurrence.NormalizeTimezone(req.Timezone)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Zona waktu tidak valid",
+			})
+		}
+		req.Timezone = tz
+	}
+
 	// Get user ID from JWT
 	userID := getUserIDFromContext(c)
 	if userID == "" {
@@ -158,10 +199,13 @@ func UpdateTenant(c echo.Context) error {
 		})
 	}
 
-	// Check if tenant exists
-	var existingTenantID string
-	checkQuery := `SELECT id FROM tenants WHERE user_id = $1 LIMIT 1`
-	err := db.DB.QueryRow(checkQuery, userID).Scan(&existingTenantID)
+	// Check if the active tenant exists
+	existingTenantID := getTenantIDFromContext(c)
+	err := sql.ErrNoRows
+	if existingTenantID != "" {
+		checkQuery := `SELECT id FROM tenants WHERE id = $1 LIMIT 1`
+		err = db.DB.QueryRow(checkQuery, existingTenantID).Scan(&existingTenantID)
+	}
 	if err == sql.ErrNoRows {
 		return c.JSON(http.StatusNotFound, map[string]string{
 			"error": "Tenant tidak ditemukan",
@@ -180,9 +224,10 @@ func UpdateTenant(c echo.Context) error {
 		    business_description = $3, 
 		    business_phone = $4, 
 		    business_address = $5,
+		    timezone = COALESCE(NULLIF($7, ''), timezone),
 		    updated_at = NOW()
 		WHERE id = $6
-		RETURNING id, user_id, business_name, business_type, business_description, business_phone, business_address, is_active, created_at, updated_at
+		RETURNING id, user_id, business_name, business_type, business_description, business_phone, business_address, timezone, is_active, created_at, updated_at
 	`
 
 	var tenant models.Tenant
@@ -193,6 +238,7 @@ func UpdateTenant(c echo.Context) error {
 		req.BusinessPhone,
 		req.BusinessAddress,
 		existingTenantID,
+		req.Timezone,
 	).Scan(
 		&tenant.ID,
 		&tenant.UserID,
@@ -201,6 +247,7 @@ func UpdateTenant(c echo.Context) error {
 		&tenant.BusinessDescription,
 		&tenant.BusinessPhone,
 		&tenant.BusinessAddress,
+		&tenant.Timezone,
 		&tenant.IsActive,
 		&tenant.CreatedAt,
 		&tenant.UpdatedAt,
@@ -6,7 +6,7 @@ import (
 	"os"
 	"time"
 
-	"gowa-backend/db"
+	customMiddleware "gowa-backend/middleware"
 	ws "gowa-backend/services/websocket"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -89,10 +89,9 @@ func HandleWebSocket(c echo.Context) error {
 		})
 	}
 
-	// Get tenant_id from database
-	var tenantID string
-	query := `SELECT id FROM tenants WHERE user_id = $1 AND is_active = true LIMIT 1`
-	err = db.DB.QueryRow(query, userID).Scan(&tenantID)
+	// Resolve the active tenant (honours the tenant_id claim set by tenant switching)
+	requestedTenant, _ := claims["tenant_id"].(string)
+	tenantID, _, err := customMiddleware.ResolveTenant(userID, requestedTenant)
 	if err != nil {
 		fmt.Printf("[WebSocket] Failed to get tenant: %v\n", err)
 		return c.JSON(http.StatusUnauthorized, map[string]string{
@@ -113,6 +112,7 @@ func HandleWebSocket(c echo.Context) error {
 	client := &ws.Client{
 		ID:       uuid.New().String(),
 		TenantID: tenantID,
+		UserID:   userID,
 		Conn:     conn,
 		Send:     make(chan []byte, 256),
 	}
@@ -14,7 +14,9 @@ import (
 	"time"
 
 	"gowa-backend/db"
+	customMiddleware "gowa-backend/middleware"
 	"gowa-backend/models"
+	broadcastsvc "gowa-backend/services/broadcast"
 	"gowa-backend/services/redis"
 	"gowa-backend/services/whatsapp"
 
@@ -23,6 +25,7 @@ import (
 
 var whatsappService *whatsapp.ClientService
 var redisClient *redis.Client
+var broadcastEngine *broadcastsvc.Engine
 
 // InitWhatsAppService initializes the WhatsApp service
 func InitWhatsAppService() {
@@ -55,6 +58,9 @@ func InitWhatsAppService() {
 	// db.DB is *sqlx.DB, we need *sql.DB for the service
 	whatsappService = whatsapp.NewClientService(db.DB.DB, redisClient)
 
+	// Broadcasts are queued for the worker, or sent directly without Redis
+	broadcastEngine = broadcastsvc.NewEngine(db.DB, redisClient, whatsappService)
+
 	// Auto-reconnect WhatsApp clients that were previously connected
 	go autoReconnectWhatsAppClients()
 }
@@ -128,6 +134,11 @@ func GetWhatsAppService() *whatsapp.ClientService {
 	return whatsappService
 }
 
+// GetBroadcastEngine returns the broadcast engine instance
+func GetBroadcastEngine() *broadcastsvc.Engine {
+	return broadcastEngine
+}
+
 // ConnectWhatsApp initiates a WhatsApp connection
 func ConnectWhatsApp(c echo.Context) error {
 	fmt.Printf("[DEBUG] ConnectWhatsApp: handler called\n")
@@ -484,7 +495,8 @@ func SendWhatsAppMessage(c echo.Context) error {
 
 	fmt.Printf("[DEBUG] SendWhatsAppMessage: tenantID=%s, recipientJID=%s, message=%s\n", tenantID, req.RecipientJID, req.Message)
 
-	// Send message
+	// Send message, attributed to the agent for transcripts
+	ctx = whatsapp.WithSender(ctx, whatsapp.SentByAgent, getUserIDFromContext(c))
 	messageID, err := whatsappService.SendMessage(ctx, tenantID, req.RecipientJID, req.Message)
 	if err != nil {
 		fmt.Printf("[DEBUG] SendWhatsAppMessage: error sending message: %v\n", err)
@@ -502,11 +514,15 @@ func SendWhatsAppMessage(c echo.Context) error {
 	})
 }
 
-// getTenantIDFromContext extracts tenant ID from JWT claims by:
-// 1. Getting user_id from JWT claims
-// 2. Querying database to get tenant_id for that user
+// getTenantIDFromContext returns the active tenant ID by:
+// 1. Using the tenant resolved by TenantMiddleware (membership aware)
+// 2. Falling back to the tenant owned by the user_id in the JWT claims
 func getTenantIDFromContext(c echo.Context) string {
-	// First, get user_id from JWT
+	if tenantID, ok := c.Get(customMiddleware.ContextTenantID).(string); ok && tenantID != "" {
+		return tenantID
+	}
+
+	// Fall back to the user's own tenant
 	userID := getUserIDFromContext(c)
 	fmt.Printf("[DEBUG] getTenantIDFromContext: userID from getUserIDFromContext = '%s'\n", userID)
 	
@@ -535,6 +551,12 @@ func getTenantIDFromContext(c echo.Context) string {
 	return tenantID
 }
 
+// getTenantRoleFromContext returns the user's role in the active tenant
+func getTenantRoleFromContext(c echo.Context) string {
+	role, _ := c.Get(customMiddleware.ContextTenantRole).(string)
+	return role
+}
+
 // ClearChatMessages deletes all messages for a specific chat/customer
 // DELETE /api/whatsapp/messages/:jid
 func ClearChatMessages(c echo.Context) error {
@@ -643,7 +665,8 @@ func SendWhatsAppMedia(c echo.Context) error {
 
 	fmt.Printf("[DEBUG] SendWhatsAppMedia: tenantID=%s, recipientJID=%s, type=%s, file=%s\n", tenantID, recipientJID, mediaType, file.Filename)
 
-	// Send media message
+	// Send media message, attributed to the agent for transcripts
+	ctx = whatsapp.WithSender(ctx, whatsapp.SentByAgent, getUserIDFromContext(c))
 	messageID, err := whatsappService.SendMediaMessage(ctx, tenantID, recipientJID, mediaData, mediaType, file.Filename, caption)
 	if err != nil {
 		fmt.Printf("[DEBUG] SendWhatsAppMedia: error sending media: %v\n", err)
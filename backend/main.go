@@ -13,7 +13,9 @@ import (
 	"gowa-backend/db"
 	"gowa-backend/handlers"
 	customMiddleware "gowa-backend/middleware"
+	"gowa-backend/models"
 	"gowa-backend/services/ai"
+	"gowa-backend/services/export"
 	"gowa-backend/services/scheduler"
 	"gowa-backend/workers"
 
@@ -36,6 +38,13 @@ func main() {
 		log.Fatal("❌ Failed to run migrations: ", err)
 	}
 
+	// Background exports die with the process; fail those a restart interrupted
+	if n, err := export.RecoverJobs(context.Background(), db.DB); err != nil {
+		log.Println("Warning: Failed to recover export jobs:", err)
+	} else if n > 0 {
+		log.Printf("Failed %d export jobs interrupted by a restart", n)
+	}
+
 	// Initialize WhatsApp Service (includes Redis)
 	handlers.InitWhatsAppService()
 
@@ -53,13 +62,41 @@ func main() {
 		worker := workers.NewMessageWorker(handlers.GetRedisClient(), db.DB, handlers.GetWhatsAppService())
 		ctx := context.Background()
 		go worker.Start(ctx)
-		
-		// Start broadcast scheduler
-		broadcastScheduler := scheduler.NewBroadcastScheduler(db.DB, handlers.GetRedisClient())
-		go broadcastScheduler.Start()
-		log.Println("✅ Broadcast scheduler started")
 	}
 
+	// Start broadcast scheduler (broadcasts are sent directly without Redis)
+	broadcastScheduler := scheduler.NewBroadcastScheduler(db.DB, handlers.GetBroadcastEngine())
+	go broadcastScheduler.Start()
+	log.Println("✅ Broadcast scheduler started")
+
+	// Start conversation scheduler (snooze wake-ups don't need Redis)
+	conversationScheduler := scheduler.NewConversationScheduler(db.DB)
+	go conversationScheduler.Start()
+
+	// Start tag rule sweeps
+	tagRuleScheduler := scheduler.NewTagRuleScheduler(db.DB)
+	go tagRuleScheduler.Start()
+
+	// Start nightly lead scoring
+	leadScoreScheduler := scheduler.NewLeadScoreScheduler(db.DB)
+	go leadScoreScheduler.Start()
+
+	// Start drip sequence sends (steps go straight to WhatsApp, no Redis needed)
+	sequenceScheduler := scheduler.NewSequenceScheduler(db.DB, handlers.GetWhatsAppService())
+	go sequenceScheduler.Start()
+
+	// Start follow-up reminders
+	followUpScheduler := scheduler.NewFollowUpScheduler(db.DB)
+	go followUpScheduler.Start()
+
+	// Start scheduled message sends
+	scheduledMessageScheduler := scheduler.NewScheduledMessageScheduler(db.DB, handlers.GetWhatsAppService())
+	go scheduledMessageScheduler.Start()
+
+	// Start AI customer insight enrichment
+	insightWorker := workers.NewInsightWorker(db.DB)
+	go insightWorker.Start()
+
 	e := EchoServer()
 	
 	port := os.Getenv("PORT")
@@ -151,29 +188,72 @@ func EchoServer() *echo.Echo {
 	api := e.Group("/api")
 	api.Use(customMiddleware.APIRateLimiterMiddleware())
 	api.Use(customMiddleware.JWTMiddleware())
+	api.Use(customMiddleware.TenantMiddleware())
 	api.GET("/me", handlers.GetMe)
 
+	// Role guards: viewers can read, agents can chat, admins manage settings
+	agentOnly := customMiddleware.RequireRole(models.RoleAgent)
+	adminOnly := customMiddleware.RequireRole(models.RoleAdmin)
+
 	// Tenant Routes
 	api.POST("/tenant", handlers.CreateTenant)
 	api.GET("/tenant", handlers.GetMyTenant)
-	api.PUT("/tenant", handlers.UpdateTenant)
+	api.PUT("/tenant", handlers.UpdateTenant, adminOnly)
+	api.GET("/tenant/members", handlers.GetTenantMembers)
+	api.PUT("/tenant/members/:userId", handlers.UpdateTenantMember, adminOnly)
+	api.DELETE("/tenant/members/:userId", handlers.RemoveTenantMember, adminOnly)
+	api.GET("/tenant/invitations", handlers.GetInvitations, adminOnly)
+	api.POST("/tenant/invitations", handlers.CreateInvitation, adminOnly)
+	api.DELETE("/tenant/invitations/:id", handlers.RevokeInvitation, adminOnly)
+	api.POST("/invitations/accept", handlers.AcceptInvitation)
+	api.GET("/tenants", handlers.GetMyTenants)
+	api.POST("/tenants/switch", handlers.SwitchTenant)
 
 	// WhatsApp Routes
 	whatsapp := api.Group("/whatsapp")
-	whatsapp.POST("/connect", handlers.ConnectWhatsApp)
-	whatsapp.DELETE("/disconnect", handlers.DisconnectWhatsApp)
+	whatsapp.POST("/connect", handlers.ConnectWhatsApp, adminOnly)
+	whatsapp.DELETE("/disconnect", handlers.DisconnectWhatsApp, adminOnly)
 	whatsapp.GET("/status", handlers.GetWhatsAppStatus)
-	whatsapp.GET("/qr/stream", handlers.StreamQRCode)
-	whatsapp.POST("/send", handlers.SendWhatsAppMessage)
-	whatsapp.POST("/send/media", handlers.SendWhatsAppMedia)
-	whatsapp.DELETE("/messages/:jid", handlers.ClearChatMessages)
+	whatsapp.GET("/qr/stream", handlers.StreamQRCode, adminOnly)
+	whatsapp.POST("/send", handlers.SendWhatsAppMessage, agentOnly)
+	whatsapp.POST("/send/media", handlers.SendWhatsAppMedia, agentOnly)
+	whatsapp.DELETE("/messages/:jid", handlers.ClearChatMessages, adminOnly)
 
 	// File Upload Route
-	api.POST("/upload", handlers.UploadFile)
+	api.POST("/upload", handlers.UploadFile, agentOnly)
 
 	// Serve uploaded files (static)
 	e.Static("/uploads", "/app/data/uploads")
 
+	// Export Routes
+	exports := api.Group("/exports")
+	exports.GET("", handlers.GetExportJobs)
+	exports.POST("/transcripts", handlers.CreateTranscriptExport, adminOnly)
+	exports.GET("/:id", handlers.GetExportJob)
+	exports.GET("/:id/download", handlers.DownloadExport)
+
+	// Message Search Route
+	api.GET("/messages/search", handlers.SearchMessages)
+
+	// Conversation Inbox & Assignment Routes
+	conversations := api.Group("/conversations")
+	conversations.GET("", handlers.GetConversations)
+	conversations.GET("/agents", handlers.GetOnlineAgents)
+	conversations.GET("/:id", handlers.GetConversation)
+	conversations.GET("/:id/messages", handlers.GetConversationMessages)
+	conversations.POST("/:id/read", handlers.MarkConversationRead)
+	conversations.PUT("/:id/status", handlers.UpdateConversationStatus, agentOnly)
+	conversations.POST("/:id/claim", handlers.ClaimConversation, agentOnly)
+	conversations.POST("/:id/transfer", handlers.TransferConversation, agentOnly)
+	conversations.POST("/:id/unassign", handlers.UnassignConversation, agentOnly)
+
+	// Assignment Rule Routes
+	assignmentRules := api.Group("/assignment-rules")
+	assignmentRules.GET("", handlers.GetAssignmentRules)
+	assignmentRules.POST("", handlers.CreateAssignmentRule, adminOnly)
+	assignmentRules.PUT("/:id", handlers.UpdateAssignmentRule, adminOnly)
+	assignmentRules.DELETE("/:id", handlers.DeleteAssignmentRule, adminOnly)
+
 	// Dashboard Routes
 	dashboard := api.Group("/dashboard")
 	dashboard.GET("/stats", handlers.GetDashboardStats)
@@ -184,51 +264,75 @@ func EchoServer() *echo.Echo {
 	customers := api.Group("/customers")
 	customers.GET("", handlers.GetCustomers)
 	customers.GET("/stats", handlers.GetCustomerStats)
+	customers.GET("/export", handlers.ExportCustomers)
+	customers.POST("/import", handlers.ImportCustomers, adminOnly)
+	customers.GET("/imports", handlers.GetCustomerImports)
+	customers.GET("/imports/:id/errors", handlers.GetCustomerImportErrors)
+	customers.GET("/duplicates", handlers.GetCustomerDuplicates)
+	customers.POST("/merge", handlers.MergeCustomers, adminOnly)
+	customers.GET("/merges", handlers.GetCustomerMerges)
+	customers.POST("/merges/:id/undo", handlers.UndoCustomerMerge, adminOnly)
 	customers.GET("/:id", handlers.GetCustomerDetail)
-	customers.PUT("/:id", handlers.UpdateCustomer)
+	customers.PUT("/:id", handlers.UpdateCustomer, agentOnly)
+	customers.GET("/:id/transcript", handlers.ExportCustomerTranscript, adminOnly)
 	customers.GET("/:id/tags", handlers.GetCustomerTags)
-	customers.POST("/:id/tags", handlers.AssignTagToCustomer)
-	customers.DELETE("/:id/tags/:tagId", handlers.RemoveTagFromCustomer)
+	customers.POST("/:id/tags", handlers.AssignTagToCustomer, agentOnly)
+	customers.DELETE("/:id/tags/:tagId", handlers.RemoveTagFromCustomer, agentOnly)
 	customers.GET("/:id/notes", handlers.GetCustomerNotes)
-	customers.POST("/:id/notes", handlers.CreateCustomerNote)
-	customers.DELETE("/:id/notes/:noteId", handlers.DeleteCustomerNote)
-	customers.PUT("/:id/lead-score", handlers.UpdateCustomerLeadScore)
+	customers.POST("/:id/notes", handlers.CreateCustomerNote, agentOnly)
+	customers.DELETE("/:id/notes/:noteId", handlers.DeleteCustomerNote, agentOnly)
+	customers.PUT("/:id/lead-score", handlers.UpdateCustomerLeadScore, agentOnly)
+	customers.GET("/:id/lead-score", handlers.GetCustomerLeadScore)
+	customers.GET("/:id/lead-score/history", handlers.GetCustomerLeadScoreHistory)
 
 	// Template Routes
 	templates := api.Group("/templates")
 	templates.GET("", handlers.GetTemplates)
-	templates.POST("", handlers.CreateTemplate)
-	templates.PUT("/:id", handlers.UpdateTemplate)
-	templates.DELETE("/:id", handlers.DeleteTemplate)
-	templates.POST("/:id/use", handlers.IncrementTemplateUsage)
+	templates.GET("/variables", handlers.GetTemplateVariables)
+	templates.POST("/preview", handlers.PreviewTemplate)
+	templates.POST("", handlers.CreateTemplate, adminOnly)
+	templates.PUT("/:id", handlers.UpdateTemplate, adminOnly)
+	templates.DELETE("/:id", handlers.DeleteTemplate, adminOnly)
+	templates.POST("/:id/use", handlers.IncrementTemplateUsage, agentOnly)
 
 	// Broadcast Routes
 	broadcasts := api.Group("/broadcasts")
 	broadcasts.GET("", handlers.GetBroadcasts)
 	broadcasts.GET("/stats", handlers.GetBroadcastStats)
-	broadcasts.POST("", handlers.CreateBroadcast)
+	broadcasts.POST("", handlers.CreateBroadcast, adminOnly)
+	broadcasts.POST("/recurrence/preview", handlers.PreviewRecurrence)
 	broadcasts.GET("/:id", handlers.GetBroadcast)
-	broadcasts.POST("/:id/send", handlers.SendBroadcast)
-	broadcasts.POST("/:id/cancel", handlers.CancelBroadcast)
-	broadcasts.DELETE("/:id", handlers.DeleteBroadcast)
+	broadcasts.GET("/:id/ab-results", handlers.GetBroadcastABResults)
+	broadcasts.GET("/:id/replies", handlers.GetBroadcastReplies)
+	broadcasts.GET("/:id/runs", handlers.GetBroadcastRuns)
+	broadcasts.GET("/:id/runs/:runId", handlers.GetBroadcastRun)
+	broadcasts.POST("/:id/send", handlers.SendBroadcast, adminOnly)
+	broadcasts.POST("/:id/pause", handlers.PauseBroadcast, adminOnly)
+	broadcasts.POST("/:id/resume", handlers.ResumeBroadcast, adminOnly)
+	broadcasts.POST("/:id/retry-failed", handlers.RetryFailedBroadcast, adminOnly)
+	broadcasts.POST("/:id/cancel", handlers.CancelBroadcast, adminOnly)
+	broadcasts.DELETE("/:id", handlers.DeleteBroadcast, adminOnly)
 
 	// AI Routes - Config routes are always available
 	aiHandler := handlers.NewAIHandler(globalAIService)
 	aiRoutes := api.Group("/ai")
 	aiRoutes.GET("/config", aiHandler.GetAIConfig)
-	aiRoutes.PUT("/config", aiHandler.UpdateAIConfig)
+	aiRoutes.PUT("/config", aiHandler.UpdateAIConfig, adminOnly)
 	aiRoutes.GET("/stats", aiHandler.GetAIStats)
 	aiRoutes.GET("/providers", aiHandler.GetProviders)
 	aiRoutes.GET("/providers/:provider/models", aiHandler.GetProviderModels)
-	aiRoutes.POST("/test-connection", aiHandler.TestConnection)
-	aiRoutes.POST("/test", aiHandler.TestAIResponse)
+	aiRoutes.POST("/test-connection", aiHandler.TestConnection, adminOnly)
+	aiRoutes.POST("/test", aiHandler.TestAIResponse, adminOnly)
+	aiRoutes.GET("/insights-settings", aiHandler.GetInsightSettings)
+	aiRoutes.PUT("/insights-settings", aiHandler.UpdateInsightSettings, adminOnly)
+	customers.POST("/:id/insights/refresh", aiHandler.RefreshCustomerInsights, agentOnly)
 	
 	// Knowledge Base Routes - always available
 	knowledge := api.Group("/knowledge")
 	knowledge.GET("", handlers.GetKnowledgeBase)
-	knowledge.POST("", handlers.CreateKnowledge)
-	knowledge.PUT("/:id", handlers.UpdateKnowledge)
-	knowledge.DELETE("/:id", handlers.DeleteKnowledge)
+	knowledge.POST("", handlers.CreateKnowledge, adminOnly)
+	knowledge.PUT("/:id", handlers.UpdateKnowledge, adminOnly)
+	knowledge.DELETE("/:id", handlers.DeleteKnowledge, adminOnly)
 	knowledge.GET("/stats", handlers.GetKnowledgeStats)
 
 	// Analytics Routes
@@ -240,14 +344,71 @@ func EchoServer() *echo.Echo {
 	analytics.GET("/top-customers", handlers.GetAnalyticsTopCustomers)
 	analytics.GET("/hourly", handlers.GetAnalyticsHourly)
 	analytics.GET("/intents", handlers.GetAnalyticsIntents)
+	analytics.GET("/insights", handlers.GetAnalyticsInsights)
+
+	// Customer Segments Routes
+	segments := api.Group("/segments")
+	segments.GET("", handlers.GetSegments)
+	segments.POST("", handlers.CreateSegment, adminOnly)
+	segments.POST("/preview", handlers.PreviewSegment)
+	segments.GET("/:id", handlers.GetSegment)
+	segments.PUT("/:id", handlers.UpdateSegment, adminOnly)
+	segments.DELETE("/:id", handlers.DeleteSegment, adminOnly)
+	segments.GET("/:id/customers", handlers.GetSegmentCustomers)
+
+	// Drip Sequences Routes
+	sequences := api.Group("/sequences")
+	sequences.GET("", handlers.GetSequences)
+	sequences.POST("", handlers.CreateSequence, adminOnly)
+	sequences.GET("/:id", handlers.GetSequence)
+	sequences.PUT("/:id", handlers.UpdateSequence, adminOnly)
+	sequences.DELETE("/:id", handlers.DeleteSequence, adminOnly)
+	sequences.POST("/:id/enroll", handlers.EnrollSequence, adminOnly)
+	sequences.GET("/:id/enrollments", handlers.GetSequenceEnrollments)
+	sequences.DELETE("/:id/enrollments/:enrollmentId", handlers.CancelSequenceEnrollment, adminOnly)
+	sequences.GET("/:id/stats", handlers.GetSequenceStats)
+
+	// Follow-up Task Routes
+	followUps := api.Group("/follow-ups")
+	followUps.GET("", handlers.GetFollowUps)
+	followUps.POST("", handlers.CreateFollowUp, agentOnly)
+	followUps.GET("/:id", handlers.GetFollowUp)
+	followUps.PUT("/:id", handlers.UpdateFollowUp, agentOnly)
+	followUps.POST("/:id/complete", handlers.CompleteFollowUp, agentOnly)
+	followUps.POST("/:id/cancel", handlers.CancelFollowUp, agentOnly)
+	followUps.POST("/:id/snooze", handlers.SnoozeFollowUp, agentOnly)
+	followUps.POST("/:id/send-template", handlers.SendFollowUpTemplate, agentOnly)
+
+	// Scheduled Message Routes
+	scheduledMessages := api.Group("/scheduled-messages")
+	scheduledMessages.GET("", handlers.GetScheduledMessages)
+	scheduledMessages.POST("", handlers.CreateScheduledMessage, agentOnly)
+	scheduledMessages.GET("/:id", handlers.GetScheduledMessage)
+	scheduledMessages.PUT("/:id", handlers.UpdateScheduledMessage, agentOnly)
+	scheduledMessages.POST("/:id/cancel", handlers.CancelScheduledMessage, agentOnly)
+
+	// Custom Customer Field Routes
+	customerFields := api.Group("/customer-fields")
+	customerFields.GET("", handlers.GetCustomerFields)
+	customerFields.POST("", handlers.CreateCustomerField, adminOnly)
+	customerFields.PUT("/:id", handlers.UpdateCustomerField, adminOnly)
+	customerFields.DELETE("/:id", handlers.DeleteCustomerField, adminOnly)
+
+	// Lead Scoring Routes
+	leadScoring := api.Group("/lead-scoring")
+	leadScoring.GET("", handlers.GetLeadScoringModel)
+	leadScoring.PUT("", handlers.UpdateLeadScoringModel, adminOnly)
+	leadScoring.POST("/recompute", handlers.RecomputeLeadScores, adminOnly)
 
 	// Tags Routes
 	tags := api.Group("/tags")
 	tags.GET("", handlers.GetTags)
-	tags.POST("", handlers.CreateTag)
-	tags.PUT("/:id", handlers.UpdateTag)
-	tags.DELETE("/:id", handlers.DeleteTag)
+	tags.POST("", handlers.CreateTag, adminOnly)
+	tags.PUT("/:id", handlers.UpdateTag, adminOnly)
+	tags.DELETE("/:id", handlers.DeleteTag, adminOnly)
 	tags.GET("/:id/customers", handlers.GetCustomersByTag)
+	tags.POST("/rules/test", handlers.TestTagRules, adminOnly)
+	tags.POST("/:id/rules/apply", handlers.ApplyTagRules, adminOnly)
 
 	return e
 
@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+
+	"gowa-backend/db"
+	"gowa-backend/models"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// Context keys set by TenantMiddleware
+const (
+	ContextTenantID   = "tenant_id"
+	ContextTenantRole = "tenant_role"
+)
+
+// TenantMiddleware resolves the active tenant and the user's role in it.
+// The tenant comes from the "tenant_id" JWT claim (set when switching tenants)
+// when the user is still a member of it, otherwise the user's oldest owned
+// tenant, otherwise their oldest membership. Requests without a tenant pass
+// through untouched so handlers can keep their "no tenant yet" behaviour.
+func TenantMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			userID, requestedTenant := claimsFromContext(c)
+			if userID == "" {
+				return next(c)
+			}
+
+			tenantID, role, err := ResolveTenant(userID, requestedTenant)
+			if err != nil {
+				if err != sql.ErrNoRows {
+					log.Printf("[Tenant] Failed to resolve tenant for user %s: %v", userID, err)
+				}
+				return next(c)
+			}
+
+			c.Set(ContextTenantID, tenantID)
+			c.Set(ContextTenantRole, role)
+			return next(c)
+		}
+	}
+}
+
+// RequireRole rejects requests whose tenant role is below minRole
+func RequireRole(minRole string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			role, _ := c.Get(ContextTenantRole).(string)
+			if role == "" {
+				return c.JSON(http.StatusForbidden, map[string]string{
+					"error": "Tenant not found",
+				})
+			}
+			if !models.RoleAtLeast(role, minRole) {
+				return c.JSON(http.StatusForbidden, map[string]string{
+					"error": "Forbidden: requires " + minRole + " role",
+				})
+			}
+			return next(c)
+		}
+	}
+}
+
+// ResolveTenant returns the tenant and role a user acts as. requestedTenant
+// may be empty; it is only honoured when the user is a member of it.
+func ResolveTenant(userID, requestedTenant string) (string, string, error) {
+	var tenantID, role string
+	query := `
+		SELECT tm.tenant_id, tm.role
+		FROM tenant_members tm
+		JOIN tenants t ON t.id = tm.tenant_id
+		WHERE tm.user_id = $1 AND t.is_active = true
+		ORDER BY (tm.tenant_id::text = $2) DESC, (tm.role = 'owner') DESC, tm.created_at ASC
+		LIMIT 1
+	`
+	err := db.DB.QueryRow(query, userID, requestedTenant).Scan(&tenantID, &role)
+	if err == sql.ErrNoRows {
+		// Tenants created before memberships existed
+		err = db.DB.QueryRow(`SELECT id FROM tenants WHERE user_id = $1 AND is_active = true LIMIT 1`, userID).Scan(&tenantID)
+		role = models.RoleOwner
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return tenantID, role, nil
+}
+
+// claimsFromContext reads user_id and the optional tenant_id claim from the JWT
+func claimsFromContext(c echo.Context) (string, string) {
+	token, ok := c.Get("user").(*jwt.Token)
+	if !ok {
+		return "", ""
+	}
+	claims, ok := token.Claims.(*jwt.MapClaims)
+	if !ok {
+		if mc, isMap := token.Claims.(jwt.MapClaims); isMap {
+			claims = &mc
+		} else {
+			return "", ""
+		}
+	}
+	userID, _ := (*claims)["user_id"].(string)
+	tenantID, _ := (*claims)["tenant_id"].(string)
+	return userID, tenantID
+}
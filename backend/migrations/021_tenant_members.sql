@@ -0,0 +1,42 @@
+-- Migration 021: Tenant Members & Invitations
+-- Allows several users to work in one tenant with owner/admin/agent/viewer roles
+
+CREATE TABLE IF NOT EXISTS tenant_members (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role VARCHAR(20) NOT NULL DEFAULT 'agent' CHECK (role IN ('owner', 'admin', 'agent', 'viewer')),
+    invited_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW(),
+    CONSTRAINT unique_tenant_member UNIQUE(tenant_id, user_id)
+);
+
+CREATE TABLE IF NOT EXISTS tenant_invitations (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    email VARCHAR(255) NOT NULL,
+    role VARCHAR(20) NOT NULL DEFAULT 'agent' CHECK (role IN ('admin', 'agent', 'viewer')),
+    token VARCHAR(64) NOT NULL UNIQUE,
+    invited_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    accepted_at TIMESTAMPTZ,
+    accepted_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_tenant_members_user ON tenant_members(user_id);
+CREATE INDEX IF NOT EXISTS idx_tenant_members_tenant ON tenant_members(tenant_id);
+CREATE INDEX IF NOT EXISTS idx_tenant_invitations_tenant ON tenant_invitations(tenant_id);
+CREATE INDEX IF NOT EXISTS idx_tenant_invitations_email ON tenant_invitations(LOWER(email)) WHERE accepted_at IS NULL;
+
+-- Every existing tenant owner becomes an owner member
+INSERT INTO tenant_members (tenant_id, user_id, role)
+SELECT id, user_id, 'owner'
+FROM tenants
+ON CONFLICT (tenant_id, user_id) DO NOTHING;
+
+COMMENT ON TABLE tenant_members IS 'Users that belong to a tenant and their role';
+COMMENT ON TABLE tenant_invitations IS 'Pending and accepted email invitations to join a tenant';
+COMMENT ON COLUMN tenant_members.role IS 'owner, admin, agent or viewer';
+COMMENT ON COLUMN tenant_invitations.token IS 'Random token sent in the accept link';
@@ -0,0 +1,48 @@
+-- Migration 022: Conversation Assignment & Routing Rules
+-- Gives every customer chat an assignee and lets tenants route new chats to agents
+
+CREATE TABLE IF NOT EXISTS conversations (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    customer_id UUID REFERENCES customer_insights(id) ON DELETE CASCADE,
+    customer_jid VARCHAR(100) NOT NULL,
+    assigned_to UUID REFERENCES users(id) ON DELETE SET NULL,
+    assigned_at TIMESTAMPTZ,
+    assigned_by VARCHAR(20),
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW(),
+    CONSTRAINT unique_tenant_conversation UNIQUE(tenant_id, customer_jid)
+);
+
+CREATE TABLE IF NOT EXISTS assignment_rules (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    rule_type VARCHAR(20) NOT NULL CHECK (rule_type IN ('round_robin', 'tag', 'intent')),
+    match_value VARCHAR(100),
+    assign_to_user UUID REFERENCES users(id) ON DELETE CASCADE,
+    assign_to_role VARCHAR(20) CHECK (assign_to_role IN ('owner', 'admin', 'agent')),
+    priority INTEGER DEFAULT 0,
+    is_active BOOLEAN DEFAULT true,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- Round-robin picks the online member that was assigned least recently
+ALTER TABLE tenant_members ADD COLUMN IF NOT EXISTS last_assigned_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_conversations_tenant ON conversations(tenant_id);
+CREATE INDEX IF NOT EXISTS idx_conversations_assigned ON conversations(tenant_id, assigned_to);
+CREATE INDEX IF NOT EXISTS idx_assignment_rules_tenant ON assignment_rules(tenant_id, priority) WHERE is_active = true;
+
+-- Every existing customer chat becomes an unassigned conversation
+INSERT INTO conversations (tenant_id, customer_id, customer_jid)
+SELECT tenant_id, id, customer_jid
+FROM customer_insights
+ON CONFLICT (tenant_id, customer_jid) DO NOTHING;
+
+COMMENT ON TABLE conversations IS 'One chat thread per customer with its assigned agent';
+COMMENT ON TABLE assignment_rules IS 'Rules used to auto-assign unassigned conversations, evaluated by priority';
+COMMENT ON COLUMN conversations.assigned_by IS 'manual, claim, transfer or rule';
+COMMENT ON COLUMN assignment_rules.rule_type IS 'round_robin (always matches), tag (match_value = tag id) or intent (match_value = detected intent)';
+COMMENT ON COLUMN assignment_rules.assign_to_role IS 'When assign_to_user is empty, round-robin among online members with this role';
@@ -0,0 +1,53 @@
+-- Migration 023: Conversation Inbox
+-- Adds status, snooze, last message and per-agent read state to conversations
+
+ALTER TABLE conversations ADD COLUMN IF NOT EXISTS status VARCHAR(20) NOT NULL DEFAULT 'open'
+    CHECK (status IN ('open', 'pending', 'resolved', 'snoozed'));
+ALTER TABLE conversations ADD COLUMN IF NOT EXISTS snooze_until TIMESTAMPTZ;
+ALTER TABLE conversations ADD COLUMN IF NOT EXISTS resolved_at TIMESTAMPTZ;
+ALTER TABLE conversations ADD COLUMN IF NOT EXISTS last_message_id VARCHAR(255);
+ALTER TABLE conversations ADD COLUMN IF NOT EXISTS last_message_text TEXT;
+ALTER TABLE conversations ADD COLUMN IF NOT EXISTS last_message_type VARCHAR(50);
+ALTER TABLE conversations ADD COLUMN IF NOT EXISTS last_message_from_me BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE conversations ADD COLUMN IF NOT EXISTS last_message_at TIMESTAMPTZ;
+
+-- Read state per member; messages newer than last_read_timestamp are unread
+CREATE TABLE IF NOT EXISTS conversation_reads (
+    conversation_id UUID NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    last_read_timestamp BIGINT NOT NULL DEFAULT 0,
+    last_read_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (conversation_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_conversations_status ON conversations(tenant_id, status);
+CREATE INDEX IF NOT EXISTS idx_conversations_last_message_at ON conversations(tenant_id, last_message_at DESC);
+CREATE INDEX IF NOT EXISTS idx_conversations_snoozed ON conversations(snooze_until) WHERE status = 'snoozed';
+CREATE INDEX IF NOT EXISTS idx_whatsapp_messages_tenant_sender_ts ON whatsapp_messages(tenant_id, sender_jid, timestamp DESC);
+CREATE INDEX IF NOT EXISTS idx_whatsapp_messages_tenant_chat_ts ON whatsapp_messages(tenant_id, chat_jid, timestamp DESC);
+
+-- Backfill the last message of existing conversations
+UPDATE conversations conv
+SET last_message_id = lm.message_id,
+    last_message_text = lm.message_text,
+    last_message_type = lm.message_type,
+    last_message_from_me = lm.is_from_me,
+    last_message_at = to_timestamp(lm.timestamp)
+FROM (
+    SELECT DISTINCT ON (tenant_id, customer_jid)
+        tenant_id, customer_jid, message_id, message_text, message_type, is_from_me, timestamp
+    FROM (
+        SELECT tenant_id, CASE WHEN is_from_me THEN chat_jid ELSE sender_jid END AS customer_jid,
+               message_id, message_text, message_type, is_from_me, timestamp
+        FROM whatsapp_messages
+        WHERE is_group = false
+    ) m
+    ORDER BY tenant_id, customer_jid, timestamp DESC
+) lm
+WHERE lm.tenant_id = conv.tenant_id AND lm.customer_jid = conv.customer_jid
+  AND conv.last_message_at IS NULL;
+
+COMMENT ON COLUMN conversations.status IS 'open, pending, resolved or snoozed';
+COMMENT ON COLUMN conversations.snooze_until IS 'Snoozed conversations reopen at this time';
+COMMENT ON TABLE conversation_reads IS 'Last message each member has read per conversation';
+COMMENT ON COLUMN conversation_reads.last_read_timestamp IS 'Unix timestamp of the newest read message (matches whatsapp_messages.timestamp)';
@@ -0,0 +1,13 @@
+-- Migration 024: Full-text Message Search
+-- Indexes message text and captions for searching across all chats.
+-- Uses the 'simple' configuration (no stemming) because chats mix Indonesian,
+-- English, slang and numbers like sizes or order IDs.
+
+ALTER TABLE whatsapp_messages ADD COLUMN IF NOT EXISTS search_vector tsvector
+    GENERATED ALWAYS AS (
+        to_tsvector('simple', COALESCE(message_text, '') || ' ' || COALESCE(caption, ''))
+    ) STORED;
+
+CREATE INDEX IF NOT EXISTS idx_whatsapp_messages_search ON whatsapp_messages USING GIN(search_vector);
+
+COMMENT ON COLUMN whatsapp_messages.search_vector IS 'Full-text index of message_text and caption (simple configuration)';
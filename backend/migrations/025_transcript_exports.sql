@@ -0,0 +1,29 @@
+-- Migration 025: Transcript Exports
+-- Records who sent each outgoing message and tracks background export jobs
+
+ALTER TABLE whatsapp_messages ADD COLUMN IF NOT EXISTS sent_by VARCHAR(20);
+ALTER TABLE whatsapp_messages ADD COLUMN IF NOT EXISTS sent_by_user UUID REFERENCES users(id) ON DELETE SET NULL;
+
+UPDATE whatsapp_messages SET sent_by = 'customer' WHERE is_from_me = false AND sent_by IS NULL;
+
+CREATE TABLE IF NOT EXISTS export_jobs (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    requested_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    export_type VARCHAR(50) NOT NULL DEFAULT 'transcript',
+    format VARCHAR(10) NOT NULL CHECK (format IN ('csv', 'json', 'html')),
+    params JSONB DEFAULT '{}',
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'running', 'completed', 'failed')),
+    file_path TEXT,
+    file_name VARCHAR(255),
+    row_count INTEGER DEFAULT 0,
+    error_message TEXT,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    completed_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_export_jobs_tenant ON export_jobs(tenant_id, created_at DESC);
+
+COMMENT ON COLUMN whatsapp_messages.sent_by IS 'customer, agent, ai, broadcast or phone (sent from the linked phone)';
+COMMENT ON COLUMN whatsapp_messages.sent_by_user IS 'Agent who sent the message from the dashboard';
+COMMENT ON TABLE export_jobs IS 'Background export jobs with a downloadable result file';
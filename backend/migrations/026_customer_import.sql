@@ -0,0 +1,27 @@
+-- Migration 026: Customer Import
+-- Lets customers be created from spreadsheets before they ever message us
+
+ALTER TABLE customer_insights ADD COLUMN IF NOT EXISTS custom_fields JSONB NOT NULL DEFAULT '{}'::jsonb;
+ALTER TABLE customer_insights ADD COLUMN IF NOT EXISTS source VARCHAR(20) DEFAULT 'whatsapp';
+
+CREATE TABLE IF NOT EXISTS customer_imports (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    imported_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    file_name VARCHAR(255),
+    mapping JSONB DEFAULT '{}',
+    on_duplicate VARCHAR(10) NOT NULL DEFAULT 'skip' CHECK (on_duplicate IN ('skip', 'update')),
+    total_rows INTEGER DEFAULT 0,
+    created_count INTEGER DEFAULT 0,
+    updated_count INTEGER DEFAULT 0,
+    skipped_count INTEGER DEFAULT 0,
+    failed_count INTEGER DEFAULT 0,
+    errors JSONB DEFAULT '[]',
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_customer_imports_tenant ON customer_imports(tenant_id, created_at DESC);
+
+COMMENT ON COLUMN customer_insights.custom_fields IS 'Tenant-specific customer attributes keyed by field name';
+COMMENT ON COLUMN customer_insights.source IS 'whatsapp (first message) or import (spreadsheet)';
+COMMENT ON TABLE customer_imports IS 'Spreadsheet customer imports with their row-level error report';
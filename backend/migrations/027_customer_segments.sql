@@ -0,0 +1,28 @@
+-- Migration 027: Customer Segments
+-- Saved customer filters that broadcasts can target, resolved at send time
+
+CREATE TABLE IF NOT EXISTS customer_segments (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    description TEXT,
+    filter JSONB NOT NULL DEFAULT '{"conditions": []}',
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW(),
+    UNIQUE(tenant_id, name)
+);
+
+CREATE INDEX IF NOT EXISTS idx_customer_segments_tenant ON customer_segments(tenant_id);
+
+ALTER TABLE broadcasts ADD COLUMN IF NOT EXISTS segment_id UUID REFERENCES customer_segments(id) ON DELETE SET NULL;
+
+-- Broadcast opt-out
+ALTER TABLE customer_insights ADD COLUMN IF NOT EXISTS opted_out BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE customer_insights ADD COLUMN IF NOT EXISTS opted_out_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_customer_insights_custom_fields ON customer_insights USING GIN (custom_fields);
+
+COMMENT ON TABLE customer_segments IS 'Saved customer filters (see services/segment for the filter format)';
+COMMENT ON COLUMN broadcasts.segment_id IS 'Audience segment, resolved into recipients each time the broadcast is sent';
+COMMENT ON COLUMN customer_insights.opted_out IS 'Customer asked not to receive broadcasts';
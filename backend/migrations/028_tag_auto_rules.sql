@@ -0,0 +1,13 @@
+-- Migration 028: Tag Auto-Apply Rules
+-- customer_tags.auto_apply_rules is evaluated by services/tagrules after each
+-- customer message and on a periodic sweep
+
+-- Purchases recorded for a customer, used by purchase_count rules
+ALTER TABLE customer_insights ADD COLUMN IF NOT EXISTS purchase_count INTEGER NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS idx_customer_tag_assignments_tag ON customer_tag_assignments(tag_id, assigned_by);
+CREATE INDEX IF NOT EXISTS idx_customer_tags_auto_rules ON customer_tags(tenant_id) WHERE auto_apply_rules IS NOT NULL;
+
+COMMENT ON COLUMN customer_tags.auto_apply_rules IS 'Rules for auto-applying this tag (see services/tagrules for the format)';
+COMMENT ON COLUMN customer_tag_assignments.assigned_by IS 'manual, import, auto (tag rules) or ai';
+COMMENT ON COLUMN customer_insights.purchase_count IS 'Number of purchases recorded for the customer';
@@ -0,0 +1,40 @@
+-- Migration 029: Lead Scoring
+-- Per-tenant scoring models, score history and the columns the scoring
+-- engine (services/leadscore) reads
+
+CREATE TABLE IF NOT EXISTS lead_scoring_models (
+    tenant_id UUID PRIMARY KEY REFERENCES tenants(id) ON DELETE CASCADE,
+    model JSONB NOT NULL,
+    updated_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS lead_score_history (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    customer_id UUID NOT NULL REFERENCES customer_insights(id) ON DELETE CASCADE,
+    old_score INTEGER,
+    new_score INTEGER NOT NULL,
+    old_status VARCHAR(20),
+    new_status VARCHAR(20),
+    reason VARCHAR(20) NOT NULL, -- message, nightly, recompute, manual
+    breakdown JSONB,
+    changed_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_lead_score_history_customer ON lead_score_history(customer_id, created_at DESC);
+
+-- Manually set scores are kept until scoring is switched back on for the customer
+ALTER TABLE customer_insights ADD COLUMN IF NOT EXISTS lead_score_locked BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE customer_insights ADD COLUMN IF NOT EXISTS lead_score_updated_at TIMESTAMPTZ;
+
+-- Link AI logs to the customer so intents can be scored
+ALTER TABLE ai_conversation_logs ADD COLUMN IF NOT EXISTS customer_jid VARCHAR(255);
+CREATE INDEX IF NOT EXISTS idx_ai_logs_tenant_customer_jid ON ai_conversation_logs(tenant_id, customer_jid, created_at DESC);
+
+CREATE INDEX IF NOT EXISTS idx_broadcast_recipients_customer_sent ON broadcast_recipients(customer_id, sent_at);
+
+COMMENT ON TABLE lead_scoring_models IS 'Lead scoring model per tenant (see services/leadscore); tenants without a row use the default model';
+COMMENT ON TABLE lead_score_history IS 'Every lead score or status change with the signal breakdown that produced it';
+COMMENT ON COLUMN customer_insights.lead_score_locked IS 'Score was set manually and is not recomputed';
@@ -0,0 +1,34 @@
+-- Migration 030: Customer AI Insights
+-- Background enrichment of customer_insights (sentiment, intent, product
+-- interest, rolling summary, extracted facts) with per-tenant cost limits
+
+ALTER TABLE ai_configs ADD COLUMN IF NOT EXISTS insights_enabled BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE ai_configs ADD COLUMN IF NOT EXISTS insights_monthly_budget_usd DECIMAL(10,4) NOT NULL DEFAULT 1.00;
+
+ALTER TABLE customer_insights ADD COLUMN IF NOT EXISTS conversation_summary TEXT;
+ALTER TABLE customer_insights ADD COLUMN IF NOT EXISTS ai_facts JSONB NOT NULL DEFAULT '{}'::jsonb;
+ALTER TABLE customer_insights ADD COLUMN IF NOT EXISTS insights_updated_at TIMESTAMPTZ;
+ALTER TABLE customer_insights ADD COLUMN IF NOT EXISTS insights_message_count INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE customer_insights ADD COLUMN IF NOT EXISTS insights_opted_out BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS customer_insight_runs (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    customer_id UUID REFERENCES customer_insights(id) ON DELETE SET NULL,
+    status VARCHAR(20) NOT NULL CHECK (status IN ('success', 'invalid', 'failed')),
+    tokens_used INTEGER NOT NULL DEFAULT 0,
+    cost_usd DECIMAL(10,6) NOT NULL DEFAULT 0,
+    model VARCHAR(100),
+    error TEXT,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_customer_insight_runs_tenant ON customer_insight_runs(tenant_id, created_at DESC);
+
+COMMENT ON COLUMN ai_configs.insights_enabled IS 'Whether conversations are analysed in the background for customer insights';
+COMMENT ON COLUMN ai_configs.insights_monthly_budget_usd IS 'Maximum AI spend on customer insights per calendar month';
+COMMENT ON COLUMN customer_insights.conversation_summary IS 'Rolling AI summary of the whole conversation';
+COMMENT ON COLUMN customer_insights.ai_facts IS 'Facts the customer stated, extracted by AI (name, city, preferred_product, ...)';
+COMMENT ON COLUMN customer_insights.insights_message_count IS 'message_count at the last analysis; higher counts mean new messages to analyse';
+COMMENT ON COLUMN customer_insights.insights_opted_out IS 'Exclude this customer from AI analysis';
+COMMENT ON TABLE customer_insight_runs IS 'Every AI insight call with its cost, used for the monthly budget';
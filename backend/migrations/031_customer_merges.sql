@@ -0,0 +1,32 @@
+-- Migration 031: Customer Merges
+-- Audit trail of merged duplicate customers. The merged record is removed
+-- and kept as a snapshot so the merge can be undone within a window.
+
+CREATE TABLE IF NOT EXISTS customer_merges (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    survivor_id UUID NOT NULL, -- no foreign key: a survivor merged again is followed through merged_id
+    merged_id UUID NOT NULL,   -- restored with the same ID on undo
+    merged_jid VARCHAR(255) NOT NULL,
+    reasons TEXT[] NOT NULL DEFAULT '{}',
+    merged_snapshot JSONB NOT NULL,
+    survivor_snapshot JSONB NOT NULL,
+    moved JSONB NOT NULL DEFAULT '{}'::jsonb,
+    merged_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    undo_until TIMESTAMPTZ NOT NULL,
+    undone_at TIMESTAMPTZ,
+    undone_by UUID REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_customer_merges_tenant ON customer_merges(tenant_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_customer_merges_jid ON customer_merges(tenant_id, merged_jid) WHERE undone_at IS NULL;
+
+-- Moving scheduled messages between customers looks them up by customer
+CREATE INDEX IF NOT EXISTS idx_scheduled_messages_insight ON scheduled_messages(insight_id);
+
+COMMENT ON TABLE customer_merges IS 'Merged duplicate customers with what was moved, for audit and undo';
+COMMENT ON COLUMN customer_merges.merged_snapshot IS 'The removed customer_insights row';
+COMMENT ON COLUMN customer_merges.survivor_snapshot IS 'The surviving customer_insights row before the merge';
+COMMENT ON COLUMN customer_merges.moved IS 'IDs of the rows moved to the survivor, used to move them back on undo';
+COMMENT ON COLUMN customer_merges.merged_jid IS 'New messages from this JID are attributed to the survivor while the merge is active';
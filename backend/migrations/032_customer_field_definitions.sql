@@ -0,0 +1,24 @@
+-- Migration 032: Customer Field Definitions
+-- Tenant-defined schema for customer_insights.custom_fields. Values stay in
+-- the JSONB column as text; the definition says how to validate them.
+
+CREATE TABLE IF NOT EXISTS customer_field_definitions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    key VARCHAR(50) NOT NULL,
+    label VARCHAR(100) NOT NULL,
+    field_type VARCHAR(20) NOT NULL CHECK (field_type IN ('text', 'number', 'date', 'select', 'boolean')),
+    options TEXT[] NOT NULL DEFAULT '{}',
+    required BOOLEAN NOT NULL DEFAULT false,
+    position INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW(),
+    UNIQUE (tenant_id, key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_customer_field_definitions_tenant ON customer_field_definitions(tenant_id, position);
+
+COMMENT ON TABLE customer_field_definitions IS 'Custom customer fields defined by each tenant';
+COMMENT ON COLUMN customer_field_definitions.key IS 'Key in customer_insights.custom_fields and {{custom.key}} in messages';
+COMMENT ON COLUMN customer_field_definitions.options IS 'Allowed values of a select field';
+COMMENT ON COLUMN customer_field_definitions.required IS 'A value cannot be cleared once set';
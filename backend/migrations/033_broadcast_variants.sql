@@ -0,0 +1,33 @@
+-- Migration 033: Broadcast A/B Variants
+-- Broadcasts can carry several content variants split by percentage. With a
+-- test portion, only that share of recipients is sent first; the rest are
+-- held until a winner is picked and then all get the winning variant.
+
+CREATE TABLE IF NOT EXISTS broadcast_variants (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    broadcast_id UUID NOT NULL REFERENCES broadcasts(id) ON DELETE CASCADE,
+    label VARCHAR(10) NOT NULL,
+    message_content TEXT NOT NULL,
+    weight INTEGER NOT NULL CHECK (weight BETWEEN 1 AND 100),
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    UNIQUE (broadcast_id, label)
+);
+
+ALTER TABLE broadcasts ADD COLUMN IF NOT EXISTS ab_test_percent INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE broadcasts ADD COLUMN IF NOT EXISTS ab_decide_after_hours INTEGER NOT NULL DEFAULT 24;
+ALTER TABLE broadcasts ADD COLUMN IF NOT EXISTS ab_winner_metric VARCHAR(20) NOT NULL DEFAULT 'reply_rate';
+ALTER TABLE broadcasts ADD COLUMN IF NOT EXISTS ab_winner_variant_id UUID REFERENCES broadcast_variants(id) ON DELETE SET NULL;
+ALTER TABLE broadcasts ADD COLUMN IF NOT EXISTS ab_decided_at TIMESTAMPTZ;
+
+ALTER TABLE broadcast_recipients ADD COLUMN IF NOT EXISTS variant_id UUID REFERENCES broadcast_variants(id) ON DELETE SET NULL;
+ALTER TABLE broadcast_recipients ADD COLUMN IF NOT EXISTS read_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_broadcast_variants_broadcast ON broadcast_variants(broadcast_id);
+CREATE INDEX IF NOT EXISTS idx_broadcast_recipients_message ON broadcast_recipients(message_id) WHERE message_id IS NOT NULL;
+
+COMMENT ON TABLE broadcast_variants IS 'Alternative contents of a broadcast for A/B testing';
+COMMENT ON COLUMN broadcast_variants.weight IS 'Percentage of recipients assigned to the variant';
+COMMENT ON COLUMN broadcasts.ab_test_percent IS 'Share of recipients sent first to pick a winner; 0 sends every variant to its split';
+COMMENT ON COLUMN broadcasts.ab_winner_metric IS 'reply_rate or read_rate';
+COMMENT ON COLUMN broadcast_recipients.variant_id IS 'Variant assigned deterministically from the broadcast and customer IDs';
+COMMENT ON COLUMN broadcast_recipients.status IS 'pending, held (waiting for the A/B winner), queued, sent, delivered, failed';
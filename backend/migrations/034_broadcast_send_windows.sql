@@ -0,0 +1,18 @@
+-- Migration 034: Broadcast Send Windows and Pausing
+-- A broadcast with a send window only dispatches recipients between its start
+-- and end time of day; outside it the broadcast pauses and resumes when the
+-- window opens again. Sending broadcasts can also be paused, resumed and
+-- cancelled by hand, pulling their queued recipients back out of Redis.
+
+ALTER TABLE broadcasts ADD COLUMN IF NOT EXISTS send_window_start TIME;
+ALTER TABLE broadcasts ADD COLUMN IF NOT EXISTS send_window_end TIME;
+ALTER TABLE broadcasts ADD COLUMN IF NOT EXISTS paused_at TIMESTAMPTZ;
+ALTER TABLE broadcasts ADD COLUMN IF NOT EXISTS pause_reason VARCHAR(20);
+
+CREATE INDEX IF NOT EXISTS idx_broadcasts_paused ON broadcasts(pause_reason) WHERE status = 'paused';
+
+COMMENT ON COLUMN broadcasts.send_window_start IS 'Start of the daily send window in tenant time; NULL sends at any time';
+COMMENT ON COLUMN broadcasts.send_window_end IS 'End of the daily send window; earlier than the start when the window spans midnight';
+COMMENT ON COLUMN broadcasts.pause_reason IS 'manual (paused by a user) or window (outside the send window)';
+COMMENT ON COLUMN broadcasts.status IS 'draft, scheduled, active (recurring, between runs), sending, paused, completed, cancelled';
+COMMENT ON COLUMN broadcast_recipients.status IS 'pending, held (waiting for the A/B winner), queued, sent, delivered, failed, cancelled';
@@ -0,0 +1,14 @@
+-- Migration 035: Broadcast Media
+-- Broadcasts can carry an uploaded image, video or document, with the
+-- personalized message as its caption. The file is uploaded to WhatsApp once
+-- and the upload is reused for every recipient.
+
+ALTER TABLE broadcasts ADD COLUMN IF NOT EXISTS media_url TEXT;
+ALTER TABLE broadcasts ADD COLUMN IF NOT EXISTS media_type VARCHAR(20);
+ALTER TABLE broadcasts ADD COLUMN IF NOT EXISTS media_file_name VARCHAR(255);
+ALTER TABLE broadcasts ADD COLUMN IF NOT EXISTS media_upload JSONB;
+ALTER TABLE broadcasts ADD COLUMN IF NOT EXISTS media_uploaded_at TIMESTAMPTZ;
+
+COMMENT ON COLUMN broadcasts.media_url IS 'Uploaded file (/uploads/<tenant>/<file>) sent with the message as caption';
+COMMENT ON COLUMN broadcasts.media_type IS 'image, video or document';
+COMMENT ON COLUMN broadcasts.media_upload IS 'WhatsApp upload of the media, reused for every recipient until it expires';
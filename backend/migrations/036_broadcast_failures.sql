@@ -0,0 +1,16 @@
+-- Migration 036: Broadcast Failure Taxonomy and Retries
+-- Failed sends are classified so transient failures (disconnected device,
+-- rate limiting) are retried automatically with backoff and the rest can be
+-- retried by hand when it makes sense.
+
+ALTER TABLE broadcast_recipients ADD COLUMN IF NOT EXISTS error_code VARCHAR(30);
+ALTER TABLE broadcast_recipients ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE broadcast_recipients ADD COLUMN IF NOT EXISTS next_retry_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_broadcast_recipients_retry ON broadcast_recipients(next_retry_at) WHERE status = 'retrying';
+CREATE INDEX IF NOT EXISTS idx_broadcast_recipients_error ON broadcast_recipients(broadcast_id, error_code) WHERE status = 'failed';
+
+COMMENT ON COLUMN broadcast_recipients.error_code IS 'not_on_whatsapp, disconnected, rate_limited, invalid_jid or unknown';
+COMMENT ON COLUMN broadcast_recipients.attempts IS 'Send attempts that failed';
+COMMENT ON COLUMN broadcast_recipients.next_retry_at IS 'When a recipient waiting to be retried is sent again';
+COMMENT ON COLUMN broadcast_recipients.status IS 'pending, held (waiting for the A/B winner), queued, retrying, sent, delivered, failed, cancelled';
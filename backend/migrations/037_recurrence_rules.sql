@@ -0,0 +1,18 @@
+-- Migration 037: Recurrence Rules and Tenant Timezones
+-- Recurring broadcasts can repeat monthly (on a day of the month or the nth
+-- weekday) or on a cron expression. Run times are computed on the wall clock
+-- of the tenant's timezone, which also applies to send windows.
+
+ALTER TABLE tenants ADD COLUMN IF NOT EXISTS timezone VARCHAR(64) NOT NULL DEFAULT 'Asia/Jakarta';
+
+ALTER TABLE broadcasts ADD COLUMN IF NOT EXISTS recurrence_month_day INTEGER;
+ALTER TABLE broadcasts ADD COLUMN IF NOT EXISTS recurrence_week_ordinal INTEGER;
+ALTER TABLE broadcasts ADD COLUMN IF NOT EXISTS recurrence_weekday VARCHAR(10);
+ALTER TABLE broadcasts ADD COLUMN IF NOT EXISTS recurrence_cron VARCHAR(100);
+
+COMMENT ON COLUMN tenants.timezone IS 'IANA timezone schedules and send windows are evaluated in (Asia/Jakarta, Asia/Makassar, Asia/Jayapura)';
+COMMENT ON COLUMN broadcasts.recurrence_type IS 'Type of recurrence: hourly, daily, weekly, monthly, cron';
+COMMENT ON COLUMN broadcasts.recurrence_month_day IS 'Day of the month for monthly recurrence, -1 for the last day';
+COMMENT ON COLUMN broadcasts.recurrence_week_ordinal IS 'Week of the month (1-4, -1 for the last) of recurrence_weekday for monthly recurrence';
+COMMENT ON COLUMN broadcasts.recurrence_weekday IS 'Day name for monthly recurrence on the nth weekday';
+COMMENT ON COLUMN broadcasts.recurrence_cron IS 'Five-field cron expression for cron recurrence';
@@ -0,0 +1,44 @@
+-- Migration 038: Broadcast Runs
+-- Every execution of a broadcast is a run with its own snapshot of
+-- recipients, so recurring broadcasts send to their audience again on each
+-- run and their history can be compared run by run. The counters on
+-- broadcasts describe the current run.
+
+CREATE TABLE IF NOT EXISTS broadcast_runs (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    broadcast_id UUID NOT NULL REFERENCES broadcasts(id) ON DELETE CASCADE,
+    run_number INTEGER NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'sending',
+    scheduled_for TIMESTAMPTZ,
+    started_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    completed_at TIMESTAMPTZ,
+    UNIQUE (broadcast_id, run_number)
+);
+
+ALTER TABLE broadcast_recipients ADD COLUMN IF NOT EXISTS run_id UUID REFERENCES broadcast_runs(id) ON DELETE CASCADE;
+ALTER TABLE broadcasts ADD COLUMN IF NOT EXISTS current_run_id UUID REFERENCES broadcast_runs(id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS idx_broadcast_recipients_run ON broadcast_recipients(run_id, status);
+
+-- Broadcasts that were sent before runs existed get their first run
+INSERT INTO broadcast_runs (broadcast_id, run_number, status, started_at, completed_at)
+SELECT b.id, 1,
+       CASE WHEN b.status IN ('completed', 'cancelled') THEN b.status ELSE 'sending' END,
+       COALESCE(b.started_at, b.created_at), b.completed_at
+FROM broadcasts b
+WHERE b.status NOT IN ('draft', 'scheduled')
+  AND NOT EXISTS (SELECT 1 FROM broadcast_runs r WHERE r.broadcast_id = b.id);
+
+UPDATE broadcast_recipients br SET run_id = r.id
+FROM broadcast_runs r
+WHERE r.broadcast_id = br.broadcast_id AND r.run_number = 1 AND br.run_id IS NULL;
+
+UPDATE broadcasts b SET current_run_id = r.id
+FROM broadcast_runs r
+WHERE r.broadcast_id = b.id AND r.run_number = 1 AND b.current_run_id IS NULL;
+
+COMMENT ON TABLE broadcast_runs IS 'Executions of a broadcast; recurring broadcasts have one per occurrence';
+COMMENT ON COLUMN broadcast_runs.status IS 'sending, completed or cancelled';
+COMMENT ON COLUMN broadcast_runs.scheduled_for IS 'When the run was scheduled; NULL when sent by hand';
+COMMENT ON COLUMN broadcast_recipients.run_id IS 'Run the recipient belongs to; NULL until the broadcast is first sent';
+COMMENT ON COLUMN broadcasts.current_run_id IS 'Latest run, which the broadcast counters and progress describe';
@@ -0,0 +1,90 @@
+-- Migration 039: Drip Sequences
+-- A sequence is an ordered list of messages sent to an enrolled customer,
+-- each after a delay. Customers are enrolled manually, by tag, by segment or
+-- by a trigger, and leave early when a step's exit conditions are met.
+-- services/sequence sends the steps from the sequence scheduler.
+
+CREATE TABLE IF NOT EXISTS sequences (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    description TEXT,
+    trigger_event VARCHAR(30),
+    is_active BOOLEAN NOT NULL DEFAULT true,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW(),
+    UNIQUE(tenant_id, name)
+);
+
+CREATE INDEX IF NOT EXISTS idx_sequences_trigger ON sequences(tenant_id, trigger_event) WHERE is_active AND trigger_event IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS sequence_steps (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    sequence_id UUID NOT NULL REFERENCES sequences(id) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    delay_minutes INTEGER NOT NULL DEFAULT 0,
+    message_content TEXT,
+    template_id UUID REFERENCES message_templates(id) ON DELETE SET NULL,
+    media_url TEXT,
+    media_type VARCHAR(20),
+    media_file_name VARCHAR(255),
+    media_upload JSONB,
+    media_uploaded_at TIMESTAMPTZ,
+    exit_on_reply BOOLEAN NOT NULL DEFAULT false,
+    exit_tag_ids UUID[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW(),
+    UNIQUE(sequence_id, position)
+);
+
+CREATE TABLE IF NOT EXISTS sequence_enrollments (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    sequence_id UUID NOT NULL REFERENCES sequences(id) ON DELETE CASCADE,
+    customer_id UUID NOT NULL REFERENCES customer_insights(id) ON DELETE CASCADE,
+    customer_jid VARCHAR(100) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'active',
+    source VARCHAR(30) NOT NULL DEFAULT 'manual',
+    next_position INTEGER NOT NULL DEFAULT 1,
+    next_step_at TIMESTAMPTZ,
+    last_step_at TIMESTAMPTZ,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    exit_reason VARCHAR(30),
+    enrolled_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    enrolled_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    ended_at TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_sequence_enrollments_active ON sequence_enrollments(sequence_id, customer_id) WHERE status = 'active';
+CREATE INDEX IF NOT EXISTS idx_sequence_enrollments_due ON sequence_enrollments(next_step_at) WHERE status = 'active';
+CREATE INDEX IF NOT EXISTS idx_sequence_enrollments_customer ON sequence_enrollments(customer_id);
+
+CREATE TABLE IF NOT EXISTS sequence_step_sends (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    enrollment_id UUID NOT NULL REFERENCES sequence_enrollments(id) ON DELETE CASCADE,
+    step_id UUID NOT NULL REFERENCES sequence_steps(id) ON DELETE CASCADE,
+    status VARCHAR(20) NOT NULL,
+    message_id VARCHAR(100),
+    error_code VARCHAR(30),
+    error_message TEXT,
+    sent_at TIMESTAMPTZ DEFAULT NOW(),
+    delivered_at TIMESTAMPTZ,
+    read_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_sequence_step_sends_step ON sequence_step_sends(step_id);
+CREATE INDEX IF NOT EXISTS idx_sequence_step_sends_message ON sequence_step_sends(message_id) WHERE message_id IS NOT NULL;
+
+COMMENT ON COLUMN sequences.trigger_event IS 'Enrolls customers automatically: first_message or order_intent';
+COMMENT ON COLUMN sequence_steps.delay_minutes IS 'Wait after the previous step, or after enrollment for the first step';
+COMMENT ON COLUMN sequence_steps.message_content IS 'Message template; template_id is used instead when set';
+COMMENT ON COLUMN sequence_steps.exit_on_reply IS 'Customers who messaged since enrolling leave instead of receiving this step';
+COMMENT ON COLUMN sequence_steps.exit_tag_ids IS 'Customers carrying one of these tags leave instead of receiving this step';
+COMMENT ON COLUMN sequence_enrollments.status IS 'active, completed, exited or cancelled';
+COMMENT ON COLUMN sequence_enrollments.source IS 'manual, tag, segment, first_message or order_intent';
+COMMENT ON COLUMN sequence_enrollments.next_position IS 'Position of the step sent next; for ended enrollments, the step they stopped at';
+COMMENT ON COLUMN sequence_enrollments.attempts IS 'Failed attempts to send the next step';
+COMMENT ON COLUMN sequence_enrollments.exit_reason IS 'replied, tag_added or opted_out';
+COMMENT ON COLUMN sequence_step_sends.status IS 'sent, or failed with error_code; transient failures are retried before failing';
+COMMENT ON COLUMN whatsapp_messages.sent_by IS 'customer, agent, ai, broadcast, sequence or phone (sent from the linked phone)';
@@ -0,0 +1,42 @@
+-- Migration 040: Follow-up Tasks
+-- Tasks to get back to a customer by a due time, created by agents or
+-- automatically (an order intent left without a reply for 24 hours). The
+-- follow-up scheduler announces tasks as they come due. A customer's
+-- needs_follow_up flag mirrors whether they have an open task.
+
+CREATE TABLE IF NOT EXISTS follow_up_tasks (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    customer_id UUID NOT NULL REFERENCES customer_insights(id) ON DELETE CASCADE,
+    assigned_to UUID REFERENCES users(id) ON DELETE SET NULL,
+    due_at TIMESTAMPTZ NOT NULL,
+    note TEXT,
+    status VARCHAR(20) NOT NULL DEFAULT 'open',
+    source VARCHAR(30) NOT NULL DEFAULT 'manual',
+    source_ref UUID,
+    snooze_count INTEGER NOT NULL DEFAULT 0,
+    notified_at TIMESTAMPTZ,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    completed_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    completed_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_follow_up_tasks_tenant ON follow_up_tasks(tenant_id, status, due_at);
+CREATE INDEX IF NOT EXISTS idx_follow_up_tasks_customer ON follow_up_tasks(customer_id) WHERE status = 'open';
+CREATE INDEX IF NOT EXISTS idx_follow_up_tasks_due ON follow_up_tasks(due_at) WHERE status = 'open' AND notified_at IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_follow_up_tasks_source ON follow_up_tasks(source, source_ref) WHERE source_ref IS NOT NULL;
+
+-- Customers flagged before tasks existed get one, due now
+INSERT INTO follow_up_tasks (tenant_id, customer_id, due_at, source)
+SELECT ci.tenant_id, ci.id, COALESCE(ci.follow_up_scheduled_at, NOW()), 'manual'
+FROM customer_insights ci
+WHERE ci.needs_follow_up = true
+  AND NOT EXISTS (SELECT 1 FROM follow_up_tasks t WHERE t.customer_id = ci.id);
+
+COMMENT ON TABLE follow_up_tasks IS 'Reminders to get back to a customer (see services/followup)';
+COMMENT ON COLUMN follow_up_tasks.status IS 'open, done or cancelled';
+COMMENT ON COLUMN follow_up_tasks.source IS 'manual, or order_intent for order intents left unanswered';
+COMMENT ON COLUMN follow_up_tasks.source_ref IS 'What created an automatic task, e.g. the ai_conversation_logs row of the order intent';
+COMMENT ON COLUMN follow_up_tasks.notified_at IS 'When the task was announced as due; cleared when it is rescheduled';
@@ -0,0 +1,34 @@
+-- Migration 041: Scheduled Messages
+-- Turns scheduled_messages into one-off messages to a customer: text, media
+-- or both, sent at a time picked in the tenant's timezone. The scheduled
+-- message dispatcher claims due rows ('sending') and sends them through the
+-- normal send path; until then they can be edited or cancelled.
+
+ALTER TABLE scheduled_messages ALTER COLUMN message_text DROP NOT NULL;
+ALTER TABLE scheduled_messages ALTER COLUMN scheduled_at TYPE TIMESTAMPTZ;
+ALTER TABLE scheduled_messages ALTER COLUMN sent_at TYPE TIMESTAMPTZ;
+
+ALTER TABLE scheduled_messages ADD COLUMN IF NOT EXISTS media_url TEXT;
+ALTER TABLE scheduled_messages ADD COLUMN IF NOT EXISTS media_type VARCHAR(20);
+ALTER TABLE scheduled_messages ADD COLUMN IF NOT EXISTS media_file_name VARCHAR(255);
+ALTER TABLE scheduled_messages ADD COLUMN IF NOT EXISTS timezone VARCHAR(64);
+ALTER TABLE scheduled_messages ADD COLUMN IF NOT EXISTS next_attempt_at TIMESTAMPTZ;
+ALTER TABLE scheduled_messages ADD COLUMN IF NOT EXISTS claimed_at TIMESTAMPTZ;
+ALTER TABLE scheduled_messages ADD COLUMN IF NOT EXISTS message_id VARCHAR(255);
+ALTER TABLE scheduled_messages ADD COLUMN IF NOT EXISTS error_code VARCHAR(30);
+ALTER TABLE scheduled_messages ADD COLUMN IF NOT EXISTS created_by UUID REFERENCES users(id) ON DELETE SET NULL;
+ALTER TABLE scheduled_messages ADD COLUMN IF NOT EXISTS cancelled_by UUID REFERENCES users(id) ON DELETE SET NULL;
+
+ALTER TABLE scheduled_messages DROP CONSTRAINT IF EXISTS scheduled_messages_status_check;
+ALTER TABLE scheduled_messages ADD CONSTRAINT scheduled_messages_status_check
+    CHECK (status IN ('pending', 'sending', 'sent', 'failed', 'cancelled'));
+
+CREATE INDEX IF NOT EXISTS idx_scheduled_messages_due
+    ON scheduled_messages(COALESCE(next_attempt_at, scheduled_at)) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS idx_scheduled_messages_tenant_time ON scheduled_messages(tenant_id, scheduled_at);
+
+COMMENT ON TABLE scheduled_messages IS 'One-off messages to a customer sent at a later time (see services/scheduledmsg)';
+COMMENT ON COLUMN scheduled_messages.status IS 'pending, sending (claimed by the dispatcher), sent, failed or cancelled';
+COMMENT ON COLUMN scheduled_messages.timezone IS 'Timezone the send time was picked in; the tenant''s unless overridden';
+COMMENT ON COLUMN scheduled_messages.next_attempt_at IS 'When a send that failed with a transient error is tried again';
+COMMENT ON COLUMN scheduled_messages.claimed_at IS 'When the dispatcher claimed the message; a stale claim is picked up again';
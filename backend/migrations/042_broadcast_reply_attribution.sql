@@ -0,0 +1,55 @@
+-- Migration 042: Broadcast Reply Attribution
+-- Inbound messages are attributed to the most recent broadcast the customer
+-- was sent within the attribution window (72 hours). The recipient keeps its
+-- first reply and the intents detected in the conversation that followed,
+-- so reply rate, time to reply and order intents can be counted per
+-- broadcast.
+
+ALTER TABLE broadcast_recipients ADD COLUMN IF NOT EXISTS replied_at TIMESTAMPTZ;
+ALTER TABLE broadcast_recipients ADD COLUMN IF NOT EXISTS reply_message_id VARCHAR(255);
+ALTER TABLE broadcast_recipients ADD COLUMN IF NOT EXISTS reply_intent VARCHAR(100);
+ALTER TABLE broadcast_recipients ADD COLUMN IF NOT EXISTS order_intent_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_broadcast_recipients_jid_sent ON broadcast_recipients(customer_jid, sent_at DESC) WHERE sent_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_broadcast_recipients_replied ON broadcast_recipients(broadcast_id, replied_at) WHERE replied_at IS NOT NULL;
+
+-- Attribute replies already received: each inbound message goes to the
+-- latest broadcast sent before it, within the window
+WITH sends AS (
+    SELECT br.id, b.tenant_id, br.customer_jid, br.sent_at,
+        LEAD(br.sent_at) OVER (PARTITION BY b.tenant_id, br.customer_jid ORDER BY br.sent_at) as next_sent_at
+    FROM broadcast_recipients br
+    JOIN broadcasts b ON b.id = br.broadcast_id
+    WHERE br.sent_at IS NOT NULL
+)
+UPDATE broadcast_recipients br
+SET replied_at = to_timestamp(r.timestamp), reply_message_id = r.message_id
+FROM sends s
+CROSS JOIN LATERAL (
+    SELECT m.timestamp, m.message_id
+    FROM whatsapp_messages m
+    WHERE m.tenant_id = s.tenant_id AND m.chat_jid = s.customer_jid AND NOT m.is_from_me
+      AND m.timestamp >= EXTRACT(EPOCH FROM s.sent_at)::bigint
+      AND m.timestamp <= EXTRACT(EPOCH FROM s.sent_at + INTERVAL '72 hours')::bigint
+      AND (s.next_sent_at IS NULL OR m.timestamp < EXTRACT(EPOCH FROM s.next_sent_at)::bigint)
+    ORDER BY m.timestamp
+    LIMIT 1
+) r
+WHERE br.id = s.id AND br.replied_at IS NULL;
+
+-- 'order_intent' is ai.IntentOrder (services/ai/insights.go)
+UPDATE broadcast_recipients br
+SET order_intent_at = (
+    SELECT MIN(l.created_at::timestamptz)
+    FROM ai_conversation_logs l
+    JOIN broadcasts b ON b.id = br.broadcast_id
+    WHERE l.tenant_id = b.tenant_id AND l.customer_jid = br.customer_jid AND l.detected_intent = 'order_intent'
+      AND l.created_at::timestamptz >= br.replied_at
+      AND l.created_at::timestamptz <= br.sent_at + INTERVAL '72 hours'
+)
+WHERE br.replied_at IS NOT NULL AND br.order_intent_at IS NULL;
+
+COMMENT ON COLUMN broadcast_recipients.replied_at IS 'First inbound message attributed to this send (see services/broadcast/attribution.go)';
+COMMENT ON COLUMN broadcast_recipients.reply_message_id IS 'WhatsApp ID of the first attributed reply';
+COMMENT ON COLUMN broadcast_recipients.reply_intent IS 'Intent detected on the first attributed reply';
+COMMENT ON COLUMN broadcast_recipients.order_intent_at IS 'When an order intent was first detected in the attributed conversation';
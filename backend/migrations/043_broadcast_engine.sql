@@ -0,0 +1,28 @@
+-- Migration 043: Broadcast Engine
+-- Manual sends and the scheduler now go through one engine. Recipient
+-- statuses are its checkpoint: a recipient is claimed ('queued') before it
+-- is handed to the queue or sent, and only sent, retrying or failed after.
+-- queued_at lets the engine find claims that were lost, e.g. to a restart,
+-- and hand those recipients out again; prepared_at records that a run's
+-- audience was resolved and split over variants, so it happens once.
+
+ALTER TABLE broadcast_recipients ADD COLUMN IF NOT EXISTS queued_at TIMESTAMPTZ;
+ALTER TABLE broadcast_runs ADD COLUMN IF NOT EXISTS prepared_at TIMESTAMPTZ;
+ALTER TABLE broadcasts ADD COLUMN IF NOT EXISTS checkpoint_at TIMESTAMPTZ;
+
+-- Finished runs and runs that already sent were prepared
+UPDATE broadcast_runs r SET prepared_at = r.started_at
+WHERE r.prepared_at IS NULL AND (r.status <> 'sending' OR EXISTS (
+    SELECT 1 FROM broadcast_recipients br WHERE br.run_id = r.id AND br.status <> 'pending'
+));
+
+-- Recipients claimed before queued_at existed count as claimed now
+UPDATE broadcast_recipients SET queued_at = NOW() WHERE status = 'queued' AND queued_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_broadcast_recipients_queued ON broadcast_recipients(queued_at) WHERE status = 'queued';
+CREATE INDEX IF NOT EXISTS idx_broadcast_recipients_pending ON broadcast_recipients(broadcast_id, created_at) WHERE status = 'pending';
+
+COMMENT ON COLUMN broadcast_recipients.queued_at IS 'When the engine claimed the recipient for sending';
+COMMENT ON COLUMN broadcast_runs.prepared_at IS 'When the run''s segment audience was resolved and its recipients split over variants';
+COMMENT ON COLUMN broadcasts.checkpoint_at IS 'When the engine last recorded progress dispatching the broadcast';
+COMMENT ON COLUMN broadcasts.status IS 'draft → scheduled → sending → paused/completed/cancelled; active for recurring broadcasts between runs (see services/broadcast/state.go)';
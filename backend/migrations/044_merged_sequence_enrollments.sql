@@ -0,0 +1,7 @@
+-- Migration 044: Merged Sequence Enrollments
+-- Merging customers moves the merged customer's sequence enrollments to the
+-- survivor. Where both were enrolled in the same sequence, the survivor's
+-- enrollment goes on and the merged one is cancelled with exit reason
+-- 'merged'; undoing the merge makes it active again.
+
+COMMENT ON COLUMN sequence_enrollments.exit_reason IS 'replied, tag_added, opted_out, or merged for enrollments cancelled by a customer merge';
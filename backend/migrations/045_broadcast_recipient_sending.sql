@@ -0,0 +1,12 @@
+-- Migration 045: Broadcast Recipient Sending
+-- A recipient is 'sending' from the moment a worker takes it until its send
+-- is recorded. The claim and the send's outcome are each written in one
+-- statement, so a redelivered message finds the recipient no longer queued
+-- and skips it. Recipients still 'sending' after a crash may already have
+-- received their message; recovery fails them as unknown rather than
+-- sending again.
+
+CREATE INDEX IF NOT EXISTS idx_broadcast_recipients_sending ON broadcast_recipients(queued_at) WHERE status = 'sending';
+
+COMMENT ON COLUMN broadcast_recipients.status IS 'pending, held (waiting for the A/B winner), queued, sending, retrying, sent, delivered, failed, cancelled';
+COMMENT ON COLUMN broadcast_recipients.queued_at IS 'When the engine claimed the recipient for sending, or a worker took it to send';
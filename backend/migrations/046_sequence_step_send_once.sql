@@ -0,0 +1,19 @@
+-- Migration 046: Sequence Step Sends Once
+-- A step's send is recorded as 'sending' before the message goes out, and
+-- each step is recorded once per enrollment. A pass that finds the step
+-- already recorded moves the enrollment on instead of sending it again;
+-- sends interrupted before their outcome was recorded fail as unknown.
+
+-- Keep one send per step, the successful one where a step went out twice
+DELETE FROM sequence_step_sends WHERE id IN (
+    SELECT id FROM (
+        SELECT id, ROW_NUMBER() OVER (
+            PARTITION BY enrollment_id, step_id ORDER BY status = 'sent' DESC, sent_at
+        ) as n
+        FROM sequence_step_sends
+    ) d WHERE d.n > 1
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_sequence_step_sends_once ON sequence_step_sends(enrollment_id, step_id);
+
+COMMENT ON COLUMN sequence_step_sends.status IS 'sending while the message goes out, then sent, or failed with error_code; transient failures are retried before failing';
@@ -0,0 +1,9 @@
+-- Migration 047: Media Captions Stored Once
+-- Media sent from the dashboard kept its caption in both message_text and
+-- caption, so it was indexed and shown twice. The caption is now stored
+-- only in caption, and readers fall back to it when message_text is empty.
+
+UPDATE whatsapp_messages SET message_text = NULL
+WHERE caption IS NOT NULL AND message_text = caption;
+
+COMMENT ON COLUMN whatsapp_messages.caption IS 'Caption of media sent from the dashboard; message_text is empty for those';
@@ -0,0 +1,86 @@
+package models
+
+import "time"
+
+// Assignment rule types
+const (
+	RuleTypeRoundRobin = "round_robin"
+	RuleTypeTag        = "tag"
+	RuleTypeIntent     = "intent"
+)
+
+// Conversation statuses
+const (
+	ConversationOpen     = "open"
+	ConversationPending  = "pending"
+	ConversationResolved = "resolved"
+	ConversationSnoozed  = "snoozed"
+)
+
+// IsValidConversationStatus reports whether status is a known conversation status
+func IsValidConversationStatus(status string) bool {
+	switch status {
+	case ConversationOpen, ConversationPending, ConversationResolved, ConversationSnoozed:
+		return true
+	}
+	return false
+}
+
+// Conversation is the chat thread with one customer and its assignee
+type Conversation struct {
+	ID          string     `json:"id" db:"id"`
+	TenantID    string     `json:"tenant_id" db:"tenant_id"`
+	CustomerID  *string    `json:"customer_id" db:"customer_id"`
+	CustomerJID string     `json:"customer_jid" db:"customer_jid"`
+	AssignedTo  *string    `json:"assigned_to" db:"assigned_to"`
+	AssignedAt  *time.Time `json:"assigned_at" db:"assigned_at"`
+	AssignedBy  *string    `json:"assigned_by" db:"assigned_by"`
+	Status      string     `json:"status" db:"status"`
+	SnoozeUntil *time.Time `json:"snooze_until" db:"snooze_until"`
+	ResolvedAt  *time.Time `json:"resolved_at" db:"resolved_at"`
+
+	LastMessageID     *string    `json:"last_message_id" db:"last_message_id"`
+	LastMessageText   *string    `json:"last_message_text" db:"last_message_text"`
+	LastMessageType   *string    `json:"last_message_type" db:"last_message_type"`
+	LastMessageFromMe bool       `json:"last_message_from_me" db:"last_message_from_me"`
+	LastMessageAt     *time.Time `json:"last_message_at" db:"last_message_at"`
+
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// ConversationSummary is a conversation as listed in the inbox
+type ConversationSummary struct {
+	Conversation
+	CustomerName  *string `json:"customer_name" db:"customer_name"`
+	CustomerPhone *string `json:"customer_phone" db:"customer_phone"`
+	AssigneeName  *string `json:"assignee_name" db:"assignee_name"`
+	UnreadCount   int     `json:"unread_count" db:"unread_count"`
+}
+
+// ConversationMessage is one message in a conversation's history
+type ConversationMessage struct {
+	ID          string    `json:"id" db:"id"`
+	MessageID   string    `json:"message_id" db:"message_id"`
+	MessageType string    `json:"message_type" db:"message_type"`
+	MessageText string    `json:"message_text" db:"message_text"`
+	MediaURL    string    `json:"media_url,omitempty" db:"media_url"`
+	IsFromMe    bool      `json:"is_from_me" db:"is_from_me"`
+	Timestamp   int64     `json:"-" db:"timestamp"`
+	SentAt      time.Time `json:"timestamp" db:"sent_at"`
+}
+
+// AssignmentRule routes unassigned conversations to a member
+type AssignmentRule struct {
+	ID           string    `json:"id" db:"id"`
+	TenantID     string    `json:"tenant_id" db:"tenant_id"`
+	Name         string    `json:"name" db:"name"`
+	RuleType     string    `json:"rule_type" db:"rule_type"`
+	MatchValue   *string   `json:"match_value" db:"match_value"`
+	AssignToUser *string   `json:"assign_to_user" db:"assign_to_user"`
+	AssignToRole *string   `json:"assign_to_role" db:"assign_to_role"`
+	Priority     int       `json:"priority" db:"priority"`
+	IsActive     bool      `json:"is_active" db:"is_active"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at" db:"updated_at"`
+}
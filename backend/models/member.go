@@ -0,0 +1,62 @@
+package models
+
+import "time"
+
+// Tenant member roles, from most to least privileged
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleAgent  = "agent"
+	RoleViewer = "viewer"
+)
+
+// roleRanks orders roles so a higher rank includes everything a lower rank can do
+var roleRanks = map[string]int{
+	RoleViewer: 1,
+	RoleAgent:  2,
+	RoleAdmin:  3,
+	RoleOwner:  4,
+}
+
+// IsValidRole reports whether role is a known tenant role
+func IsValidRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// RoleAtLeast reports whether role grants at least the permissions of minRole
+func RoleAtLeast(role, minRole string) bool {
+	return roleRanks[role] >= roleRanks[minRole] && roleRanks[role] > 0
+}
+
+// TenantMember represents a user's membership in a tenant
+type TenantMember struct {
+	ID        string    `json:"id" db:"id"`
+	TenantID  string    `json:"tenant_id" db:"tenant_id"`
+	UserID    string    `json:"user_id" db:"user_id"`
+	Email     string    `json:"email" db:"email"`
+	FullName  string    `json:"full_name" db:"full_name"`
+	Role      string    `json:"role" db:"role"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// TenantMembership is a tenant as seen by one of its members
+type TenantMembership struct {
+	TenantID     string `json:"tenant_id" db:"tenant_id"`
+	BusinessName string `json:"business_name" db:"business_name"`
+	Role         string `json:"role" db:"role"`
+	IsCurrent    bool   `json:"is_current" db:"-"`
+}
+
+// TenantInvitation represents an email invitation to join a tenant
+type TenantInvitation struct {
+	ID         string     `json:"id" db:"id"`
+	TenantID   string     `json:"tenant_id" db:"tenant_id"`
+	Email      string     `json:"email" db:"email"`
+	Role       string     `json:"role" db:"role"`
+	Token      string     `json:"-" db:"token"`
+	InvitedBy  *string    `json:"invited_by" db:"invited_by"`
+	ExpiresAt  time.Time  `json:"expires_at" db:"expires_at"`
+	AcceptedAt *time.Time `json:"accepted_at" db:"accepted_at"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+}
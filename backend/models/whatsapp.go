@@ -11,6 +11,7 @@ type Tenant struct {
 	BusinessDescription string    `json:"business_description" db:"business_description"`
 	BusinessPhone       string    `json:"business_phone" db:"business_phone"`
 	BusinessAddress     string    `json:"business_address" db:"business_address"`
+	Timezone            string    `json:"timezone" db:"timezone"`
 	IsActive            bool      `json:"is_active" db:"is_active"`
 	CreatedAt           time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt           time.Time `json:"updated_at" db:"updated_at"`
@@ -0,0 +1,226 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// IntentOrder is the intent of customers who want to buy. It enrolls them in
+// sequences, gets unanswered ones a follow-up and counts as a broadcast
+// conversion.
+const IntentOrder = "order_intent"
+
+// Intents are the intent labels used across auto-replies and insights
+var Intents = []string{
+	"price_inquiry", "location_inquiry", "hours_inquiry", "availability_inquiry",
+	IntentOrder, "complaint", "shipping_inquiry", "payment_inquiry", "general_inquiry",
+}
+
+// Sentiments allowed by customer_insights.sentiment
+var Sentiments = []string{"positive", "neutral", "negative", "mixed"}
+
+const (
+	insightMaxTokens     = 600
+	maxProductInterests  = 10
+	maxFacts             = 15
+	maxFactLength        = 200
+	maxSummaryLength     = 1000
+	maxProductNameLength = 100
+)
+
+// ErrInvalidInsight is returned when the model's answer isn't usable JSON
+var ErrInvalidInsight = errors.New("AI returned an invalid insight")
+
+var factKeyPattern = regexp.MustCompile(`^[a-z0-9_]{1,50}$`)
+
+type structuredOutputKey struct{}
+
+// WithStructuredOutput marks a request whose answer is parsed by code.
+// Providers then leave out the chat reply style rules (language, length).
+func WithStructuredOutput(ctx context.Context) context.Context {
+	return context.WithValue(ctx, structuredOutputKey{}, true)
+}
+
+// IsStructuredOutput reports whether ctx asks for structured output
+func IsStructuredOutput(ctx context.Context) bool {
+	structured, _ := ctx.Value(structuredOutputKey{}).(bool)
+	return structured
+}
+
+// InsightRequest is a conversation to analyse with the tenant's provider
+type InsightRequest struct {
+	Provider        string
+	APIKey          string // empty to use the system key
+	Model           string
+	BusinessContext string
+	PreviousSummary string
+	Transcript      string // oldest first, one "Customer:"/"Business:" line per message
+}
+
+// ConversationInsight is what the AI derived from a conversation
+type ConversationInsight struct {
+	Sentiment       string            `json:"sentiment"`
+	Intent          string            `json:"intent"`
+	ProductInterest []string          `json:"product_interest"`
+	Summary         string            `json:"summary"`
+	Facts           map[string]string `json:"facts"`
+}
+
+const insightPrompt = `You analyse WhatsApp conversations between a small business and a customer.
+Answer with one JSON object and nothing else, using this shape:
+{"sentiment": "positive|neutral|negative|mixed",
+ "intent": "<one of: %s>",
+ "product_interest": ["<product or service the customer is interested in>"],
+ "summary": "<2-4 sentences summarising the whole relationship so far, in the conversation's language>",
+ "facts": {"name": "", "city": "", "preferred_product": ""}}
+Only include facts the customer stated; leave out unknown facts. Fact keys are lowercase snake_case.
+Update the previous summary with the new messages instead of starting over.`
+
+// AnalyzeConversation asks the AI for the sentiment, intent, product
+// interest, a rolling summary and facts of a conversation. The AIResponse
+// is returned with the usage even when the answer can't be parsed, so the
+// cost can still be recorded.
+func (s *AIService) AnalyzeConversation(ctx context.Context, req InsightRequest) (*ConversationInsight, *AIResponse, error) {
+	provider, err := s.insightProvider(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer provider.Close()
+
+	ctx, cancel := context.WithTimeout(WithStructuredOutput(ctx), 20*time.Second)
+	defer cancel()
+
+	var contextInfo strings.Builder
+	if req.BusinessContext != "" {
+		contextInfo.WriteString("Business: " + req.BusinessContext + "\n")
+	}
+	if req.PreviousSummary != "" {
+		contextInfo.WriteString("Previous summary: " + req.PreviousSummary + "\n")
+	}
+
+	systemPrompt := fmt.Sprintf(insightPrompt, strings.Join(Intents, ", "))
+	resp, err := provider.GenerateResponse(ctx, systemPrompt, "CONVERSATION:\n"+req.Transcript, contextInfo.String())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to analyse conversation: %w", err)
+	}
+
+	insight, err := parseInsight(resp.Response)
+	return insight, resp, err
+}
+
+// insightProvider creates a provider with room for the JSON answer. The
+// system key of the requested provider is used when the tenant has no key.
+func (s *AIService) insightProvider(req InsightRequest) (AIProvider, error) {
+	config := ProviderConfig{
+		Provider:    req.Provider,
+		APIKey:      req.APIKey,
+		Model:       req.Model,
+		MaxTokens:   insightMaxTokens,
+		Temperature: 0.2,
+	}
+
+	if config.APIKey == "" {
+		if config.Provider == "" {
+			config.Provider = "gemini"
+		}
+		config.APIKey = os.Getenv(strings.ToUpper(config.Provider) + "_API_KEY")
+		if config.APIKey == "" && s.defaultAPIKey != "" {
+			// Fall back to the system Gemini key and model
+			config.Provider = "gemini"
+			config.APIKey = s.defaultAPIKey
+			config.Model = ""
+		}
+	}
+	if config.APIKey == "" {
+		return nil, fmt.Errorf("no API key available for provider %s", config.Provider)
+	}
+
+	return CreateProvider(config)
+}
+
+// parseInsight extracts the JSON object from the answer and normalizes it
+func parseInsight(answer string) (*ConversationInsight, error) {
+	start := strings.Index(answer, "{")
+	end := strings.LastIndex(answer, "}")
+	if start < 0 || end < start {
+		return nil, ErrInvalidInsight
+	}
+
+	var raw struct {
+		Sentiment       string                 `json:"sentiment"`
+		Intent          string                 `json:"intent"`
+		ProductInterest []string               `json:"product_interest"`
+		Summary         string                 `json:"summary"`
+		Facts           map[string]interface{} `json:"facts"`
+	}
+	if err := json.Unmarshal([]byte(answer[start:end+1]), &raw); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidInsight, err)
+	}
+
+	insight := &ConversationInsight{
+		Sentiment:       oneOf(raw.Sentiment, Sentiments, ""),
+		Intent:          oneOf(raw.Intent, Intents, "general_inquiry"),
+		ProductInterest: []string{},
+		Summary:         truncate(strings.TrimSpace(raw.Summary), maxSummaryLength),
+		Facts:           map[string]string{},
+	}
+
+	seen := map[string]bool{}
+	for _, product := range raw.ProductInterest {
+		product = truncate(strings.TrimSpace(product), maxProductNameLength)
+		if product == "" || seen[strings.ToLower(product)] || len(insight.ProductInterest) >= maxProductInterests {
+			continue
+		}
+		seen[strings.ToLower(product)] = true
+		insight.ProductInterest = append(insight.ProductInterest, product)
+	}
+
+	for key, value := range raw.Facts {
+		key = strings.ToLower(strings.TrimSpace(key))
+		var text string
+		switch v := value.(type) {
+		case string:
+			text = strings.TrimSpace(v)
+		case float64, bool:
+			text = fmt.Sprint(v)
+		}
+		if !factKeyPattern.MatchString(key) || isUnknown(text) || len(insight.Facts) >= maxFacts {
+			continue
+		}
+		insight.Facts[key] = truncate(text, maxFactLength)
+	}
+
+	return insight, nil
+}
+
+func oneOf(value string, allowed []string, fallback string) string {
+	value = strings.ToLower(strings.TrimSpace(value))
+	for _, a := range allowed {
+		if value == a {
+			return value
+		}
+	}
+	return fallback
+}
+
+func isUnknown(value string) bool {
+	switch strings.ToLower(value) {
+	case "", "-", "null", "none", "unknown", "n/a", "tidak diketahui":
+		return true
+	}
+	return false
+}
+
+func truncate(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	return string(runes[:max])
+}
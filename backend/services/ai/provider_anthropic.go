@@ -103,7 +103,9 @@ func (a *AnthropicProvider) GenerateResponse(ctx context.Context, systemPrompt,
 	if contextInfo != "" {
 		fullSystem += "\n\nCONTEXT:\n" + contextInfo
 	}
-	fullSystem += "\n\nIMPORTANT RULES:\n- Respond in Indonesian language\n- Be helpful, friendly, and professional\n- Keep responses concise (max 300 characters)\n- If you don't know something, say so honestly"
+	if !IsStructuredOutput(ctx) {
+		fullSystem += "\n\nIMPORTANT RULES:\n- Respond in Indonesian language\n- Be helpful, friendly, and professional\n- Keep responses concise (max 300 characters)\n- If you don't know something, say so honestly"
+	}
 
 	reqBody := anthropicRequest{
 		Model:     a.modelName,
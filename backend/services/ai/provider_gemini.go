@@ -82,7 +82,7 @@ func (g *GeminiProvider) GenerateResponse(ctx context.Context, systemPrompt, use
 	ctxWithTimeout, cancel := context.WithTimeout(ctx, 8*time.Second)
 	defer cancel()
 
-	fullPrompt := buildPrompt(systemPrompt, contextInfo, userMessage)
+	fullPrompt := buildPrompt(systemPrompt, contextInfo, userMessage, !IsStructuredOutput(ctx))
 
 	resp, err := g.model.GenerateContent(ctxWithTimeout, genai.Text(fullPrompt))
 	if err != nil {
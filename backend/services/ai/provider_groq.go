@@ -73,7 +73,9 @@ func (g *GroqProvider) GenerateResponse(ctx context.Context, systemPrompt, userM
 	if contextInfo != "" {
 		fullContext += "\n\nCONTEXT:\n" + contextInfo
 	}
-	fullContext += "\n\nIMPORTANT RULES:\n- Respond in Indonesian language\n- Be helpful, friendly, and professional\n- Keep responses concise (max 300 characters)\n- If you don't know something, say so honestly"
+	if !IsStructuredOutput(ctx) {
+		fullContext += "\n\nIMPORTANT RULES:\n- Respond in Indonesian language\n- Be helpful, friendly, and professional\n- Keep responses concise (max 300 characters)\n- If you don't know something, say so honestly"
+	}
 
 	reqBody := openAIRequest{
 		Model: g.modelName,
@@ -103,7 +103,9 @@ func (o *OpenAIProvider) GenerateResponse(ctx context.Context, systemPrompt, use
 	if contextInfo != "" {
 		fullContext += "\n\nCONTEXT:\n" + contextInfo
 	}
-	fullContext += "\n\nIMPORTANT RULES:\n- Respond in Indonesian language\n- Be helpful, friendly, and professional\n- Keep responses concise (max 300 characters)\n- If you don't know something, say so honestly"
+	if !IsStructuredOutput(ctx) {
+		fullContext += "\n\nIMPORTANT RULES:\n- Respond in Indonesian language\n- Be helpful, friendly, and professional\n- Keep responses concise (max 300 characters)\n- If you don't know something, say so honestly"
+	}
 
 	reqBody := openAIRequest{
 		Model: o.modelName,
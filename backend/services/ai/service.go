@@ -273,7 +273,7 @@ func (s *AIService) detectIntent(message string) string {
 		return "availability_inquiry"
 	}
 	if containsAny(msg, []string{"pesan", "order", "beli", "buy", "mau"}) {
-		return "order_intent"
+		return IntentOrder
 	}
 	if containsAny(msg, []string{"komplain", "kecewa", "marah", "complaint", "buruk", "jelek"}) {
 		return "complaint"
@@ -309,8 +309,9 @@ func (s *AIService) HasDefaultProvider() bool {
 	return s.defaultProvider != nil
 }
 
-// Helper function for prompt building
-func buildPrompt(systemPrompt, contextInfo, userMessage string) string {
+// Helper function for prompt building. replyRules adds the chat reply style
+// rules; they are left out for structured (JSON) output.
+func buildPrompt(systemPrompt, contextInfo, userMessage string, replyRules bool) string {
 	var sb strings.Builder
 
 	sb.WriteString("SYSTEM INSTRUCTIONS:\n")
@@ -323,11 +324,13 @@ func buildPrompt(systemPrompt, contextInfo, userMessage string) string {
 		sb.WriteString("\n\n")
 	}
 
-	sb.WriteString("RULES:\n")
-	sb.WriteString("- Bahasa Indonesia\n")
-	sb.WriteString("- Ramah, ringkas (max 150 karakter)\n")
-	sb.WriteString("- Jujur jika tidak tahu\n")
-	sb.WriteString("- Gunakan context yang diberikan\n\n")
+	if replyRules {
+		sb.WriteString("RULES:\n")
+		sb.WriteString("- Bahasa Indonesia\n")
+		sb.WriteString("- Ramah, ringkas (max 150 karakter)\n")
+		sb.WriteString("- Jujur jika tidak tahu\n")
+		sb.WriteString("- Gunakan context yang diberikan\n\n")
+	}
 
 	sb.WriteString("USER MESSAGE:\n")
 	sb.WriteString(userMessage)
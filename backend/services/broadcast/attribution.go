@@ -0,0 +1,133 @@
+package broadcast
+
+import (
+	"context"
+	"time"
+
+	"gowa-backend/services/ai"
+)
+
+// Attribution sums up the replies attributed to a broadcast. Times to reply
+// are in seconds and nil without replies.
+type Attribution struct {
+	Sent              int            `json:"sent" db:"sent"`
+	Replied           int            `json:"replied" db:"replied"`
+	ReplyRate         float64        `json:"reply_rate" db:"-"`
+	AvgTimeToReply    *float64       `json:"avg_time_to_reply" db:"avg_time_to_reply"`
+	MedianTimeToReply *float64       `json:"median_time_to_reply" db:"median_time_to_reply"`
+	OrderIntents      int            `json:"order_intents" db:"order_intents"`
+	OrderIntentRate   float64        `json:"order_intent_rate" db:"-"`
+	Intents           map[string]int `json:"intents" db:"-"`
+}
+
+// Reply is a reply attributed to a broadcast, with the message that started it
+type Reply struct {
+	RecipientID   string     `json:"recipient_id" db:"recipient_id"`
+	RunID         *string    `json:"run_id" db:"run_id"`
+	VariantID     *string    `json:"variant_id" db:"variant_id"`
+	CustomerID    string     `json:"customer_id" db:"customer_id"`
+	CustomerJID   string     `json:"customer_jid" db:"customer_jid"`
+	CustomerName  string     `json:"customer_name" db:"customer_name"`
+	SentAt        time.Time  `json:"sent_at" db:"sent_at"`
+	RepliedAt     time.Time  `json:"replied_at" db:"replied_at"`
+	TimeToReply   int        `json:"time_to_reply" db:"time_to_reply"`
+	MessageID     *string    `json:"message_id" db:"reply_message_id"`
+	MessageText   *string    `json:"message_text" db:"message_text"`
+	Intent        *string    `json:"intent" db:"reply_intent"`
+	OrderIntentAt *time.Time `json:"order_intent_at" db:"order_intent_at"`
+}
+
+// Attribution counts the broadcast's sends, attributed replies and order
+// intents over all its runs. The reply rate is of sends, the order intent
+// rate of replies.
+func (s *Service) Attribution(ctx context.Context, broadcastID string) (*Attribution, error) {
+	var a Attribution
+	err := s.db.GetContext(ctx, &a, `
+		SELECT COUNT(sent_at) as sent,
+			COUNT(replied_at) as replied,
+			AVG(EXTRACT(EPOCH FROM replied_at - sent_at)) as avg_time_to_reply,
+			percentile_cont(0.5) WITHIN GROUP (ORDER BY EXTRACT(EPOCH FROM replied_at - sent_at)) as median_time_to_reply,
+			COUNT(order_intent_at) as order_intents
+		FROM broadcast_recipients
+		WHERE broadcast_id = $1
+	`, broadcastID)
+	if err != nil {
+		return nil, err
+	}
+
+	var intents []struct {
+		Intent string `db:"reply_intent"`
+		Count  int    `db:"count"`
+	}
+	err = s.db.SelectContext(ctx, &intents, `
+		SELECT reply_intent, COUNT(*) as count
+		FROM broadcast_recipients
+		WHERE broadcast_id = $1 AND reply_intent IS NOT NULL
+		GROUP BY reply_intent
+	`, broadcastID)
+	if err != nil {
+		return nil, err
+	}
+	a.Intents = map[string]int{}
+	for _, i := range intents {
+		a.Intents[i.Intent] = i.Count
+	}
+
+	if a.Sent > 0 {
+		a.ReplyRate = rate(a.Replied, a.Sent)
+	}
+	if a.Replied > 0 {
+		a.OrderIntentRate = rate(a.OrderIntents, a.Replied)
+	}
+	return &a, nil
+}
+
+// Replies returns a page of the broadcast's attributed replies, latest
+// first, with their total
+func (s *Service) Replies(ctx context.Context, tenantID, broadcastID string, limit, offset int) ([]Reply, int, error) {
+	var total int
+	err := s.db.GetContext(ctx, &total, `
+		SELECT COUNT(*) FROM broadcast_recipients WHERE broadcast_id = $1 AND replied_at IS NOT NULL
+	`, broadcastID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	replies := []Reply{}
+	err = s.db.SelectContext(ctx, &replies, `
+		SELECT br.id as recipient_id, br.run_id, br.variant_id, br.customer_id, br.customer_jid,
+			COALESCE(ci.customer_name, ci.customer_phone, br.customer_jid) as customer_name,
+			br.sent_at, br.replied_at, EXTRACT(EPOCH FROM br.replied_at - br.sent_at)::int as time_to_reply,
+			br.reply_message_id, m.message_text, br.reply_intent, br.order_intent_at
+		FROM broadcast_recipients br
+		LEFT JOIN customer_insights ci ON ci.id = br.customer_id
+		LEFT JOIN whatsapp_messages m ON m.tenant_id = $2 AND m.message_id = br.reply_message_id
+		WHERE br.broadcast_id = $1 AND br.replied_at IS NOT NULL
+		ORDER BY br.replied_at DESC
+		LIMIT $3 OFFSET $4
+	`, broadcastID, tenantID, limit, offset)
+	return replies, total, err
+}
+
+// AttributeIntent records an intent detected on a customer's message
+// against the broadcast their reply was attributed to: the first intent as
+// the reply's, and the first order intent as a conversion. Only the latest
+// send within ReplyWindow, and only once answered, is considered.
+func (s *Service) AttributeIntent(ctx context.Context, tenantID, customerJID, intent string) error {
+	if intent == "" {
+		return nil
+	}
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE broadcast_recipients br SET
+			reply_intent = COALESCE(br.reply_intent, $3::text),
+			order_intent_at = CASE WHEN $3::text = $5::text THEN COALESCE(br.order_intent_at, NOW()) ELSE br.order_intent_at END
+		WHERE br.replied_at IS NOT NULL AND br.id = (
+			SELECT r.id FROM broadcast_recipients r
+			JOIN broadcasts b ON b.id = r.broadcast_id
+			WHERE b.tenant_id = $1 AND r.customer_jid = $2 AND r.sent_at >= NOW() - make_interval(secs => $4)
+			ORDER BY r.sent_at DESC
+			LIMIT 1
+		)
+	`, tenantID, customerJID, intent, ReplyWindow.Seconds(), ai.IntentOrder)
+	return err
+}
@@ -0,0 +1,356 @@
+package broadcast
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"gowa-backend/services/recurrence"
+	"gowa-backend/services/redis"
+	ws "gowa-backend/services/websocket"
+
+	"github.com/lib/pq"
+)
+
+// Broadcast statuses
+const (
+	StatusSending   = "sending"
+	StatusPaused    = "paused"
+	StatusCompleted = "completed"
+	StatusCancelled = "cancelled"
+)
+
+// Pause reasons
+const (
+	PauseManual = "manual"
+	PauseWindow = "window"
+)
+
+var (
+	// ErrInvalidWindow wraps every send window validation error
+	ErrInvalidWindow = errors.New("invalid send window")
+	// ErrNotSending is returned when pausing a broadcast that is not sending
+	ErrNotSending = errors.New("broadcast is not sending")
+	// ErrNotPaused is returned when resuming a broadcast that is not paused
+	ErrNotPaused = errors.New("broadcast is not paused")
+	// ErrNotCancellable is returned when cancelling a finished broadcast
+	ErrNotCancellable = errors.New("broadcast cannot be cancelled")
+)
+
+// Window is a daily send window. An end before the start spans midnight,
+// e.g. 20:00–06:00.
+type Window struct {
+	Start int // minutes after midnight
+	End   int
+}
+
+// ParseWindow reads a window from "HH:MM" times. Without both times there is
+// no window and nil is returned.
+func ParseWindow(start, end string) (*Window, error) {
+	if start == "" && end == "" {
+		return nil, nil
+	}
+	if start == "" || end == "" {
+		return nil, fmt.Errorf("%w: set both the start and the end", ErrInvalidWindow)
+	}
+	s, err := time.Parse("15:04", start)
+	if err != nil {
+		return nil, fmt.Errorf("%w: start must be HH:MM", ErrInvalidWindow)
+	}
+	e, err := time.Parse("15:04", end)
+	if err != nil {
+		return nil, fmt.Errorf("%w: end must be HH:MM", ErrInvalidWindow)
+	}
+	w := &Window{Start: s.Hour()*60 + s.Minute(), End: e.Hour()*60 + e.Minute()}
+	if w.Start == w.End {
+		return nil, fmt.Errorf("%w: start and end must differ", ErrInvalidWindow)
+	}
+	return w, nil
+}
+
+// Contains reports whether t falls in the window on the wall clock of loc.
+// A nil window always does.
+func (w *Window) Contains(t time.Time, loc *time.Location) bool {
+	if w == nil {
+		return true
+	}
+	t = t.In(loc)
+	m := t.Hour()*60 + t.Minute()
+	if w.Start < w.End {
+		return m >= w.Start && m < w.End
+	}
+	return m >= w.Start || m < w.End
+}
+
+// window loads a broadcast's send window and its tenant's timezone
+func (s *Service) window(ctx context.Context, broadcastID string) (*Window, *time.Location, error) {
+	var times struct {
+		Start    string `db:"window_start"`
+		End      string `db:"window_end"`
+		Timezone string `db:"timezone"`
+	}
+	err := s.db.GetContext(ctx, &times, `
+		SELECT COALESCE(to_char(b.send_window_start, 'HH24:MI'), '') as window_start,
+		       COALESCE(to_char(b.send_window_end, 'HH24:MI'), '') as window_end,
+		       COALESCE(t.timezone, '') as timezone
+		FROM broadcasts b JOIN tenants t ON t.id = b.tenant_id
+		WHERE b.id = $1
+	`, broadcastID)
+	if err != nil {
+		return nil, nil, err
+	}
+	w, err := ParseWindow(times.Start, times.End)
+	return w, recurrence.LoadLocation(times.Timezone), err
+}
+
+// InWindow reports whether the broadcast may send now
+func (s *Service) InWindow(ctx context.Context, broadcastID string) (bool, error) {
+	w, loc, err := s.window(ctx, broadcastID)
+	if err != nil {
+		return false, err
+	}
+	return w.Contains(time.Now(), loc), nil
+}
+
+// Continue reports whether the broadcast should go on sending. It stops once
+// the broadcast is paused or cancelled, and pauses it outside its send
+// window. Recurring broadcasts that were 'active' while their run drained
+// go on as well.
+func (s *Service) Continue(ctx context.Context, queue *redis.Client, broadcastID string) (bool, error) {
+	var status string
+	if err := s.db.GetContext(ctx, &status, `SELECT status FROM broadcasts WHERE id = $1`, broadcastID); err != nil {
+		return false, err
+	}
+	switch status {
+	case "active":
+		return true, nil
+	case StatusSending:
+	default:
+		return false, nil
+	}
+
+	inWindow, err := s.InWindow(ctx, broadcastID)
+	if err != nil || inWindow {
+		return inWindow, err
+	}
+	if err := s.Pause(ctx, queue, broadcastID, PauseWindow); err != nil && err != ErrNotSending {
+		return false, err
+	}
+	return false, nil
+}
+
+// Pause stops a sending broadcast. Its queued recipients are taken back out
+// of the queue and become pending again; ones a worker already picked up
+// finish sending. queue may be nil when broadcasts are sent without Redis.
+func (s *Service) Pause(ctx context.Context, queue *redis.Client, broadcastID, reason string) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE broadcasts SET status = 'paused', paused_at = NOW(), pause_reason = $2, updated_at = NOW()
+		WHERE id = $1 AND status = ANY($3)
+	`, broadcastID, reason, pq.Array(From(StatusPaused)))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotSending
+	}
+
+	if err := s.pullBack(ctx, queue, broadcastID, "pending"); err != nil {
+		return err
+	}
+	s.PublishProgress(ctx, broadcastID)
+	return nil
+}
+
+// Resume continues a paused broadcast. Outside its send window it stays
+// paused until the window opens; resumed reports whether it is sending.
+// The caller dispatches the pending recipients.
+func (s *Service) Resume(ctx context.Context, broadcastID string) (resumed bool, err error) {
+	inWindow, err := s.InWindow(ctx, broadcastID)
+	if err != nil {
+		return false, err
+	}
+
+	query := `
+		UPDATE broadcasts SET status = 'sending', paused_at = NULL, pause_reason = NULL, updated_at = NOW()
+		WHERE id = $1 AND status = 'paused'
+	`
+	if !inWindow {
+		query = `
+			UPDATE broadcasts SET pause_reason = 'window', updated_at = NOW()
+			WHERE id = $1 AND status = 'paused'
+		`
+	}
+	res, err := s.db.ExecContext(ctx, query, broadcastID)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, ErrNotPaused
+	}
+
+	s.PublishProgress(ctx, broadcastID)
+	return inWindow, nil
+}
+
+// Cancel stops a broadcast for good. Recipients that were not sent yet,
+// including queued ones, are cancelled.
+func (s *Service) Cancel(ctx context.Context, queue *redis.Client, tenantID, broadcastID string) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE broadcasts SET status = 'cancelled', paused_at = NULL, pause_reason = NULL, updated_at = NOW()
+		WHERE id = $1 AND tenant_id = $2 AND status = ANY($3)
+	`, broadcastID, tenantID, pq.Array(From(StatusCancelled)))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotCancellable
+	}
+
+	if err := s.pullBack(ctx, queue, broadcastID, "cancelled"); err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		UPDATE broadcast_recipients SET status = 'cancelled'
+		WHERE broadcast_id = $1 AND status IN ('pending', 'held', 'retrying')
+	`, broadcastID)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		UPDATE broadcast_runs SET status = 'cancelled', completed_at = NOW()
+		WHERE broadcast_id = $1 AND status = 'sending'
+	`, broadcastID)
+	if err != nil {
+		return err
+	}
+	s.PublishProgress(ctx, broadcastID)
+	return nil
+}
+
+// Complete marks a sending broadcast completed once no recipient is left to
+// send: none pending, queued, being sent, held for an A/B winner or waiting
+// for a retry. A recurring broadcast with a next run scheduled goes back to
+// 'active' instead; its last run completes it. Recurring broadcasts that are
+// already 'active' stay that way; only their runs complete.
+func (s *Service) Complete(ctx context.Context, broadcastID string) (bool, error) {
+	if err := s.completeRuns(ctx, broadcastID); err != nil {
+		return false, err
+	}
+
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE broadcasts SET
+			status = CASE WHEN is_recurring AND scheduled_at > started_at THEN 'active' ELSE 'completed' END,
+			completed_at = CASE WHEN is_recurring AND scheduled_at > started_at THEN completed_at ELSE NOW() END,
+			updated_at = NOW()
+		WHERE id = $1 AND status = ANY($2) AND NOT EXISTS (
+			SELECT 1 FROM broadcast_recipients
+			WHERE broadcast_id = $1 AND status IN ('pending', 'queued', 'sending', 'held', 'retrying')
+		)
+	`, broadcastID, pq.Array(From(StatusCompleted)))
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	if n > 0 {
+		s.PublishProgress(ctx, broadcastID)
+	}
+	return n > 0, nil
+}
+
+// pullBack removes the broadcast's messages from the queue and gives their
+// recipients the status
+func (s *Service) pullBack(ctx context.Context, queue *redis.Client, broadcastID, status string) error {
+	if queue == nil {
+		return nil
+	}
+	removed, err := queue.RemoveBroadcastMessages(ctx, broadcastID)
+	if len(removed) > 0 {
+		_, dbErr := s.db.ExecContext(ctx, `
+			UPDATE broadcast_recipients SET status = $1
+			WHERE id::text = ANY($2) AND status = 'queued'
+		`, status, pq.Array(removed))
+		if dbErr != nil {
+			return dbErr
+		}
+	}
+	return err
+}
+
+// Progress is how far a broadcast has got
+type Progress struct {
+	BroadcastID  string     `json:"broadcast_id" db:"broadcast_id"`
+	TenantID     string     `json:"-" db:"tenant_id"`
+	Status       string     `json:"status" db:"status"`
+	PauseReason  *string    `json:"pause_reason" db:"pause_reason"`
+	CheckpointAt *time.Time `json:"checkpoint_at" db:"checkpoint_at"`
+	Total        int        `json:"total" db:"total"`
+	Pending      int        `json:"pending" db:"pending"`
+	Held         int        `json:"held" db:"held"`
+	Queued       int        `json:"queued" db:"queued"`
+	Sending      int        `json:"sending" db:"sending"`
+	Retrying     int        `json:"retrying" db:"retrying"`
+	Sent         int        `json:"sent" db:"sent"`
+	Delivered    int        `json:"delivered" db:"delivered"`
+	Read         int        `json:"read" db:"read"`
+	Failed       int        `json:"failed" db:"failed"`
+	Cancelled    int        `json:"cancelled" db:"cancelled"`
+}
+
+// Progress counts the recipients of a broadcast's current run by status
+func (s *Service) Progress(ctx context.Context, broadcastID string) (*Progress, error) {
+	var p Progress
+	err := s.db.GetContext(ctx, &p, `
+		SELECT b.id as broadcast_id, b.tenant_id, b.status, b.pause_reason, b.checkpoint_at,
+			COUNT(br.id) as total,
+			COUNT(*) FILTER (WHERE br.status = 'pending') as pending,
+			COUNT(*) FILTER (WHERE br.status = 'held') as held,
+			COUNT(*) FILTER (WHERE br.status = 'queued') as queued,
+			COUNT(*) FILTER (WHERE br.status = 'sending') as sending,
+			COUNT(*) FILTER (WHERE br.status = 'retrying') as retrying,
+			COUNT(br.sent_at) as sent,
+			COUNT(br.delivered_at) as delivered,
+			COUNT(br.read_at) as read,
+			COUNT(*) FILTER (WHERE br.status = 'failed') as failed,
+			COUNT(*) FILTER (WHERE br.status = 'cancelled') as cancelled
+		FROM broadcasts b
+		LEFT JOIN broadcast_recipients br ON br.broadcast_id = b.id
+			AND (b.current_run_id IS NULL OR br.run_id = b.current_run_id)
+		WHERE b.id = $1
+		GROUP BY b.id
+	`, broadcastID)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// PublishProgress sends the broadcast's progress to the tenant's WebSocket
+// clients
+func (s *Service) PublishProgress(ctx context.Context, broadcastID string) {
+	p, err := s.Progress(ctx, broadcastID)
+	if err != nil {
+		return
+	}
+	if p.Status == StatusCompleted || p.Status == StatusCancelled {
+		lastProgress.Delete(broadcastID)
+	} else {
+		lastProgress.Store(broadcastID, time.Now())
+	}
+	ws.GetHub().BroadcastToTenant(p.TenantID, ws.EventBroadcastProgress, p)
+}
+
+// progressInterval limits how often ReportProgress publishes per broadcast
+const progressInterval = 2 * time.Second
+
+var lastProgress sync.Map
+
+// ReportProgress publishes progress while sending, at most once every
+// progressInterval per broadcast
+func (s *Service) ReportProgress(ctx context.Context, broadcastID string) {
+	if last, ok := lastProgress.Load(broadcastID); ok && time.Since(last.(time.Time)) < progressInterval {
+		return
+	}
+	s.PublishProgress(ctx, broadcastID)
+}
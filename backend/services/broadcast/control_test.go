@@ -0,0 +1,91 @@
+package broadcast
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseWindow(t *testing.T) {
+	tests := []struct {
+		name       string
+		start, end string
+		want       *Window
+		err        bool
+	}{
+		{"no window", "", "", nil, false},
+		{"daytime", "08:00", "17:30", &Window{Start: 480, End: 1050}, false},
+		{"across midnight", "20:00", "06:00", &Window{Start: 1200, End: 360}, false},
+		{"until midnight", "21:00", "00:00", &Window{Start: 1260, End: 0}, false},
+		{"from midnight", "00:00", "05:00", &Window{Start: 0, End: 300}, false},
+		{"missing end", "08:00", "", nil, true},
+		{"missing start", "", "17:00", nil, true},
+		{"bad start", "8am", "17:00", nil, true},
+		{"bad end", "08:00", "24:00", nil, true},
+		{"empty window", "09:15", "09:15", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseWindow(tt.start, tt.end)
+			if (err != nil) != tt.err {
+				t.Fatalf("ParseWindow(%q, %q) error = %v", tt.start, tt.end, err)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidWindow) {
+				t.Errorf("ParseWindow(%q, %q) error = %v, want ErrInvalidWindow", tt.start, tt.end, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseWindow(%q, %q) = %+v, want %+v", tt.start, tt.end, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	jakarta, err := time.LoadLocation("Asia/Jakarta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(hour, minute int) time.Time {
+		return time.Date(2024, 5, 1, hour, minute, 0, 0, jakarta)
+	}
+
+	daytime := &Window{Start: 8 * 60, End: 17 * 60}
+	overnight := &Window{Start: 20 * 60, End: 6 * 60}
+	untilMidnight := &Window{Start: 21 * 60, End: 0}
+
+	tests := []struct {
+		name   string
+		window *Window
+		t      time.Time
+		want   bool
+	}{
+		{"no window", nil, at(3, 0), true},
+		{"daytime start is inside", daytime, at(8, 0), true},
+		{"daytime middle", daytime, at(12, 30), true},
+		{"daytime end is outside", daytime, at(17, 0), false},
+		{"daytime before start", daytime, at(7, 59), false},
+		{"overnight start is inside", overnight, at(20, 0), true},
+		{"overnight before midnight", overnight, at(23, 59), true},
+		{"overnight at midnight", overnight, at(0, 0), true},
+		{"overnight after midnight", overnight, at(5, 59), true},
+		{"overnight end is outside", overnight, at(6, 0), false},
+		{"overnight during the day", overnight, at(12, 0), false},
+		{"overnight just before start", overnight, at(19, 59), false},
+		{"until midnight evening", untilMidnight, at(23, 30), true},
+		{"until midnight at midnight", untilMidnight, at(0, 0), false},
+		{"until midnight morning", untilMidnight, at(9, 0), false},
+		// 14:00 UTC is 21:00 in Jakarta
+		{"wall clock of the location", untilMidnight, time.Date(2024, 5, 1, 14, 0, 0, 0, time.UTC), true},
+		{"overnight across the UTC date", overnight, time.Date(2024, 4, 30, 22, 30, 0, 0, time.UTC), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.window.Contains(tt.t, jakarta); got != tt.want {
+				t.Errorf("Contains(%v) = %v, want %v", tt.t.In(jakarta), got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,460 @@
+package broadcast
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+
+	"gowa-backend/services/redis"
+	"gowa-backend/services/segment"
+	"gowa-backend/services/whatsapp"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+const (
+	// batchSize is how many pending recipients a dispatch claims between
+	// checkpoints
+	batchSize = 200
+	// queueDelay spaces out handing recipients to the queue
+	queueDelay = 50 * time.Millisecond
+	// sendDelay spaces out sends without Redis to avoid rate limiting
+	sendDelay = 500 * time.Millisecond
+	// queueLease is how long a claimed recipient that is in neither the
+	// queue nor a worker's hands stays claimed before it is handed out again
+	queueLease = 15 * time.Minute
+)
+
+// startable are the statuses a new run starts from. Paused and completed
+// broadcasts go back to sending by being resumed or retried instead.
+var startable = []string{StatusDraft, StatusScheduled, StatusActive}
+
+// Sender sends broadcast messages through WhatsApp
+type Sender interface {
+	MediaUploader
+	SendMessage(ctx context.Context, tenantID string, recipientJID string, message string) (string, error)
+	SendUploadedMedia(ctx context.Context, tenantID string, recipientJID string, media *whatsapp.UploadedMedia, caption string) (string, error)
+}
+
+// Engine executes broadcasts. It starts their runs, claims their pending
+// recipients and hands them to the queue, or sends them itself without
+// Redis, and picks up what was left when the server stopped. Recipient
+// statuses are its checkpoint, so a dispatch can stop at any point and a
+// later one carries on. The manual send and the scheduler both go through
+// it; the queue worker delivers through it.
+type Engine struct {
+	svc    *Service
+	db     *sqlx.DB
+	queue  *redis.Client
+	sender Sender
+
+	// running holds the broadcasts this engine is dispatching
+	running sync.Map
+}
+
+// NewEngine creates a broadcast engine. queue may be nil, in which case
+// recipients are sent directly.
+func NewEngine(db *sqlx.DB, queue *redis.Client, sender Sender) *Engine {
+	return &Engine{svc: NewService(db), db: db, queue: queue, sender: sender}
+}
+
+// Start starts a new run of a draft, scheduled or recurring broadcast and
+// dispatches it. next is when a recurring broadcast runs again; with it the
+// broadcast goes back to 'active' once this run is sent, without it the run
+// completes the broadcast. Outside its send window the broadcast is paused
+// until the window opens; sending reports whether it is being sent now. It
+// returns ErrInvalidTransition when the broadcast cannot start from its
+// status, e.g. because another start got there first.
+func (e *Engine) Start(ctx context.Context, broadcastID string, scheduledFor, next *time.Time) (sending bool, err error) {
+	tx, err := e.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		UPDATE broadcasts SET status = 'sending', started_at = NOW(), last_executed_at = NOW(),
+			execution_count = execution_count + 1, scheduled_at = COALESCE($3::timestamptz, scheduled_at),
+			completed_at = NULL, checkpoint_at = NOW(), updated_at = NOW()
+		WHERE id = $1 AND status = ANY($2)
+	`, broadcastID, pq.Array(startable), next)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, ErrInvalidTransition
+	}
+	if _, err := e.svc.StartRun(ctx, tx, broadcastID, scheduledFor); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	if err := e.prepare(ctx, broadcastID); err != nil {
+		return false, err
+	}
+	ok, err := e.svc.Continue(ctx, e.queue, broadcastID)
+	if err != nil || !ok {
+		return false, err
+	}
+	e.Dispatch(broadcastID)
+	return true, nil
+}
+
+// prepare resolves the segment audience of the broadcast's current run as
+// of now and splits its recipients over the variants, holding back those
+// outside the test portion. A run is prepared once.
+func (e *Engine) prepare(ctx context.Context, broadcastID string) error {
+	var run struct {
+		ID        string  `db:"id"`
+		TenantID  string  `db:"tenant_id"`
+		SegmentID *string `db:"segment_id"`
+	}
+	err := e.db.GetContext(ctx, &run, `
+		SELECT r.id, b.tenant_id, b.segment_id
+		FROM broadcasts b JOIN broadcast_runs r ON r.id = b.current_run_id
+		WHERE b.id = $1 AND r.prepared_at IS NULL
+	`, broadcastID)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if run.SegmentID != nil {
+		if _, err := segment.NewService(e.db).AddBroadcastRecipients(ctx, run.TenantID, broadcastID, *run.SegmentID); err != nil {
+			return err
+		}
+	}
+	if err := e.svc.AssignVariants(ctx, broadcastID); err != nil {
+		return err
+	}
+	_, err = e.db.ExecContext(ctx, `UPDATE broadcast_runs SET prepared_at = NOW() WHERE id = $1`, run.ID)
+	return err
+}
+
+// Dispatch hands the broadcast's pending recipients out in the background,
+// unless this engine is dispatching it already. Recipients that become
+// pending while a dispatch finishes are picked up by the next Recover.
+func (e *Engine) Dispatch(broadcastID string) {
+	if _, busy := e.running.LoadOrStore(broadcastID, true); busy {
+		return
+	}
+	go func() {
+		defer e.running.Delete(broadcastID)
+		e.dispatch(context.Background(), broadcastID)
+	}()
+}
+
+// pendingRecipient is a recipient to dispatch
+type pendingRecipient struct {
+	ID           string  `db:"id"`
+	CustomerID   string  `db:"customer_id"`
+	CustomerJID  string  `db:"customer_jid"`
+	CustomerName string  `db:"customer_name"`
+	VariantID    *string `db:"variant_id"`
+}
+
+// dispatch claims the broadcast's pending recipients batch by batch and
+// queues or sends each one, until none is left or the broadcast stops
+// sending. Progress is checkpointed after every batch.
+func (e *Engine) dispatch(ctx context.Context, broadcastID string) {
+	var b struct {
+		TenantID       string `db:"tenant_id"`
+		MessageContent string `db:"message_content"`
+	}
+	err := e.db.GetContext(ctx, &b, `SELECT tenant_id, message_content FROM broadcasts WHERE id = $1`, broadcastID)
+	if err != nil {
+		log.Printf("[Broadcast] Failed to load %s: %v", broadcastID, err)
+		return
+	}
+	if err := e.prepare(ctx, broadcastID); err != nil {
+		log.Printf("[Broadcast] Failed to prepare %s: %v", broadcastID, err)
+		return
+	}
+	messages, err := e.svc.Messages(ctx, b.TenantID, broadcastID, b.MessageContent)
+	if err != nil {
+		log.Printf("[Broadcast] Failed to prepare message of %s: %v", broadcastID, err)
+		return
+	}
+
+	handed, failed := 0, 0
+	defer func() {
+		log.Printf("[Broadcast] Dispatched %s - Handed out: %d, Failed: %d", broadcastID, handed, failed)
+	}()
+
+	for {
+		var recipients []pendingRecipient
+		err := e.db.SelectContext(ctx, &recipients, `
+			SELECT br.id, br.customer_id, br.customer_jid, br.variant_id,
+				COALESCE(ci.customer_name, ci.customer_phone, '') as customer_name
+			FROM broadcast_recipients br
+			LEFT JOIN customer_insights ci ON ci.id = br.customer_id
+			WHERE br.broadcast_id = $1 AND br.status = 'pending'
+			ORDER BY br.created_at, br.id
+			LIMIT $2
+		`, broadcastID, batchSize)
+		if err != nil {
+			log.Printf("[Broadcast] Failed to get recipients of %s: %v", broadcastID, err)
+			return
+		}
+		if len(recipients) == 0 {
+			break
+		}
+
+		claimed := 0
+		for _, r := range recipients {
+			// Stop when paused, cancelled or outside the send window; the rest stay pending
+			if ok, err := e.svc.Continue(ctx, e.queue, broadcastID); !ok {
+				if err != nil {
+					log.Printf("[Broadcast] Failed to check status of %s: %v", broadcastID, err)
+				}
+				e.checkpoint(ctx, broadcastID)
+				e.svc.PublishProgress(ctx, broadcastID)
+				return
+			}
+
+			// Skip recipients another sender took
+			if ok, err := e.svc.Claim(ctx, r.ID); err != nil || !ok {
+				continue
+			}
+			claimed++
+
+			text, err := messages.Render(ctx, r.CustomerID, r.VariantID)
+			if err != nil {
+				failed++
+				e.svc.RecordFailure(ctx, broadcastID, r.ID, err)
+				continue
+			}
+			payload := &redis.BroadcastMessagePayload{
+				TenantID:     b.TenantID,
+				BroadcastID:  broadcastID,
+				RecipientID:  r.ID,
+				CustomerJID:  r.CustomerJID,
+				Message:      text,
+				CustomerName: r.CustomerName,
+			}
+
+			if e.queue == nil {
+				if _, err := e.Deliver(ctx, payload); err != nil {
+					failed++
+				} else {
+					handed++
+				}
+				time.Sleep(sendDelay)
+				continue
+			}
+			if err := e.queue.PushToBroadcastQueue(ctx, payload); err != nil {
+				failed++
+				e.svc.RecordFailure(ctx, broadcastID, r.ID, err)
+			} else {
+				handed++
+			}
+			time.Sleep(queueDelay)
+		}
+
+		e.checkpoint(ctx, broadcastID)
+		if claimed == 0 {
+			break
+		}
+	}
+
+	// A broadcast whose every recipient was handled here is done already;
+	// otherwise the worker completes it with its last delivery
+	if completed, _ := e.svc.Complete(ctx, broadcastID); !completed {
+		e.svc.PublishProgress(ctx, broadcastID)
+	}
+}
+
+// checkpoint records that the broadcast made progress
+func (e *Engine) checkpoint(ctx context.Context, broadcastID string) {
+	e.db.ExecContext(ctx, `UPDATE broadcasts SET checkpoint_at = NOW() WHERE id = $1`, broadcastID)
+}
+
+// Deliver sends a claimed recipient its message, with the broadcast's media
+// as its caption when it has some. A recipient that is no longer claimed is
+// skipped; one whose broadcast stopped sending goes back to pending, or is
+// cancelled with it. The recipient is 'sending' while its message is sent,
+// so a redelivered payload never sends it twice. Failures are recorded as
+// for RecordFailure and returned. The message ID is empty when the
+// recipient was skipped.
+func (e *Engine) Deliver(ctx context.Context, payload *redis.BroadcastMessagePayload) (string, error) {
+	// Taking the recipient renews its claim, so Recover leaves it alone
+	var status string
+	err := e.db.GetContext(ctx, &status, `
+		UPDATE broadcast_recipients br SET
+			status = CASE
+				WHEN b.status IN ('sending', 'active') THEN 'sending'
+				WHEN b.status = 'cancelled' THEN 'cancelled'
+				ELSE 'pending'
+			END,
+			queued_at = NOW()
+		FROM broadcasts b
+		WHERE b.id = br.broadcast_id AND br.id = $1 AND br.status = 'queued'
+		RETURNING b.status
+	`, payload.RecipientID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	if status != StatusSending && status != StatusActive {
+		return "", nil
+	}
+
+	// Broadcast media is uploaded on first use and the upload reused
+	sendCtx := whatsapp.WithSender(ctx, whatsapp.SentByBroadcast, "")
+	var messageID string
+	media, sendErr := e.svc.Media(ctx, e.sender, payload.TenantID, payload.BroadcastID)
+	if sendErr == nil && media != nil {
+		messageID, sendErr = e.sender.SendUploadedMedia(sendCtx, payload.TenantID, payload.CustomerJID, media, payload.Message)
+	} else if sendErr == nil {
+		messageID, sendErr = e.sender.SendMessage(sendCtx, payload.TenantID, payload.CustomerJID, payload.Message)
+	}
+
+	if sendErr != nil {
+		// Failed for good, or retried later when the failure is transient
+		final, err := e.svc.RecordFailure(ctx, payload.BroadcastID, payload.RecipientID, sendErr)
+		if err != nil {
+			return "", err
+		}
+		if final {
+			e.svc.Complete(ctx, payload.BroadcastID)
+		}
+		e.svc.ReportProgress(ctx, payload.BroadcastID)
+		return "", sendErr
+	}
+
+	// Releasing the claim records the send and counts it in one statement
+	_, err = e.db.ExecContext(ctx, `
+		WITH sent AS (
+			UPDATE broadcast_recipients SET status = 'sent', message_id = $1, sent_at = NOW()
+			WHERE id = $2 AND status = 'sending'
+			RETURNING broadcast_id
+		)
+		UPDATE broadcasts SET sent_count = sent_count + 1, updated_at = NOW()
+		WHERE id IN (SELECT broadcast_id FROM sent)
+	`, messageID, payload.RecipientID)
+	if err != nil {
+		return messageID, err
+	}
+
+	// The last delivery completes the broadcast
+	if completed, _ := e.svc.Complete(ctx, payload.BroadcastID); !completed {
+		e.svc.ReportProgress(ctx, payload.BroadcastID)
+	}
+	return messageID, nil
+}
+
+// Pause stops a sending broadcast and takes its queued recipients back
+func (e *Engine) Pause(ctx context.Context, broadcastID, reason string) error {
+	return e.svc.Pause(ctx, e.queue, broadcastID, reason)
+}
+
+// Recover picks up broadcasts whose sending was interrupted. Claimed
+// recipients that are no longer in the queue go back to pending once their
+// claim is older than queueLease, or right away at startup, when no worker
+// can hold them anymore. Their message was lost or dead-lettered after too
+// many deliveries, so this counts as an attempt and the last of MaxAttempts
+// fails them. Recipients left 'sending' may have been sent already, so they
+// fail as unknown instead of being sent again. Sending and recurring
+// broadcasts with pending recipients or an unprepared run are dispatched
+// again, and those with nothing left are completed.
+func (e *Engine) Recover(ctx context.Context, startup bool) error {
+	lease := queueLease
+	if startup {
+		lease = 0
+	}
+
+	inQueue := []string{}
+	if e.queue != nil {
+		var err error
+		if inQueue, err = e.queue.QueuedBroadcastRecipients(ctx); err != nil {
+			return err
+		}
+	}
+	var orphaned []struct {
+		BroadcastID string `db:"broadcast_id"`
+		Status      string `db:"status"`
+	}
+	err := e.db.SelectContext(ctx, &orphaned, `
+		UPDATE broadcast_recipients SET
+			status = CASE WHEN attempts + 1 >= $3 THEN 'failed' ELSE 'pending' END,
+			error_code = CASE WHEN attempts + 1 >= $3 THEN 'unknown' ELSE error_code END,
+			error_message = CASE WHEN attempts + 1 >= $3 THEN 'message lost from the queue' ELSE error_message END,
+			attempts = attempts + 1, queued_at = NULL
+		WHERE status = 'queued' AND COALESCE(queued_at, '-infinity') <= NOW() - make_interval(secs => $1)
+		  AND NOT (id::text = ANY($2))
+		RETURNING broadcast_id, status
+	`, lease.Seconds(), pq.Array(inQueue), MaxAttempts)
+	if err != nil {
+		return err
+	}
+	var interruptedSends []struct {
+		BroadcastID string `db:"broadcast_id"`
+		Status      string `db:"status"`
+	}
+	err = e.db.SelectContext(ctx, &interruptedSends, `
+		UPDATE broadcast_recipients SET
+			status = 'failed', error_code = 'unknown',
+			error_message = 'sending was interrupted, the message may have been sent',
+			attempts = attempts + 1, queued_at = NULL
+		WHERE status = 'sending' AND COALESCE(queued_at, '-infinity') <= NOW() - make_interval(secs => $1)
+		RETURNING broadcast_id, status
+	`, lease.Seconds())
+	if err != nil {
+		return err
+	}
+	orphaned = append(orphaned, interruptedSends...)
+	if len(orphaned) > 0 {
+		log.Printf("[Broadcast] Recovered %d orphaned recipients", len(orphaned))
+	}
+	for _, o := range orphaned {
+		if o.Status == "failed" {
+			e.db.ExecContext(ctx, `UPDATE broadcasts SET failed_count = failed_count + 1, updated_at = NOW() WHERE id = $1`, o.BroadcastID)
+		}
+	}
+
+	var interrupted []string
+	err = e.db.SelectContext(ctx, &interrupted, `
+		SELECT b.id FROM broadcasts b
+		LEFT JOIN broadcast_runs r ON r.id = b.current_run_id
+		WHERE b.status IN ('sending', 'active') AND (
+			(r.status = 'sending' AND r.prepared_at IS NULL)
+			OR EXISTS (SELECT 1 FROM broadcast_recipients br WHERE br.broadcast_id = b.id AND br.status = 'pending')
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	for _, id := range interrupted {
+		if ok, err := e.svc.Continue(ctx, e.queue, id); err == nil && ok {
+			e.Dispatch(id)
+		}
+	}
+
+	var drained []string
+	err = e.db.SelectContext(ctx, &drained, `
+		SELECT b.id FROM broadcasts b
+		LEFT JOIN broadcast_runs r ON r.id = b.current_run_id
+		WHERE (b.status = 'sending' OR (b.status = 'active' AND r.status = 'sending'))
+		  AND (r.id IS NULL OR r.prepared_at IS NOT NULL)
+		  AND NOT EXISTS (
+			SELECT 1 FROM broadcast_recipients br
+			WHERE br.broadcast_id = b.id AND br.status IN ('pending', 'queued', 'sending', 'held', 'retrying')
+		  )
+	`)
+	if err != nil {
+		return err
+	}
+	for _, id := range drained {
+		if _, busy := e.running.Load(id); !busy {
+			e.svc.Complete(ctx, id)
+		}
+	}
+	return nil
+}
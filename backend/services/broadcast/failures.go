@@ -0,0 +1,266 @@
+package broadcast
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// Failure codes of broadcast sends
+const (
+	FailureNotOnWhatsApp = "not_on_whatsapp"
+	FailureDisconnected  = "disconnected"
+	FailureRateLimited   = "rate_limited"
+	FailureInvalidJID    = "invalid_jid"
+	FailureUnknown       = "unknown"
+)
+
+// StatusRetrying is a recipient waiting to be sent again
+const StatusRetrying = "retrying"
+
+// MaxAttempts is how often a recipient is tried before a transient failure
+// becomes final
+const MaxAttempts = 4
+
+// serverErrorCode finds the code in whatsmeow's "server returned error <code>"
+var serverErrorCode = regexp.MustCompile(`server returned error (\d+)\b`)
+
+// failurePhrases classify errors that lost their type, e.g. ones formatted
+// with %v along the way, by the exact text of the errors they came from
+var failurePhrases = []struct {
+	phrase string
+	code   string
+}{
+	{"whatsapp client not found", FailureDisconnected},
+	{"whatsapp not connected", FailureDisconnected},
+	{"websocket not connected", FailureDisconnected},
+	{"websocket disconnected before", FailureDisconnected},
+	{"info query returned status 429: rate-overlimit", FailureRateLimited},
+	{"invalid recipient jid", FailureInvalidJID},
+	{"is not on whatsapp", FailureNotOnWhatsApp},
+	{"info query returned status 404: item-not-found", FailureNotOnWhatsApp},
+	{"info query returned status 406: not-acceptable", FailureNotOnWhatsApp},
+}
+
+// ErrNotRetryable is returned when retrying failed recipients of a broadcast
+// that is neither sending, paused nor completed
+var ErrNotRetryable = errors.New("broadcast cannot be retried")
+
+// Classify maps a send error to a failure code. whatsmeow's errors are
+// matched by type and code; the text is only checked for exact phrases.
+func Classify(err error) string {
+	var disconnected *whatsmeow.DisconnectedError
+	var iq *whatsmeow.IQError
+	switch {
+	case errors.Is(err, whatsmeow.ErrNotConnected), errors.Is(err, whatsmeow.ErrNotLoggedIn),
+		errors.Is(err, whatsmeow.ErrClientIsNil), errors.Is(err, whatsmeow.ErrIQTimedOut),
+		errors.Is(err, whatsmeow.ErrMessageTimedOut), errors.As(err, &disconnected):
+		return FailureDisconnected
+	case errors.Is(err, whatsmeow.ErrUnknownServer), errors.Is(err, whatsmeow.ErrRecipientADJID),
+		errors.Is(err, whatsmeow.ErrPhoneNumberTooShort), errors.Is(err, whatsmeow.ErrPhoneNumberIsNotInternational):
+		return FailureInvalidJID
+	case errors.As(err, &iq):
+		switch iq.Code {
+		case 429:
+			return FailureRateLimited
+		case 404, 406:
+			return FailureNotOnWhatsApp
+		}
+		return FailureUnknown
+	case errors.Is(err, whatsmeow.ErrServerReturnedError):
+		if m := serverErrorCode.FindStringSubmatch(err.Error()); m != nil && m[1] == "429" {
+			return FailureRateLimited
+		}
+		return FailureUnknown
+	}
+
+	msg := strings.ToLower(err.Error())
+	if m := serverErrorCode.FindStringSubmatch(msg); m != nil && m[1] == "429" {
+		return FailureRateLimited
+	}
+	for _, p := range failurePhrases {
+		if strings.Contains(msg, p.phrase) {
+			return p.code
+		}
+	}
+	return FailureUnknown
+}
+
+// Transient reports whether failures with the code are retried automatically
+func Transient(code string) bool {
+	return code == FailureDisconnected || code == FailureRateLimited
+}
+
+// Retryable reports whether retrying a failure with the code by hand can
+// succeed
+func Retryable(code string) bool {
+	return code != FailureNotOnWhatsApp && code != FailureInvalidJID
+}
+
+// RetryDelay is how long to wait before retrying a send that failed with
+// the code for the attempts-th time. It backs off exponentially from a
+// minute, or five when rate limited.
+func RetryDelay(code string, attempts int) time.Duration {
+	base := time.Minute
+	if code == FailureRateLimited {
+		base = 5 * time.Minute
+	}
+	return base << (attempts - 1)
+}
+
+// RecordFailure classifies a failed send. Transient failures are retried
+// until MaxAttempts; other failures and the last attempt mark the recipient
+// failed and count it on the broadcast. final reports the latter.
+func (s *Service) RecordFailure(ctx context.Context, broadcastID, recipientID string, sendErr error) (final bool, err error) {
+	code := Classify(sendErr)
+
+	var attempts int
+	err = s.db.GetContext(ctx, &attempts, `
+		UPDATE broadcast_recipients SET attempts = attempts + 1, error_code = $2, error_message = $3
+		WHERE id = $1
+		RETURNING attempts
+	`, recipientID, code, sendErr.Error())
+	if err != nil {
+		return false, err
+	}
+
+	if Transient(code) && attempts < MaxAttempts {
+		_, err = s.db.ExecContext(ctx, `
+			UPDATE broadcast_recipients SET status = 'retrying', next_retry_at = NOW() + make_interval(secs => $2)
+			WHERE id = $1
+		`, recipientID, RetryDelay(code, attempts).Seconds())
+		return false, err
+	}
+
+	_, err = s.db.ExecContext(ctx, `UPDATE broadcast_recipients SET status = 'failed', next_retry_at = NULL WHERE id = $1`, recipientID)
+	if err != nil {
+		return true, err
+	}
+	_, err = s.db.ExecContext(ctx, `UPDATE broadcasts SET failed_count = failed_count + 1, updated_at = NOW() WHERE id = $1`, broadcastID)
+	return true, err
+}
+
+// Dispatch is a broadcast with recipients ready to send
+type Dispatch struct {
+	ID             string `db:"id"`
+	TenantID       string `db:"tenant_id"`
+	MessageContent string `db:"message_content"`
+}
+
+// ReleaseRetries makes recipients whose retry is due pending again and
+// returns the broadcasts to dispatch. Recipients of paused broadcasts wait.
+func (s *Service) ReleaseRetries(ctx context.Context) ([]Dispatch, error) {
+	var due []Dispatch
+	err := s.db.SelectContext(ctx, &due, `
+		WITH released AS (
+			UPDATE broadcast_recipients br SET status = 'pending', next_retry_at = NULL
+			FROM broadcasts b
+			WHERE b.id = br.broadcast_id AND br.status = 'retrying' AND br.next_retry_at <= NOW()
+			  AND b.status IN ('sending', 'active')
+			RETURNING br.broadcast_id
+		)
+		SELECT DISTINCT b.id, b.tenant_id, b.message_content
+		FROM released r JOIN broadcasts b ON b.id = r.broadcast_id
+	`)
+	return due, err
+}
+
+// RetryFailed makes failed recipients whose failure is retryable pending
+// again and returns how many. A completed broadcast goes back to sending;
+// the caller dispatches the recipients unless the broadcast is paused.
+func (s *Service) RetryFailed(ctx context.Context, broadcastID string) (int, error) {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var status string
+	if err := tx.GetContext(ctx, &status, `SELECT status FROM broadcasts WHERE id = $1 FOR UPDATE`, broadcastID); err != nil {
+		return 0, err
+	}
+	if status != StatusSending && status != StatusPaused && status != StatusCompleted {
+		return 0, ErrNotRetryable
+	}
+
+	res, err := tx.ExecContext(ctx, `
+		UPDATE broadcast_recipients SET status = 'pending', attempts = 0, next_retry_at = NULL
+		WHERE broadcast_id = $1 AND status = 'failed'
+		  AND COALESCE(error_code, 'unknown') NOT IN ('not_on_whatsapp', 'invalid_jid')
+	`, broadcastID)
+	if err != nil {
+		return 0, err
+	}
+	retried, _ := res.RowsAffected()
+	if retried == 0 {
+		return 0, nil
+	}
+
+	// Their runs are sending again
+	_, err = tx.ExecContext(ctx, `
+		UPDATE broadcast_runs SET status = 'sending', completed_at = NULL
+		WHERE id IN (SELECT run_id FROM broadcast_recipients WHERE broadcast_id = $1 AND status = 'pending')
+	`, broadcastID)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE broadcasts SET
+			failed_count = GREATEST(failed_count - $2, 0),
+			status = CASE WHEN status = 'completed' THEN 'sending' ELSE status END,
+			completed_at = CASE WHEN status = 'completed' THEN NULL ELSE completed_at END,
+			updated_at = NOW()
+		WHERE id = $1
+	`, broadcastID, retried)
+	if err != nil {
+		return 0, err
+	}
+	return int(retried), tx.Commit()
+}
+
+// FailureBreakdown counts failed recipients by failure code, for one
+// broadcast or, with broadcastID empty, all of the tenant's broadcasts
+func (s *Service) FailureBreakdown(ctx context.Context, tenantID, broadcastID string) (map[string]int, error) {
+	var rows []struct {
+		Code  string `db:"code"`
+		Count int    `db:"count"`
+	}
+	err := s.db.SelectContext(ctx, &rows, `
+		SELECT COALESCE(br.error_code, 'unknown') as code, COUNT(*) as count
+		FROM broadcast_recipients br
+		JOIN broadcasts b ON b.id = br.broadcast_id
+		WHERE b.tenant_id = $1 AND ($2 = '' OR b.id::text = $2) AND br.status = 'failed'
+		GROUP BY 1
+	`, tenantID, broadcastID)
+	if err != nil {
+		return nil, err
+	}
+
+	breakdown := map[string]int{
+		FailureNotOnWhatsApp: 0,
+		FailureDisconnected:  0,
+		FailureRateLimited:   0,
+		FailureInvalidJID:    0,
+		FailureUnknown:       0,
+	}
+	for _, r := range rows {
+		breakdown[r.Code] += r.Count
+	}
+	return breakdown, nil
+}
+
+// Claim marks a pending recipient as taken for sending, so two senders of
+// the same broadcast never both send it
+func (s *Service) Claim(ctx context.Context, recipientID string) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `UPDATE broadcast_recipients SET status = 'queued', queued_at = NOW() WHERE id = $1 AND status = 'pending'`, recipientID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
@@ -0,0 +1,104 @@
+package broadcast
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"not connected", whatsmeow.ErrNotConnected, FailureDisconnected},
+		{"wrapped not logged in", fmt.Errorf("failed to send: %w", whatsmeow.ErrNotLoggedIn), FailureDisconnected},
+		{"message timeout", whatsmeow.ErrMessageTimedOut, FailureDisconnected},
+		{"client missing", errors.New("WhatsApp client not found for tenant"), FailureDisconnected},
+		{"websocket", errors.New("websocket not connected"), FailureDisconnected},
+		{"unknown server", whatsmeow.ErrUnknownServer, FailureInvalidJID},
+		{"short phone number", whatsmeow.ErrPhoneNumberTooShort, FailureInvalidJID},
+		{"invalid JID text", errors.New("invalid recipient JID: abc"), FailureInvalidJID},
+		{"rate limit IQ error", fmt.Errorf("failed to send: %w", whatsmeow.ErrIQRateOverLimit), FailureRateLimited},
+		{"server error 429", fmt.Errorf("%w %d", whatsmeow.ErrServerReturnedError, 429), FailureRateLimited},
+		{"wrapped server error 429", fmt.Errorf("failed to send message: %w", fmt.Errorf("%w %d", whatsmeow.ErrServerReturnedError, 429)), FailureRateLimited},
+		{"rate-overlimit text", errors.New("info query returned status 429: rate-overlimit"), FailureRateLimited},
+		{"other server error", fmt.Errorf("%w %d", whatsmeow.ErrServerReturnedError, 4290), FailureUnknown},
+		{"phone number containing 429", errors.New("failed to send to 6281242912345@s.whatsapp.net: boom"), FailureUnknown},
+		{"disconnected error", fmt.Errorf("failed to send: %w", &whatsmeow.DisconnectedError{Action: "message send"}), FailureDisconnected},
+		{"disconnected text", errors.New("websocket disconnected before info query returned response"), FailureDisconnected},
+		{"rate limit IQ code", &whatsmeow.IQError{Code: 429, Text: "rate-overlimit"}, FailureRateLimited},
+		{"IQ not found", fmt.Errorf("failed to get user info: %w", whatsmeow.ErrIQNotFound), FailureNotOnWhatsApp},
+		{"IQ not acceptable", &whatsmeow.IQError{Code: 406, Text: "not-acceptable"}, FailureNotOnWhatsApp},
+		{"other IQ error", fmt.Errorf("failed to upload: %w", whatsmeow.ErrIQServiceUnavailable), FailureUnknown},
+		{"not on WhatsApp", errors.New("6281234567890 is not on WhatsApp"), FailureNotOnWhatsApp},
+		{"item not found", errors.New("info query returned status 404: item-not-found"), FailureNotOnWhatsApp},
+		{"not acceptable text", errors.New("info query returned status 406: not-acceptable"), FailureNotOnWhatsApp},
+		{"disconnected in other text", errors.New("customer disconnected the call"), FailureUnknown},
+		{"not-acceptable in other text", errors.New("media type not-acceptable for template"), FailureUnknown},
+		{"rate limit in other text", errors.New("AI provider rate limit exceeded"), FailureUnknown},
+		{"invalid JID in other text", errors.New("invalid jid in contact card"), FailureUnknown},
+		{"unknown", errors.New("something else went wrong"), FailureUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Classify(tt.err); got != tt.want {
+				t.Errorf("Classify(%q) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		code     string
+		attempts int
+		want     time.Duration
+	}{
+		{FailureDisconnected, 1, time.Minute},
+		{FailureDisconnected, 2, 2 * time.Minute},
+		{FailureDisconnected, 3, 4 * time.Minute},
+		{FailureRateLimited, 1, 5 * time.Minute},
+		{FailureRateLimited, 2, 10 * time.Minute},
+		{FailureRateLimited, MaxAttempts - 1, 20 * time.Minute},
+		{FailureUnknown, 1, time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%d", tt.code, tt.attempts), func(t *testing.T) {
+			if got := RetryDelay(tt.code, tt.attempts); got != tt.want {
+				t.Errorf("RetryDelay(%q, %d) = %v, want %v", tt.code, tt.attempts, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		code      string
+		transient bool
+		retryable bool
+	}{
+		{FailureDisconnected, true, true},
+		{FailureRateLimited, true, true},
+		{FailureUnknown, false, true},
+		{FailureNotOnWhatsApp, false, false},
+		{FailureInvalidJID, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			if got := Transient(tt.code); got != tt.transient {
+				t.Errorf("Transient(%q) = %v, want %v", tt.code, got, tt.transient)
+			}
+			if got := Retryable(tt.code); got != tt.retryable {
+				t.Errorf("Retryable(%q) = %v, want %v", tt.code, got, tt.retryable)
+			}
+		})
+	}
+}
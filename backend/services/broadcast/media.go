@@ -0,0 +1,107 @@
+package broadcast
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gowa-backend/services/whatsapp"
+)
+
+// uploadsDir is where uploaded files are stored, served under /uploads
+const uploadsDir = "/app/data/uploads"
+
+// mediaUploadTTL is how long a WhatsApp upload is reused. WhatsApp drops
+// media from its servers after a while, so older uploads are redone.
+const mediaUploadTTL = 24 * time.Hour
+
+// ErrInvalidMedia wraps every broadcast media validation error
+var ErrInvalidMedia = errors.New("invalid broadcast media")
+
+// MediaUploader uploads media to WhatsApp
+type MediaUploader interface {
+	UploadMedia(ctx context.Context, tenantID string, mediaData []byte, mediaType string, fileName string) (*whatsapp.UploadedMedia, error)
+}
+
+// ResolveMedia checks mediaURL is a file the tenant uploaded that WhatsApp
+// can send, and returns its path and media type
+func ResolveMedia(tenantID, mediaURL string) (path, mediaType string, err error) {
+	prefix := "/uploads/" + tenantID + "/"
+	name := strings.TrimPrefix(mediaURL, prefix)
+	if !strings.HasPrefix(mediaURL, prefix) || name == "" || strings.ContainsAny(name, `/\`) || name == ".." {
+		return "", "", fmt.Errorf("%w: media_url must be a file uploaded by this tenant", ErrInvalidMedia)
+	}
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".webp":
+		mediaType = "image"
+	case ".mp4", ".3gp":
+		mediaType = "video"
+	case ".pdf", ".doc", ".docx", ".xls", ".xlsx", ".ppt", ".pptx", ".txt", ".csv":
+		mediaType = "document"
+	default:
+		return "", "", fmt.Errorf("%w: send an image (jpg, png, webp), video (mp4, 3gp) or document (pdf, office, txt, csv)", ErrInvalidMedia)
+	}
+
+	path = filepath.Join(uploadsDir, tenantID, name)
+	if _, err := os.Stat(path); err != nil {
+		return "", "", fmt.Errorf("%w: uploaded file not found", ErrInvalidMedia)
+	}
+	return path, mediaType, nil
+}
+
+// Media returns the broadcast's media uploaded to WhatsApp, uploading it on
+// first use and again once the upload expired. It returns nil when the
+// broadcast has no media.
+func (s *Service) Media(ctx context.Context, uploader MediaUploader, tenantID, broadcastID string) (*whatsapp.UploadedMedia, error) {
+	var m struct {
+		URL        *string    `db:"media_url"`
+		FileName   *string    `db:"media_file_name"`
+		Upload     *string    `db:"media_upload"`
+		UploadedAt *time.Time `db:"media_uploaded_at"`
+	}
+	err := s.db.GetContext(ctx, &m, `
+		SELECT media_url, media_file_name, media_upload::text, media_uploaded_at
+		FROM broadcasts WHERE id = $1
+	`, broadcastID)
+	if err != nil || m.URL == nil {
+		return nil, err
+	}
+
+	if m.Upload != nil && m.UploadedAt != nil && time.Since(*m.UploadedAt) < mediaUploadTTL {
+		var media whatsapp.UploadedMedia
+		if json.Unmarshal([]byte(*m.Upload), &media) == nil {
+			return &media, nil
+		}
+	}
+
+	path, mediaType, err := ResolveMedia(tenantID, *m.URL)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read broadcast media: %w", err)
+	}
+	fileName := filepath.Base(path)
+	if m.FileName != nil && *m.FileName != "" {
+		fileName = *m.FileName
+	}
+
+	media, err := uploader.UploadMedia(ctx, tenantID, data, mediaType, fileName)
+	if err != nil {
+		return nil, err
+	}
+	media.LocalURL = *m.URL
+
+	upload, _ := json.Marshal(media)
+	_, err = s.db.ExecContext(ctx, `
+		UPDATE broadcasts SET media_upload = $1::jsonb, media_uploaded_at = NOW() WHERE id = $2
+	`, string(upload), broadcastID)
+	return media, err
+}
@@ -0,0 +1,154 @@
+package broadcast
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Run is one execution of a broadcast with its own recipients
+type Run struct {
+	ID           string     `json:"id" db:"id"`
+	BroadcastID  string     `json:"broadcast_id" db:"broadcast_id"`
+	RunNumber    int        `json:"run_number" db:"run_number"`
+	Status       string     `json:"status" db:"status"`
+	ScheduledFor *time.Time `json:"scheduled_for" db:"scheduled_for"`
+	StartedAt    time.Time  `json:"started_at" db:"started_at"`
+	CompletedAt  *time.Time `json:"completed_at" db:"completed_at"`
+	Recipients   int        `json:"recipients" db:"recipients"`
+	Sent         int        `json:"sent" db:"sent"`
+	Delivered    int        `json:"delivered" db:"delivered"`
+	Read         int        `json:"read" db:"read"`
+	Failed       int        `json:"failed" db:"failed"`
+	Cancelled    int        `json:"cancelled" db:"cancelled"`
+	Replied      int        `json:"replied" db:"replied"`
+	DeliveryRate float64    `json:"delivery_rate" db:"-"`
+	ReadRate     float64    `json:"read_rate" db:"-"`
+	ReplyRate    float64    `json:"reply_rate" db:"-"`
+}
+
+// runColumns selects a run with its recipients counted. Replies count when
+// they arrive within $2 seconds of the send, as for variants.
+const runColumns = `
+	r.id, r.broadcast_id, r.run_number, r.status, r.scheduled_for, r.started_at, r.completed_at,
+	COUNT(br.id) as recipients,
+	COUNT(br.sent_at) as sent,
+	COUNT(br.delivered_at) as delivered,
+	COUNT(br.read_at) as read,
+	COUNT(*) FILTER (WHERE br.status = 'failed') as failed,
+	COUNT(*) FILTER (WHERE br.status = 'cancelled') as cancelled,
+	COUNT(*) FILTER (WHERE br.sent_at IS NOT NULL AND EXISTS (
+		SELECT 1 FROM whatsapp_messages m
+		WHERE m.tenant_id = b.tenant_id AND m.chat_jid = br.customer_jid AND NOT m.is_from_me
+		  AND m.timestamp BETWEEN EXTRACT(EPOCH FROM br.sent_at)::bigint
+		                      AND EXTRACT(EPOCH FROM br.sent_at + make_interval(secs => $2))::bigint
+	)) as replied`
+
+// StartRun records a new run of the broadcast in tx and snapshots its
+// recipients: the first run takes the recipients added when the broadcast
+// was created, later runs copy those of the first run who have not opted
+// out since. Segment audiences are resolved into the run when it is sent.
+// The broadcast's counters are reset to describe the new run.
+func (s *Service) StartRun(ctx context.Context, tx *sqlx.Tx, broadcastID string, scheduledFor *time.Time) (string, error) {
+	var run struct {
+		ID        string `db:"id"`
+		RunNumber int    `db:"run_number"`
+	}
+	err := tx.GetContext(ctx, &run, `
+		INSERT INTO broadcast_runs (broadcast_id, run_number, scheduled_for)
+		SELECT $1::uuid, COALESCE(MAX(run_number), 0) + 1, $2::timestamptz FROM broadcast_runs WHERE broadcast_id = $1
+		RETURNING id, run_number
+	`, broadcastID, scheduledFor)
+	if err != nil {
+		return "", err
+	}
+
+	if run.RunNumber == 1 {
+		_, err = tx.ExecContext(ctx, `
+			UPDATE broadcast_recipients SET run_id = $2 WHERE broadcast_id = $1 AND run_id IS NULL
+		`, broadcastID, run.ID)
+	} else {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO broadcast_recipients (broadcast_id, run_id, customer_id, customer_jid)
+			SELECT DISTINCT ON (ci.id) $1::uuid, $2::uuid, ci.id, ci.customer_jid
+			FROM broadcast_recipients br
+			JOIN broadcast_runs fr ON fr.id = br.run_id AND fr.run_number = 1
+			JOIN customer_insights ci ON ci.id = br.customer_id AND ci.opted_out = false
+			JOIN broadcasts b ON b.id = br.broadcast_id AND b.segment_id IS NULL
+			WHERE br.broadcast_id = $1
+		`, broadcastID, run.ID)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE broadcasts SET current_run_id = $2,
+			total_recipients = (SELECT COUNT(*) FROM broadcast_recipients WHERE run_id = $2),
+			sent_count = 0, delivered_count = 0, failed_count = 0, updated_at = NOW()
+		WHERE id = $1
+	`, broadcastID, run.ID)
+	return run.ID, err
+}
+
+// completeRuns marks the broadcast's runs completed once none of their
+// recipients is left to send
+func (s *Service) completeRuns(ctx context.Context, broadcastID string) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE broadcast_runs r SET status = 'completed', completed_at = NOW()
+		WHERE r.broadcast_id = $1 AND r.status = 'sending' AND NOT EXISTS (
+			SELECT 1 FROM broadcast_recipients
+			WHERE run_id = r.id AND status IN ('pending', 'queued', 'sending', 'held', 'retrying')
+		)
+	`, broadcastID)
+	return err
+}
+
+// Runs returns the broadcast's runs, latest first, counting replies within
+// window of each send
+func (s *Service) Runs(ctx context.Context, broadcastID string, window time.Duration) ([]Run, error) {
+	runs := []Run{}
+	err := s.db.SelectContext(ctx, &runs, `
+		SELECT `+runColumns+`
+		FROM broadcast_runs r
+		JOIN broadcasts b ON b.id = r.broadcast_id
+		LEFT JOIN broadcast_recipients br ON br.run_id = r.id
+		WHERE r.broadcast_id = $1
+		GROUP BY r.id, b.tenant_id
+		ORDER BY r.run_number DESC
+	`, broadcastID, window.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	for i := range runs {
+		runs[i].rates()
+	}
+	return runs, nil
+}
+
+// Run returns one run of the broadcast
+func (s *Service) Run(ctx context.Context, broadcastID, runID string, window time.Duration) (*Run, error) {
+	var run Run
+	err := s.db.GetContext(ctx, &run, `
+		SELECT `+runColumns+`
+		FROM broadcast_runs r
+		JOIN broadcasts b ON b.id = r.broadcast_id
+		LEFT JOIN broadcast_recipients br ON br.run_id = r.id
+		WHERE r.broadcast_id = $1 AND r.id::text = $3
+		GROUP BY r.id, b.tenant_id
+	`, broadcastID, window.Seconds(), runID)
+	if err != nil {
+		return nil, err
+	}
+	run.rates()
+	return &run, nil
+}
+
+func (r *Run) rates() {
+	if r.Sent > 0 {
+		r.DeliveryRate = rate(r.Delivered, r.Sent)
+		r.ReadRate = rate(r.Read, r.Sent)
+		r.ReplyRate = rate(r.Replied, r.Sent)
+	}
+}
@@ -0,0 +1,50 @@
+package broadcast
+
+import "errors"
+
+// Broadcast statuses before sending. Recurring broadcasts are 'active'
+// between runs.
+const (
+	StatusDraft     = "draft"
+	StatusScheduled = "scheduled"
+	StatusActive    = "active"
+)
+
+// ErrInvalidTransition is returned when a broadcast cannot move to a status
+// from the one it is in
+var ErrInvalidTransition = errors.New("invalid broadcast status transition")
+
+// transitions lists the statuses a broadcast may move to from each status.
+// A broadcast is sending from its start until its run has drained; a
+// completed broadcast sends again when failed recipients are retried.
+var transitions = map[string][]string{
+	StatusDraft:     {StatusScheduled, StatusSending, StatusCancelled},
+	StatusScheduled: {StatusSending, StatusCancelled},
+	StatusActive:    {StatusSending, StatusCancelled},
+	StatusSending:   {StatusActive, StatusPaused, StatusCompleted, StatusCancelled},
+	StatusPaused:    {StatusSending, StatusCancelled},
+	StatusCompleted: {StatusSending},
+}
+
+// CanTransition reports whether a broadcast may move from one status to
+// another
+func CanTransition(from, to string) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// From returns the statuses a broadcast may move to the status from, for
+// use in guarded updates
+func From(to string) []string {
+	from := []string{}
+	for _, s := range []string{StatusDraft, StatusScheduled, StatusActive, StatusSending, StatusPaused, StatusCompleted} {
+		if CanTransition(s, to) {
+			from = append(from, s)
+		}
+	}
+	return from
+}
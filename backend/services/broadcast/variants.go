@@ -0,0 +1,410 @@
+// Package broadcast holds the parts of sending a broadcast that the manual
+// send, the scheduler and the queue worker share.
+package broadcast
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"time"
+
+	"gowa-backend/services/templating"
+	"gowa-backend/services/whatsapp"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// A/B winner metrics
+const (
+	MetricReplyRate = "reply_rate"
+	MetricReadRate  = "read_rate"
+)
+
+// Recipient statuses specific to A/B tests
+const (
+	StatusHeld = "held"
+)
+
+const (
+	maxVariants = 5
+	// ReplyWindow is how long after a send an inbound message counts as a reply
+	ReplyWindow = whatsapp.ReplyWindow
+)
+
+// ErrInvalidVariants wraps every variant validation error
+var ErrInvalidVariants = errors.New("invalid broadcast variants")
+
+// Variant is one content alternative of a broadcast
+type Variant struct {
+	ID             string    `json:"id" db:"id"`
+	BroadcastID    string    `json:"broadcast_id" db:"broadcast_id"`
+	Label          string    `json:"label" db:"label"`
+	MessageContent string    `json:"message_content" db:"message_content"`
+	Weight         int       `json:"weight" db:"weight"`
+	CreatedAt      time.Time `json:"created_at" db:"created_at"`
+}
+
+// ABTest configures sending a test portion first
+type ABTest struct {
+	TestPercent      int    `json:"test_percent"`
+	DecideAfterHours int    `json:"decide_after_hours"`
+	WinnerMetric     string `json:"winner_metric"`
+}
+
+// VariantInput is a variant in a create request
+type VariantInput struct {
+	Label          string `json:"label"`
+	MessageContent string `json:"message_content"`
+	Weight         int    `json:"weight"`
+}
+
+// ValidateVariants labels variants A, B, … when unlabeled and checks their
+// weights add up to 100
+func ValidateVariants(variants []VariantInput) error {
+	if len(variants) == 0 {
+		return nil
+	}
+	if len(variants) < 2 || len(variants) > maxVariants {
+		return fmt.Errorf("%w: use 2 to %d variants", ErrInvalidVariants, maxVariants)
+	}
+
+	total := 0
+	labels := map[string]bool{}
+	for i := range variants {
+		v := &variants[i]
+		v.Label = strings.ToUpper(strings.TrimSpace(v.Label))
+		if v.Label == "" {
+			v.Label = string(rune('A' + i))
+		}
+		if len(v.Label) > 10 || labels[v.Label] {
+			return fmt.Errorf("%w: labels must be unique and at most 10 characters", ErrInvalidVariants)
+		}
+		labels[v.Label] = true
+		if strings.TrimSpace(v.MessageContent) == "" {
+			return fmt.Errorf("%w: variant %s has no content", ErrInvalidVariants, v.Label)
+		}
+		if v.Weight < 1 || v.Weight > 99 {
+			return fmt.Errorf("%w: variant %s weight must be between 1 and 99", ErrInvalidVariants, v.Label)
+		}
+		total += v.Weight
+	}
+	if total != 100 {
+		return fmt.Errorf("%w: weights must add up to 100, not %d", ErrInvalidVariants, total)
+	}
+	return nil
+}
+
+// Validate fills in defaults and checks the test settings
+func (t *ABTest) Validate() error {
+	if t.TestPercent < 0 || t.TestPercent >= 100 {
+		return fmt.Errorf("%w: test_percent must be between 0 and 99", ErrInvalidVariants)
+	}
+	if t.DecideAfterHours == 0 {
+		t.DecideAfterHours = 24
+	}
+	if t.DecideAfterHours < 1 || t.DecideAfterHours > 168 {
+		return fmt.Errorf("%w: decide_after_hours must be between 1 and 168", ErrInvalidVariants)
+	}
+	switch t.WinnerMetric {
+	case "":
+		t.WinnerMetric = MetricReplyRate
+	case MetricReplyRate, MetricReadRate:
+	default:
+		return fmt.Errorf("%w: winner_metric must be reply_rate or read_rate", ErrInvalidVariants)
+	}
+	return nil
+}
+
+// Service runs broadcast A/B tests
+type Service struct {
+	db *sqlx.DB
+}
+
+// NewService creates a broadcast service
+func NewService(db *sqlx.DB) *Service {
+	return &Service{db: db}
+}
+
+// Variants returns a broadcast's variants in label order
+func (s *Service) Variants(ctx context.Context, broadcastID string) ([]Variant, error) {
+	variants := []Variant{}
+	err := s.db.SelectContext(ctx, &variants, `
+		SELECT id, broadcast_id, label, message_content, weight, created_at
+		FROM broadcast_variants WHERE broadcast_id = $1
+		ORDER BY label
+	`, broadcastID)
+	return variants, err
+}
+
+// CreateVariants stores the variants of a new broadcast
+func CreateVariants(ctx context.Context, tx *sqlx.Tx, broadcastID string, variants []VariantInput) error {
+	for _, v := range variants {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO broadcast_variants (broadcast_id, label, message_content, weight)
+			VALUES ($1, $2, $3, $4)
+		`, broadcastID, v.Label, v.MessageContent, v.Weight)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bucket maps a broadcast and customer to 0..99, the same way every time
+func bucket(salt, broadcastID, customerID string) int {
+	h := fnv.New32a()
+	h.Write([]byte(salt + ":" + broadcastID + ":" + customerID))
+	return int(h.Sum32() % 100)
+}
+
+// pick returns the variant whose cumulative weight covers the bucket
+func pick(variants []Variant, b int) Variant {
+	cumulative := 0
+	for _, v := range variants {
+		cumulative += v.Weight
+		if b < cumulative {
+			return v
+		}
+	}
+	return variants[len(variants)-1]
+}
+
+// AssignVariants gives pending recipients without a variant their variant.
+// Assignment hashes the broadcast and customer IDs, so a recipient keeps its
+// variant if assignment runs again. While a test portion is running,
+// recipients outside it are held until a winner is picked; once there is a
+// winner they get it directly.
+func (s *Service) AssignVariants(ctx context.Context, broadcastID string) error {
+	variants, err := s.Variants(ctx, broadcastID)
+	if err != nil || len(variants) == 0 {
+		return err
+	}
+
+	var b struct {
+		TestPercent int            `db:"ab_test_percent"`
+		WinnerID    sql.NullString `db:"ab_winner_variant_id"`
+	}
+	err = s.db.GetContext(ctx, &b, `SELECT ab_test_percent, ab_winner_variant_id FROM broadcasts WHERE id = $1`, broadcastID)
+	if err != nil {
+		return err
+	}
+
+	var recipients []struct {
+		ID         string `db:"id"`
+		CustomerID string `db:"customer_id"`
+	}
+	err = s.db.SelectContext(ctx, &recipients, `
+		SELECT id, customer_id FROM broadcast_recipients
+		WHERE broadcast_id = $1 AND status = 'pending' AND variant_id IS NULL
+	`, broadcastID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, r := range recipients {
+		variantID := pick(variants, bucket("variant", broadcastID, r.CustomerID)).ID
+		status := "pending"
+		switch {
+		case b.WinnerID.Valid:
+			variantID = b.WinnerID.String
+		case b.TestPercent > 0 && bucket("test", broadcastID, r.CustomerID) >= b.TestPercent:
+			status = StatusHeld
+		}
+
+		if status == StatusHeld {
+			_, err = tx.ExecContext(ctx, `UPDATE broadcast_recipients SET status = $1 WHERE id = $2`, StatusHeld, r.ID)
+		} else {
+			_, err = tx.ExecContext(ctx, `UPDATE broadcast_recipients SET variant_id = $1 WHERE id = $2`, variantID, r.ID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// VariantResult is how one variant performed
+type VariantResult struct {
+	Variant
+	Recipients   int     `json:"recipients" db:"recipients"`
+	Sent         int     `json:"sent" db:"sent"`
+	Delivered    int     `json:"delivered" db:"delivered"`
+	Read         int     `json:"read" db:"read"`
+	Replied      int     `json:"replied" db:"replied"`
+	Failed       int     `json:"failed" db:"failed"`
+	DeliveryRate float64 `json:"delivery_rate" db:"-"`
+	ReadRate     float64 `json:"read_rate" db:"-"`
+	ReplyRate    float64 `json:"reply_rate" db:"-"`
+	Winner       bool    `json:"winner" db:"winner"`
+}
+
+// Results counts delivery, reads and replies per variant. A reply is an
+// inbound message from the recipient within window of the send.
+func (s *Service) Results(ctx context.Context, broadcastID string, window time.Duration) ([]VariantResult, error) {
+	results := []VariantResult{}
+	err := s.db.SelectContext(ctx, &results, `
+		SELECT v.id, v.broadcast_id, v.label, v.message_content, v.weight, v.created_at,
+			COUNT(br.id) as recipients,
+			COUNT(br.sent_at) as sent,
+			COUNT(br.delivered_at) as delivered,
+			COUNT(br.read_at) as read,
+			COUNT(*) FILTER (WHERE br.status = 'failed') as failed,
+			COUNT(*) FILTER (WHERE br.sent_at IS NOT NULL AND EXISTS (
+				SELECT 1 FROM whatsapp_messages m
+				WHERE m.tenant_id = b.tenant_id AND m.chat_jid = br.customer_jid AND NOT m.is_from_me
+				  AND m.timestamp BETWEEN EXTRACT(EPOCH FROM br.sent_at)::bigint
+				                      AND EXTRACT(EPOCH FROM br.sent_at + make_interval(secs => $2))::bigint
+			)) as replied,
+			COALESCE(b.ab_winner_variant_id = v.id, false) as winner
+		FROM broadcast_variants v
+		JOIN broadcasts b ON b.id = v.broadcast_id
+		LEFT JOIN broadcast_recipients br ON br.variant_id = v.id
+		WHERE v.broadcast_id = $1
+		GROUP BY v.id, b.tenant_id, b.ab_winner_variant_id
+		ORDER BY v.label
+	`, broadcastID, window.Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range results {
+		r := &results[i]
+		if r.Sent > 0 {
+			r.DeliveryRate = rate(r.Delivered, r.Sent)
+			r.ReadRate = rate(r.Read, r.Sent)
+			r.ReplyRate = rate(r.Replied, r.Sent)
+		}
+	}
+	return results, nil
+}
+
+func rate(n, of int) float64 {
+	return float64(int(float64(n)/float64(of)*1000+0.5)) / 1000
+}
+
+// PendingDecision is a broadcast whose test portion is due for a winner
+type PendingDecision struct {
+	ID             string `db:"id"`
+	TenantID       string `db:"tenant_id"`
+	MessageContent string `db:"message_content"`
+	WinnerMetric   string `db:"ab_winner_metric"`
+}
+
+// DueDecisions returns broadcasts whose test portion has run long enough
+func (s *Service) DueDecisions(ctx context.Context) ([]PendingDecision, error) {
+	var due []PendingDecision
+	err := s.db.SelectContext(ctx, &due, `
+		SELECT b.id, b.tenant_id, b.message_content, b.ab_winner_metric
+		FROM broadcasts b
+		WHERE b.ab_test_percent > 0 AND b.ab_winner_variant_id IS NULL
+		  AND b.started_at <= NOW() - make_interval(hours => b.ab_decide_after_hours)
+		  AND EXISTS (SELECT 1 FROM broadcast_recipients br WHERE br.broadcast_id = b.id AND br.status = 'held')
+	`)
+	return due, err
+}
+
+// DecideWinner picks the variant with the best metric, breaking ties by the
+// other rate and then by label, and releases the held recipients with it as
+// pending. It returns the winning variant.
+func (s *Service) DecideWinner(ctx context.Context, broadcastID, metric string) (*VariantResult, error) {
+	results, err := s.Results(ctx, broadcastID, ReplyWindow)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	score := func(r VariantResult) (float64, float64) {
+		if metric == MetricReadRate {
+			return r.ReadRate, r.ReplyRate
+		}
+		return r.ReplyRate, r.ReadRate
+	}
+	best := results[0]
+	for _, r := range results[1:] {
+		p1, p2 := score(r)
+		b1, b2 := score(best)
+		if p1 > b1 || p1 == b1 && p2 > b2 {
+			best = r
+		}
+	}
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		UPDATE broadcasts SET ab_winner_variant_id = $1, ab_decided_at = NOW(), updated_at = NOW()
+		WHERE id = $2 AND ab_winner_variant_id IS NULL
+	`, best.ID, broadcastID)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// Decided concurrently
+		return nil, sql.ErrNoRows
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE broadcast_recipients SET status = 'pending', variant_id = $1
+		WHERE broadcast_id = $2 AND status = 'held'
+	`, best.ID, broadcastID)
+	if err != nil {
+		return nil, err
+	}
+
+	best.Winner = true
+	return &best, tx.Commit()
+}
+
+// Messages renders a broadcast's content per recipient, using the
+// recipient's variant when it has one
+type Messages struct {
+	svc      *templating.Service
+	tenantID string
+	base     *templating.Personalizer
+	variants map[string]*templating.Personalizer
+}
+
+// Messages prepares the broadcast's content and variants for rendering
+func (s *Service) Messages(ctx context.Context, tenantID, broadcastID, content string) (*Messages, error) {
+	svc := templating.NewService(s.db)
+	base, err := svc.Personalizer(ctx, tenantID, content)
+	if err != nil {
+		return nil, err
+	}
+
+	variants, err := s.Variants(ctx, broadcastID)
+	if err != nil {
+		return nil, err
+	}
+	m := &Messages{svc: svc, tenantID: tenantID, base: base, variants: map[string]*templating.Personalizer{}}
+	for _, v := range variants {
+		if m.variants[v.ID], err = svc.Personalizer(ctx, tenantID, v.MessageContent); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Render returns the message for one recipient
+func (m *Messages) Render(ctx context.Context, customerID string, variantID *string) (string, error) {
+	if variantID != nil {
+		if p, ok := m.variants[*variantID]; ok {
+			return p.Render(ctx, customerID)
+		}
+	}
+	return m.base.Render(ctx, customerID)
+}
@@ -0,0 +1,332 @@
+package conversation
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gowa-backend/models"
+	ws "gowa-backend/services/websocket"
+
+	"github.com/google/uuid"
+)
+
+// ErrInvalidCursor is returned for a malformed message history cursor
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// maxReceiptBatch caps how many message IDs are sent in one read receipt
+const maxReceiptBatch = 100
+
+// LastMessage describes a message that was just stored for a conversation
+type LastMessage struct {
+	MessageID string
+	Text      string
+	Type      string
+	FromMe    bool
+	At        time.Time
+}
+
+// ListFilter narrows the inbox listing
+type ListFilter struct {
+	Status   string // open, pending, resolved, snoozed or "" for all
+	Assigned string // "mine", "unassigned", a user ID or "" for all
+	Search   string
+	Page     int
+	Limit    int
+}
+
+// RecordMessage stores msg as the conversation's last message, creating the
+// conversation on first contact. A message from the customer reopens a
+// resolved or snoozed conversation. Messages older than the current last
+// message are ignored and return a nil conversation.
+func (s *Service) RecordMessage(ctx context.Context, tenantID, customerJID string, msg LastMessage) (*models.Conversation, error) {
+	var prevStatus string
+	s.db.GetContext(ctx, &prevStatus, `SELECT status FROM conversations WHERE tenant_id = $1 AND customer_jid = $2`, tenantID, customerJID)
+
+	var conv models.Conversation
+	query := `
+		INSERT INTO conversations (
+			tenant_id, customer_id, customer_jid,
+			last_message_id, last_message_text, last_message_type, last_message_from_me, last_message_at
+		) VALUES (
+			$1, (SELECT id FROM customer_insights WHERE tenant_id = $1 AND customer_jid = $2), $2,
+			$3, $4, $5, $6, $7
+		)
+		ON CONFLICT (tenant_id, customer_jid) DO UPDATE SET
+			customer_id = COALESCE(conversations.customer_id, EXCLUDED.customer_id),
+			last_message_id = EXCLUDED.last_message_id,
+			last_message_text = EXCLUDED.last_message_text,
+			last_message_type = EXCLUDED.last_message_type,
+			last_message_from_me = EXCLUDED.last_message_from_me,
+			last_message_at = EXCLUDED.last_message_at,
+			status = CASE
+				WHEN NOT EXCLUDED.last_message_from_me AND conversations.status IN ('resolved', 'snoozed') THEN 'open'
+				ELSE conversations.status
+			END,
+			snooze_until = CASE WHEN EXCLUDED.last_message_from_me THEN conversations.snooze_until ELSE NULL END,
+			resolved_at = CASE WHEN EXCLUDED.last_message_from_me THEN conversations.resolved_at ELSE NULL END,
+			updated_at = NOW()
+		WHERE conversations.last_message_at IS NULL OR EXCLUDED.last_message_at >= conversations.last_message_at
+		RETURNING ` + conversationColumns("")
+	err := s.db.GetContext(ctx, &conv, query,
+		tenantID, customerJID, msg.MessageID, msg.Text, msg.Type, msg.FromMe, msg.At)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if prevStatus != conv.Status {
+		s.notifyUpdated(&conv)
+	}
+	return &conv, nil
+}
+
+// SetStatus changes a conversation's status. snoozeUntil is required for
+// snoozed and ignored otherwise.
+func (s *Service) SetStatus(ctx context.Context, tenantID, conversationID, status string, snoozeUntil *time.Time) (*models.Conversation, error) {
+	if status != models.ConversationSnoozed {
+		snoozeUntil = nil
+	}
+
+	var conv models.Conversation
+	query := `
+		UPDATE conversations
+		SET status = $1,
+		    snooze_until = $2,
+		    resolved_at = CASE WHEN $1 = 'resolved' THEN NOW() ELSE NULL END,
+		    updated_at = NOW()
+		WHERE id = $3 AND tenant_id = $4
+		RETURNING ` + conversationColumns("")
+	if err := s.db.GetContext(ctx, &conv, query, status, snoozeUntil, conversationID, tenantID); err != nil {
+		return nil, err
+	}
+
+	s.notifyUpdated(&conv)
+	return &conv, nil
+}
+
+// WakeSnoozed reopens snoozed conversations whose snooze time has passed
+func (s *Service) WakeSnoozed(ctx context.Context) (int, error) {
+	var convs []models.Conversation
+	query := `
+		UPDATE conversations
+		SET status = 'open', snooze_until = NULL, updated_at = NOW()
+		WHERE status = 'snoozed' AND snooze_until <= NOW()
+		RETURNING ` + conversationColumns("")
+	if err := s.db.SelectContext(ctx, &convs, query); err != nil {
+		return 0, err
+	}
+
+	for i := range convs {
+		s.notifyUpdated(&convs[i])
+	}
+	return len(convs), nil
+}
+
+// List returns one page of the inbox for userID, most recent activity first,
+// together with the total number of matching conversations
+func (s *Service) List(ctx context.Context, tenantID, userID string, filter ListFilter) ([]models.ConversationSummary, int, error) {
+	baseQuery := `
+		FROM conversations conv
+		LEFT JOIN customer_insights ci ON ci.tenant_id = conv.tenant_id AND ci.customer_jid = conv.customer_jid
+		WHERE conv.tenant_id = $1
+	`
+	args := []interface{}{tenantID}
+	argCount := 1
+
+	if filter.Status != "" && filter.Status != "all" {
+		argCount++
+		baseQuery += ` AND conv.status = $` + strconv.Itoa(argCount)
+		args = append(args, filter.Status)
+	}
+
+	switch filter.Assigned {
+	case "", "all":
+	case "unassigned":
+		baseQuery += ` AND conv.assigned_to IS NULL`
+	default:
+		assignee := filter.Assigned
+		if assignee == "mine" {
+			assignee = userID
+		}
+		argCount++
+		baseQuery += ` AND conv.assigned_to::text = $` + strconv.Itoa(argCount)
+		args = append(args, assignee)
+	}
+
+	if filter.Search != "" {
+		argCount++
+		baseQuery += ` AND (
+			ci.customer_name ILIKE $` + strconv.Itoa(argCount) + ` OR
+			ci.customer_phone ILIKE $` + strconv.Itoa(argCount) + ` OR
+			conv.customer_jid ILIKE $` + strconv.Itoa(argCount) + ` OR
+			conv.last_message_text ILIKE $` + strconv.Itoa(argCount) + `
+		)`
+		args = append(args, "%"+filter.Search+"%")
+	}
+
+	var total int
+	if err := s.db.GetContext(ctx, &total, `SELECT COUNT(*) `+baseQuery, args...); err != nil {
+		return nil, 0, err
+	}
+
+	argCount++
+	userArg := strconv.Itoa(argCount)
+	args = append(args, userID)
+
+	selectQuery := `
+		SELECT ` + conversationColumns("conv.") + `,
+		       ci.customer_name, ci.customer_phone,
+		       (SELECT u.full_name FROM users u WHERE u.id = conv.assigned_to) as assignee_name,
+		       (SELECT COUNT(*) FROM whatsapp_messages m
+		        WHERE m.tenant_id = conv.tenant_id AND m.sender_jid = conv.customer_jid
+		          AND m.is_from_me = false AND m.is_group = false
+		          AND m.timestamp > COALESCE((
+		              SELECT r.last_read_timestamp FROM conversation_reads r
+		              WHERE r.conversation_id = conv.id AND r.user_id::text = $` + userArg + `
+		          ), 0)) as unread_count
+		` + baseQuery + `
+		ORDER BY COALESCE(conv.last_message_at, conv.created_at) DESC
+		LIMIT $` + strconv.Itoa(argCount+1) + ` OFFSET $` + strconv.Itoa(argCount+2)
+	args = append(args, filter.Limit, (filter.Page-1)*filter.Limit)
+
+	var items []models.ConversationSummary
+	if err := s.db.SelectContext(ctx, &items, selectQuery, args...); err != nil {
+		return nil, 0, err
+	}
+	if items == nil {
+		items = []models.ConversationSummary{}
+	}
+	return items, total, nil
+}
+
+// Messages returns up to limit messages of a conversation, newest first,
+// older than cursor. Group messages belong to no conversation. nextCursor is empty when there are no older messages.
+func (s *Service) Messages(ctx context.Context, conv *models.Conversation, cursor string, limit int) ([]models.ConversationMessage, string, error) {
+	query := `
+		SELECT id, COALESCE(message_id, '') as message_id,
+		       COALESCE(message_type, 'text') as message_type,
+		       COALESCE(NULLIF(message_text, ''), caption, '') as message_text,
+		       COALESCE(media_url, '') as media_url,
+		       is_from_me, timestamp, to_timestamp(timestamp) as sent_at
+		FROM whatsapp_messages
+		WHERE tenant_id = $1 AND (sender_jid = $2 OR chat_jid = $2) AND is_group = false
+	`
+	args := []interface{}{conv.TenantID, conv.CustomerJID}
+
+	if cursor != "" {
+		ts, id, err := decodeCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		query += ` AND (timestamp, id) < ($3, $4::uuid)`
+		args = append(args, ts, id)
+	}
+
+	query += ` ORDER BY timestamp DESC, id DESC LIMIT $` + strconv.Itoa(len(args)+1)
+	args = append(args, limit+1)
+
+	var messages []models.ConversationMessage
+	if err := s.db.SelectContext(ctx, &messages, query, args...); err != nil {
+		return nil, "", err
+	}
+	if messages == nil {
+		messages = []models.ConversationMessage{}
+	}
+
+	nextCursor := ""
+	if len(messages) > limit {
+		messages = messages[:limit]
+		last := messages[len(messages)-1]
+		nextCursor = encodeCursor(last.Timestamp, last.ID)
+	}
+	return messages, nextCursor, nil
+}
+
+// MarkRead marks every customer message of a conversation as read by userID.
+// It returns the WhatsApp IDs of the messages that were unread until now so
+// the caller can send read receipts.
+func (s *Service) MarkRead(ctx context.Context, conv *models.Conversation, userID string) ([]string, error) {
+	var unreadIDs []string
+	err := s.db.SelectContext(ctx, &unreadIDs, `
+		SELECT message_id
+		FROM whatsapp_messages
+		WHERE tenant_id = $1 AND sender_jid = $2 AND is_from_me = false AND is_group = false
+		  AND timestamp > COALESCE((
+		      SELECT last_read_timestamp FROM conversation_reads
+		      WHERE conversation_id = $3 AND user_id = $4
+		  ), 0)
+		ORDER BY timestamp DESC
+		LIMIT $5
+	`, conv.TenantID, conv.CustomerJID, conv.ID, userID, maxReceiptBatch)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastRead int64
+	err = s.db.GetContext(ctx, &lastRead, `
+		INSERT INTO conversation_reads (conversation_id, user_id, last_read_timestamp, last_read_at)
+		VALUES ($1, $2, COALESCE((
+			SELECT MAX(timestamp) FROM whatsapp_messages
+			WHERE tenant_id = $3 AND sender_jid = $4 AND is_from_me = false AND is_group = false
+		), 0), NOW())
+		ON CONFLICT (conversation_id, user_id) DO UPDATE SET
+			last_read_timestamp = GREATEST(conversation_reads.last_read_timestamp, EXCLUDED.last_read_timestamp),
+			last_read_at = NOW()
+		RETURNING last_read_timestamp
+	`, conv.ID, userID, conv.TenantID, conv.CustomerJID)
+	if err != nil {
+		return nil, err
+	}
+
+	ws.GetHub().BroadcastToTenant(conv.TenantID, ws.EventConversationRead, map[string]interface{}{
+		"conversation_id":     conv.ID,
+		"user_id":             userID,
+		"last_read_timestamp": lastRead,
+	})
+
+	return unreadIDs, nil
+}
+
+// notifyUpdated tells connected clients that a conversation changed
+func (s *Service) notifyUpdated(conv *models.Conversation) {
+	ws.GetHub().BroadcastToTenant(conv.TenantID, ws.EventConversationUpdated, conv)
+}
+
+// encodeCursor builds an opaque history cursor from a message position
+func encodeCursor(timestamp int64, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d_%s", timestamp, id)))
+}
+
+// CursorAt returns a history cursor whose first page starts with the
+// messages sent at timestamp, used to jump to a message from search results
+func CursorAt(timestamp int64) string {
+	return encodeCursor(timestamp+1, uuid.Nil.String())
+}
+
+// decodeCursor parses a cursor created by encodeCursor
+func decodeCursor(cursor string) (int64, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, "", ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(raw), "_", 2)
+	if len(parts) != 2 {
+		return 0, "", ErrInvalidCursor
+	}
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", ErrInvalidCursor
+	}
+	if _, err := uuid.Parse(parts[1]); err != nil {
+		return 0, "", ErrInvalidCursor
+	}
+	return ts, parts[1], nil
+}
@@ -0,0 +1,264 @@
+package conversation
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+
+	"gowa-backend/models"
+	ws "gowa-backend/services/websocket"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// How a conversation got its current assignee
+const (
+	AssignedByManual   = "manual"
+	AssignedByClaim    = "claim"
+	AssignedByTransfer = "transfer"
+	AssignedByRule     = "rule"
+)
+
+// ErrAlreadyAssigned is returned when claiming a conversation another member owns
+var ErrAlreadyAssigned = errors.New("conversation is already assigned")
+
+// conversationFields are the columns scanned into models.Conversation
+var conversationFields = []string{
+	"id", "tenant_id", "customer_id", "customer_jid", "assigned_to",
+	"assigned_at", "assigned_by", "status", "snooze_until", "resolved_at",
+	"last_message_id", "last_message_text", "last_message_type",
+	"last_message_from_me", "last_message_at", "created_at", "updated_at",
+}
+
+// conversationColumns returns the conversation select list, optionally
+// qualified with a table alias such as "conv."
+func conversationColumns(prefix string) string {
+	cols := make([]string, len(conversationFields))
+	for i, field := range conversationFields {
+		cols[i] = prefix + field
+	}
+	return strings.Join(cols, ", ")
+}
+
+// Service manages conversations and their assignment to tenant members
+type Service struct {
+	db *sqlx.DB
+}
+
+// NewService creates a conversation service
+func NewService(db *sqlx.DB) *Service {
+	return &Service{db: db}
+}
+
+// Get returns a conversation of the tenant
+func (s *Service) Get(ctx context.Context, tenantID, conversationID string) (*models.Conversation, error) {
+	var conv models.Conversation
+	query := `SELECT ` + conversationColumns("") + ` FROM conversations WHERE id = $1 AND tenant_id = $2`
+	if err := s.db.GetContext(ctx, &conv, query, conversationID, tenantID); err != nil {
+		return nil, err
+	}
+	return &conv, nil
+}
+
+// Ensure returns the conversation for a customer, creating it on first contact.
+// customer_id is filled in once the customer exists in customer_insights.
+func (s *Service) Ensure(ctx context.Context, tenantID, customerJID string) (*models.Conversation, error) {
+	var conv models.Conversation
+	query := `
+		INSERT INTO conversations (tenant_id, customer_id, customer_jid)
+		VALUES ($1, (SELECT id FROM customer_insights WHERE tenant_id = $1 AND customer_jid = $2), $2)
+		ON CONFLICT (tenant_id, customer_jid)
+		DO UPDATE SET customer_id = COALESCE(conversations.customer_id, EXCLUDED.customer_id)
+		RETURNING ` + conversationColumns("")
+	if err := s.db.GetContext(ctx, &conv, query, tenantID, customerJID); err != nil {
+		return nil, err
+	}
+	return &conv, nil
+}
+
+// Assign sets (or with a nil userID clears) the assignee of a conversation
+func (s *Service) Assign(ctx context.Context, tenantID, conversationID string, userID *string, assignedBy string) (*models.Conversation, error) {
+	return s.setAssignee(ctx, tenantID, conversationID, userID, assignedBy, false)
+}
+
+// Claim assigns a conversation to userID unless another member already owns it
+func (s *Service) Claim(ctx context.Context, tenantID, conversationID, userID string) (*models.Conversation, error) {
+	return s.setAssignee(ctx, tenantID, conversationID, &userID, AssignedByClaim, true)
+}
+
+// IsAssignableMember reports whether userID may be assigned conversations of the tenant
+func (s *Service) IsAssignableMember(ctx context.Context, tenantID, userID string) (bool, error) {
+	var role string
+	err := s.db.GetContext(ctx, &role, `SELECT role FROM tenant_members WHERE tenant_id = $1 AND user_id = $2`, tenantID, userID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return models.RoleAtLeast(role, models.RoleAgent), nil
+}
+
+// AutoAssign runs the tenant's routing rules for an unassigned conversation.
+// intent is the detected intent of the latest customer message and may be empty.
+// It returns the conversation whether or not a rule matched.
+func (s *Service) AutoAssign(ctx context.Context, tenantID, customerJID, intent string) (*models.Conversation, error) {
+	conv, err := s.Ensure(ctx, tenantID, customerJID)
+	if err != nil {
+		return nil, err
+	}
+	if conv.AssignedTo != nil {
+		return conv, nil
+	}
+
+	var rules []models.AssignmentRule
+	err = s.db.SelectContext(ctx, &rules, `
+		SELECT id, tenant_id, name, rule_type, match_value, assign_to_user, assign_to_role,
+		       priority, is_active, created_at, updated_at
+		FROM assignment_rules
+		WHERE tenant_id = $1 AND is_active = true
+		ORDER BY priority DESC, created_at ASC
+	`, tenantID)
+	if err != nil {
+		return conv, err
+	}
+	if len(rules) == 0 {
+		return conv, nil
+	}
+
+	tagIDs := map[string]bool{}
+	if conv.CustomerID != nil {
+		var ids []string
+		if err := s.db.SelectContext(ctx, &ids, `SELECT tag_id::text FROM customer_tag_assignments WHERE customer_id = $1`, *conv.CustomerID); err == nil {
+			for _, id := range ids {
+				tagIDs[id] = true
+			}
+		}
+	}
+
+	for _, rule := range rules {
+		if !ruleMatches(rule, intent, tagIDs) {
+			continue
+		}
+
+		userID, err := s.ruleTarget(ctx, tenantID, rule)
+		if err != nil {
+			return conv, err
+		}
+		if userID == "" {
+			// Nobody available for this rule, try the next one
+			continue
+		}
+
+		assigned, err := s.setAssignee(ctx, tenantID, conv.ID, &userID, AssignedByRule, true)
+		if err == ErrAlreadyAssigned {
+			// Claimed by someone while the rules were evaluated
+			return s.Get(ctx, tenantID, conv.ID)
+		}
+		if err != nil {
+			return conv, err
+		}
+		log.Printf("[Routing] Conversation %s assigned to %s by rule %q", conv.ID, userID, rule.Name)
+		return assigned, nil
+	}
+
+	return conv, nil
+}
+
+// ruleMatches reports whether a rule applies to a conversation
+func ruleMatches(rule models.AssignmentRule, intent string, tagIDs map[string]bool) bool {
+	switch rule.RuleType {
+	case models.RuleTypeRoundRobin:
+		return true
+	case models.RuleTypeTag:
+		return rule.MatchValue != nil && tagIDs[*rule.MatchValue]
+	case models.RuleTypeIntent:
+		return rule.MatchValue != nil && intent != "" && strings.EqualFold(*rule.MatchValue, intent)
+	}
+	return false
+}
+
+// ruleTarget picks the member a rule assigns to, or "" when nobody is available.
+// A fixed user always receives the conversation; otherwise the online member
+// with the wanted role that was assigned least recently is chosen.
+func (s *Service) ruleTarget(ctx context.Context, tenantID string, rule models.AssignmentRule) (string, error) {
+	if rule.AssignToUser != nil {
+		ok, err := s.IsAssignableMember(ctx, tenantID, *rule.AssignToUser)
+		if err != nil || !ok {
+			return "", err
+		}
+		return *rule.AssignToUser, nil
+	}
+
+	online := ws.GetHub().GetOnlineUserIDs(tenantID)
+	if len(online) == 0 {
+		return "", nil
+	}
+
+	roles := []string{models.RoleOwner, models.RoleAdmin, models.RoleAgent}
+	if rule.AssignToRole != nil && *rule.AssignToRole != "" {
+		roles = []string{*rule.AssignToRole}
+	}
+
+	var userID string
+	err := s.db.GetContext(ctx, &userID, `
+		SELECT user_id
+		FROM tenant_members
+		WHERE tenant_id = $1 AND user_id::text = ANY($2) AND role = ANY($3)
+		ORDER BY last_assigned_at ASC NULLS FIRST, created_at ASC
+		LIMIT 1
+	`, tenantID, pq.Array(online), pq.Array(roles))
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return userID, err
+}
+
+// setAssignee updates the assignee and notifies connected clients. With
+// requireFree the update only succeeds when the conversation is unassigned
+// or already belongs to userID.
+func (s *Service) setAssignee(ctx context.Context, tenantID, conversationID string, userID *string, assignedBy string, requireFree bool) (*models.Conversation, error) {
+	query := `
+		UPDATE conversations
+		SET assigned_to = $1,
+		    assigned_at = CASE WHEN $1::uuid IS NULL THEN NULL ELSE NOW() END,
+		    assigned_by = CASE WHEN $1::uuid IS NULL THEN NULL ELSE $2 END,
+		    updated_at = NOW()
+		WHERE id = $3 AND tenant_id = $4
+	`
+	if requireFree {
+		query += ` AND (assigned_to IS NULL OR assigned_to = $1)`
+	}
+	query += ` RETURNING ` + conversationColumns("")
+
+	var conv models.Conversation
+	err := s.db.GetContext(ctx, &conv, query, userID, assignedBy, conversationID, tenantID)
+	if err == sql.ErrNoRows && requireFree {
+		if _, getErr := s.Get(ctx, tenantID, conversationID); getErr == nil {
+			return nil, ErrAlreadyAssigned
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if userID != nil {
+		if _, err := s.db.ExecContext(ctx, `UPDATE tenant_members SET last_assigned_at = NOW() WHERE tenant_id = $1 AND user_id = $2`, tenantID, *userID); err != nil {
+			log.Printf("[Routing] Failed to update last_assigned_at: %v", err)
+		}
+	}
+
+	ws.GetHub().BroadcastToTenant(tenantID, ws.EventConversationAssigned, map[string]interface{}{
+		"conversation_id": conv.ID,
+		"customer_id":     conv.CustomerID,
+		"customer_jid":    conv.CustomerJID,
+		"assigned_to":     conv.AssignedTo,
+		"assigned_by":     conv.AssignedBy,
+		"assigned_at":     conv.AssignedAt,
+	})
+
+	return &conv, nil
+}
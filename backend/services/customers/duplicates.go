@@ -0,0 +1,283 @@
+package customers
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Reasons two customers are reported as duplicates
+const (
+	ReasonJIDMapping = "jid_mapping" // an @lid JID and its phone JID
+	ReasonPhone      = "phone"       // same number after normalization
+	ReasonName       = "name"        // similar names
+)
+
+const (
+	// minNameSimilarity is the trigram similarity two names need to match
+	minNameSimilarity = 0.8
+	// maxGroupSize skips phone numbers and first names shared by so many
+	// customers that comparing them all would be too slow
+	maxGroupSize = 50
+)
+
+// reasonScores is the confidence each reason gives on its own
+var reasonScores = map[string]float64{
+	ReasonJIDMapping: 1,
+	ReasonPhone:      0.9,
+	ReasonName:       0.5,
+}
+
+// DuplicateCustomer is one side of a suspected duplicate
+type DuplicateCustomer struct {
+	ID            string     `json:"id" db:"id"`
+	CustomerJID   string     `json:"customer_jid" db:"customer_jid"`
+	CustomerName  *string    `json:"customer_name" db:"customer_name"`
+	CustomerPhone *string    `json:"customer_phone" db:"customer_phone"`
+	MessageCount  int        `json:"message_count" db:"message_count"`
+	LastMessageAt *time.Time `json:"last_message_at" db:"last_message_at"`
+	CreatedAt     time.Time  `json:"created_at" db:"created_at"`
+}
+
+// Duplicate is a pair of customers that are probably the same person
+type Duplicate struct {
+	Customers         [2]DuplicateCustomer `json:"customers"`
+	Reasons           []string             `json:"reasons"`
+	Score             float64              `json:"score"`
+	SuggestedSurvivor string               `json:"suggested_survivor_id"`
+}
+
+// FindDuplicates reports pairs of the tenant's customers that look like the
+// same person, by JID mapping, normalized phone number and name similarity,
+// best matches first. Pairs scoring below minScore are left out.
+func (s *Service) FindDuplicates(ctx context.Context, tenantID string, minScore float64) ([]Duplicate, error) {
+	var customers []DuplicateCustomer
+	err := s.db.SelectContext(ctx, &customers, `
+		SELECT id, customer_jid, customer_name, customer_phone,
+			COALESCE(message_count, 0) as message_count, last_message_at, created_at
+		FROM customer_insights
+		WHERE tenant_id = $1 AND customer_jid NOT LIKE '%@g.us'
+	`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	mappings, err := s.jidMappings(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Candidate pairs share a phone number or the first word of their name;
+	// matchReasons then decides why they match
+	candidates := map[[2]int]bool{}
+	addGroup := func(group []int) {
+		if len(group) > maxGroupSize {
+			return
+		}
+		for x := 0; x < len(group); x++ {
+			for y := x + 1; y < len(group); y++ {
+				candidates[[2]int{group[x], group[y]}] = true
+			}
+		}
+	}
+
+	byPhone := map[string][]int{}
+	blocks := map[string][]int{}
+	for i, c := range customers {
+		for _, p := range customerPhones(c, mappings) {
+			byPhone[p] = append(byPhone[p], i)
+		}
+		if c.CustomerName != nil {
+			if words := strings.Fields(normalizeName(*c.CustomerName)); len(words) > 0 {
+				blocks[words[0]] = append(blocks[words[0]], i)
+			}
+		}
+	}
+	for _, group := range byPhone {
+		addGroup(group)
+	}
+	for _, block := range blocks {
+		addGroup(block)
+	}
+
+	duplicates := []Duplicate{}
+	for pair := range candidates {
+		a, b := customers[pair[0]], customers[pair[1]]
+		reasons := matchReasons(a, b, mappings)
+		if len(reasons) == 0 {
+			continue
+		}
+
+		d := Duplicate{Customers: [2]DuplicateCustomer{a, b}, Reasons: reasons, Score: score(reasons)}
+		if d.Score < minScore {
+			continue
+		}
+		d.SuggestedSurvivor = suggestSurvivor(a, b).ID
+		duplicates = append(duplicates, d)
+	}
+
+	sort.Slice(duplicates, func(i, j int) bool {
+		if duplicates[i].Score != duplicates[j].Score {
+			return duplicates[i].Score > duplicates[j].Score
+		}
+		return duplicates[i].Customers[0].ID < duplicates[j].Customers[0].ID
+	})
+	return duplicates, nil
+}
+
+// jidMapping is the phone side of an @lid JID
+type jidMapping struct {
+	PhoneJID    string
+	PhoneNumber string
+}
+
+// jidMappings returns the tenant's @lid mappings keyed by @lid JID
+func (s *Service) jidMappings(ctx context.Context, tenantID string) (map[string]jidMapping, error) {
+	var rows []struct {
+		LidJID      string `db:"lid_jid"`
+		PhoneJID    string `db:"phone_jid"`
+		PhoneNumber string `db:"phone_number"`
+	}
+	err := s.db.SelectContext(ctx, &rows, `SELECT lid_jid, phone_jid, phone_number FROM jid_mappings WHERE tenant_id = $1`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	mappings := make(map[string]jidMapping, len(rows))
+	for _, r := range rows {
+		mappings[r.LidJID] = jidMapping{PhoneJID: r.PhoneJID, PhoneNumber: r.PhoneNumber}
+	}
+	return mappings, nil
+}
+
+// matchReasons returns why two customers look like the same person
+func matchReasons(a, b DuplicateCustomer, mappings map[string]jidMapping) []string {
+	reasons := []string{}
+
+	if m, ok := mappings[a.CustomerJID]; ok && m.PhoneJID == b.CustomerJID {
+		reasons = append(reasons, ReasonJIDMapping)
+	} else if m, ok := mappings[b.CustomerJID]; ok && m.PhoneJID == a.CustomerJID {
+		reasons = append(reasons, ReasonJIDMapping)
+	}
+
+	phones := map[string]bool{}
+	for _, p := range customerPhones(a, mappings) {
+		phones[p] = true
+	}
+	for _, p := range customerPhones(b, mappings) {
+		if phones[p] {
+			reasons = append(reasons, ReasonPhone)
+			break
+		}
+	}
+
+	if a.CustomerName != nil && b.CustomerName != nil {
+		nameA, nameB := normalizeName(*a.CustomerName), normalizeName(*b.CustomerName)
+		if len([]rune(nameA)) >= 3 && len([]rune(nameB)) >= 3 && nameSimilarity(nameA, nameB) >= minNameSimilarity {
+			reasons = append(reasons, ReasonName)
+		}
+	}
+
+	return reasons
+}
+
+// score combines the reasons as independent signals: 1 - product of (1 - score)
+func score(reasons []string) float64 {
+	miss := 1.0
+	for _, reason := range reasons {
+		miss *= 1 - reasonScores[reason]
+	}
+	return math.Round((1-miss)*100) / 100
+}
+
+// customerPhones returns the normalized numbers of a customer: the number
+// in a phone JID, the mapped number of an @lid JID and the phone field
+func customerPhones(c DuplicateCustomer, mappings map[string]jidMapping) []string {
+	raw := []string{}
+	if strings.HasSuffix(c.CustomerJID, "@s.whatsapp.net") {
+		raw = append(raw, c.CustomerJID)
+	}
+	if m, ok := mappings[c.CustomerJID]; ok {
+		raw = append(raw, m.PhoneNumber)
+	}
+	if c.CustomerPhone != nil {
+		raw = append(raw, *c.CustomerPhone)
+	}
+
+	phones := []string{}
+	seen := map[string]bool{}
+	for _, r := range raw {
+		if p, err := NormalizePhone(r); err == nil && !seen[p] {
+			seen[p] = true
+			phones = append(phones, p)
+		}
+	}
+	return phones
+}
+
+// suggestSurvivor prefers the phone JID, which replies can be sent to
+// without a mapping, then the customer with more history
+func suggestSurvivor(a, b DuplicateCustomer) DuplicateCustomer {
+	aPhone := strings.HasSuffix(a.CustomerJID, "@s.whatsapp.net")
+	bPhone := strings.HasSuffix(b.CustomerJID, "@s.whatsapp.net")
+	switch {
+	case aPhone != bPhone:
+		if aPhone {
+			return a
+		}
+		return b
+	case a.MessageCount != b.MessageCount:
+		if a.MessageCount > b.MessageCount {
+			return a
+		}
+		return b
+	case b.CreatedAt.Before(a.CreatedAt):
+		return b
+	default:
+		return a
+	}
+}
+
+// normalizeName lowercases a name and reduces it to words of letters and
+// digits
+func normalizeName(name string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			sb.WriteRune(r)
+		} else {
+			sb.WriteRune(' ')
+		}
+	}
+	return strings.Join(strings.Fields(sb.String()), " ")
+}
+
+// nameSimilarity is the Dice coefficient of the names' trigrams
+func nameSimilarity(a, b string) float64 {
+	if a == b {
+		return 1
+	}
+	ta, tb := trigrams(a), trigrams(b)
+	if len(ta) == 0 || len(tb) == 0 {
+		return 0
+	}
+	common := 0
+	for t := range ta {
+		if tb[t] {
+			common++
+		}
+	}
+	return 2 * float64(common) / float64(len(ta)+len(tb))
+}
+
+func trigrams(s string) map[string]bool {
+	runes := []rune("  " + s + " ")
+	set := map[string]bool{}
+	for i := 0; i+3 <= len(runes); i++ {
+		set[string(runes[i:i+3])] = true
+	}
+	return set
+}
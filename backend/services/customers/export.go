@@ -0,0 +1,174 @@
+package customers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+
+	"gowa-backend/services/spreadsheet"
+)
+
+// ExportFilter selects the customers to export
+type ExportFilter struct {
+	TenantID string
+	Search   string
+	Status   string
+	TagID    string
+}
+
+// exportHeader uses the import field names so an export can be imported back
+var exportHeader = []string{
+	FieldPhone, FieldName, FieldStatus, FieldLeadScore, FieldTags, FieldNotes,
+	"customer_jid", "source", "message_count", "last_message_at", "created_at",
+}
+
+type exportRow struct {
+	Phone         string     `db:"phone"`
+	Name          string     `db:"customer_name"`
+	Status        string     `db:"status"`
+	LeadScore     int        `db:"lead_score"`
+	Tags          string     `db:"tags"`
+	Notes         string     `db:"notes"`
+	JID           string     `db:"customer_jid"`
+	Source        string     `db:"source"`
+	MessageCount  int        `db:"message_count"`
+	LastMessageAt *time.Time `db:"last_message_at"`
+	CreatedAt     time.Time  `db:"created_at"`
+	CustomFields  string     `db:"custom_fields"`
+}
+
+// Export writes the customers matching filter as CSV or XLSX with their tags,
+// notes and custom fields (one cf_<key> column per key). It returns the
+// number of customers written.
+func (s *Service) Export(ctx context.Context, w io.Writer, format string, filter ExportFilter) (int, error) {
+	where := ` WHERE ci.tenant_id = $1`
+	args := []interface{}{filter.TenantID}
+	argCount := 1
+
+	if filter.Search != "" {
+		argCount++
+		where += ` AND (ci.customer_name ILIKE $` + strconv.Itoa(argCount) + ` OR ci.customer_phone ILIKE $` + strconv.Itoa(argCount) + ` OR ci.customer_jid ILIKE $` + strconv.Itoa(argCount) + `)`
+		args = append(args, "%"+filter.Search+"%")
+	}
+	if filter.Status != "" && filter.Status != "all" {
+		argCount++
+		where += ` AND ci.status = $` + strconv.Itoa(argCount)
+		args = append(args, filter.Status)
+	}
+	if filter.TagID != "" {
+		argCount++
+		where += ` AND EXISTS (
+			SELECT 1 FROM customer_tag_assignments cta
+			WHERE cta.customer_id = ci.id AND cta.tag_id::text = $` + strconv.Itoa(argCount) + `
+		)`
+		args = append(args, filter.TagID)
+	}
+
+	var customKeys []string
+	err := s.db.SelectContext(ctx, &customKeys, `
+		SELECT DISTINCT jsonb_object_keys(ci.custom_fields) as key
+		FROM customer_insights ci`+where+`
+		ORDER BY key
+	`, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	// Phone prefers the real number of @lid customers from jid_mappings
+	rows, err := s.db.QueryxContext(ctx, `
+		SELECT
+			COALESCE(
+				(SELECT jm.phone_number FROM jid_mappings jm WHERE jm.tenant_id = ci.tenant_id AND jm.lid_jid = ci.customer_jid),
+				ci.customer_phone, split_part(ci.customer_jid, '@', 1)
+			) as phone,
+			COALESCE(ci.customer_name, '') as customer_name,
+			COALESCE(ci.status, 'new') as status,
+			COALESCE(ci.lead_score, 0) as lead_score,
+			COALESCE((
+				SELECT string_agg(t.name, '; ' ORDER BY t.name)
+				FROM customer_tag_assignments cta
+				JOIN customer_tags t ON t.id = cta.tag_id
+				WHERE cta.customer_id = ci.id
+			), '') as tags,
+			COALESCE((
+				SELECT string_agg(n.content, ' | ' ORDER BY n.created_at)
+				FROM customer_notes n
+				WHERE n.customer_id = ci.id
+			), '') as notes,
+			ci.customer_jid,
+			COALESCE(ci.source, 'whatsapp') as source,
+			COALESCE(ci.message_count, 0) as message_count,
+			ci.last_message_at, ci.created_at,
+			COALESCE(ci.custom_fields, '{}'::jsonb)::text as custom_fields
+		FROM customer_insights ci`+where+`
+		ORDER BY ci.created_at ASC
+	`, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	sw, err := spreadsheet.NewWriter(w, format)
+	if err != nil {
+		return 0, err
+	}
+
+	header := append([]string{}, exportHeader...)
+	for _, key := range customKeys {
+		header = append(header, CustomFieldPrefix+key)
+	}
+	if err := sw.Write(header); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for rows.Next() {
+		var r exportRow
+		if err := rows.StructScan(&r); err != nil {
+			return count, err
+		}
+
+		lastMessageAt := ""
+		if r.LastMessageAt != nil {
+			lastMessageAt = r.LastMessageAt.Format(time.RFC3339)
+		}
+		record := []string{
+			r.Phone, r.Name, r.Status, strconv.Itoa(r.LeadScore), r.Tags, r.Notes,
+			r.JID, r.Source, strconv.Itoa(r.MessageCount), lastMessageAt, r.CreatedAt.Format(time.RFC3339),
+		}
+
+		var custom map[string]interface{}
+		json.Unmarshal([]byte(r.CustomFields), &custom)
+		for _, key := range customKeys {
+			record = append(record, customFieldString(custom[key]))
+		}
+
+		if err := sw.Write(record); err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+
+	return count, sw.Close()
+}
+
+// customFieldString formats a custom field value for a spreadsheet cell
+func customFieldString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	data, _ := json.Marshal(value)
+	return string(data)
+}
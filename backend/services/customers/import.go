@@ -0,0 +1,655 @@
+package customers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Fields a spreadsheet column can be mapped to. Columns mapped to
+// CustomFieldPrefix+key are stored in custom_fields[key].
+const (
+	FieldPhone     = "phone"
+	FieldName      = "name"
+	FieldStatus    = "status"
+	FieldLeadScore = "lead_score"
+	FieldTags      = "tags"
+	FieldNotes     = "notes"
+
+	CustomFieldPrefix = "cf_"
+)
+
+// How rows matching an existing customer are handled
+const (
+	DuplicateSkip   = "skip"
+	DuplicateUpdate = "update"
+)
+
+// Row actions reported in the import preview
+const (
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionSkip   = "skip"
+	ActionError  = "error"
+)
+
+const (
+	// MaxImportRows is the largest number of data rows in one import
+	MaxImportRows = 20000
+	// previewLimit is how many parsed rows are returned in the result
+	previewLimit = 50
+	maxTagLength = 50
+)
+
+var (
+	ErrEmptyFile           = errors.New("file has no data rows")
+	ErrTooManyRows         = fmt.Errorf("file has more than %d rows", MaxImportRows)
+	ErrPhoneColumnRequired = errors.New("no phone column found, map one with mapping.phone")
+	ErrUnknownColumn       = errors.New("mapped column not found in header")
+	ErrUnknownField        = errors.New("unknown import field")
+	ErrUnknownTag          = errors.New("tag not found")
+)
+
+// ValidStatuses are the allowed customer_insights.status values
+var ValidStatuses = map[string]bool{
+	"new": true, "hot_lead": true, "warm_lead": true,
+	"cold_lead": true, "customer": true, "complaint": true, "spam": true,
+}
+
+// fieldAliases are header names recognised when no mapping is given
+var fieldAliases = map[string][]string{
+	FieldPhone:     {"phone", "phone number", "customer phone", "customer jid", "jid", "no hp", "nomor hp", "nomor", "no telp", "no telepon", "nomor telepon", "telepon", "hp", "whatsapp", "no wa", "nomor wa", "mobile"},
+	FieldName:      {"name", "customer name", "full name", "nama", "nama lengkap", "nama pelanggan"},
+	FieldStatus:    {"status", "lead status"},
+	FieldLeadScore: {"lead score", "score", "skor"},
+	FieldTags:      {"tags", "tag", "label", "labels"},
+	FieldNotes:     {"notes", "note", "catatan", "keterangan"},
+}
+
+// Service runs bulk customer operations
+type Service struct {
+	db *sqlx.DB
+}
+
+// NewService creates a customer service
+func NewService(db *sqlx.DB) *Service {
+	return &Service{db: db}
+}
+
+// ImportOptions configures an import. Mapping maps a field to a header name;
+// when empty the header is matched against known aliases.
+type ImportOptions struct {
+	TenantID    string
+	UserID      string
+	FileName    string
+	Mapping     map[string]string
+	OnDuplicate string
+	TagIDs      []string
+	DryRun      bool
+}
+
+// ImportRow is one parsed data row and what the import does with it
+type ImportRow struct {
+	Row          int               `json:"row"`
+	Phone        string            `json:"phone"`
+	JID          string            `json:"jid"`
+	Name         string            `json:"name,omitempty"`
+	Status       string            `json:"status,omitempty"`
+	LeadScore    *int              `json:"lead_score,omitempty"`
+	Tags         []string          `json:"tags,omitempty"`
+	Notes        string            `json:"notes,omitempty"`
+	CustomFields map[string]string `json:"custom_fields,omitempty"`
+	Action       string            `json:"action"`
+	ExistingID   string            `json:"existing_id,omitempty"`
+	Error        string            `json:"error,omitempty"`
+}
+
+// ImportError is one line of the error report
+type ImportError struct {
+	Row    int    `json:"row"`
+	Column string `json:"column,omitempty"`
+	Value  string `json:"value,omitempty"`
+	Error  string `json:"error"`
+}
+
+// ImportResult summarises an import or a dry run
+type ImportResult struct {
+	ImportID  string            `json:"import_id,omitempty"`
+	DryRun    bool              `json:"dry_run"`
+	TotalRows int               `json:"total_rows"`
+	Created   int               `json:"created"`
+	Updated   int               `json:"updated"`
+	Skipped   int               `json:"skipped"`
+	Failed    int               `json:"failed"`
+	Mapping   map[string]string `json:"mapping"`
+	NewTags   []string          `json:"new_tags"`
+	Errors    []ImportError     `json:"errors"`
+	Preview   []ImportRow       `json:"preview"`
+}
+
+// Import validates spreadsheet rows (the first row is the header) and, unless
+// DryRun is set, creates or updates the customers. Row numbers in the result
+// match the spreadsheet, so the header is row 1.
+func (s *Service) Import(ctx context.Context, rows [][]string, opts ImportOptions) (*ImportResult, error) {
+	if len(rows) < 2 {
+		return nil, ErrEmptyFile
+	}
+	if len(rows)-1 > MaxImportRows {
+		return nil, ErrTooManyRows
+	}
+	if opts.OnDuplicate != DuplicateUpdate {
+		opts.OnDuplicate = DuplicateSkip
+	}
+
+	columns, mapping, err := resolveColumns(rows[0], opts.Mapping)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.checkTagIDs(ctx, opts.TenantID, opts.TagIDs); err != nil {
+		return nil, err
+	}
+
+	existing, err := s.existingCustomers(ctx, opts.TenantID)
+	if err != nil {
+		return nil, err
+	}
+	tagIDs, err := s.tagIDsByName(ctx, opts.TenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ImportResult{
+		DryRun:  opts.DryRun,
+		Mapping: mapping,
+		NewTags: []string{},
+		Errors:  []ImportError{},
+		Preview: []ImportRow{},
+	}
+
+	seen := make(map[string]int)
+	newTags := make(map[string]bool)
+	var parsed []ImportRow
+
+	for i, values := range rows[1:] {
+		rowNumber := i + 2
+		if isBlankRow(values) {
+			continue
+		}
+		result.TotalRows++
+
+		row, rowErr := parseRow(rowNumber, values, columns)
+		if rowErr != nil {
+			row.Action = ActionError
+			row.Error = rowErr.Error
+			result.Failed++
+			result.Errors = append(result.Errors, *rowErr)
+		} else if first, dup := seen[row.JID]; dup {
+			row.Action = ActionSkip
+			row.Error = fmt.Sprintf("duplicate of row %d", first)
+			result.Skipped++
+			result.Errors = append(result.Errors, ImportError{Row: rowNumber, Column: mapping[FieldPhone], Value: row.Phone, Error: row.Error})
+		} else {
+			seen[row.JID] = rowNumber
+			row.ExistingID = existing.find(row.JID)
+			switch {
+			case row.ExistingID == "":
+				row.Action = ActionCreate
+			case opts.OnDuplicate == DuplicateUpdate:
+				row.Action = ActionUpdate
+			default:
+				row.Action = ActionSkip
+				row.Error = "customer already exists"
+			}
+
+			if row.Action != ActionSkip {
+				for _, tag := range row.Tags {
+					if _, ok := tagIDs[strings.ToLower(tag)]; !ok && !newTags[strings.ToLower(tag)] {
+						newTags[strings.ToLower(tag)] = true
+						result.NewTags = append(result.NewTags, tag)
+					}
+				}
+			}
+		}
+
+		if len(result.Preview) < previewLimit {
+			result.Preview = append(result.Preview, row)
+		}
+		parsed = append(parsed, row)
+	}
+
+	if result.TotalRows == 0 {
+		return nil, ErrEmptyFile
+	}
+
+	if opts.DryRun {
+		for _, row := range parsed {
+			switch row.Action {
+			case ActionCreate:
+				result.Created++
+			case ActionUpdate:
+				result.Updated++
+			case ActionSkip:
+				if row.ExistingID != "" {
+					result.Skipped++
+				}
+			}
+		}
+		return result, nil
+	}
+
+	for _, name := range result.NewTags {
+		id, err := s.createTag(ctx, opts.TenantID, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create tag %q: %w", name, err)
+		}
+		tagIDs[strings.ToLower(name)] = id
+	}
+
+	for _, row := range parsed {
+		switch row.Action {
+		case ActionCreate, ActionUpdate:
+		case ActionSkip:
+			if row.ExistingID != "" {
+				result.Skipped++
+			}
+			continue
+		default:
+			continue
+		}
+
+		rowTagIDs := append([]string{}, opts.TagIDs...)
+		for _, tag := range row.Tags {
+			rowTagIDs = append(rowTagIDs, tagIDs[strings.ToLower(tag)])
+		}
+
+		created, err := s.saveRow(ctx, opts, row, rowTagIDs)
+		if err != nil {
+			result.Failed++
+			result.Errors = append(result.Errors, ImportError{Row: row.Row, Value: row.Phone, Error: "failed to save customer"})
+			continue
+		}
+		if created {
+			result.Created++
+		} else {
+			result.Updated++
+		}
+	}
+
+	importID, err := s.recordImport(ctx, opts, result)
+	if err != nil {
+		return nil, err
+	}
+	result.ImportID = importID
+
+	return result, nil
+}
+
+// resolveColumns maps fields to column indexes, using aliases when no
+// explicit mapping is given. It returns the mapping it used.
+func resolveColumns(header []string, mapping map[string]string) (map[string]int, map[string]string, error) {
+	normalized := make([]string, len(header))
+	for i, h := range header {
+		normalized[i] = normalizeHeader(h)
+	}
+
+	columns := make(map[string]int)
+	used := make(map[string]string)
+
+	if len(mapping) > 0 {
+		for field, name := range mapping {
+			if name == "" {
+				continue
+			}
+			if !isImportField(field) {
+				return nil, nil, fmt.Errorf("%w: %s", ErrUnknownField, field)
+			}
+			idx := indexOf(normalized, normalizeHeader(name))
+			if idx == -1 {
+				return nil, nil, fmt.Errorf("%w: %s", ErrUnknownColumn, name)
+			}
+			columns[field] = idx
+			used[field] = header[idx]
+		}
+	} else {
+		for field, aliases := range fieldAliases {
+			for _, alias := range aliases {
+				if idx := indexOf(normalized, alias); idx != -1 {
+					columns[field] = idx
+					used[field] = header[idx]
+					break
+				}
+			}
+		}
+		for i, h := range header {
+			if key := strings.TrimSpace(h); strings.HasPrefix(strings.ToLower(key), CustomFieldPrefix) && len(key) > len(CustomFieldPrefix) {
+				field := CustomFieldPrefix + key[len(CustomFieldPrefix):]
+				columns[field] = i
+				used[field] = h
+			}
+		}
+	}
+
+	if _, ok := columns[FieldPhone]; !ok {
+		return nil, nil, ErrPhoneColumnRequired
+	}
+	return columns, used, nil
+}
+
+func isImportField(field string) bool {
+	if _, ok := fieldAliases[field]; ok {
+		return true
+	}
+	return strings.HasPrefix(field, CustomFieldPrefix) && len(field) > len(CustomFieldPrefix)
+}
+
+// normalizeHeader lowercases a header and treats _ and - as spaces
+func normalizeHeader(h string) string {
+	h = strings.ToLower(strings.TrimSpace(h))
+	h = strings.NewReplacer("_", " ", "-", " ", ".", "").Replace(h)
+	return strings.Join(strings.Fields(h), " ")
+}
+
+func indexOf(values []string, target string) int {
+	for i, v := range values {
+		if v == target {
+			return i
+		}
+	}
+	return -1
+}
+
+func isBlankRow(values []string) bool {
+	for _, v := range values {
+		if v != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// parseRow validates one data row
+func parseRow(rowNumber int, values []string, columns map[string]int) (ImportRow, *ImportError) {
+	cell := func(field string) string {
+		idx, ok := columns[field]
+		if !ok || idx >= len(values) {
+			return ""
+		}
+		return values[idx]
+	}
+
+	row := ImportRow{Row: rowNumber, Phone: cell(FieldPhone), Name: cell(FieldName), Notes: cell(FieldNotes)}
+
+	if row.Phone == "" {
+		return row, &ImportError{Row: rowNumber, Column: FieldPhone, Error: "phone is required"}
+	}
+	phone, err := NormalizePhone(row.Phone)
+	if err != nil {
+		return row, &ImportError{Row: rowNumber, Column: FieldPhone, Value: row.Phone, Error: err.Error()}
+	}
+	row.Phone = phone
+	row.JID = PhoneToJID(phone)
+
+	if status := cell(FieldStatus); status != "" {
+		status = strings.ReplaceAll(normalizeHeader(status), " ", "_")
+		if !ValidStatuses[status] {
+			return row, &ImportError{Row: rowNumber, Column: FieldStatus, Value: cell(FieldStatus), Error: "invalid status"}
+		}
+		row.Status = status
+	}
+
+	if raw := cell(FieldLeadScore); raw != "" {
+		score, err := strconv.ParseFloat(strings.ReplaceAll(raw, ",", "."), 64)
+		if err != nil || score < 0 || score > 100 {
+			return row, &ImportError{Row: rowNumber, Column: FieldLeadScore, Value: raw, Error: "lead score must be a number between 0 and 100"}
+		}
+		rounded := int(score + 0.5)
+		row.LeadScore = &rounded
+	}
+
+	if raw := cell(FieldTags); raw != "" {
+		for _, tag := range strings.FieldsFunc(raw, func(r rune) bool { return r == ',' || r == ';' || r == '|' }) {
+			tag = strings.TrimSpace(tag)
+			if tag == "" {
+				continue
+			}
+			if len(tag) > maxTagLength {
+				return row, &ImportError{Row: rowNumber, Column: FieldTags, Value: tag, Error: fmt.Sprintf("tag is longer than %d characters", maxTagLength)}
+			}
+			row.Tags = append(row.Tags, tag)
+		}
+	}
+
+	for field := range columns {
+		if !strings.HasPrefix(field, CustomFieldPrefix) {
+			continue
+		}
+		if value := cell(field); value != "" {
+			if row.CustomFields == nil {
+				row.CustomFields = make(map[string]string)
+			}
+			row.CustomFields[strings.TrimPrefix(field, CustomFieldPrefix)] = value
+		}
+	}
+
+	return row, nil
+}
+
+// existingCustomerIndex finds customers by phone JID, including customers
+// only known by their @lid JID
+type existingCustomerIndex struct {
+	byJID      map[string]string
+	lidByPhone map[string]string
+}
+
+func (e existingCustomerIndex) find(jid string) string {
+	if id, ok := e.byJID[jid]; ok {
+		return id
+	}
+	if lid, ok := e.lidByPhone[jid]; ok {
+		return e.byJID[lid]
+	}
+	return ""
+}
+
+func (s *Service) existingCustomers(ctx context.Context, tenantID string) (existingCustomerIndex, error) {
+	index := existingCustomerIndex{byJID: map[string]string{}, lidByPhone: map[string]string{}}
+
+	var customers []struct {
+		ID  string `db:"id"`
+		JID string `db:"customer_jid"`
+	}
+	if err := s.db.SelectContext(ctx, &customers, `SELECT id, customer_jid FROM customer_insights WHERE tenant_id = $1`, tenantID); err != nil {
+		return index, err
+	}
+	for _, c := range customers {
+		index.byJID[c.JID] = c.ID
+	}
+
+	var mappings []struct {
+		LidJID   string `db:"lid_jid"`
+		PhoneJID string `db:"phone_jid"`
+	}
+	if err := s.db.SelectContext(ctx, &mappings, `SELECT lid_jid, phone_jid FROM jid_mappings WHERE tenant_id = $1`, tenantID); err != nil {
+		return index, err
+	}
+	for _, m := range mappings {
+		index.lidByPhone[m.PhoneJID] = m.LidJID
+	}
+
+	return index, nil
+}
+
+// tagIDsByName returns the tenant's tag IDs keyed by lowercase name
+func (s *Service) tagIDsByName(ctx context.Context, tenantID string) (map[string]string, error) {
+	var tags []struct {
+		ID   string `db:"id"`
+		Name string `db:"name"`
+	}
+	if err := s.db.SelectContext(ctx, &tags, `SELECT id, name FROM customer_tags WHERE tenant_id = $1`, tenantID); err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]string, len(tags))
+	for _, t := range tags {
+		ids[strings.ToLower(t.Name)] = t.ID
+	}
+	return ids, nil
+}
+
+// checkTagIDs verifies every tag ID belongs to the tenant
+func (s *Service) checkTagIDs(ctx context.Context, tenantID string, tagIDs []string) error {
+	if len(tagIDs) == 0 {
+		return nil
+	}
+	var count int
+	err := s.db.GetContext(ctx, &count, `
+		SELECT COUNT(*) FROM customer_tags WHERE tenant_id = $1 AND id::text = ANY($2)
+	`, tenantID, pq.Array(tagIDs))
+	if err != nil {
+		return err
+	}
+	if count != len(tagIDs) {
+		return ErrUnknownTag
+	}
+	return nil
+}
+
+func (s *Service) createTag(ctx context.Context, tenantID, name string) (string, error) {
+	var id string
+	err := s.db.GetContext(ctx, &id, `
+		INSERT INTO customer_tags (tenant_id, name)
+		VALUES ($1, $2)
+		ON CONFLICT (tenant_id, name) DO UPDATE SET updated_at = NOW()
+		RETURNING id
+	`, tenantID, name)
+	return id, err
+}
+
+// saveRow creates or updates one customer with its tags and note. It
+// reports whether a new customer was created.
+func (s *Service) saveRow(ctx context.Context, opts ImportOptions, row ImportRow, tagIDs []string) (bool, error) {
+	customFields := row.CustomFields
+	if customFields == nil {
+		customFields = map[string]string{}
+	}
+	customFieldsJSON, _ := json.Marshal(customFields)
+
+	var name *string
+	if row.Name != "" {
+		name = &row.Name
+	}
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	customerID := row.ExistingID
+	created := false
+
+	if customerID == "" {
+		err = tx.GetContext(ctx, &customerID, `
+			INSERT INTO customer_insights (
+				tenant_id, customer_jid, customer_name, customer_phone,
+				status, lead_score, lead_score_locked, custom_fields, source
+			) VALUES ($1, $2, $3, $4, COALESCE(NULLIF($5, ''), 'new'), COALESCE($6, 0), $6::int IS NOT NULL, $7::jsonb, 'import')
+			ON CONFLICT (tenant_id, customer_jid) DO UPDATE SET updated_at = NOW()
+			RETURNING id
+		`, opts.TenantID, row.JID, name, row.Phone, row.Status, row.LeadScore, string(customFieldsJSON))
+		if err != nil {
+			return false, err
+		}
+		created = true
+	} else {
+		_, err = tx.ExecContext(ctx, `
+			UPDATE customer_insights
+			SET customer_name = COALESCE($1, customer_name),
+				status = COALESCE(NULLIF($2, ''), status),
+				lead_score = COALESCE($3, lead_score),
+				lead_score_locked = lead_score_locked OR $3::int IS NOT NULL,
+				custom_fields = COALESCE(custom_fields, '{}'::jsonb) || $4::jsonb,
+				customer_phone = COALESCE(customer_phone, $5),
+				updated_at = NOW()
+			WHERE id = $6 AND tenant_id = $7
+		`, name, row.Status, row.LeadScore, string(customFieldsJSON), row.Phone, customerID, opts.TenantID)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	for _, tagID := range tagIDs {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO customer_tag_assignments (customer_id, tag_id, assigned_by)
+			VALUES ($1, $2, 'import')
+			ON CONFLICT DO NOTHING
+		`, customerID, tagID)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if row.Notes != "" {
+		var createdBy *string
+		if opts.UserID != "" {
+			createdBy = &opts.UserID
+		}
+		// Skip notes that are already there so re-importing an export is harmless
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO customer_notes (customer_id, tenant_id, content, created_by)
+			SELECT $1, $2, $3, $4
+			WHERE NOT EXISTS (SELECT 1 FROM customer_notes WHERE customer_id = $1 AND content = $3)
+		`, customerID, opts.TenantID, row.Notes, createdBy)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return created, tx.Commit()
+}
+
+// recordImport stores the import summary and error report
+func (s *Service) recordImport(ctx context.Context, opts ImportOptions, result *ImportResult) (string, error) {
+	mappingJSON, _ := json.Marshal(result.Mapping)
+	errorsJSON, _ := json.Marshal(result.Errors)
+
+	var importedBy *string
+	if opts.UserID != "" {
+		importedBy = &opts.UserID
+	}
+
+	var id string
+	err := s.db.GetContext(ctx, &id, `
+		INSERT INTO customer_imports (
+			tenant_id, imported_by, file_name, mapping, on_duplicate,
+			total_rows, created_count, updated_count, skipped_count, failed_count, errors
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING id
+	`, opts.TenantID, importedBy, opts.FileName, string(mappingJSON), opts.OnDuplicate,
+		result.TotalRows, result.Created, result.Updated, result.Skipped, result.Failed, string(errorsJSON))
+	return id, err
+}
+
+// ImportErrors returns the error report of a finished import
+func (s *Service) ImportErrors(ctx context.Context, tenantID, importID string) ([]ImportError, error) {
+	var raw string
+	err := s.db.GetContext(ctx, &raw, `
+		SELECT COALESCE(errors, '[]')::text FROM customer_imports WHERE id = $1 AND tenant_id = $2
+	`, importID, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	var report []ImportError
+	if err := json.Unmarshal([]byte(raw), &report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
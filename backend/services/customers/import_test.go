@@ -0,0 +1,156 @@
+package customers
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolveColumns(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  []string
+		mapping map[string]string
+		want    map[string]int
+		used    map[string]string
+		err     error
+	}{
+		{
+			name:   "aliases",
+			header: []string{"Nama Lengkap", "No_HP", "Skor", "Label", "Catatan"},
+			want:   map[string]int{FieldName: 0, FieldPhone: 1, FieldLeadScore: 2, FieldTags: 3, FieldNotes: 4},
+			used:   map[string]string{FieldName: "Nama Lengkap", FieldPhone: "No_HP", FieldLeadScore: "Skor", FieldTags: "Label", FieldNotes: "Catatan"},
+		},
+		{
+			name:   "custom field columns",
+			header: []string{"WhatsApp", "cf_city", "CF_Tier", "cf_"},
+			want:   map[string]int{FieldPhone: 0, "cf_city": 1, "cf_Tier": 2},
+			used:   map[string]string{FieldPhone: "WhatsApp", "cf_city": "cf_city", "cf_Tier": "CF_Tier"},
+		},
+		{
+			name:    "explicit mapping",
+			header:  []string{"Kontak", "Nama", "Kota"},
+			mapping: map[string]string{FieldPhone: "kontak", "cf_city": "Kota", FieldName: ""},
+			want:    map[string]int{FieldPhone: 0, "cf_city": 2},
+			used:    map[string]string{FieldPhone: "Kontak", "cf_city": "Kota"},
+		},
+		{
+			name:   "no phone column",
+			header: []string{"Nama", "Kota"},
+			err:    ErrPhoneColumnRequired,
+		},
+		{
+			name:    "mapped column missing",
+			header:  []string{"Phone"},
+			mapping: map[string]string{FieldPhone: "Telepon"},
+			err:     ErrUnknownColumn,
+		},
+		{
+			name:    "unknown field",
+			header:  []string{"Phone"},
+			mapping: map[string]string{FieldPhone: "Phone", "email": "Phone"},
+			err:     ErrUnknownField,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			columns, used, err := resolveColumns(tt.header, tt.mapping)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("resolveColumns() error = %v, want %v", err, tt.err)
+			}
+			if tt.err != nil {
+				return
+			}
+			if !reflect.DeepEqual(columns, tt.want) {
+				t.Errorf("resolveColumns() columns = %v, want %v", columns, tt.want)
+			}
+			if !reflect.DeepEqual(used, tt.used) {
+				t.Errorf("resolveColumns() mapping = %v, want %v", used, tt.used)
+			}
+		})
+	}
+}
+
+func TestParseRow(t *testing.T) {
+	columns := map[string]int{
+		FieldPhone:     0,
+		FieldName:      1,
+		FieldStatus:    2,
+		FieldLeadScore: 3,
+		FieldTags:      4,
+		"cf_city":      5,
+	}
+	score := func(n int) *int { return &n }
+
+	tests := []struct {
+		name   string
+		values []string
+		want   ImportRow
+		column string
+	}{
+		{
+			name:   "full row",
+			values: []string{"0812-3456-789", "Budi", "Hot Lead", "72,6", "vip; reseller | , jakarta", "Bandung"},
+			want: ImportRow{
+				Row: 2, Phone: "628123456789", JID: "628123456789@s.whatsapp.net", Name: "Budi",
+				Status: "hot_lead", LeadScore: score(73), Tags: []string{"vip", "reseller", "jakarta"},
+				CustomFields: map[string]string{"city": "Bandung"},
+			},
+		},
+		{
+			name:   "short row",
+			values: []string{"628123456789"},
+			want:   ImportRow{Row: 2, Phone: "628123456789", JID: "628123456789@s.whatsapp.net"},
+		},
+		{
+			name:   "missing phone",
+			values: []string{"", "Budi"},
+			column: FieldPhone,
+		},
+		{
+			name:   "invalid phone",
+			values: []string{"0812-CALL-ME"},
+			column: FieldPhone,
+		},
+		{
+			name:   "unknown status",
+			values: []string{"08123456789", "", "maybe"},
+			column: FieldStatus,
+		},
+		{
+			name:   "lead score out of range",
+			values: []string{"08123456789", "", "", "101"},
+			column: FieldLeadScore,
+		},
+		{
+			name:   "lead score not a number",
+			values: []string{"08123456789", "", "", "high"},
+			column: FieldLeadScore,
+		},
+		{
+			name:   "tag too long",
+			values: []string{"08123456789", "", "", "", "vip, " + strings.Repeat("x", maxTagLength+1)},
+			column: FieldTags,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			row, importErr := parseRow(2, tt.values, columns)
+			if tt.column != "" {
+				if importErr == nil || importErr.Column != tt.column || importErr.Row != 2 {
+					t.Fatalf("parseRow() error = %+v, want one for column %s", importErr, tt.column)
+				}
+				return
+			}
+			if importErr != nil {
+				t.Fatalf("parseRow() error = %+v", importErr)
+			}
+			if !reflect.DeepEqual(row, tt.want) {
+				t.Errorf("parseRow() = %+v, want %+v", row, tt.want)
+			}
+		})
+	}
+}
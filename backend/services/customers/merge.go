@@ -0,0 +1,676 @@
+package customers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gowa-backend/services/followup"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// UndoWindow is how long a merge can be undone
+const UndoWindow = 7 * 24 * time.Hour
+
+var (
+	ErrSameCustomer     = errors.New("a customer cannot be merged into itself")
+	ErrCustomerNotFound = errors.New("customer not found")
+	ErrGroupMerge       = errors.New("group chats cannot be merged")
+	ErrMergeNotFound    = errors.New("merge not found")
+	ErrMergeUndone      = errors.New("merge was already undone")
+	ErrUndoExpired      = errors.New("the undo window of this merge has passed")
+	ErrSurvivorGone     = errors.New("the surviving customer was deleted or merged again, undo the later merge first")
+	ErrJIDInUse         = errors.New("another customer now uses the merged JID")
+)
+
+// MergeMoves records which rows a merge moved to the survivor, so undo can
+// move exactly those back
+type MergeMoves struct {
+	ChatMessages        []string        `json:"chat_messages"`
+	SenderMessages      []string        `json:"sender_messages"`
+	Notes               []string        `json:"notes"`
+	Tags                []string        `json:"tags"` // tag IDs the survivor didn't have yet
+	TagAssignments      []TagAssignment `json:"tag_assignments"`
+	BroadcastRecipients []string        `json:"broadcast_recipients"`
+	AILogs              []string        `json:"ai_logs"`
+	LeadScoreHistory    []string        `json:"lead_score_history"`
+	InsightRuns         []string        `json:"insight_runs"`
+	ScheduledMessages   []string        `json:"scheduled_messages"`
+	SequenceEnrollments []string        `json:"sequence_enrollments"`
+	FollowUpTasks       []string        `json:"follow_up_tasks"`
+
+	// EndedEnrollments are the merged customer's active enrollments that were
+	// cancelled because the survivor was enrolled in the same sequence
+	EndedEnrollments []EndedEnrollment `json:"ended_enrollments"`
+
+	// ConversationID is set when the merged customer's conversation was
+	// moved; Conversation holds it when it was removed because the survivor
+	// already had one
+	ConversationID string          `json:"conversation_id,omitempty"`
+	Conversation   json.RawMessage `json:"conversation,omitempty"`
+}
+
+// TagAssignment is a tag of the merged customer
+type TagAssignment struct {
+	TagID      string    `json:"tag_id" db:"tag_id"`
+	AssignedAt time.Time `json:"assigned_at" db:"assigned_at"`
+	AssignedBy string    `json:"assigned_by" db:"assigned_by"`
+}
+
+// EndedEnrollment is an active enrollment the merge cancelled
+type EndedEnrollment struct {
+	ID         string     `json:"id" db:"id"`
+	NextStepAt *time.Time `json:"next_step_at" db:"next_step_at"`
+}
+
+// Counts summarises the moves for the API
+func (m MergeMoves) Counts() map[string]int {
+	conversation := 0
+	if m.ConversationID != "" || len(m.Conversation) > 0 {
+		conversation = 1
+	}
+	return map[string]int{
+		"messages":             len(m.ChatMessages),
+		"notes":                len(m.Notes),
+		"tags":                 len(m.Tags),
+		"broadcast_recipients": len(m.BroadcastRecipients),
+		"ai_logs":              len(m.AILogs),
+		"lead_score_history":   len(m.LeadScoreHistory),
+		"insight_runs":         len(m.InsightRuns),
+		"scheduled_messages":   len(m.ScheduledMessages),
+		"sequence_enrollments": len(m.SequenceEnrollments),
+		"follow_up_tasks":      len(m.FollowUpTasks),
+		"conversation":         conversation,
+	}
+}
+
+// Merge is an audit record of a merge
+type Merge struct {
+	ID          string         `json:"id" db:"id"`
+	SurvivorID  string         `json:"survivor_id" db:"survivor_id"`
+	MergedID    string         `json:"merged_id" db:"merged_id"`
+	MergedJID   string         `json:"merged_jid" db:"merged_jid"`
+	MergedName  *string        `json:"merged_name" db:"merged_name"`
+	Reasons     pq.StringArray `json:"reasons" db:"reasons"`
+	MovedJSON   string         `json:"-" db:"moved"`
+	Moved       map[string]int `json:"moved" db:"-"`
+	MergedBy    *string        `json:"merged_by" db:"merged_by"`
+	CreatedAt   time.Time      `json:"created_at" db:"created_at"`
+	UndoUntil   time.Time      `json:"undo_until" db:"undo_until"`
+	UndoneAt    *time.Time     `json:"undone_at" db:"undone_at"`
+	UndoneBy    *string        `json:"undone_by" db:"undone_by"`
+	CanUndo     bool           `json:"can_undo" db:"-"`
+	mergedMoves MergeMoves
+}
+
+const mergeColumns = `id, survivor_id, merged_id, merged_jid, merged_snapshot->>'customer_name' as merged_name,
+	reasons, moved::text as moved, merged_by, created_at, undo_until, undone_at, undone_by`
+
+// decode fills the fields derived from the stored moves
+func (m *Merge) decode() error {
+	if err := json.Unmarshal([]byte(m.MovedJSON), &m.mergedMoves); err != nil {
+		return err
+	}
+	m.Moved = m.mergedMoves.Counts()
+	m.CanUndo = m.UndoneAt == nil && time.Now().Before(m.UndoUntil)
+	return nil
+}
+
+// mergeCustomer is the part of a customer row the merge works with
+type mergeCustomer struct {
+	DuplicateCustomer
+	Snapshot string `db:"snapshot"`
+}
+
+// MergeCustomers merges mergedID into survivorID. The merged customer's
+// messages, notes, tags, broadcast recipients, AI logs, score history,
+// sequence enrollments, follow-up tasks and conversation move to the survivor, empty survivor fields are filled from
+// it, and the merged record is removed. New messages from the merged JID
+// are attributed to the survivor until the merge is undone.
+func (s *Service) MergeCustomers(ctx context.Context, tenantID, userID, survivorID, mergedID string) (*Merge, error) {
+	if survivorID == mergedID {
+		return nil, ErrSameCustomer
+	}
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var rows []mergeCustomer
+	err = tx.SelectContext(ctx, &rows, `
+		SELECT ci.id, ci.customer_jid, to_jsonb(ci)::text as snapshot,
+			ci.customer_name, ci.customer_phone, COALESCE(ci.message_count, 0) as message_count,
+			ci.last_message_at, ci.created_at
+		FROM customer_insights ci
+		WHERE ci.tenant_id = $1 AND ci.id::text = ANY($2)
+		FOR UPDATE
+	`, tenantID, pq.Array([]string{survivorID, mergedID}))
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) != 2 {
+		return nil, ErrCustomerNotFound
+	}
+	survivor, merged := rows[0], rows[1]
+	if survivor.ID != survivorID {
+		survivor, merged = merged, survivor
+	}
+	if strings.HasSuffix(survivor.CustomerJID, "@g.us") || strings.HasSuffix(merged.CustomerJID, "@g.us") {
+		return nil, ErrGroupMerge
+	}
+
+	mappings, err := s.jidMappings(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	reasons := matchReasons(survivor.DuplicateCustomer, merged.DuplicateCustomer, mappings)
+
+	moves, err := moveCustomerRows(ctx, tx, tenantID, survivor.ID, survivor.CustomerJID, merged.ID, merged.CustomerJID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fill what the survivor is missing; counts add up and opt-outs carry over
+	_, err = tx.ExecContext(ctx, `
+		UPDATE customer_insights s SET
+			customer_name = COALESCE(NULLIF(s.customer_name, ''), m.customer_name),
+			customer_phone = COALESCE(NULLIF(s.customer_phone, ''), m.customer_phone),
+			message_count = COALESCE(s.message_count, 0) + COALESCE(m.message_count, 0),
+			total_messages = COALESCE(s.total_messages, 0) + COALESCE(m.total_messages, 0),
+			purchase_count = s.purchase_count + m.purchase_count,
+			first_message_at = LEAST(s.first_message_at, m.first_message_at),
+			last_message_at = GREATEST(s.last_message_at, m.last_message_at),
+			custom_fields = COALESCE(m.custom_fields, '{}'::jsonb) || COALESCE(s.custom_fields, '{}'::jsonb),
+			ai_facts = COALESCE(m.ai_facts, '{}'::jsonb) || COALESCE(s.ai_facts, '{}'::jsonb),
+			opted_out = s.opted_out OR m.opted_out,
+			opted_out_at = COALESCE(s.opted_out_at, m.opted_out_at),
+			insights_opted_out = s.insights_opted_out OR m.insights_opted_out,
+			updated_at = NOW()
+		FROM customer_insights m
+		WHERE s.id = $1 AND m.id = $2
+	`, survivor.ID, merged.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update survivor: %w", err)
+	}
+	if err := followup.SyncCustomers(ctx, tx, survivor.ID); err != nil {
+		return nil, fmt.Errorf("failed to update follow-up state: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM customer_insights WHERE id = $1`, merged.ID); err != nil {
+		return nil, fmt.Errorf("failed to remove merged customer: %w", err)
+	}
+
+	movesJSON, _ := json.Marshal(moves)
+	var mergeID string
+	err = tx.GetContext(ctx, &mergeID, `
+		INSERT INTO customer_merges (tenant_id, survivor_id, merged_id, merged_jid, reasons,
+			merged_snapshot, survivor_snapshot, moved, merged_by, undo_until)
+		VALUES ($1, $2, $3, $4, $5, $6::jsonb, $7::jsonb, $8::jsonb, $9, NOW() + make_interval(secs => $10))
+		RETURNING id
+	`, tenantID, survivor.ID, merged.ID, merged.CustomerJID, pq.Array(reasons),
+		merged.Snapshot, survivor.Snapshot, string(movesJSON), nullIfEmpty(userID), UndoWindow.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to record merge: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return s.GetMerge(ctx, tenantID, mergeID)
+}
+
+// moveCustomerRows moves everything that belongs to the merged customer to
+// the survivor and returns what was moved
+func moveCustomerRows(ctx context.Context, tx *sqlx.Tx, tenantID, survivorID, survivorJID, mergedID, mergedJID string) (*MergeMoves, error) {
+	moves := &MergeMoves{}
+
+	// A customer is enrolled in a sequence at most once at a time; where both
+	// are, the survivor's enrollment goes on and the merged one is cancelled
+	moves.EndedEnrollments = []EndedEnrollment{}
+	err := tx.SelectContext(ctx, &moves.EndedEnrollments, `
+		UPDATE sequence_enrollments e SET status = 'cancelled', exit_reason = 'merged', next_step_at = NULL, ended_at = NOW()
+		FROM sequence_enrollments old
+		WHERE old.id = e.id AND e.customer_id = $1 AND e.status = 'active'
+		  AND EXISTS (
+			SELECT 1 FROM sequence_enrollments s
+			WHERE s.customer_id = $2 AND s.sequence_id = e.sequence_id AND s.status = 'active'
+		  )
+		RETURNING e.id, old.next_step_at
+	`, mergedID, survivorID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to end sequence enrollments: %w", err)
+	}
+
+	steps := []struct {
+		name  string
+		dest  *[]string
+		query string
+		args  []interface{}
+	}{
+		{"messages", &moves.ChatMessages,
+			`UPDATE whatsapp_messages SET chat_jid = $1 WHERE tenant_id = $2 AND chat_jid = $3 RETURNING id`,
+			[]interface{}{survivorJID, tenantID, mergedJID}},
+		{"messages", &moves.SenderMessages,
+			`UPDATE whatsapp_messages SET sender_jid = $1 WHERE tenant_id = $2 AND sender_jid = $3 RETURNING id`,
+			[]interface{}{survivorJID, tenantID, mergedJID}},
+		{"notes", &moves.Notes,
+			`UPDATE customer_notes SET customer_id = $1 WHERE customer_id = $2 RETURNING id`,
+			[]interface{}{survivorID, mergedID}},
+		{"broadcast recipients", &moves.BroadcastRecipients,
+			`UPDATE broadcast_recipients SET customer_id = $1, customer_jid = $2 WHERE customer_id = $3 RETURNING id`,
+			[]interface{}{survivorID, survivorJID, mergedID}},
+		{"AI logs", &moves.AILogs,
+			`UPDATE ai_conversation_logs SET customer_id = $1, customer_jid = $2
+			 WHERE tenant_id = $3 AND (customer_id = $4 OR customer_jid = $5) RETURNING id`,
+			[]interface{}{survivorID, survivorJID, tenantID, mergedID, mergedJID}},
+		{"lead score history", &moves.LeadScoreHistory,
+			`UPDATE lead_score_history SET customer_id = $1 WHERE customer_id = $2 RETURNING id`,
+			[]interface{}{survivorID, mergedID}},
+		{"insight runs", &moves.InsightRuns,
+			`UPDATE customer_insight_runs SET customer_id = $1 WHERE customer_id = $2 RETURNING id`,
+			[]interface{}{survivorID, mergedID}},
+		{"scheduled messages", &moves.ScheduledMessages,
+			`UPDATE scheduled_messages SET insight_id = $1,
+				recipient_jid = CASE WHEN recipient_jid = $2 THEN $3 ELSE recipient_jid END
+			 WHERE tenant_id = $4 AND (insight_id = $5 OR (recipient_jid = $2 AND status = 'pending')) RETURNING id`,
+			[]interface{}{survivorID, mergedJID, survivorJID, tenantID, mergedID}},
+		{"sequence enrollments", &moves.SequenceEnrollments,
+			`UPDATE sequence_enrollments SET customer_id = $1, customer_jid = $2 WHERE customer_id = $3 RETURNING id`,
+			[]interface{}{survivorID, survivorJID, mergedID}},
+		{"follow-up tasks", &moves.FollowUpTasks,
+			`UPDATE follow_up_tasks SET customer_id = $1, updated_at = NOW() WHERE customer_id = $2 RETURNING id`,
+			[]interface{}{survivorID, mergedID}},
+	}
+	for _, step := range steps {
+		*step.dest = []string{}
+		if err := tx.SelectContext(ctx, step.dest, step.query, step.args...); err != nil {
+			return nil, fmt.Errorf("failed to move %s: %w", step.name, err)
+		}
+	}
+
+	moves.TagAssignments = []TagAssignment{}
+	err = tx.SelectContext(ctx, &moves.TagAssignments, `
+		SELECT tag_id, COALESCE(assigned_at, NOW()) as assigned_at, COALESCE(assigned_by, 'manual') as assigned_by
+		FROM customer_tag_assignments WHERE customer_id = $1
+	`, mergedID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tags: %w", err)
+	}
+	moves.Tags = []string{}
+	err = tx.SelectContext(ctx, &moves.Tags, `
+		INSERT INTO customer_tag_assignments (customer_id, tag_id, assigned_at, assigned_by)
+		SELECT $1, tag_id, assigned_at, assigned_by FROM customer_tag_assignments WHERE customer_id = $2
+		ON CONFLICT (customer_id, tag_id) DO NOTHING
+		RETURNING tag_id
+	`, survivorID, mergedID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to move tags: %w", err)
+	}
+
+	if err := moveConversation(ctx, tx, tenantID, survivorID, survivorJID, mergedJID, moves); err != nil {
+		return nil, err
+	}
+	return moves, nil
+}
+
+// moveConversation hands the merged customer's conversation to the survivor,
+// or removes it when the survivor has one, keeping the newer last message
+func moveConversation(ctx context.Context, tx *sqlx.Tx, tenantID, survivorID, survivorJID, mergedJID string, moves *MergeMoves) error {
+	var conv struct {
+		ID       string `db:"id"`
+		Snapshot string `db:"snapshot"`
+	}
+	err := tx.GetContext(ctx, &conv, `
+		SELECT id, to_jsonb(conv)::text as snapshot FROM conversations conv
+		WHERE tenant_id = $1 AND customer_jid = $2
+		FOR UPDATE
+	`, tenantID, mergedJID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read conversation: %w", err)
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		UPDATE conversations s SET
+			last_message_id = m.last_message_id,
+			last_message_text = m.last_message_text,
+			last_message_type = m.last_message_type,
+			last_message_from_me = m.last_message_from_me,
+			last_message_at = m.last_message_at,
+			updated_at = NOW()
+		FROM conversations m
+		WHERE s.tenant_id = $1 AND s.customer_jid = $2 AND m.id = $3
+		  AND m.last_message_at > COALESCE(s.last_message_at, '-infinity')
+	`, tenantID, survivorJID, conv.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update conversation: %w", err)
+	}
+
+	var survivorHasConversation bool
+	if affected, _ := result.RowsAffected(); affected > 0 {
+		survivorHasConversation = true
+	} else {
+		err = tx.GetContext(ctx, &survivorHasConversation, `
+			SELECT EXISTS (SELECT 1 FROM conversations WHERE tenant_id = $1 AND customer_jid = $2)
+		`, tenantID, survivorJID)
+		if err != nil {
+			return err
+		}
+	}
+
+	if survivorHasConversation {
+		moves.Conversation = json.RawMessage(conv.Snapshot)
+		_, err = tx.ExecContext(ctx, `DELETE FROM conversations WHERE id = $1`, conv.ID)
+	} else {
+		moves.ConversationID = conv.ID
+		_, err = tx.ExecContext(ctx, `
+			UPDATE conversations SET customer_id = $1, customer_jid = $2, updated_at = NOW() WHERE id = $3
+		`, survivorID, survivorJID, conv.ID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to move conversation: %w", err)
+	}
+	return nil
+}
+
+// UndoMerge restores the merged customer with its original ID and moves the
+// rows recorded by the merge back. Messages received after the merge stay
+// with the survivor, and opt-outs are kept.
+func (s *Service) UndoMerge(ctx context.Context, tenantID, userID, mergeID string) (*Merge, error) {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var m struct {
+		Merge
+		MergedSnapshot   string `db:"merged_snapshot"`
+		SurvivorSnapshot string `db:"survivor_snapshot"`
+	}
+	err = tx.GetContext(ctx, &m, `
+		SELECT `+mergeColumns+`, merged_snapshot::text as merged_snapshot, survivor_snapshot::text as survivor_snapshot
+		FROM customer_merges
+		WHERE id = $1 AND tenant_id = $2
+		FOR UPDATE
+	`, mergeID, tenantID)
+	if err == sql.ErrNoRows {
+		return nil, ErrMergeNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := m.decode(); err != nil {
+		return nil, err
+	}
+	switch {
+	case m.UndoneAt != nil:
+		return nil, ErrMergeUndone
+	case !m.CanUndo:
+		return nil, ErrUndoExpired
+	}
+
+	var survivorJID string
+	err = tx.GetContext(ctx, &survivorJID, `
+		SELECT customer_jid FROM customer_insights WHERE id = $1 AND tenant_id = $2 FOR UPDATE
+	`, m.SurvivorID, tenantID)
+	if err == sql.ErrNoRows {
+		return nil, ErrSurvivorGone
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var inUse bool
+	err = tx.GetContext(ctx, &inUse, `
+		SELECT EXISTS (SELECT 1 FROM customer_insights WHERE tenant_id = $1 AND customer_jid = $2)
+	`, tenantID, m.MergedJID)
+	if err != nil {
+		return nil, err
+	}
+	if inUse {
+		return nil, ErrJIDInUse
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO customer_insights SELECT * FROM jsonb_populate_record(NULL::customer_insights, $1::jsonb)
+	`, m.MergedSnapshot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore customer: %w", err)
+	}
+
+	// Take back what the merge added to the survivor, unless it was changed since
+	_, err = tx.ExecContext(ctx, `
+		UPDATE customer_insights ci SET
+			customer_name = CASE WHEN ci.customer_name IS NOT DISTINCT FROM $3::jsonb->>'customer_name'
+				THEN $2::jsonb->>'customer_name' ELSE ci.customer_name END,
+			customer_phone = CASE WHEN ci.customer_phone IS NOT DISTINCT FROM $3::jsonb->>'customer_phone'
+				THEN $2::jsonb->>'customer_phone' ELSE ci.customer_phone END,
+			message_count = GREATEST(COALESCE(ci.message_count, 0) - COALESCE(($3::jsonb->>'message_count')::int, 0), 0),
+			total_messages = GREATEST(COALESCE(ci.total_messages, 0) - COALESCE(($3::jsonb->>'total_messages')::int, 0), 0),
+			purchase_count = GREATEST(ci.purchase_count - COALESCE(($3::jsonb->>'purchase_count')::int, 0), 0),
+			custom_fields = ci.custom_fields - ARRAY(
+				SELECT f.key FROM jsonb_each(COALESCE($3::jsonb->'custom_fields', '{}'::jsonb)) f
+				WHERE NOT COALESCE($2::jsonb->'custom_fields', '{}'::jsonb) ? f.key AND ci.custom_fields->f.key = f.value),
+			ai_facts = ci.ai_facts - ARRAY(
+				SELECT f.key FROM jsonb_each(COALESCE($3::jsonb->'ai_facts', '{}'::jsonb)) f
+				WHERE NOT COALESCE($2::jsonb->'ai_facts', '{}'::jsonb) ? f.key AND ci.ai_facts->f.key = f.value),
+			updated_at = NOW()
+		WHERE ci.id = $1
+	`, m.SurvivorID, m.SurvivorSnapshot, m.MergedSnapshot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update survivor: %w", err)
+	}
+
+	if err := restoreCustomerRows(ctx, tx, tenantID, m.SurvivorID, survivorJID, m.MergedID, m.MergedJID, &m.mergedMoves); err != nil {
+		return nil, err
+	}
+	if err := followup.SyncCustomers(ctx, tx, m.SurvivorID, m.MergedID); err != nil {
+		return nil, fmt.Errorf("failed to update follow-up state: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE customer_merges SET undone_at = NOW(), undone_by = $1 WHERE id = $2
+	`, nullIfEmpty(userID), mergeID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return s.GetMerge(ctx, tenantID, mergeID)
+}
+
+// restoreCustomerRows moves the rows recorded in moves back to the restored
+// customer
+func restoreCustomerRows(ctx context.Context, tx *sqlx.Tx, tenantID, survivorID, survivorJID, mergedID, mergedJID string, moves *MergeMoves) error {
+	steps := []struct {
+		name  string
+		ids   []string
+		query string
+		args  []interface{}
+	}{
+		{"messages", moves.ChatMessages,
+			`UPDATE whatsapp_messages SET chat_jid = $2 WHERE tenant_id = $3 AND id = ANY($1::uuid[])`,
+			[]interface{}{mergedJID, tenantID}},
+		{"messages", moves.SenderMessages,
+			`UPDATE whatsapp_messages SET sender_jid = $2 WHERE tenant_id = $3 AND id = ANY($1::uuid[])`,
+			[]interface{}{mergedJID, tenantID}},
+		{"notes", moves.Notes,
+			`UPDATE customer_notes SET customer_id = $2 WHERE customer_id = $3 AND id = ANY($1::uuid[])`,
+			[]interface{}{mergedID, survivorID}},
+		{"broadcast recipients", moves.BroadcastRecipients,
+			`UPDATE broadcast_recipients SET customer_id = $2, customer_jid = $3 WHERE customer_id = $4 AND id = ANY($1::uuid[])`,
+			[]interface{}{mergedID, mergedJID, survivorID}},
+		{"AI logs", moves.AILogs,
+			`UPDATE ai_conversation_logs SET customer_id = $2, customer_jid = $3 WHERE tenant_id = $4 AND id = ANY($1::uuid[])`,
+			[]interface{}{mergedID, mergedJID, tenantID}},
+		{"lead score history", moves.LeadScoreHistory,
+			`UPDATE lead_score_history SET customer_id = $2 WHERE customer_id = $3 AND id = ANY($1::uuid[])`,
+			[]interface{}{mergedID, survivorID}},
+		{"insight runs", moves.InsightRuns,
+			`UPDATE customer_insight_runs SET customer_id = $2 WHERE customer_id = $3 AND id = ANY($1::uuid[])`,
+			[]interface{}{mergedID, survivorID}},
+		{"scheduled messages", moves.ScheduledMessages,
+			`UPDATE scheduled_messages SET insight_id = $2,
+				recipient_jid = CASE WHEN recipient_jid = $3 THEN $4 ELSE recipient_jid END
+			 WHERE tenant_id = $5 AND id = ANY($1::uuid[])`,
+			[]interface{}{mergedID, survivorJID, mergedJID, tenantID}},
+		{"sequence enrollments", moves.SequenceEnrollments,
+			`UPDATE sequence_enrollments SET customer_id = $2, customer_jid = $3 WHERE customer_id = $4 AND id = ANY($1::uuid[])`,
+			[]interface{}{mergedID, mergedJID, survivorID}},
+		{"follow-up tasks", moves.FollowUpTasks,
+			`UPDATE follow_up_tasks SET customer_id = $2, updated_at = NOW() WHERE customer_id = $3 AND id = ANY($1::uuid[])`,
+			[]interface{}{mergedID, survivorID}},
+	}
+	for _, step := range steps {
+		if len(step.ids) == 0 {
+			continue
+		}
+		args := append([]interface{}{pq.Array(step.ids)}, step.args...)
+		if _, err := tx.ExecContext(ctx, step.query, args...); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", step.name, err)
+		}
+	}
+
+	for _, e := range moves.EndedEnrollments {
+		// Enrollments ended for another reason since the merge stay ended
+		_, err := tx.ExecContext(ctx, `
+			UPDATE sequence_enrollments SET status = 'active', exit_reason = NULL, next_step_at = $2, ended_at = NULL
+			WHERE id = $1 AND customer_id = $3 AND status = 'cancelled' AND exit_reason = 'merged'
+		`, e.ID, e.NextStepAt, mergedID)
+		if err != nil {
+			return fmt.Errorf("failed to restore sequence enrollments: %w", err)
+		}
+	}
+
+	if len(moves.Tags) > 0 {
+		_, err := tx.ExecContext(ctx, `
+			DELETE FROM customer_tag_assignments WHERE customer_id = $1 AND tag_id = ANY($2::uuid[])
+		`, survivorID, pq.Array(moves.Tags))
+		if err != nil {
+			return fmt.Errorf("failed to restore tags: %w", err)
+		}
+	}
+	for _, a := range moves.TagAssignments {
+		// Tags deleted since the merge are skipped
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO customer_tag_assignments (customer_id, tag_id, assigned_at, assigned_by)
+			SELECT $1, id, $3, $4 FROM customer_tags WHERE id = $2
+			ON CONFLICT (customer_id, tag_id) DO NOTHING
+		`, mergedID, a.TagID, a.AssignedAt, a.AssignedBy)
+		if err != nil {
+			return fmt.Errorf("failed to restore tags: %w", err)
+		}
+	}
+
+	var err error
+	switch {
+	case moves.ConversationID != "":
+		_, err = tx.ExecContext(ctx, `
+			UPDATE conversations SET customer_id = $1, customer_jid = $2, updated_at = NOW() WHERE id = $3
+		`, mergedID, mergedJID, moves.ConversationID)
+	case len(moves.Conversation) > 0:
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO conversations SELECT * FROM jsonb_populate_record(NULL::conversations, $1::jsonb)
+			ON CONFLICT DO NOTHING
+		`, string(moves.Conversation))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to restore conversation: %w", err)
+	}
+	return nil
+}
+
+// GetMerge returns a merge of the tenant
+func (s *Service) GetMerge(ctx context.Context, tenantID, mergeID string) (*Merge, error) {
+	var m Merge
+	err := s.db.GetContext(ctx, &m, `
+		SELECT `+mergeColumns+` FROM customer_merges WHERE id = $1 AND tenant_id = $2
+	`, mergeID, tenantID)
+	if err == sql.ErrNoRows {
+		return nil, ErrMergeNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, m.decode()
+}
+
+// ListMerges returns the tenant's merges, newest first. customerID limits
+// them to merges into or of that customer.
+func (s *Service) ListMerges(ctx context.Context, tenantID, customerID string, limit, offset int) ([]Merge, int, error) {
+	where := `tenant_id = $1`
+	args := []interface{}{tenantID}
+	if customerID != "" {
+		where += ` AND (survivor_id::text = $2 OR merged_id::text = $2)`
+		args = append(args, customerID)
+	}
+
+	var total int
+	if err := s.db.GetContext(ctx, &total, `SELECT COUNT(*) FROM customer_merges WHERE `+where, args...); err != nil {
+		return nil, 0, err
+	}
+
+	merges := []Merge{}
+	err := s.db.SelectContext(ctx, &merges, fmt.Sprintf(`
+		SELECT `+mergeColumns+` FROM customer_merges WHERE `+where+`
+		ORDER BY created_at DESC LIMIT $%d OFFSET $%d
+	`, len(args)+1, len(args)+2), append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range merges {
+		if err := merges[i].decode(); err != nil {
+			return nil, 0, err
+		}
+	}
+	return merges, total, nil
+}
+
+// rowQueryer is satisfied by *sql.DB, *sqlx.DB and transactions
+type rowQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// MergedJID returns the JID of the customer jid was merged into, following
+// chains of merges, or "" when jid isn't merged
+func MergedJID(ctx context.Context, db rowQueryer, tenantID, jid string) string {
+	var survivorJID string
+	err := db.QueryRowContext(ctx, `
+		WITH RECURSIVE chain AS (
+			SELECT survivor_id, 1 AS depth FROM customer_merges
+			WHERE tenant_id = $1 AND merged_jid = $2 AND undone_at IS NULL
+			UNION ALL
+			SELECT m.survivor_id, chain.depth + 1 FROM customer_merges m
+			JOIN chain ON m.merged_id = chain.survivor_id
+			WHERE m.tenant_id = $1 AND m.undone_at IS NULL AND chain.depth < 10
+		)
+		SELECT ci.customer_jid FROM chain
+		JOIN customer_insights ci ON ci.id = chain.survivor_id
+		ORDER BY chain.depth DESC
+		LIMIT 1
+	`, tenantID, jid).Scan(&survivorJID)
+	if err != nil {
+		return ""
+	}
+	return survivorJID
+}
+
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
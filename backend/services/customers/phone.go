@@ -0,0 +1,70 @@
+// Package customers holds bulk operations on customer records such as
+// spreadsheet import and export.
+package customers
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrInvalidPhone is returned for values that cannot be turned into a WhatsApp number
+var ErrInvalidPhone = errors.New("invalid phone number")
+
+// NormalizePhone converts the ways Indonesian numbers are usually written
+// (0812-3456-789, +62 812 3456 789, 62812..., 812...) to the international
+// digits WhatsApp uses (62812...). Numbers written with another country code
+// after "+" or "00" are kept as they are.
+func NormalizePhone(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if at := strings.Index(raw, "@"); at != -1 {
+		raw = raw[:at]
+	}
+	// Device suffix of a JID (62812:12)
+	if colon := strings.Index(raw, ":"); colon != -1 {
+		raw = raw[:colon]
+	}
+
+	international := strings.HasPrefix(raw, "+")
+
+	var digits strings.Builder
+	for _, r := range raw {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r == '+' || r == ' ' || r == '-' || r == '.' || r == '(' || r == ')' || r == '/':
+		default:
+			return "", ErrInvalidPhone
+		}
+	}
+	phone := digits.String()
+
+	switch {
+	case strings.HasPrefix(phone, "00"):
+		phone = phone[2:]
+	case international:
+	case strings.HasPrefix(phone, "0"):
+		phone = "62" + phone[1:]
+	case strings.HasPrefix(phone, "8"):
+		// Leading zero dropped by a spreadsheet
+		phone = "62" + phone
+	}
+
+	if strings.HasPrefix(phone, "620") {
+		// +62 0812... written with both the country code and the trunk zero
+		phone = "62" + phone[3:]
+	}
+
+	if len(phone) < 10 || len(phone) > 15 || phone[0] == '0' {
+		return "", ErrInvalidPhone
+	}
+	if strings.HasPrefix(phone, "62") && (len(phone) < 11 || len(phone) > 14) {
+		return "", ErrInvalidPhone
+	}
+
+	return phone, nil
+}
+
+// PhoneToJID returns the WhatsApp user JID of a normalized phone number
+func PhoneToJID(phone string) string {
+	return phone + "@s.whatsapp.net"
+}
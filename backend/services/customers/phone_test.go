@@ -0,0 +1,46 @@
+package customers
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalizePhone(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+		err  error
+	}{
+		{"local with dashes", "0812-3456-789", "628123456789", nil},
+		{"international with spaces", "+62 812 3456 789", "628123456789", nil},
+		{"country code without plus", "628123456789", "628123456789", nil},
+		{"leading zero dropped", "8123456789", "628123456789", nil},
+		{"double zero prefix", "0062 812 3456 789", "628123456789", nil},
+		{"country code and trunk zero", "+62 0812 3456 789", "628123456789", nil},
+		{"parentheses and dots", "(0812) 3456.789", "628123456789", nil},
+		{"surrounding space", "  08123456789 ", "628123456789", nil},
+		{"JID", "628123456789@s.whatsapp.net", "628123456789", nil},
+		{"JID with device", "628123456789:12@s.whatsapp.net", "628123456789", nil},
+		{"other country after plus", "+1 415 555 2671", "14155552671", nil},
+		{"other country after double zero", "0044 20 7946 0958", "442079460958", nil},
+		{"letters", "0812-CALL-ME", "", ErrInvalidPhone},
+		{"empty", "", "", ErrInvalidPhone},
+		{"too short", "0812345", "", ErrInvalidPhone},
+		{"too long", "+1234567890123456", "", ErrInvalidPhone},
+		{"Indonesian too short", "+62 812 345 67", "", ErrInvalidPhone},
+		{"Indonesian too long", "0812 3456 7890 123", "", ErrInvalidPhone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NormalizePhone(tt.raw)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("NormalizePhone(%q) error = %v, want %v", tt.raw, err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("NormalizePhone(%q) = %q, want %q", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
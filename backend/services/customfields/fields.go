@@ -0,0 +1,303 @@
+// Package customfields validates tenant-defined customer fields. Values are
+// stored as text in customer_insights.custom_fields, keyed by the field key,
+// so segments, exports and imports see them like any other custom field.
+package customfields
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Field types
+const (
+	TypeText    = "text"
+	TypeNumber  = "number"
+	TypeDate    = "date"
+	TypeSelect  = "select"
+	TypeBoolean = "boolean"
+)
+
+// DateLayout is how date values are stored
+const DateLayout = "2006-01-02"
+
+const (
+	maxLabelLength = 100
+	maxOptions     = 100
+	maxTextLength  = 500
+)
+
+var (
+	// ErrInvalidDefinition wraps every field definition validation error
+	ErrInvalidDefinition = errors.New("invalid custom field")
+	// ErrInvalidValue wraps every value validation error
+	ErrInvalidValue = errors.New("invalid custom field value")
+)
+
+var keyPattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,49}$`)
+
+// Definition is a custom field of a tenant's customers
+type Definition struct {
+	ID        string         `json:"id" db:"id"`
+	TenantID  string         `json:"tenant_id" db:"tenant_id"`
+	Key       string         `json:"key" db:"key"`
+	Label     string         `json:"label" db:"label"`
+	Type      string         `json:"type" db:"field_type"`
+	Options   pq.StringArray `json:"options" db:"options"`
+	Required  bool           `json:"required" db:"required"`
+	Position  int            `json:"position" db:"position"`
+	CreatedAt time.Time      `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at" db:"updated_at"`
+}
+
+// Columns is the select list for Definition
+const Columns = `id, tenant_id, key, label, field_type, options, required, position, created_at, updated_at`
+
+// Normalize trims the definition and checks it is usable
+func (d *Definition) Normalize() error {
+	d.Key = strings.TrimSpace(d.Key)
+	d.Label = strings.TrimSpace(d.Label)
+
+	if !keyPattern.MatchString(d.Key) {
+		return fmt.Errorf("%w: key must start with a lowercase letter and contain only a-z, 0-9 and _ (max 50)", ErrInvalidDefinition)
+	}
+	if d.Label == "" || len([]rune(d.Label)) > maxLabelLength {
+		return fmt.Errorf("%w: label is required (max %d characters)", ErrInvalidDefinition, maxLabelLength)
+	}
+
+	switch d.Type {
+	case TypeText, TypeNumber, TypeDate, TypeBoolean:
+		if len(d.Options) > 0 {
+			return fmt.Errorf("%w: only select fields have options", ErrInvalidDefinition)
+		}
+		d.Options = pq.StringArray{}
+	case TypeSelect:
+		options := pq.StringArray{}
+		seen := map[string]bool{}
+		for _, o := range d.Options {
+			o = strings.TrimSpace(o)
+			if o == "" || seen[strings.ToLower(o)] {
+				continue
+			}
+			seen[strings.ToLower(o)] = true
+			options = append(options, o)
+		}
+		if len(options) == 0 || len(options) > maxOptions {
+			return fmt.Errorf("%w: select fields need 1 to %d options", ErrInvalidDefinition, maxOptions)
+		}
+		d.Options = options
+	default:
+		return fmt.Errorf("%w: type must be text, number, date, select or boolean", ErrInvalidDefinition)
+	}
+	return nil
+}
+
+// Value checks a JSON value against the field and returns it as stored.
+// An empty string means the value is cleared.
+func (d Definition) Value(raw json.RawMessage) (string, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return "", d.invalid("is not valid JSON")
+	}
+	if v == nil {
+		return "", nil
+	}
+	if s, ok := v.(string); ok {
+		v = strings.TrimSpace(s)
+		if v == "" {
+			return "", nil
+		}
+	}
+
+	switch d.Type {
+	case TypeText:
+		s, ok := v.(string)
+		if !ok {
+			return "", d.invalid("must be text")
+		}
+		if len([]rune(s)) > maxTextLength {
+			return "", d.invalid(fmt.Sprintf("must be at most %d characters", maxTextLength))
+		}
+		return s, nil
+
+	case TypeNumber:
+		var text string
+		switch n := v.(type) {
+		case json.Number:
+			text = n.String()
+		case string:
+			text = n
+		default:
+			return "", d.invalid("must be a number")
+		}
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return "", d.invalid("must be a number")
+		}
+		return strconv.FormatFloat(f, 'f', -1, 64), nil
+
+	case TypeDate:
+		s, ok := v.(string)
+		if !ok {
+			return "", d.invalid("must be a date (YYYY-MM-DD)")
+		}
+		if t, err := time.Parse(DateLayout, s); err == nil {
+			return t.Format(DateLayout), nil
+		}
+		if t, err := time.Parse(time.RFC3339, s); err == nil {
+			return t.Format(DateLayout), nil
+		}
+		return "", d.invalid("must be a date (YYYY-MM-DD)")
+
+	case TypeSelect:
+		s, ok := v.(string)
+		if !ok {
+			return "", d.invalid("must be one of the options")
+		}
+		for _, o := range d.Options {
+			if strings.EqualFold(o, s) {
+				return o, nil
+			}
+		}
+		return "", d.invalid("must be one of: " + strings.Join(d.Options, ", "))
+
+	case TypeBoolean:
+		switch b := v.(type) {
+		case bool:
+			return strconv.FormatBool(b), nil
+		case string:
+			switch strings.ToLower(b) {
+			case "true", "yes", "ya", "1":
+				return "true", nil
+			case "false", "no", "tidak", "0":
+				return "false", nil
+			}
+		case json.Number:
+			switch b.String() {
+			case "1":
+				return "true", nil
+			case "0":
+				return "false", nil
+			}
+		}
+		return "", d.invalid("must be true or false")
+	}
+	return "", d.invalid("has an unknown type")
+}
+
+func (d Definition) invalid(reason string) error {
+	return fmt.Errorf("%w: %s %s", ErrInvalidValue, d.Key, reason)
+}
+
+// Service loads field definitions and checks values against them
+type Service struct {
+	db *sqlx.DB
+}
+
+// NewService creates a custom field service
+func NewService(db *sqlx.DB) *Service {
+	return &Service{db: db}
+}
+
+// Definitions returns the tenant's fields in display order
+func (s *Service) Definitions(ctx context.Context, tenantID string) ([]Definition, error) {
+	definitions := []Definition{}
+	err := s.db.SelectContext(ctx, &definitions, `
+		SELECT `+Columns+` FROM customer_field_definitions
+		WHERE tenant_id = $1
+		ORDER BY position, label
+	`, tenantID)
+	return definitions, err
+}
+
+// Validate checks a customer update of custom fields. It returns the values
+// to set and the keys to remove; null or empty values remove a field.
+// Only defined fields can be edited, and required fields cannot be cleared.
+func (s *Service) Validate(ctx context.Context, tenantID string, values map[string]json.RawMessage) (map[string]string, []string, error) {
+	definitions, err := s.Definitions(ctx, tenantID)
+	if err != nil {
+		return nil, nil, err
+	}
+	byKey := make(map[string]Definition, len(definitions))
+	for _, d := range definitions {
+		byKey[d.Key] = d
+	}
+
+	set := map[string]string{}
+	unset := []string{}
+	for key, raw := range values {
+		d, ok := byKey[key]
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: unknown field %s", ErrInvalidValue, key)
+		}
+		value, err := d.Value(raw)
+		if err != nil {
+			return nil, nil, err
+		}
+		if value == "" {
+			if d.Required {
+				return nil, nil, d.invalid("is required")
+			}
+			unset = append(unset, key)
+			continue
+		}
+		set[key] = value
+	}
+	return set, unset, nil
+}
+
+// Known keeps the values that fit one of the tenant's fields, converted to
+// how they are stored. Unknown keys, empty values and values of the wrong
+// type are dropped; it is meant for values from untrusted sources such as
+// AI extraction.
+func (s *Service) Known(ctx context.Context, tenantID string, values map[string]string) (map[string]string, error) {
+	definitions, err := s.Definitions(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	known := map[string]string{}
+	for _, d := range definitions {
+		raw, ok := values[d.Key]
+		if !ok {
+			continue
+		}
+		encoded, _ := json.Marshal(raw)
+		if value, err := d.Value(encoded); err == nil && value != "" {
+			known[d.Key] = value
+		}
+	}
+	return known, nil
+}
+
+// Decode reads stored custom_fields JSON. Values written by other sources
+// as numbers or booleans are returned as text.
+func Decode(raw string) map[string]string {
+	var stored map[string]interface{}
+	json.Unmarshal([]byte(raw), &stored)
+
+	values := make(map[string]string, len(stored))
+	for key, v := range stored {
+		switch v := v.(type) {
+		case string:
+			values[key] = v
+		case nil:
+		case float64:
+			values[key] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			values[key] = fmt.Sprint(v)
+		}
+	}
+	return values
+}
@@ -0,0 +1,95 @@
+package email
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+)
+
+// Mailer sends plain-text emails over SMTP
+type Mailer struct {
+	host     string
+	port     string
+	user     string
+	password string
+	from     string
+}
+
+// NewMailerFromEnv creates a mailer from SMTP_* environment variables.
+// It returns nil when SMTP_HOST is not set.
+func NewMailerFromEnv() *Mailer {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return nil
+	}
+
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		from = os.Getenv("SMTP_USER")
+	}
+
+	return &Mailer{
+		host:     host,
+		port:     port,
+		user:     os.Getenv("SMTP_USER"),
+		password: os.Getenv("SMTP_PASSWORD"),
+		from:     from,
+	}
+}
+
+// Send sends an email. With a nil mailer the message is only logged so
+// development setups without SMTP keep working.
+func (m *Mailer) Send(to, subject, body string) error {
+	if m == nil {
+		log.Printf("[Email] SMTP not configured, skipping email to %s: %s", to, subject)
+		return nil
+	}
+
+	// The recipient and subject may come from user input, so neither may
+	// add headers of its own
+	recipient, err := mail.ParseAddress(to)
+	if err != nil {
+		return fmt.Errorf("invalid recipient %q: %w", to, err)
+	}
+
+	headers := []string{
+		"From: " + m.from,
+		"To: " + recipient.String(),
+		"Subject: " + encodeHeader(subject),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+	}
+	msg := strings.Join(headers, "\r\n") + "\r\n\r\n" + body
+
+	var auth smtp.Auth
+	if m.user != "" {
+		auth = smtp.PlainAuth("", m.user, m.password, m.host)
+	}
+
+	// The envelope sender must be a bare address even if SMTP_FROM has a display name
+	envelopeFrom := m.from
+	if addr, err := mail.ParseAddress(m.from); err == nil {
+		envelopeFrom = addr.Address
+	}
+
+	addr := fmt.Sprintf("%s:%s", m.host, m.port)
+	if err := smtp.SendMail(addr, auth, envelopeFrom, []string{recipient.Address}, []byte(msg)); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	return nil
+}
+
+// encodeHeader makes text safe for a header value: line breaks become
+// spaces and non-ASCII text is Q-encoded
+func encodeHeader(text string) string {
+	return mime.QEncoding.Encode("utf-8", strings.Join(strings.Fields(text), " "))
+}
@@ -0,0 +1,101 @@
+package export
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// exportsDir is where background export files are written
+const exportsDir = "/app/data/exports"
+
+// Job is a background export and its result file
+type Job struct {
+	ID           string     `json:"id" db:"id"`
+	TenantID     string     `json:"tenant_id" db:"tenant_id"`
+	RequestedBy  *string    `json:"requested_by" db:"requested_by"`
+	ExportType   string     `json:"export_type" db:"export_type"`
+	Format       string     `json:"format" db:"format"`
+	Params       string     `json:"params" db:"params"`
+	Status       string     `json:"status" db:"status"`
+	FilePath     *string    `json:"-" db:"file_path"`
+	FileName     *string    `json:"file_name" db:"file_name"`
+	RowCount     int        `json:"row_count" db:"row_count"`
+	ErrorMessage *string    `json:"error_message" db:"error_message"`
+	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
+	CompletedAt  *time.Time `json:"completed_at" db:"completed_at"`
+}
+
+// JobColumns is the select list for Job
+const JobColumns = `
+	id, tenant_id, requested_by, export_type, format, params::text as params, status,
+	file_path, file_name, row_count, error_message, created_at, completed_at
+`
+
+// RunTranscriptJob writes a transcript export to disk and records the result
+// on the job. It is meant to run in its own goroutine.
+func RunTranscriptJob(db *sqlx.DB, jobID, format, title, fileName string, filter TranscriptFilter) {
+	ctx := context.Background()
+	db.ExecContext(ctx, `UPDATE export_jobs SET status = 'running' WHERE id = $1`, jobID)
+
+	dir := filepath.Join(exportsDir, filter.TenantID)
+	filePath := filepath.Join(dir, jobID+"."+format)
+
+	count, err := writeTranscriptFile(ctx, db, dir, filePath, format, title, filter)
+	if err != nil {
+		log.Printf("[Export] Transcript job %s failed: %v", jobID, err)
+		os.Remove(filePath)
+		db.ExecContext(ctx, `
+			UPDATE export_jobs SET status = 'failed', error_message = $1, completed_at = NOW()
+			WHERE id = $2
+		`, err.Error(), jobID)
+		return
+	}
+
+	db.ExecContext(ctx, `
+		UPDATE export_jobs
+		SET status = 'completed', file_path = $1, file_name = $2, row_count = $3, completed_at = NOW()
+		WHERE id = $4
+	`, filePath, fileName, count, jobID)
+	log.Printf("[Export] Transcript job %s completed: %d messages", jobID, count)
+}
+
+// RecoverJobs fails the jobs left pending or running by a previous process.
+// Jobs run in the server's goroutines, so after a restart nothing will
+// finish them and clients would poll them forever. It returns how many
+// jobs were failed.
+func RecoverJobs(ctx context.Context, db *sqlx.DB) (int64, error) {
+	res, err := db.ExecContext(ctx, `
+		UPDATE export_jobs SET status = 'failed', error_message = 'export was interrupted by a server restart, please start it again',
+			completed_at = NOW()
+		WHERE status IN ('pending', 'running')
+	`)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// writeTranscriptFile creates filePath and writes the transcript into it
+func writeTranscriptFile(ctx context.Context, db *sqlx.DB, dir, filePath, format, title string, filter TranscriptFilter) (int, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, fmt.Errorf("failed to create export directory: %w", err)
+	}
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create export file: %w", err)
+	}
+	defer file.Close()
+
+	count, err := WriteTranscript(ctx, db, file, format, title, filter)
+	if err != nil {
+		return count, err
+	}
+	return count, file.Close()
+}
@@ -0,0 +1,344 @@
+package export
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Supported transcript formats. HTML is print-ready so it can be saved as PDF
+// from the browser.
+const (
+	FormatCSV  = "csv"
+	FormatJSON = "json"
+	FormatHTML = "html"
+)
+
+// IsValidFormat reports whether format is a supported transcript format
+func IsValidFormat(format string) bool {
+	return format == FormatCSV || format == FormatJSON || format == FormatHTML
+}
+
+// ContentType returns the MIME type of a transcript format
+func ContentType(format string) string {
+	switch format {
+	case FormatCSV:
+		return "text/csv; charset=utf-8"
+	case FormatJSON:
+		return "application/json; charset=utf-8"
+	}
+	return "text/html; charset=utf-8"
+}
+
+// TranscriptFilter selects the messages of a transcript. CustomerJID limits it
+// to one chat; From/To are optional bounds on the message time.
+type TranscriptFilter struct {
+	TenantID    string     `json:"-"`
+	CustomerJID string     `json:"customer_jid,omitempty"`
+	From        *time.Time `json:"from,omitempty"`
+	To          *time.Time `json:"to,omitempty"`
+}
+
+// TranscriptMessage is one row of a transcript
+type TranscriptMessage struct {
+	MessageID     string    `json:"message_id" db:"message_id"`
+	SentAt        time.Time `json:"timestamp" db:"sent_at"`
+	IsFromMe      bool      `json:"is_from_me" db:"is_from_me"`
+	CustomerJID   string    `json:"customer_jid" db:"customer_jid"`
+	CustomerName  *string   `json:"customer_name" db:"customer_name"`
+	CustomerPhone *string   `json:"customer_phone" db:"customer_phone"`
+	MessageType   string    `json:"message_type" db:"message_type"`
+	Text          string    `json:"text" db:"message_text"`
+	Caption       string    `json:"caption,omitempty" db:"caption"`
+	MediaURL      string    `json:"media_url,omitempty" db:"media_url"`
+	SentBy        *string   `json:"sent_by" db:"sent_by"`
+	SentByName    *string   `json:"sent_by_name,omitempty" db:"sent_by_name"`
+	Sender        string    `json:"sender" db:"-"`
+}
+
+// customerJIDExpr is the customer side of a message: sender for incoming, chat for outgoing
+const customerJIDExpr = `CASE WHEN m.is_from_me THEN m.chat_jid ELSE m.sender_jid END`
+
+// buildWhere returns the shared FROM/WHERE clause for a filter
+func buildWhere(filter TranscriptFilter) (string, []interface{}) {
+	where := `
+		FROM whatsapp_messages m
+		LEFT JOIN customer_insights ci ON ci.tenant_id = m.tenant_id AND ci.customer_jid = ` + customerJIDExpr + `
+		LEFT JOIN users u ON u.id = m.sent_by_user
+		WHERE m.tenant_id = $1 AND m.is_group = false
+	`
+	args := []interface{}{filter.TenantID}
+
+	if filter.CustomerJID != "" {
+		args = append(args, filter.CustomerJID)
+		where += ` AND (m.sender_jid = $` + strconv.Itoa(len(args)) + ` OR m.chat_jid = $` + strconv.Itoa(len(args)) + `)`
+	}
+	if filter.From != nil {
+		args = append(args, filter.From.Unix())
+		where += ` AND m.timestamp >= $` + strconv.Itoa(len(args))
+	}
+	if filter.To != nil {
+		args = append(args, filter.To.Unix())
+		where += ` AND m.timestamp <= $` + strconv.Itoa(len(args))
+	}
+	return where, args
+}
+
+// CountTranscript returns how many messages a transcript would contain
+func CountTranscript(ctx context.Context, db *sqlx.DB, filter TranscriptFilter) (int, error) {
+	where, args := buildWhere(filter)
+	var count int
+	err := db.GetContext(ctx, &count, `SELECT COUNT(*) `+where, args...)
+	return count, err
+}
+
+// WriteTranscript streams the messages matching filter to w in the given
+// format, grouped by chat and in chronological order. It returns the number
+// of messages written.
+func WriteTranscript(ctx context.Context, db *sqlx.DB, w io.Writer, format, title string, filter TranscriptFilter) (int, error) {
+	where, args := buildWhere(filter)
+	query := `
+		SELECT
+			COALESCE(m.message_id, '') as message_id, to_timestamp(m.timestamp) as sent_at, m.is_from_me,
+			` + customerJIDExpr + ` as customer_jid, ci.customer_name, ci.customer_phone,
+			COALESCE(m.message_type, 'text') as message_type,
+			COALESCE(m.message_text, '') as message_text,
+			COALESCE(m.caption, '') as caption,
+			COALESCE(m.media_url, '') as media_url,
+			m.sent_by, u.full_name as sent_by_name
+		` + where + `
+		ORDER BY customer_jid, m.timestamp ASC, m.id ASC
+	`
+
+	rows, err := db.QueryxContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	tw := newTranscriptWriter(w, format)
+	if err := tw.begin(title); err != nil {
+		return 0, err
+	}
+
+	baseURL := strings.TrimRight(os.Getenv("BACKEND_URL"), "/")
+	count := 0
+	for rows.Next() {
+		var msg TranscriptMessage
+		if err := rows.StructScan(&msg); err != nil {
+			return count, err
+		}
+		if msg.MediaURL != "" && strings.HasPrefix(msg.MediaURL, "/") {
+			msg.MediaURL = baseURL + msg.MediaURL
+		}
+		msg.Sender = senderLabel(&msg)
+
+		if err := tw.write(&msg); err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+
+	return count, tw.end()
+}
+
+// senderLabel describes who wrote a message for people reading the transcript
+func senderLabel(msg *TranscriptMessage) string {
+	if !msg.IsFromMe {
+		return customerLabel(msg)
+	}
+
+	sentBy := ""
+	if msg.SentBy != nil {
+		sentBy = *msg.SentBy
+	}
+	switch sentBy {
+	case "ai":
+		return "AI Assistant"
+	case "agent":
+		if msg.SentByName != nil && *msg.SentByName != "" {
+			return "Agent: " + *msg.SentByName
+		}
+		return "Agent"
+	case "broadcast":
+		return "Broadcast"
+	case "phone":
+		return "Business (phone)"
+	}
+	return "Business"
+}
+
+// customerLabel returns the customer's name, phone or JID
+func customerLabel(msg *TranscriptMessage) string {
+	if msg.CustomerName != nil && *msg.CustomerName != "" {
+		return *msg.CustomerName
+	}
+	if msg.CustomerPhone != nil && *msg.CustomerPhone != "" {
+		return *msg.CustomerPhone
+	}
+	return strings.SplitN(msg.CustomerJID, "@", 2)[0]
+}
+
+// transcriptWriter renders transcript rows in one format
+type transcriptWriter interface {
+	begin(title string) error
+	write(msg *TranscriptMessage) error
+	end() error
+}
+
+func newTranscriptWriter(w io.Writer, format string) transcriptWriter {
+	switch format {
+	case FormatCSV:
+		return &csvTranscriptWriter{w: csv.NewWriter(w)}
+	case FormatJSON:
+		return &jsonTranscriptWriter{w: w}
+	}
+	return &htmlTranscriptWriter{w: w}
+}
+
+type csvTranscriptWriter struct {
+	w *csv.Writer
+}
+
+func (t *csvTranscriptWriter) begin(title string) error {
+	return t.w.Write([]string{
+		"timestamp", "customer_name", "customer_jid", "direction", "sender",
+		"message_type", "text", "caption", "media_url", "message_id",
+	})
+}
+
+func (t *csvTranscriptWriter) write(msg *TranscriptMessage) error {
+	direction := "incoming"
+	if msg.IsFromMe {
+		direction = "outgoing"
+	}
+	return t.w.Write([]string{
+		msg.SentAt.Format(time.RFC3339), customerLabel(msg), msg.CustomerJID, direction, msg.Sender,
+		msg.MessageType, msg.Text, msg.Caption, msg.MediaURL, msg.MessageID,
+	})
+}
+
+func (t *csvTranscriptWriter) end() error {
+	t.w.Flush()
+	return t.w.Error()
+}
+
+type jsonTranscriptWriter struct {
+	w     io.Writer
+	count int
+}
+
+func (t *jsonTranscriptWriter) begin(title string) error {
+	header, err := json.Marshal(map[string]interface{}{
+		"title":        title,
+		"generated_at": time.Now().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	// Reopen the header object to append the streamed messages array
+	_, err = fmt.Fprintf(t.w, "%s,\"messages\":[", header[:len(header)-1])
+	return err
+}
+
+func (t *jsonTranscriptWriter) write(msg *TranscriptMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if t.count > 0 {
+		if _, err := io.WriteString(t.w, ","); err != nil {
+			return err
+		}
+	}
+	t.count++
+	_, err = t.w.Write(data)
+	return err
+}
+
+func (t *jsonTranscriptWriter) end() error {
+	_, err := fmt.Fprintf(t.w, "],\"total\":%d}", t.count)
+	return err
+}
+
+var htmlTranscriptTemplates = template.Must(template.New("transcript").Parse(`
+{{define "begin"}}<!DOCTYPE html>
+<html lang="id">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+  body { font-family: -apple-system, "Segoe UI", Roboto, sans-serif; color: #111; margin: 2rem; font-size: 13px; }
+  h1 { font-size: 20px; margin-bottom: 0; }
+  .meta { color: #666; margin-bottom: 1.5rem; }
+  h2 { font-size: 15px; border-bottom: 1px solid #ddd; padding-bottom: 4px; margin-top: 2rem; }
+  .msg { margin: 6px 0; padding: 6px 10px; border-radius: 6px; max-width: 75%; page-break-inside: avoid; }
+  .in { background: #f1f1f1; }
+  .out { background: #dcf8c6; margin-left: auto; }
+  .head { font-size: 11px; color: #555; margin-bottom: 2px; }
+  .text { white-space: pre-wrap; }
+  .media a { color: #0b63c5; word-break: break-all; }
+  @media print { body { margin: 0; } a { color: inherit; } }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<div class="meta">Dibuat {{.GeneratedAt}}</div>
+{{end}}
+{{define "chat"}}<h2>{{.}}</h2>
+{{end}}
+{{define "message"}}<div class="msg {{if .IsFromMe}}out{{else}}in{{end}}">
+  <div class="head"><strong>{{.Sender}}</strong> &middot; {{.SentAt.Format "02 Jan 2006 15:04"}}{{if ne .MessageType "text"}} &middot; {{.MessageType}}{{end}}</div>
+  {{if .Text}}<div class="text">{{.Text}}</div>{{end}}
+  {{if and .Caption (ne .Caption .Text)}}<div class="text">{{.Caption}}</div>{{end}}
+  {{if .MediaURL}}<div class="media"><a href="{{.MediaURL}}">{{.MediaURL}}</a></div>{{end}}
+</div>
+{{end}}
+{{define "end"}}<div class="meta">{{.}} pesan</div>
+</body>
+</html>
+{{end}}`))
+
+type htmlTranscriptWriter struct {
+	w       io.Writer
+	lastJID string
+	count   int
+}
+
+func (t *htmlTranscriptWriter) begin(title string) error {
+	return htmlTranscriptTemplates.ExecuteTemplate(t.w, "begin", map[string]string{
+		"Title":       title,
+		"GeneratedAt": time.Now().Format("02 Jan 2006 15:04"),
+	})
+}
+
+func (t *htmlTranscriptWriter) write(msg *TranscriptMessage) error {
+	if msg.CustomerJID != t.lastJID {
+		t.lastJID = msg.CustomerJID
+		label := customerLabel(msg)
+		if phone := strings.SplitN(msg.CustomerJID, "@", 2)[0]; phone != label {
+			label += " (" + phone + ")"
+		}
+		if err := htmlTranscriptTemplates.ExecuteTemplate(t.w, "chat", label); err != nil {
+			return err
+		}
+	}
+	t.count++
+	return htmlTranscriptTemplates.ExecuteTemplate(t.w, "message", msg)
+}
+
+func (t *htmlTranscriptWriter) end() error {
+	return htmlTranscriptTemplates.ExecuteTemplate(t.w, "end", t.count)
+}
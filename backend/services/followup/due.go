@@ -0,0 +1,116 @@
+package followup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"gowa-backend/services/email"
+	ws "gowa-backend/services/websocket"
+
+	"github.com/lib/pq"
+)
+
+// UnansweredAfter is how long an order intent may go without a reply from
+// the team before a follow-up task is created for it
+const UnansweredAfter = 24 * time.Hour
+
+// unansweredLookback bounds how old an order intent may be to still get a task
+const unansweredLookback = 7 * 24 * time.Hour
+
+// CreateUnanswered creates a task, due now, for each customer whose latest
+// order intent got no reply from an agent or the linked phone within
+// UnansweredAfter. AI auto-replies don't count as a reply. Customers with an
+// open task, or a task created since the intent, are skipped. It returns the
+// number of tasks created.
+func (s *Service) CreateUnanswered(ctx context.Context) (int, error) {
+	var customerIDs []string
+	err := s.db.SelectContext(ctx, &customerIDs, `
+		INSERT INTO follow_up_tasks (tenant_id, customer_id, assigned_to, due_at, note, source, source_ref)
+		SELECT DISTINCT ON (l.customer_id) l.tenant_id, l.customer_id, conv.assigned_to, NOW(),
+			'Order intent without a reply: ' || LEFT(l.customer_message, 200), $3::text, l.id
+		FROM ai_conversation_logs l
+		JOIN customer_insights ci ON ci.id = l.customer_id
+		LEFT JOIN conversations conv ON conv.tenant_id = l.tenant_id AND conv.customer_jid = ci.customer_jid
+		WHERE l.detected_intent = $3::text
+		  AND l.created_at::timestamptz <= NOW() - make_interval(secs => $1)
+		  AND l.created_at::timestamptz > NOW() - make_interval(secs => $2)
+		  AND NOT EXISTS (
+			SELECT 1 FROM whatsapp_messages m
+			WHERE m.tenant_id = l.tenant_id AND m.chat_jid = ci.customer_jid AND m.is_from_me
+			  AND m.sent_by IN ('agent', 'phone')
+			  AND m.timestamp >= EXTRACT(EPOCH FROM l.created_at::timestamptz)::bigint
+		  )
+		  AND NOT EXISTS (
+			SELECT 1 FROM follow_up_tasks t
+			WHERE t.customer_id = l.customer_id AND (t.status = 'open' OR t.created_at >= l.created_at::timestamptz)
+		  )
+		ORDER BY l.customer_id, l.created_at DESC
+		ON CONFLICT (source, source_ref) WHERE source_ref IS NOT NULL DO NOTHING
+		RETURNING customer_id
+	`, UnansweredAfter.Seconds(), (UnansweredAfter + unansweredLookback).Seconds(), SourceOrderIntent)
+	if err != nil {
+		return 0, err
+	}
+	return len(customerIDs), s.syncCustomers(ctx, customerIDs...)
+}
+
+// dueTask is a task announced as due, with its assignee's email
+type dueTask struct {
+	Task
+	AssigneeEmail *string `db:"assignee_email"`
+}
+
+// NotifyDue announces open tasks that came due since they were created or
+// rescheduled: over WebSocket to the tenant, and by email to the assignee.
+// Each task is announced once per due time. It returns the number announced.
+func (s *Service) NotifyDue(ctx context.Context, mailer *email.Mailer) (int, error) {
+	var ids []string
+	err := s.db.SelectContext(ctx, &ids, `
+		UPDATE follow_up_tasks SET notified_at = NOW()
+		WHERE status = 'open' AND notified_at IS NULL AND due_at <= NOW()
+		RETURNING id
+	`)
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+
+	var tasks []dueTask
+	err = s.db.SelectContext(ctx, &tasks, `
+		SELECT q.*, u.email as assignee_email
+		FROM (`+taskSelect+`) q
+		LEFT JOIN users u ON u.id = q.assigned_to
+		WHERE q.id::text = ANY($1)
+	`, pq.Array(ids))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, task := range tasks {
+		ws.GetHub().BroadcastToTenant(task.TenantID, ws.EventFollowUpDue, task.Task)
+		if task.AssigneeEmail != nil {
+			if err := mailer.Send(*task.AssigneeEmail, "Follow-up due: "+customerLabel(task.Task), dueEmail(task.Task)); err != nil {
+				log.Printf("[FollowUp] Failed to email task %s: %v", task.ID, err)
+			}
+		}
+	}
+	return len(tasks), nil
+}
+
+// customerLabel names the task's customer
+func customerLabel(task Task) string {
+	if task.CustomerName != nil && *task.CustomerName != "" {
+		return *task.CustomerName
+	}
+	return task.CustomerJID
+}
+
+// dueEmail is the body of a due task email
+func dueEmail(task Task) string {
+	body := fmt.Sprintf("A follow-up with %s was due at %s.\n", customerLabel(task), task.DueAt.Format(time.RFC1123))
+	if task.Note != nil && *task.Note != "" {
+		body += "\nNote: " + *task.Note + "\n"
+	}
+	return body + "\nOpen the dashboard to reply, send a template or snooze the task.\n"
+}
@@ -0,0 +1,354 @@
+// Package followup manages follow-up tasks: reminders to get back to a
+// customer by a due time. Tasks are created by agents, by setting a
+// customer's needs_follow_up flag, or automatically for order intents left
+// without a reply. The flag always mirrors whether the customer has an open
+// task.
+package followup
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gowa-backend/services/ai"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Task statuses
+const (
+	StatusOpen      = "open"
+	StatusDone      = "done"
+	StatusCancelled = "cancelled"
+)
+
+// Task sources
+const (
+	SourceManual      = "manual"
+	SourceOrderIntent = ai.IntentOrder
+)
+
+// ErrInvalidTask wraps every validation error
+var ErrInvalidTask = errors.New("invalid follow-up task")
+
+// Task is a follow-up task with its customer and assignee
+type Task struct {
+	ID           string     `json:"id" db:"id"`
+	TenantID     string     `json:"tenant_id" db:"tenant_id"`
+	CustomerID   string     `json:"customer_id" db:"customer_id"`
+	CustomerJID  string     `json:"customer_jid" db:"customer_jid"`
+	CustomerName *string    `json:"customer_name" db:"customer_name"`
+	AssignedTo   *string    `json:"assigned_to" db:"assigned_to"`
+	AssigneeName *string    `json:"assignee_name" db:"assignee_name"`
+	DueAt        time.Time  `json:"due_at" db:"due_at"`
+	Note         *string    `json:"note" db:"note"`
+	Status       string     `json:"status" db:"status"`
+	Source       string     `json:"source" db:"source"`
+	SnoozeCount  int        `json:"snooze_count" db:"snooze_count"`
+	NotifiedAt   *time.Time `json:"notified_at" db:"notified_at"`
+	CreatedBy    *string    `json:"created_by" db:"created_by"`
+	CompletedBy  *string    `json:"completed_by" db:"completed_by"`
+	CompletedAt  *time.Time `json:"completed_at" db:"completed_at"`
+	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at" db:"updated_at"`
+	Overdue      bool       `json:"overdue" db:"overdue"`
+}
+
+// taskSelect selects tasks as t with their customer and assignee
+const taskSelect = `
+	SELECT t.id, t.tenant_id, t.customer_id, ci.customer_jid, ci.customer_name,
+		t.assigned_to, u.full_name as assignee_name, t.due_at, t.note, t.status, t.source,
+		t.snooze_count, t.notified_at, t.created_by, t.completed_by, t.completed_at,
+		t.created_at, t.updated_at, (t.status = 'open' AND t.due_at < NOW()) as overdue
+	FROM follow_up_tasks t
+	JOIN customer_insights ci ON ci.id = t.customer_id
+	LEFT JOIN users u ON u.id = t.assigned_to`
+
+// Input creates or changes a task. On updates nil fields are left alone and
+// an empty AssignedTo unassigns the task.
+type Input struct {
+	CustomerID string     `json:"customer_id"`
+	AssignedTo *string    `json:"assigned_to"`
+	DueAt      *time.Time `json:"due_at"`
+	Note       *string    `json:"note"`
+}
+
+// Filter narrows a task list. Status defaults to open and takes "all";
+// AssignedTo takes "none" for unassigned tasks. Overdue keeps open tasks
+// past their due time and DueBefore tasks due before it.
+type Filter struct {
+	Status     string
+	AssignedTo string
+	CustomerID string
+	Overdue    bool
+	DueBefore  *time.Time
+}
+
+// Service manages follow-up tasks
+type Service struct {
+	db *sqlx.DB
+}
+
+// NewService creates a follow-up service
+func NewService(db *sqlx.DB) *Service {
+	return &Service{db: db}
+}
+
+// Get loads a task of the tenant
+func (s *Service) Get(ctx context.Context, tenantID, taskID string) (*Task, error) {
+	var task Task
+	err := s.db.GetContext(ctx, &task, taskSelect+` WHERE t.id::text = $1 AND t.tenant_id = $2`, taskID, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+// List returns a page of the tenant's tasks, soonest due first, with the
+// total matching the filter
+func (s *Service) List(ctx context.Context, tenantID string, filter Filter, limit, offset int) ([]Task, int, error) {
+	conditions := []string{"t.tenant_id = $1"}
+	args := []interface{}{tenantID}
+	add := func(condition string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, strings.ReplaceAll(condition, "?", "$"+strconv.Itoa(len(args))))
+	}
+
+	status := filter.Status
+	if status == "" || filter.Overdue {
+		status = StatusOpen
+	}
+	if status != "all" {
+		add("t.status = ?", status)
+	}
+	if filter.AssignedTo == "none" {
+		conditions = append(conditions, "t.assigned_to IS NULL")
+	} else if filter.AssignedTo != "" {
+		add("t.assigned_to::text = ?", filter.AssignedTo)
+	}
+	if filter.CustomerID != "" {
+		add("t.customer_id::text = ?", filter.CustomerID)
+	}
+	if filter.Overdue {
+		conditions = append(conditions, "t.due_at < NOW()")
+	}
+	if filter.DueBefore != nil {
+		add("t.due_at < ?", *filter.DueBefore)
+	}
+	where := " WHERE " + strings.Join(conditions, " AND ")
+
+	var total int
+	err := s.db.GetContext(ctx, &total, `SELECT COUNT(*) FROM follow_up_tasks t`+where, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	tasks := []Task{}
+	err = s.db.SelectContext(ctx, &tasks, taskSelect+where+`
+		ORDER BY t.due_at ASC
+		LIMIT $`+strconv.Itoa(len(args)+1)+` OFFSET $`+strconv.Itoa(len(args)+2),
+		append(args, limit, offset)...)
+	return tasks, total, err
+}
+
+// checkAssignee checks userID is a member of the tenant
+func (s *Service) checkAssignee(ctx context.Context, tenantID, userID string) error {
+	var member bool
+	err := s.db.GetContext(ctx, &member, `SELECT EXISTS (SELECT 1 FROM tenant_members WHERE tenant_id = $1 AND user_id::text = $2)`, tenantID, userID)
+	if err != nil {
+		return err
+	}
+	if !member {
+		return fmt.Errorf("%w: assignee is not a member of this tenant", ErrInvalidTask)
+	}
+	return nil
+}
+
+// Create adds an open task for a customer of the tenant. Without a due time
+// it is due now; without an assignee it goes to whoever owns the customer's
+// conversation.
+func (s *Service) Create(ctx context.Context, tenantID string, in Input, createdBy string) (*Task, error) {
+	if in.CustomerID == "" {
+		return nil, fmt.Errorf("%w: customer_id is required", ErrInvalidTask)
+	}
+	if in.AssignedTo != nil && *in.AssignedTo != "" {
+		if err := s.checkAssignee(ctx, tenantID, *in.AssignedTo); err != nil {
+			return nil, err
+		}
+	}
+	due := time.Now()
+	if in.DueAt != nil {
+		due = *in.DueAt
+	}
+	var assignee string
+	if in.AssignedTo != nil {
+		assignee = *in.AssignedTo
+	}
+
+	var taskID string
+	err := s.db.GetContext(ctx, &taskID, `
+		INSERT INTO follow_up_tasks (tenant_id, customer_id, assigned_to, due_at, note, source, created_by)
+		SELECT ci.tenant_id, ci.id, COALESCE(NULLIF($3, '')::uuid, conv.assigned_to), $4::timestamptz, $5::text, 'manual', NULLIF($6, '')::uuid
+		FROM customer_insights ci
+		LEFT JOIN conversations conv ON conv.tenant_id = ci.tenant_id AND conv.customer_jid = ci.customer_jid
+		WHERE ci.id::text = $1 AND ci.tenant_id = $2
+		RETURNING id
+	`, in.CustomerID, tenantID, assignee, due, in.Note, createdBy)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: customer not found", ErrInvalidTask)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := s.syncCustomers(ctx, in.CustomerID); err != nil {
+		return nil, err
+	}
+	return s.Get(ctx, tenantID, taskID)
+}
+
+// Update changes an open task's due time, assignee or note. A new due time
+// announces the task again when it comes due.
+func (s *Service) Update(ctx context.Context, tenantID, taskID string, in Input) (*Task, error) {
+	if in.AssignedTo != nil && *in.AssignedTo != "" {
+		if err := s.checkAssignee(ctx, tenantID, *in.AssignedTo); err != nil {
+			return nil, err
+		}
+	}
+
+	sets := []string{"updated_at = NOW()"}
+	args := []interface{}{taskID, tenantID}
+	if in.DueAt != nil {
+		args = append(args, *in.DueAt)
+		sets = append(sets, "due_at = $"+strconv.Itoa(len(args)), "notified_at = NULL")
+	}
+	if in.AssignedTo != nil {
+		args = append(args, *in.AssignedTo)
+		sets = append(sets, "assigned_to = NULLIF($"+strconv.Itoa(len(args))+", '')::uuid")
+	}
+	if in.Note != nil {
+		args = append(args, *in.Note)
+		sets = append(sets, "note = $"+strconv.Itoa(len(args)))
+	}
+
+	var customerID string
+	err := s.db.GetContext(ctx, &customerID, `
+		UPDATE follow_up_tasks SET `+strings.Join(sets, ", ")+`
+		WHERE id::text = $1 AND tenant_id = $2 AND status = 'open'
+		RETURNING customer_id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.syncCustomers(ctx, customerID); err != nil {
+		return nil, err
+	}
+	return s.Get(ctx, tenantID, taskID)
+}
+
+// Snooze pushes an open task's due time to until
+func (s *Service) Snooze(ctx context.Context, tenantID, taskID string, until time.Time) (*Task, error) {
+	if !until.After(time.Now()) {
+		return nil, fmt.Errorf("%w: snooze until must be in the future", ErrInvalidTask)
+	}
+	var customerID string
+	err := s.db.GetContext(ctx, &customerID, `
+		UPDATE follow_up_tasks
+		SET due_at = $3, notified_at = NULL, snooze_count = snooze_count + 1, updated_at = NOW()
+		WHERE id::text = $1 AND tenant_id = $2 AND status = 'open'
+		RETURNING customer_id
+	`, taskID, tenantID, until)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.syncCustomers(ctx, customerID); err != nil {
+		return nil, err
+	}
+	return s.Get(ctx, tenantID, taskID)
+}
+
+// Close marks an open task done or cancelled
+func (s *Service) Close(ctx context.Context, tenantID, taskID, status, userID string) (*Task, error) {
+	if status != StatusDone && status != StatusCancelled {
+		return nil, fmt.Errorf("%w: status must be %s or %s", ErrInvalidTask, StatusDone, StatusCancelled)
+	}
+	var customerID string
+	err := s.db.GetContext(ctx, &customerID, `
+		UPDATE follow_up_tasks
+		SET status = $3, completed_by = NULLIF($4, '')::uuid, completed_at = NOW(), updated_at = NOW()
+		WHERE id::text = $1 AND tenant_id = $2 AND status = 'open'
+		RETURNING customer_id
+	`, taskID, tenantID, status, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.syncCustomers(ctx, customerID); err != nil {
+		return nil, err
+	}
+	return s.Get(ctx, tenantID, taskID)
+}
+
+// SetNeedsFollowUp applies a change of a customer's needs_follow_up flag:
+// flagging a customer without an open task creates one due now, clearing
+// the flag completes their open tasks
+func (s *Service) SetNeedsFollowUp(ctx context.Context, tenantID, customerID string, needed bool, userID string) error {
+	if needed {
+		_, err := s.db.ExecContext(ctx, `
+			INSERT INTO follow_up_tasks (tenant_id, customer_id, assigned_to, due_at, source, created_by)
+			SELECT ci.tenant_id, ci.id, conv.assigned_to, NOW(), 'manual', NULLIF($3, '')::uuid
+			FROM customer_insights ci
+			LEFT JOIN conversations conv ON conv.tenant_id = ci.tenant_id AND conv.customer_jid = ci.customer_jid
+			WHERE ci.id::text = $1 AND ci.tenant_id = $2
+			  AND NOT EXISTS (SELECT 1 FROM follow_up_tasks t WHERE t.customer_id = ci.id AND t.status = 'open')
+		`, customerID, tenantID, userID)
+		if err != nil {
+			return err
+		}
+	} else {
+		_, err := s.db.ExecContext(ctx, `
+			UPDATE follow_up_tasks
+			SET status = 'done', completed_by = NULLIF($3, '')::uuid, completed_at = NOW(), updated_at = NOW()
+			WHERE customer_id::text = $1 AND tenant_id = $2 AND status = 'open'
+		`, customerID, tenantID, userID)
+		if err != nil {
+			return err
+		}
+	}
+	return s.syncCustomers(ctx, customerID)
+}
+
+// syncCustomers sets the customers' needs_follow_up flag and scheduled time
+// from their open tasks
+func (s *Service) syncCustomers(ctx context.Context, customerIDs ...string) error {
+	return SyncCustomers(ctx, s.db, customerIDs...)
+}
+
+// SyncCustomers is syncCustomers for callers that move tasks themselves,
+// e.g. within a transaction
+func SyncCustomers(ctx context.Context, db sqlx.ExecerContext, customerIDs ...string) error {
+	if len(customerIDs) == 0 {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, `
+		UPDATE customer_insights ci SET
+			needs_follow_up = o.due_at IS NOT NULL,
+			follow_up_scheduled_at = o.due_at,
+			follow_up_completed = o.due_at IS NULL AND EXISTS (
+				SELECT 1 FROM follow_up_tasks t WHERE t.customer_id = ci.id AND t.status = 'done'
+			),
+			updated_at = NOW()
+		FROM (
+			SELECT c.id, MIN(t.due_at) as due_at
+			FROM customer_insights c
+			LEFT JOIN follow_up_tasks t ON t.customer_id = c.id AND t.status = 'open'
+			WHERE c.id::text = ANY($1)
+			GROUP BY c.id
+		) o
+		WHERE ci.id = o.id
+	`, pq.Array(customerIDs))
+	return err
+}
@@ -0,0 +1,324 @@
+// Package insights enriches customer_insights with AI analysis of recent
+// conversations: sentiment, intent, product interest, a rolling summary and
+// facts the customer mentioned.
+package insights
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gowa-backend/services/ai"
+	"gowa-backend/services/customfields"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Run statuses recorded in customer_insight_runs
+const (
+	RunSuccess = "success"
+	RunInvalid = "invalid"
+	RunFailed  = "failed"
+)
+
+const (
+	// transcriptMessages is the conversation window sent to the AI
+	transcriptMessages = 30
+	// settleTime lets a conversation go quiet before it is analysed
+	settleTime = 10 * time.Minute
+	// minInterval is the least time between two analyses of a customer
+	minInterval = 30 * time.Minute
+	// maxAge skips customers who haven't written for a long time
+	maxAge = 7 * 24 * time.Hour
+)
+
+var (
+	// ErrDisabled is returned when the tenant turned insights off
+	ErrDisabled = errors.New("AI insights are disabled for this tenant")
+	// ErrBudgetExceeded is returned when this month's insight spend reached the limit
+	ErrBudgetExceeded = errors.New("monthly AI insights budget reached")
+	// ErrOptedOut is returned for customers excluded from AI analysis
+	ErrOptedOut = errors.New("customer opted out of AI insights")
+	// ErrNoMessages is returned when there is nothing to analyse
+	ErrNoMessages = errors.New("customer has no messages to analyse")
+)
+
+// Settings are a tenant's insight options
+type Settings struct {
+	Enabled          bool    `json:"enabled" db:"insights_enabled"`
+	MonthlyBudgetUSD float64 `json:"monthly_budget_usd" db:"insights_monthly_budget_usd"`
+	SpentUSD         float64 `json:"spent_this_month_usd" db:"spent_usd"`
+	RunsThisMonth    int     `json:"runs_this_month" db:"runs"`
+}
+
+// Provider is the AI provider and business context of a tenant
+type Provider struct {
+	Name            string
+	Model           string
+	APIKey          string // empty to use the system key
+	BusinessContext string
+}
+
+// Candidate is a customer with new messages to analyse
+type Candidate struct {
+	ID       string `db:"id"`
+	TenantID string `db:"tenant_id"`
+}
+
+// Service runs AI enrichment
+type Service struct {
+	db     *sqlx.DB
+	ai     *ai.AIService
+	fields *customfields.Service
+}
+
+// NewService creates an insights service
+func NewService(db *sqlx.DB, aiService *ai.AIService) *Service {
+	return &Service{db: db, ai: aiService, fields: customfields.NewService(db)}
+}
+
+// Settings returns the tenant's insight settings and this month's spend.
+// Tenants without an AI config get the defaults.
+func (s *Service) Settings(ctx context.Context, tenantID string) (*Settings, error) {
+	settings := &Settings{Enabled: true, MonthlyBudgetUSD: 1}
+	err := s.db.GetContext(ctx, settings, `
+		SELECT insights_enabled, insights_monthly_budget_usd::float8 as insights_monthly_budget_usd, 0::float8 as spent_usd, 0 as runs
+		FROM ai_configs WHERE tenant_id = $1
+	`, tenantID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	err = s.db.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(cost_usd), 0)::float8, COUNT(*)
+		FROM customer_insight_runs
+		WHERE tenant_id = $1 AND created_at >= date_trunc('month', NOW())
+	`, tenantID).Scan(&settings.SpentUSD, &settings.RunsThisMonth)
+	if err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// SaveSettings stores the tenant's insight options
+func (s *Service) SaveSettings(ctx context.Context, tenantID string, enabled bool, monthlyBudgetUSD float64) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO ai_configs (tenant_id, insights_enabled, insights_monthly_budget_usd)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (tenant_id) DO UPDATE SET
+			insights_enabled = EXCLUDED.insights_enabled,
+			insights_monthly_budget_usd = EXCLUDED.insights_monthly_budget_usd,
+			updated_at = NOW()
+	`, tenantID, enabled, monthlyBudgetUSD)
+	return err
+}
+
+// Candidates returns customers with messages since their last analysis
+// whose conversation has settled, for tenants that have insights enabled
+func (s *Service) Candidates(ctx context.Context, limit int) ([]Candidate, error) {
+	candidates := []Candidate{}
+	err := s.db.SelectContext(ctx, &candidates, `
+		SELECT ci.id, ci.tenant_id
+		FROM customer_insights ci
+		JOIN ai_configs ac ON ac.tenant_id = ci.tenant_id AND ac.insights_enabled = true
+		WHERE ci.insights_opted_out = false AND ci.customer_jid NOT LIKE '%@g.us'
+		  AND COALESCE(ci.message_count, 0) > ci.insights_message_count
+		  AND ci.last_message_at < NOW() - make_interval(secs => $1)
+		  AND ci.last_message_at > NOW() - make_interval(secs => $2)
+		  AND (ci.insights_updated_at IS NULL OR ci.insights_updated_at < NOW() - make_interval(secs => $3))
+		ORDER BY ci.tenant_id, ci.last_message_at DESC
+		LIMIT $4
+	`, settleTime.Seconds(), maxAge.Seconds(), minInterval.Seconds(), limit)
+	return candidates, err
+}
+
+// Enrich analyses a customer's recent conversation and stores the result.
+// It checks the tenant's opt-out and budget first. Every AI call is
+// recorded in customer_insight_runs with its cost.
+func (s *Service) Enrich(ctx context.Context, tenantID, customerID string, provider Provider) (*ai.ConversationInsight, error) {
+	if s.ai == nil {
+		return nil, errors.New("AI service not available")
+	}
+
+	settings, err := s.Settings(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	if !settings.Enabled {
+		return nil, ErrDisabled
+	}
+	if settings.SpentUSD >= settings.MonthlyBudgetUSD {
+		return nil, ErrBudgetExceeded
+	}
+
+	var customer struct {
+		CustomerJID  string  `db:"customer_jid"`
+		Summary      *string `db:"conversation_summary"`
+		MessageCount int     `db:"message_count"`
+		OptedOut     bool    `db:"insights_opted_out"`
+	}
+	err = s.db.GetContext(ctx, &customer, `
+		SELECT customer_jid, conversation_summary, COALESCE(message_count, 0) as message_count, insights_opted_out
+		FROM customer_insights WHERE id = $1 AND tenant_id = $2
+	`, customerID, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	if customer.OptedOut {
+		return nil, ErrOptedOut
+	}
+
+	transcript, err := s.transcript(ctx, tenantID, customer.CustomerJID)
+	if err != nil {
+		return nil, err
+	}
+	if transcript == "" {
+		s.markAnalysed(ctx, customerID, customer.MessageCount)
+		return nil, ErrNoMessages
+	}
+
+	req := ai.InsightRequest{
+		Provider:        provider.Name,
+		APIKey:          provider.APIKey,
+		Model:           provider.Model,
+		BusinessContext: provider.BusinessContext,
+		Transcript:      transcript,
+	}
+	if customer.Summary != nil {
+		req.PreviousSummary = *customer.Summary
+	}
+
+	insight, resp, err := s.ai.AnalyzeConversation(ctx, req)
+	switch {
+	case resp == nil:
+		// The provider failed before answering; nothing was spent
+		s.recordRun(ctx, tenantID, customerID, RunFailed, nil, err)
+		s.markAnalysed(ctx, customerID, -1)
+		return nil, err
+	case err != nil:
+		s.recordRun(ctx, tenantID, customerID, RunInvalid, resp, err)
+		s.markAnalysed(ctx, customerID, customer.MessageCount)
+		return nil, err
+	}
+
+	s.recordRun(ctx, tenantID, customerID, RunSuccess, resp, nil)
+	if err := s.apply(ctx, tenantID, customerID, customer.MessageCount, insight); err != nil {
+		return nil, err
+	}
+	return insight, nil
+}
+
+// transcript formats the latest messages of a chat, oldest first
+func (s *Service) transcript(ctx context.Context, tenantID, customerJID string) (string, error) {
+	var messages []struct {
+		Text      string `db:"message_text"`
+		Type      string `db:"message_type"`
+		IsFromMe  bool   `db:"is_from_me"`
+		Timestamp int64  `db:"timestamp"`
+	}
+	err := s.db.SelectContext(ctx, &messages, `
+		SELECT COALESCE(NULLIF(message_text, ''), caption, '') as message_text, COALESCE(message_type, 'text') as message_type, is_from_me, timestamp
+		FROM whatsapp_messages
+		WHERE tenant_id = $1 AND chat_jid = $2
+		ORDER BY timestamp DESC
+		LIMIT $3
+	`, tenantID, customerJID, transcriptMessages)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	for i := len(messages) - 1; i >= 0; i-- {
+		m := messages[i]
+		text := strings.TrimSpace(m.Text)
+		if text == "" {
+			if m.Type == "text" {
+				continue
+			}
+			text = "[" + m.Type + "]"
+		}
+
+		speaker := "Customer"
+		if m.IsFromMe {
+			speaker = "Business"
+		}
+		sb.WriteString(time.Unix(m.Timestamp, 0).Format("2006-01-02 15:04") + " " + speaker + ": " + text + "\n")
+	}
+	return sb.String(), nil
+}
+
+// apply stores the insight. Facts fill the name and custom fields only where
+// they are still empty, so data entered by agents is never overwritten.
+// Only facts that fit one of the tenant's custom fields are copied there;
+// all facts are kept in ai_facts.
+func (s *Service) apply(ctx context.Context, tenantID, customerID string, messageCount int, insight *ai.ConversationInsight) error {
+	products, _ := json.Marshal(insight.ProductInterest)
+	facts, _ := json.Marshal(insight.Facts)
+
+	extracted := map[string]string{}
+	for key, value := range insight.Facts {
+		if key != "name" {
+			extracted[key] = value
+		}
+	}
+	customFields, err := s.fields.Known(ctx, tenantID, extracted)
+	if err != nil {
+		return err
+	}
+	customFieldsJSON, _ := json.Marshal(customFields)
+
+	_, err = s.db.ExecContext(ctx, `
+		UPDATE customer_insights SET
+			sentiment = COALESCE(NULLIF($1, ''), sentiment),
+			intent = COALESCE(NULLIF($2, ''), intent),
+			product_interest = CASE WHEN jsonb_array_length($3::jsonb) > 0 THEN $3::jsonb ELSE product_interest END,
+			conversation_summary = COALESCE(NULLIF($4, ''), conversation_summary),
+			ai_facts = COALESCE(ai_facts, '{}'::jsonb) || $5::jsonb,
+			custom_fields = $6::jsonb || COALESCE(custom_fields, '{}'::jsonb),
+			customer_name = COALESCE(NULLIF(customer_name, ''), NULLIF($7, '')),
+			insights_message_count = $8,
+			insights_updated_at = NOW(),
+			updated_at = NOW()
+		WHERE id = $9
+	`, insight.Sentiment, insight.Intent, string(products), insight.Summary, string(facts),
+		string(customFieldsJSON), insight.Facts["name"], messageCount, customerID)
+	return err
+}
+
+// markAnalysed moves the customer out of the queue. messageCount -1 keeps
+// the count so the customer is retried after minInterval.
+func (s *Service) markAnalysed(ctx context.Context, customerID string, messageCount int) {
+	s.db.ExecContext(ctx, `
+		UPDATE customer_insights
+		SET insights_message_count = CASE WHEN $1 >= 0 THEN $1 ELSE insights_message_count END,
+			insights_updated_at = NOW()
+		WHERE id = $2
+	`, messageCount, customerID)
+}
+
+func (s *Service) recordRun(ctx context.Context, tenantID, customerID, status string, resp *ai.AIResponse, runErr error) {
+	var tokens int
+	var cost float64
+	var model, errText *string
+	if resp != nil {
+		tokens = resp.TokensUsed
+		cost = resp.CostUSD
+		model = &resp.Model
+	}
+	if runErr != nil {
+		text := runErr.Error()
+		errText = &text
+	}
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO customer_insight_runs (tenant_id, customer_id, status, tokens_used, cost_usd, model, error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, tenantID, customerID, status, tokens, cost, model, errText)
+	if err != nil {
+		fmt.Printf("[Insights] Failed to record run: %v\n", err)
+	}
+}
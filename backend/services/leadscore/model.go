@@ -0,0 +1,266 @@
+// Package leadscore computes customer lead scores from weighted signals. Each
+// tenant has a Model; event signals (intents, messages, broadcast replies)
+// decay with a half-life so scores fall when a customer goes quiet.
+package leadscore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	"gowa-backend/services/ai"
+)
+
+// Lead statuses the engine moves customers between. Other statuses
+// (customer, complaint, spam) are never changed by scoring.
+const (
+	StatusNew  = "new"
+	StatusHot  = "hot_lead"
+	StatusWarm = "warm_lead"
+	StatusCold = "cold_lead"
+)
+
+const (
+	maxWindowDays   = 365
+	maxHalfLifeDays = 365
+	maxPoints       = 100
+	maxTagWeights   = 100
+
+	// Replies within fastReplySeconds get full reply latency points, replies
+	// slower than slowReplySeconds get none
+	fastReplySeconds = 5 * 60
+	slowReplySeconds = 24 * 60 * 60
+)
+
+// ErrInvalidModel wraps every validation error
+var ErrInvalidModel = errors.New("invalid lead scoring model")
+
+// Signal weighs a countable event. Each event adds Points, decayed by its
+// age; the signal contributes at most Max.
+type Signal struct {
+	Points float64 `json:"points"`
+	Max    float64 `json:"max"`
+}
+
+// Model is a tenant's scoring configuration
+//
+//	{"enabled":true,"window_days":30,"half_life_days":14,
+//	 "intents":{"order_intent":{"points":15,"max":45},"price_inquiry":{"points":8,"max":24}},
+//	 "messages":{"points":1,"max":15},"broadcast_replies":{"points":5,"max":15},
+//	 "recency_max":20,"reply_latency_max":10,"tag_weights":{"<tag-id>":10},
+//	 "update_status":true,"hot_threshold":70,"warm_threshold":40}
+type Model struct {
+	Enabled      bool    `json:"enabled"`
+	WindowDays   int     `json:"window_days"`
+	HalfLifeDays float64 `json:"half_life_days"`
+
+	// Intents detected by the AI in ai_conversation_logs, keyed by intent
+	Intents map[string]Signal `json:"intents"`
+	// Inbound messages (frequency)
+	Messages Signal `json:"messages"`
+	// Broadcasts the customer replied to within three days
+	BroadcastReplies Signal `json:"broadcast_replies"`
+	// Full points for a message today, falling linearly to zero at WindowDays
+	RecencyMax float64 `json:"recency_max"`
+	// Full points when the customer answers our messages within 5 minutes on
+	// average, falling to zero at 24 hours
+	ReplyLatencyMax float64 `json:"reply_latency_max"`
+	// Fixed points per assigned tag, may be negative
+	TagWeights map[string]float64 `json:"tag_weights"`
+
+	// UpdateStatus moves new/hot/warm/cold leads by the thresholds
+	UpdateStatus  bool `json:"update_status"`
+	HotThreshold  int  `json:"hot_threshold"`
+	WarmThreshold int  `json:"warm_threshold"`
+}
+
+// DefaultModel is used by tenants that haven't saved their own model
+func DefaultModel() Model {
+	return Model{
+		Enabled:      true,
+		WindowDays:   30,
+		HalfLifeDays: 14,
+		Intents: map[string]Signal{
+			ai.IntentOrder:     {Points: 15, Max: 45},
+			"price_inquiry":    {Points: 8, Max: 24},
+			"payment_inquiry":  {Points: 10, Max: 20},
+			"shipping_inquiry": {Points: 5, Max: 10},
+			"complaint":        {Points: -10, Max: 20},
+		},
+		Messages:         Signal{Points: 1, Max: 15},
+		BroadcastReplies: Signal{Points: 5, Max: 15},
+		RecencyMax:       20,
+		ReplyLatencyMax:  10,
+		TagWeights:       map[string]float64{},
+		UpdateStatus:     true,
+		HotThreshold:     70,
+		WarmThreshold:    40,
+	}
+}
+
+// ParseModel decodes a model on top of the defaults, so fields left out keep
+// their default values. Intents and tag_weights replace the defaults as a
+// whole when given.
+func ParseModel(data []byte) (Model, error) {
+	m := DefaultModel()
+	m.Intents = nil
+	m.TagWeights = nil
+	if err := json.Unmarshal(data, &m); err != nil {
+		return Model{}, fmt.Errorf("%w: %v", ErrInvalidModel, err)
+	}
+
+	defaults := DefaultModel()
+	if m.Intents == nil {
+		m.Intents = defaults.Intents
+	}
+	if m.TagWeights == nil {
+		m.TagWeights = defaults.TagWeights
+	}
+	return m, m.Validate()
+}
+
+// Validate checks ranges so a model can't produce runaway scores
+func (m Model) Validate() error {
+	if m.WindowDays < 1 || m.WindowDays > maxWindowDays {
+		return fmt.Errorf("%w: window_days must be between 1 and %d", ErrInvalidModel, maxWindowDays)
+	}
+	if m.HalfLifeDays <= 0 || m.HalfLifeDays > maxHalfLifeDays {
+		return fmt.Errorf("%w: half_life_days must be greater than 0 and at most %d", ErrInvalidModel, maxHalfLifeDays)
+	}
+	for intent, signal := range m.Intents {
+		if err := signal.validate(); err != nil {
+			return fmt.Errorf("%w: intent %s: %v", ErrInvalidModel, intent, err)
+		}
+	}
+	if err := m.Messages.validate(); err != nil {
+		return fmt.Errorf("%w: messages: %v", ErrInvalidModel, err)
+	}
+	if err := m.BroadcastReplies.validate(); err != nil {
+		return fmt.Errorf("%w: broadcast_replies: %v", ErrInvalidModel, err)
+	}
+	if m.RecencyMax < 0 || m.RecencyMax > maxPoints {
+		return fmt.Errorf("%w: recency_max must be between 0 and %d", ErrInvalidModel, maxPoints)
+	}
+	if m.ReplyLatencyMax < 0 || m.ReplyLatencyMax > maxPoints {
+		return fmt.Errorf("%w: reply_latency_max must be between 0 and %d", ErrInvalidModel, maxPoints)
+	}
+	if len(m.TagWeights) > maxTagWeights {
+		return fmt.Errorf("%w: at most %d tag weights", ErrInvalidModel, maxTagWeights)
+	}
+	for tagID, weight := range m.TagWeights {
+		if math.Abs(weight) > maxPoints {
+			return fmt.Errorf("%w: tag %s weight must be between -%d and %d", ErrInvalidModel, tagID, maxPoints, maxPoints)
+		}
+	}
+	if m.UpdateStatus {
+		if m.WarmThreshold < 1 || m.HotThreshold > maxPoints || m.WarmThreshold >= m.HotThreshold {
+			return fmt.Errorf("%w: thresholds must satisfy 0 < warm_threshold < hot_threshold <= 100", ErrInvalidModel)
+		}
+	}
+	return nil
+}
+
+func (s Signal) validate() error {
+	if math.Abs(s.Points) > maxPoints {
+		return fmt.Errorf("points must be between -%d and %d", maxPoints, maxPoints)
+	}
+	if s.Max < 0 || s.Max > maxPoints {
+		return fmt.Errorf("max must be between 0 and %d", maxPoints)
+	}
+	return nil
+}
+
+// Signals are a customer's raw, already decayed activity. Weights are sums
+// of 0.5^(age/half-life) over the events in the window.
+type Signals struct {
+	IntentWeights        map[string]float64
+	MessageWeight        float64
+	BroadcastReplyWeight float64
+	DaysSinceLastMessage *float64
+	AvgReplySeconds      *float64
+	TagIDs               []string
+}
+
+// Breakdown explains a score; it is stored with every history entry
+type Breakdown struct {
+	Intents          map[string]float64 `json:"intents,omitempty"`
+	Messages         float64            `json:"messages"`
+	BroadcastReplies float64            `json:"broadcast_replies"`
+	Recency          float64            `json:"recency"`
+	ReplyLatency     float64            `json:"reply_latency"`
+	Tags             float64            `json:"tags"`
+	Total            int                `json:"total"`
+}
+
+// Score computes the 0-100 score of a customer
+func (m Model) Score(s Signals) Breakdown {
+	var b Breakdown
+	sum := 0.0
+
+	for intent, signal := range m.Intents {
+		if points := signal.apply(s.IntentWeights[intent]); points != 0 {
+			if b.Intents == nil {
+				b.Intents = map[string]float64{}
+			}
+			b.Intents[intent] = points
+			sum += points
+		}
+	}
+
+	b.Messages = m.Messages.apply(s.MessageWeight)
+	b.BroadcastReplies = m.BroadcastReplies.apply(s.BroadcastReplyWeight)
+
+	if s.DaysSinceLastMessage != nil {
+		b.Recency = round(m.RecencyMax * clamp(1-*s.DaysSinceLastMessage/float64(m.WindowDays), 0, 1))
+	}
+	if s.AvgReplySeconds != nil {
+		ratio := (slowReplySeconds - *s.AvgReplySeconds) / (slowReplySeconds - fastReplySeconds)
+		b.ReplyLatency = round(m.ReplyLatencyMax * clamp(ratio, 0, 1))
+	}
+	for _, tagID := range s.TagIDs {
+		b.Tags += m.TagWeights[tagID]
+	}
+
+	sum += b.Messages + b.BroadcastReplies + b.Recency + b.ReplyLatency + b.Tags
+	b.Total = int(math.Round(clamp(sum, 0, maxPoints)))
+	return b
+}
+
+// apply turns a decayed event weight into points, capped at Max in either
+// direction
+func (s Signal) apply(weight float64) float64 {
+	return round(clamp(s.Points*weight, -s.Max, s.Max))
+}
+
+// Status returns the lead status for score, or current when the model
+// doesn't manage it. New customers only move once they reach warm.
+func (m Model) Status(current string, score int) string {
+	if !m.UpdateStatus {
+		return current
+	}
+	switch current {
+	case StatusNew, StatusHot, StatusWarm, StatusCold:
+	default:
+		return current
+	}
+
+	switch {
+	case score >= m.HotThreshold:
+		return StatusHot
+	case score >= m.WarmThreshold:
+		return StatusWarm
+	case current == StatusNew:
+		return StatusNew
+	default:
+		return StatusCold
+	}
+}
+
+func clamp(v, min, max float64) float64 {
+	return math.Max(min, math.Min(max, v))
+}
+
+func round(v float64) float64 {
+	return math.Round(v*100) / 100
+}
@@ -0,0 +1,200 @@
+package leadscore
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+
+	"gowa-backend/services/ai"
+)
+
+func TestModelScore(t *testing.T) {
+	m := DefaultModel()
+	m.TagWeights = map[string]float64{"vip": 25, "blocked": -40}
+	days := func(n float64) *float64 { return &n }
+	seconds := days
+
+	// Two orders, one 14 days (one half-life) old, one today
+	decayed := 1 + math.Pow(0.5, 14.0/m.HalfLifeDays)
+
+	tests := []struct {
+		name    string
+		signals Signals
+		want    Breakdown
+	}{
+		{
+			name: "no activity",
+		},
+		{
+			name:    "decayed intents",
+			signals: Signals{IntentWeights: map[string]float64{ai.IntentOrder: decayed, "price_inquiry": 0.25}},
+			want:    Breakdown{Intents: map[string]float64{ai.IntentOrder: 22.5, "price_inquiry": 2}, Total: 25},
+		},
+		{
+			name:    "signals capped at max",
+			signals: Signals{IntentWeights: map[string]float64{ai.IntentOrder: 10}, MessageWeight: 40, BroadcastReplyWeight: 2},
+			want:    Breakdown{Intents: map[string]float64{ai.IntentOrder: 45}, Messages: 15, BroadcastReplies: 10, Total: 70},
+		},
+		{
+			name:    "negative signals capped at max",
+			signals: Signals{IntentWeights: map[string]float64{"complaint": 5}, MessageWeight: 30},
+			want:    Breakdown{Intents: map[string]float64{"complaint": -20}, Messages: 15, Total: 0},
+		},
+		{
+			name:    "recency falls over the window",
+			signals: Signals{DaysSinceLastMessage: days(7.5)},
+			want:    Breakdown{Recency: 15, Total: 15},
+		},
+		{
+			name:    "recency past the window",
+			signals: Signals{DaysSinceLastMessage: days(45)},
+			want:    Breakdown{},
+		},
+		{
+			name:    "fast replies",
+			signals: Signals{AvgReplySeconds: seconds(60)},
+			want:    Breakdown{ReplyLatency: 10, Total: 10},
+		},
+		{
+			name:    "replies halfway to slow",
+			signals: Signals{AvgReplySeconds: seconds((fastReplySeconds + slowReplySeconds) / 2)},
+			want:    Breakdown{ReplyLatency: 5, Total: 5},
+		},
+		{
+			name:    "slow replies",
+			signals: Signals{AvgReplySeconds: seconds(3 * slowReplySeconds)},
+			want:    Breakdown{},
+		},
+		{
+			name:    "tag weights",
+			signals: Signals{TagIDs: []string{"vip", "unknown"}, MessageWeight: 4.4},
+			want:    Breakdown{Messages: 4.4, Tags: 25, Total: 29},
+		},
+		{
+			name:    "total clamped to zero",
+			signals: Signals{TagIDs: []string{"blocked"}, MessageWeight: 10},
+			want:    Breakdown{Messages: 10, Tags: -40, Total: 0},
+		},
+		{
+			name: "total clamped to 100",
+			signals: Signals{
+				IntentWeights:        map[string]float64{ai.IntentOrder: 3, "payment_inquiry": 2},
+				MessageWeight:        15,
+				BroadcastReplyWeight: 3,
+				DaysSinceLastMessage: days(0),
+				AvgReplySeconds:      seconds(0),
+				TagIDs:               []string{"vip"},
+			},
+			want: Breakdown{
+				Intents:  map[string]float64{ai.IntentOrder: 45, "payment_inquiry": 20},
+				Messages: 15, BroadcastReplies: 15, Recency: 20, ReplyLatency: 10, Tags: 25, Total: 100,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := m.Score(tt.signals); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Score() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestModelValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Model)
+		err    bool
+	}{
+		{"default", func(m *Model) {}, false},
+		{"window too short", func(m *Model) { m.WindowDays = 0 }, true},
+		{"window too long", func(m *Model) { m.WindowDays = maxWindowDays + 1 }, true},
+		{"zero half-life", func(m *Model) { m.HalfLifeDays = 0 }, true},
+		{"half-life too long", func(m *Model) { m.HalfLifeDays = maxHalfLifeDays + 0.5 }, true},
+		{"intent points too high", func(m *Model) { m.Intents["spam"] = Signal{Points: 101, Max: 10} }, true},
+		{"negative intent max", func(m *Model) { m.Intents["spam"] = Signal{Points: -5, Max: -5} }, true},
+		{"negative intent points", func(m *Model) { m.Intents["spam"] = Signal{Points: -100, Max: 100} }, false},
+		{"messages max too high", func(m *Model) { m.Messages.Max = 150 }, true},
+		{"broadcast replies points too low", func(m *Model) { m.BroadcastReplies.Points = -101 }, true},
+		{"negative recency", func(m *Model) { m.RecencyMax = -1 }, true},
+		{"reply latency too high", func(m *Model) { m.ReplyLatencyMax = 101 }, true},
+		{"tag weight too high", func(m *Model) { m.TagWeights["vip"] = 100.5 }, true},
+		{"tag weight too low", func(m *Model) { m.TagWeights["spam"] = -101 }, true},
+		{"too many tag weights", func(m *Model) {
+			for i := 0; i <= maxTagWeights; i++ {
+				m.TagWeights[string(rune('a'+i%26))+string(rune('0'+i/26))] = 1
+			}
+		}, true},
+		{"warm threshold zero", func(m *Model) { m.WarmThreshold = 0 }, true},
+		{"hot threshold too high", func(m *Model) { m.HotThreshold = 101 }, true},
+		{"warm threshold not below hot", func(m *Model) { m.WarmThreshold, m.HotThreshold = 70, 70 }, true},
+		{"thresholds ignored without status updates", func(m *Model) { m.UpdateStatus, m.WarmThreshold = false, 0 }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := DefaultModel()
+			tt.modify(&m)
+			err := m.Validate()
+			if (err != nil) != tt.err {
+				t.Fatalf("Validate() error = %v, want error %v", err, tt.err)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidModel) {
+				t.Errorf("Validate() error = %v, want ErrInvalidModel", err)
+			}
+		})
+	}
+}
+
+func TestParseModel(t *testing.T) {
+	m, err := ParseModel([]byte(`{"window_days":60,"intents":{"price_inquiry":{"points":5,"max":10}}}`))
+	if err != nil {
+		t.Fatalf("ParseModel() error = %v", err)
+	}
+	if m.WindowDays != 60 || m.HalfLifeDays != 14 || m.HotThreshold != 70 {
+		t.Errorf("ParseModel() = %+v, want defaults for fields left out", m)
+	}
+	if want := map[string]Signal{"price_inquiry": {Points: 5, Max: 10}}; !reflect.DeepEqual(m.Intents, want) {
+		t.Errorf("ParseModel() intents = %v, want %v", m.Intents, want)
+	}
+
+	for _, data := range []string{`{"window_days":0}`, `{"intents":[]}`, `not json`} {
+		if _, err := ParseModel([]byte(data)); !errors.Is(err, ErrInvalidModel) {
+			t.Errorf("ParseModel(%s) error = %v, want ErrInvalidModel", data, err)
+		}
+	}
+}
+
+func TestModelStatus(t *testing.T) {
+	m := DefaultModel()
+	manual := DefaultModel()
+	manual.UpdateStatus = false
+
+	tests := []struct {
+		name    string
+		model   Model
+		current string
+		score   int
+		want    string
+	}{
+		{"new stays new below warm", m, StatusNew, 39, StatusNew},
+		{"new becomes warm", m, StatusNew, 40, StatusWarm},
+		{"new becomes hot", m, StatusNew, 70, StatusHot},
+		{"hot cools to warm", m, StatusHot, 69, StatusWarm},
+		{"warm cools to cold", m, StatusWarm, 39, StatusCold},
+		{"cold heats up", m, StatusCold, 100, StatusHot},
+		{"customers are kept", m, "customer", 100, "customer"},
+		{"complaints are kept", m, "complaint", 0, "complaint"},
+		{"status updates disabled", manual, StatusCold, 100, StatusCold},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.model.Status(tt.current, tt.score); got != tt.want {
+				t.Errorf("Status(%q, %d) = %q, want %q", tt.current, tt.score, got, tt.want)
+			}
+		})
+	}
+}
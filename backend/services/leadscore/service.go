@@ -0,0 +1,335 @@
+package leadscore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Reasons recorded in lead_score_history
+const (
+	ReasonMessage   = "message"
+	ReasonNightly   = "nightly"
+	ReasonRecompute = "recompute"
+	ReasonManual    = "manual"
+)
+
+// batchSize is how many customers a tenant recompute loads at a time
+const batchSize = 500
+
+// HistoryEntry is one change of a customer's score or status
+type HistoryEntry struct {
+	ID        string          `json:"id" db:"id"`
+	OldScore  *int            `json:"old_score" db:"old_score"`
+	NewScore  int             `json:"new_score" db:"new_score"`
+	OldStatus *string         `json:"old_status" db:"old_status"`
+	NewStatus *string         `json:"new_status" db:"new_status"`
+	Reason    string          `json:"reason" db:"reason"`
+	Breakdown json.RawMessage `json:"breakdown" db:"-"`
+	RawJSON   *string         `json:"-" db:"breakdown"`
+	ChangedBy *string         `json:"changed_by" db:"changed_by"`
+	CreatedAt time.Time       `json:"created_at" db:"created_at"`
+}
+
+// Service scores customers and keeps their score history
+type Service struct {
+	db *sqlx.DB
+}
+
+// NewService creates a lead scoring service
+func NewService(db *sqlx.DB) *Service {
+	return &Service{db: db}
+}
+
+// Model returns the tenant's scoring model, or the default model
+func (s *Service) Model(ctx context.Context, tenantID string) (Model, error) {
+	var data string
+	err := s.db.GetContext(ctx, &data, `SELECT model::text FROM lead_scoring_models WHERE tenant_id = $1`, tenantID)
+	if err == sql.ErrNoRows {
+		return DefaultModel(), nil
+	} else if err != nil {
+		return Model{}, err
+	}
+	return ParseModel([]byte(data))
+}
+
+// SaveModel stores the tenant's scoring model
+func (s *Service) SaveModel(ctx context.Context, tenantID, userID string, m Model) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	data, _ := json.Marshal(m)
+
+	var updatedBy *string
+	if userID != "" {
+		updatedBy = &userID
+	}
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO lead_scoring_models (tenant_id, model, updated_by, updated_at)
+		VALUES ($1, $2::jsonb, $3, NOW())
+		ON CONFLICT (tenant_id) DO UPDATE SET model = EXCLUDED.model, updated_by = EXCLUDED.updated_by, updated_at = NOW()
+	`, tenantID, string(data), updatedBy)
+	return err
+}
+
+// signalRow is a customer with its aggregated signals
+type signalRow struct {
+	ID                   string          `db:"id"`
+	LeadScore            int             `db:"lead_score"`
+	Status               string          `db:"status"`
+	DaysSinceLastMessage sql.NullFloat64 `db:"days_since_last_message"`
+	IntentWeights        string          `db:"intent_weights"`
+	MessageWeight        float64         `db:"message_weight"`
+	AvgReplySeconds      sql.NullFloat64 `db:"avg_reply_seconds"`
+	BroadcastReplyWeight float64         `db:"broadcast_reply_weight"`
+	TagIDs               pq.StringArray  `db:"tag_ids"`
+}
+
+// signalsQuery aggregates the decayed signals of customers. $1 is
+// the tenant, $2 the window in days and $3 the half-life in days; callers
+// append their own conditions and ordering.
+const signalsQuery = `
+	SELECT ci.id, COALESCE(ci.lead_score, 0) as lead_score, COALESCE(ci.status, 'new') as status,
+		(EXTRACT(EPOCH FROM NOW() - ci.last_message_at) / 86400)::float8 as days_since_last_message,
+		COALESCE(intents.weights, '{}')::text as intent_weights,
+		COALESCE(msgs.weight, 0)::float8 as message_weight,
+		msgs.avg_reply_seconds::float8 as avg_reply_seconds,
+		COALESCE(replies.weight, 0)::float8 as broadcast_reply_weight,
+		COALESCE(tags.ids, '{}') as tag_ids
+	FROM customer_insights ci
+	LEFT JOIN LATERAL (
+		SELECT jsonb_object_agg(x.detected_intent, x.weight) as weights
+		FROM (
+			SELECT l.detected_intent, SUM(power(0.5, EXTRACT(EPOCH FROM NOW() - l.created_at) / 86400 / $3)) as weight
+			FROM ai_conversation_logs l
+			WHERE l.tenant_id = ci.tenant_id AND l.customer_jid = ci.customer_jid
+			  AND l.detected_intent IS NOT NULL AND l.created_at >= NOW() - make_interval(days => $2)
+			GROUP BY l.detected_intent
+		) x
+	) intents ON true
+	LEFT JOIN LATERAL (
+		SELECT SUM(power(0.5, (EXTRACT(EPOCH FROM NOW()) - m.timestamp) / 86400 / $3)) FILTER (WHERE NOT m.is_from_me) as weight,
+			AVG(m.timestamp - m.prev_timestamp) FILTER (WHERE NOT m.is_from_me AND m.prev_from_me) as avg_reply_seconds
+		FROM (
+			SELECT timestamp, is_from_me,
+				LAG(timestamp) OVER (ORDER BY timestamp) as prev_timestamp,
+				LAG(is_from_me) OVER (ORDER BY timestamp) as prev_from_me
+			FROM whatsapp_messages
+			WHERE tenant_id = ci.tenant_id AND chat_jid = ci.customer_jid
+			  AND timestamp >= EXTRACT(EPOCH FROM NOW() - make_interval(days => $2))::bigint
+		) m
+	) msgs ON true
+	LEFT JOIN LATERAL (
+		SELECT SUM(power(0.5, EXTRACT(EPOCH FROM NOW() - br.sent_at) / 86400 / $3)) as weight
+		FROM broadcast_recipients br
+		WHERE br.customer_id = ci.id AND br.sent_at >= NOW() - make_interval(days => $2)
+		  AND EXISTS (
+			SELECT 1 FROM whatsapp_messages m
+			WHERE m.tenant_id = ci.tenant_id AND m.chat_jid = ci.customer_jid AND NOT m.is_from_me
+			  AND m.timestamp BETWEEN EXTRACT(EPOCH FROM br.sent_at)::bigint AND EXTRACT(EPOCH FROM br.sent_at + INTERVAL '3 days')::bigint
+		  )
+	) replies ON true
+	LEFT JOIN LATERAL (
+		SELECT array_agg(cta.tag_id::text) as ids FROM customer_tag_assignments cta WHERE cta.customer_id = ci.id
+	) tags ON true
+	WHERE ci.tenant_id = $1 AND ci.customer_jid NOT LIKE '%@g.us'`
+
+func (r signalRow) signals() Signals {
+	sig := Signals{
+		MessageWeight:        r.MessageWeight,
+		BroadcastReplyWeight: r.BroadcastReplyWeight,
+		TagIDs:               r.TagIDs,
+	}
+	json.Unmarshal([]byte(r.IntentWeights), &sig.IntentWeights)
+	if r.DaysSinceLastMessage.Valid {
+		sig.DaysSinceLastMessage = &r.DaysSinceLastMessage.Float64
+	}
+	if r.AvgReplySeconds.Valid {
+		sig.AvgReplySeconds = &r.AvgReplySeconds.Float64
+	}
+	return sig
+}
+
+// RecomputeCustomer rescores one customer. Locked (manually scored)
+// customers and tenants with scoring disabled are left alone. It reports
+// whether the score or status changed.
+func (s *Service) RecomputeCustomer(ctx context.Context, tenantID, customerID, reason string) (bool, error) {
+	model, err := s.Model(ctx, tenantID)
+	if err != nil || !model.Enabled {
+		return false, err
+	}
+
+	var row signalRow
+	err = s.db.GetContext(ctx, &row, signalsQuery+` AND ci.lead_score_locked = false AND ci.id = $4`, tenantID, model.WindowDays, model.HalfLifeDays, customerID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return s.apply(ctx, tenantID, model, row, reason)
+}
+
+// RecomputeTenant rescores all of a tenant's customers and returns how many
+// changed
+func (s *Service) RecomputeTenant(ctx context.Context, tenantID, reason string) (int, error) {
+	model, err := s.Model(ctx, tenantID)
+	if err != nil || !model.Enabled {
+		return 0, err
+	}
+
+	changed := 0
+	after := "00000000-0000-0000-0000-000000000000"
+	for {
+		var rows []signalRow
+		err := s.db.SelectContext(ctx, &rows, signalsQuery+` AND ci.lead_score_locked = false AND ci.id > $4 ORDER BY ci.id LIMIT $5`,
+			tenantID, model.WindowDays, model.HalfLifeDays, after, batchSize)
+		if err != nil {
+			return changed, err
+		}
+
+		for _, row := range rows {
+			ok, err := s.apply(ctx, tenantID, model, row, reason)
+			if err != nil {
+				return changed, err
+			}
+			if ok {
+				changed++
+			}
+		}
+
+		if len(rows) < batchSize {
+			return changed, nil
+		}
+		after = rows[len(rows)-1].ID
+	}
+}
+
+// RecomputeAll rescores the customers of every tenant with scoring enabled
+func (s *Service) RecomputeAll(ctx context.Context, reason string) (int, error) {
+	var tenantIDs []string
+	err := s.db.SelectContext(ctx, &tenantIDs, `
+		SELECT t.id FROM tenants t
+		LEFT JOIN lead_scoring_models m ON m.tenant_id = t.id
+		WHERE m.model IS NULL OR m.model->>'enabled' = 'true'
+	`)
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	var firstErr error
+	for _, tenantID := range tenantIDs {
+		changed, err := s.RecomputeTenant(ctx, tenantID, reason)
+		total += changed
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("tenant %s: %w", tenantID, err)
+		}
+	}
+	return total, firstErr
+}
+
+// apply stores a new score and status when they changed, with a history
+// entry explaining the score
+func (s *Service) apply(ctx context.Context, tenantID string, model Model, row signalRow, reason string) (bool, error) {
+	breakdown := model.Score(row.signals())
+	status := model.Status(row.Status, breakdown.Total)
+	if breakdown.Total == row.LeadScore && status == row.Status {
+		return false, nil
+	}
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+		UPDATE customer_insights
+		SET lead_score = $1, status = $2, lead_score_updated_at = NOW(), updated_at = NOW()
+		WHERE id = $3 AND lead_score_locked = false
+	`, breakdown.Total, status, row.ID)
+	if err != nil {
+		return false, err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		// Locked between reading and writing
+		return false, nil
+	}
+
+	data, _ := json.Marshal(breakdown)
+	if err := s.record(ctx, tx, tenantID, row.ID, &row.LeadScore, breakdown.Total, &row.Status, &status, reason, string(data), ""); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// RecordManual logs a score or status set by a user
+func (s *Service) RecordManual(ctx context.Context, tenantID, customerID, userID string, oldScore, newScore int, oldStatus, newStatus string) error {
+	return s.record(ctx, s.db, tenantID, customerID, &oldScore, newScore, &oldStatus, &newStatus, ReasonManual, "", userID)
+}
+
+func (s *Service) record(ctx context.Context, db sqlx.ExecerContext, tenantID, customerID string, oldScore *int, newScore int, oldStatus, newStatus *string, reason, breakdown, userID string) error {
+	var changedBy *string
+	if userID != "" {
+		changedBy = &userID
+	}
+	var breakdownJSON *string
+	if breakdown != "" {
+		breakdownJSON = &breakdown
+	}
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO lead_score_history (tenant_id, customer_id, old_score, new_score, old_status, new_status, reason, breakdown, changed_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8::jsonb, $9)
+	`, tenantID, customerID, oldScore, newScore, oldStatus, newStatus, reason, breakdownJSON, changedBy)
+	return err
+}
+
+// History returns a page of a customer's score changes, newest first
+func (s *Service) History(ctx context.Context, tenantID, customerID string, limit, offset int) ([]HistoryEntry, int, error) {
+	var total int
+	err := s.db.GetContext(ctx, &total, `SELECT COUNT(*) FROM lead_score_history WHERE tenant_id = $1 AND customer_id = $2`, tenantID, customerID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	entries := []HistoryEntry{}
+	err = s.db.SelectContext(ctx, &entries, `
+		SELECT id, old_score, new_score, old_status, new_status, reason, breakdown::text as breakdown, changed_by, created_at
+		FROM lead_score_history
+		WHERE tenant_id = $1 AND customer_id = $2
+		ORDER BY created_at DESC
+		LIMIT $3 OFFSET $4
+	`, tenantID, customerID, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range entries {
+		if entries[i].RawJSON != nil {
+			entries[i].Breakdown = json.RawMessage(*entries[i].RawJSON)
+		}
+	}
+	return entries, total, nil
+}
+
+// Explain scores a customer with the tenant's model without saving, for
+// showing why a customer has its current score. Locked customers are
+// explained too.
+func (s *Service) Explain(ctx context.Context, tenantID, customerID string) (*Breakdown, error) {
+	model, err := s.Model(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	var row signalRow
+	if err := s.db.GetContext(ctx, &row, signalsQuery+` AND ci.id = $4`, tenantID, model.WindowDays, model.HalfLifeDays, customerID); err != nil {
+		return nil, err
+	}
+	breakdown := model.Score(row.signals())
+	return &breakdown, nil
+}
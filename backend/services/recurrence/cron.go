@@ -0,0 +1,257 @@
+package recurrence
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// searchDays bounds the search for the next run; eight years covers a
+// 29 February that skips a century year
+const searchDays = 8*366 + 1
+
+var monthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var weekdayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// nthWeekday is the nth weekday of a month; n is -1 for the last one
+type nthWeekday struct {
+	weekday time.Weekday
+	n       int
+}
+
+// cronSchedule is a parsed cron expression. Each field is a bitset of the
+// values it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	lastDom                       bool
+	nth                           []nthWeekday
+	// With both day fields restricted a day matching either runs, as in cron
+	domAny, dowAny bool
+}
+
+// parseCron parses a five-field cron expression: minute hour day-of-month
+// month day-of-week. Fields take *, lists, ranges, steps and month and
+// weekday names. Day of month also takes L for the last day, day of week
+// 5#2 for the second Friday and 5L for the last Friday.
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%w: cron expression needs 5 fields (minute hour day month weekday)", ErrInvalidRule)
+	}
+
+	c := &cronSchedule{
+		domAny: fields[2] == "?" || strings.HasPrefix(fields[2], "*"),
+		dowAny: fields[4] == "?" || strings.HasPrefix(fields[4], "*"),
+	}
+	var err error
+	if c.minute, err = parseField(fields[0], 0, 59, nil); err != nil {
+		return nil, cronError("minute", fields[0])
+	}
+	if c.hour, err = parseField(fields[1], 0, 23, nil); err != nil {
+		return nil, cronError("hour", fields[1])
+	}
+	if c.month, err = parseField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, cronError("month", fields[3])
+	}
+
+	for _, part := range strings.Split(fields[2], ",") {
+		if strings.EqualFold(part, "L") {
+			c.lastDom = true
+			continue
+		}
+		bits, err := parseRange(part, 1, 31, nil)
+		if err != nil {
+			return nil, cronError("day of month", fields[2])
+		}
+		c.dom |= bits
+	}
+
+	for _, part := range strings.Split(fields[4], ",") {
+		if i := strings.Index(part, "#"); i > 0 {
+			wd, err := parseValue(part[:i], 0, 7, weekdayNames)
+			n, nerr := strconv.Atoi(part[i+1:])
+			if err != nil || nerr != nil || n < 1 || n > 5 {
+				return nil, cronError("day of week", fields[4])
+			}
+			c.nth = append(c.nth, nthWeekday{weekday: time.Weekday(wd % 7), n: n})
+			continue
+		}
+		if len(part) > 1 && strings.HasSuffix(strings.ToUpper(part), "L") {
+			wd, err := parseValue(part[:len(part)-1], 0, 7, weekdayNames)
+			if err != nil {
+				return nil, cronError("day of week", fields[4])
+			}
+			c.nth = append(c.nth, nthWeekday{weekday: time.Weekday(wd % 7), n: -1})
+			continue
+		}
+		bits, err := parseRange(part, 0, 7, weekdayNames)
+		if err != nil {
+			return nil, cronError("day of week", fields[4])
+		}
+		c.dow |= bits
+	}
+	// 7 is Sunday too
+	if c.dow&(1<<7) != 0 {
+		c.dow = c.dow&^(1<<7) | 1
+	}
+	return c, nil
+}
+
+func cronError(field, value string) error {
+	return fmt.Errorf("%w: invalid cron %s field %q", ErrInvalidRule, field, value)
+}
+
+// parseField parses a comma separated list of ranges
+func parseField(field string, min, max int, names map[string]int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		b, err := parseRange(part, min, max, names)
+		if err != nil {
+			return 0, err
+		}
+		bits |= b
+	}
+	return bits, nil
+}
+
+// parseRange parses *, a value or a range, each with an optional /step
+func parseRange(part string, min, max int, names map[string]int) (uint64, error) {
+	step, stepped := 1, false
+	if i := strings.Index(part, "/"); i >= 0 {
+		s, err := strconv.Atoi(part[i+1:])
+		if err != nil || s < 1 {
+			return 0, fmt.Errorf("invalid step %q", part)
+		}
+		step, stepped, part = s, true, part[:i]
+	}
+
+	lo, hi := min, max
+	switch {
+	case part == "*" || part == "?":
+	case strings.Contains(part, "-"):
+		i := strings.Index(part, "-")
+		var err error
+		if lo, err = parseValue(part[:i], min, max, names); err != nil {
+			return 0, err
+		}
+		if hi, err = parseValue(part[i+1:], min, max, names); err != nil {
+			return 0, err
+		}
+		if lo > hi {
+			return 0, fmt.Errorf("invalid range %q", part)
+		}
+	default:
+		var err error
+		if lo, err = parseValue(part, min, max, names); err != nil {
+			return 0, err
+		}
+		if !stepped {
+			hi = lo
+		}
+	}
+
+	var bits uint64
+	for v := lo; v <= hi; v += step {
+		bits |= 1 << uint(v)
+	}
+	return bits, nil
+}
+
+// parseValue parses a number or a name
+func parseValue(s string, min, max int, names map[string]int) (int, error) {
+	if v, ok := names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < min || v > max {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	return v, nil
+}
+
+// bitRange is a bitset of min through max
+func bitRange(min, max int) uint64 {
+	var bits uint64
+	for v := min; v <= max; v++ {
+		bits |= 1 << uint(v)
+	}
+	return bits
+}
+
+// matchesDay reports whether the schedule runs on a date
+func (c *cronSchedule) matchesDay(day time.Time) bool {
+	if c.month&(1<<uint(day.Month())) == 0 {
+		return false
+	}
+	d, last := day.Day(), daysIn(day.Year(), day.Month())
+
+	domOK := c.dom&(1<<uint(d)) != 0 || (c.lastDom && d == last)
+	dowOK := c.dow&(1<<uint(day.Weekday())) != 0
+	for _, n := range c.nth {
+		if day.Weekday() == n.weekday && ((n.n > 0 && (d-1)/7+1 == n.n) || (n.n < 0 && d+7 > last)) {
+			dowOK = true
+		}
+	}
+
+	if c.domAny || c.dowAny {
+		return domOK && dowOK
+	}
+	return domOK || dowOK
+}
+
+// next returns the first run after the given time on the wall clock of loc,
+// on a date keep accepts. Dates are stepped on the calendar so DST changes
+// never skip or repeat a day.
+func (c *cronSchedule) next(after time.Time, loc *time.Location, keep func(day time.Time) bool) time.Time {
+	local := after.In(loc)
+	day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.UTC)
+	for i := 0; i < searchDays; i++ {
+		if c.matchesDay(day) && (keep == nil || keep(day)) {
+			for h := 0; h < 24; h++ {
+				if c.hour&(1<<uint(h)) == 0 {
+					continue
+				}
+				for m := 0; m < 60; m++ {
+					if c.minute&(1<<uint(m)) == 0 {
+						continue
+					}
+					if t := wallTime(day, h, m, loc); t.After(after) {
+						return t
+					}
+				}
+			}
+		}
+		day = day.AddDate(0, 0, 1)
+	}
+	return time.Time{}
+}
+
+// wallTime is h:m on day in loc. A time skipped when clocks go forward runs
+// at the moment they jump, a time repeated when they go back runs once.
+func wallTime(day time.Time, h, m int, loc *time.Location) time.Time {
+	t := time.Date(day.Year(), day.Month(), day.Day(), h, m, 0, 0, loc)
+	if t.Hour() == h && t.Minute() == m {
+		return t
+	}
+
+	// time.Date normalized a time in the gap to either side of it
+	want := time.Date(day.Year(), day.Month(), day.Day(), h, m, 0, 0, time.UTC)
+	got := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+	start, end := t.ZoneBounds()
+	if got.After(want) {
+		return start
+	}
+	return end
+}
+
+// daysIn is the number of days in a month
+func daysIn(year int, month time.Month) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
@@ -0,0 +1,83 @@
+package recurrence
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseCronInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		expr string
+	}{
+		{"too few fields", "0 9 * *"},
+		{"too many fields", "0 9 * * * 2024"},
+		{"minute out of range", "60 9 * * *"},
+		{"hour out of range", "0 24 * * *"},
+		{"day of month zero", "0 9 0 * *"},
+		{"month out of range", "0 9 * 13 *"},
+		{"unknown month name", "0 9 * foo *"},
+		{"weekday out of range", "0 9 * * 8"},
+		{"reversed range", "0 17-9 * * *"},
+		{"zero step", "*/0 * * * *"},
+		{"nth weekday out of range", "0 9 * * 5#6"},
+		{"bad last weekday", "0 9 * * xL"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseCron(tt.expr); !errors.Is(err, ErrInvalidRule) {
+				t.Errorf("parseCron(%q) error = %v, want ErrInvalidRule", tt.expr, err)
+			}
+		})
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	jakarta := LoadLocation("WIB")
+	at := func(year int, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(year, month, day, hour, minute, 0, 0, jakarta)
+	}
+
+	tests := []struct {
+		name  string
+		expr  string
+		after time.Time
+		want  time.Time
+	}{
+		{"later the same day", "30 9 * * *", at(2024, 5, 1, 8, 0), at(2024, 5, 1, 9, 30)},
+		{"strictly after", "30 9 * * *", at(2024, 5, 1, 9, 30), at(2024, 5, 2, 9, 30)},
+		{"minute step", "*/15 * * * *", at(2024, 5, 1, 8, 1), at(2024, 5, 1, 8, 15)},
+		{"hour list", "0 9,13,17 * * *", at(2024, 5, 1, 13, 0), at(2024, 5, 1, 17, 0)},
+		{"weekday range", "0 8 * * mon-fri", at(2024, 5, 3, 9, 0), at(2024, 5, 6, 8, 0)},
+		{"sunday as 7", "0 8 * * 7", at(2024, 5, 1, 0, 0), at(2024, 5, 5, 8, 0)},
+		{"month names", "0 8 1 jan,jul *", at(2024, 2, 1, 0, 0), at(2024, 7, 1, 8, 0)},
+		{"last day of month", "0 8 L * *", at(2024, 2, 10, 0, 0), at(2024, 2, 29, 8, 0)},
+		{"second friday", "0 10 * * 5#2", at(2024, 5, 1, 0, 0), at(2024, 5, 10, 10, 0)},
+		{"last friday", "0 10 * * 5L", at(2024, 5, 1, 0, 0), at(2024, 5, 31, 10, 0)},
+		{"either day field", "0 7 13 * fri", at(2024, 9, 1, 0, 0), at(2024, 9, 6, 7, 0)},
+		{"31st skips short months", "0 9 31 * *", at(2024, 4, 1, 0, 0), at(2024, 5, 31, 9, 0)},
+		{"leap day", "0 0 29 2 *", at(2024, 3, 1, 0, 0), at(2028, 2, 29, 0, 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatalf("parseCron(%q) error = %v", tt.expr, err)
+			}
+			if got := c.next(tt.after, jakarta, nil); !got.Equal(tt.want) {
+				t.Errorf("next(%q) = %v, want %v", tt.expr, got, tt.want)
+			}
+		})
+	}
+
+	never, err := parseCron("0 0 30 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := never.next(at(2024, 1, 1, 0, 0), jakarta, nil); !got.IsZero() {
+		t.Errorf("next of 30 February = %v, want zero", got)
+	}
+}
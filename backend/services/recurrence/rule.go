@@ -0,0 +1,211 @@
+// Package recurrence computes when recurring broadcasts run. Rules are
+// evaluated on the wall clock of the tenant's timezone, so "every 25th at
+// 10:00" stays at 10:00 local time across DST changes:
+//
+//	daily    every interval days at time
+//	weekly   on days of every interval weeks at time
+//	monthly  on month_day (-1 is the last day), or on the week_ordinal
+//	         weekday (-1 is the last), of every interval months at time
+//	cron     a five-field cron expression
+//	hourly   every interval hours
+package recurrence
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Recurrence types
+const (
+	Hourly  = "hourly"
+	Daily   = "daily"
+	Weekly  = "weekly"
+	Monthly = "monthly"
+	Cron    = "cron"
+)
+
+// ErrInvalidRule wraps every recurrence validation error
+var ErrInvalidRule = errors.New("invalid recurrence")
+
+var dayNames = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// Rule is the recurrence of a broadcast
+type Rule struct {
+	Type     string   `json:"recurrence_type"`
+	Interval int      `json:"recurrence_interval"`
+	Days     []string `json:"recurrence_days"`
+	Time     string   `json:"recurrence_time"`
+	// Monthly rules set MonthDay or WeekOrdinal with Weekday
+	MonthDay    int    `json:"recurrence_month_day"`
+	WeekOrdinal int    `json:"recurrence_week_ordinal"`
+	Weekday     string `json:"recurrence_weekday"`
+	Cron        string `json:"recurrence_cron"`
+}
+
+// Validate checks the rule can be scheduled
+func (r Rule) Validate() error {
+	_, err := r.schedule()
+	return err
+}
+
+// schedule compiles the rule to a cron schedule. Hourly rules have none.
+func (r Rule) schedule() (*cronSchedule, error) {
+	if r.Interval < 0 {
+		return nil, fmt.Errorf("%w: recurrence_interval must be at least 1", ErrInvalidRule)
+	}
+
+	switch r.Type {
+	case Hourly:
+		return nil, nil
+	case Cron:
+		return parseCron(r.Cron)
+	case Daily, Weekly, Monthly:
+	default:
+		return nil, fmt.Errorf("%w: recurrence_type must be hourly, daily, weekly, monthly or cron", ErrInvalidRule)
+	}
+
+	c := &cronSchedule{
+		dom: bitRange(1, 31), month: bitRange(1, 12), dow: bitRange(0, 6),
+		domAny: true, dowAny: true,
+	}
+	hour, minute, err := parseTime(r.Time)
+	if err != nil {
+		return nil, err
+	}
+	c.hour, c.minute = 1<<uint(hour), 1<<uint(minute)
+
+	switch r.Type {
+	case Weekly:
+		if len(r.Days) == 0 {
+			return nil, fmt.Errorf("%w: recurrence_days is required for weekly broadcasts", ErrInvalidRule)
+		}
+		c.dow = 0
+		for _, day := range r.Days {
+			wd, ok := dayNames[strings.ToLower(day)]
+			if !ok {
+				return nil, fmt.Errorf("%w: unknown day %q in recurrence_days", ErrInvalidRule, day)
+			}
+			c.dow |= 1 << uint(wd)
+		}
+	case Monthly:
+		switch {
+		case r.MonthDay != 0 && r.WeekOrdinal != 0:
+			return nil, fmt.Errorf("%w: set either recurrence_month_day or recurrence_week_ordinal, not both", ErrInvalidRule)
+		case r.MonthDay == -1:
+			c.dom, c.lastDom, c.domAny = 0, true, false
+		case r.MonthDay >= 1 && r.MonthDay <= 31:
+			c.dom, c.domAny = 1<<uint(r.MonthDay), false
+		case r.MonthDay != 0:
+			return nil, fmt.Errorf("%w: recurrence_month_day must be 1-31, or -1 for the last day", ErrInvalidRule)
+		case r.WeekOrdinal == -1 || (r.WeekOrdinal >= 1 && r.WeekOrdinal <= 4):
+			wd, ok := dayNames[strings.ToLower(r.Weekday)]
+			if !ok {
+				return nil, fmt.Errorf("%w: recurrence_weekday must be a day name", ErrInvalidRule)
+			}
+			c.dow, c.dowAny = 0, false
+			c.nth = []nthWeekday{{weekday: wd, n: r.WeekOrdinal}}
+		case r.WeekOrdinal != 0:
+			return nil, fmt.Errorf("%w: recurrence_week_ordinal must be 1-4, or -1 for the last", ErrInvalidRule)
+		default:
+			return nil, fmt.Errorf("%w: monthly broadcasts need recurrence_month_day or recurrence_week_ordinal", ErrInvalidRule)
+		}
+	}
+	return c, nil
+}
+
+// parseTime reads an HH:MM or HH:MM:SS time of day; empty is midnight
+func parseTime(s string) (hour, minute int, err error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		t, err = time.Parse("15:04:05", s)
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: recurrence_time must be HH:MM", ErrInvalidRule)
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+// Next returns the first run of the rule after the given time, in loc. The
+// interval counts from the date of after, normally the previous run.
+func (r Rule) Next(after time.Time, loc *time.Location) (time.Time, error) {
+	c, err := r.schedule()
+	if err != nil {
+		return time.Time{}, err
+	}
+	interval := r.Interval
+	if interval < 1 {
+		interval = 1
+	}
+	if r.Type == Hourly {
+		return after.Add(time.Duration(interval) * time.Hour).In(loc), nil
+	}
+
+	local := after.In(loc)
+	anchor := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.UTC)
+	var keep func(day time.Time) bool
+	if interval > 1 {
+		switch r.Type {
+		case Daily:
+			keep = func(day time.Time) bool {
+				return int(day.Sub(anchor).Hours()/24)%interval == 0
+			}
+		case Weekly:
+			keep = func(day time.Time) bool {
+				return int(weekStart(day).Sub(weekStart(anchor)).Hours()/24/7)%interval == 0
+			}
+		case Monthly:
+			keep = func(day time.Time) bool {
+				months := (day.Year()-anchor.Year())*12 + int(day.Month()) - int(anchor.Month())
+				return months%interval == 0
+			}
+		}
+	}
+
+	next := c.next(after, loc, keep)
+	if next.IsZero() {
+		return next, fmt.Errorf("%w: the rule never runs", ErrInvalidRule)
+	}
+	return next.In(loc), nil
+}
+
+// weekStart is the Monday of a date's week
+func weekStart(day time.Time) time.Time {
+	return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+}
+
+// Runs lists up to n runs, starting with first, the broadcast's scheduled
+// time. Runs after end are left out, and with remaining zero or more no more
+// than remaining runs are listed.
+func (r Rule) Runs(first time.Time, loc *time.Location, n int, end *time.Time, remaining int) ([]time.Time, error) {
+	if remaining >= 0 && remaining < n {
+		n = remaining
+	}
+
+	runs := []time.Time{}
+	run := first.In(loc)
+	for len(runs) < n {
+		if end != nil && run.After(*end) {
+			break
+		}
+		runs = append(runs, run)
+
+		var err error
+		if run, err = r.Next(run, loc); err != nil {
+			return runs, err
+		}
+	}
+	return runs, nil
+}
@@ -0,0 +1,245 @@
+package recurrence
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func mustLoad(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestRuleNext(t *testing.T) {
+	jakarta := LoadLocation("WIB")
+	newYork := mustLoad(t, "America/New_York")
+	berlin := mustLoad(t, "Europe/Berlin")
+
+	tests := []struct {
+		name  string
+		rule  Rule
+		after time.Time
+		loc   *time.Location
+		want  time.Time
+	}{
+		{
+			name:  "daily",
+			rule:  Rule{Type: Daily, Time: "09:00"},
+			after: time.Date(2024, 5, 1, 9, 0, 0, 0, jakarta),
+			loc:   jakarta,
+			want:  time.Date(2024, 5, 2, 9, 0, 0, 0, jakarta),
+		},
+		{
+			name:  "every third day",
+			rule:  Rule{Type: Daily, Interval: 3, Time: "09:00:00"},
+			after: time.Date(2024, 5, 1, 9, 0, 0, 0, jakarta),
+			loc:   jakarta,
+			want:  time.Date(2024, 5, 4, 9, 0, 0, 0, jakarta),
+		},
+		{
+			name:  "hourly",
+			rule:  Rule{Type: Hourly, Interval: 6},
+			after: time.Date(2024, 5, 1, 21, 15, 0, 0, jakarta),
+			loc:   jakarta,
+			want:  time.Date(2024, 5, 2, 3, 15, 0, 0, jakarta),
+		},
+		{
+			name:  "weekly on several days",
+			rule:  Rule{Type: Weekly, Days: []string{"Monday", "thursday"}, Time: "08:00"},
+			after: time.Date(2024, 5, 6, 8, 0, 0, 0, jakarta),
+			loc:   jakarta,
+			want:  time.Date(2024, 5, 9, 8, 0, 0, 0, jakarta),
+		},
+		{
+			name:  "every other week",
+			rule:  Rule{Type: Weekly, Interval: 2, Days: []string{"monday"}, Time: "08:00"},
+			after: time.Date(2024, 5, 6, 8, 0, 0, 0, jakarta),
+			loc:   jakarta,
+			want:  time.Date(2024, 5, 20, 8, 0, 0, 0, jakarta),
+		},
+		{
+			name:  "monthly on the last day",
+			rule:  Rule{Type: Monthly, MonthDay: -1, Time: "17:00"},
+			after: time.Date(2024, 1, 31, 17, 0, 0, 0, jakarta),
+			loc:   jakarta,
+			want:  time.Date(2024, 2, 29, 17, 0, 0, 0, jakarta),
+		},
+		{
+			name:  "monthly on the 31st",
+			rule:  Rule{Type: Monthly, MonthDay: 31, Time: "10:00"},
+			after: time.Date(2024, 1, 31, 10, 0, 0, 0, jakarta),
+			loc:   jakarta,
+			want:  time.Date(2024, 3, 31, 10, 0, 0, 0, jakarta),
+		},
+		{
+			name:  "quarterly on the first monday",
+			rule:  Rule{Type: Monthly, Interval: 3, WeekOrdinal: 1, Weekday: "monday", Time: "10:00"},
+			after: time.Date(2024, 1, 1, 10, 0, 0, 0, jakarta),
+			loc:   jakarta,
+			want:  time.Date(2024, 4, 1, 10, 0, 0, 0, jakarta),
+		},
+		{
+			name:  "monthly on the last friday",
+			rule:  Rule{Type: Monthly, WeekOrdinal: -1, Weekday: "friday", Time: "16:00"},
+			after: time.Date(2024, 5, 31, 16, 0, 0, 0, jakarta),
+			loc:   jakarta,
+			want:  time.Date(2024, 6, 28, 16, 0, 0, 0, jakarta),
+		},
+		{
+			name:  "cron",
+			rule:  Rule{Type: Cron, Cron: "0 9 * * 1-5"},
+			after: time.Date(2024, 5, 3, 9, 0, 0, 0, jakarta),
+			loc:   jakarta,
+			want:  time.Date(2024, 5, 6, 9, 0, 0, 0, jakarta),
+		},
+
+		// Indonesian time zones
+		{
+			name:  "WIB",
+			rule:  Rule{Type: Daily, Time: "09:00"},
+			after: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+			loc:   LoadLocation("WIB"),
+			want:  time.Date(2024, 5, 1, 2, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "WITA",
+			rule:  Rule{Type: Daily, Time: "09:00"},
+			after: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+			loc:   LoadLocation("WITA"),
+			want:  time.Date(2024, 5, 1, 1, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "WIT",
+			rule:  Rule{Type: Daily, Time: "09:00"},
+			after: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+			loc:   LoadLocation("WIT"),
+			want:  time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC), // 09:00 WIT has passed
+		},
+		{
+			name:  "WIT day starts before UTC",
+			rule:  Rule{Type: Weekly, Days: []string{"saturday"}, Time: "07:00"},
+			after: time.Date(2024, 5, 3, 21, 0, 0, 0, time.UTC), // Saturday 06:00 WIT
+			loc:   LoadLocation("WIT"),
+			want:  time.Date(2024, 5, 3, 22, 0, 0, 0, time.UTC),
+		},
+
+		// DST
+		{
+			name:  "local time kept when clocks go forward",
+			rule:  Rule{Type: Daily, Time: "10:00"},
+			after: time.Date(2024, 3, 9, 10, 0, 0, 0, newYork),
+			loc:   newYork,
+			want:  time.Date(2024, 3, 10, 14, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "local time kept when clocks go back",
+			rule:  Rule{Type: Daily, Time: "10:00"},
+			after: time.Date(2024, 11, 2, 10, 0, 0, 0, newYork),
+			loc:   newYork,
+			want:  time.Date(2024, 11, 3, 15, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "skipped time runs when clocks jump",
+			rule:  Rule{Type: Daily, Time: "02:30"},
+			after: time.Date(2024, 3, 9, 2, 30, 0, 0, newYork),
+			loc:   newYork,
+			want:  time.Date(2024, 3, 10, 7, 0, 0, 0, time.UTC), // 03:00 EDT
+		},
+		{
+			name:  "repeated time runs once",
+			rule:  Rule{Type: Daily, Time: "01:30"},
+			after: time.Date(2024, 11, 3, 5, 30, 0, 0, time.UTC), // 01:30 EDT
+			loc:   newYork,
+			want:  time.Date(2024, 11, 4, 6, 30, 0, 0, time.UTC), // 01:30 EST the next day
+		},
+		{
+			name:  "every other day across DST",
+			rule:  Rule{Type: Daily, Interval: 2, Time: "09:00"},
+			after: time.Date(2024, 3, 30, 9, 0, 0, 0, berlin),
+			loc:   berlin,
+			want:  time.Date(2024, 4, 1, 7, 0, 0, 0, time.UTC), // 09:00 CEST
+		},
+		{
+			name:  "hourly counts real hours across DST",
+			rule:  Rule{Type: Hourly, Interval: 1},
+			after: time.Date(2024, 3, 31, 0, 30, 0, 0, time.UTC), // 01:30 CET
+			loc:   berlin,
+			want:  time.Date(2024, 3, 31, 1, 30, 0, 0, time.UTC), // 03:30 CEST
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.rule.Next(tt.after, tt.loc)
+			if err != nil {
+				t.Fatalf("Next() error = %v", err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("Next() = %v, want %v", got, tt.want.In(tt.loc))
+			}
+			if got.Location() != tt.loc {
+				t.Errorf("Next() location = %v, want %v", got.Location(), tt.loc)
+			}
+		})
+	}
+}
+
+func TestRuleValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+	}{
+		{"unknown type", Rule{Type: "yearly"}},
+		{"negative interval", Rule{Type: Daily, Interval: -1}},
+		{"bad time", Rule{Type: Daily, Time: "9am"}},
+		{"weekly without days", Rule{Type: Weekly, Time: "09:00"}},
+		{"weekly unknown day", Rule{Type: Weekly, Days: []string{"funday"}}},
+		{"monthly without day", Rule{Type: Monthly}},
+		{"monthly with both", Rule{Type: Monthly, MonthDay: 1, WeekOrdinal: 1, Weekday: "monday"}},
+		{"month day out of range", Rule{Type: Monthly, MonthDay: 32}},
+		{"week ordinal out of range", Rule{Type: Monthly, WeekOrdinal: 5, Weekday: "monday"}},
+		{"week ordinal without weekday", Rule{Type: Monthly, WeekOrdinal: 2}},
+		{"bad cron", Rule{Type: Cron, Cron: "every day"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rule.Validate(); !errors.Is(err, ErrInvalidRule) {
+				t.Errorf("Validate() error = %v, want ErrInvalidRule", err)
+			}
+		})
+	}
+}
+
+func TestNormalizeTimezone(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		err  bool
+	}{
+		{"WIB", "Asia/Jakarta", false},
+		{"wita", "Asia/Makassar", false},
+		{" WIT ", "Asia/Jayapura", false},
+		{"Europe/Berlin", "Europe/Berlin", false},
+		{"Local", "", true},
+		{"", "", true},
+		{"Mars/Olympus", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NormalizeTimezone(tt.name)
+			if (err != nil) != tt.err {
+				t.Fatalf("NormalizeTimezone(%q) error = %v", tt.name, err)
+			}
+			if got != tt.want {
+				t.Errorf("NormalizeTimezone(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package recurrence
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	// Runtime images ship without a zoneinfo database
+	_ "time/tzdata"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// DefaultTimezone is the timezone of tenants that did not pick one
+const DefaultTimezone = "Asia/Jakarta"
+
+// zoneAliases maps the Indonesian time zones to their IANA names
+var zoneAliases = map[string]string{
+	"WIB":  "Asia/Jakarta",
+	"WITA": "Asia/Makassar",
+	"WIT":  "Asia/Jayapura",
+}
+
+// NormalizeTimezone checks name is an IANA timezone, or WIB, WITA or WIT,
+// and returns its IANA name
+func NormalizeTimezone(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if alias, ok := zoneAliases[strings.ToUpper(name)]; ok {
+		return alias, nil
+	}
+	if name == "" || name == "Local" {
+		return "", fmt.Errorf("%w: unknown timezone %q", ErrInvalidRule, name)
+	}
+	if _, err := time.LoadLocation(name); err != nil {
+		return "", fmt.Errorf("%w: unknown timezone %q", ErrInvalidRule, name)
+	}
+	return name, nil
+}
+
+// LoadLocation loads a tenant timezone, falling back to DefaultTimezone
+func LoadLocation(name string) *time.Location {
+	if name, err := NormalizeTimezone(name); err == nil {
+		if loc, err := time.LoadLocation(name); err == nil {
+			return loc
+		}
+	}
+	loc, _ := time.LoadLocation(DefaultTimezone)
+	return loc
+}
+
+// TenantLocation loads the timezone of a tenant
+func TenantLocation(ctx context.Context, db *sqlx.DB, tenantID string) (*time.Location, error) {
+	var name string
+	err := db.GetContext(ctx, &name, `SELECT COALESCE(timezone, '') FROM tenants WHERE id = $1`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return LoadLocation(name), nil
+}
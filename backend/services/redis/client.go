@@ -3,6 +3,7 @@ package redis
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -10,7 +11,11 @@ import (
 
 // Client wraps the Redis client with our custom methods
 type Client struct {
-	rdb *redis.Client
+	rdb      *redis.Client
+	consumer string
+
+	sweepMu   sync.Mutex
+	lastSweep time.Time
 }
 
 // Config holds Redis configuration
@@ -39,7 +44,11 @@ func NewClient(config Config) (*Client, error) {
 		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
 	}
 
-	return &Client{rdb: rdb}, nil
+	c := &Client{rdb: rdb, consumer: consumerName()}
+	if err := c.setupQueues(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
 // Close closes the Redis connection
@@ -4,17 +4,40 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
 const (
-	// Queue names
-	AIQueueKey        = "ai:messages:queue"
-	BroadcastQueueKey = "broadcast:messages:queue"
+	// Queue names. Each queue is a stream that workers read as
+	// ConsumerGroup and acknowledge once they processed an entry.
+	AIQueueKey        = "ai:messages:stream"
+	BroadcastQueueKey = "broadcast:messages:stream"
+
+	// ConsumerGroup is the group workers read the queues as
+	ConsumerGroup = "workers"
+
+	// ClaimIdle is how long an entry may stay unacknowledged before another
+	// consumer claims it, e.g. because the worker reading it crashed
+	ClaimIdle = 2 * time.Minute
+
+	// MaxDeliveries is how often an entry is handed to a worker before it is
+	// moved to the queue's dead letter stream
+	MaxDeliveries = 5
+
+	// deadLetterMaxLen caps the dead letter streams
+	deadLetterMaxLen = 10000
 )
 
+// legacyQueues are the lists the queues were before they became streams
+var legacyQueues = map[string]string{
+	"ai:messages:queue":        AIQueueKey,
+	"broadcast:messages:queue": BroadcastQueueKey,
+}
+
 // MessagePayload represents a message in the AI processing queue
 type MessagePayload struct {
 	TenantID    string `json:"tenant_id"`
@@ -22,16 +45,203 @@ type MessagePayload struct {
 	SenderJID   string `json:"sender_jid"`
 	MessageText string `json:"message_text"`
 	Timestamp   int64  `json:"timestamp"`
+
+	// EntryID and Attempts are set when the message is popped
+	EntryID  string `json:"-"`
+	Attempts int    `json:"-"`
 }
 
 // BroadcastMessagePayload represents a broadcast message in the queue
 type BroadcastMessagePayload struct {
-	TenantID      string `json:"tenant_id"`
-	BroadcastID   string `json:"broadcast_id"`
-	RecipientID   string `json:"recipient_id"`
-	CustomerJID   string `json:"customer_jid"`
-	Message       string `json:"message"`
-	CustomerName  string `json:"customer_name,omitempty"`
+	TenantID     string `json:"tenant_id"`
+	BroadcastID  string `json:"broadcast_id"`
+	RecipientID  string `json:"recipient_id"`
+	CustomerJID  string `json:"customer_jid"`
+	Message      string `json:"message"`
+	CustomerName string `json:"customer_name,omitempty"`
+
+	// EntryID and Attempts are set when the message is popped
+	EntryID  string `json:"-"`
+	Attempts int    `json:"-"`
+}
+
+// DeadLetterKey returns the stream entries of a queue are moved to once
+// they were delivered MaxDeliveries times
+func DeadLetterKey(queueKey string) string {
+	return queueKey + ":dead"
+}
+
+// consumerName names this process in the consumer groups
+func consumerName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "worker"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// setupQueues creates the consumer groups and moves messages still waiting
+// in the old lists onto the streams
+func (c *Client) setupQueues(ctx context.Context) error {
+	for _, stream := range []string{AIQueueKey, BroadcastQueueKey} {
+		err := c.rdb.XGroupCreateMkStream(ctx, stream, ConsumerGroup, "0").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return fmt.Errorf("failed to create consumer group on %s: %w", stream, err)
+		}
+	}
+
+	for list, stream := range legacyQueues {
+		for {
+			item, err := c.rdb.LPop(ctx, list).Result()
+			if err == redis.Nil {
+				break
+			} else if err != nil {
+				return fmt.Errorf("failed to move %s: %w", list, err)
+			}
+			if err := c.add(ctx, stream, item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// add appends an encoded payload to a queue
+func (c *Client) add(ctx context.Context, stream, data string) error {
+	return c.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		Values: map[string]interface{}{"payload": data},
+	}).Err()
+}
+
+// entry is a queue entry handed to this consumer
+type entry struct {
+	id       string
+	data     string
+	attempts int
+}
+
+// pop hands this consumer the next entry of a queue: first one another
+// consumer left unacknowledged for ClaimIdle, then a new one, waiting up to
+// timeout. Entries delivered more than MaxDeliveries times are dead-lettered
+// on the way. It returns nil when there is no entry.
+func (c *Client) pop(ctx context.Context, stream string, timeout time.Duration) (*entry, error) {
+	for {
+		claimed, _, err := c.rdb.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   stream,
+			Group:    ConsumerGroup,
+			Consumer: c.consumer,
+			MinIdle:  ClaimIdle,
+			Start:    "0-0",
+			Count:    1,
+		}).Result()
+		if err != nil && strings.HasPrefix(err.Error(), "NOGROUP") {
+			// The stream or its group is gone, e.g. after a flush
+			if err := c.setupQueues(ctx); err != nil {
+				return nil, err
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		c.sweepConsumers(ctx, len(claimed) > 0)
+
+		var msg redis.XMessage
+		attempts := 1
+		if len(claimed) > 0 {
+			msg = claimed[0]
+			pending, err := c.rdb.XPendingExt(ctx, &redis.XPendingExtArgs{
+				Stream: stream,
+				Group:  ConsumerGroup,
+				Start:  msg.ID,
+				End:    msg.ID,
+				Count:  1,
+			}).Result()
+			if err != nil {
+				return nil, err
+			}
+			if len(pending) > 0 {
+				attempts = int(pending[0].RetryCount)
+			}
+		} else {
+			streams, err := c.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+				Group:    ConsumerGroup,
+				Consumer: c.consumer,
+				Streams:  []string{stream, ">"},
+				Count:    1,
+				Block:    timeout,
+			}).Result()
+			if err == redis.Nil {
+				return nil, nil // No message available
+			} else if err != nil {
+				return nil, err
+			}
+			if len(streams) == 0 || len(streams[0].Messages) == 0 {
+				return nil, nil
+			}
+			msg = streams[0].Messages[0]
+		}
+
+		data, _ := msg.Values["payload"].(string)
+		if attempts <= MaxDeliveries {
+			return &entry{id: msg.ID, data: data, attempts: attempts}, nil
+		}
+		if err := c.deadLetter(ctx, stream, msg.ID, data, attempts); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// sweepConsumers removes consumers that stopped reading, e.g. workers that
+// were restarted, once nothing is pending for them anymore. It runs after
+// this consumer claimed another's entry, and otherwise every ClaimIdle.
+func (c *Client) sweepConsumers(ctx context.Context, claimed bool) {
+	c.sweepMu.Lock()
+	if !claimed && time.Since(c.lastSweep) < ClaimIdle {
+		c.sweepMu.Unlock()
+		return
+	}
+	c.lastSweep = time.Now()
+	c.sweepMu.Unlock()
+
+	for _, stream := range []string{AIQueueKey, BroadcastQueueKey} {
+		consumers, err := c.rdb.XInfoConsumers(ctx, stream, ConsumerGroup).Result()
+		if err != nil {
+			continue
+		}
+		for _, consumer := range consumers {
+			// A consumer waiting for entries is seen at least every read
+			// timeout, so one idle for ClaimIdle is gone
+			if consumer.Name == c.consumer || consumer.Pending > 0 || consumer.Idle < ClaimIdle {
+				continue
+			}
+			c.rdb.XGroupDelConsumer(ctx, stream, ConsumerGroup, consumer.Name)
+		}
+	}
+}
+
+// ack acknowledges a processed entry and removes it from the queue
+func (c *Client) ack(ctx context.Context, stream, id string) error {
+	if err := c.rdb.XAck(ctx, stream, ConsumerGroup, id).Err(); err != nil {
+		return err
+	}
+	return c.rdb.XDel(ctx, stream, id).Err()
+}
+
+// deadLetter moves an entry that cannot be processed to the queue's dead
+// letter stream
+func (c *Client) deadLetter(ctx context.Context, stream, id, data string, attempts int) error {
+	err := c.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: DeadLetterKey(stream),
+		MaxLen: deadLetterMaxLen,
+		Approx: true,
+		Values: map[string]interface{}{"payload": data, "entry_id": id, "attempts": attempts},
+	}).Err()
+	if err != nil {
+		return err
+	}
+	return c.ack(ctx, stream, id)
 }
 
 // PushToAIQueue adds a message to the AI processing queue
@@ -41,31 +251,34 @@ func (c *Client) PushToAIQueue(ctx context.Context, payload *MessagePayload) err
 		return fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
-	return c.rdb.RPush(ctx, AIQueueKey, data).Err()
+	return c.add(ctx, AIQueueKey, string(data))
 }
 
-// PopFromAIQueue retrieves and removes a message from the AI queue
+// PopFromAIQueue retrieves a message from the AI queue. The message stays
+// pending until AckAIMessage; unacknowledged messages are handed out again
+// after ClaimIdle.
 func (c *Client) PopFromAIQueue(ctx context.Context, timeout time.Duration) (*MessagePayload, error) {
-	result, err := c.rdb.BLPop(ctx, timeout, AIQueueKey).Result()
-	if err != nil {
-		if err == redis.Nil {
-			return nil, nil // No message available
-		}
+	e, err := c.pop(ctx, AIQueueKey, timeout)
+	if err != nil || e == nil {
 		return nil, err
 	}
 
-	if len(result) < 2 {
-		return nil, fmt.Errorf("unexpected result format")
-	}
-
 	var payload MessagePayload
-	if err := json.Unmarshal([]byte(result[1]), &payload); err != nil {
+	if err := json.Unmarshal([]byte(e.data), &payload); err != nil {
+		c.deadLetter(ctx, AIQueueKey, e.id, e.data, e.attempts)
 		return nil, fmt.Errorf("failed to unmarshal payload: %w", err)
 	}
+	payload.EntryID = e.id
+	payload.Attempts = e.attempts
 
 	return &payload, nil
 }
 
+// AckAIMessage acknowledges a processed AI queue message
+func (c *Client) AckAIMessage(ctx context.Context, payload *MessagePayload) error {
+	return c.ack(ctx, AIQueueKey, payload.EntryID)
+}
+
 // PushToBroadcastQueue adds a broadcast message to the queue
 func (c *Client) PushToBroadcastQueue(ctx context.Context, payload *BroadcastMessagePayload) error {
 	data, err := json.Marshal(payload)
@@ -73,32 +286,98 @@ func (c *Client) PushToBroadcastQueue(ctx context.Context, payload *BroadcastMes
 		return fmt.Errorf("failed to marshal broadcast payload: %w", err)
 	}
 
-	return c.rdb.RPush(ctx, BroadcastQueueKey, data).Err()
+	return c.add(ctx, BroadcastQueueKey, string(data))
 }
 
-// PopFromBroadcastQueue retrieves and removes a broadcast message from the queue
+// PopFromBroadcastQueue retrieves a broadcast message from the queue. The
+// message stays pending until AckBroadcastMessage; unacknowledged messages
+// are handed out again after ClaimIdle.
 func (c *Client) PopFromBroadcastQueue(ctx context.Context, timeout time.Duration) (*BroadcastMessagePayload, error) {
-	result, err := c.rdb.BLPop(ctx, timeout, BroadcastQueueKey).Result()
+	e, err := c.pop(ctx, BroadcastQueueKey, timeout)
+	if err != nil || e == nil {
+		return nil, err
+	}
+
+	var payload BroadcastMessagePayload
+	if err := json.Unmarshal([]byte(e.data), &payload); err != nil {
+		c.deadLetter(ctx, BroadcastQueueKey, e.id, e.data, e.attempts)
+		return nil, fmt.Errorf("failed to unmarshal broadcast payload: %w", err)
+	}
+	payload.EntryID = e.id
+	payload.Attempts = e.attempts
+
+	return &payload, nil
+}
+
+// AckBroadcastMessage acknowledges a processed broadcast message
+func (c *Client) AckBroadcastMessage(ctx context.Context, payload *BroadcastMessagePayload) error {
+	return c.ack(ctx, BroadcastQueueKey, payload.EntryID)
+}
+
+// broadcastEntries returns the broadcast messages in the queue by entry ID,
+// including those a worker holds but has not acknowledged yet
+func (c *Client) broadcastEntries(ctx context.Context) (map[string]BroadcastMessagePayload, error) {
+	msgs, err := c.rdb.XRange(ctx, BroadcastQueueKey, "-", "+").Result()
 	if err != nil {
-		if err == redis.Nil {
-			return nil, nil // No message available
+		return nil, err
+	}
+
+	entries := map[string]BroadcastMessagePayload{}
+	for _, msg := range msgs {
+		data, _ := msg.Values["payload"].(string)
+		var payload BroadcastMessagePayload
+		if err := json.Unmarshal([]byte(data), &payload); err == nil {
+			entries[msg.ID] = payload
 		}
+	}
+	return entries, nil
+}
+
+// RemoveBroadcastMessages takes a broadcast's messages back out of the
+// queue and returns the recipient IDs removed. Messages a worker holds are
+// removed as well; the worker finds their recipient no longer queued.
+func (c *Client) RemoveBroadcastMessages(ctx context.Context, broadcastID string) ([]string, error) {
+	entries, err := c.broadcastEntries(ctx)
+	if err != nil {
 		return nil, err
 	}
 
-	if len(result) < 2 {
-		return nil, fmt.Errorf("unexpected result format")
+	removed := []string{}
+	for id, payload := range entries {
+		if payload.BroadcastID != broadcastID {
+			continue
+		}
+		if err := c.rdb.XAck(ctx, BroadcastQueueKey, ConsumerGroup, id).Err(); err != nil {
+			return removed, err
+		}
+		n, err := c.rdb.XDel(ctx, BroadcastQueueKey, id).Result()
+		if err != nil {
+			return removed, err
+		}
+		if n > 0 {
+			removed = append(removed, payload.RecipientID)
+		}
 	}
+	return removed, nil
+}
 
-	var payload BroadcastMessagePayload
-	if err := json.Unmarshal([]byte(result[1]), &payload); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal broadcast payload: %w", err)
+// QueuedBroadcastRecipients returns the recipient IDs of all broadcast
+// messages in the queue, waiting or held by a worker
+func (c *Client) QueuedBroadcastRecipients(ctx context.Context) ([]string, error) {
+	entries, err := c.broadcastEntries(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	return &payload, nil
+	ids := []string{}
+	for _, payload := range entries {
+		ids = append(ids, payload.RecipientID)
+	}
+	return ids, nil
 }
 
-// GetQueueLength returns the number of items in a queue
+// GetQueueLength returns the number of items in a queue, including those
+// handed out but not acknowledged yet
 func (c *Client) GetQueueLength(ctx context.Context, queueKey string) (int64, error) {
-	return c.rdb.LLen(ctx, queueKey).Result()
+	return c.rdb.XLen(ctx, queueKey).Result()
 }
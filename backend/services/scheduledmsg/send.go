@@ -0,0 +1,159 @@
+package scheduledmsg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gowa-backend/services/broadcast"
+	"gowa-backend/services/whatsapp"
+)
+
+// FailureOptedOut is the error code of messages not sent because the
+// customer opted out
+const FailureOptedOut = "opted_out"
+
+// claimLease is how long a claimed message is held before it is given up on,
+// should sending it never finish
+const claimLease = 10 * time.Minute
+
+// Sender sends scheduled messages through WhatsApp
+type Sender interface {
+	broadcast.MediaUploader
+	SendMessage(ctx context.Context, tenantID string, recipientJID string, message string) (string, error)
+	SendUploadedMedia(ctx context.Context, tenantID string, recipientJID string, media *whatsapp.UploadedMedia, caption string) (string, error)
+}
+
+// Result counts what a pass over due messages did
+type Result struct {
+	Sent     int
+	Retrying int
+	Failed   int
+}
+
+// ProcessDue claims up to limit due messages and sends them, attributed to
+// whoever scheduled them. Transient failures are retried with backoff up to
+// broadcast.MaxAttempts; other failures fail the message. Due messages to
+// customers who opted out fail without being sent. Messages still claimed
+// after claimLease may have been sent, so they fail as unknown instead of
+// being sent again. The first error recording an outcome is returned.
+func (s *Service) ProcessDue(ctx context.Context, sender Sender, limit int) (Result, error) {
+	var result Result
+	var firstErr error
+
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE scheduled_messages SET status = 'failed', error_code = $1,
+			error_message = 'sending was interrupted, the message may have been sent', updated_at = NOW()
+		WHERE status = 'sending' AND claimed_at < NOW() - make_interval(secs => $2)
+	`, broadcast.FailureUnknown, claimLease.Seconds())
+	if err != nil {
+		return result, err
+	}
+	interrupted, _ := res.RowsAffected()
+	result.Failed += int(interrupted)
+
+	res, err = s.db.ExecContext(ctx, `
+		UPDATE scheduled_messages m SET status = 'failed', error_code = $1,
+			error_message = 'customer opted out', updated_at = NOW()
+		FROM customer_insights ci
+		WHERE ci.id = m.insight_id AND ci.opted_out = true
+		  AND m.status = 'pending' AND COALESCE(m.next_attempt_at, m.scheduled_at) <= NOW()
+	`, FailureOptedOut)
+	if err != nil {
+		return result, err
+	}
+	optedOut, _ := res.RowsAffected()
+	result.Failed += int(optedOut)
+
+	var messages []Message
+	err = s.db.SelectContext(ctx, &messages, `
+		WITH claimed AS (
+			UPDATE scheduled_messages m SET status = 'sending', claimed_at = NOW(), updated_at = NOW()
+			WHERE m.id IN (
+				SELECT d.id FROM scheduled_messages d
+				LEFT JOIN customer_insights ci ON ci.id = d.insight_id
+				WHERE d.status = 'pending' AND COALESCE(d.next_attempt_at, d.scheduled_at) <= NOW()
+				  AND COALESCE(ci.opted_out, false) = false
+				ORDER BY COALESCE(d.next_attempt_at, d.scheduled_at)
+				LIMIT $1
+				FOR UPDATE OF d SKIP LOCKED
+			)
+			RETURNING m.id
+		)
+		SELECT q.* FROM (`+messageSelect+`) q
+		JOIN claimed ON claimed.id = q.id
+	`, limit)
+	if err != nil {
+		return result, err
+	}
+
+	for _, msg := range messages {
+		messageID, sendErr := s.send(ctx, sender, msg)
+		if sendErr == nil {
+			_, err = s.db.ExecContext(ctx, `
+				UPDATE scheduled_messages SET status = 'sent', sent_at = NOW(), message_id = $2,
+					error_code = NULL, error_message = NULL, updated_at = NOW()
+				WHERE id = $1
+			`, msg.ID, messageID)
+			result.Sent++
+		} else if code := broadcast.Classify(sendErr); broadcast.Transient(code) && msg.RetryCount+1 < broadcast.MaxAttempts {
+			_, err = s.db.ExecContext(ctx, `
+				UPDATE scheduled_messages SET status = 'pending', retry_count = COALESCE(retry_count, 0) + 1,
+					next_attempt_at = NOW() + make_interval(secs => $2), error_code = $3, error_message = $4, updated_at = NOW()
+				WHERE id = $1
+			`, msg.ID, broadcast.RetryDelay(code, msg.RetryCount+1).Seconds(), code, sendErr.Error())
+			result.Retrying++
+		} else {
+			_, err = s.db.ExecContext(ctx, `
+				UPDATE scheduled_messages SET status = 'failed', error_code = $2, error_message = $3, updated_at = NOW()
+				WHERE id = $1
+			`, msg.ID, code, sendErr.Error())
+			result.Failed++
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("scheduled message %s: %w", msg.ID, err)
+		}
+	}
+	return result, firstErr
+}
+
+// send sends the message, with its media when it has some
+func (s *Service) send(ctx context.Context, sender Sender, msg Message) (string, error) {
+	createdBy := ""
+	if msg.CreatedBy != nil {
+		createdBy = *msg.CreatedBy
+	}
+	sendCtx := whatsapp.WithSender(ctx, whatsapp.SentByAgent, createdBy)
+
+	text := ""
+	if msg.MessageText != nil {
+		text = *msg.MessageText
+	}
+	if msg.MediaURL == nil {
+		if text == "" {
+			return "", fmt.Errorf("%w: nothing to send", ErrInvalidMessage)
+		}
+		return sender.SendMessage(sendCtx, msg.TenantID, msg.CustomerJID, text)
+	}
+
+	path, mediaType, err := broadcast.ResolveMedia(msg.TenantID, *msg.MediaURL)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read media: %w", err)
+	}
+	fileName := filepath.Base(path)
+	if msg.MediaFileName != nil && *msg.MediaFileName != "" {
+		fileName = *msg.MediaFileName
+	}
+	media, err := sender.UploadMedia(sendCtx, msg.TenantID, data, mediaType, fileName)
+	if err != nil {
+		return "", err
+	}
+	media.LocalURL = *msg.MediaURL
+	return sender.SendUploadedMedia(sendCtx, msg.TenantID, msg.CustomerJID, media, text)
+}
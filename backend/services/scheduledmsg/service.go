@@ -0,0 +1,383 @@
+// Package scheduledmsg manages scheduled messages: one-off messages to a
+// customer, text, media or both, sent at a time picked in the tenant's
+// timezone. The dispatcher sends due messages through the normal send path;
+// until it claims them they can be edited or cancelled.
+package scheduledmsg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gowa-backend/services/broadcast"
+	"gowa-backend/services/recurrence"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Message statuses
+const (
+	StatusPending   = "pending"
+	StatusSending   = "sending"
+	StatusSent      = "sent"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+)
+
+// MaxAhead is how far ahead a message may be scheduled
+const MaxAhead = 365 * 24 * time.Hour
+
+// ErrInvalidMessage wraps every validation error
+var ErrInvalidMessage = errors.New("invalid scheduled message")
+
+// localLayouts are the send time formats read in the message's timezone
+var localLayouts = []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04:05", "2006-01-02 15:04"}
+
+// Message is a scheduled message with its customer
+type Message struct {
+	ID            string     `json:"id" db:"id"`
+	TenantID      string     `json:"tenant_id" db:"tenant_id"`
+	CustomerID    *string    `json:"customer_id" db:"insight_id"`
+	CustomerJID   string     `json:"customer_jid" db:"recipient_jid"`
+	CustomerName  *string    `json:"customer_name" db:"customer_name"`
+	MessageText   *string    `json:"message_text" db:"message_text"`
+	MediaURL      *string    `json:"media_url" db:"media_url"`
+	MediaType     *string    `json:"media_type" db:"media_type"`
+	MediaFileName *string    `json:"media_file_name" db:"media_file_name"`
+	ScheduledAt   time.Time  `json:"scheduled_at" db:"scheduled_at"`
+	Timezone      string     `json:"timezone" db:"timezone"`
+	LocalTime     string     `json:"scheduled_local" db:"-"`
+	Status        string     `json:"status" db:"status"`
+	RetryCount    int        `json:"retry_count" db:"retry_count"`
+	NextAttemptAt *time.Time `json:"next_attempt_at" db:"next_attempt_at"`
+	SentAt        *time.Time `json:"sent_at" db:"sent_at"`
+	MessageID     *string    `json:"message_id" db:"message_id"`
+	ErrorCode     *string    `json:"error_code" db:"error_code"`
+	ErrorMessage  *string    `json:"error_message" db:"error_message"`
+	CreatedBy     *string    `json:"created_by" db:"created_by"`
+	CreatorName   *string    `json:"created_by_name" db:"creator_name"`
+	CancelledBy   *string    `json:"cancelled_by" db:"cancelled_by"`
+	CreatedAt     time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// messageSelect selects messages as m with their customer and creator
+const messageSelect = `
+	SELECT m.id, m.tenant_id, m.insight_id, m.recipient_jid, ci.customer_name,
+		NULLIF(m.message_text, '') as message_text, m.media_url, m.media_type, m.media_file_name,
+		m.scheduled_at, COALESCE(m.timezone, '') as timezone, m.status, COALESCE(m.retry_count, 0) as retry_count,
+		m.next_attempt_at, m.sent_at, m.message_id, m.error_code, m.error_message,
+		m.created_by, u.full_name as creator_name, m.cancelled_by, m.created_at, m.updated_at
+	FROM scheduled_messages m
+	LEFT JOIN customer_insights ci ON ci.id = m.insight_id
+	LEFT JOIN users u ON u.id = m.created_by`
+
+// Input creates or changes a message. SendAt is an RFC 3339 time, or a
+// local date and time ("2024-05-01T08:00") read in Timezone, which defaults
+// to the tenant's. On updates nil fields are left alone; an empty MediaURL
+// removes the media.
+type Input struct {
+	CustomerID    string  `json:"customer_id"`
+	MessageText   *string `json:"message_text"`
+	MediaURL      *string `json:"media_url"`
+	MediaFileName *string `json:"media_file_name"`
+	SendAt        *string `json:"send_at"`
+	Timezone      *string `json:"timezone"`
+}
+
+// Filter narrows a message list. Status takes "all"; without one every
+// message but cancelled ones is listed.
+type Filter struct {
+	Status     string
+	CustomerID string
+	From       *time.Time
+	To         *time.Time
+}
+
+// Service manages scheduled messages
+type Service struct {
+	db *sqlx.DB
+}
+
+// NewService creates a scheduled message service
+func NewService(db *sqlx.DB) *Service {
+	return &Service{db: db}
+}
+
+// Get loads a message of the tenant
+func (s *Service) Get(ctx context.Context, tenantID, id string) (*Message, error) {
+	var msg Message
+	err := s.db.GetContext(ctx, &msg, messageSelect+` WHERE m.id::text = $1 AND m.tenant_id = $2`, id, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	localize(&msg)
+	return &msg, nil
+}
+
+// List returns a page of the tenant's messages, soonest first, with the
+// total matching the filter
+func (s *Service) List(ctx context.Context, tenantID string, filter Filter, limit, offset int) ([]Message, int, error) {
+	conditions := []string{"m.tenant_id = $1"}
+	args := []interface{}{tenantID}
+	add := func(condition string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, strings.ReplaceAll(condition, "?", "$"+strconv.Itoa(len(args))))
+	}
+
+	switch filter.Status {
+	case "":
+		conditions = append(conditions, "m.status <> 'cancelled'")
+	case "all":
+	default:
+		add("m.status = ?", filter.Status)
+	}
+	if filter.CustomerID != "" {
+		add("m.insight_id::text = ?", filter.CustomerID)
+	}
+	if filter.From != nil {
+		add("m.scheduled_at >= ?", *filter.From)
+	}
+	if filter.To != nil {
+		add("m.scheduled_at < ?", *filter.To)
+	}
+	where := " WHERE " + strings.Join(conditions, " AND ")
+
+	var total int
+	err := s.db.GetContext(ctx, &total, `SELECT COUNT(*) FROM scheduled_messages m`+where, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	messages := []Message{}
+	err = s.db.SelectContext(ctx, &messages, messageSelect+where+`
+		ORDER BY m.scheduled_at ASC
+		LIMIT $`+strconv.Itoa(len(args)+1)+` OFFSET $`+strconv.Itoa(len(args)+2),
+		append(args, limit, offset)...)
+	for i := range messages {
+		localize(&messages[i])
+	}
+	return messages, total, err
+}
+
+// Timeline returns a customer's messages that have not gone out yet or
+// failed, soonest first, to show alongside their chat history
+func (s *Service) Timeline(ctx context.Context, tenantID, customerID string) ([]Message, error) {
+	messages := []Message{}
+	err := s.db.SelectContext(ctx, &messages, messageSelect+`
+		WHERE m.tenant_id = $1 AND m.insight_id::text = $2 AND m.status IN ('pending', 'sending', 'failed')
+		ORDER BY m.scheduled_at ASC
+		LIMIT 50
+	`, tenantID, customerID)
+	for i := range messages {
+		localize(&messages[i])
+	}
+	return messages, err
+}
+
+// sendTime parses a send time, reading local times in loc, and checks it
+// lies ahead
+func sendTime(value string, loc *time.Location) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		for _, layout := range localLayouts {
+			if t, err = time.ParseInLocation(layout, value, loc); err == nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: send_at must be an RFC 3339 time or a local time like 2006-01-02T15:04", ErrInvalidMessage)
+	}
+	if !t.After(time.Now()) {
+		return time.Time{}, fmt.Errorf("%w: send_at must be in the future", ErrInvalidMessage)
+	}
+	if t.After(time.Now().Add(MaxAhead)) {
+		return time.Time{}, fmt.Errorf("%w: send_at must be within a year", ErrInvalidMessage)
+	}
+	return t, nil
+}
+
+// location returns the timezone a message is scheduled in: the given one,
+// else the tenant's
+func (s *Service) location(ctx context.Context, tenantID string, timezone *string) (*time.Location, error) {
+	if timezone != nil && *timezone != "" {
+		name, err := recurrence.NormalizeTimezone(*timezone)
+		if err != nil {
+			return nil, fmt.Errorf("%w: unknown timezone %q", ErrInvalidMessage, *timezone)
+		}
+		return recurrence.LoadLocation(name), nil
+	}
+	return recurrence.TenantLocation(ctx, s.db, tenantID)
+}
+
+// Create schedules a message to a customer of the tenant
+func (s *Service) Create(ctx context.Context, tenantID string, in Input, createdBy string) (*Message, error) {
+	if in.CustomerID == "" {
+		return nil, fmt.Errorf("%w: customer_id is required", ErrInvalidMessage)
+	}
+	if in.SendAt == nil || *in.SendAt == "" {
+		return nil, fmt.Errorf("%w: send_at is required", ErrInvalidMessage)
+	}
+	loc, err := s.location(ctx, tenantID, in.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	at, err := sendTime(*in.SendAt, loc)
+	if err != nil {
+		return nil, err
+	}
+
+	text := ""
+	if in.MessageText != nil {
+		text = strings.TrimSpace(*in.MessageText)
+	}
+	var mediaURL, mediaType, mediaFileName *string
+	if in.MediaURL != nil && *in.MediaURL != "" {
+		if mediaURL, mediaType, mediaFileName, err = resolveMedia(tenantID, *in.MediaURL, in.MediaFileName); err != nil {
+			return nil, err
+		}
+	}
+	if text == "" && mediaURL == nil {
+		return nil, fmt.Errorf("%w: message_text or media_url is required", ErrInvalidMessage)
+	}
+
+	var id string
+	err = s.db.GetContext(ctx, &id, `
+		INSERT INTO scheduled_messages (tenant_id, insight_id, recipient_jid, message_text, media_url, media_type,
+			media_file_name, scheduled_at, timezone, status, created_by)
+		SELECT ci.tenant_id, ci.id, ci.customer_jid, NULLIF($3, ''), $4::text, $5::text,
+			$6::text, $7::timestamptz, $8::text, 'pending', NULLIF($9, '')::uuid
+		FROM customer_insights ci
+		WHERE ci.id::text = $1 AND ci.tenant_id = $2
+		RETURNING id
+	`, in.CustomerID, tenantID, text, mediaURL, mediaType, mediaFileName, at, loc.String(), createdBy)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: customer not found", ErrInvalidMessage)
+	} else if err != nil {
+		return nil, err
+	}
+	return s.Get(ctx, tenantID, id)
+}
+
+// Update changes a pending message's text, media or send time. A new send
+// time clears any pending retry.
+func (s *Service) Update(ctx context.Context, tenantID, id string, in Input) (*Message, error) {
+	current, err := s.Get(ctx, tenantID, id)
+	if err != nil {
+		return nil, err
+	}
+	if current.Status != StatusPending {
+		return nil, sql.ErrNoRows
+	}
+
+	sets := []string{"updated_at = NOW()"}
+	args := []interface{}{id, tenantID}
+	set := func(column string, value interface{}) {
+		args = append(args, value)
+		sets = append(sets, column+" = $"+strconv.Itoa(len(args)))
+	}
+
+	text := current.MessageText
+	if in.MessageText != nil {
+		trimmed := strings.TrimSpace(*in.MessageText)
+		text = &trimmed
+		set("message_text", trimmed)
+	}
+	media := current.MediaURL
+	if in.MediaURL != nil {
+		if *in.MediaURL == "" {
+			media = nil
+			sets = append(sets, "media_url = NULL", "media_type = NULL", "media_file_name = NULL")
+		} else {
+			mediaURL, mediaType, mediaFileName, err := resolveMedia(tenantID, *in.MediaURL, in.MediaFileName)
+			if err != nil {
+				return nil, err
+			}
+			media = mediaURL
+			set("media_url", *mediaURL)
+			set("media_type", *mediaType)
+			set("media_file_name", mediaFileName)
+		}
+	} else if in.MediaFileName != nil && media != nil {
+		set("media_file_name", strings.TrimSpace(*in.MediaFileName))
+	}
+	if (text == nil || *text == "") && media == nil {
+		return nil, fmt.Errorf("%w: message_text or media_url is required", ErrInvalidMessage)
+	}
+
+	if in.SendAt != nil || in.Timezone != nil {
+		timezone := in.Timezone
+		if timezone == nil && current.Timezone != "" {
+			timezone = &current.Timezone
+		}
+		loc, err := s.location(ctx, tenantID, timezone)
+		if err != nil {
+			return nil, err
+		}
+		at := current.ScheduledAt
+		if in.SendAt != nil {
+			if at, err = sendTime(*in.SendAt, loc); err != nil {
+				return nil, err
+			}
+		}
+		set("scheduled_at", at)
+		set("timezone", loc.String())
+		sets = append(sets, "next_attempt_at = NULL")
+	}
+
+	// The status check makes a change lose against the dispatcher claiming
+	// the message in the meantime
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE scheduled_messages SET `+strings.Join(sets, ", ")+`
+		WHERE id::text = $1 AND tenant_id = $2 AND status = 'pending'
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return s.Get(ctx, tenantID, id)
+}
+
+// Cancel cancels a pending message
+func (s *Service) Cancel(ctx context.Context, tenantID, id, userID string) (*Message, error) {
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE scheduled_messages SET status = 'cancelled', cancelled_by = NULLIF($3, '')::uuid, updated_at = NOW()
+		WHERE id::text = $1 AND tenant_id = $2 AND status = 'pending'
+	`, id, tenantID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return s.Get(ctx, tenantID, id)
+}
+
+// resolveMedia checks an uploaded file can be sent and returns its URL, type
+// and file name
+func resolveMedia(tenantID, url string, fileName *string) (*string, *string, *string, error) {
+	_, mediaType, err := broadcast.ResolveMedia(tenantID, url)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+	var name *string
+	if fileName != nil {
+		if trimmed := strings.TrimSpace(*fileName); trimmed != "" {
+			name = &trimmed
+		}
+	}
+	return &url, &mediaType, name, nil
+}
+
+// localize fills in the send time as read in the message's timezone
+func localize(msg *Message) {
+	msg.LocalTime = msg.ScheduledAt.In(recurrence.LoadLocation(msg.Timezone)).Format("2006-01-02T15:04:05")
+}
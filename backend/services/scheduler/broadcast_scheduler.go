@@ -6,48 +6,72 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"strings"
 	"time"
 
-	"gowa-backend/services/redis"
+	"gowa-backend/services/broadcast"
+	"gowa-backend/services/recurrence"
 
 	"github.com/jmoiron/sqlx"
 )
 
 // BroadcastScheduler handles scheduled and recurring broadcasts
 type BroadcastScheduler struct {
-	db          *sqlx.DB
-	redisClient *redis.Client
-	ticker      *time.Ticker
-	done        chan bool
+	db     *sqlx.DB
+	engine *broadcast.Engine
+	ticker *time.Ticker
+	done   chan bool
 }
 
 // Broadcast represents a broadcast with scheduling info
+
 type Broadcast struct {
-	ID                string         `db:"id"`
-	TenantID          string         `db:"tenant_id"`
-	Name              string         `db:"name"`
-	MessageContent    string         `db:"message_content"`
-	TemplateID        sql.NullString `db:"template_id"`
-	Status            string         `db:"status"`
-	ScheduledAt       sql.NullTime   `db:"scheduled_at"`
-	IsRecurring       bool           `db:"is_recurring"`
-	RecurrenceType    sql.NullString `db:"recurrence_type"`
-	RecurrenceInterval sql.NullInt32 `db:"recurrence_interval"`
-	RecurrenceDays    sql.NullString `db:"recurrence_days"` // JSONB as string
-	RecurrenceTime    sql.NullString `db:"recurrence_time"` // TIME as string
-	RecurrenceEndDate sql.NullTime   `db:"recurrence_end_date"`
-	RecurrenceCount   sql.NullInt32  `db:"recurrence_count"`
-	LastExecutedAt    sql.NullTime   `db:"last_executed_at"`
-	ExecutionCount    int            `db:"execution_count"`
+	ID                    string         `db:"id"`
+	TenantID              string         `db:"tenant_id"`
+	Name                  string         `db:"name"`
+	MessageContent        string         `db:"message_content"`
+	TemplateID            sql.NullString `db:"template_id"`
+	Status                string         `db:"status"`
+	ScheduledAt           sql.NullTime   `db:"scheduled_at"`
+	IsRecurring           bool           `db:"is_recurring"`
+	RecurrenceType        sql.NullString `db:"recurrence_type"`
+	RecurrenceInterval    sql.NullInt32  `db:"recurrence_interval"`
+	RecurrenceDays        sql.NullString `db:"recurrence_days"` // JSONB as string
+	RecurrenceTime        sql.NullString `db:"recurrence_time"` // TIME as string
+	RecurrenceEndDate     sql.NullTime   `db:"recurrence_end_date"`
+	RecurrenceCount       sql.NullInt32  `db:"recurrence_count"`
+	RecurrenceMonthDay    sql.NullInt32  `db:"recurrence_month_day"`
+	RecurrenceWeekOrdinal sql.NullInt32  `db:"recurrence_week_ordinal"`
+	RecurrenceWeekday     sql.NullString `db:"recurrence_weekday"`
+	RecurrenceCron        sql.NullString `db:"recurrence_cron"`
+	Timezone              string         `db:"timezone"`
+	LastExecutedAt        sql.NullTime   `db:"last_executed_at"`
+	ExecutionCount        int            `db:"execution_count"`
+	SegmentID             sql.NullString `db:"segment_id"`
+}
+
+// Rule is the broadcast's recurrence rule
+func (b *Broadcast) Rule() recurrence.Rule {
+	rule := recurrence.Rule{
+		Type:        b.RecurrenceType.String,
+		Interval:    int(b.RecurrenceInterval.Int32),
+		Time:        b.RecurrenceTime.String,
+		MonthDay:    int(b.RecurrenceMonthDay.Int32),
+		WeekOrdinal: int(b.RecurrenceWeekOrdinal.Int32),
+		Weekday:     b.RecurrenceWeekday.String,
+		Cron:        b.RecurrenceCron.String,
+	}
+	if b.RecurrenceDays.Valid {
+		json.Unmarshal([]byte(b.RecurrenceDays.String), &rule.Days)
+	}
+	return rule
 }
 
 // NewBroadcastScheduler creates a new broadcast scheduler
-func NewBroadcastScheduler(db *sqlx.DB, redisClient *redis.Client) *BroadcastScheduler {
+func NewBroadcastScheduler(db *sqlx.DB, engine *broadcast.Engine) *BroadcastScheduler {
 	return &BroadcastScheduler{
-		db:          db,
-		redisClient: redisClient,
-		done:        make(chan bool),
+		db:     db,
+		engine: engine,
+		done:   make(chan bool),
 	}
 }
 
@@ -56,6 +80,11 @@ func (s *BroadcastScheduler) Start() {
 	log.Println("[Scheduler] Starting broadcast scheduler...")
 	s.ticker = time.NewTicker(1 * time.Minute)
 
+	// Pick up broadcasts that were sending when the server stopped
+	if err := s.engine.Recover(context.Background(), true); err != nil {
+		log.Printf("[Scheduler] Error recovering broadcasts: %v", err)
+	}
+
 	// Run immediately on start
 	s.checkScheduledBroadcasts()
 
@@ -89,7 +118,9 @@ func (s *BroadcastScheduler) checkScheduledBroadcasts() {
 		SELECT id, tenant_id, name, message_content, template_id, status,
 		       scheduled_at, is_recurring, recurrence_type, recurrence_interval,
 		       recurrence_days, recurrence_time, recurrence_end_date, recurrence_count,
-		       last_executed_at, execution_count
+		       recurrence_month_day, recurrence_week_ordinal, recurrence_weekday, recurrence_cron,
+		       last_executed_at, execution_count, segment_id,
+		       COALESCE((SELECT timezone FROM tenants t WHERE t.id = broadcasts.tenant_id), '') as timezone
 		FROM broadcasts
 		WHERE (status = 'scheduled' OR (status = 'active' AND is_recurring = true))
 		  AND scheduled_at <= $1
@@ -111,192 +142,168 @@ func (s *BroadcastScheduler) checkScheduledBroadcasts() {
 	for _, broadcast := range broadcasts {
 		s.executeBroadcast(ctx, &broadcast)
 	}
-}
 
-// executeBroadcast executes a broadcast
-func (s *BroadcastScheduler) executeBroadcast(ctx context.Context, broadcast *Broadcast) {
-	log.Printf("[Scheduler] Executing broadcast: %s (ID: %s)", broadcast.Name, broadcast.ID)
+	s.decideABTests(ctx)
+	s.enforceSendWindows(ctx)
+	s.releaseRetries(ctx)
 
-	// Start transaction
-	tx, err := s.db.BeginTxx(ctx, nil)
-	if err != nil {
-		log.Printf("[Scheduler] Error starting transaction: %v", err)
-		return
+	// Hand out recipients whose claim was lost
+	if err := s.engine.Recover(ctx, false); err != nil {
+		log.Printf("[Scheduler] Error recovering broadcasts: %v", err)
 	}
-	defer tx.Rollback()
-
-	// Update status to sending
-	updateQuery := `
-		UPDATE broadcasts
-		SET status = 'sending',
-		    started_at = NOW(),
-		    last_executed_at = NOW(),
-		    execution_count = execution_count + 1,
-		    updated_at = NOW()
-		WHERE id = $1 AND (status = 'scheduled' OR status = 'active')
-		RETURNING id
-	`
+}
 
-	var updatedID string
-	err = tx.GetContext(ctx, &updatedID, updateQuery, broadcast.ID)
+// releaseRetries sends recipients again whose transient failure is due for
+// a retry
+func (s *BroadcastScheduler) releaseRetries(ctx context.Context) {
+	due, err := broadcast.NewService(s.db).ReleaseRetries(ctx)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			// Already being processed
-			return
-		}
-		log.Printf("[Scheduler] Error updating broadcast status: %v", err)
+		log.Printf("[Scheduler] Error releasing broadcast retries: %v", err)
 		return
 	}
 
-	// Commit transaction
-	if err := tx.Commit(); err != nil {
-		log.Printf("[Scheduler] Error committing transaction: %v", err)
-		return
-	}
-
-	log.Printf("[Scheduler] Broadcast %s marked as sending", broadcast.ID)
-
-	// Trigger actual message sending
-	go s.sendBroadcastMessages(broadcast.TenantID, broadcast.ID, broadcast.MessageContent)
-
-	// Handle recurring broadcasts
-	if broadcast.IsRecurring {
-		s.scheduleNextRecurrence(ctx, broadcast)
+	for _, b := range due {
+		log.Printf("[Scheduler] Retrying failed recipients of broadcast %s", b.ID)
+		s.engine.Dispatch(b.ID)
 	}
 }
 
-// sendBroadcastMessages queues messages to Redis for all recipients
-func (s *BroadcastScheduler) sendBroadcastMessages(tenantID, broadcastID, messageTemplate string) {
-	ctx := context.Background()
-	
-	// Get recipients
-	type Recipient struct {
-		ID          string `db:"id"`
-		CustomerID  string `db:"customer_id"`
-		CustomerJID string `db:"customer_jid"`
-	}
-	
-	var recipients []Recipient
-	recipientQuery := `SELECT id, customer_id, customer_jid FROM broadcast_recipients WHERE broadcast_id = $1 AND status = 'pending'`
-	if err := s.db.SelectContext(ctx, &recipients, recipientQuery, broadcastID); err != nil {
-		log.Printf("[Scheduler] Error getting recipients for broadcast %s: %v", broadcastID, err)
-		return
+// enforceSendWindows pauses sending broadcasts whose send window has closed
+// and resumes those paused for it once the window opens
+func (s *BroadcastScheduler) enforceSendWindows(ctx context.Context) {
+	var windowed []struct {
+		ID             string `db:"id"`
+		TenantID       string `db:"tenant_id"`
+		MessageContent string `db:"message_content"`
+		Status         string `db:"status"`
 	}
-	
-	if len(recipients) == 0 {
-		log.Printf("[Scheduler] No recipients found for broadcast %s", broadcastID)
-		// Mark as completed anyway
-		s.db.ExecContext(ctx, `UPDATE broadcasts SET status = 'completed', completed_at = NOW() WHERE id = $1`, broadcastID)
+	err := s.db.SelectContext(ctx, &windowed, `
+		SELECT id, tenant_id, message_content, status
+		FROM broadcasts
+		WHERE send_window_start IS NOT NULL
+		  AND (status = 'sending' OR (status = 'paused' AND pause_reason = 'window'))
+	`)
+	if err != nil {
+		log.Printf("[Scheduler] Error querying broadcasts with send windows: %v", err)
 		return
 	}
 
-	log.Printf("[Scheduler] Queueing broadcast %s to %d recipients via Redis", broadcastID, len(recipients))
-
-	queuedCount := 0
-	failedCount := 0
-
-	for _, recipient := range recipients {
-		// Get customer name for personalization
-		var customerName string
-		nameQuery := `SELECT COALESCE(customer_name, customer_phone, '') FROM customer_insights WHERE id = $1`
-		s.db.Get(&customerName, nameQuery, recipient.CustomerID)
-
-		// Personalize message
-		personalizedMessage := messageTemplate
-		personalizedMessage = strings.Replace(personalizedMessage, "{{nama}}", customerName, -1)
-		personalizedMessage = strings.Replace(personalizedMessage, "{{name}}", customerName, -1)
-
-		// Create broadcast message payload
-		payload := &redis.BroadcastMessagePayload{
-			TenantID:     tenantID,
-			BroadcastID:  broadcastID,
-			RecipientID:  recipient.ID,
-			CustomerJID:  recipient.CustomerJID,
-			Message:      personalizedMessage,
-			CustomerName: customerName,
+	svc := broadcast.NewService(s.db)
+	for _, b := range windowed {
+		inWindow, err := svc.InWindow(ctx, b.ID)
+		if err != nil {
+			log.Printf("[Scheduler] Error checking send window of broadcast %s: %v", b.ID, err)
+			continue
 		}
 
-		// Push to Redis broadcast queue
-		if err := s.redisClient.PushToBroadcastQueue(ctx, payload); err != nil {
-			log.Printf("[Scheduler] Error queuing message for recipient %s: %v", recipient.ID, err)
-			failedCount++
-			// Mark as failed
-			s.db.ExecContext(ctx, `UPDATE broadcast_recipients SET status = 'failed', error_message = $1 WHERE id = $2`, err.Error(), recipient.ID)
-		} else {
-			log.Printf("[Scheduler] Queued message to %s: %s", recipient.CustomerJID, personalizedMessage)
-			queuedCount++
-			// Mark as queued
-			s.db.ExecContext(ctx, `UPDATE broadcast_recipients SET status = 'queued' WHERE id = $1`, recipient.ID)
+		switch {
+		case b.Status == broadcast.StatusSending && !inWindow:
+			if err := s.engine.Pause(ctx, b.ID, broadcast.PauseWindow); err != nil && err != broadcast.ErrNotSending {
+				log.Printf("[Scheduler] Error pausing broadcast %s: %v", b.ID, err)
+			} else {
+				log.Printf("[Scheduler] Broadcast %s paused outside its send window", b.ID)
+			}
+		case b.Status == broadcast.StatusPaused && inWindow:
+			resumed, err := svc.Resume(ctx, b.ID)
+			if err != nil {
+				log.Printf("[Scheduler] Error resuming broadcast %s: %v", b.ID, err)
+				continue
+			}
+			if resumed {
+				log.Printf("[Scheduler] Broadcast %s resumed as its send window opened", b.ID)
+				s.engine.Dispatch(b.ID)
+			}
 		}
+	}
+}
 
-		// Small delay to avoid overwhelming Redis
-		time.Sleep(50 * time.Millisecond)
+// decideABTests picks the winner of A/B tests whose test portion has run long
+// enough and sends it to the held recipients
+func (s *BroadcastScheduler) decideABTests(ctx context.Context) {
+	svc := broadcast.NewService(s.db)
+	due, err := svc.DueDecisions(ctx)
+	if err != nil {
+		log.Printf("[Scheduler] Error querying A/B tests to decide: %v", err)
+		return
 	}
 
-	// Update broadcast counts
-	updateBroadcastQuery := `UPDATE broadcasts SET sent_count = $1, failed_count = $2, status = 'sending', updated_at = NOW() WHERE id = $3`
-	s.db.ExecContext(ctx, updateBroadcastQuery, queuedCount, failedCount, broadcastID)
+	for _, b := range due {
+		winner, err := svc.DecideWinner(ctx, b.ID, b.WinnerMetric)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			log.Printf("[Scheduler] Error deciding A/B test of broadcast %s: %v", b.ID, err)
+			continue
+		}
 
-	log.Printf("[Scheduler] Broadcast %s - Queued: %d, Failed: %d messages", broadcastID, queuedCount, failedCount)
+		log.Printf("[Scheduler] Broadcast %s A/B winner: variant %s (reply rate %.3f, read rate %.3f)",
+			b.ID, winner.Label, winner.ReplyRate, winner.ReadRate)
+		s.engine.Dispatch(b.ID)
+	}
 }
 
-// scheduleNextRecurrence calculates and schedules the next occurrence
-func (s *BroadcastScheduler) scheduleNextRecurrence(ctx context.Context, broadcast *Broadcast) {
-	// Check if should continue recurring
-	if !s.shouldContinueRecurring(broadcast) {
-		// Mark as completed
-		_, err := s.db.ExecContext(ctx, `
-			UPDATE broadcasts
-			SET status = 'completed',
-			    completed_at = NOW(),
-			    updated_at = NOW()
-			WHERE id = $1
-		`, broadcast.ID)
-		if err != nil {
-			log.Printf("[Scheduler] Error marking recurring broadcast as completed: %v", err)
-		} else {
-			log.Printf("[Scheduler] Recurring broadcast %s completed", broadcast.ID)
-		}
-		return
+// executeBroadcast starts a run of a broadcast through the engine
+func (s *BroadcastScheduler) executeBroadcast(ctx context.Context, b *Broadcast) {
+	log.Printf("[Scheduler] Executing broadcast: %s (ID: %s)", b.Name, b.ID)
+
+	var scheduledFor *time.Time
+	if b.ScheduledAt.Valid {
+		scheduledFor = &b.ScheduledAt.Time
 	}
 
-	// Calculate next execution time
-	nextExecution := s.calculateNextExecution(broadcast)
-	if nextExecution.IsZero() {
-		log.Printf("[Scheduler] Could not calculate next execution for broadcast %s", broadcast.ID)
-		return
+	// Recurring broadcasts are scheduled for their next run as this one starts
+	var next *time.Time
+	if b.IsRecurring {
+		next = s.nextRecurrence(b)
 	}
 
-	// Update scheduled_at for next execution
-	_, err := s.db.ExecContext(ctx, `
-		UPDATE broadcasts
-		SET scheduled_at = $1,
-		    status = 'active',
-		    updated_at = NOW()
-		WHERE id = $2
-	`, nextExecution, broadcast.ID)
+	sending, err := s.engine.Start(ctx, b.ID, scheduledFor, next)
+	if err == broadcast.ErrInvalidTransition {
+		// Already being processed
+		return
+	} else if err != nil {
+		log.Printf("[Scheduler] Error starting broadcast %s: %v", b.ID, err)
+		return
+	}
 
-	if err != nil {
-		log.Printf("[Scheduler] Error scheduling next recurrence: %v", err)
+	if sending {
+		log.Printf("[Scheduler] Broadcast %s marked as sending", b.ID)
 	} else {
-		log.Printf("[Scheduler] Next execution for %s scheduled at %s", broadcast.ID, nextExecution.Format(time.RFC3339))
+		log.Printf("[Scheduler] Broadcast %s paused until its send window opens", b.ID)
+	}
+	if next != nil {
+		log.Printf("[Scheduler] Next execution for %s scheduled at %s", b.ID, next.Format(time.RFC3339))
+	} else if b.IsRecurring {
+		log.Printf("[Scheduler] Recurring broadcast %s completes with this run", b.ID)
 	}
 }
 
-// shouldContinueRecurring checks if recurring broadcast should continue
-func (s *BroadcastScheduler) shouldContinueRecurring(broadcast *Broadcast) bool {
-	now := time.Now()
+// nextRecurrence calculates the next occurrence of a recurring broadcast,
+// or nil when the run about to start is its last
+func (s *BroadcastScheduler) nextRecurrence(broadcast *Broadcast) *time.Time {
+	nextExecution, err := s.calculateNextExecution(broadcast)
+	if err != nil {
+		log.Printf("[Scheduler] Could not calculate next execution for broadcast %s: %v", broadcast.ID, err)
+		return nil
+	}
+	if !s.shouldContinueRecurring(broadcast, nextExecution) {
+		return nil
+	}
+	return &nextExecution
+}
 
+// shouldContinueRecurring checks if recurring broadcast should run again at next
+func (s *BroadcastScheduler) shouldContinueRecurring(broadcast *Broadcast, next time.Time) bool {
 	// Check end date
 	if broadcast.RecurrenceEndDate.Valid {
-		if now.After(broadcast.RecurrenceEndDate.Time) {
+		if next.After(broadcast.RecurrenceEndDate.Time) {
 			return false
 		}
 	}
 
-	// Check execution count
+	// Check execution count; the run that just started is not counted yet
 	if broadcast.RecurrenceCount.Valid {
-		if broadcast.ExecutionCount >= int(broadcast.RecurrenceCount.Int32) {
+		if broadcast.ExecutionCount+1 >= int(broadcast.RecurrenceCount.Int32) {
 			return false
 		}
 	}
@@ -304,106 +311,26 @@ func (s *BroadcastScheduler) shouldContinueRecurring(broadcast *Broadcast) bool
 	return true
 }
 
-// calculateNextExecution calculates the next execution time for recurring broadcast
-func (s *BroadcastScheduler) calculateNextExecution(broadcast *Broadcast) time.Time {
+// calculateNextExecution calculates the next execution time for recurring
+// broadcast on the wall clock of the tenant's timezone. It counts from the
+// planned run so late runs do not shift the schedule, and skips runs missed
+// while the scheduler was down.
+func (s *BroadcastScheduler) calculateNextExecution(broadcast *Broadcast) (time.Time, error) {
 	if !broadcast.IsRecurring || !broadcast.RecurrenceType.Valid {
-		return time.Time{}
-	}
-
-	lastExec := time.Now()
-	if broadcast.LastExecutedAt.Valid {
-		lastExec = broadcast.LastExecutedAt.Time
-	}
-
-	interval := 1
-	if broadcast.RecurrenceInterval.Valid {
-		interval = int(broadcast.RecurrenceInterval.Int32)
+		return time.Time{}, fmt.Errorf("broadcast is not recurring")
 	}
 
-	switch broadcast.RecurrenceType.String {
-	case "hourly":
-		return lastExec.Add(time.Duration(interval) * time.Hour)
-
-	case "daily":
-		return s.calculateDailyNext(lastExec, interval, broadcast.RecurrenceTime.String)
-
-	case "weekly":
-		return s.calculateWeeklyNext(lastExec, interval, broadcast.RecurrenceDays.String, broadcast.RecurrenceTime.String)
-
-	default:
-		return time.Time{}
-	}
-}
-
-// calculateDailyNext calculates next daily execution
-func (s *BroadcastScheduler) calculateDailyNext(lastExec time.Time, interval int, timeStr string) time.Time {
-	// Parse time (format: HH:MM:SS)
-	var hour, minute int
-	if timeStr != "" {
-		fmt.Sscanf(timeStr, "%d:%d", &hour, &minute)
-	}
-
-	// Add interval days
-	nextDate := lastExec.AddDate(0, 0, interval)
-
-	// Set to specific time
-	return time.Date(
-		nextDate.Year(), nextDate.Month(), nextDate.Day(),
-		hour, minute, 0, 0,
-		lastExec.Location(),
-	)
-}
-
-// calculateWeeklyNext calculates next weekly execution
-func (s *BroadcastScheduler) calculateWeeklyNext(lastExec time.Time, interval int, daysJSON string, timeStr string) time.Time {
-	// Parse time
-	var hour, minute int
-	if timeStr != "" {
-		fmt.Sscanf(timeStr, "%d:%d", &hour, &minute)
-	}
-
-	// Parse days
-	var days []string
-	if daysJSON != "" {
-		json.Unmarshal([]byte(daysJSON), &days)
-	}
-
-	if len(days) == 0 {
-		return time.Time{}
-	}
-
-	// Convert day names to weekday numbers
-	dayMap := map[string]time.Weekday{
-		"sunday":    time.Sunday,
-		"monday":    time.Monday,
-		"tuesday":   time.Tuesday,
-		"wednesday": time.Wednesday,
-		"thursday":  time.Thursday,
-		"friday":    time.Friday,
-		"saturday":  time.Saturday,
-	}
-
-	var targetDays []time.Weekday
-	for _, day := range days {
-		if wd, ok := dayMap[day]; ok {
-			targetDays = append(targetDays, wd)
-		}
+	now := time.Now()
+	after := now
+	if broadcast.ScheduledAt.Valid {
+		after = broadcast.ScheduledAt.Time
 	}
 
-	// Find next occurrence
-	current := lastExec.AddDate(0, 0, 1) // Start from next day
-	for i := 0; i < 14; i++ {             // Check up to 2 weeks
-		for _, targetDay := range targetDays {
-			if current.Weekday() == targetDay {
-				return time.Date(
-					current.Year(), current.Month(), current.Day(),
-					hour, minute, 0, 0,
-					current.Location(),
-				)
-			}
-		}
-		current = current.AddDate(0, 0, 1)
+	rule := broadcast.Rule()
+	loc := recurrence.LoadLocation(broadcast.Timezone)
+	next, err := rule.Next(after, loc)
+	for err == nil && !next.After(now) {
+		next, err = rule.Next(next, loc)
 	}
-
-	return time.Time{}
+	return next, err
 }
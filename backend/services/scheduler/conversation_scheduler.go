@@ -0,0 +1,64 @@
+package scheduler
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"gowa-backend/services/conversation"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ConversationScheduler reopens snoozed conversations when their time is up
+type ConversationScheduler struct {
+	conversations *conversation.Service
+	ticker        *time.Ticker
+	done          chan bool
+}
+
+// NewConversationScheduler creates a new conversation scheduler
+func NewConversationScheduler(db *sqlx.DB) *ConversationScheduler {
+	return &ConversationScheduler{
+		conversations: conversation.NewService(db),
+		done:          make(chan bool),
+	}
+}
+
+// Start begins the scheduler (checks every minute)
+func (s *ConversationScheduler) Start() {
+	log.Println("[Scheduler] Starting conversation scheduler...")
+	s.ticker = time.NewTicker(1 * time.Minute)
+
+	s.wakeSnoozed()
+
+	for {
+		select {
+		case <-s.ticker.C:
+			s.wakeSnoozed()
+		case <-s.done:
+			log.Println("[Scheduler] Stopping conversation scheduler...")
+			return
+		}
+	}
+}
+
+// Stop stops the scheduler
+func (s *ConversationScheduler) Stop() {
+	if s.ticker != nil {
+		s.ticker.Stop()
+	}
+	s.done <- true
+}
+
+// wakeSnoozed reopens conversations whose snooze time has passed
+func (s *ConversationScheduler) wakeSnoozed() {
+	count, err := s.conversations.WakeSnoozed(context.Background())
+	if err != nil {
+		log.Printf("[Scheduler] Error waking snoozed conversations: %v", err)
+		return
+	}
+	if count > 0 {
+		log.Printf("[Scheduler] Reopened %d snoozed conversation(s)", count)
+	}
+}
@@ -0,0 +1,77 @@
+package scheduler
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"gowa-backend/services/email"
+	"gowa-backend/services/followup"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// FollowUpScheduler creates follow-up tasks for unanswered order intents and
+// announces tasks as they come due
+type FollowUpScheduler struct {
+	followUps *followup.Service
+	mailer    *email.Mailer
+	ticker    *time.Ticker
+	done      chan bool
+}
+
+// NewFollowUpScheduler creates a new follow-up scheduler
+func NewFollowUpScheduler(db *sqlx.DB) *FollowUpScheduler {
+	return &FollowUpScheduler{
+		followUps: followup.NewService(db),
+		mailer:    email.NewMailerFromEnv(),
+		done:      make(chan bool),
+	}
+}
+
+// Start begins the scheduler (checks every minute)
+func (s *FollowUpScheduler) Start() {
+	log.Println("[Scheduler] Starting follow-up scheduler...")
+	s.ticker = time.NewTicker(1 * time.Minute)
+
+	s.check()
+
+	for {
+		select {
+		case <-s.ticker.C:
+			s.check()
+		case <-s.done:
+			log.Println("[Scheduler] Stopping follow-up scheduler...")
+			return
+		}
+	}
+}
+
+// Stop stops the scheduler
+func (s *FollowUpScheduler) Stop() {
+	if s.ticker != nil {
+		s.ticker.Stop()
+	}
+	s.done <- true
+}
+
+// check creates tasks for unanswered order intents, then announces due tasks
+func (s *FollowUpScheduler) check() {
+	ctx := context.Background()
+
+	created, err := s.followUps.CreateUnanswered(ctx)
+	if err != nil {
+		log.Printf("[Scheduler] Error creating follow-ups for unanswered order intents: %v", err)
+	}
+	if created > 0 {
+		log.Printf("[Scheduler] Created %d follow-up task(s) for unanswered order intents", created)
+	}
+
+	notified, err := s.followUps.NotifyDue(ctx, s.mailer)
+	if err != nil {
+		log.Printf("[Scheduler] Error announcing due follow-ups: %v", err)
+	}
+	if notified > 0 {
+		log.Printf("[Scheduler] Announced %d due follow-up task(s)", notified)
+	}
+}
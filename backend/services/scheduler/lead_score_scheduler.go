@@ -0,0 +1,73 @@
+package scheduler
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"gowa-backend/services/leadscore"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// leadScoreHour is the local hour the nightly rescore runs at
+const leadScoreHour = 2
+
+// LeadScoreScheduler rescores every customer once a night so scores decay
+// for customers who stopped writing
+type LeadScoreScheduler struct {
+	scores *leadscore.Service
+	timer  *time.Timer
+	done   chan bool
+}
+
+// NewLeadScoreScheduler creates a new lead score scheduler
+func NewLeadScoreScheduler(db *sqlx.DB) *LeadScoreScheduler {
+	return &LeadScoreScheduler{
+		scores: leadscore.NewService(db),
+		done:   make(chan bool),
+	}
+}
+
+// Start begins the scheduler (runs nightly at 02:00)
+func (s *LeadScoreScheduler) Start() {
+	log.Println("[Scheduler] Starting lead score scheduler...")
+
+	for {
+		s.timer = time.NewTimer(time.Until(nextRun(time.Now(), leadScoreHour)))
+		select {
+		case <-s.timer.C:
+			s.rescore()
+		case <-s.done:
+			log.Println("[Scheduler] Stopping lead score scheduler...")
+			return
+		}
+	}
+}
+
+// Stop stops the scheduler
+func (s *LeadScoreScheduler) Stop() {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.done <- true
+}
+
+// nextRun returns the next time the clock reads hour:00 after now
+func nextRun(now time.Time, hour int) time.Time {
+	next := time.Date(now.Year(), now.Month(), now.Day(), hour, 0, 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// rescore recomputes the scores of all tenants
+func (s *LeadScoreScheduler) rescore() {
+	started := time.Now()
+	changed, err := s.scores.RecomputeAll(context.Background(), leadscore.ReasonNightly)
+	if err != nil {
+		log.Printf("[Scheduler] Error recomputing lead scores: %v", err)
+	}
+	log.Printf("[Scheduler] Nightly lead scoring changed %d customer(s) in %s", changed, time.Since(started).Round(time.Second))
+}
@@ -0,0 +1,75 @@
+package scheduler
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"gowa-backend/services/scheduledmsg"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// scheduledMessageBatchSize is how many due messages one pass sends at most
+const scheduledMessageBatchSize = 100
+
+// ScheduledMessageScheduler sends scheduled messages as they come due
+type ScheduledMessageScheduler struct {
+	messages *scheduledmsg.Service
+	sender   scheduledmsg.Sender
+	ticker   *time.Ticker
+	done     chan bool
+}
+
+// NewScheduledMessageScheduler creates a new scheduled message scheduler
+func NewScheduledMessageScheduler(db *sqlx.DB, sender scheduledmsg.Sender) *ScheduledMessageScheduler {
+	return &ScheduledMessageScheduler{
+		messages: scheduledmsg.NewService(db),
+		sender:   sender,
+		done:     make(chan bool),
+	}
+}
+
+// Start begins the scheduler (checks every 30 seconds)
+func (s *ScheduledMessageScheduler) Start() {
+	log.Println("[Scheduler] Starting scheduled message scheduler...")
+	s.ticker = time.NewTicker(30 * time.Second)
+
+	s.sendDue()
+
+	for {
+		select {
+		case <-s.ticker.C:
+			s.sendDue()
+		case <-s.done:
+			log.Println("[Scheduler] Stopping scheduled message scheduler...")
+			return
+		}
+	}
+}
+
+// Stop stops the scheduler
+func (s *ScheduledMessageScheduler) Stop() {
+	if s.ticker != nil {
+		s.ticker.Stop()
+	}
+	s.done <- true
+}
+
+// sendDue sends due messages in batches until none are left
+func (s *ScheduledMessageScheduler) sendDue() {
+	for {
+		result, err := s.messages.ProcessDue(context.Background(), s.sender, scheduledMessageBatchSize)
+		if err != nil {
+			log.Printf("[Scheduler] Error sending scheduled messages: %v", err)
+		}
+		handled := result.Sent + result.Retrying + result.Failed
+		if handled > 0 {
+			log.Printf("[Scheduler] Scheduled messages: %d sent, %d to retry, %d failed",
+				result.Sent, result.Retrying, result.Failed)
+		}
+		if err != nil || handled < scheduledMessageBatchSize {
+			return
+		}
+	}
+}
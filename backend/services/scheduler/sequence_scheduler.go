@@ -0,0 +1,75 @@
+package scheduler
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"gowa-backend/services/sequence"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// sequenceBatchSize is how many due enrollments one pass sends at most
+const sequenceBatchSize = 200
+
+// SequenceScheduler sends the steps of drip sequences as they come due
+type SequenceScheduler struct {
+	sequences *sequence.Service
+	sender    sequence.Sender
+	ticker    *time.Ticker
+	done      chan bool
+}
+
+// NewSequenceScheduler creates a new sequence scheduler
+func NewSequenceScheduler(db *sqlx.DB, sender sequence.Sender) *SequenceScheduler {
+	return &SequenceScheduler{
+		sequences: sequence.NewService(db),
+		sender:    sender,
+		done:      make(chan bool),
+	}
+}
+
+// Start begins the scheduler (checks every minute)
+func (s *SequenceScheduler) Start() {
+	log.Println("[Scheduler] Starting sequence scheduler...")
+	s.ticker = time.NewTicker(1 * time.Minute)
+
+	s.sendDue()
+
+	for {
+		select {
+		case <-s.ticker.C:
+			s.sendDue()
+		case <-s.done:
+			log.Println("[Scheduler] Stopping sequence scheduler...")
+			return
+		}
+	}
+}
+
+// Stop stops the scheduler
+func (s *SequenceScheduler) Stop() {
+	if s.ticker != nil {
+		s.ticker.Stop()
+	}
+	s.done <- true
+}
+
+// sendDue sends due steps in batches until none are left
+func (s *SequenceScheduler) sendDue() {
+	for {
+		result, err := s.sequences.ProcessDue(context.Background(), s.sender, sequenceBatchSize)
+		if err != nil {
+			log.Printf("[Scheduler] Error sending sequence steps: %v", err)
+		}
+		handled := result.Sent + result.Failed + result.Exited + result.Completed
+		if handled > 0 {
+			log.Printf("[Scheduler] Sequences sent %d step(s), %d failed, %d exited, %d completed",
+				result.Sent, result.Failed, result.Exited, result.Completed)
+		}
+		if err != nil || handled < sequenceBatchSize {
+			return
+		}
+	}
+}
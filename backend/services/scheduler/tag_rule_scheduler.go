@@ -0,0 +1,64 @@
+package scheduler
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"gowa-backend/services/tagrules"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// TagRuleScheduler periodically re-evaluates tag auto-apply rules so
+// conditions that change without new messages, like inactivity, are applied
+type TagRuleScheduler struct {
+	rules  *tagrules.Service
+	ticker *time.Ticker
+	done   chan bool
+}
+
+// NewTagRuleScheduler creates a new tag rule scheduler
+func NewTagRuleScheduler(db *sqlx.DB) *TagRuleScheduler {
+	return &TagRuleScheduler{
+		rules: tagrules.NewService(db),
+		done:  make(chan bool),
+	}
+}
+
+// Start begins the scheduler (sweeps every hour)
+func (s *TagRuleScheduler) Start() {
+	log.Println("[Scheduler] Starting tag rule scheduler...")
+	s.ticker = time.NewTicker(1 * time.Hour)
+
+	s.sweep()
+
+	for {
+		select {
+		case <-s.ticker.C:
+			s.sweep()
+		case <-s.done:
+			log.Println("[Scheduler] Stopping tag rule scheduler...")
+			return
+		}
+	}
+}
+
+// Stop stops the scheduler
+func (s *TagRuleScheduler) Stop() {
+	if s.ticker != nil {
+		s.ticker.Stop()
+	}
+	s.done <- true
+}
+
+// sweep applies every enabled tag rule to all customers
+func (s *TagRuleScheduler) sweep() {
+	result, err := s.rules.Sweep(context.Background())
+	if err != nil {
+		log.Printf("[Scheduler] Error applying tag rules: %v", err)
+	}
+	if result.Added > 0 || result.Removed > 0 {
+		log.Printf("[Scheduler] Tag rules added %d and removed %d tag(s)", result.Added, result.Removed)
+	}
+}
@@ -0,0 +1,497 @@
+// Package segment evaluates saved customer segments. A segment is a filter of
+// nested condition groups that compiles to a parameterized SQL predicate on
+// customer_insights (aliased ci).
+package segment
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Group match modes
+const (
+	MatchAll = "all"
+	MatchAny = "any"
+)
+
+// Condition fields
+const (
+	FieldTags          = "tags"
+	FieldStatus        = "status"
+	FieldLeadScore     = "lead_score"
+	FieldMessageCount  = "message_count"
+	FieldPurchaseCount = "purchase_count"
+	FieldLastMessageAt = "last_message_at"
+	FieldLastActiveAt  = "last_active_at"
+	FieldMessageText   = "message_text"
+	FieldIntent        = "intent"
+	FieldCustomField   = "custom_field"
+	FieldOptIn         = "opt_in"
+)
+
+// Opt-in values for FieldOptIn
+const (
+	OptedIn  = "opted_in"
+	OptedOut = "opted_out"
+)
+
+const (
+	maxDepth      = 3
+	maxConditions = 50
+
+	// Limits of message_text conditions
+	maxKeywords        = 50
+	defaultKeywordDays = 30
+	maxKeywordDays     = 3650
+)
+
+// ErrInvalidFilter wraps every validation error
+var ErrInvalidFilter = errors.New("invalid segment filter")
+
+var customFieldKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_]{1,50}$`)
+
+// Filter is a group of conditions. Match is "all" (AND, default) or "any" (OR).
+// A condition with its own Conditions is a nested group.
+//
+//	{"match":"all","conditions":[
+//	  {"field":"tags","op":"any","value":["<tag-id>"]},
+//	  {"field":"lead_score","op":"gte","value":50},
+//	  {"match":"any","conditions":[
+//	    {"field":"last_message_at","op":"within_days","value":30},
+//	    {"field":"custom_field","key":"tier","op":"eq","value":"gold"},
+//	    {"field":"message_text","op":"contains_any","value":["promo"],"days":14}]}]}
+//
+// Custom fields defined as number, date or boolean are stored as text in a
+// fixed format (see package customfields), so gt/lt, before/after and eq
+// true/false work on them like on the built-in fields.
+type Filter struct {
+	Match      string      `json:"match,omitempty"`
+	Conditions []Condition `json:"conditions"`
+}
+
+// Condition is one comparison, or a nested group when Conditions is set.
+// Days limits message_text conditions to the customer's messages of the
+// last Days days (default 30).
+type Condition struct {
+	Field string          `json:"field,omitempty"`
+	Key   string          `json:"key,omitempty"`
+	Op    string          `json:"op,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+	Days  int             `json:"days,omitempty"`
+
+	Match      string      `json:"match,omitempty"`
+	Conditions []Condition `json:"conditions,omitempty"`
+}
+
+func (c Condition) isGroup() bool {
+	return c.Field == "" && len(c.Conditions) > 0
+}
+
+// Query collects the SQL arguments of a compiled filter. Start is the number
+// of arguments that precede the filter in the final query.
+type Query struct {
+	Args []interface{}
+	base int
+}
+
+// NewQuery starts a query whose first placeholder is $start+1
+func NewQuery(start int) *Query {
+	return &Query{base: start}
+}
+
+func (q *Query) arg(value interface{}) string {
+	q.Args = append(q.Args, value)
+	return "$" + strconv.Itoa(q.base+len(q.Args))
+}
+
+// Validate checks a filter without building it
+func (f Filter) Validate() error {
+	_, err := f.SQL(NewQuery(0))
+	return err
+}
+
+// SQL compiles the filter to a predicate on ci. Values are always bound as
+// arguments; only whitelisted column names are written into the SQL.
+func (f Filter) SQL(q *Query) (string, error) {
+	count := 0
+	return buildGroup(q, f.Match, f.Conditions, 1, &count)
+}
+
+func buildGroup(q *Query, match string, conditions []Condition, depth int, count *int) (string, error) {
+	if depth > maxDepth {
+		return "", fmt.Errorf("%w: groups can be nested at most %d levels", ErrInvalidFilter, maxDepth)
+	}
+
+	joiner := " AND "
+	switch match {
+	case "", MatchAll:
+	case MatchAny:
+		joiner = " OR "
+	default:
+		return "", fmt.Errorf("%w: match must be all or any", ErrInvalidFilter)
+	}
+
+	if len(conditions) == 0 {
+		// An empty group matches every customer
+		return "TRUE", nil
+	}
+
+	parts := make([]string, 0, len(conditions))
+	for _, cond := range conditions {
+		*count++
+		if *count > maxConditions {
+			return "", fmt.Errorf("%w: at most %d conditions", ErrInvalidFilter, maxConditions)
+		}
+
+		var part string
+		var err error
+		if cond.isGroup() {
+			part, err = buildGroup(q, cond.Match, cond.Conditions, depth+1, count)
+		} else {
+			part, err = buildCondition(q, cond)
+		}
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, "("+part+")")
+	}
+
+	return strings.Join(parts, joiner), nil
+}
+
+func buildCondition(q *Query, c Condition) (string, error) {
+	switch c.Field {
+	case FieldTags:
+		return buildTags(q, c)
+	case FieldStatus:
+		return buildStringList(q, c, `COALESCE(ci.status, 'new')`)
+	case FieldIntent:
+		return buildStringList(q, c, `ci.intent`)
+	case FieldLeadScore:
+		return buildNumber(q, c, `COALESCE(ci.lead_score, 0)`)
+	case FieldMessageCount:
+		return buildNumber(q, c, `COALESCE(ci.message_count, 0)`)
+	case FieldPurchaseCount:
+		return buildNumber(q, c, `ci.purchase_count`)
+	case FieldLastMessageAt:
+		return buildDate(q, c, `ci.last_message_at`)
+	case FieldLastActiveAt:
+		// Customers who never wrote count as active since they were added
+		return buildDate(q, c, `COALESCE(ci.last_message_at, ci.created_at)`)
+	case FieldMessageText:
+		return buildMessageText(q, c)
+	case FieldCustomField:
+		return buildCustomField(q, c)
+	case FieldOptIn:
+		var state string
+		if err := decodeValue(c, &state); err != nil {
+			return "", err
+		}
+		switch state {
+		case OptedIn:
+			return `ci.opted_out = false`, nil
+		case OptedOut:
+			return `ci.opted_out = true`, nil
+		}
+		return "", invalidValue(c, "opted_in or opted_out")
+	case "":
+		return "", fmt.Errorf("%w: condition needs a field or nested conditions", ErrInvalidFilter)
+	}
+	return "", fmt.Errorf("%w: unknown field %q", ErrInvalidFilter, c.Field)
+}
+
+// buildTags handles any/all/none of a list of tag IDs
+func buildTags(q *Query, c Condition) (string, error) {
+	var ids []string
+	if err := decodeValue(c, &ids); err != nil || len(ids) == 0 {
+		return "", invalidValue(c, "a non-empty list of tag IDs")
+	}
+	ids = unique(ids)
+
+	switch c.Op {
+	case "any", "none":
+		exists := `EXISTS (
+			SELECT 1 FROM customer_tag_assignments cta
+			WHERE cta.customer_id = ci.id AND cta.tag_id::text = ANY(` + q.arg(pq.Array(ids)) + `)
+		)`
+		if c.Op == "none" {
+			return "NOT " + exists, nil
+		}
+		return exists, nil
+	case "all":
+		return `(
+			SELECT COUNT(DISTINCT cta.tag_id) FROM customer_tag_assignments cta
+			WHERE cta.customer_id = ci.id AND cta.tag_id::text = ANY(` + q.arg(pq.Array(ids)) + `)
+		) = ` + q.arg(len(ids)), nil
+	}
+	return "", invalidOp(c, "any, all, none")
+}
+
+// buildStringList handles in/not_in/is_empty/is_not_empty on a text column
+func buildStringList(q *Query, c Condition, column string) (string, error) {
+	switch c.Op {
+	case "is_empty":
+		return column + ` IS NULL OR ` + column + ` = ''`, nil
+	case "is_not_empty":
+		return column + ` IS NOT NULL AND ` + column + ` <> ''`, nil
+	case "eq", "neq", "in", "not_in":
+	default:
+		return "", invalidOp(c, "eq, neq, in, not_in, is_empty, is_not_empty")
+	}
+
+	values, err := decodeStrings(c)
+	if err != nil {
+		return "", err
+	}
+
+	if c.Op == "neq" || c.Op == "not_in" {
+		return `COALESCE(` + column + `, '') <> ALL(` + q.arg(pq.Array(values)) + `)`, nil
+	}
+	return column + ` = ANY(` + q.arg(pq.Array(values)) + `)`, nil
+}
+
+// numericOps maps comparison operators to SQL
+var numericOps = map[string]string{
+	"eq": "=", "neq": "<>", "gt": ">", "gte": ">=", "lt": "<", "lte": "<=",
+}
+
+// buildNumber handles comparisons and between on a numeric expression
+func buildNumber(q *Query, c Condition, expr string) (string, error) {
+	if c.Op == "between" {
+		var bounds []float64
+		if err := decodeValue(c, &bounds); err != nil || len(bounds) != 2 {
+			return "", invalidValue(c, "[min, max]")
+		}
+		return expr + ` BETWEEN ` + q.arg(bounds[0]) + ` AND ` + q.arg(bounds[1]), nil
+	}
+
+	sqlOp, ok := numericOps[c.Op]
+	if !ok {
+		return "", invalidOp(c, "eq, neq, gt, gte, lt, lte, between")
+	}
+	var value float64
+	if err := decodeValue(c, &value); err != nil {
+		return "", invalidValue(c, "a number")
+	}
+	return expr + ` ` + sqlOp + ` ` + q.arg(value), nil
+}
+
+// buildDate handles relative (days) and absolute (YYYY-MM-DD) date conditions
+func buildDate(q *Query, c Condition, column string) (string, error) {
+	switch c.Op {
+	case "is_empty":
+		return column + ` IS NULL`, nil
+	case "is_not_empty":
+		return column + ` IS NOT NULL`, nil
+	case "within_days", "older_than_days":
+		var days int
+		if err := decodeValue(c, &days); err != nil || days < 0 {
+			return "", invalidValue(c, "a number of days")
+		}
+		if c.Op == "within_days" {
+			return column + ` >= NOW() - make_interval(days => ` + q.arg(days) + `)`, nil
+		}
+		return column + ` < NOW() - make_interval(days => ` + q.arg(days) + `)`, nil
+	case "before", "after":
+		var raw string
+		if err := decodeValue(c, &raw); err != nil {
+			return "", invalidValue(c, "a date (YYYY-MM-DD)")
+		}
+		date, err := time.Parse("2006-01-02", raw)
+		if err != nil {
+			return "", invalidValue(c, "a date (YYYY-MM-DD)")
+		}
+		if c.Op == "before" {
+			return column + ` < ` + q.arg(date), nil
+		}
+		return column + ` >= ` + q.arg(date.AddDate(0, 0, 1)), nil
+	}
+	return "", invalidOp(c, "within_days, older_than_days, before, after, is_empty, is_not_empty")
+}
+
+// buildMessageText matches customers who sent a message (not our replies)
+// whose text or caption contains any of the keywords, case-insensitively
+func buildMessageText(q *Query, c Condition) (string, error) {
+	if c.Op != "contains_any" {
+		return "", invalidOp(c, "contains_any")
+	}
+	var keywords []string
+	if err := decodeValue(c, &keywords); err != nil {
+		return "", invalidValue(c, "a list of keywords")
+	}
+	patterns := make([]string, 0, len(keywords))
+	for _, keyword := range keywords {
+		if keyword = strings.TrimSpace(keyword); keyword != "" {
+			patterns = append(patterns, "%"+escapeLike(keyword)+"%")
+		}
+	}
+	if len(patterns) == 0 || len(patterns) > maxKeywords {
+		return "", invalidValue(c, fmt.Sprintf("1 to %d keywords", maxKeywords))
+	}
+
+	days := c.Days
+	if days == 0 {
+		days = defaultKeywordDays
+	}
+	if days < 1 || days > maxKeywordDays {
+		return "", fmt.Errorf("%w: %s days must be between 1 and %d", ErrInvalidFilter, c.Field, maxKeywordDays)
+	}
+
+	return `EXISTS (
+			SELECT 1 FROM whatsapp_messages m
+			WHERE m.tenant_id = ci.tenant_id AND m.chat_jid = ci.customer_jid AND m.is_from_me = false
+			  AND m.timestamp >= EXTRACT(EPOCH FROM NOW() - make_interval(days => ` + q.arg(days) + `))::bigint
+			  AND COALESCE(m.message_text, '') || ' ' || COALESCE(m.caption, '') ILIKE ANY(` + q.arg(pq.Array(patterns)) + `)
+		)`, nil
+}
+
+// buildCustomField compares custom_fields[key]. Numeric and date comparisons
+// ignore values that are not numbers or dates instead of failing the query.
+func buildCustomField(q *Query, c Condition) (string, error) {
+	if !customFieldKeyPattern.MatchString(c.Key) {
+		return "", fmt.Errorf("%w: custom_field needs a key of letters, digits and _", ErrInvalidFilter)
+	}
+	value := `(ci.custom_fields ->> ` + q.arg(c.Key) + `)`
+
+	switch c.Op {
+	case "exists":
+		return value + ` IS NOT NULL AND ` + value + ` <> ''`, nil
+	case "not_exists":
+		return value + ` IS NULL OR ` + value + ` = ''`, nil
+	case "eq", "neq", "in", "not_in":
+		values, err := decodeFieldValues(c)
+		if err != nil {
+			return "", err
+		}
+		if c.Op == "neq" || c.Op == "not_in" {
+			return `COALESCE(lower(` + value + `), '') <> ALL(` + q.arg(pq.Array(lowerAll(values))) + `)`, nil
+		}
+		return `lower(` + value + `) = ANY(` + q.arg(pq.Array(lowerAll(values))) + `)`, nil
+	case "contains":
+		var s string
+		if err := decodeValue(c, &s); err != nil || s == "" {
+			return "", invalidValue(c, "text")
+		}
+		return value + ` ILIKE ` + q.arg("%"+escapeLike(s)+"%"), nil
+	case "before", "after":
+		var raw string
+		if err := decodeValue(c, &raw); err != nil {
+			return "", invalidValue(c, "a date (YYYY-MM-DD)")
+		}
+		date, err := time.Parse("2006-01-02", raw)
+		if err != nil {
+			return "", invalidValue(c, "a date (YYYY-MM-DD)")
+		}
+		asDate := `(CASE WHEN ` + value + ` ~ '^\d{4}-\d{2}-\d{2}' THEN left(` + value + `, 10)::date END)`
+		if c.Op == "before" {
+			return asDate + ` < ` + q.arg(date), nil
+		}
+		return asDate + ` > ` + q.arg(date), nil
+	}
+
+	asNumber := `(CASE WHEN ` + value + ` ~ '^-?\d+(\.\d+)?$' THEN (` + value + `)::numeric END)`
+	if c.Op == "between" {
+		return buildNumber(q, c, asNumber)
+	}
+	if _, ok := numericOps[c.Op]; ok {
+		return buildNumber(q, c, asNumber)
+	}
+	return "", invalidOp(c, "eq, neq, in, not_in, contains, exists, not_exists, gt, gte, lt, lte, between, before, after")
+}
+
+func decodeValue(c Condition, v interface{}) error {
+	if len(c.Value) == 0 {
+		return invalidValue(c, "a value")
+	}
+	if err := json.Unmarshal(c.Value, v); err != nil {
+		return invalidValue(c, "a valid value")
+	}
+	return nil
+}
+
+// decodeStrings accepts a single string or a list of strings
+func decodeStrings(c Condition) ([]string, error) {
+	var values []string
+	if err := json.Unmarshal(c.Value, &values); err != nil {
+		var single string
+		if err := json.Unmarshal(c.Value, &single); err != nil {
+			return nil, invalidValue(c, "text or a list of text")
+		}
+		values = []string{single}
+	}
+	if len(values) == 0 {
+		return nil, invalidValue(c, "at least one value")
+	}
+	return values, nil
+}
+
+// decodeFieldValues is decodeStrings for custom fields, whose values are
+// stored as text: numbers and booleans compare as their text form, so
+// {"key":"member","op":"eq","value":true} matches a boolean field.
+func decodeFieldValues(c Condition) ([]string, error) {
+	var raw []interface{}
+	if err := json.Unmarshal(c.Value, &raw); err != nil {
+		var single interface{}
+		if err := json.Unmarshal(c.Value, &single); err != nil {
+			return nil, invalidValue(c, "a value or a list of values")
+		}
+		raw = []interface{}{single}
+	}
+
+	values := make([]string, 0, len(raw))
+	for _, v := range raw {
+		switch v := v.(type) {
+		case string:
+			values = append(values, v)
+		case bool:
+			values = append(values, strconv.FormatBool(v))
+		case float64:
+			values = append(values, strconv.FormatFloat(v, 'f', -1, 64))
+		default:
+			return nil, invalidValue(c, "text, numbers or booleans")
+		}
+	}
+	if len(values) == 0 {
+		return nil, invalidValue(c, "at least one value")
+	}
+	return values, nil
+}
+
+func invalidOp(c Condition, allowed string) error {
+	return fmt.Errorf("%w: %s supports op %s", ErrInvalidFilter, c.Field, allowed)
+}
+
+func invalidValue(c Condition, want string) error {
+	return fmt.Errorf("%w: %s %s needs %s", ErrInvalidFilter, c.Field, c.Op, want)
+}
+
+func unique(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	out := values[:0]
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func lowerAll(values []string) []string {
+	out := make([]string, len(values))
+	for i, v := range values {
+		out[i] = strings.ToLower(v)
+	}
+	return out
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -0,0 +1,149 @@
+package segment
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestFilterSQL(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter string
+		start  int
+		want   string
+		args   []interface{}
+	}{
+		{
+			name:   "empty filter matches everyone",
+			filter: `{"conditions":[]}`,
+			want:   `TRUE`,
+		},
+		{
+			name:   "number comparison",
+			filter: `{"conditions":[{"field":"lead_score","op":"gte","value":50}]}`,
+			want:   `(COALESCE(ci.lead_score, 0) >= $1)`,
+			args:   []interface{}{50.0},
+		},
+		{
+			name:   "placeholders follow preceding arguments",
+			filter: `{"conditions":[{"field":"purchase_count","op":"between","value":[1,3]}]}`,
+			start:  2,
+			want:   `(ci.purchase_count BETWEEN $3 AND $4)`,
+			args:   []interface{}{1.0, 3.0},
+		},
+		{
+			name:   "all joins with AND",
+			filter: `{"match":"all","conditions":[{"field":"status","op":"in","value":["new","lead"]},{"field":"opt_in","op":"eq","value":"opted_in"}]}`,
+			want:   `(COALESCE(ci.status, 'new') = ANY($1)) AND (ci.opted_out = false)`,
+			args:   []interface{}{pq.Array([]string{"new", "lead"})},
+		},
+		{
+			name:   "any joins with OR",
+			filter: `{"match":"any","conditions":[{"field":"intent","op":"neq","value":"complaint"},{"field":"last_message_at","op":"is_empty"}]}`,
+			want:   `(COALESCE(ci.intent, '') <> ALL($1)) OR (ci.last_message_at IS NULL)`,
+			args:   []interface{}{pq.Array([]string{"complaint"})},
+		},
+		{
+			name:   "nested group",
+			filter: `{"conditions":[{"field":"message_count","op":"gt","value":5},{"match":"any","conditions":[{"field":"last_message_at","op":"within_days","value":30},{"field":"lead_score","op":"lt","value":10}]}]}`,
+			want:   `(COALESCE(ci.message_count, 0) > $1) AND ((ci.last_message_at >= NOW() - make_interval(days => $2)) OR (COALESCE(ci.lead_score, 0) < $3))`,
+			args:   []interface{}{5.0, 30, 10.0},
+		},
+		{
+			name:   "absolute date",
+			filter: `{"conditions":[{"field":"last_message_at","op":"after","value":"2024-05-01"}]}`,
+			want:   `(ci.last_message_at >= $1)`,
+			args:   []interface{}{time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)},
+		},
+		{
+			name:   "custom field compared as text",
+			filter: `{"conditions":[{"field":"custom_field","key":"member","op":"eq","value":true}]}`,
+			want:   `(lower((ci.custom_fields ->> $1)) = ANY($2))`,
+			args:   []interface{}{"member", pq.Array([]string{"true"})},
+		},
+		{
+			name:   "custom field contains escapes LIKE wildcards",
+			filter: `{"conditions":[{"field":"custom_field","key":"note","op":"contains","value":"50%_off"}]}`,
+			want:   `((ci.custom_fields ->> $1) ILIKE $2)`,
+			args:   []interface{}{"note", `%50\%\_off%`},
+		},
+		{
+			name:   "tags none",
+			filter: `{"conditions":[{"field":"tags","op":"none","value":["a","b","a"]}]}`,
+			want: `(NOT EXISTS (
+			SELECT 1 FROM customer_tag_assignments cta
+			WHERE cta.customer_id = ci.id AND cta.tag_id::text = ANY($1)
+		))`,
+			args: []interface{}{pq.Array([]string{"a", "b"})},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var f Filter
+			if err := json.Unmarshal([]byte(tt.filter), &f); err != nil {
+				t.Fatal(err)
+			}
+			q := NewQuery(tt.start)
+			got, err := f.SQL(q)
+			if err != nil {
+				t.Fatalf("SQL() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("SQL() =\n%s\nwant\n%s", got, tt.want)
+			}
+			if !reflect.DeepEqual(q.Args, tt.args) {
+				t.Errorf("Args = %#v, want %#v", q.Args, tt.args)
+			}
+		})
+	}
+}
+
+func TestFilterSQLInvalid(t *testing.T) {
+	deep := `{"conditions":[{"field":"lead_score","op":"gt","value":1}]}`
+	for i := 0; i < maxDepth; i++ {
+		deep = `{"match":"any","conditions":[` + deep + `]}`
+	}
+	tooMany := `{"field":"lead_score","op":"gt","value":1}` + strings.Repeat(`,{"field":"lead_score","op":"gt","value":1}`, maxConditions)
+
+	tests := []struct {
+		name    string
+		filter  string
+		message string
+	}{
+		{"unknown match", `{"match":"some","conditions":[]}`, "match must be all or any"},
+		{"unknown field", `{"conditions":[{"field":"salary","op":"gt","value":1}]}`, `unknown field "salary"`},
+		{"missing field", `{"conditions":[{"op":"gt","value":1}]}`, "needs a field"},
+		{"unsupported op", `{"conditions":[{"field":"lead_score","op":"contains","value":1}]}`, "lead_score supports op"},
+		{"wrong value type", `{"conditions":[{"field":"lead_score","op":"gt","value":"high"}]}`, "needs a number"},
+		{"between needs two bounds", `{"conditions":[{"field":"lead_score","op":"between","value":[1]}]}`, "needs [min, max]"},
+		{"bad date", `{"conditions":[{"field":"last_message_at","op":"before","value":"01/05/2024"}]}`, "needs a date"},
+		{"empty tag list", `{"conditions":[{"field":"tags","op":"any","value":[]}]}`, "non-empty list"},
+		{"custom field key", `{"conditions":[{"field":"custom_field","key":"a-b","op":"eq","value":"x"}]}`, "needs a key"},
+		{"bad opt-in state", `{"conditions":[{"field":"opt_in","op":"eq","value":"maybe"}]}`, "opted_in or opted_out"},
+		{"nested too deep", `{"conditions":[` + deep + `]}`, "nested at most"},
+		{"too many conditions", `{"conditions":[` + tooMany + `]}`, "at most 50 conditions"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var f Filter
+			if err := json.Unmarshal([]byte(tt.filter), &f); err != nil {
+				t.Fatal(err)
+			}
+			_, err := f.SQL(NewQuery(0))
+			if !errors.Is(err, ErrInvalidFilter) {
+				t.Fatalf("SQL() error = %v, want ErrInvalidFilter", err)
+			}
+			if !strings.Contains(err.Error(), tt.message) {
+				t.Errorf("SQL() error = %q, want it to mention %q", err, tt.message)
+			}
+		})
+	}
+}
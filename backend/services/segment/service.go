@@ -0,0 +1,175 @@
+package segment
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Segment is a saved customer filter
+type Segment struct {
+	ID          string    `json:"id" db:"id"`
+	TenantID    string    `json:"tenant_id" db:"tenant_id"`
+	Name        string    `json:"name" db:"name"`
+	Description *string   `json:"description" db:"description"`
+	Filter      Filter    `json:"filter" db:"-"`
+	FilterJSON  string    `json:"-" db:"filter"`
+	CreatedBy   *string   `json:"created_by" db:"created_by"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
+	MemberCount *int      `json:"member_count,omitempty" db:"-"`
+}
+
+// Columns is the select list for Segment
+const Columns = `id, tenant_id, name, description, filter::text as filter, created_by, created_at, updated_at`
+
+// DecodeFilter fills Filter from the stored JSON
+func (s *Segment) DecodeFilter() error {
+	return json.Unmarshal([]byte(s.FilterJSON), &s.Filter)
+}
+
+// Member is a customer matching a segment
+type Member struct {
+	ID            string     `json:"id" db:"id"`
+	CustomerJID   string     `json:"customer_jid" db:"customer_jid"`
+	CustomerName  *string    `json:"customer_name" db:"customer_name"`
+	CustomerPhone *string    `json:"customer_phone" db:"customer_phone"`
+	Status        string     `json:"status" db:"status"`
+	LeadScore     int        `json:"lead_score" db:"lead_score"`
+	MessageCount  int        `json:"message_count" db:"message_count"`
+	LastMessageAt *time.Time `json:"last_message_at" db:"last_message_at"`
+	OptedOut      bool       `json:"opted_out" db:"opted_out"`
+}
+
+// Service evaluates segments against customer_insights
+type Service struct {
+	db *sqlx.DB
+}
+
+// NewService creates a segment service
+func NewService(db *sqlx.DB) *Service {
+	return &Service{db: db}
+}
+
+// Get loads a segment of the tenant with its decoded filter
+func (s *Service) Get(ctx context.Context, tenantID, segmentID string) (*Segment, error) {
+	var seg Segment
+	err := s.db.GetContext(ctx, &seg, `SELECT `+Columns+` FROM customer_segments WHERE id = $1 AND tenant_id = $2`, segmentID, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	if err := seg.DecodeFilter(); err != nil {
+		return nil, err
+	}
+	return &seg, nil
+}
+
+// where builds the FROM/WHERE clause for the tenant's customers matching
+// filter. Group chats never match; opted-out customers are dropped when
+// reachableOnly is set.
+func where(tenantID string, filter Filter, reachableOnly bool) (string, []interface{}, error) {
+	q := NewQuery(1)
+	predicate, err := filter.SQL(q)
+	if err != nil {
+		return "", nil, err
+	}
+
+	clause := `
+		FROM customer_insights ci
+		WHERE ci.tenant_id = $1 AND ci.customer_jid NOT LIKE '%@g.us' AND (` + predicate + `)`
+	if reachableOnly {
+		clause += ` AND ci.opted_out = false`
+	}
+	return clause, append([]interface{}{tenantID}, q.Args...), nil
+}
+
+// Count returns how many customers match filter. reachableOnly excludes
+// customers who opted out of broadcasts.
+func (s *Service) Count(ctx context.Context, tenantID string, filter Filter, reachableOnly bool) (int, error) {
+	clause, args, err := where(tenantID, filter, reachableOnly)
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	err = s.db.GetContext(ctx, &count, `SELECT COUNT(*) `+clause, args...)
+	return count, err
+}
+
+// Members returns a page of customers matching filter, most recently active first
+func (s *Service) Members(ctx context.Context, tenantID string, filter Filter, limit, offset int) ([]Member, error) {
+	clause, args, err := where(tenantID, filter, false)
+	if err != nil {
+		return nil, err
+	}
+
+	members := []Member{}
+	err = s.db.SelectContext(ctx, &members, `
+		SELECT ci.id, ci.customer_jid, ci.customer_name, ci.customer_phone,
+			COALESCE(ci.status, 'new') as status, COALESCE(ci.lead_score, 0) as lead_score,
+			COALESCE(ci.message_count, 0) as message_count, ci.last_message_at, ci.opted_out
+		`+clause+`
+		ORDER BY ci.last_message_at DESC NULLS LAST, ci.created_at DESC
+		LIMIT $`+strconv.Itoa(len(args)+1)+` OFFSET $`+strconv.Itoa(len(args)+2),
+		append(args, limit, offset)...)
+	return members, err
+}
+
+// MemberIDs returns the IDs of every member of filter who can be messaged
+func (s *Service) MemberIDs(ctx context.Context, tenantID string, filter Filter) ([]string, error) {
+	clause, args, err := where(tenantID, filter, true)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	err = s.db.SelectContext(ctx, &ids, `SELECT ci.id `+clause, args...)
+	return ids, err
+}
+
+// AddBroadcastRecipients resolves the segment now and adds every reachable
+// member to the broadcast's current run, unless they are in it already or
+// still wait to be sent from an earlier run. It is called each time a
+// segment broadcast is sent, so every run of a recurring broadcast reaches
+// the segment as it is then. It returns the number of recipients added.
+func (s *Service) AddBroadcastRecipients(ctx context.Context, tenantID, broadcastID, segmentID string) (int, error) {
+	seg, err := s.Get(ctx, tenantID, segmentID)
+	if err != nil {
+		return 0, err
+	}
+
+	clause, args, err := where(tenantID, seg.Filter, true)
+	if err != nil {
+		return 0, err
+	}
+
+	broadcastArg := "$" + strconv.Itoa(len(args)+1)
+	// Members join the broadcast's current run once
+	result, err := s.db.ExecContext(ctx, `
+		INSERT INTO broadcast_recipients (broadcast_id, run_id, customer_id, customer_jid)
+		SELECT `+broadcastArg+`::uuid, (SELECT current_run_id FROM broadcasts WHERE id = `+broadcastArg+`::uuid), ci.id, ci.customer_jid
+		`+clause+`
+		AND NOT EXISTS (
+			SELECT 1 FROM broadcast_recipients br
+			JOIN broadcasts b ON b.id = br.broadcast_id
+			WHERE br.broadcast_id = `+broadcastArg+`::uuid AND br.customer_id = ci.id
+			  AND (br.run_id IS NOT DISTINCT FROM b.current_run_id OR br.status IN ('pending', 'queued', 'sending'))
+		)
+	`, append(args, broadcastID)...)
+	if err != nil {
+		return 0, err
+	}
+
+	added, _ := result.RowsAffected()
+	s.db.ExecContext(ctx, `
+		UPDATE broadcasts b
+		SET total_recipients = (
+			SELECT COUNT(*) FROM broadcast_recipients br
+			WHERE br.broadcast_id = b.id AND br.run_id IS NOT DISTINCT FROM b.current_run_id
+		), updated_at = NOW()
+		WHERE b.id = $1
+	`, broadcastID)
+
+	return int(added), nil
+}
@@ -0,0 +1,174 @@
+package sequence
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"time"
+
+	"gowa-backend/services/segment"
+
+	"github.com/lib/pq"
+)
+
+// Enrollment is a customer's progress through a sequence
+type Enrollment struct {
+	ID           string     `json:"id" db:"id"`
+	SequenceID   string     `json:"sequence_id" db:"sequence_id"`
+	CustomerID   string     `json:"customer_id" db:"customer_id"`
+	CustomerJID  string     `json:"customer_jid" db:"customer_jid"`
+	CustomerName *string    `json:"customer_name" db:"customer_name"`
+	Status       string     `json:"status" db:"status"`
+	Source       string     `json:"source" db:"source"`
+	NextPosition int        `json:"next_position" db:"next_position"`
+	NextStepAt   *time.Time `json:"next_step_at" db:"next_step_at"`
+	LastStepAt   *time.Time `json:"last_step_at" db:"last_step_at"`
+	ExitReason   *string    `json:"exit_reason" db:"exit_reason"`
+	EnrolledBy   *string    `json:"enrolled_by" db:"enrolled_by"`
+	EnrolledAt   time.Time  `json:"enrolled_at" db:"enrolled_at"`
+	EndedAt      *time.Time `json:"ended_at" db:"ended_at"`
+}
+
+// enroll adds the customers matching audience, a condition on
+// customer_insights ci, to the sequence. Group chats, opted-out customers
+// and customers already active in the sequence are skipped; with once set,
+// so is anyone who was ever enrolled. The first step is due after its delay.
+func (s *Service) enroll(ctx context.Context, tenantID, sequenceID, audience string, args []interface{}, source, enrolledBy string, once bool) (int, error) {
+	n := len(args)
+	query := `
+		INSERT INTO sequence_enrollments (tenant_id, sequence_id, customer_id, customer_jid, source, enrolled_by, next_step_at)
+		SELECT s.tenant_id, s.id, ci.id, ci.customer_jid, $` + strconv.Itoa(n+3) + `, NULLIF($` + strconv.Itoa(n+4) + `, '')::uuid,
+			NOW() + make_interval(mins => st.delay_minutes)
+		FROM sequences s
+		JOIN sequence_steps st ON st.sequence_id = s.id AND st.position = 1
+		JOIN customer_insights ci ON ci.tenant_id = s.tenant_id
+		WHERE s.tenant_id = $` + strconv.Itoa(n+1) + ` AND s.id::text = $` + strconv.Itoa(n+2) + `
+		  AND ci.customer_jid NOT LIKE '%@g.us' AND ci.opted_out = false
+		  AND (` + audience + `)`
+	if once {
+		query += `
+		  AND NOT EXISTS (SELECT 1 FROM sequence_enrollments e WHERE e.sequence_id = s.id AND e.customer_id = ci.id)`
+	}
+	query += `
+		ON CONFLICT (sequence_id, customer_id) WHERE status = 'active' DO NOTHING`
+
+	result, err := s.db.ExecContext(ctx, query, append(args, tenantID, sequenceID, source, enrolledBy)...)
+	if err != nil {
+		return 0, err
+	}
+	added, _ := result.RowsAffected()
+	return int(added), nil
+}
+
+// Exists checks the sequence belongs to the tenant
+func (s *Service) Exists(ctx context.Context, tenantID, sequenceID string) error {
+	var found bool
+	err := s.db.GetContext(ctx, &found, `SELECT EXISTS (SELECT 1 FROM sequences WHERE id::text = $1 AND tenant_id = $2)`, sequenceID, tenantID)
+	if err == nil && !found {
+		err = sql.ErrNoRows
+	}
+	return err
+}
+
+// EnrollCustomers enrolls customers by ID and returns how many were added
+func (s *Service) EnrollCustomers(ctx context.Context, tenantID, sequenceID string, customerIDs []string, enrolledBy string) (int, error) {
+	if err := s.Exists(ctx, tenantID, sequenceID); err != nil {
+		return 0, err
+	}
+	return s.enroll(ctx, tenantID, sequenceID, `ci.id::text = ANY($1)`, []interface{}{pq.Array(customerIDs)}, SourceManual, enrolledBy, false)
+}
+
+// EnrollTag enrolls every customer carrying the tag
+func (s *Service) EnrollTag(ctx context.Context, tenantID, sequenceID, tagID, enrolledBy string) (int, error) {
+	if err := s.Exists(ctx, tenantID, sequenceID); err != nil {
+		return 0, err
+	}
+	audience := `EXISTS (SELECT 1 FROM customer_tag_assignments cta WHERE cta.customer_id = ci.id AND cta.tag_id::text = $1)`
+	return s.enroll(ctx, tenantID, sequenceID, audience, []interface{}{tagID}, SourceTag, enrolledBy, false)
+}
+
+// EnrollSegment enrolls the segment's members as they are now
+func (s *Service) EnrollSegment(ctx context.Context, tenantID, sequenceID, segmentID, enrolledBy string) (int, error) {
+	if err := s.Exists(ctx, tenantID, sequenceID); err != nil {
+		return 0, err
+	}
+	segments := segment.NewService(s.db)
+	seg, err := segments.Get(ctx, tenantID, segmentID)
+	if err != nil {
+		return 0, err
+	}
+	ids, err := segments.MemberIDs(ctx, tenantID, seg.Filter)
+	if err != nil {
+		return 0, err
+	}
+	return s.enroll(ctx, tenantID, sequenceID, `ci.id::text = ANY($1)`, []interface{}{pq.Array(ids)}, SourceSegment, enrolledBy, false)
+}
+
+// Trigger enrolls a customer into the tenant's active sequences started by
+// one of the events, once per sequence. It is called as customer messages
+// are processed.
+func (s *Service) Trigger(ctx context.Context, tenantID, customerID string, events []string) (int, error) {
+	if len(events) == 0 {
+		return 0, nil
+	}
+	var sequences []struct {
+		ID      string `db:"id"`
+		Trigger string `db:"trigger_event"`
+	}
+	err := s.db.SelectContext(ctx, &sequences, `
+		SELECT id, trigger_event FROM sequences
+		WHERE tenant_id = $1 AND is_active AND trigger_event = ANY($2)
+	`, tenantID, pq.Array(events))
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, seq := range sequences {
+		added, err := s.enroll(ctx, tenantID, seq.ID, `ci.id::text = $1`, []interface{}{customerID}, seq.Trigger, "", true)
+		if err != nil {
+			return total, err
+		}
+		total += added
+	}
+	return total, nil
+}
+
+// Enrollments returns a page of the sequence's enrollments, newest first,
+// optionally with one status
+func (s *Service) Enrollments(ctx context.Context, tenantID, sequenceID, status string, limit, offset int) ([]Enrollment, int, error) {
+	where := `WHERE e.tenant_id = $1 AND e.sequence_id::text = $2 AND ($3 = '' OR e.status = $3)`
+	args := []interface{}{tenantID, sequenceID, status}
+
+	var total int
+	if err := s.db.GetContext(ctx, &total, `SELECT COUNT(*) FROM sequence_enrollments e `+where, args...); err != nil {
+		return nil, 0, err
+	}
+
+	enrollments := []Enrollment{}
+	err := s.db.SelectContext(ctx, &enrollments, `
+		SELECT e.id, e.sequence_id, e.customer_id, e.customer_jid, ci.customer_name, e.status, e.source,
+			e.next_position, e.next_step_at, e.last_step_at, e.exit_reason, e.enrolled_by, e.enrolled_at, e.ended_at
+		FROM sequence_enrollments e
+		JOIN customer_insights ci ON ci.id = e.customer_id
+		`+where+`
+		ORDER BY e.enrolled_at DESC
+		LIMIT $4 OFFSET $5
+	`, append(args, limit, offset)...)
+	return enrollments, total, err
+}
+
+// Cancel stops an active enrollment
+func (s *Service) Cancel(ctx context.Context, tenantID, sequenceID, enrollmentID string) error {
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE sequence_enrollments SET status = 'cancelled', next_step_at = NULL, ended_at = NOW()
+		WHERE id::text = $1 AND sequence_id::text = $2 AND tenant_id = $3 AND status = 'active'
+	`, enrollmentID, sequenceID, tenantID)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
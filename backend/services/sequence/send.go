@@ -0,0 +1,341 @@
+package sequence
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gowa-backend/services/broadcast"
+	"gowa-backend/services/templating"
+	"gowa-backend/services/whatsapp"
+)
+
+// claimLease is how long a claimed enrollment is held before another pass
+// may pick it up again, should sending it never finish
+const claimLease = 10 * time.Minute
+
+// mediaUploadTTL is how long a step's WhatsApp upload is reused
+const mediaUploadTTL = 24 * time.Hour
+
+// Sender sends step messages through WhatsApp
+type Sender interface {
+	broadcast.MediaUploader
+	SendMessage(ctx context.Context, tenantID string, recipientJID string, message string) (string, error)
+	SendUploadedMedia(ctx context.Context, tenantID string, recipientJID string, media *whatsapp.UploadedMedia, caption string) (string, error)
+}
+
+// Result counts what a pass over due enrollments did
+type Result struct {
+	Sent      int
+	Failed    int
+	Exited    int
+	Completed int
+}
+
+// due is a claimed enrollment with the step it waits for
+type due struct {
+	ID           string    `db:"id"`
+	TenantID     string    `db:"tenant_id"`
+	SequenceID   string    `db:"sequence_id"`
+	CustomerID   string    `db:"customer_id"`
+	CustomerJID  string    `db:"customer_jid"`
+	NextPosition int       `db:"next_position"`
+	Attempts     int       `db:"attempts"`
+	EnrolledAt   time.Time `db:"enrolled_at"`
+}
+
+// ProcessDue sends the next step of up to limit enrollments that are due,
+// in active sequences. Before each step its exit conditions are checked;
+// enrollments past the last step complete. An enrollment that fails is
+// tried again once its claim lapses; the first error is returned.
+func (s *Service) ProcessDue(ctx context.Context, sender Sender, limit int) (Result, error) {
+	var result Result
+	var firstErr error
+
+	var enrollments []due
+	err := s.db.SelectContext(ctx, &enrollments, `
+		UPDATE sequence_enrollments e SET next_step_at = NOW() + make_interval(secs => $2)
+		WHERE e.id IN (
+			SELECT d.id FROM sequence_enrollments d
+			JOIN sequences s ON s.id = d.sequence_id AND s.is_active
+			WHERE d.status = 'active' AND d.next_step_at <= NOW()
+			ORDER BY d.next_step_at
+			LIMIT $1
+			FOR UPDATE OF d SKIP LOCKED
+		)
+		RETURNING e.id, e.tenant_id, e.sequence_id, e.customer_id, e.customer_jid, e.next_position, e.attempts, e.enrolled_at
+	`, limit, claimLease.Seconds())
+	if err != nil {
+		return result, err
+	}
+
+	personalizers := map[string]*templating.Personalizer{}
+	for _, e := range enrollments {
+		outcome, err := s.process(ctx, sender, e, personalizers)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("enrollment %s: %w", e.ID, err)
+			}
+			continue
+		}
+		switch outcome {
+		case StatusCompleted:
+			result.Completed++
+		case StatusExited:
+			result.Exited++
+		case "sent":
+			result.Sent++
+		case "failed":
+			result.Failed++
+		}
+	}
+	return result, firstErr
+}
+
+// process handles one claimed enrollment and reports what happened
+func (s *Service) process(ctx context.Context, sender Sender, e due, personalizers map[string]*templating.Personalizer) (string, error) {
+	var step Step
+	err := s.db.GetContext(ctx, &step, `SELECT `+stepColumns+` FROM sequence_steps WHERE sequence_id = $1 AND position = $2`, e.SequenceID, e.NextPosition)
+	if err == sql.ErrNoRows {
+		return StatusCompleted, s.end(ctx, e.ID, StatusCompleted, "")
+	} else if err != nil {
+		return "", err
+	}
+
+	reason, err := s.exitReason(ctx, e, step)
+	if err != nil {
+		return "", err
+	}
+	if reason != "" {
+		return StatusExited, s.end(ctx, e.ID, StatusExited, reason)
+	}
+
+	// The step's send is recorded before it is sent, so a step is never sent
+	// twice to an enrollment, even when recording its outcome fails
+	var sendID string
+	err = s.db.GetContext(ctx, &sendID, `
+		INSERT INTO sequence_step_sends (enrollment_id, step_id, status)
+		VALUES ($1, $2, 'sending')
+		ON CONFLICT (enrollment_id, step_id) DO NOTHING
+		RETURNING id
+	`, e.ID, step.ID)
+	if err == sql.ErrNoRows {
+		return s.resume(ctx, e, step)
+	} else if err != nil {
+		return "", err
+	}
+
+	messageID, sendErr := s.send(ctx, sender, e, step, personalizers)
+	if sendErr != nil {
+		code := broadcast.Classify(sendErr)
+		if broadcast.Transient(code) && e.Attempts+1 < broadcast.MaxAttempts {
+			_, err = s.db.ExecContext(ctx, `
+				WITH retried AS (DELETE FROM sequence_step_sends WHERE id = $3)
+				UPDATE sequence_enrollments SET attempts = attempts + 1, next_step_at = NOW() + make_interval(secs => $2)
+				WHERE id = $1
+			`, e.ID, broadcast.RetryDelay(code, e.Attempts+1).Seconds(), sendID)
+			return "retrying", err
+		}
+		_, err = s.db.ExecContext(ctx, `
+			UPDATE sequence_step_sends SET status = 'failed', error_code = $2, error_message = $3
+			WHERE id = $1
+		`, sendID, code, sendErr.Error())
+		if err != nil {
+			return "", err
+		}
+		return "failed", s.advance(ctx, e, false)
+	}
+
+	_, err = s.db.ExecContext(ctx, `
+		UPDATE sequence_step_sends SET status = 'sent', message_id = $2, sent_at = NOW() WHERE id = $1
+	`, sendID, messageID)
+	if err != nil {
+		return "", err
+	}
+	return "sent", s.advance(ctx, e, true)
+}
+
+// resume moves on an enrollment whose step was already handled by an
+// earlier pass that didn't get to advance it. A send that never recorded its
+// outcome may have reached the customer, so it fails as unknown instead of
+// being sent again.
+func (s *Service) resume(ctx context.Context, e due, step Step) (string, error) {
+	var status string
+	err := s.db.GetContext(ctx, &status, `
+		UPDATE sequence_step_sends SET
+			status = CASE WHEN status = 'sending' THEN 'failed' ELSE status END,
+			error_code = CASE WHEN status = 'sending' THEN $3 ELSE error_code END,
+			error_message = CASE WHEN status = 'sending' THEN 'sending was interrupted, the message may have been sent' ELSE error_message END
+		WHERE enrollment_id = $1 AND step_id = $2
+		RETURNING status
+	`, e.ID, step.ID, broadcast.FailureUnknown)
+	if err != nil {
+		return "", err
+	}
+	if status == "sent" {
+		return "sent", s.advance(ctx, e, true)
+	}
+	return "failed", s.advance(ctx, e, false)
+}
+
+// exitReason checks the step's exit conditions for the enrollment. Customers
+// who opted out always leave.
+func (s *Service) exitReason(ctx context.Context, e due, step Step) (string, error) {
+	var state struct {
+		OptedOut bool `db:"opted_out"`
+		Replied  bool `db:"replied"`
+		Tagged   bool `db:"tagged"`
+	}
+	err := s.db.GetContext(ctx, &state, `
+		SELECT ci.opted_out,
+			$3 AND EXISTS (
+				SELECT 1 FROM whatsapp_messages m
+				WHERE m.tenant_id = ci.tenant_id AND m.chat_jid = $2 AND NOT m.is_from_me
+				  AND m.timestamp > EXTRACT(EPOCH FROM $4::timestamptz)::bigint
+			) as replied,
+			EXISTS (
+				SELECT 1 FROM customer_tag_assignments cta
+				WHERE cta.customer_id = ci.id AND cta.tag_id::text = ANY($5)
+			) as tagged
+		FROM customer_insights ci WHERE ci.id = $1
+	`, e.CustomerID, e.CustomerJID, step.ExitOnReply, e.EnrolledAt, step.ExitTagIDs)
+	if err == sql.ErrNoRows {
+		return ExitOptedOut, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	switch {
+	case state.OptedOut:
+		return ExitOptedOut, nil
+	case state.Replied:
+		return ExitReplied, nil
+	case state.Tagged:
+		return ExitTagAdded, nil
+	}
+	return "", nil
+}
+
+// send renders the step for the customer and sends it, with its media when
+// it has some
+func (s *Service) send(ctx context.Context, sender Sender, e due, step Step, personalizers map[string]*templating.Personalizer) (string, error) {
+	p, ok := personalizers[step.ID]
+	if !ok {
+		content := ""
+		if step.TemplateID != nil {
+			err := s.db.GetContext(ctx, &content, `SELECT content FROM message_templates WHERE id = $1`, *step.TemplateID)
+			if err != nil {
+				return "", fmt.Errorf("failed to load template: %w", err)
+			}
+		} else if step.MessageContent != nil {
+			content = *step.MessageContent
+		}
+		var err error
+		if p, err = templating.NewService(s.db).Personalizer(ctx, e.TenantID, content); err != nil {
+			return "", err
+		}
+		personalizers[step.ID] = p
+	}
+
+	message, err := p.Render(ctx, e.CustomerID)
+	if err != nil {
+		return "", err
+	}
+	if message == "" && step.MediaURL == nil {
+		return "", fmt.Errorf("%w: step %d has no message", ErrInvalidSequence, step.Position)
+	}
+
+	sendCtx := whatsapp.WithSender(ctx, whatsapp.SentBySequence, "")
+	if step.MediaURL == nil {
+		return sender.SendMessage(sendCtx, e.TenantID, e.CustomerJID, message)
+	}
+	media, err := s.media(ctx, sender, e.TenantID, step)
+	if err != nil {
+		return "", err
+	}
+	return sender.SendUploadedMedia(sendCtx, e.TenantID, e.CustomerJID, media, message)
+}
+
+// media returns the step's media uploaded to WhatsApp, uploading it on first
+// use and again once the upload expired
+func (s *Service) media(ctx context.Context, uploader broadcast.MediaUploader, tenantID string, step Step) (*whatsapp.UploadedMedia, error) {
+	var cached struct {
+		Upload     *string    `db:"media_upload"`
+		UploadedAt *time.Time `db:"media_uploaded_at"`
+	}
+	err := s.db.GetContext(ctx, &cached, `SELECT media_upload::text, media_uploaded_at FROM sequence_steps WHERE id = $1`, step.ID)
+	if err != nil {
+		return nil, err
+	}
+	if cached.Upload != nil && cached.UploadedAt != nil && time.Since(*cached.UploadedAt) < mediaUploadTTL {
+		var media whatsapp.UploadedMedia
+		if json.Unmarshal([]byte(*cached.Upload), &media) == nil {
+			return &media, nil
+		}
+	}
+
+	path, mediaType, err := broadcast.ResolveMedia(tenantID, *step.MediaURL)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read step media: %w", err)
+	}
+	fileName := filepath.Base(path)
+	if step.MediaFileName != nil && *step.MediaFileName != "" {
+		fileName = *step.MediaFileName
+	}
+
+	media, err := uploader.UploadMedia(ctx, tenantID, data, mediaType, fileName)
+	if err != nil {
+		return nil, err
+	}
+	media.LocalURL = *step.MediaURL
+
+	upload, _ := json.Marshal(media)
+	_, err = s.db.ExecContext(ctx, `
+		UPDATE sequence_steps SET media_upload = $1::jsonb, media_uploaded_at = NOW() WHERE id = $2
+	`, string(upload), step.ID)
+	return media, err
+}
+
+// advance moves the enrollment to the step after the one just handled,
+// due after that step's delay, or completes it after the last step
+func (s *Service) advance(ctx context.Context, e due, sent bool) error {
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE sequence_enrollments e SET
+			next_position = st.position,
+			next_step_at = NOW() + make_interval(mins => st.delay_minutes),
+			last_step_at = CASE WHEN $3 THEN NOW() ELSE e.last_step_at END,
+			attempts = 0
+		FROM sequence_steps st
+		WHERE e.id = $1 AND st.sequence_id = e.sequence_id AND st.position = $2 + 1
+	`, e.ID, e.NextPosition, sent)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows > 0 {
+		return nil
+	}
+
+	_, err = s.db.ExecContext(ctx, `
+		UPDATE sequence_enrollments SET status = 'completed', next_position = $2 + 1, next_step_at = NULL,
+			last_step_at = CASE WHEN $3 THEN NOW() ELSE last_step_at END, attempts = 0, ended_at = NOW()
+		WHERE id = $1
+	`, e.ID, e.NextPosition, sent)
+	return err
+}
+
+// end finishes the enrollment with a status and, for exits, a reason
+func (s *Service) end(ctx context.Context, enrollmentID, status, reason string) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE sequence_enrollments SET status = $2, exit_reason = NULLIF($3, ''), next_step_at = NULL, ended_at = NOW()
+		WHERE id = $1
+	`, enrollmentID, status, reason)
+	return err
+}
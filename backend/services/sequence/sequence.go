@@ -0,0 +1,309 @@
+// Package sequence sends drip sequences: ordered messages delivered to each
+// enrolled customer, every step after its delay from the previous one.
+// Customers are enrolled manually, by tag, by segment or by a trigger, and
+// leave early when the exit conditions of their next step are met:
+//
+//	{"name":"Welcome","trigger":"first_message","steps":[
+//	  {"delay_minutes":0,"message_content":"Halo {{name}}!"},
+//	  {"delay_minutes":2880,"template_id":"<template-id>","media_url":"/uploads/<tenant>/catalogue.pdf","exit_on_reply":true},
+//	  {"delay_minutes":7200,"message_content":"Diskon 10% untuk Anda","exit_tag_ids":["<tag-id>"]}]}
+package sequence
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gowa-backend/services/ai"
+	"gowa-backend/services/broadcast"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Triggers that enroll customers automatically
+const (
+	TriggerFirstMessage = "first_message"
+	TriggerOrderIntent  = ai.IntentOrder
+)
+
+// Enrollment sources besides the triggers
+const (
+	SourceManual  = "manual"
+	SourceTag     = "tag"
+	SourceSegment = "segment"
+)
+
+// Enrollment statuses
+const (
+	StatusActive    = "active"
+	StatusCompleted = "completed"
+	StatusExited    = "exited"
+	StatusCancelled = "cancelled"
+)
+
+// Exit reasons
+const (
+	ExitReplied  = "replied"
+	ExitTagAdded = "tag_added"
+	ExitOptedOut = "opted_out"
+)
+
+const (
+	maxSteps     = 20
+	maxDelayDays = 365
+)
+
+// ErrInvalidSequence wraps every validation error
+var ErrInvalidSequence = errors.New("invalid sequence")
+
+// Sequence is a drip sequence with its steps
+type Sequence struct {
+	ID                string    `json:"id" db:"id"`
+	TenantID          string    `json:"tenant_id" db:"tenant_id"`
+	Name              string    `json:"name" db:"name"`
+	Description       *string   `json:"description" db:"description"`
+	Trigger           *string   `json:"trigger" db:"trigger_event"`
+	IsActive          bool      `json:"is_active" db:"is_active"`
+	CreatedBy         *string   `json:"created_by" db:"created_by"`
+	CreatedAt         time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at" db:"updated_at"`
+	StepCount         int       `json:"step_count" db:"step_count"`
+	ActiveEnrollments int       `json:"active_enrollments" db:"active_enrollments"`
+	Steps             []Step    `json:"steps,omitempty" db:"-"`
+}
+
+// Columns is the select list for Sequence, with s aliasing sequences
+const Columns = `s.id, s.tenant_id, s.name, s.description, s.trigger_event, s.is_active,
+	s.created_by, s.created_at, s.updated_at,
+	(SELECT COUNT(*) FROM sequence_steps WHERE sequence_id = s.id) as step_count,
+	(SELECT COUNT(*) FROM sequence_enrollments WHERE sequence_id = s.id AND status = 'active') as active_enrollments`
+
+// Step is one message of a sequence
+type Step struct {
+	ID             string         `json:"id" db:"id"`
+	Position       int            `json:"position" db:"position"`
+	DelayMinutes   int            `json:"delay_minutes" db:"delay_minutes"`
+	MessageContent *string        `json:"message_content" db:"message_content"`
+	TemplateID     *string        `json:"template_id" db:"template_id"`
+	MediaURL       *string        `json:"media_url" db:"media_url"`
+	MediaType      *string        `json:"media_type" db:"media_type"`
+	MediaFileName  *string        `json:"media_file_name" db:"media_file_name"`
+	ExitOnReply    bool           `json:"exit_on_reply" db:"exit_on_reply"`
+	ExitTagIDs     pq.StringArray `json:"exit_tag_ids" db:"exit_tag_ids"`
+}
+
+const stepColumns = `id, position, delay_minutes, message_content, template_id, media_url, media_type,
+	media_file_name, exit_on_reply, exit_tag_ids::text[] as exit_tag_ids`
+
+// Definition is a sequence as created or updated through the API
+type Definition struct {
+	Name        string           `json:"name"`
+	Description *string          `json:"description"`
+	Trigger     string           `json:"trigger"`
+	IsActive    *bool            `json:"is_active"`
+	Steps       []StepDefinition `json:"steps"`
+}
+
+// StepDefinition is a step of a Definition. A step sends either
+// MessageContent or the message template TemplateID, optionally with an
+// uploaded file as MediaURL.
+type StepDefinition struct {
+	DelayMinutes   int      `json:"delay_minutes"`
+	MessageContent string   `json:"message_content"`
+	TemplateID     string   `json:"template_id"`
+	MediaURL       string   `json:"media_url"`
+	MediaFileName  string   `json:"media_file_name"`
+	ExitOnReply    bool     `json:"exit_on_reply"`
+	ExitTagIDs     []string `json:"exit_tag_ids"`
+
+	mediaType string
+}
+
+// Validate trims the definition and checks it can be sent. Templates and
+// tags are checked against the tenant when saving.
+func (d *Definition) Validate(tenantID string) error {
+	d.Name = strings.TrimSpace(d.Name)
+	if d.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidSequence)
+	}
+	switch d.Trigger {
+	case "", TriggerFirstMessage, TriggerOrderIntent:
+	default:
+		return fmt.Errorf("%w: trigger must be %s or %s", ErrInvalidSequence, TriggerFirstMessage, TriggerOrderIntent)
+	}
+	if len(d.Steps) == 0 || len(d.Steps) > maxSteps {
+		return fmt.Errorf("%w: a sequence needs 1 to %d steps", ErrInvalidSequence, maxSteps)
+	}
+
+	for i := range d.Steps {
+		step := &d.Steps[i]
+		n := i + 1
+		if step.DelayMinutes < 0 || step.DelayMinutes > maxDelayDays*24*60 {
+			return fmt.Errorf("%w: step %d: delay_minutes must be between 0 and %d days", ErrInvalidSequence, n, maxDelayDays)
+		}
+		step.MessageContent = strings.TrimSpace(step.MessageContent)
+		if (step.MessageContent == "") == (step.TemplateID == "") {
+			return fmt.Errorf("%w: step %d needs either message_content or template_id", ErrInvalidSequence, n)
+		}
+		if step.MediaURL != "" {
+			_, mediaType, err := broadcast.ResolveMedia(tenantID, step.MediaURL)
+			if err != nil {
+				return fmt.Errorf("%w: step %d: %v", ErrInvalidSequence, n, err)
+			}
+			step.mediaType = mediaType
+		}
+		if step.ExitTagIDs == nil {
+			step.ExitTagIDs = []string{}
+		}
+	}
+	return nil
+}
+
+// Service manages sequences and their enrollments
+type Service struct {
+	db *sqlx.DB
+}
+
+// NewService creates a sequence service
+func NewService(db *sqlx.DB) *Service {
+	return &Service{db: db}
+}
+
+// Get loads a sequence of the tenant with its steps
+func (s *Service) Get(ctx context.Context, tenantID, sequenceID string) (*Sequence, error) {
+	var seq Sequence
+	err := s.db.GetContext(ctx, &seq, `SELECT `+Columns+` FROM sequences s WHERE s.id::text = $1 AND s.tenant_id = $2`, sequenceID, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	seq.Steps = []Step{}
+	err = s.db.SelectContext(ctx, &seq.Steps, `SELECT `+stepColumns+` FROM sequence_steps WHERE sequence_id = $1 ORDER BY position`, seq.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &seq, nil
+}
+
+// Save creates the sequence, or with sequenceID set replaces its definition.
+// Steps keep their identity by position, so stats and enrollments waiting
+// for a step carry over to the step now in its place; enrollments waiting
+// for a removed step complete when next processed.
+func (s *Service) Save(ctx context.Context, tenantID, sequenceID string, def Definition, createdBy string) (*Sequence, error) {
+	if err := s.checkReferences(ctx, tenantID, def); err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	isActive := def.IsActive == nil || *def.IsActive
+	if sequenceID == "" {
+		err = tx.GetContext(ctx, &sequenceID, `
+			INSERT INTO sequences (tenant_id, name, description, trigger_event, is_active, created_by)
+			VALUES ($1, $2, $3, NULLIF($4, ''), $5, NULLIF($6, '')::uuid)
+			RETURNING id
+		`, tenantID, def.Name, def.Description, def.Trigger, isActive, createdBy)
+	} else {
+		err = tx.GetContext(ctx, &sequenceID, `
+			UPDATE sequences
+			SET name = $1, description = $2, trigger_event = NULLIF($3, ''), is_active = $4, updated_at = NOW()
+			WHERE id::text = $5 AND tenant_id = $6
+			RETURNING id
+		`, def.Name, def.Description, def.Trigger, isActive, sequenceID, tenantID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i, step := range def.Steps {
+		// A new file is uploaded to WhatsApp again
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO sequence_steps (sequence_id, position, delay_minutes, message_content, template_id,
+				media_url, media_type, media_file_name, exit_on_reply, exit_tag_ids)
+			VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, '')::uuid, NULLIF($6, ''), NULLIF($7, ''), NULLIF($8, ''), $9, $10::uuid[])
+			ON CONFLICT (sequence_id, position) DO UPDATE SET
+				delay_minutes = EXCLUDED.delay_minutes,
+				message_content = EXCLUDED.message_content,
+				template_id = EXCLUDED.template_id,
+				media_url = EXCLUDED.media_url,
+				media_type = EXCLUDED.media_type,
+				media_file_name = EXCLUDED.media_file_name,
+				media_upload = CASE WHEN sequence_steps.media_url IS NOT DISTINCT FROM EXCLUDED.media_url
+					THEN sequence_steps.media_upload END,
+				exit_on_reply = EXCLUDED.exit_on_reply,
+				exit_tag_ids = EXCLUDED.exit_tag_ids,
+				updated_at = NOW()
+		`, sequenceID, i+1, step.DelayMinutes, step.MessageContent, step.TemplateID,
+			step.MediaURL, step.mediaType, step.MediaFileName, step.ExitOnReply, pq.Array(step.ExitTagIDs))
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM sequence_steps WHERE sequence_id = $1 AND position > $2`, sequenceID, len(def.Steps))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return s.Get(ctx, tenantID, sequenceID)
+}
+
+// checkReferences checks the templates and exit tags of the definition
+// belong to the tenant
+func (s *Service) checkReferences(ctx context.Context, tenantID string, def Definition) error {
+	templates := map[string]bool{}
+	tags := map[string]bool{}
+	for _, step := range def.Steps {
+		if step.TemplateID != "" {
+			templates[step.TemplateID] = true
+		}
+		for _, tagID := range step.ExitTagIDs {
+			tags[tagID] = true
+		}
+	}
+
+	check := func(table string, ids map[string]bool, what string) error {
+		if len(ids) == 0 {
+			return nil
+		}
+		list := make([]string, 0, len(ids))
+		for id := range ids {
+			list = append(list, id)
+		}
+		var found int
+		err := s.db.GetContext(ctx, &found, `SELECT COUNT(*) FROM `+table+` WHERE tenant_id = $1 AND id::text = ANY($2)`, tenantID, pq.Array(list))
+		if err != nil {
+			return err
+		}
+		if found != len(list) {
+			return fmt.Errorf("%w: unknown %s", ErrInvalidSequence, what)
+		}
+		return nil
+	}
+
+	if err := check("message_templates", templates, "template_id"); err != nil {
+		return err
+	}
+	return check("customer_tags", tags, "tag in exit_tag_ids")
+}
+
+// Delete removes a sequence with its enrollments and stats
+func (s *Service) Delete(ctx context.Context, tenantID, sequenceID string) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM sequences WHERE id::text = $1 AND tenant_id = $2`, sequenceID, tenantID)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
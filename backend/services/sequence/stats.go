@@ -0,0 +1,99 @@
+package sequence
+
+import (
+	"context"
+	"time"
+)
+
+// StepStats is how one step performed. Replies count when they arrive within
+// the reply window of the send; exited counts enrollments that left instead
+// of receiving the step.
+type StepStats struct {
+	StepID       string  `json:"step_id" db:"step_id"`
+	Position     int     `json:"position" db:"position"`
+	DelayMinutes int     `json:"delay_minutes" db:"delay_minutes"`
+	Waiting      int     `json:"waiting" db:"waiting"`
+	Sent         int     `json:"sent" db:"sent"`
+	Failed       int     `json:"failed" db:"failed"`
+	Delivered    int     `json:"delivered" db:"delivered"`
+	Read         int     `json:"read" db:"read"`
+	Replied      int     `json:"replied" db:"replied"`
+	Exited       int     `json:"exited" db:"exited"`
+	DeliveryRate float64 `json:"delivery_rate" db:"-"`
+	ReadRate     float64 `json:"read_rate" db:"-"`
+	ReplyRate    float64 `json:"reply_rate" db:"-"`
+}
+
+// Stats counts a sequence's enrollments by status and its steps' results
+type Stats struct {
+	Enrolled  int         `json:"enrolled" db:"enrolled"`
+	Active    int         `json:"active" db:"active"`
+	Completed int         `json:"completed" db:"completed"`
+	Exited    int         `json:"exited" db:"exited"`
+	Cancelled int         `json:"cancelled" db:"cancelled"`
+	Steps     []StepStats `json:"steps" db:"-"`
+}
+
+// Stats returns the performance of the sequence, counting replies within
+// window of each send
+func (s *Service) Stats(ctx context.Context, tenantID, sequenceID string, window time.Duration) (*Stats, error) {
+	if err := s.Exists(ctx, tenantID, sequenceID); err != nil {
+		return nil, err
+	}
+
+	var stats Stats
+	err := s.db.GetContext(ctx, &stats, `
+		SELECT COUNT(*) as enrolled,
+			COUNT(*) FILTER (WHERE status = 'active') as active,
+			COUNT(*) FILTER (WHERE status = 'completed') as completed,
+			COUNT(*) FILTER (WHERE status = 'exited') as exited,
+			COUNT(*) FILTER (WHERE status = 'cancelled') as cancelled
+		FROM sequence_enrollments WHERE sequence_id::text = $1
+	`, sequenceID)
+	if err != nil {
+		return nil, err
+	}
+
+	stats.Steps = []StepStats{}
+	err = s.db.SelectContext(ctx, &stats.Steps, `
+		SELECT st.id as step_id, st.position, st.delay_minutes,
+			(SELECT COUNT(*) FROM sequence_enrollments x
+			 WHERE x.sequence_id = st.sequence_id AND x.next_position = st.position AND x.status = 'active') as waiting,
+			COUNT(ss.id) FILTER (WHERE ss.status = 'sent') as sent,
+			COUNT(ss.id) FILTER (WHERE ss.status = 'failed') as failed,
+			COUNT(ss.delivered_at) as delivered,
+			COUNT(ss.read_at) as read,
+			COUNT(ss.id) FILTER (WHERE ss.status = 'sent' AND EXISTS (
+				SELECT 1 FROM whatsapp_messages m
+				WHERE m.tenant_id = e.tenant_id AND m.chat_jid = e.customer_jid AND NOT m.is_from_me
+				  AND m.timestamp BETWEEN EXTRACT(EPOCH FROM ss.sent_at)::bigint
+				                      AND EXTRACT(EPOCH FROM ss.sent_at + make_interval(secs => $2))::bigint
+			)) as replied,
+			(SELECT COUNT(*) FROM sequence_enrollments x
+			 WHERE x.sequence_id = st.sequence_id AND x.next_position = st.position AND x.status = 'exited') as exited
+		FROM sequence_steps st
+		LEFT JOIN sequence_step_sends ss ON ss.step_id = st.id
+		LEFT JOIN sequence_enrollments e ON e.id = ss.enrollment_id
+		WHERE st.sequence_id::text = $1
+		GROUP BY st.id
+		ORDER BY st.position
+	`, sequenceID, window.Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range stats.Steps {
+		step := &stats.Steps[i]
+		if step.Sent > 0 {
+			step.DeliveryRate = rate(step.Delivered, step.Sent)
+			step.ReadRate = rate(step.Read, step.Sent)
+			step.ReplyRate = rate(step.Replied, step.Sent)
+		}
+	}
+	return &stats, nil
+}
+
+// rate is n of of as a fraction rounded to three decimals
+func rate(n, of int) float64 {
+	return float64(int(float64(n)/float64(of)*1000+0.5)) / 1000
+}
@@ -0,0 +1,373 @@
+package spreadsheet
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxXLSXPartSize caps how much of one XML part is decompressed
+	maxXLSXPartSize = 200 << 20 // 200MB
+	// xlsxColumnLimit is the column limit of the format (A to XFD)
+	xlsxColumnLimit = 16384
+	// maxXLSXColumns caps the columns read. Rows are padded up to their
+	// last cell, so a far-off cell in every row would cost a lot of memory.
+	maxXLSXColumns = 256
+)
+
+var errInvalidXLSX = errors.New("invalid XLSX file")
+
+// xlsxRichText is the text of a shared or inline string, either plain or
+// split into formatted runs
+type xlsxRichText struct {
+	T    string `xml:"t"`
+	Runs []struct {
+		T string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t xlsxRichText) String() string {
+	if len(t.Runs) == 0 {
+		return t.T
+	}
+	var sb strings.Builder
+	sb.WriteString(t.T)
+	for _, r := range t.Runs {
+		sb.WriteString(r.T)
+	}
+	return sb.String()
+}
+
+type xlsxCell struct {
+	Ref    string       `xml:"r,attr"`
+	Type   string       `xml:"t,attr"`
+	Value  string       `xml:"v"`
+	Inline xlsxRichText `xml:"is"`
+}
+
+type xlsxRow struct {
+	Index int        `xml:"r,attr"`
+	Cells []xlsxCell `xml:"c"`
+}
+
+// readXLSX returns the rows of the first worksheet in the workbook. Rows
+// past maxRows and cells past maxXLSXColumns are only allowed when empty;
+// see ReadAll.
+func readXLSX(data []byte, maxRows int) ([][]string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, errInvalidXLSX
+	}
+
+	files := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	shared, err := readSharedStrings(files["xl/sharedStrings.xml"])
+	if err != nil {
+		return nil, err
+	}
+
+	sheet := files[firstSheetPath(files)]
+	if sheet == nil {
+		return nil, fmt.Errorf("%w: no worksheet found", errInvalidXLSX)
+	}
+
+	rc, err := sheet.Open()
+	if err != nil {
+		return nil, errInvalidXLSX
+	}
+	defer rc.Close()
+
+	var rows [][]string
+	dec := xml.NewDecoder(io.LimitReader(rc, maxXLSXPartSize))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidXLSX, err)
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "row" {
+			continue
+		}
+
+		var row xlsxRow
+		if err := dec.DecodeElement(&row, &start); err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidXLSX, err)
+		}
+
+		// Empty rows are omitted from the sheet, keep row numbers aligned
+		index := len(rows)
+		if row.Index > 0 {
+			index = row.Index - 1
+		}
+		if index < len(rows) {
+			return nil, fmt.Errorf("%w: row %d is out of order", errInvalidXLSX, row.Index)
+		}
+		if index >= maxRows {
+			// Formatting can leave empty rows far below the data
+			if len(row.Cells) == 0 {
+				continue
+			}
+			return nil, ErrTooManyRows
+		}
+		for len(rows) < index {
+			rows = append(rows, nil)
+		}
+
+		var values []string
+		for i, cell := range row.Cells {
+			col := i
+			if cell.Ref != "" {
+				if col, err = columnIndex(cell.Ref); err != nil {
+					return nil, err
+				}
+			}
+			value := cellValue(cell, shared)
+			if col >= maxXLSXColumns {
+				// Formatting can leave empty cells far right of the data
+				if value == "" {
+					continue
+				}
+				return nil, fmt.Errorf("%w: more than %d columns", errInvalidXLSX, maxXLSXColumns)
+			}
+			for len(values) <= col {
+				values = append(values, "")
+			}
+			values[col] = value
+		}
+		rows = append(rows, values)
+	}
+
+	return rows, nil
+}
+
+// readSharedStrings loads the workbook's shared string table
+func readSharedStrings(f *zip.File) ([]string, error) {
+	if f == nil {
+		return nil, nil
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return nil, errInvalidXLSX
+	}
+	defer rc.Close()
+
+	var sst struct {
+		Items []xlsxRichText `xml:"si"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(rc, maxXLSXPartSize)).Decode(&sst); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidXLSX, err)
+	}
+
+	shared := make([]string, len(sst.Items))
+	for i, item := range sst.Items {
+		shared[i] = item.String()
+	}
+	return shared, nil
+}
+
+// firstSheetPath resolves the part name of the workbook's first sheet
+func firstSheetPath(files map[string]*zip.File) string {
+	const fallback = "xl/worksheets/sheet1.xml"
+
+	var workbook struct {
+		Sheets []struct {
+			RelID string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	var rels struct {
+		Relationships []struct {
+			ID     string `xml:"Id,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+
+	if decodeZipXML(files["xl/workbook.xml"], &workbook) != nil || len(workbook.Sheets) == 0 {
+		return fallback
+	}
+	if decodeZipXML(files["xl/_rels/workbook.xml.rels"], &rels) != nil {
+		return fallback
+	}
+
+	for _, rel := range rels.Relationships {
+		if rel.ID != workbook.Sheets[0].RelID {
+			continue
+		}
+		if strings.HasPrefix(rel.Target, "/") {
+			return strings.TrimPrefix(rel.Target, "/")
+		}
+		return path.Join("xl", rel.Target)
+	}
+	return fallback
+}
+
+func decodeZipXML(f *zip.File, v interface{}) error {
+	if f == nil {
+		return errInvalidXLSX
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return xml.NewDecoder(io.LimitReader(rc, maxXLSXPartSize)).Decode(v)
+}
+
+// cellValue converts a cell to its display text
+func cellValue(cell xlsxCell, shared []string) string {
+	switch cell.Type {
+	case "s":
+		idx, err := strconv.Atoi(cell.Value)
+		if err != nil || idx < 0 || idx >= len(shared) {
+			return ""
+		}
+		return shared[idx]
+	case "inlineStr":
+		return cell.Inline.String()
+	case "b":
+		if cell.Value == "1" {
+			return "TRUE"
+		}
+		return "FALSE"
+	case "str", "e":
+		return cell.Value
+	}
+
+	// Numbers: phone numbers typed into Excel are stored as numbers and may
+	// be written in scientific notation (6.28123456789E+12)
+	if strings.ContainsAny(cell.Value, "eE") {
+		if f, err := strconv.ParseFloat(cell.Value, 64); err == nil {
+			return strconv.FormatFloat(f, 'f', -1, 64)
+		}
+	}
+	return cell.Value
+}
+
+// columnIndex converts the letters of a cell reference (e.g. "AB12") to a
+// zero-based column index. References must be letters followed by digits,
+// within the format's column limit.
+func columnIndex(ref string) (int, error) {
+	col, i := 0, 0
+	for ; i < len(ref); i++ {
+		c := ref[i]
+		if c >= 'a' && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		if c < 'A' || c > 'Z' {
+			break
+		}
+		col = col*26 + int(c-'A'+1)
+		if col > xlsxColumnLimit {
+			return 0, fmt.Errorf("%w: column of cell %q out of range", errInvalidXLSX, ref)
+		}
+	}
+	if i == 0 {
+		return 0, fmt.Errorf("%w: invalid cell reference %q", errInvalidXLSX, ref)
+	}
+	for _, c := range ref[i:] {
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("%w: invalid cell reference %q", errInvalidXLSX, ref)
+		}
+	}
+	return col - 1, nil
+}
+
+// columnName converts a zero-based column index to letters (0 -> A, 27 -> AB)
+func columnName(col int) string {
+	name := ""
+	for col >= 0 {
+		name = string(rune('A'+col%26)) + name
+		col = col/26 - 1
+	}
+	return name
+}
+
+// xlsxStaticParts are the fixed parts of a single-sheet workbook
+var xlsxStaticParts = []struct {
+	name    string
+	content string
+}{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+	{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Sheet1" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`},
+}
+
+// xlsxWriter streams rows into a single-sheet workbook. All cells are
+// written as inline strings so phone numbers keep their leading digits.
+type xlsxWriter struct {
+	zw    *zip.Writer
+	sheet io.Writer
+	row   int
+}
+
+func newXLSXWriter(w io.Writer) (*xlsxWriter, error) {
+	zw := zip.NewWriter(w)
+	for _, part := range xlsxStaticParts {
+		f, err := zw.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(f, part.content); err != nil {
+			return nil, err
+		}
+	}
+
+	sheet, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.WriteString(sheet, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	if err != nil {
+		return nil, err
+	}
+
+	return &xlsxWriter{zw: zw, sheet: sheet}, nil
+}
+
+func (x *xlsxWriter) Write(row []string) error {
+	x.row++
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<row r="%d">`, x.row)
+	for i, value := range row {
+		if value == "" {
+			continue
+		}
+		fmt.Fprintf(&buf, `<c r="%s%d" t="inlineStr"><is><t xml:space="preserve">`, columnName(i), x.row)
+		if err := xml.EscapeText(&buf, []byte(value)); err != nil {
+			return err
+		}
+		buf.WriteString(`</t></is></c>`)
+	}
+	buf.WriteString(`</row>`)
+
+	_, err := x.sheet.Write(buf.Bytes())
+	return err
+}
+
+func (x *xlsxWriter) Close() error {
+	if _, err := io.WriteString(x.sheet, `</sheetData></worksheet>`); err != nil {
+		return err
+	}
+	return x.zw.Close()
+}
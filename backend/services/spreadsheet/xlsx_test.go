@@ -0,0 +1,257 @@
+package spreadsheet
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// workbook builds an XLSX file with one sheet of rows and a shared string
+// table
+func workbook(t *testing.T, rows string, shared ...string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	write := func(name, content string) {
+		f, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, part := range xlsxStaticParts {
+		write(part.name, part.content)
+	}
+	sst := `<sst xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`
+	for _, s := range shared {
+		sst += "<si><t>" + s + "</t></si>"
+	}
+	write("xl/sharedStrings.xml", sst+"</sst>")
+	write("xl/worksheets/sheet1.xml", `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`+rows+`</sheetData></worksheet>`)
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestColumnIndex(t *testing.T) {
+	tests := []struct {
+		ref  string
+		want int
+		err  bool
+	}{
+		{"A1", 0, false},
+		{"z9", 25, false},
+		{"AA10", 26, false},
+		{"AB12", 27, false},
+		{"IV3", 255, false},
+		{"XFD1048576", 16383, false},
+		{"B", 1, false},
+		{"XFE1", 0, true},
+		{"AAAAAAAAAAAAAAAA1", 0, true},
+		{"", 0, true},
+		{"12", 0, true},
+		{"A1B", 0, true},
+		{"A-1", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			got, err := columnIndex(tt.ref)
+			if (err != nil) != tt.err {
+				t.Fatalf("columnIndex(%q) error = %v", tt.ref, err)
+			}
+			if err != nil && !errors.Is(err, errInvalidXLSX) {
+				t.Errorf("columnIndex(%q) error = %v, want errInvalidXLSX", tt.ref, err)
+			}
+			if got != tt.want {
+				t.Errorf("columnIndex(%q) = %d, want %d", tt.ref, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestColumnName(t *testing.T) {
+	for _, col := range []int{0, 25, 26, 27, 255, 701, 702, 16383} {
+		got, err := columnIndex(columnName(col) + "1")
+		if err != nil || got != col {
+			t.Errorf("columnIndex(columnName(%d)) = %d, %v", col, got, err)
+		}
+	}
+}
+
+func TestCellValue(t *testing.T) {
+	shared := []string{"Budi", "0812345678"}
+	rich := xlsxRichText{T: "Halo "}
+	rich.Runs = append(rich.Runs, struct {
+		T string `xml:"t"`
+	}{"Kak"})
+
+	tests := []struct {
+		name string
+		cell xlsxCell
+		want string
+	}{
+		{"shared string", xlsxCell{Type: "s", Value: "1"}, "0812345678"},
+		{"shared string out of range", xlsxCell{Type: "s", Value: "2"}, ""},
+		{"shared string bad index", xlsxCell{Type: "s", Value: "x"}, ""},
+		{"inline string", xlsxCell{Type: "inlineStr", Inline: xlsxRichText{T: "Siti"}}, "Siti"},
+		{"inline rich text", xlsxCell{Type: "inlineStr", Inline: rich}, "Halo Kak"},
+		{"boolean true", xlsxCell{Type: "b", Value: "1"}, "TRUE"},
+		{"boolean false", xlsxCell{Type: "b", Value: "0"}, "FALSE"},
+		{"formula string", xlsxCell{Type: "str", Value: "vip"}, "vip"},
+		{"number", xlsxCell{Value: "42"}, "42"},
+		{"decimal", xlsxCell{Value: "72.5"}, "72.5"},
+		{"phone in scientific notation", xlsxCell{Value: "6.28123456789E+12"}, "6281234567890"},
+		{"lowercase exponent", xlsxCell{Value: "6.2812345678e11"}, "628123456780"},
+		{"not a number", xlsxCell{Value: "E-mail"}, "E-mail"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cellValue(tt.cell, shared); got != tt.want {
+				t.Errorf("cellValue() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadXLSX(t *testing.T) {
+	header := `<row r="1"><c r="A1" t="s"><v>0</v></c><c r="B1" t="s"><v>1</v></c></row>`
+
+	tests := []struct {
+		name    string
+		rows    string
+		maxRows int
+		want    [][]string
+		err     error
+	}{
+		{
+			name:    "shared and inline strings",
+			rows:    header + `<row r="2"><c r="A2" t="inlineStr"><is><t>Budi</t></is></c><c r="B2"><v>6.28123456789E+12</v></c></row>`,
+			maxRows: 10,
+			want:    [][]string{{"name", "phone"}, {"Budi", "6281234567890"}},
+		},
+		{
+			name:    "skipped rows and cells are kept in place",
+			rows:    header + `<row r="4"><c r="B4" t="inlineStr"><is><t>0812</t></is></c></row>`,
+			maxRows: 10,
+			want:    [][]string{{"name", "phone"}, nil, nil, {"", "0812"}},
+		},
+		{
+			name:    "cells without references",
+			rows:    `<row><c t="s"><v>0</v></c><c t="s"><v>1</v></c></row>`,
+			maxRows: 10,
+			want:    [][]string{{"name", "phone"}},
+		},
+		{
+			name:    "empty rows past the limit",
+			rows:    header + `<row r="1048576"/>`,
+			maxRows: 2,
+			want:    [][]string{{"name", "phone"}},
+		},
+		{
+			name:    "empty cells past the column limit",
+			rows:    header + `<row r="2"><c r="A2" t="inlineStr"><is><t>Budi</t></is></c><c r="XFD2" s="1"/></row>`,
+			maxRows: 10,
+			want:    [][]string{{"name", "phone"}, {"Budi"}},
+		},
+		{
+			name:    "out of order rows",
+			rows:    `<row r="2"><c r="A2"><v>1</v></c></row><row r="1"><c r="A1"><v>2</v></c></row>`,
+			maxRows: 10,
+			err:     errInvalidXLSX,
+		},
+		{
+			name:    "repeated row",
+			rows:    header + header,
+			maxRows: 10,
+			err:     errInvalidXLSX,
+		},
+		{
+			name:    "values past the column limit",
+			rows:    `<row r="1"><c r="IW1"><v>1</v></c></row>`,
+			maxRows: 10,
+			err:     errInvalidXLSX,
+		},
+		{
+			name:    "invalid cell reference",
+			rows:    `<row r="1"><c r="1A"><v>1</v></c></row>`,
+			maxRows: 10,
+			err:     errInvalidXLSX,
+		},
+		{
+			name:    "too many rows",
+			rows:    header + `<row r="3"><c r="A3"><v>1</v></c></row>`,
+			maxRows: 2,
+			err:     ErrTooManyRows,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readXLSX(workbook(t, tt.rows, "name", "phone"), tt.maxRows)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("readXLSX() error = %v, want %v", err, tt.err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readXLSX() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := readXLSX([]byte("not a zip"), 10); !errors.Is(err, errInvalidXLSX) {
+		t.Errorf("readXLSX() of a non-zip file error = %v, want errInvalidXLSX", err)
+	}
+}
+
+func TestXLSXRoundTrip(t *testing.T) {
+	rows := [][]string{
+		{"phone", "name", "notes"},
+		{"0812345678", "Budi <Toko & Co>", "line one\nline two"},
+		{"6281234567890", "", "kosong di tengah"},
+		{"+62 812 3456 789", "Siti"},
+		{"", "", ""},
+		{strings.Repeat("x", 300), "ünïcödé 😀"},
+	}
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, FormatXLSX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		if err := w.Write(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReadAll(buf.Bytes(), FormatXLSX, len(rows))
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+
+	// Empty cells are not written, so rows end at their last value
+	want := [][]string{
+		rows[0],
+		rows[1],
+		rows[2],
+		rows[3],
+		nil,
+		rows[5],
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadAll() = %q, want %q", got, want)
+	}
+}
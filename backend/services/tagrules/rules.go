@@ -0,0 +1,225 @@
+// Package tagrules applies customer tags automatically. A tag's
+// customer_tags.auto_apply_rules holds a Rules document that compiles to a
+// segment filter, and through it to a parameterized SQL predicate on
+// customer_insights (aliased ci).
+package tagrules
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gowa-backend/services/segment"
+)
+
+// Condition types
+const (
+	TypeKeyword       = "keyword"
+	TypeIntent        = "intent"
+	TypeLeadScore     = "lead_score"
+	TypeInactiveDays  = "inactive_days"
+	TypePurchaseCount = "purchase_count"
+)
+
+// Match modes
+const (
+	MatchAll = segment.MatchAll
+	MatchAny = segment.MatchAny
+)
+
+const (
+	maxConditions      = 20
+	maxKeywords        = 50
+	defaultKeywordDays = 30
+	maxDays            = 3650
+)
+
+// ErrInvalidRules wraps every validation error
+var ErrInvalidRules = errors.New("invalid auto-apply rules")
+
+// Rules decide which customers carry a tag. Customers matching the
+// conditions get the tag with assigned_by 'auto'; with RemoveWhenUnmatched
+// set, auto-assigned tags are taken off customers that no longer match.
+// Manually assigned tags are never removed.
+//
+//	{"enabled":true,"match":"all","remove_when_unmatched":true,"conditions":[
+//	  {"type":"keyword","keywords":["harga","promo"],"days":30},
+//	  {"type":"intent","intents":["order_intent"]},
+//	  {"type":"lead_score","min":70},
+//	  {"type":"inactive_days","days":60},
+//	  {"type":"purchase_count","min":2}]}
+type Rules struct {
+	Enabled             bool        `json:"enabled"`
+	Match               string      `json:"match,omitempty"`
+	RemoveWhenUnmatched bool        `json:"remove_when_unmatched"`
+	Conditions          []Condition `json:"conditions"`
+}
+
+// Condition is one rule. Which fields apply depends on Type:
+//   - keyword: Keywords found in the text or caption of a customer message of
+//     the last Days (default 30)
+//   - intent: the customer's last detected intent is one of Intents
+//   - lead_score, purchase_count: value between Min and Max, both inclusive and optional
+//   - inactive_days: no customer message for at least Days
+type Condition struct {
+	Type     string   `json:"type"`
+	Keywords []string `json:"keywords,omitempty"`
+	Intents  []string `json:"intents,omitempty"`
+	Min      *int     `json:"min,omitempty"`
+	Max      *int     `json:"max,omitempty"`
+	Days     int      `json:"days,omitempty"`
+}
+
+// Parse decodes and validates stored rules. Empty or null input yields nil.
+func Parse(data []byte) (*Rules, error) {
+	if len(data) == 0 || string(data) == "null" {
+		return nil, nil
+	}
+	var rules Rules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRules, err)
+	}
+	if err := rules.Validate(); err != nil {
+		return nil, err
+	}
+	return &rules, nil
+}
+
+// Validate checks the rules without building them
+func (r Rules) Validate() error {
+	_, err := r.SQL(segment.NewQuery(0))
+	return err
+}
+
+// SQL compiles the rules to a predicate on ci
+func (r Rules) SQL(q *segment.Query) (string, error) {
+	filter, err := r.Filter()
+	if err != nil {
+		return "", err
+	}
+	predicate, err := filter.SQL(q)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidRules, err)
+	}
+	return predicate, nil
+}
+
+// Filter translates the rules to the segment filter they apply
+func (r Rules) Filter() (segment.Filter, error) {
+	switch r.Match {
+	case "", MatchAll, MatchAny:
+	default:
+		return segment.Filter{}, fmt.Errorf("%w: match must be all or any", ErrInvalidRules)
+	}
+
+	if len(r.Conditions) == 0 {
+		return segment.Filter{}, fmt.Errorf("%w: at least one condition is required", ErrInvalidRules)
+	}
+	if len(r.Conditions) > maxConditions {
+		return segment.Filter{}, fmt.Errorf("%w: at most %d conditions", ErrInvalidRules, maxConditions)
+	}
+
+	filter := segment.Filter{Match: r.Match, Conditions: make([]segment.Condition, 0, len(r.Conditions))}
+	for i, cond := range r.Conditions {
+		converted, err := cond.filter()
+		if err != nil {
+			return segment.Filter{}, fmt.Errorf("%w: condition %d: %v", ErrInvalidRules, i+1, err)
+		}
+		filter.Conditions = append(filter.Conditions, converted)
+	}
+	return filter, nil
+}
+
+func (c Condition) filter() (segment.Condition, error) {
+	switch c.Type {
+	case TypeKeyword:
+		return c.keywordFilter()
+	case TypeIntent:
+		intents := cleanList(c.Intents)
+		if len(intents) == 0 {
+			return segment.Condition{}, errors.New("intents are required")
+		}
+		return condition(segment.FieldIntent, "in", intents, 0)
+	case TypeLeadScore:
+		return c.rangeFilter(segment.FieldLeadScore, 100)
+	case TypePurchaseCount:
+		return c.rangeFilter(segment.FieldPurchaseCount, 0)
+	case TypeInactiveDays:
+		if c.Days < 1 || c.Days > maxDays {
+			return segment.Condition{}, fmt.Errorf("days must be between 1 and %d", maxDays)
+		}
+		return condition(segment.FieldLastActiveAt, "older_than_days", c.Days, 0)
+	case "":
+		return segment.Condition{}, errors.New("type is required")
+	default:
+		return segment.Condition{}, fmt.Errorf("unknown type %q", c.Type)
+	}
+}
+
+// keywordFilter matches customer messages (not our replies) containing any
+// of the keywords, case-insensitively
+func (c Condition) keywordFilter() (segment.Condition, error) {
+	keywords := cleanList(c.Keywords)
+	if len(keywords) == 0 {
+		return segment.Condition{}, errors.New("keywords are required")
+	}
+	if len(keywords) > maxKeywords {
+		return segment.Condition{}, fmt.Errorf("at most %d keywords", maxKeywords)
+	}
+
+	days := c.Days
+	if days == 0 {
+		days = defaultKeywordDays
+	}
+	if days < 1 || days > maxDays {
+		return segment.Condition{}, fmt.Errorf("days must be between 1 and %d", maxDays)
+	}
+	return condition(segment.FieldMessageText, "contains_any", keywords, days)
+}
+
+// rangeFilter compares field with the optional Min and Max bounds. limit
+// caps the bounds when positive.
+func (c Condition) rangeFilter(field string, limit int) (segment.Condition, error) {
+	if c.Min == nil && c.Max == nil {
+		return segment.Condition{}, errors.New("min or max is required")
+	}
+	for _, bound := range []*int{c.Min, c.Max} {
+		if bound != nil && (*bound < 0 || (limit > 0 && *bound > limit)) {
+			if limit > 0 {
+				return segment.Condition{}, fmt.Errorf("min and max must be between 0 and %d", limit)
+			}
+			return segment.Condition{}, errors.New("min and max must not be negative")
+		}
+	}
+
+	switch {
+	case c.Min != nil && c.Max != nil:
+		if *c.Min > *c.Max {
+			return segment.Condition{}, errors.New("min must not be greater than max")
+		}
+		return condition(field, "between", []int{*c.Min, *c.Max}, 0)
+	case c.Min != nil:
+		return condition(field, "gte", *c.Min, 0)
+	default:
+		return condition(field, "lte", *c.Max, 0)
+	}
+}
+
+func condition(field, op string, value interface{}, days int) (segment.Condition, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return segment.Condition{}, err
+	}
+	return segment.Condition{Field: field, Op: op, Value: raw, Days: days}, nil
+}
+
+func cleanList(values []string) []string {
+	cleaned := make([]string, 0, len(values))
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			cleaned = append(cleaned, v)
+		}
+	}
+	return cleaned
+}
@@ -0,0 +1,147 @@
+package tagrules
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gowa-backend/services/segment"
+)
+
+func intPtr(n int) *int { return &n }
+
+func TestRulesFilter(t *testing.T) {
+	tests := []struct {
+		name string
+		cond Condition
+		want segment.Condition
+	}{
+		{
+			name: "keywords with default days",
+			cond: Condition{Type: TypeKeyword, Keywords: []string{" harga ", "", "promo"}},
+			want: segment.Condition{Field: segment.FieldMessageText, Op: "contains_any", Value: json.RawMessage(`["harga","promo"]`), Days: defaultKeywordDays},
+		},
+		{
+			name: "keywords at the days limit",
+			cond: Condition{Type: TypeKeyword, Keywords: []string{"harga"}, Days: maxDays},
+			want: segment.Condition{Field: segment.FieldMessageText, Op: "contains_any", Value: json.RawMessage(`["harga"]`), Days: maxDays},
+		},
+		{
+			name: "intents",
+			cond: Condition{Type: TypeIntent, Intents: []string{"order_intent"}},
+			want: segment.Condition{Field: segment.FieldIntent, Op: "in", Value: json.RawMessage(`["order_intent"]`)},
+		},
+		{
+			name: "lead score between",
+			cond: Condition{Type: TypeLeadScore, Min: intPtr(0), Max: intPtr(100)},
+			want: segment.Condition{Field: segment.FieldLeadScore, Op: "between", Value: json.RawMessage(`[0,100]`)},
+		},
+		{
+			name: "lead score min only",
+			cond: Condition{Type: TypeLeadScore, Min: intPtr(70)},
+			want: segment.Condition{Field: segment.FieldLeadScore, Op: "gte", Value: json.RawMessage(`70`)},
+		},
+		{
+			name: "purchase count max only, no upper limit",
+			cond: Condition{Type: TypePurchaseCount, Max: intPtr(1000)},
+			want: segment.Condition{Field: segment.FieldPurchaseCount, Op: "lte", Value: json.RawMessage(`1000`)},
+		},
+		{
+			name: "inactive days",
+			cond: Condition{Type: TypeInactiveDays, Days: 1},
+			want: segment.Condition{Field: segment.FieldLastActiveAt, Op: "older_than_days", Value: json.RawMessage(`1`)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := Rules{Match: MatchAny, Conditions: []Condition{tt.cond}}
+			filter, err := rules.Filter()
+			if err != nil {
+				t.Fatalf("Filter() error = %v", err)
+			}
+			want := segment.Filter{Match: MatchAny, Conditions: []segment.Condition{tt.want}}
+			if !reflect.DeepEqual(filter, want) {
+				t.Errorf("Filter() = %+v, want %+v", filter, want)
+			}
+			if err := rules.Validate(); err != nil {
+				t.Errorf("Validate() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestRulesFilterInvalid(t *testing.T) {
+	conditions := func(n int) []Condition {
+		conds := make([]Condition, n)
+		for i := range conds {
+			conds[i] = Condition{Type: TypeInactiveDays, Days: 30}
+		}
+		return conds
+	}
+	keywords := func(n int) []string {
+		return strings.Fields(strings.Repeat("promo ", n))
+	}
+
+	tests := []struct {
+		name  string
+		rules Rules
+	}{
+		{"unknown match", Rules{Match: "some", Conditions: conditions(1)}},
+		{"no conditions", Rules{}},
+		{"too many conditions", Rules{Conditions: conditions(maxConditions + 1)}},
+		{"missing type", Rules{Conditions: []Condition{{Days: 30}}}},
+		{"unknown type", Rules{Conditions: []Condition{{Type: "tag"}}}},
+		{"blank keywords", Rules{Conditions: []Condition{{Type: TypeKeyword, Keywords: []string{" ", ""}}}}},
+		{"too many keywords", Rules{Conditions: []Condition{{Type: TypeKeyword, Keywords: keywords(maxKeywords + 1)}}}},
+		{"keyword days negative", Rules{Conditions: []Condition{{Type: TypeKeyword, Keywords: []string{"promo"}, Days: -1}}}},
+		{"keyword days too long", Rules{Conditions: []Condition{{Type: TypeKeyword, Keywords: []string{"promo"}, Days: maxDays + 1}}}},
+		{"no intents", Rules{Conditions: []Condition{{Type: TypeIntent}}}},
+		{"range without bounds", Rules{Conditions: []Condition{{Type: TypeLeadScore}}}},
+		{"lead score above 100", Rules{Conditions: []Condition{{Type: TypeLeadScore, Max: intPtr(101)}}}},
+		{"negative lead score", Rules{Conditions: []Condition{{Type: TypeLeadScore, Min: intPtr(-1)}}}},
+		{"negative purchase count", Rules{Conditions: []Condition{{Type: TypePurchaseCount, Max: intPtr(-1)}}}},
+		{"min above max", Rules{Conditions: []Condition{{Type: TypePurchaseCount, Min: intPtr(5), Max: intPtr(2)}}}},
+		{"inactive days missing", Rules{Conditions: []Condition{{Type: TypeInactiveDays}}}},
+		{"inactive days too long", Rules{Conditions: []Condition{{Type: TypeInactiveDays, Days: maxDays + 1}}}},
+		{"one bad condition among good ones", Rules{Conditions: append(conditions(2), Condition{Type: TypeIntent})}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.rules.Filter(); !errors.Is(err, ErrInvalidRules) {
+				t.Errorf("Filter() error = %v, want ErrInvalidRules", err)
+			}
+		})
+	}
+
+	ok := Rules{Conditions: conditions(maxConditions)}
+	ok.Conditions[0] = Condition{Type: TypeKeyword, Keywords: keywords(maxKeywords)}
+	if _, err := ok.Filter(); err != nil {
+		t.Errorf("Filter() at the limits error = %v", err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, data := range []string{"", "null"} {
+		if rules, err := Parse([]byte(data)); rules != nil || err != nil {
+			t.Errorf("Parse(%q) = %v, %v, want nil, nil", data, rules, err)
+		}
+	}
+
+	rules, err := Parse([]byte(`{"enabled":true,"match":"all","conditions":[{"type":"lead_score","min":70}]}`))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if !rules.Enabled || len(rules.Conditions) != 1 || *rules.Conditions[0].Min != 70 {
+		t.Errorf("Parse() = %+v", rules)
+	}
+
+	for _, data := range []string{`{"conditions":{}}`, `{"conditions":[]}`, `[`} {
+		if _, err := Parse([]byte(data)); !errors.Is(err, ErrInvalidRules) {
+			t.Errorf("Parse(%s) error = %v, want ErrInvalidRules", data, err)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package tagrules
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"gowa-backend/services/segment"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// AssignedByAuto marks tag assignments made by rules
+const AssignedByAuto = "auto"
+
+// ErrNoRules is returned when a tag has no enabled rules
+var ErrNoRules = errors.New("tag has no enabled auto-apply rules")
+
+// Result counts the assignments a rule run changed
+type Result struct {
+	Added   int `json:"added"`
+	Removed int `json:"removed"`
+}
+
+// TestResult previews what applying rules would change
+type TestResult struct {
+	Matching      int        `json:"matching"`
+	AlreadyTagged int        `json:"already_tagged"`
+	WouldAdd      int        `json:"would_add"`
+	WouldRemove   int        `json:"would_remove"`
+	Sample        []Customer `json:"sample"`
+}
+
+// Customer is a customer matching the rules
+type Customer struct {
+	ID            string  `json:"id" db:"id"`
+	CustomerJID   string  `json:"customer_jid" db:"customer_jid"`
+	CustomerName  *string `json:"customer_name" db:"customer_name"`
+	CustomerPhone *string `json:"customer_phone" db:"customer_phone"`
+	LeadScore     int     `json:"lead_score" db:"lead_score"`
+	PurchaseCount int     `json:"purchase_count" db:"purchase_count"`
+	HasTag        bool    `json:"has_tag" db:"has_tag"`
+}
+
+// ruleTag is a tag with stored rules
+type ruleTag struct {
+	ID        string `db:"id"`
+	TenantID  string `db:"tenant_id"`
+	RulesJSON string `db:"auto_apply_rules"`
+}
+
+const ruleTagsQuery = `
+	SELECT id, tenant_id, auto_apply_rules::text as auto_apply_rules
+	FROM customer_tags
+	WHERE auto_apply_rules IS NOT NULL AND auto_apply_rules->>'enabled' = 'true'`
+
+// Service evaluates tag rules against customer_insights
+type Service struct {
+	db *sqlx.DB
+}
+
+// NewService creates a tag rules service
+func NewService(db *sqlx.DB) *Service {
+	return &Service{db: db}
+}
+
+// ApplyTag runs a tag's rules against all of the tenant's customers
+func (s *Service) ApplyTag(ctx context.Context, tenantID, tagID string) (Result, error) {
+	var tag ruleTag
+	err := s.db.GetContext(ctx, &tag, ruleTagsQuery+` AND id = $1 AND tenant_id = $2`, tagID, tenantID)
+	if err == sql.ErrNoRows {
+		return Result{}, ErrNoRules
+	} else if err != nil {
+		return Result{}, err
+	}
+
+	rules, err := Parse([]byte(tag.RulesJSON))
+	if err != nil {
+		return Result{}, err
+	}
+	return s.apply(ctx, tenantID, tagID, *rules, "")
+}
+
+// ApplyCustomer runs every enabled rule of the tenant against one customer.
+// It is called after a customer's insight changes.
+func (s *Service) ApplyCustomer(ctx context.Context, tenantID, customerID string) (Result, error) {
+	var tags []ruleTag
+	if err := s.db.SelectContext(ctx, &tags, ruleTagsQuery+` AND tenant_id = $1`, tenantID); err != nil {
+		return Result{}, err
+	}
+	return s.applyAll(ctx, tags, customerID)
+}
+
+// Sweep runs every enabled rule of every tenant against all customers, so
+// time-based conditions such as inactivity are picked up without new messages
+func (s *Service) Sweep(ctx context.Context) (Result, error) {
+	var tags []ruleTag
+	if err := s.db.SelectContext(ctx, &tags, ruleTagsQuery); err != nil {
+		return Result{}, err
+	}
+	return s.applyAll(ctx, tags, "")
+}
+
+// applyAll applies each tag's rules, skipping tags whose rules fail so one
+// broken rule doesn't block the others. The first error is returned.
+func (s *Service) applyAll(ctx context.Context, tags []ruleTag, customerID string) (Result, error) {
+	var total Result
+	var firstErr error
+	for _, tag := range tags {
+		rules, err := Parse([]byte(tag.RulesJSON))
+		if err == nil {
+			var result Result
+			result, err = s.apply(ctx, tag.TenantID, tag.ID, *rules, customerID)
+			total.Added += result.Added
+			total.Removed += result.Removed
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("tag %s: %w", tag.ID, err)
+		}
+	}
+	return total, firstErr
+}
+
+// scope builds the WHERE clause for the tenant's customers ($1), optionally
+// limited to one customer, followed by the rules predicate
+func scope(tenantID, tagID string, rules Rules, customerID string) (string, string, []interface{}, error) {
+	args := []interface{}{tenantID, tagID}
+	clause := `ci.tenant_id = $1 AND ci.customer_jid NOT LIKE '%@g.us'`
+	if customerID != "" {
+		args = append(args, customerID)
+		clause += ` AND ci.id = $` + strconv.Itoa(len(args))
+	}
+
+	q := segment.NewQuery(len(args))
+	predicate, err := rules.SQL(q)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return clause, `COALESCE((` + predicate + `), false)`, append(args, q.Args...), nil
+}
+
+// apply adds the tag to matching customers and, when the rules ask for it,
+// removes auto-assigned tags from customers that no longer match
+func (s *Service) apply(ctx context.Context, tenantID, tagID string, rules Rules, customerID string) (Result, error) {
+	clause, predicate, args, err := scope(tenantID, tagID, rules, customerID)
+	if err != nil {
+		return Result{}, err
+	}
+
+	var result Result
+	res, err := s.db.ExecContext(ctx, `
+		INSERT INTO customer_tag_assignments (customer_id, tag_id, assigned_by)
+		SELECT ci.id, $2::uuid, '`+AssignedByAuto+`'
+		FROM customer_insights ci
+		WHERE `+clause+` AND `+predicate+`
+		ON CONFLICT (customer_id, tag_id) DO NOTHING
+	`, args...)
+	if err != nil {
+		return result, err
+	}
+	added, _ := res.RowsAffected()
+	result.Added = int(added)
+
+	if rules.RemoveWhenUnmatched {
+		res, err = s.db.ExecContext(ctx, `
+			DELETE FROM customer_tag_assignments cta
+			USING customer_insights ci
+			WHERE cta.customer_id = ci.id AND cta.tag_id = $2::uuid AND cta.assigned_by = '`+AssignedByAuto+`'
+			  AND `+clause+` AND NOT `+predicate,
+			args...)
+		if err != nil {
+			return result, err
+		}
+		removed, _ := res.RowsAffected()
+		result.Removed = int(removed)
+	}
+
+	return result, nil
+}
+
+// Test evaluates rules against the tenant's current customers without
+// changing anything. tagID may be empty for a tag that isn't saved yet.
+func (s *Service) Test(ctx context.Context, tenantID, tagID string, rules Rules) (*TestResult, error) {
+	var tagArg interface{}
+	if tagID != "" {
+		tagArg = tagID
+	}
+
+	args := []interface{}{tenantID, tagArg}
+	q := segment.NewQuery(len(args))
+	predicate, err := rules.SQL(q)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, q.Args...)
+	predicate = `COALESCE((` + predicate + `), false)`
+	clause := `ci.tenant_id = $1 AND ci.customer_jid NOT LIKE '%@g.us'`
+	hasTag := `EXISTS (SELECT 1 FROM customer_tag_assignments cta WHERE cta.customer_id = ci.id AND cta.tag_id = $2::uuid)`
+
+	result := &TestResult{Sample: []Customer{}}
+	err = s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*), COUNT(*) FILTER (WHERE `+hasTag+`)
+		FROM customer_insights ci
+		WHERE `+clause+` AND `+predicate,
+		args...).Scan(&result.Matching, &result.AlreadyTagged)
+	if err != nil {
+		return nil, err
+	}
+	result.WouldAdd = result.Matching - result.AlreadyTagged
+
+	if rules.RemoveWhenUnmatched && tagID != "" {
+		err = s.db.GetContext(ctx, &result.WouldRemove, `
+			SELECT COUNT(*)
+			FROM customer_tag_assignments cta
+			JOIN customer_insights ci ON ci.id = cta.customer_id
+			WHERE cta.tag_id = $2::uuid AND cta.assigned_by = '`+AssignedByAuto+`'
+			  AND `+clause+` AND NOT `+predicate,
+			args...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = s.db.SelectContext(ctx, &result.Sample, `
+		SELECT ci.id, ci.customer_jid, ci.customer_name, ci.customer_phone,
+			COALESCE(ci.lead_score, 0) as lead_score, ci.purchase_count, `+hasTag+` as has_tag
+		FROM customer_insights ci
+		WHERE `+clause+` AND `+predicate+`
+		ORDER BY ci.last_message_at DESC NULLS LAST, ci.created_at DESC
+		LIMIT 20`,
+		args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
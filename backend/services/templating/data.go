@@ -0,0 +1,240 @@
+package templating
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"gowa-backend/services/customfields"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// DateLayout is how dates are passed between filters and stored
+const DateLayout = "2006-01-02"
+
+// Variable is a built-in template variable
+type Variable struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// Builtins are the variables every template can use besides custom.<key>
+// and its declared variables
+var Builtins = []Variable{
+	{"name", "Customer name (alias: nama)"},
+	{"first_name", "First word of the customer name (alias: nama_depan)"},
+	{"phone", "Customer phone number (alias: telepon)"},
+	{"status", "Customer status"},
+	{"lead_score", "Customer lead score"},
+	{"business.name", "Business name"},
+	{"business.type", "Business type"},
+	{"business.phone", "Business phone number"},
+	{"business.address", "Business address"},
+	{"business.hours", "Business hours"},
+	{"business.payment_methods", "Accepted payment methods"},
+	{"today", "Today's date, e.g. {{today | date}} or {{today | add_days 3 | date \"02/01/2006\"}}"},
+	{"time", "Current time (HH:MM)"},
+}
+
+// aliases maps alternative names to built-in variables
+var aliases = map[string]string{
+	"nama":       "name",
+	"nama_depan": "first_name",
+	"telepon":    "phone",
+}
+
+var builtins = func() map[string]bool {
+	names := map[string]bool{}
+	for _, v := range Builtins {
+		names[v.Name] = true
+	}
+	return names
+}()
+
+// IsBuiltin reports whether name is a built-in variable or one of its aliases
+func IsBuiltin(name string) bool {
+	name = strings.ToLower(name)
+	if alias, ok := aliases[name]; ok {
+		name = alias
+	}
+	return builtins[name]
+}
+
+// Data is what a template is rendered with
+type Data struct {
+	Values map[string]string
+	Now    time.Time
+}
+
+// NewData merges value sets, later ones winning, dated now
+func NewData(sets ...map[string]string) Data {
+	data := Data{Values: map[string]string{}, Now: time.Now()}
+	for _, set := range sets {
+		for name, value := range set {
+			data.Values[strings.ToLower(name)] = value
+		}
+	}
+	return data
+}
+
+// Lookup returns the value of a variable, or "" when it has none
+func (d Data) Lookup(name string) string {
+	if alias, ok := aliases[name]; ok {
+		name = alias
+	}
+	if value, ok := d.Values[name]; ok {
+		return value
+	}
+	switch name {
+	case "today":
+		return d.Now.Format(DateLayout)
+	case "time":
+		return d.Now.Format("15:04")
+	}
+	return ""
+}
+
+// Service loads the values templates are rendered with
+type Service struct {
+	db *sqlx.DB
+}
+
+// NewService creates a template data service
+func NewService(db *sqlx.DB) *Service {
+	return &Service{db: db}
+}
+
+// Data loads the business values and, when customerID is set, the customer's.
+// vars (a template's declared variables) override both.
+func (s *Service) Data(ctx context.Context, tenantID, customerID string, vars map[string]string) (Data, error) {
+	business, err := s.Business(ctx, tenantID)
+	if err != nil {
+		return Data{}, err
+	}
+	customer := map[string]string{}
+	if customerID != "" {
+		if customer, err = s.Customer(ctx, tenantID, customerID); err != nil {
+			return Data{}, err
+		}
+	}
+	return NewData(business, customer, vars), nil
+}
+
+// Business returns the business.* values of a tenant. The AI settings'
+// business profile wins over the one given when the tenant was created.
+func (s *Service) Business(ctx context.Context, tenantID string) (map[string]string, error) {
+	var b struct {
+		Name           string `db:"name"`
+		Type           string `db:"type"`
+		Phone          string `db:"phone"`
+		Address        string `db:"address"`
+		Hours          string `db:"hours"`
+		PaymentMethods string `db:"payment_methods"`
+	}
+	err := s.db.GetContext(ctx, &b, `
+		SELECT
+			COALESCE(NULLIF(a.business_name, ''), t.business_name, '') as name,
+			COALESCE(NULLIF(a.business_type, ''), t.business_type, '') as type,
+			COALESCE(t.business_phone, '') as phone,
+			COALESCE(NULLIF(a.business_address, ''), t.business_address, '') as address,
+			COALESCE(a.business_hours, '') as hours,
+			COALESCE(a.payment_methods, '') as payment_methods
+		FROM tenants t
+		LEFT JOIN ai_configs a ON a.tenant_id = t.id
+		WHERE t.id = $1
+	`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{
+		"business.name":            b.Name,
+		"business.type":            b.Type,
+		"business.phone":           b.Phone,
+		"business.address":         b.Address,
+		"business.hours":           b.Hours,
+		"business.payment_methods": b.PaymentMethods,
+	}, nil
+}
+
+// Customer returns a customer's values, including custom.<key> for every
+// custom field they have
+func (s *Service) Customer(ctx context.Context, tenantID, customerID string) (map[string]string, error) {
+	var c struct {
+		JID          string  `db:"customer_jid"`
+		Name         *string `db:"customer_name"`
+		Phone        *string `db:"customer_phone"`
+		Status       string  `db:"status"`
+		LeadScore    int     `db:"lead_score"`
+		CustomFields string  `db:"custom_fields"`
+	}
+	err := s.db.GetContext(ctx, &c, `
+		SELECT customer_jid, customer_name, customer_phone,
+			COALESCE(status, 'new') as status, COALESCE(lead_score, 0) as lead_score,
+			COALESCE(custom_fields, '{}'::jsonb)::text as custom_fields
+		FROM customer_insights
+		WHERE id = $1 AND tenant_id = $2
+	`, customerID, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]string{
+		"status":     c.Status,
+		"lead_score": strconv.Itoa(c.LeadScore),
+	}
+	if c.Name != nil {
+		name := strings.TrimSpace(*c.Name)
+		values["name"] = name
+		if words := strings.Fields(name); len(words) > 0 {
+			values["first_name"] = words[0]
+		}
+	}
+	switch {
+	case c.Phone != nil && *c.Phone != "":
+		values["phone"] = *c.Phone
+	case strings.HasSuffix(c.JID, "@s.whatsapp.net"):
+		values["phone"] = strings.TrimSuffix(c.JID, "@s.whatsapp.net")
+	}
+	for key, value := range customfields.Decode(c.CustomFields) {
+		values["custom."+strings.ToLower(key)] = value
+	}
+	return values, nil
+}
+
+// Personalizer renders one message for many customers, loading the business
+// values once
+type Personalizer struct {
+	svc      *Service
+	tenantID string
+	content  string
+	tmpl     *Template
+	business map[string]string
+}
+
+// Personalizer prepares content for sending to the tenant's customers.
+// Content saved before templates were validated may not parse; it is then
+// sent as written.
+func (s *Service) Personalizer(ctx context.Context, tenantID, content string) (*Personalizer, error) {
+	business, err := s.Business(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, _ := Parse(content)
+	return &Personalizer{svc: s, tenantID: tenantID, content: content, tmpl: tmpl, business: business}, nil
+}
+
+// Render returns the message for one customer
+func (p *Personalizer) Render(ctx context.Context, customerID string) (string, error) {
+	if p.tmpl == nil {
+		return p.content, nil
+	}
+	customer, err := p.svc.Customer(ctx, p.tenantID, customerID)
+	if err != nil {
+		return "", err
+	}
+	message, _ := p.tmpl.Render(NewData(p.business, customer))
+	return message, nil
+}
@@ -0,0 +1,554 @@
+// Package templating renders message templates for broadcasts, quick replies
+// and previews. The language is deliberately small so templates written by
+// tenants cannot run code or read anything but the values they are given:
+//
+//	Halo {{nama | "Kak"}}!
+//	{{#if custom.tier == "gold"}}Diskon 20% untukmu.{{else}}Diskon 10%.{{/if}}
+//	Berlaku sampai {{today | add_days 7 | date "2 January 2006"}}.
+//
+// A tag is a variable with optional filters separated by |. A quoted string
+// after | is the default used when the value is empty. Blocks are
+// {{#if cond}}…{{else}}…{{/if}} and {{#unless cond}}…{{/unless}}, where cond
+// is a variable (true when not empty, "false" or "0"), !variable, or a
+// comparison with ==, !=, <, <=, > or >= against a quoted string or number.
+package templating
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// MaxLength is the longest template accepted
+const MaxLength = 4096
+
+// maxDepth is how deep blocks can be nested
+const maxDepth = 5
+
+// defaultDateLayout is used by the date filter without a layout
+const defaultDateLayout = "2 January 2006"
+
+// ErrSyntax wraps every template parse error
+var ErrSyntax = errors.New("invalid template")
+
+var namePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*(\.[A-Za-z0-9_]+)?$`)
+
+// Template is a parsed template
+type Template struct {
+	nodes     []node
+	variables []string
+}
+
+type node interface{}
+
+type textNode string
+
+type varNode struct {
+	name    string
+	filters []filter
+}
+
+type filter struct {
+	name string
+	arg  string
+}
+
+type ifNode struct {
+	cond condition
+	then []node
+	els  []node
+}
+
+type condition struct {
+	name   string
+	negate bool
+	op     string
+	value  string
+}
+
+// filterArgs is how many arguments each filter takes, as min and max
+var filterArgs = map[string][2]int{
+	"default":  {1, 1},
+	"upper":    {0, 0},
+	"lower":    {0, 0},
+	"title":    {0, 0},
+	"date":     {0, 1},
+	"add_days": {1, 1},
+}
+
+// Parse checks a template and prepares it for rendering
+func Parse(src string) (*Template, error) {
+	if len(src) > MaxLength {
+		return nil, fmt.Errorf("%w: longer than %d characters", ErrSyntax, MaxLength)
+	}
+
+	t := &Template{}
+	seen := map[string]bool{}
+	use := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			t.variables = append(t.variables, name)
+		}
+	}
+
+	type frame struct {
+		node   *ifNode
+		kind   string
+		inElse bool
+	}
+	var stack []*frame
+	add := func(n node) {
+		if len(stack) == 0 {
+			t.nodes = append(t.nodes, n)
+			return
+		}
+		f := stack[len(stack)-1]
+		if f.inElse {
+			f.node.els = append(f.node.els, n)
+		} else {
+			f.node.then = append(f.node.then, n)
+		}
+	}
+
+	rest := src
+	offset := 0
+	for rest != "" {
+		start := strings.Index(rest, "{{")
+		if start < 0 {
+			add(textNode(rest))
+			break
+		}
+		if start > 0 {
+			add(textNode(rest[:start]))
+		}
+		end := strings.Index(rest[start:], "}}")
+		if end < 0 {
+			return nil, syntaxError(offset+start, "{{ is never closed")
+		}
+		pos := offset + start
+		tag := strings.TrimSpace(rest[start+2 : start+end])
+		rest = rest[start+end+2:]
+		offset += start + end + 2
+
+		switch {
+		case strings.HasPrefix(tag, "#"):
+			kind, expr, _ := strings.Cut(tag[1:], " ")
+			if kind != "if" && kind != "unless" {
+				return nil, syntaxError(pos, "unknown block #"+kind)
+			}
+			if len(stack) >= maxDepth {
+				return nil, syntaxError(pos, fmt.Sprintf("blocks can be nested at most %d levels", maxDepth))
+			}
+			cond, err := parseCondition(expr)
+			if err != nil {
+				return nil, syntaxError(pos, err.Error())
+			}
+			if kind == "unless" {
+				cond.negate = !cond.negate
+			}
+			use(cond.name)
+			n := &ifNode{cond: cond}
+			add(n)
+			stack = append(stack, &frame{node: n, kind: kind})
+
+		case tag == "else":
+			if len(stack) == 0 || stack[len(stack)-1].inElse {
+				return nil, syntaxError(pos, "{{else}} without {{#if}}")
+			}
+			stack[len(stack)-1].inElse = true
+
+		case strings.HasPrefix(tag, "/"):
+			if len(stack) == 0 {
+				return nil, syntaxError(pos, "{{"+tag+"}} without an open block")
+			}
+			if kind := stack[len(stack)-1].kind; tag[1:] != kind {
+				return nil, syntaxError(pos, "expected {{/"+kind+"}}")
+			}
+			stack = stack[:len(stack)-1]
+
+		default:
+			v, err := parseVariable(tag)
+			if err != nil {
+				return nil, syntaxError(pos, err.Error())
+			}
+			use(v.name)
+			add(v)
+		}
+	}
+
+	if len(stack) > 0 {
+		return nil, fmt.Errorf("%w: {{#%s}} is never closed", ErrSyntax, stack[len(stack)-1].kind)
+	}
+	return t, nil
+}
+
+func syntaxError(pos int, msg string) error {
+	return fmt.Errorf("%w: %s at position %d", ErrSyntax, msg, pos+1)
+}
+
+// Variables returns the variables the template uses, lowercased, in order of
+// first use
+func (t *Template) Variables() []string {
+	return append([]string{}, t.variables...)
+}
+
+// Check reports variables that are neither built in, a custom field (as
+// custom.<key>) nor declared by the template
+func (t *Template) Check(customFields, declared []string) error {
+	known := map[string]bool{}
+	for _, key := range customFields {
+		known["custom."+strings.ToLower(key)] = true
+	}
+	for _, name := range declared {
+		known[strings.ToLower(name)] = true
+	}
+
+	unknown := []string{}
+	for _, name := range t.variables {
+		if !known[name] && !IsBuiltin(name) {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("%w: unknown variables %s; declare them or define custom fields", ErrSyntax, strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// Render fills in the template. It also returns the variables that had no
+// value, whether or not a default covered them.
+func (t *Template) Render(data Data) (string, []string) {
+	r := &renderer{data: data, missingSeen: map[string]bool{}}
+	r.nodes(t.nodes)
+	return r.sb.String(), r.missing
+}
+
+type renderer struct {
+	data        Data
+	sb          strings.Builder
+	missing     []string
+	missingSeen map[string]bool
+}
+
+func (r *renderer) nodes(nodes []node) {
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case textNode:
+			r.sb.WriteString(string(n))
+		case *varNode:
+			r.sb.WriteString(r.variable(n))
+		case *ifNode:
+			if r.condition(n.cond) {
+				r.nodes(n.then)
+			} else {
+				r.nodes(n.els)
+			}
+		}
+	}
+}
+
+func (r *renderer) lookup(name string) string {
+	value := r.data.Lookup(name)
+	if value == "" && !r.missingSeen[name] {
+		r.missingSeen[name] = true
+		r.missing = append(r.missing, name)
+	}
+	return value
+}
+
+func (r *renderer) variable(v *varNode) string {
+	value := r.lookup(v.name)
+	for _, f := range v.filters {
+		switch f.name {
+		case "default":
+			if value == "" {
+				value = f.arg
+			}
+		case "upper":
+			value = strings.ToUpper(value)
+		case "lower":
+			value = strings.ToLower(value)
+		case "title":
+			value = title(value)
+		case "date":
+			if d, ok := parseDate(value); ok {
+				layout := f.arg
+				if layout == "" {
+					layout = defaultDateLayout
+				}
+				value = indonesianDates.Replace(d.Format(layout))
+			}
+		case "add_days":
+			if d, ok := parseDate(value); ok {
+				days, _ := strconv.Atoi(f.arg)
+				value = d.AddDate(0, 0, days).Format(DateLayout)
+			}
+		}
+	}
+	return value
+}
+
+func (r *renderer) condition(c condition) bool {
+	value := r.lookup(c.name)
+
+	var result bool
+	switch c.op {
+	case "":
+		switch strings.ToLower(value) {
+		case "", "false", "0", "no", "tidak":
+			result = false
+		default:
+			result = true
+		}
+	case "==", "!=":
+		equal := strings.EqualFold(value, c.value)
+		if a, b, ok := numbers(value, c.value); ok {
+			equal = a == b
+		}
+		result = equal == (c.op == "==")
+	default:
+		cmp, ok := compare(value, c.value)
+		if !ok {
+			return false
+		}
+		switch c.op {
+		case "<":
+			result = cmp < 0
+		case "<=":
+			result = cmp <= 0
+		case ">":
+			result = cmp > 0
+		case ">=":
+			result = cmp >= 0
+		}
+	}
+
+	if c.negate {
+		return !result
+	}
+	return result
+}
+
+// compare orders two values as numbers or, failing that, as dates
+func compare(a, b string) (int, bool) {
+	if x, y, ok := numbers(a, b); ok {
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+	x, okA := parseDate(a)
+	y, okB := parseDate(b)
+	if okA && okB {
+		return x.Compare(y), true
+	}
+	return 0, false
+}
+
+func numbers(a, b string) (float64, float64, bool) {
+	x, errA := strconv.ParseFloat(a, 64)
+	y, errB := strconv.ParseFloat(b, 64)
+	return x, y, errA == nil && errB == nil
+}
+
+func parseDate(value string) (time.Time, bool) {
+	if d, err := time.Parse(DateLayout, value); err == nil {
+		return d, true
+	}
+	if d, err := time.Parse(time.RFC3339, value); err == nil {
+		return d, true
+	}
+	return time.Time{}, false
+}
+
+func title(s string) string {
+	words := strings.Fields(s)
+	for i, w := range words {
+		runes := []rune(strings.ToLower(w))
+		runes[0] = unicode.ToUpper(runes[0])
+		words[i] = string(runes)
+	}
+	return strings.Join(words, " ")
+}
+
+// indonesianDates translates the English month and day names of
+// time.Format. Full names come first so they win over abbreviations.
+var indonesianDates = strings.NewReplacer(
+	"January", "Januari", "February", "Februari", "March", "Maret", "April", "April",
+	"May", "Mei", "June", "Juni", "July", "Juli", "August", "Agustus",
+	"September", "September", "October", "Oktober", "November", "November", "December", "Desember",
+	"Monday", "Senin", "Tuesday", "Selasa", "Wednesday", "Rabu", "Thursday", "Kamis",
+	"Friday", "Jumat", "Saturday", "Sabtu", "Sunday", "Minggu",
+	"Aug", "Agu", "Oct", "Okt", "Dec", "Des",
+	"Mon", "Sen", "Tue", "Sel", "Wed", "Rab", "Thu", "Kam", "Fri", "Jum", "Sat", "Sab", "Sun", "Min",
+)
+
+// Tag contents
+
+const (
+	tokWord = iota
+	tokString
+	tokOp
+	tokPipe
+)
+
+type token struct {
+	kind int
+	text string
+}
+
+var operators = map[string]bool{"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true, "!": true}
+
+func lex(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		ch := s[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			i++
+		case ch == '|':
+			tokens = append(tokens, token{tokPipe, "|"})
+			i++
+		case ch == '"' || ch == '\'':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(s) && s[j] != ch; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				sb.WriteByte(s[j])
+			}
+			if j >= len(s) {
+				return nil, errors.New("unterminated string")
+			}
+			tokens = append(tokens, token{tokString, sb.String()})
+			i = j + 1
+		case strings.IndexByte("=!<>", ch) >= 0:
+			j := i
+			for j < len(s) && strings.IndexByte("=!<>", s[j]) >= 0 {
+				j++
+			}
+			if !operators[s[i:j]] {
+				return nil, fmt.Errorf("unknown operator %s", s[i:j])
+			}
+			tokens = append(tokens, token{tokOp, s[i:j]})
+			i = j
+		default:
+			j := i
+			for j < len(s) && strings.IndexByte(" \t\n\r|\"'=!<>", s[j]) < 0 {
+				j++
+			}
+			tokens = append(tokens, token{tokWord, s[i:j]})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+func parseVariable(tag string) (*varNode, error) {
+	tokens, err := lex(tag)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 || tokens[0].kind != tokWord || !namePattern.MatchString(tokens[0].text) {
+		return nil, errors.New("expected a variable name")
+	}
+
+	v := &varNode{name: strings.ToLower(tokens[0].text)}
+	for i := 1; i < len(tokens); {
+		if tokens[i].kind != tokPipe {
+			return nil, fmt.Errorf("unexpected %q, separate filters with |", tokens[i].text)
+		}
+		i++
+		if i >= len(tokens) || tokens[i].kind == tokPipe {
+			return nil, errors.New("expected a filter or default after |")
+		}
+
+		if tokens[i].kind == tokString {
+			v.filters = append(v.filters, filter{name: "default", arg: tokens[i].text})
+			i++
+			continue
+		}
+		if tokens[i].kind != tokWord {
+			return nil, fmt.Errorf("unexpected %q", tokens[i].text)
+		}
+
+		f := filter{name: strings.ToLower(tokens[i].text)}
+		limits, ok := filterArgs[f.name]
+		if !ok {
+			return nil, fmt.Errorf("unknown filter %s", f.name)
+		}
+		i++
+		args := []token{}
+		for i < len(tokens) && tokens[i].kind != tokPipe {
+			args = append(args, tokens[i])
+			i++
+		}
+		if len(args) < limits[0] || len(args) > limits[1] {
+			return nil, fmt.Errorf("filter %s takes %d to %d arguments", f.name, limits[0], limits[1])
+		}
+		if len(args) == 1 {
+			f.arg = args[0].text
+		}
+		if f.name == "add_days" {
+			if _, err := strconv.Atoi(f.arg); err != nil {
+				return nil, errors.New("add_days needs a whole number of days")
+			}
+		}
+		v.filters = append(v.filters, f)
+	}
+	return v, nil
+}
+
+func parseCondition(expr string) (condition, error) {
+	tokens, err := lex(expr)
+	if err != nil {
+		return condition{}, err
+	}
+
+	var c condition
+	if len(tokens) > 0 && (tokens[0].kind == tokOp && tokens[0].text == "!" || tokens[0].kind == tokWord && tokens[0].text == "not") {
+		c.negate = true
+		tokens = tokens[1:]
+	}
+	if len(tokens) == 0 || tokens[0].kind != tokWord || !namePattern.MatchString(tokens[0].text) {
+		return c, errors.New("expected a variable to test")
+	}
+	c.name = strings.ToLower(tokens[0].text)
+
+	switch len(tokens) {
+	case 1:
+		return c, nil
+	case 3:
+	default:
+		return c, errors.New("expected a variable, or a variable, operator and value")
+	}
+
+	if c.negate {
+		return c, errors.New("use != instead of negating a comparison")
+	}
+	if tokens[1].kind != tokOp || tokens[1].text == "!" {
+		return c, fmt.Errorf("expected an operator, got %q", tokens[1].text)
+	}
+	c.op = tokens[1].text
+	c.value = tokens[2].text
+	switch tokens[2].kind {
+	case tokString:
+	case tokWord:
+		if _, err := strconv.ParseFloat(c.value, 64); err != nil {
+			return c, fmt.Errorf("quote the text %q", c.value)
+		}
+	default:
+		return c, fmt.Errorf("unexpected %q", c.value)
+	}
+	return c, nil
+}
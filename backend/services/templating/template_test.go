@@ -0,0 +1,151 @@
+package templating
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRender(t *testing.T) {
+	data := Data{
+		Values: map[string]string{
+			"name":             "budi santoso",
+			"lead_score":       "72",
+			"custom.tier":      "Gold",
+			"custom.member":    "false",
+			"custom.joined":    "2024-02-29",
+			"business.name":    "Toko Maju",
+			"business.address": "",
+		},
+		Now: time.Date(2024, 12, 30, 9, 5, 0, 0, time.UTC),
+	}
+
+	tests := []struct {
+		name    string
+		src     string
+		want    string
+		missing []string
+	}{
+		{"plain text", "Halo semua", "Halo semua", nil},
+		{"variable", "Halo {{name}}", "Halo budi santoso", nil},
+		{"alias and case", "Halo {{ NAMA | title }}", "Halo Budi Santoso", nil},
+		{"upper and lower", "{{custom.tier | upper}} {{custom.tier | lower}}", "GOLD gold", nil},
+		{"default for missing value", "Halo {{nickname | \"Kak\"}}", "Halo Kak", []string{"nickname"}},
+		{"default filter", "{{business.address | default 'online'}}", "online", []string{"business.address"}},
+		{"missing reported once", "{{x}}{{x}}", "", []string{"x"}},
+		{"today and time", "{{today}} {{time}}", "2024-12-30 09:05", nil},
+		{"date filter", "{{custom.joined | date}}", "29 Februari 2024", nil},
+		{"date layout", `{{custom.joined | date "Mon, 02 Jan"}}`, "Kam, 29 Feb", nil},
+		{"add days across a year", `{{today | add_days 3 | date "2 January 2006"}}`, "2 Januari 2025", nil},
+		{"date of non-date is kept", "{{name | date}}", "budi santoso", nil},
+		{"if true", "{{#if custom.tier}}member{{/if}}", "member", nil},
+		{"if false value", "{{#if custom.member}}yes{{else}}no{{/if}}", "no", nil},
+		{"negated", "{{#if !custom.member}}guest{{/if}}", "guest", nil},
+		{"unless", "{{#unless custom.tier}}none{{else}}some{{/unless}}", "some", nil},
+		{"equal ignores case", `{{#if custom.tier == "gold"}}20%{{else}}10%{{/if}}`, "20%", nil},
+		{"not equal", `{{#if custom.tier != "gold"}}x{{else}}y{{/if}}`, "y", nil},
+		{"number comparison", "{{#if lead_score >= 70}}hot{{else}}cold{{/if}}", "hot", nil},
+		{"numbers compare numerically", "{{#if lead_score < 100}}under{{/if}}", "under", nil},
+		{"date comparison", `{{#if custom.joined < "2024-03-01"}}early{{/if}}`, "early", nil},
+		{"incomparable is false", `{{#if name > 5}}x{{else}}y{{/if}}`, "y", nil},
+		{"nested blocks", `{{#if custom.tier}}{{#if lead_score > 80}}a{{else}}b{{/if}}{{/if}}`, "b", nil},
+		{"missing condition variable", "{{#if vip}}vip{{/if}}", "", []string{"vip"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := Parse(tt.src)
+			if err != nil {
+				t.Fatalf("Parse(%q) error = %v", tt.src, err)
+			}
+			got, missing := tmpl.Render(data)
+			if got != tt.want {
+				t.Errorf("Render() = %q, want %q", got, tt.want)
+			}
+			if len(missing) == 0 {
+				missing = nil
+			}
+			if !reflect.DeepEqual(missing, tt.missing) {
+				t.Errorf("Render() missing = %v, want %v", missing, tt.missing)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		message string
+	}{
+		{"unclosed tag", "Halo {{name", "{{ is never closed at position 6"},
+		{"unclosed block", "{{#if name}}x", "{{#if}} is never closed"},
+		{"unknown block", "{{#each items}}{{/each}}", "unknown block #each"},
+		{"stray else", "{{else}}", "{{else}} without {{#if}}"},
+		{"double else", "{{#if a}}{{else}}{{else}}{{/if}}", "{{else}} without {{#if}}"},
+		{"stray close", "{{/if}}", "without an open block"},
+		{"mismatched close", "{{#unless a}}{{/if}}", "expected {{/unless}}"},
+		{"too deep", strings.Repeat("{{#if a}}", maxDepth+1), "nested at most"},
+		{"bad variable name", "{{1abc}}", "expected a variable name"},
+		{"unknown filter", "{{name | reverse}}", "unknown filter reverse"},
+		{"filter arguments", "{{name | upper 2}}", "filter upper takes 0 to 0 arguments"},
+		{"add_days needs a number", "{{today | add_days soon}}", "whole number of days"},
+		{"empty filter", "{{name | }}", "expected a filter or default"},
+		{"unterminated string", `{{name | "Kak}}`, "unterminated string"},
+		{"unknown operator", "{{#if a => 1}}{{/if}}", "unknown operator =>"},
+		{"unquoted text", "{{#if tier == gold}}{{/if}}", `quote the text "gold"`},
+		{"negated comparison", `{{#if !tier == "a"}}{{/if}}`, "use != instead"},
+		{"too long", strings.Repeat("a", MaxLength+1), "longer than"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.src)
+			if !errors.Is(err, ErrSyntax) {
+				t.Fatalf("Parse(%q) error = %v, want ErrSyntax", tt.src, err)
+			}
+			if !strings.Contains(err.Error(), tt.message) {
+				t.Errorf("Parse(%q) error = %q, want it to mention %q", tt.src, err, tt.message)
+			}
+		})
+	}
+}
+
+func TestVariablesAndCheck(t *testing.T) {
+	tmpl, err := Parse(`{{Nama}} {{#if custom.Tier}}{{promo_code}}{{/if}} {{nama}} {{business.name}} {{custom.size}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"nama", "custom.tier", "promo_code", "business.name", "custom.size"}
+	if got := tmpl.Variables(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Variables() = %v, want %v", got, want)
+	}
+
+	tests := []struct {
+		name         string
+		customFields []string
+		declared     []string
+		message      string
+	}{
+		{"all known", []string{"tier", "size"}, []string{"PROMO_CODE"}, ""},
+		{"undeclared variable", []string{"tier", "size"}, nil, "unknown variables promo_code"},
+		{"undefined custom fields", nil, []string{"promo_code"}, "unknown variables custom.size, custom.tier"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tmpl.Check(tt.customFields, tt.declared)
+			if tt.message == "" {
+				if err != nil {
+					t.Fatalf("Check() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.message) {
+				t.Errorf("Check() error = %v, want it to mention %q", err, tt.message)
+			}
+		})
+	}
+}
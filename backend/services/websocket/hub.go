@@ -12,6 +12,7 @@ import (
 type Client struct {
 	ID       string
 	TenantID string
+	UserID   string
 	Conn     *websocket.Conn
 	Send     chan []byte
 }
@@ -47,6 +48,11 @@ const (
 	EventCustomerUpdated = "customer_updated"
 	EventMessageSent     = "message_sent"
 	EventConnectionStatus = "connection_status"
+	EventConversationAssigned = "conversation_assigned"
+	EventConversationUpdated = "conversation_updated"
+	EventConversationRead = "conversation_read"
+	EventBroadcastProgress = "broadcast_progress"
+	EventFollowUpDue = "follow_up_due"
 )
 
 // WSMessage is the message format sent to clients
@@ -166,3 +172,19 @@ func (h *Hub) GetClientCount(tenantID string) int {
 	return 0
 }
 
+
+// GetOnlineUserIDs returns the distinct users with an open connection for a tenant
+func (h *Hub) GetOnlineUserIDs(tenantID string) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	seen := make(map[string]bool)
+	userIDs := []string{}
+	for client := range h.clients[tenantID] {
+		if client.UserID == "" || seen[client.UserID] {
+			continue
+		}
+		seen[client.UserID] = true
+		userIDs = append(userIDs, client.UserID)
+	}
+	return userIDs
+}
@@ -9,9 +9,14 @@ import (
 	"strings"
 	"time"
 
+	"gowa-backend/services/conversation"
+	"gowa-backend/services/customers"
 	"gowa-backend/services/redis"
 	"gowa-backend/services/websocket"
 
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+
 	"go.mau.fi/whatsmeow"
 	"go.mau.fi/whatsmeow/store/sqlstore"
 	"go.mau.fi/whatsmeow/types"
@@ -27,6 +32,7 @@ type ClientService struct {
 	db            *sql.DB
 	clientManager *ClientManager
 	redisClient   *redis.Client
+	conversations *conversation.Service
 	logger        waLog.Logger
 }
 
@@ -36,6 +42,7 @@ func NewClientService(db *sql.DB, redisClient *redis.Client) *ClientService {
 		db:            db,
 		clientManager: GetGlobalClientManager(),
 		redisClient:   redisClient,
+		conversations: conversation.NewService(sqlx.NewDb(db, "postgres")),
 		logger:        waLog.Stdout("ClientService", "INFO", true),
 	}
 }
@@ -228,6 +235,16 @@ func (s *ClientService) handleMessage(tenantID string, evt *events.Message) {
 		s.logger.Infof("[%s] Incoming message from customer: %s", tenantID, customerJID)
 	}
 	
+	// A customer merged into another keeps writing from the old JID; file
+	// the message under the surviving customer
+	if !evt.Info.IsGroup {
+		if survivorJID := customers.MergedJID(context.Background(), s.db, tenantID, customerJID); survivorJID != "" {
+			s.logger.Infof("[%s] %s was merged into %s", tenantID, customerJID, survivorJID)
+			customerJID = survivorJID
+			normalizedChatJID = survivorJID
+		}
+	}
+
 	s.logger.Infof("[%s] Normalized JIDs - Chat: %s, Sender: %s, Customer: %s", tenantID, normalizedChatJID, normalizedSenderJID, customerJID)
 
 	// Download and save media for incoming messages
@@ -289,10 +306,16 @@ func (s *ClientService) handleMessage(tenantID string, evt *events.Message) {
 		INSERT INTO whatsapp_messages (
 			tenant_id, message_id, chat_jid, sender_jid, 
 			message_type, message_text, media_url, is_from_me, is_group, 
-			timestamp, created_at
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NOW())
+			timestamp, sent_by, created_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, NOW())
 		ON CONFLICT (tenant_id, message_id) DO NOTHING
 	`
+
+	// Our own messages that reach here without a dashboard insert were sent from the phone
+	sentBy := SentByCustomer
+	if evt.Info.IsFromMe {
+		sentBy = SentByPhone
+	}
 	
 	_, err := s.db.ExecContext(ctx, query,
 		tenantID,
@@ -305,6 +328,7 @@ func (s *ClientService) handleMessage(tenantID string, evt *events.Message) {
 		evt.Info.IsFromMe,
 		evt.Info.IsGroup,
 		evt.Info.Timestamp.Unix(),
+		sentBy,
 	)
 	
 	if err != nil {
@@ -312,6 +336,20 @@ func (s *ClientService) handleMessage(tenantID string, evt *events.Message) {
 		return
 	}
 
+	// Keep the conversation's last message and status up to date
+	s.recordConversationMessage(ctx, tenantID, customerJID, conversation.LastMessage{
+		MessageID: evt.Info.ID,
+		Text:      messageText,
+		Type:      messageType,
+		FromMe:    evt.Info.IsFromMe,
+		At:        evt.Info.Timestamp,
+	})
+
+	// Attribute customer replies to the broadcast they answer
+	if !evt.Info.IsFromMe && !evt.Info.IsGroup {
+		s.trackBroadcastReply(ctx, tenantID, normalizedChatJID, evt.Info.ID, evt.Info.Timestamp)
+	}
+
 	// Push to Redis queue for AI processing (only for incoming messages)
 	if s.redisClient != nil && !evt.Info.IsFromMe {
 		payload := &redis.MessagePayload{
@@ -395,8 +433,93 @@ func (s *ClientService) handleLoggedOut(tenantID string) {
 // pendingMappings stores MessageID -> JID for correlating Receipt events
 var pendingMappings = make(map[string]map[string]string) // tenantID -> messageID -> jid
 
+// trackBroadcastReceipt records delivery and read receipts of broadcast and
+// sequence messages. Counting only recipients whose delivered_at was still
+// empty keeps the broadcast's delivered_count right when receipts repeat.
+func (s *ClientService) trackBroadcastReceipt(tenantID string, evt *events.Receipt) {
+	if evt.IsFromMe || len(evt.MessageIDs) == 0 {
+		return
+	}
+	var read bool
+	switch evt.Type {
+	case types.ReceiptTypeDelivered:
+	case types.ReceiptTypeRead, types.ReceiptTypePlayed:
+		read = true
+	default:
+		return
+	}
+
+	messageIDs := make([]string, len(evt.MessageIDs))
+	for i, id := range evt.MessageIDs {
+		messageIDs[i] = string(id)
+	}
+
+	query := `
+		WITH targets AS (
+			SELECT br.id, br.broadcast_id, br.delivered_at IS NULL as newly_delivered
+			FROM broadcast_recipients br
+			JOIN broadcasts b ON b.id = br.broadcast_id
+			WHERE b.tenant_id = $1 AND br.message_id = ANY($2)
+			  AND (br.delivered_at IS NULL OR ($4 AND br.read_at IS NULL))
+			FOR UPDATE OF br
+		), updated AS (
+			UPDATE broadcast_recipients br SET
+				delivered_at = COALESCE(br.delivered_at, $3),
+				read_at = CASE WHEN $4 THEN COALESCE(br.read_at, $3) ELSE br.read_at END,
+				status = CASE WHEN br.status = 'sent' THEN 'delivered' ELSE br.status END
+			FROM targets t
+			WHERE br.id = t.id
+			RETURNING t.broadcast_id, t.newly_delivered
+		)
+		UPDATE broadcasts b
+		SET delivered_count = delivered_count + d.delivered, updated_at = NOW()
+		FROM (
+			SELECT broadcast_id, COUNT(*) FILTER (WHERE newly_delivered) as delivered
+			FROM updated GROUP BY broadcast_id
+		) d
+		WHERE b.id = d.broadcast_id AND d.delivered > 0
+	`
+	if _, err := s.db.ExecContext(context.Background(), query, tenantID, pq.Array(messageIDs), evt.Timestamp, read); err != nil {
+		s.logger.Errorf("[%s] Failed to record broadcast receipt: %v", tenantID, err)
+	}
+
+	query = `
+		UPDATE sequence_step_sends ss SET
+			delivered_at = COALESCE(ss.delivered_at, $3),
+			read_at = CASE WHEN $4 THEN COALESCE(ss.read_at, $3) ELSE ss.read_at END
+		FROM sequence_enrollments e
+		WHERE e.id = ss.enrollment_id AND e.tenant_id = $1 AND ss.message_id = ANY($2)
+		  AND (ss.delivered_at IS NULL OR ($4 AND ss.read_at IS NULL))
+	`
+	if _, err := s.db.ExecContext(context.Background(), query, tenantID, pq.Array(messageIDs), evt.Timestamp, read); err != nil {
+		s.logger.Errorf("[%s] Failed to record sequence receipt: %v", tenantID, err)
+	}
+}
+
+// trackBroadcastReply attributes an inbound message to the most recent
+// broadcast sent to the customer within ReplyWindow. Only the first reply to
+// a send is kept.
+func (s *ClientService) trackBroadcastReply(ctx context.Context, tenantID, chatJID, messageID string, at time.Time) {
+	query := `
+		UPDATE broadcast_recipients br SET replied_at = $4, reply_message_id = $3
+		WHERE br.replied_at IS NULL AND br.id = (
+			SELECT r.id FROM broadcast_recipients r
+			JOIN broadcasts b ON b.id = r.broadcast_id
+			WHERE b.tenant_id = $1 AND r.customer_jid = $2 AND r.sent_at IS NOT NULL
+			  AND r.sent_at BETWEEN $4::timestamptz - make_interval(secs => $5) AND $4::timestamptz
+			ORDER BY r.sent_at DESC
+			LIMIT 1
+		)
+	`
+	if _, err := s.db.ExecContext(ctx, query, tenantID, chatJID, messageID, at, ReplyWindow.Seconds()); err != nil {
+		s.logger.Errorf("[%s] Failed to attribute broadcast reply: %v", tenantID, err)
+	}
+}
+
 // handleReceipt handles receipt events and stores JID mappings
 func (s *ClientService) handleReceipt(tenantID string, evt *events.Receipt) {
+	s.trackBroadcastReceipt(tenantID, evt)
+
 	chatJID := evt.MessageSource.Chat.String()
 	
 	for _, msgID := range evt.MessageIDs {
@@ -675,10 +798,12 @@ func (s *ClientService) SendMessage(ctx context.Context, tenantID string, recipi
 		INSERT INTO whatsapp_messages (
 			tenant_id, message_id, chat_jid, sender_jid, 
 			message_type, message_text, is_from_me, is_group, 
-			timestamp, created_at
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NOW())
-		ON CONFLICT (tenant_id, message_id) DO NOTHING
+			timestamp, sent_by, sent_by_user, created_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, NOW())
+		ON CONFLICT (tenant_id, message_id) DO UPDATE SET
+			sent_by = EXCLUDED.sent_by, sent_by_user = EXCLUDED.sent_by_user
 	`
+	sentBy, sentByUser := senderFromContext(ctx)
 
 	// Get our own JID for sender
 	senderJID := ""
@@ -696,6 +821,8 @@ func (s *ClientService) SendMessage(ctx context.Context, tenantID string, recipi
 		true, // is_from_me
 		false, // is_group (assuming direct message)
 		timestamp,
+		sentBy,
+		sentByUser,
 	)
 
 	if dbErr != nil {
@@ -703,6 +830,14 @@ func (s *ClientService) SendMessage(ctx context.Context, tenantID string, recipi
 		// Don't return error - message was sent successfully
 	}
 
+	s.recordConversationMessage(ctx, tenantID, jid.String(), conversation.LastMessage{
+		MessageID: messageID,
+		Text:      message,
+		Type:      "text",
+		FromMe:    true,
+		At:        resp.Timestamp,
+	})
+
 	// Broadcast sent message via WebSocket so frontend can update in real-time
 	hub := websocket.GetHub()
 	hub.BroadcastToTenant(tenantID, websocket.EventNewMessage, map[string]interface{}{
@@ -719,6 +854,43 @@ func (s *ClientService) SendMessage(ctx context.Context, tenantID string, recipi
 	return messageID, nil
 }
 
+// MarkRead sends read receipts for messages a customer sent in a direct chat
+func (s *ClientService) MarkRead(ctx context.Context, tenantID string, chatJID string, messageIDs []string) error {
+	if len(messageIDs) == 0 {
+		return nil
+	}
+
+	client, err := s.clientManager.GetClient(tenantID)
+	if err != nil {
+		return fmt.Errorf("WhatsApp client not found. Please connect first")
+	}
+	if !client.IsConnected() {
+		return fmt.Errorf("WhatsApp not connected. Please reconnect")
+	}
+
+	jid, err := types.ParseJID(chatJID)
+	if err != nil {
+		return fmt.Errorf("invalid chat JID: %w", err)
+	}
+
+	ids := make([]types.MessageID, len(messageIDs))
+	for i, id := range messageIDs {
+		ids[i] = types.MessageID(id)
+	}
+
+	if err := client.MarkRead(ctx, ids, time.Now(), jid.ToNonAD(), types.EmptyJID); err != nil {
+		return fmt.Errorf("failed to send read receipt: %w", err)
+	}
+	return nil
+}
+
+// recordConversationMessage updates the customer's conversation after a message was stored
+func (s *ClientService) recordConversationMessage(ctx context.Context, tenantID, customerJID string, msg conversation.LastMessage) {
+	if _, err := s.conversations.RecordMessage(ctx, tenantID, customerJID, msg); err != nil {
+		s.logger.Errorf("[%s] Failed to update conversation: %v", tenantID, err)
+	}
+}
+
 // SendMessageResult holds the result of sending a message
 type SendMessageResult struct {
 	MessageID string    `json:"message_id"`
@@ -777,105 +949,12 @@ func (s *ClientService) SendMediaMessage(ctx context.Context, tenantID string, r
 	// Generate the accessible URL
 	localMediaURL := fmt.Sprintf("/uploads/%s/%s", tenantID, localFileName)
 
-	// Upload to WhatsApp
-	var uploaded whatsmeow.UploadResponse
-	var msg *waProto.Message
-
-	switch mediaType {
-	case "image":
-		uploaded, err = client.Upload(ctx, mediaData, whatsmeow.MediaImage)
-		if err != nil {
-			return "", fmt.Errorf("failed to upload image: %w", err)
-		}
-		msg = &waProto.Message{
-			ImageMessage: &waProto.ImageMessage{
-				Caption:       proto.String(caption),
-				URL:           proto.String(uploaded.URL),
-				DirectPath:    proto.String(uploaded.DirectPath),
-				MediaKey:      uploaded.MediaKey,
-				Mimetype:      proto.String("image/jpeg"), // Assuming JPEG for now, should detect
-				FileEncSHA256: uploaded.FileEncSHA256,
-				FileSHA256:    uploaded.FileSHA256,
-				FileLength:    proto.Uint64(uint64(len(mediaData))),
-			},
-		}
-	case "document":
-		uploaded, err = client.Upload(ctx, mediaData, whatsmeow.MediaDocument)
-		if err != nil {
-			return "", fmt.Errorf("failed to upload document: %w", err)
-		}
-		msg = &waProto.Message{
-			DocumentMessage: &waProto.DocumentMessage{
-				Caption:       proto.String(caption),
-				URL:           proto.String(uploaded.URL),
-				DirectPath:    proto.String(uploaded.DirectPath),
-				MediaKey:      uploaded.MediaKey,
-				Mimetype:      proto.String("application/pdf"), // Default to PDF, should detect
-				FileEncSHA256: uploaded.FileEncSHA256,
-				FileSHA256:    uploaded.FileSHA256,
-				FileLength:    proto.Uint64(uint64(len(mediaData))),
-				FileName:      proto.String(fileName),
-			},
-		}
-	default:
-		return "", fmt.Errorf("unsupported media type: %s", mediaType)
-	}
-
-	// Send message
-	resp, err := client.SendMessage(ctx, jid, msg)
+	// Upload to WhatsApp and send
+	media, err := s.UploadMedia(ctx, tenantID, mediaData, mediaType, fileName)
 	if err != nil {
-		return "", fmt.Errorf("failed to send media message: %w", err)
+		return "", err
 	}
+	media.LocalURL = localMediaURL
 
-	s.logger.Infof("[%s] Media message sent! ID=%s", tenantID, resp.ID)
-
-	// Store in database with LOCAL URL (not WhatsApp CDN URL)
-	// Use DO UPDATE to overwrite media_url if handleMessage already inserted with CDN URL
-	query := `
-		INSERT INTO whatsapp_messages (
-			tenant_id, message_id, chat_jid, sender_jid, 
-			message_type, message_text, media_url, caption,
-			is_from_me, is_group, timestamp, created_at
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, NOW())
-		ON CONFLICT (tenant_id, message_id) DO UPDATE SET media_url = EXCLUDED.media_url
-	`
-
-	senderJID := ""
-	if client.Store != nil && client.Store.ID != nil {
-		senderJID = client.Store.ID.String()
-	}
-
-	_, dbErr := s.db.ExecContext(ctx, query,
-		tenantID,
-		resp.ID,
-		recipientJID,
-		senderJID,
-		mediaType,
-		caption, // Use caption as message text for display
-		localMediaURL, // Use LOCAL URL, not WhatsApp CDN URL
-		caption,
-		true,
-		false,
-		resp.Timestamp.Unix(),
-	)
-
-	if dbErr != nil {
-		s.logger.Errorf("Failed to store sent media message: %v", dbErr)
-	}
-
-	// Broadcast via WebSocket with LOCAL URL
-	hub := websocket.GetHub()
-	hub.BroadcastToTenant(tenantID, websocket.EventNewMessage, map[string]interface{}{
-		"message_id":   resp.ID,
-		"sender_jid":   senderJID,
-		"chat_jid":     recipientJID,
-		"message_text": caption,
-		"message_type": mediaType,
-		"media_url":    localMediaURL, // Use LOCAL URL
-		"caption":      caption,
-		"timestamp":    resp.Timestamp.Unix(),
-		"is_from_me":   true,
-	})
-
-	return resp.ID, nil
+	return s.SendUploadedMedia(ctx, tenantID, recipientJID, media, caption)
 }
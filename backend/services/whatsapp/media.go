@@ -0,0 +1,219 @@
+package whatsapp
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+
+	"gowa-backend/services/conversation"
+	"gowa-backend/services/websocket"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// UploadedMedia is media uploaded to WhatsApp once. It can be sent to any
+// number of recipients without uploading it again.
+type UploadedMedia struct {
+	Type          string `json:"type"`
+	MimeType      string `json:"mime_type"`
+	FileName      string `json:"file_name"`
+	URL           string `json:"url"`
+	DirectPath    string `json:"direct_path"`
+	MediaKey      []byte `json:"media_key"`
+	FileEncSHA256 []byte `json:"file_enc_sha256"`
+	FileSHA256    []byte `json:"file_sha256"`
+	FileLength    uint64 `json:"file_length"`
+	// LocalURL is where the UI shows the media from
+	LocalURL string `json:"local_url"`
+}
+
+// UploadMedia uploads an image, video or document to WhatsApp
+func (s *ClientService) UploadMedia(ctx context.Context, tenantID string, mediaData []byte, mediaType string, fileName string) (*UploadedMedia, error) {
+	client, err := s.clientManager.GetClient(tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("WhatsApp client not found. Please connect first")
+	}
+	if !client.IsConnected() {
+		return nil, fmt.Errorf("WhatsApp not connected. Please reconnect")
+	}
+
+	var appInfo whatsmeow.MediaType
+	mimeType := mime.TypeByExtension(filepath.Ext(fileName))
+	switch mediaType {
+	case "image":
+		appInfo = whatsmeow.MediaImage
+		mimeType = http.DetectContentType(mediaData)
+	case "video":
+		appInfo = whatsmeow.MediaVideo
+		if mimeType == "" {
+			mimeType = "video/mp4"
+		}
+	case "document":
+		appInfo = whatsmeow.MediaDocument
+		if mimeType == "" {
+			mimeType = "application/pdf"
+		}
+	default:
+		return nil, fmt.Errorf("unsupported media type: %s", mediaType)
+	}
+
+	uploaded, err := client.Upload(ctx, mediaData, appInfo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload %s: %w", mediaType, err)
+	}
+
+	return &UploadedMedia{
+		Type:          mediaType,
+		MimeType:      mimeType,
+		FileName:      fileName,
+		URL:           uploaded.URL,
+		DirectPath:    uploaded.DirectPath,
+		MediaKey:      uploaded.MediaKey,
+		FileEncSHA256: uploaded.FileEncSHA256,
+		FileSHA256:    uploaded.FileSHA256,
+		FileLength:    uint64(len(mediaData)),
+	}, nil
+}
+
+// mediaMessage builds the message for uploaded media
+func mediaMessage(media *UploadedMedia, caption string) (*waProto.Message, error) {
+	switch media.Type {
+	case "image":
+		return &waProto.Message{
+			ImageMessage: &waProto.ImageMessage{
+				Caption:       proto.String(caption),
+				URL:           proto.String(media.URL),
+				DirectPath:    proto.String(media.DirectPath),
+				MediaKey:      media.MediaKey,
+				Mimetype:      proto.String(media.MimeType),
+				FileEncSHA256: media.FileEncSHA256,
+				FileSHA256:    media.FileSHA256,
+				FileLength:    proto.Uint64(media.FileLength),
+			},
+		}, nil
+	case "video":
+		return &waProto.Message{
+			VideoMessage: &waProto.VideoMessage{
+				Caption:       proto.String(caption),
+				URL:           proto.String(media.URL),
+				DirectPath:    proto.String(media.DirectPath),
+				MediaKey:      media.MediaKey,
+				Mimetype:      proto.String(media.MimeType),
+				FileEncSHA256: media.FileEncSHA256,
+				FileSHA256:    media.FileSHA256,
+				FileLength:    proto.Uint64(media.FileLength),
+			},
+		}, nil
+	case "document":
+		return &waProto.Message{
+			DocumentMessage: &waProto.DocumentMessage{
+				Caption:       proto.String(caption),
+				URL:           proto.String(media.URL),
+				DirectPath:    proto.String(media.DirectPath),
+				MediaKey:      media.MediaKey,
+				Mimetype:      proto.String(media.MimeType),
+				FileEncSHA256: media.FileEncSHA256,
+				FileSHA256:    media.FileSHA256,
+				FileLength:    proto.Uint64(media.FileLength),
+				FileName:      proto.String(media.FileName),
+			},
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported media type: %s", media.Type)
+}
+
+// SendUploadedMedia sends media uploaded with UploadMedia with a caption
+func (s *ClientService) SendUploadedMedia(ctx context.Context, tenantID string, recipientJID string, media *UploadedMedia, caption string) (string, error) {
+	client, err := s.clientManager.GetClient(tenantID)
+	if err != nil {
+		return "", fmt.Errorf("WhatsApp client not found. Please connect first")
+	}
+	if !client.IsConnected() {
+		return "", fmt.Errorf("WhatsApp not connected. Please reconnect")
+	}
+
+	jid, err := types.ParseJID(recipientJID)
+	if err != nil {
+		return "", fmt.Errorf("invalid recipient JID: %w", err)
+	}
+	jid = jid.ToNonAD()
+
+	msg, err := mediaMessage(media, caption)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.SendMessage(ctx, jid, msg)
+	if err != nil {
+		return "", fmt.Errorf("failed to send media message: %w", err)
+	}
+
+	s.logger.Infof("[%s] Media message sent! ID=%s", tenantID, resp.ID)
+
+	// Store in database with LOCAL URL (not WhatsApp CDN URL)
+	// Use DO UPDATE to overwrite media_url if handleMessage already inserted with CDN URL
+	query := `
+		INSERT INTO whatsapp_messages (
+			tenant_id, message_id, chat_jid, sender_jid,
+			message_type, message_text, media_url, caption,
+			is_from_me, is_group, timestamp, sent_by, sent_by_user, created_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, NOW())
+		ON CONFLICT (tenant_id, message_id) DO UPDATE SET
+			media_url = EXCLUDED.media_url, message_text = NULL, caption = EXCLUDED.caption,
+			sent_by = EXCLUDED.sent_by, sent_by_user = EXCLUDED.sent_by_user
+	`
+	sentBy, sentByUser := senderFromContext(ctx)
+
+	senderJID := ""
+	if client.Store != nil && client.Store.ID != nil {
+		senderJID = client.Store.ID.String()
+	}
+
+	_, dbErr := s.db.ExecContext(ctx, query,
+		tenantID,
+		resp.ID,
+		recipientJID,
+		senderJID,
+		media.Type,
+		nil, // The caption is the text; readers fall back to it
+		media.LocalURL,
+		caption,
+		true,
+		false,
+		resp.Timestamp.Unix(),
+		sentBy,
+		sentByUser,
+	)
+	if dbErr != nil {
+		s.logger.Errorf("Failed to store sent media message: %v", dbErr)
+	}
+
+	s.recordConversationMessage(ctx, tenantID, jid.String(), conversation.LastMessage{
+		MessageID: resp.ID,
+		Text:      caption,
+		Type:      media.Type,
+		FromMe:    true,
+		At:        resp.Timestamp,
+	})
+
+	// Broadcast via WebSocket with LOCAL URL
+	hub := websocket.GetHub()
+	hub.BroadcastToTenant(tenantID, websocket.EventNewMessage, map[string]interface{}{
+		"message_id":   resp.ID,
+		"sender_jid":   senderJID,
+		"chat_jid":     recipientJID,
+		"message_text": caption,
+		"message_type": media.Type,
+		"media_url":    media.LocalURL,
+		"caption":      caption,
+		"timestamp":    resp.Timestamp.Unix(),
+		"is_from_me":   true,
+	})
+
+	return resp.ID, nil
+}
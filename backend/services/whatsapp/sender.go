@@ -0,0 +1,46 @@
+package whatsapp
+
+import (
+	"context"
+	"time"
+)
+
+// Message sources stored in whatsapp_messages.sent_by
+const (
+	SentByCustomer  = "customer"
+	SentByAgent     = "agent"
+	SentByAI        = "ai"
+	SentByBroadcast = "broadcast"
+	SentBySequence  = "sequence"
+	SentByPhone     = "phone"
+)
+
+// ReplyWindow is how long after a broadcast send an inbound message from the
+// recipient is attributed to that broadcast
+const ReplyWindow = 72 * time.Hour
+
+type senderKey struct{}
+
+type sender struct {
+	source string
+	userID string
+}
+
+// WithSender marks messages sent with ctx as coming from source, and for
+// agents from the given user, so transcripts can attribute them
+func WithSender(ctx context.Context, source, userID string) context.Context {
+	return context.WithValue(ctx, senderKey{}, sender{source: source, userID: userID})
+}
+
+// senderFromContext returns the attribution set by WithSender. Messages sent
+// without one are attributed to the agent dashboard.
+func senderFromContext(ctx context.Context) (string, *string) {
+	s, ok := ctx.Value(senderKey{}).(sender)
+	if !ok || s.source == "" {
+		return SentByAgent, nil
+	}
+	if s.userID == "" {
+		return s.source, nil
+	}
+	return s.source, &s.userID
+}
@@ -0,0 +1,135 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gowa-backend/services/ai"
+	"gowa-backend/services/insights"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// insightBatchSize is the number of customers analysed per tick
+const insightBatchSize = 100
+
+// InsightWorker analyses settled conversations in the background and fills
+// the AI fields of customer_insights
+type InsightWorker struct {
+	db       *sqlx.DB
+	insights *insights.Service
+	ticker   *time.Ticker
+	done     chan bool
+}
+
+// NewInsightWorker creates a new insight worker
+func NewInsightWorker(db *sqlx.DB) *InsightWorker {
+	aiService, err := ai.NewAIService()
+	if err != nil {
+		fmt.Printf("[Insights] Warning: AI service not available: %v\n", err)
+	}
+
+	return &InsightWorker{
+		db:       db,
+		insights: insights.NewService(db, aiService),
+		done:     make(chan bool),
+	}
+}
+
+// Start begins the worker (runs every 5 minutes)
+func (w *InsightWorker) Start() {
+	fmt.Println("[Insights] Starting insight worker...")
+	w.ticker = time.NewTicker(5 * time.Minute)
+
+	for {
+		select {
+		case <-w.ticker.C:
+			w.run()
+		case <-w.done:
+			fmt.Println("[Insights] Stopping insight worker...")
+			return
+		}
+	}
+}
+
+// Stop stops the worker
+func (w *InsightWorker) Stop() {
+	if w.ticker != nil {
+		w.ticker.Stop()
+	}
+	w.done <- true
+}
+
+// run analyses one batch of customers. Tenants that reach their budget or
+// turned insights off are skipped for the rest of the batch.
+func (w *InsightWorker) run() {
+	ctx := context.Background()
+
+	candidates, err := w.insights.Candidates(ctx, insightBatchSize)
+	if err != nil {
+		fmt.Printf("[Insights] Failed to load candidates: %v\n", err)
+		return
+	}
+
+	providers := map[string]*insights.Provider{}
+	skipped := map[string]bool{}
+	analysed := 0
+
+	for _, candidate := range candidates {
+		if skipped[candidate.TenantID] {
+			continue
+		}
+
+		provider, ok := providers[candidate.TenantID]
+		if !ok {
+			provider, err = w.provider(ctx, candidate.TenantID)
+			if err != nil {
+				fmt.Printf("[Insights] Failed to load AI config for tenant %s: %v\n", candidate.TenantID, err)
+				skipped[candidate.TenantID] = true
+				continue
+			}
+			providers[candidate.TenantID] = provider
+		}
+
+		_, err := w.insights.Enrich(ctx, candidate.TenantID, candidate.ID, *provider)
+		switch {
+		case err == nil:
+			analysed++
+		case errors.Is(err, insights.ErrBudgetExceeded), errors.Is(err, insights.ErrDisabled):
+			fmt.Printf("[Insights] Skipping tenant %s: %v\n", candidate.TenantID, err)
+			skipped[candidate.TenantID] = true
+		case errors.Is(err, insights.ErrNoMessages), errors.Is(err, insights.ErrOptedOut):
+		default:
+			fmt.Printf("[Insights] Failed to analyse customer %s: %v\n", candidate.ID, err)
+		}
+	}
+
+	if analysed > 0 {
+		fmt.Printf("[Insights] Analysed %d customer(s)\n", analysed)
+	}
+}
+
+// provider builds the tenant's insight provider from its AI config
+func (w *InsightWorker) provider(ctx context.Context, tenantID string) (*insights.Provider, error) {
+	config, err := loadAIConfig(ctx, w.db, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	var business []string
+	for _, part := range []string{config.BusinessName, config.BusinessType, config.BusinessDescription} {
+		if part != "" {
+			business = append(business, part)
+		}
+	}
+
+	return &insights.Provider{
+		Name:            config.AIProvider,
+		Model:           config.Model,
+		APIKey:          config.UserAPIKey,
+		BusinessContext: strings.Join(business, " - "),
+	}, nil
+}
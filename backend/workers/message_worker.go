@@ -7,12 +7,19 @@ import (
 	"database/sql"
 	"encoding/base64"
 	"fmt"
+	"log"
 	"os"
 	"strings"
 	"time"
 
 	"gowa-backend/services/ai"
+	"gowa-backend/services/broadcast"
+	"gowa-backend/services/conversation"
+	"gowa-backend/services/leadscore"
 	"gowa-backend/services/redis"
+	"gowa-backend/services/sequence"
+	"gowa-backend/services/tagrules"
+	"gowa-backend/services/whatsapp"
 
 	"github.com/jmoiron/sqlx"
 )
@@ -23,6 +30,12 @@ type MessageWorker struct {
 	db              *sqlx.DB
 	whatsappService WhatsAppService
 	aiService       *ai.AIService
+	conversations   *conversation.Service
+	leadScores      *leadscore.Service
+	tagRules        *tagrules.Service
+	sequences       *sequence.Service
+	broadcasts      *broadcast.Engine
+	logger          *log.Logger
 	stopChan        chan struct{}
 }
 
@@ -30,6 +43,8 @@ type MessageWorker struct {
 type WhatsAppService interface {
 	SendMessage(ctx context.Context, tenantID string, recipientJID string, message string) (string, error)
 	SendMediaMessage(ctx context.Context, tenantID string, recipientJID string, mediaData []byte, mediaType string, fileName string, caption string) (string, error)
+	UploadMedia(ctx context.Context, tenantID string, mediaData []byte, mediaType string, fileName string) (*whatsapp.UploadedMedia, error)
+	SendUploadedMedia(ctx context.Context, tenantID string, recipientJID string, media *whatsapp.UploadedMedia, caption string) (string, error)
 }
 
 // NewMessageWorker creates a new message worker
@@ -45,6 +60,12 @@ func NewMessageWorker(redisClient *redis.Client, db *sqlx.DB, whatsappService Wh
 		db:              db,
 		whatsappService: whatsappService,
 		aiService:       aiService,
+		conversations:   conversation.NewService(db),
+		leadScores:      leadscore.NewService(db),
+		tagRules:        tagrules.NewService(db),
+		sequences:       sequence.NewService(db),
+		broadcasts:      broadcast.NewEngine(db, redisClient, whatsappService),
+		logger:          log.New(os.Stdout, "[Worker] ", log.LstdFlags),
 		stopChan:        make(chan struct{}),
 	}
 }
@@ -73,6 +94,7 @@ func (w *MessageWorker) processAIMessages(ctx context.Context) {
 	workerCount := 3
 	for i := 0; i < workerCount; i++ {
 		go func(workerID int) {
+			failures := 0
 			for {
 				select {
 				case <-ctx.Done():
@@ -80,7 +102,19 @@ func (w *MessageWorker) processAIMessages(ctx context.Context) {
 				case <-w.stopChan:
 					return
 				default:
-					w.processAIMessage(ctx)
+				}
+
+				// Pop message from AI queue with 1 second timeout for faster processing
+				payload, err := w.redisClient.PopFromAIQueue(ctx, 1*time.Second)
+				if err != nil {
+					failures++
+					fmt.Printf("[Worker] Failed to read AI queue: %v\n", err)
+					w.backOff(ctx, failures)
+					continue
+				}
+				failures = 0
+				if payload != nil {
+					w.processAIMessage(ctx, payload)
 				}
 			}
 		}(i)
@@ -94,6 +128,7 @@ func (w *MessageWorker) processAIMessages(ctx context.Context) {
 func (w *MessageWorker) processBroadcastMessages(ctx context.Context) {
 	fmt.Println("[Worker] Broadcast message processor started")
 	
+	failures := 0
 	for {
 		select {
 		case <-ctx.Done():
@@ -101,8 +136,34 @@ func (w *MessageWorker) processBroadcastMessages(ctx context.Context) {
 		case <-w.stopChan:
 			return
 		default:
-			w.processBroadcastMessage(ctx)
 		}
+
+		// Pop message from broadcast queue with 5 second timeout
+		payload, err := w.redisClient.PopFromBroadcastQueue(ctx, 5*time.Second)
+		if err != nil {
+			failures++
+			fmt.Printf("[Worker] Failed to read broadcast queue: %v\n", err)
+			w.backOff(ctx, failures)
+			continue
+		}
+		failures = 0
+		if payload != nil {
+			w.processBroadcastMessage(ctx, payload)
+		}
+	}
+}
+
+// backOff waits before reading a queue again after consecutive failures,
+// doubling from 100ms up to 10s, so an unreachable Redis isn't hammered
+func (w *MessageWorker) backOff(ctx context.Context, failures int) {
+	delay := 10 * time.Second
+	if failures < 7 {
+		delay = 100 * time.Millisecond << uint(failures-1)
+	}
+	select {
+	case <-ctx.Done():
+	case <-w.stopChan:
+	case <-time.After(delay):
 	}
 }
 
@@ -128,6 +189,11 @@ type AIConfig struct {
 
 // getAIConfig loads AI configuration for a tenant
 func (w *MessageWorker) getAIConfig(ctx context.Context, tenantID string) (*AIConfig, error) {
+	return loadAIConfig(ctx, w.db, tenantID)
+}
+
+// loadAIConfig loads AI configuration for a tenant, shared by the workers
+func loadAIConfig(ctx context.Context, db *sqlx.DB, tenantID string) (*AIConfig, error) {
 	var config AIConfig
 	var encryptedAPIKey sql.NullString
 	
@@ -153,7 +219,7 @@ func (w *MessageWorker) getAIConfig(ctx context.Context, tenantID string) (*AICo
 		WHERE tenant_id = $1
 	`
 	
-	row := w.db.QueryRowContext(ctx, query, tenantID)
+	row := db.QueryRowContext(ctx, query, tenantID)
 	err := row.Scan(
 		&config.Enabled,
 		&config.AIProvider,
@@ -261,9 +327,9 @@ func (w *MessageWorker) buildBusinessContext(config *AIConfig) string {
 // getChatHistory retrieves recent chat messages for context
 func (w *MessageWorker) getChatHistory(ctx context.Context, tenantID, chatJID string) string {
 	query := `
-		SELECT message_text, is_from_me, timestamp
+		SELECT COALESCE(NULLIF(message_text, ''), caption) as message_text, is_from_me, timestamp
 		FROM whatsapp_messages
-		WHERE tenant_id = $1 AND chat_jid = $2 AND message_text IS NOT NULL AND message_text != ''
+		WHERE tenant_id = $1 AND chat_jid = $2 AND COALESCE(NULLIF(message_text, ''), caption, '') != ''
 		ORDER BY timestamp DESC
 		LIMIT 5
 	`
@@ -326,8 +392,9 @@ func (w *MessageWorker) logAIConversation(ctx context.Context, tenantID string,
 			tenant_id, customer_message, ai_response, detected_intent,
 			confidence_score, action_taken, escalation_reason,
 			response_time_ms, tokens_used, input_tokens, output_tokens,
-			cost_usd, model_used
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+			cost_usd, model_used, customer_jid, customer_id
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14,
+			(SELECT id FROM customer_insights WHERE tenant_id = $1 AND customer_jid = $14))
 	`
 	
 	_, err := w.db.ExecContext(ctx, query,
@@ -344,6 +411,7 @@ func (w *MessageWorker) logAIConversation(ctx context.Context, tenantID string,
 		response.OutputTokens,
 		response.CostUSD,
 		response.Model,
+		normalizeJID(senderJID),
 	)
 	
 	if err != nil {
@@ -377,33 +445,66 @@ func (w *MessageWorker) updateAIUsageStats(ctx context.Context, tenantID string,
 }
 
 // processAIMessage processes a single message from the AI queue
-func (w *MessageWorker) processAIMessage(ctx context.Context) {
-	// Pop message from AI queue with 1 second timeout for faster processing
-	payload, err := w.redisClient.PopFromAIQueue(ctx, 1*time.Second)
-	if err != nil {
-		// Timeout or error - just continue
-		return
-	}
+func (w *MessageWorker) processAIMessage(ctx context.Context, payload *redis.MessagePayload) {
+	fmt.Printf("[Worker] Processing AI message from tenant %s: %s\n", payload.TenantID, payload.MessageText)
+	if payload.Attempts > 1 {
+		fmt.Printf("[Worker] AI message %s is on delivery attempt %d\n", payload.MessageID, payload.Attempts)
+	}
+
+	// The message is acknowledged only once it was handled or deliberately
+	// dropped. Failures, panics included, leave it pending so it is claimed
+	// again after redis.ClaimIdle and dead-lettered after redis.MaxDeliveries;
+	// on its last delivery a failing message is dropped instead.
+	lastDelivery := payload.Attempts >= redis.MaxDeliveries
+	handled := false
+	detectedIntent := ""
+	defer func() {
+		if r := recover(); r != nil {
+			w.logger.Printf("Panic processing AI message %s: %v", payload.MessageID, r)
+			return
+		}
+		if !handled {
+			w.logger.Printf("AI message %s left pending for redelivery", payload.MessageID)
+			return
+		}
 
-	if payload == nil {
-		// No message available
+		// Route the conversation once the customer insight exists, using the
+		// detected intent when the AI got that far
+		w.routeConversation(ctx, payload, detectedIntent)
+		if err := w.redisClient.AckAIMessage(ctx, payload); err != nil {
+			w.logger.Printf("Failed to acknowledge AI message %s: %v", payload.MessageID, err)
+		}
+	}()
+
+	// A message handled before, e.g. one whose reply was sent just before a
+	// crash, is only acknowledged so the customer never gets a reply twice
+	if w.messageProcessed(ctx, payload) {
+		w.logger.Printf("AI message %s was already handled", payload.MessageID)
+		handled = true
 		return
 	}
 
-	fmt.Printf("[Worker] Processing AI message from tenant %s: %s\n", payload.TenantID, payload.MessageText)
+	// drop gives up on the message without an AI reply
+	drop := func() {
+		w.markMessageProcessed(ctx, payload, false)
+		w.updateCustomerInsight(ctx, payload, "")
+		handled = true
+	}
 
 	// Load AI config for tenant
 	config, err := w.getAIConfig(ctx, payload.TenantID)
 	if err != nil {
 		fmt.Printf("[Worker] Failed to load AI config: %v\n", err)
+		if lastDelivery {
+			drop()
+		}
 		return
 	}
 
 	// Check if AI auto-reply is enabled
 	if !config.Enabled {
 		fmt.Printf("[Worker] AI auto-reply disabled for tenant %s (enabled=false in config)\n", payload.TenantID)
-		w.markMessageProcessed(ctx, payload, false)
-		w.updateCustomerInsight(ctx, payload)
+		drop()
 		return
 	}
 
@@ -412,8 +513,7 @@ func (w *MessageWorker) processAIMessage(ctx context.Context) {
 	// Check if AI service is available
 	if w.aiService == nil {
 		fmt.Printf("[Worker] AI service not available - service is nil\n")
-		w.markMessageProcessed(ctx, payload, false)
-		w.updateCustomerInsight(ctx, payload)
+		drop()
 		return
 	}
 
@@ -439,8 +539,7 @@ func (w *MessageWorker) processAIMessage(ctx context.Context) {
 
 	if !hasAPIKey {
 		fmt.Printf("[Worker] No API key available for tenant %s. Please configure API key in AI settings.\n", payload.TenantID)
-		w.markMessageProcessed(ctx, payload, false)
-		w.updateCustomerInsight(ctx, payload)
+		drop()
 		return
 	}
 
@@ -515,13 +614,15 @@ Selalu gunakan bahasa yang santun dan profesional.`
 		fmt.Printf("[Worker] Failed to generate AI response for tenant %s: %v\n", payload.TenantID, err)
 		fmt.Printf("[Worker] Error details - Provider: %s, Model: %s, UseSystemKey: %v, HasUserKey: %v\n",
 			config.AIProvider, config.Model, config.UseSystemKey, config.UserAPIKey != "")
-		w.markMessageProcessed(ctx, payload, false)
-		w.updateCustomerInsight(ctx, payload)
+		if lastDelivery {
+			drop()
+		}
 		return
 	}
 
 	fmt.Printf("[Worker] AI Response: confidence=%.2f, intent=%s, escalate=%v\n",
 		response.Confidence, response.DetectedIntent, response.ShouldEscalate)
+	detectedIntent = response.DetectedIntent
 
 	// Determine action based on confidence and escalation rules
 	shouldEscalate := response.ShouldEscalate
@@ -532,7 +633,7 @@ Selalu gunakan bahasa yang santun dan profesional.`
 		shouldEscalate = true
 		response.EscalationReason = "Complaint detected"
 	}
-	if config.EscalateOrder && response.DetectedIntent == "order_intent" {
+	if config.EscalateOrder && response.DetectedIntent == ai.IntentOrder {
 		shouldEscalate = true
 		response.EscalationReason = "Order intent detected"
 	}
@@ -543,6 +644,7 @@ Selalu gunakan bahasa yang santun dan profesional.`
 		response.EscalationReason = fmt.Sprintf("Low confidence: %.0f%%", response.Confidence*100)
 	}
 
+	replied := false
 	if shouldEscalate {
 		action = "escalated"
 		fmt.Printf("[Worker] Message escalated: %s\n", response.EscalationReason)
@@ -550,13 +652,25 @@ Selalu gunakan bahasa yang santun dan profesional.`
 	} else {
 		// Send auto-reply via WhatsApp
 		if w.whatsappService != nil {
+			// Attribute the reply and its attachments to the AI in transcripts
+			ctx := whatsapp.WithSender(ctx, whatsapp.SentByAI, "")
+
 			// Send text response first
 			messageID, err := w.whatsappService.SendMessage(ctx, payload.TenantID, payload.SenderJID, response.Response)
 			if err != nil {
 				fmt.Printf("[Worker] Failed to send auto-reply: %v\n", err)
+				if !lastDelivery {
+					// The tokens were spent; the reply is generated again on redelivery
+					w.updateAIUsageStats(ctx, payload.TenantID, response.TokensUsed, response.CostUSD)
+					return
+				}
 				action = "failed"
 			} else {
 				fmt.Printf("[Worker] Auto-reply sent! MessageID: %s\n", messageID)
+				// Recorded before anything else can fail, so a redelivery
+				// doesn't send the reply again
+				w.markMessageProcessed(ctx, payload, true)
+				replied = true
 			}
 
 			// Send attachments if any
@@ -605,10 +719,27 @@ Selalu gunakan bahasa yang santun dan profesional.`
 	w.updateAIUsageStats(ctx, payload.TenantID, response.TokensUsed, response.CostUSD)
 
 	// Mark message as AI processed
-	w.markMessageProcessed(ctx, payload, true)
+	if !replied {
+		w.markMessageProcessed(ctx, payload, true)
+	}
 
 	// Update customer insight
-	w.updateCustomerInsight(ctx, payload)
+	w.updateCustomerInsight(ctx, payload, response.DetectedIntent)
+	handled = true
+}
+
+// messageProcessed reports whether the message was already handled: replied
+// to, escalated or dropped
+func (w *MessageWorker) messageProcessed(ctx context.Context, payload *redis.MessagePayload) bool {
+	var processed bool
+	err := w.db.GetContext(ctx, &processed, `
+		SELECT ai_processed_at IS NOT NULL FROM whatsapp_messages
+		WHERE tenant_id = $1 AND message_id = $2
+	`, payload.TenantID, payload.MessageID)
+	if err != nil && err != sql.ErrNoRows {
+		w.logger.Printf("Failed to check AI message %s: %v", payload.MessageID, err)
+	}
+	return processed
 }
 
 // markMessageProcessed marks a message as processed
@@ -626,59 +757,24 @@ func (w *MessageWorker) markMessageProcessed(ctx context.Context, payload *redis
 }
 
 // processBroadcastMessage processes a single broadcast message from the queue
-func (w *MessageWorker) processBroadcastMessage(ctx context.Context) {
-	// Pop message from broadcast queue with 5 second timeout
-	payload, err := w.redisClient.PopFromBroadcastQueue(ctx, 5*time.Second)
-	if err != nil {
-		// Timeout or error - just continue
-		return
-	}
-
-	if payload == nil {
-		// No message available
-		return
-	}
-
+func (w *MessageWorker) processBroadcastMessage(ctx context.Context, payload *redis.BroadcastMessagePayload) {
 	fmt.Printf("[Worker] Processing broadcast message to %s: %s\n", payload.CustomerJID, payload.Message)
 
-	// Send message via WhatsApp service
-	messageID, err := w.whatsappService.SendMessage(ctx, payload.TenantID, payload.CustomerJID, payload.Message)
-	
+	// The engine skips recipients that are no longer queued and records the
+	// outcome, so the message is acknowledged either way
+	messageID, err := w.broadcasts.Deliver(ctx, payload)
+	if ackErr := w.redisClient.AckBroadcastMessage(ctx, payload); ackErr != nil {
+		fmt.Printf("[Worker] Failed to acknowledge broadcast message to %s: %v\n", payload.CustomerJID, ackErr)
+	}
 	if err != nil {
-		fmt.Printf("[Worker] Error sending WhatsApp message: %v\n", err)
-		// Mark as failed
-		failQuery := `UPDATE broadcast_recipients SET status = 'failed', error_message = $1 WHERE id = $2`
-		w.db.ExecContext(ctx, failQuery, err.Error(), payload.RecipientID)
-		
-		// Update broadcast failed count
-		w.db.ExecContext(ctx, `UPDATE broadcasts SET failed_count = failed_count + 1, updated_at = NOW() WHERE id = $1`, payload.BroadcastID)
+		fmt.Printf("[Worker] Error sending broadcast message to %s: %v\n", payload.CustomerJID, err)
 		return
 	}
-
-	fmt.Printf("[Worker] WhatsApp message sent successfully! MessageID: %s\n", messageID)
-	
-	// Update recipient status to sent with message ID
-	updateQuery := `UPDATE broadcast_recipients SET status = 'sent', message_id = $1, sent_at = NOW() WHERE id = $2`
-	if _, err := w.db.ExecContext(ctx, updateQuery, messageID, payload.RecipientID); err != nil {
-		fmt.Printf("[Worker] Error updating recipient status: %v\n", err)
+	if messageID == "" {
+		fmt.Printf("[Worker] Skipping recipient %s: no longer queued for sending\n", payload.RecipientID)
 		return
 	}
 
-	// Update broadcast sent count
-	countQuery := `UPDATE broadcasts SET sent_count = sent_count + 1, updated_at = NOW() WHERE id = $1`
-	w.db.ExecContext(ctx, countQuery, payload.BroadcastID)
-
-	// Check if all recipients are processed
-	var pendingCount int
-	w.db.Get(&pendingCount, `SELECT COUNT(*) FROM broadcast_recipients WHERE broadcast_id = $1 AND status = 'queued'`, payload.BroadcastID)
-	
-	if pendingCount == 0 {
-		// All messages sent, mark broadcast as completed
-		completeQuery := `UPDATE broadcasts SET status = 'completed', completed_at = NOW(), updated_at = NOW() WHERE id = $1`
-		w.db.ExecContext(ctx, completeQuery, payload.BroadcastID)
-		fmt.Printf("[Worker] Broadcast %s completed\n", payload.BroadcastID)
-	}
-
 	fmt.Printf("[Worker] Broadcast message delivered to %s (MessageID: %s)\n", payload.CustomerJID, messageID)
 }
 
@@ -708,8 +804,11 @@ func extractPhoneFromJID(jid string) string {
 	return normalized
 }
 
-// updateCustomerInsight creates or updates customer insight record
-func (w *MessageWorker) updateCustomerInsight(ctx context.Context, payload *redis.MessagePayload) {
+// updateCustomerInsight creates or updates customer insight record, keeps the
+// last detected intent when one is given, then rescores the customer,
+// re-evaluates tag rules, enrolls them into triggered sequences and credits
+// the intent to the broadcast they replied to
+func (w *MessageWorker) updateCustomerInsight(ctx context.Context, payload *redis.MessagePayload, intent string) {
 	// Normalize the JID to ensure consistent customer identification
 	normalizedJID := normalizeJID(payload.SenderJID)
 	phone := extractPhoneFromJID(payload.SenderJID)
@@ -721,14 +820,17 @@ func (w *MessageWorker) updateCustomerInsight(ctx context.Context, payload *redi
 		INSERT INTO customer_insights (
 			tenant_id, customer_jid, customer_phone, 
 			message_count, last_message_at, first_message_at,
-			last_message_summary, created_at, updated_at
-		) VALUES ($1, $2, $3, 1, NOW(), NOW(), $4, NOW(), NOW())
+			last_message_summary, intent, created_at, updated_at
+		) VALUES ($1, $2, $3, 1, NOW(), NOW(), $4, NULLIF($5, ''), NOW(), NOW())
 		ON CONFLICT (tenant_id, customer_jid)
 		DO UPDATE SET
 			message_count = customer_insights.message_count + 1,
 			last_message_at = NOW(),
+			first_message_at = COALESCE(customer_insights.first_message_at, NOW()),
 			last_message_summary = EXCLUDED.last_message_summary,
+			intent = COALESCE(EXCLUDED.intent, customer_insights.intent),
 			updated_at = NOW()
+		RETURNING id, message_count
 	`
 
 	// Truncate message for summary
@@ -737,15 +839,50 @@ func (w *MessageWorker) updateCustomerInsight(ctx context.Context, payload *redi
 		summary = summary[:200] + "..."
 	}
 
-	_, err := w.db.ExecContext(ctx, query,
+	var customerID string
+	var messageCount int
+	err := w.db.QueryRowContext(ctx, query,
 		payload.TenantID,
 		normalizedJID,
 		phone,
 		summary,
-	)
+		intent,
+	).Scan(&customerID, &messageCount)
 
 	if err != nil {
 		fmt.Printf("Failed to update customer insight: %v\n", err)
+		return
+	}
+
+	// Rescore first so lead score tag rules see the new score
+	if _, err := w.leadScores.RecomputeCustomer(ctx, payload.TenantID, customerID, leadscore.ReasonMessage); err != nil {
+		fmt.Printf("[Worker] Failed to recompute lead score: %v\n", err)
+	}
+
+	if _, err := w.tagRules.ApplyCustomer(ctx, payload.TenantID, customerID); err != nil {
+		fmt.Printf("[Worker] Failed to apply tag rules: %v\n", err)
+	}
+
+	var triggers []string
+	if messageCount == 1 {
+		triggers = append(triggers, sequence.TriggerFirstMessage)
+	}
+	if intent == ai.IntentOrder {
+		triggers = append(triggers, sequence.TriggerOrderIntent)
+	}
+	if _, err := w.sequences.Trigger(ctx, payload.TenantID, customerID, triggers); err != nil {
+		fmt.Printf("[Worker] Failed to enroll customer into sequences: %v\n", err)
+	}
+
+	if err := broadcast.NewService(w.db).AttributeIntent(ctx, payload.TenantID, normalizedJID, intent); err != nil {
+		fmt.Printf("[Worker] Failed to attribute intent to broadcast: %v\n", err)
+	}
+}
+
+// routeConversation assigns an unassigned conversation using the tenant's routing rules
+func (w *MessageWorker) routeConversation(ctx context.Context, payload *redis.MessagePayload, intent string) {
+	if _, err := w.conversations.AutoAssign(ctx, payload.TenantID, normalizeJID(payload.SenderJID), intent); err != nil && err != sql.ErrNoRows {
+		fmt.Printf("[Worker] Failed to route conversation: %v\n", err)
 	}
 }
 